@@ -4,28 +4,62 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/hoangsonww/backupagent/config"
 	"github.com/hoangsonww/backupagent/internal/agent"
+	"github.com/hoangsonww/backupagent/internal/bundle"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/progress"
+	"github.com/hoangsonww/backupagent/internal/render"
+	"github.com/hoangsonww/backupagent/internal/snapshots"
 	"github.com/hoangsonww/backupagent/internal/versioning"
 )
 
 var (
 	cfgFile    string
 	passphrase string
+
+	chown     string
+	noOwner   bool
+	mapUsers  []string
+	mapGroups []string
+
+	out = &render.Printer{Format: render.Table}
 )
 
 func main() {
+	bundle.Main()
+	if err := newRoot().ExecuteContext(context.Background()); err != nil {
+		out.Fail("Error:", err)
+		os.Exit(render.ExitError)
+	}
+}
+
+// newRoot returns the restore-agent command and its subcommands
+func newRoot() *cobra.Command {
 	root := &cobra.Command{
 		Use:   "restore-agent",
 		Short: "Restore a snapshot from repository",
+		// Structured results own stdout; logs go to stderr with the notes
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if out.Structured() {
+				monitoring.GetLogger().SetOutput(os.Stderr)
+			}
+		},
 	}
 	root.PersistentFlags().StringVarP(&cfgFile, "config", "c", "config.yaml", "Path to config file")
 	root.PersistentFlags().StringVarP(&passphrase, "pass", "p", "", "Passphrase for decryption (required)")
+	root.PersistentFlags().Var(&out.Format, "output", "Print results as table, json or yaml")
 
+	var fromPeer string
+	var trustSigners []string
+	var prewarm bool
+	var limitRate string
+	var ioNice bool
 	restoreCmd := &cobra.Command{
 		Use:   "restore [snapshot-id] [target-dir]",
 		Short: "Restore snapshot to target directory",
@@ -36,6 +70,84 @@ func main() {
 			}
 			snapshotID := args[0]
 			target := args[1]
+			rate, err := agent.ParseRate(limitRate)
+			if err != nil {
+				return err
+			}
+			owners, err := ownerMapping()
+			if err != nil {
+				return err
+			}
+			cfg, err := config.Load(cfgFile)
+			if err != nil {
+				return err
+			}
+			if prewarm {
+				cfg.Storage.RestorePrewarm = true
+			}
+			ag, err := agent.New(cfg, passphrase)
+			if err != nil {
+				return err
+			}
+			var snap *versioning.Snapshot
+			if fromPeer != "" {
+				snap, err = ag.PullSnapshot(cmd.Context(), snapshotID, fromPeer, trustSigners, func(got, missing int, bytes int64) {
+					out.Printf("\rFetched %d/%d chunks (%.1f MiB)", got, missing, float64(bytes)/(1<<20))
+				})
+				if err != nil {
+					out.Println()
+					return err
+				}
+				out.Println()
+			} else {
+				snap, err = versioning.LoadSnapshot(ag.DB, snapshotID)
+				if err != nil {
+					return err
+				}
+			}
+			var th *agent.Throttle
+			if rate > 0 || ioNice {
+				th = agent.NewThrottle(agent.ThrottleSettings{LimitRate: rate, IONice: ioNice})
+			}
+			scan := ag.RestoreScanner()
+			ctx, stop := watchProgress(cmd.Context())
+			output, err := ag.RestoreSnapshot(ctx, snap, target, th, owners, scan)
+			stop()
+			if err != nil {
+				return err
+			}
+			res := restoreResult{SnapshotID: snap.ID, Target: output, Owners: owners.Report(), Scan: scan.Report()}
+			return exitQuarantined(scan, out.Result(res, func() {
+				fmt.Printf("Restored snapshot %s to %s\n", snapshotID, output)
+				printOwners(owners)
+				printScan(scan)
+			}))
+		},
+	}
+
+	restoreCmd.Flags().StringVar(&fromPeer, "from-peer", "", "fetch the snapshot and missing chunks from this peer ID or multiaddr")
+	restoreCmd.Flags().StringSliceVar(&trustSigners, "trust-signer", nil, "also accept snapshots signed by this base64 key (repeatable)")
+	restoreCmd.Flags().BoolVar(&prewarm, "prewarm", false, "load the snapshot's chunks into the page cache before restoring")
+	restoreCmd.Flags().StringVar(&limitRate, "limit-rate", "0", "restore at most this many bytes per second, e.g. 20M (0 is unlimited)")
+	restoreCmd.Flags().BoolVar(&ioNice, "io-nice", false, "restore with idle I/O priority and a lowered CPU priority (Linux)")
+	addOwnerFlags(restoreCmd)
+
+	restoreFileCmd := &cobra.Command{
+		Use:   "file [snapshot-id] [path-in-snapshot] [target]",
+		Short: "Restore one file of a snapshot to a file or into a directory",
+		Args:  cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if passphrase == "" {
+				return fmt.Errorf("passphrase is required")
+			}
+			rate, err := agent.ParseRate(limitRate)
+			if err != nil {
+				return err
+			}
+			owners, err := ownerMapping()
+			if err != nil {
+				return err
+			}
 			cfg, err := config.Load(cfgFile)
 			if err != nil {
 				return err
@@ -44,37 +156,374 @@ func main() {
 			if err != nil {
 				return err
 			}
-			snap, err := versioning.LoadSnapshot(ag.DB, snapshotID)
+			snap, err := versioning.LoadSnapshot(ag.DB, args[0])
 			if err != nil {
 				return err
 			}
+			var th *agent.Throttle
+			if rate > 0 || ioNice {
+				th = agent.NewThrottle(agent.ThrottleSettings{LimitRate: rate, IONice: ioNice})
+			}
+			scan := ag.RestoreScanner()
+			ctx, stop := watchProgress(cmd.Context())
+			output, err := ag.RestoreFile(ctx, snap, args[1], args[2], th, owners, scan)
+			stop()
+			if err != nil {
+				return err
+			}
+			res := restoreResult{SnapshotID: snap.ID, Path: args[1], Target: output, Owners: owners.Report(), Scan: scan.Report()}
+			return exitQuarantined(scan, out.Result(res, func() {
+				fmt.Printf("Restored %s of snapshot %s to %s\n", args[1], snap.ID, output)
+				printOwners(owners)
+				printScan(scan)
+			}))
+		},
+	}
+	restoreFileCmd.Flags().StringVar(&limitRate, "limit-rate", "0", "restore at most this many bytes per second, e.g. 20M (0 is unlimited)")
+	restoreFileCmd.Flags().BoolVar(&ioNice, "io-nice", false, "restore with idle I/O priority and a lowered CPU priority (Linux)")
+	addOwnerFlags(restoreFileCmd)
+	restoreCmd.AddCommand(restoreFileCmd)
 
-			if err := os.MkdirAll(target, 0755); err != nil {
+	var host, at, hostTarget string
+	var sources []string
+	var dryRun bool
+	restoreHostCmd := &cobra.Command{
+		Use:   "restore-host",
+		Short: "Restore the newest snapshot of every source of a host in one job",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if passphrase == "" {
+				return fmt.Errorf("passphrase is required")
+			}
+			when, err := parseAt(at)
+			if err != nil {
+				return err
+			}
+			rate, err := agent.ParseRate(limitRate)
+			if err != nil {
+				return err
+			}
+			owners, err := ownerMapping()
+			if err != nil {
 				return err
 			}
-			output := filepath.Join(target, fmt.Sprintf("restored_%s.bin", snapshotID))
-			f, err := os.Create(output)
+			cfg, err := config.Load(cfgFile)
 			if err != nil {
 				return err
 			}
-			defer f.Close()
-			for _, h := range snap.Chunks {
-				data, err := ag.Store.GetChunk(h)
+			if prewarm {
+				cfg.Storage.RestorePrewarm = true
+			}
+			ag, err := agent.New(cfg, passphrase)
+			if err != nil {
+				return err
+			}
+			plan, err := ag.PlanHostRestore(host, when, sources, hostTarget)
+			if err != nil {
+				return err
+			}
+			res := newHostResult(plan)
+			printPlan := func() {
+				fmt.Printf("Recovery plan for %s as of %s:\n", plan.Host, plan.At.Local().Format(time.RFC1123))
+				for _, e := range plan.Entries {
+					fmt.Printf("  %s  %s  %6d chunks  %s -> %s\n", e.Snapshot.ID,
+						e.Snapshot.Timestamp.Time().Local().Format(time.RFC1123), len(e.Snapshot.Chunks), e.Source, e.Target)
+				}
+			}
+			if dryRun {
+				return out.Result(res, printPlan)
+			}
+			if !out.Structured() {
+				printPlan()
+			}
+
+			if fromPeer != "" {
+				for _, e := range plan.Entries {
+					_, err := ag.PullSnapshot(cmd.Context(), e.Snapshot.ID, fromPeer, trustSigners, func(got, missing int, bytes int64) {
+						out.Printf("\rFetching %s: %d/%d chunks (%.1f MiB)", e.Source, got, missing, float64(bytes)/(1<<20))
+					})
+					if err != nil {
+						out.Println()
+						return err
+					}
+				}
+				out.Println()
+			}
+
+			var th *agent.Throttle
+			if rate > 0 || ioNice {
+				th = agent.NewThrottle(agent.ThrottleSettings{LimitRate: rate, IONice: ioNice})
+			}
+			scan := ag.RestoreScanner()
+			outputs, err := ag.RestoreHost(cmd.Context(), plan, th, owners, scan, func(p agent.HostProgress) {
+				out.Printf("\rRestoring %d/%d %s: %d/%d chunks (%.1f MiB)",
+					p.Entry, p.Entries, p.Source, p.Chunks, p.TotalChunks, float64(p.Bytes)/(1<<20))
+			})
+			out.Println()
+			if err != nil {
+				err = fmt.Errorf("restored %d of %d sources: %w", len(outputs), len(plan.Entries), err)
+			}
+			if out.Structured() {
+				res.Restored = append([]string{}, outputs...)
+				report := owners.Report()
+				res.Owners = &report
+				res.Scan = scan.Report()
 				if err != nil {
-					return fmt.Errorf("failed to get chunk %s: %w", h, err)
+					// The result printed reports the failure
+					res.Error = err.Error()
+					out.Result(res, nil)
+					os.Exit(render.ExitError)
 				}
-				if _, err := f.Write(data); err != nil {
-					return err
+				return exitQuarantined(scan, out.Result(res, nil))
+			}
+			for _, output := range outputs {
+				fmt.Printf("Restored %s\n", output)
+			}
+			printOwners(owners)
+			printScan(scan)
+			if err != nil {
+				return err
+			}
+			return exitQuarantined(scan, nil)
+		},
+	}
+	hostname, _ := os.Hostname()
+	restoreHostCmd.Flags().StringVar(&host, "host", hostname, "host whose snapshots to restore")
+	restoreHostCmd.Flags().StringVar(&at, "at", "", "restore the state as of this RFC 3339 time, or the start of a local date such as 2026-10-01 (default: now)")
+	restoreHostCmd.Flags().StringSliceVar(&sources, "source", nil, "restore only this source path (repeatable)")
+	restoreHostCmd.Flags().StringVar(&hostTarget, "target", "", "restore below this directory, mirroring the original paths (default: the original paths)")
+	restoreHostCmd.Flags().BoolVar(&dryRun, "dry-run", false, "print the recovery plan without restoring")
+	restoreHostCmd.Flags().StringVar(&fromPeer, "from-peer", "", "fetch missing chunks from this peer ID or multiaddr")
+	restoreHostCmd.Flags().StringSliceVar(&trustSigners, "trust-signer", nil, "also accept snapshots signed by this base64 key (repeatable)")
+	restoreHostCmd.Flags().BoolVar(&prewarm, "prewarm", false, "load each snapshot's chunks into the page cache before restoring")
+	restoreHostCmd.Flags().StringVar(&limitRate, "limit-rate", "0", "restore at most this many bytes per second, e.g. 20M (0 is unlimited)")
+	restoreHostCmd.Flags().BoolVar(&ioNice, "io-nice", false, "restore with idle I/O priority and a lowered CPU priority (Linux)")
+	addOwnerFlags(restoreHostCmd)
+
+	historyCmd := &cobra.Command{
+		Use:   "history [snapshot-id] [path-in-snapshot]",
+		Short: "Show the versions of a file along a snapshot's parent chain",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if passphrase == "" {
+				return fmt.Errorf("passphrase is required")
+			}
+			cfg, err := config.Load(cfgFile)
+			if err != nil {
+				return err
+			}
+			ag, err := agent.New(cfg, passphrase)
+			if err != nil {
+				return err
+			}
+			snap, err := versioning.LoadSnapshot(ag.DB, args[0])
+			if err != nil {
+				return err
+			}
+			versions, err := ag.FileHistory(snap, args[1])
+			if err != nil {
+				return err
+			}
+			type version struct {
+				SnapshotID string     `json:"snapshot_id"`
+				Timestamp  time.Time  `json:"timestamp"`
+				State      string     `json:"state"` // absent, unchanged or read
+				Size       int64      `json:"size,omitempty"`
+				ModTime    *time.Time `json:"mtime,omitempty"`
+				From       string     `json:"from,omitempty"` // snapshot the unchanged file was read in
+			}
+			res := make([]version, 0, len(versions))
+			for _, v := range versions {
+				r := version{SnapshotID: v.Snapshot.ID, Timestamp: v.Snapshot.Timestamp.Time(), State: "absent"}
+				if e := v.Entry; e != nil {
+					r.State, r.Size, r.ModTime, r.From = "read", e.Size, &e.ModTime, e.From
+					if e.From != "" {
+						r.State = "unchanged"
+					}
 				}
+				res = append(res, r)
+			}
+			return out.Result(res, func() {
+				for _, v := range res {
+					at := v.Timestamp.Local().Format(time.RFC1123)
+					switch v.State {
+					case "absent":
+						fmt.Printf("  %s  %s  absent\n", v.SnapshotID, at)
+					case "unchanged":
+						fmt.Printf("  %s  %s  %10d bytes  unchanged since %s\n", v.SnapshotID, at, v.Size, v.From)
+					default:
+						fmt.Printf("  %s  %s  %10d bytes  read, modified %s\n", v.SnapshotID, at, v.Size, v.ModTime.Local().Format(time.RFC1123))
+					}
+				}
+			})
+		},
+	}
+
+	var archiveFormat, archiveOut string
+	var archivePaths []string
+	exportArchiveCmd := &cobra.Command{
+		Use:   "export-archive <snapshot-id>",
+		Short: "Write a snapshot as a tar or zip archive, to a file or stdout",
+		Long: `Streams the files of a snapshot as a standard archive, under a top directory
+named after the snapshot's source, keeping modes, owners and modification
+times. Without --out, or with --out -, the archive goes to stdout and logs and
+the summary to stderr.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if passphrase == "" {
+				return fmt.Errorf("passphrase is required")
+			}
+			toStdout := agent.StreamsArchive(archiveOut)
+			if toStdout {
+				if out.Structured() {
+					return fmt.Errorf("the archive goes to stdout; pass --out to print a %s result", out.Format.String())
+				}
+				// Nothing but the archive may reach stdout
+				monitoring.GetLogger().SetOutput(os.Stderr)
+			}
+			cfg, err := config.Load(cfgFile)
+			if err != nil {
+				return err
+			}
+			ag, err := agent.New(cfg, passphrase)
+			if err != nil {
+				return err
 			}
-			fmt.Printf("Restored snapshot %s to %s\n", snapshotID, output)
-			return nil
+			defer ag.Close()
+			res, err := ag.ExportArchiveTo(cmd.Context(), args[0], archiveOut, archiveFormat, archivePaths)
+			if err != nil {
+				return err
+			}
+			if toStdout {
+				fmt.Fprintln(os.Stderr, res)
+				return nil
+			}
+			return out.Result(res, func() { out.Println(res) })
 		},
 	}
+	exportArchiveCmd.Flags().StringVar(&archiveFormat, "format", "", "archive format: "+strings.Join(snapshots.ArchiveFormats, ", ")+" (default: from --out, else tar)")
+	exportArchiveCmd.Flags().StringVarP(&archiveOut, "out", "o", "", "write the archive to this file instead of stdout")
+	exportArchiveCmd.Flags().StringArrayVar(&archivePaths, "path", nil, "export only this file or directory, relative to the source (repeatable)")
+
+	root.AddCommand(restoreCmd, restoreHostCmd, historyCmd, exportArchiveCmd)
+	return root
+}
+
+// restoreResult is the result of restore and restore file
+type restoreResult struct {
+	SnapshotID string                `json:"snapshot_id"`
+	Path       string                `json:"path,omitempty"` // of a restored file, in the snapshot
+	Target     string                `json:"target"`
+	Owners     snapshots.OwnerReport `json:"owners"`
+	Scan       *snapshots.ScanReport `json:"scan,omitempty"` // with restore.scan_command set
+}
+
+// hostResult is the recovery plan of restore-host and, unless it was a dry
+// run, what was restored
+type hostResult struct {
+	Host     string                 `json:"host"`
+	At       time.Time              `json:"at"`
+	Entries  []hostEntry            `json:"entries"`
+	Restored []string               `json:"restored,omitempty"` // targets, in plan order
+	Owners   *snapshots.OwnerReport `json:"owners,omitempty"`
+	Scan     *snapshots.ScanReport  `json:"scan,omitempty"`  // with restore.scan_command set
+	Error    string                 `json:"error,omitempty"` // of a restore that stopped early
+}
+
+type hostEntry struct {
+	Source     string    `json:"source"`
+	SnapshotID string    `json:"snapshot_id"`
+	Timestamp  time.Time `json:"timestamp"`
+	Chunks     int       `json:"chunks"`
+	Target     string    `json:"target"`
+}
+
+func newHostResult(plan *agent.HostPlan) *hostResult {
+	res := &hostResult{Host: plan.Host, At: plan.At, Entries: []hostEntry{}}
+	for _, e := range plan.Entries {
+		res.Entries = append(res.Entries, hostEntry{e.Source, e.Snapshot.ID, e.Snapshot.Timestamp.Time(), len(e.Snapshot.Chunks), e.Target})
+	}
+	return res
+}
+
+// parseAt reads --at: an RFC 3339 time, or a date meaning its local midnight
+func parseAt(s string) (time.Time, error) {
+	if s == "" {
+		return time.Now(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --at %q: want an RFC 3339 time or a YYYY-MM-DD date", s)
+	}
+	return t, nil
+}
 
-	root.AddCommand(restoreCmd)
-	if err := root.ExecuteContext(context.Background()); err != nil {
-		fmt.Println("Error:", err)
-		os.Exit(1)
+// watchProgress returns ctx carrying a progress tracker, whose report is
+// redrawn on one line every second until stop is called
+func watchProgress(ctx context.Context) (context.Context, func()) {
+	t := progress.New()
+	stop := t.Watch(time.Second, func(r *progress.Report) {
+		out.Printf("\r\033[K%s", r)
+	})
+	return progress.With(ctx, t), func() {
+		stop()
+		out.Printf("\r\033[K")
+	}
+}
+
+func addOwnerFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&chown, "chown", "", "current-user leaves every restored file to the restoring user")
+	cmd.Flags().BoolVar(&noOwner, "no-owner", false, "leave every restored file to the restoring user, for unprivileged restores (same as --chown current-user)")
+	cmd.Flags().StringSliceVar(&mapUsers, "map-user", nil, "give files of a stored user, by name or ID, to a local one: old:new (repeatable)")
+	cmd.Flags().StringSliceVar(&mapGroups, "map-group", nil, "give files of a stored group, by name or ID, to a local one: old:new (repeatable)")
+}
+
+// ownerMapping builds the owner mapping of --chown, --no-owner, --map-user
+// and --map-group
+func ownerMapping() (*snapshots.Owners, error) {
+	if chown != "" && chown != "current-user" {
+		return nil, fmt.Errorf("invalid --chown %q: only current-user is supported", chown)
+	}
+	return snapshots.NewOwners(noOwner || chown == "current-user", mapUsers, mapGroups)
+}
+
+// printScan reports what restore.scan_command scanned and quarantined
+func printScan(scan *snapshots.Scanner) {
+	r := scan.Report()
+	if r == nil {
+		return
+	}
+	fmt.Printf("Scanned %d files\n", r.Scanned)
+	for _, q := range r.Quarantined {
+		fmt.Printf("Quarantined %s as %s\n", q.Path, q.Quarantine)
+		if q.Output != "" {
+			fmt.Printf("  %s\n", strings.ReplaceAll(q.Output, "\n", "\n  "))
+		}
+	}
+}
+
+// exitQuarantined exits with render.ExitPartial once the result is printed
+// without error if scan quarantined files, and otherwise returns err
+func exitQuarantined(scan *snapshots.Scanner, err error) error {
+	if err == nil && scan.Err() != nil {
+		os.Exit(render.ExitPartial)
+	}
+	return err
+}
+
+// printOwners reports how the owners of restored files were mapped
+func printOwners(owners *snapshots.Owners) {
+	r := owners.Report()
+	if r.Mapped > 0 {
+		fmt.Printf("Set the owner of %d entries\n", r.Mapped)
+	}
+	for _, owner := range r.UnmappedOwners() {
+		fmt.Printf("Unmapped %s: %d entries left to the restoring user\n", owner, r.Unmapped[owner])
+	}
+	if r.Denied > 0 {
+		fmt.Printf("Not permitted to set the owner of %d entries: restore as root, or pass --no-owner\n", r.Denied)
 	}
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/hoangsonww/backupagent/internal/agent"
+	"github.com/hoangsonww/backupagent/internal/gc"
+	"github.com/hoangsonww/backupagent/internal/tui"
+)
+
+// importCmd builds the commands converting other tools' repositories
+func importCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Import the snapshots of another backup tool's repository",
+	}
+
+	var opts agent.ImportOptions
+	var passwordFile string
+	resticCmd := &cobra.Command{
+		Use:   "restic [repository]",
+		Short: "Import the snapshots of a local restic repository",
+		Long: `Reads every snapshot of the restic repository in the given directory, oldest
+first, and stores it as a snapshot of this repository with its original time,
+host, paths and tags. The password is read from --password-file,
+RESTIC_PASSWORD_FILE or RESTIC_PASSWORD, or asked for. Snapshots imported
+before are skipped, so an interrupted import can be run again.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir := strings.TrimPrefix(args[0], "local:")
+			if i := strings.Index(dir, ":"); i > 1 && !strings.ContainsAny(dir[:i], `/\`) {
+				return fmt.Errorf("only restic repositories in a local directory can be imported; copy %s to disk first, e.g. with rclone", args[0])
+			}
+			password, err := resticPassword(passwordFile)
+			if err != nil {
+				return err
+			}
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			report, err := ag.ImportRestic(cmd.Context(), dir, password, opts, func(s *agent.ImportedSnapshot) {
+				if s.Existing {
+					out.Printf("%s: imported before as %s\n", shortID(s.ResticID), s.SnapshotID)
+					return
+				}
+				out.Printf("%s: %s of %s, %d files (%.1f MiB) as %s\n", shortID(s.ResticID), s.Time.Local().Format("2006-01-02 15:04"), s.Source, s.Files, float64(s.Bytes)/(1<<20), s.SnapshotID)
+			})
+			if err != nil {
+				if report != nil && len(report.Snapshots) > 0 {
+					out.Printf("Stopped after %d snapshot(s); run the import again to continue\n", len(report.Snapshots))
+				}
+				return err
+			}
+			warnExpiring(ag, report)
+			return out.Result(report, func() { printImport(report) })
+		},
+	}
+	resticCmd.Flags().StringVar(&passwordFile, "password-file", os.Getenv("RESTIC_PASSWORD_FILE"), "read the restic password from this file")
+	resticCmd.Flags().StringArrayVar(&opts.Snapshots, "snapshot", nil, "import only this restic snapshot ID or prefix (repeatable)")
+	resticCmd.Flags().StringVar(&opts.Host, "host", "", "import only snapshots taken on this host")
+	resticCmd.Flags().StringArrayVar(&opts.Tags, "tag", nil, "add this tag to every imported snapshot (repeatable)")
+	cmd.AddCommand(resticCmd)
+	return cmd
+}
+
+// resticPassword reads the password of the repository to import the way
+// restic does
+func resticPassword(file string) (string, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	if p := os.Getenv("RESTIC_PASSWORD"); p != "" {
+		return p, nil
+	}
+	restore, hidden, err := tui.HideInput(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+	out.Printf("restic repository password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	restore()
+	if hidden {
+		out.Println()
+	}
+	if err != nil && line == "" {
+		return "", fmt.Errorf("no restic password given")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// warnExpiring notes imported snapshots the retention policy would delete at
+// the next garbage collection
+func warnExpiring(ag *agent.Agent, report *agent.ImportReport) {
+	imported := make(map[string]bool)
+	for _, s := range report.Snapshots {
+		imported[s.SnapshotID] = true
+	}
+	st := ag.Config.Storage
+	plan, err := gc.NewCollector(ag.DB, ag.Store, st.RetentionDays, st.Retention, st.GCInterval, st.GCGrace).Plan(time.Now())
+	if err != nil {
+		return
+	}
+	n := 0
+	for _, d := range plan {
+		if imported[d.SnapshotID] && !d.Keep {
+			n++
+		}
+	}
+	if n > 0 {
+		out.Printf("Note: the next garbage collection deletes %d imported snapshot(s) under the retention policy; see prune --dry-run and storage.retention\n", n)
+	}
+}
+
+// printImport lists the imported snapshots
+func printImport(r *agent.ImportReport) {
+	added := 0
+	for _, s := range r.Snapshots {
+		if s.Existing {
+			continue
+		}
+		added++
+		if s.Skipped > 0 {
+			fmt.Printf("%s: %d symlinks, devices and other special files left out\n", s.SnapshotID, s.Skipped)
+		}
+		if len(s.DroppedTags) > 0 {
+			fmt.Printf("%s: tags %s left out; tags are letters, digits and -_.:/\n", s.SnapshotID, strings.Join(s.DroppedTags, ", "))
+		}
+	}
+	fmt.Printf("Imported %d snapshot(s) from restic repository %s, %d already imported\n", added, r.Repository, len(r.Snapshots)-added)
+}
+
+// shortID abbreviates a restic ID as restic prints it
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
@@ -2,71 +2,1527 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/hoangsonww/backupagent/config"
 	"github.com/hoangsonww/backupagent/internal/agent"
+	"github.com/hoangsonww/backupagent/internal/api"
+	"github.com/hoangsonww/backupagent/internal/auth"
+	"github.com/hoangsonww/backupagent/internal/bundle"
+	"github.com/hoangsonww/backupagent/internal/chunkindex"
+	"github.com/hoangsonww/backupagent/internal/compression"
+	"github.com/hoangsonww/backupagent/internal/gc"
+	"github.com/hoangsonww/backupagent/internal/metabackup"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/privacy"
+	"github.com/hoangsonww/backupagent/internal/progress"
+	"github.com/hoangsonww/backupagent/internal/render"
+	"github.com/hoangsonww/backupagent/internal/security"
+	"github.com/hoangsonww/backupagent/internal/service"
+	"github.com/hoangsonww/backupagent/internal/snapshots"
+	"github.com/hoangsonww/backupagent/internal/sneakernet"
+	"github.com/hoangsonww/backupagent/internal/storage"
+	"github.com/hoangsonww/backupagent/internal/verification"
+	"github.com/hoangsonww/backupagent/internal/versioning"
 )
 
 var (
-	cfgFile    string
-	passphrase string
+	cfgFile       string
+	passphrase    string
+	privacyReport bool
+	excludes      []string // --exclude, added to snapshot.excludes
+	noDefaults    bool     // --no-default-excludes, sets snapshot.no_default_excludes
+	snapshotTags  []string
+
+	out = &render.Printer{Format: render.Table}
 )
 
 func main() {
+	bundle.Main()
+	if err := newRoot().Execute(); err != nil {
+		out.Fail("Error:", err)
+		os.Exit(render.ExitError)
+	}
+}
+
+// newRoot returns the backup-agent command and its subcommands
+func newRoot() *cobra.Command {
 	root := &cobra.Command{
 		Use:   "backup-agent",
 		Short: "Decentralized Encrypted Backup Agent",
+		// Structured results own stdout; logs go to stderr with the notes
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if out.Structured() {
+				monitoring.GetLogger().SetOutput(os.Stderr)
+			}
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !privacyReport {
+				return cmd.Help()
+			}
+			cfg, err := config.Load(cfgFile)
+			if err != nil {
+				return err
+			}
+			report := privacy.Generate(cfg)
+			return out.Result(report, func() { report.WriteText(os.Stdout) })
+		},
 	}
+	root.Flags().BoolVar(&privacyReport, "privacy-report", false, "Report what metadata this configuration leaks to peers and the DHT")
 
 	root.PersistentFlags().StringVarP(&cfgFile, "config", "c", "config.yaml", "Path to config file")
 	root.PersistentFlags().StringVarP(&passphrase, "pass", "p", "", "Passphrase for encryption (required)")
+	root.PersistentFlags().Var(&out.Format, "output", "Print results as table, json or yaml")
 
+	var importFrom []string
+	var passFile string
 	initCmd := &cobra.Command{
 		Use:   "daemon",
 		Short: "Start the backup agent daemon",
+		Long: `Runs the agent until interrupted. Started by the Windows service control
+manager or launchd, as set up by service install, it stops when they ask and,
+on Windows, logs to the event log.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if passFile != "" {
+				p, err := readPassFile(passFile)
+				if err != nil {
+					return err
+				}
+				passphrase = p
+			}
 			if passphrase == "" {
 				return fmt.Errorf("passphrase is required")
 			}
-			cfg, err := config.Load(cfgFile)
-			if err != nil {
-				return err
+			if service.Managed() && filepath.IsAbs(cfgFile) {
+				// Service managers start us in / or System32; resolve the
+				// config's relative paths against its own directory
+				if err := os.Chdir(filepath.Dir(cfgFile)); err != nil {
+					return err
+				}
 			}
-			ag, err := agent.New(cfg, passphrase)
+			cfg, err := config.Load(cfgFile)
 			if err != nil {
 				return err
 			}
-			return ag.RunDaemon(context.Background())
+			return service.Run(func(ctx context.Context) error {
+				ag, err := agent.New(cfg, passphrase)
+				if err != nil {
+					return err
+				}
+				defer ag.Close()
+				out.Printf("Repository: %s\n", ag.RepoID)
+				for _, id := range importFrom {
+					ag.AllowImport(id)
+					out.Printf("Importing snapshots and chunks from repository %s\n", id)
+				}
+				if cfg.API.Enable {
+					listeners, err := service.Listeners()
+					if err != nil {
+						return err
+					}
+					collector := gc.NewCollector(ag.DB, ag.Store, cfg.Storage.RetentionDays, cfg.Storage.Retention, cfg.Storage.GCInterval, cfg.Storage.GCGrace)
+					srv := api.NewServer(ag, collector, cfg.API.Port)
+					serve := func(start func() error) {
+						if err := start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+							monitoring.GetLogger().WithError(err).Error("API server failed")
+						}
+					}
+					if len(listeners) == 0 {
+						go serve(srv.Start)
+					}
+					for _, l := range listeners {
+						l := l
+						go serve(func() error { return srv.Serve(l) })
+					}
+					defer srv.Stop(context.Background())
+				}
+				return ag.RunDaemon(ctx)
+			})
 		},
 	}
+	initCmd.Flags().StringSliceVar(&importFrom, "import-from", nil, "accept snapshots and chunks from this foreign repository ID (repeatable)")
+	initCmd.Flags().StringVar(&passFile, "pass-file", "", "read the passphrase from this file instead of --pass")
 
+	var dryRun, fromStdin bool
+	var stdinName, group string
 	snapCmd := &cobra.Command{
-		Use:   "snapshot [path]",
+		Use:   "snapshot [path...]",
 		Short: "Take snapshot of a directory",
-		Args:  cobra.ExactArgs(1),
+		Long: `Take a snapshot of a directory or file.
+
+Several paths are captured together into one snapshot, each under its own
+section named after the path, and form one history:
+
+  backup-agent snapshot /etc /var/www
+
+--group without paths backs up the paths of that group of
+scheduler.source_groups; with paths, it names the history they form.
+
+With --stdin, what is piped in is backed up as a single file, without a
+temporary copy on disk:
+
+  pg_dump mydb | backup-agent snapshot --stdin --stdin-filename mydb.sql`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if fromStdin {
+				return cobra.NoArgs(cmd, args)
+			}
+			if group != "" {
+				return nil
+			}
+			return cobra.MinimumNArgs(1)(cmd, args)
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if passphrase == "" {
 				return fmt.Errorf("passphrase is required")
 			}
+			if fromStdin && (dryRun || group != "") {
+				return fmt.Errorf("--dry-run and --group cannot be combined with --stdin")
+			}
+			if dryRun && (len(args) != 1 || group != "") {
+				return fmt.Errorf("--dry-run takes a single path")
+			}
 			cfg, err := config.Load(cfgFile)
 			if err != nil {
 				return err
 			}
+			cfg.Snapshot.Excludes = append(cfg.Snapshot.Excludes, excludes...)
+			cfg.Snapshot.NoDefaultExcludes = cfg.Snapshot.NoDefaultExcludes || noDefaults
 			ag, err := agent.New(cfg, passphrase)
 			if err != nil {
 				return err
 			}
-			return ag.CreateAndSaveSnapshot(args[0])
+			defer ag.Close()
+			if dryRun {
+				report, err := ag.DryRunSnapshot(cmd.Context(), args[0])
+				if err != nil {
+					return err
+				}
+				return out.Result(report, func() { printDryRun(report) })
+			}
+			tracker := progress.New()
+			stop := tracker.Watch(time.Second, func(r *progress.Report) {
+				out.Printf("\r\033[K%s", r)
+			})
+			ctx := progress.With(context.Background(), tracker)
+			var snap *versioning.Snapshot
+			switch {
+			case fromStdin:
+				snap, err = ag.BackupStreamWithHooks(ctx, os.Stdin, stdinName, snapshotTags...)
+			case group != "" || len(args) > 1:
+				paths := args
+				if len(paths) == 0 {
+					if paths, err = ag.SourceGroup(group); err != nil {
+						stop()
+						return err
+					}
+				}
+				snap, err = ag.BackupGroupWithHooks(ctx, group, paths, snapshotTags...)
+			default:
+				snap, err = ag.BackupWithHooks(ctx, args[0], snapshotTags...)
+			}
+			stop()
+			out.Printf("\r\033[K")
+			var skipped *snapshots.SkippedError
+			if err != nil && !errors.As(err, &skipped) {
+				return err
+			}
+			res := newSnapshotResult(snap)
+			res.Progress = tracker.Report()
+			err = out.Result(res, func() {
+				fmt.Printf("Snapshot %s of %s\n  %s\n", snap.ID, res.Source, res.Progress)
+				if skipped != nil {
+					printSkipped(skipped)
+				}
+			})
+			if err == nil && skipped != nil {
+				ag.Close()
+				os.Exit(render.ExitPartial)
+			}
+			return err
+		},
+	}
+
+	snapCmd.Flags().StringArrayVar(&snapshotTags, "tag", nil, "label the snapshot, e.g. for retention.tags rules (repeatable)")
+	snapCmd.Flags().BoolVar(&dryRun, "dry-run", false, "report what the snapshot would read and store, writing nothing")
+	snapCmd.Flags().StringVar(&group, "group", "", "back up the paths of this scheduler.source_groups group, or the paths given under this name, into one snapshot")
+	snapCmd.Flags().BoolVar(&fromStdin, "stdin", false, "back up what is piped to standard input as a single file")
+	snapCmd.Flags().StringVar(&stdinName, "stdin-filename", "stdin", "name of the file backed up with --stdin, and of its snapshot history")
+	snapCmd.Flags().StringArrayVar(&excludes, "exclude", nil, "leave out paths matching this gitignore-style pattern, besides snapshot.excludes (repeatable)")
+	snapCmd.Flags().BoolVar(&noDefaults, "no-default-excludes", false, "keep trash, caches and other paths left out by default, as snapshot.no_default_excludes")
+
+	var holdReason string
+	snapHoldCmd := &cobra.Command{
+		Use:   "hold <snapshot-id>",
+		Short: "Keep a snapshot from deletion by retention, GC or anything else until unheld",
+		Long: `Places a hold on a snapshot, for a legal hold or a restore point known to
+be good. Retention keeps it whatever storage.retention says, and deleting it
+fails, until "snapshot unhold" releases it.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			h, err := versioning.PlaceHold(ag.DB, args[0], holdReason)
+			if err != nil {
+				return err
+			}
+			return out.Result(h, func() {
+				out.Printf("Snapshot %s held since %s\n", h.SnapshotID, h.Since.Local().Format(time.RFC1123))
+			})
+		},
+	}
+	snapHoldCmd.Flags().StringVar(&holdReason, "reason", "", "why the snapshot is held, e.g. a case number")
+
+	snapUnholdCmd := &cobra.Command{
+		Use:   "unhold <snapshot-id>",
+		Short: "Release the hold on a snapshot, leaving it to retention again",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			held, err := versioning.ReleaseHold(ag.DB, args[0])
+			if err != nil {
+				return err
+			}
+			if !held {
+				return fmt.Errorf("snapshot %s is not held", args[0])
+			}
+			return out.Result(map[string]string{"snapshot_id": args[0]}, func() {
+				out.Printf("Released the hold on snapshot %s\n", args[0])
+			})
+		},
+	}
+
+	snapHoldsCmd := &cobra.Command{
+		Use:   "holds",
+		Short: "List held snapshots",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			holds, err := versioning.ListHolds(ag.DB)
+			if err != nil {
+				return err
+			}
+			return out.Result(holds, func() {
+				if len(holds) == 0 {
+					out.Println("No snapshots held")
+				}
+				for _, h := range holds {
+					out.Printf("%s  held since %s", h.SnapshotID, h.Since.Local().Format(time.RFC1123))
+					if h.Reason != "" {
+						out.Printf("  (%s)", h.Reason)
+					}
+					out.Println()
+				}
+			})
+		},
+	}
+	snapCmd.AddCommand(snapHoldCmd, snapUnholdCmd, snapHoldsCmd)
+
+	recoveryCmd := &cobra.Command{
+		Use:   "recovery",
+		Short: "Social recovery of the passphrase via trusted peers",
+	}
+
+	distributeCmd := &cobra.Command{
+		Use:   "distribute",
+		Short: "Split the passphrase into shares and send them to trusted peers",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			if err := ag.DistributeKeyShares([]byte(passphrase)); err != nil {
+				return err
+			}
+			res := struct {
+				Shares    int    `json:"shares"`
+				Threshold int    `json:"threshold"`
+				OwnerKey  string `json:"owner_key"`
+			}{len(ag.Config.Recovery.TrustedPeers), ag.Config.Recovery.Threshold, auth.PubKeyToString(ag.SignerPub)}
+			return out.Result(res, func() {
+				fmt.Printf("Distributed %d shares (threshold %d)\n", res.Shares, res.Threshold)
+				fmt.Printf("Owner key: %s\n", res.OwnerKey)
+			})
+		},
+	}
+
+	requestCmd := &cobra.Command{
+		Use:   "request [owner-pubkey]",
+		Short: "Ask trustees to release shares for a lost identity",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			req, err := ag.RequestKeyShares(args[0])
+			if err != nil {
+				return err
+			}
+			res := shareRequestResult{req.OwnerPub, req.RequesterPub, req.ConfirmationCode()}
+			return out.Result(res, func() {
+				fmt.Printf("Recovery requested. Read this code to each trustee: %s\n", res.ConfirmationCode)
+			})
+		},
+	}
+
+	pendingCmd := &cobra.Command{
+		Use:   "pending",
+		Short: "List share requests awaiting approval",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			reqs, err := ag.Recovery.PendingRequests()
+			if err != nil {
+				return err
+			}
+			res := make([]shareRequestResult, 0, len(reqs))
+			for _, r := range reqs {
+				res = append(res, shareRequestResult{r.OwnerPub, r.RequesterPub, r.ConfirmationCode()})
+			}
+			return out.Result(res, func() {
+				for _, r := range res {
+					fmt.Printf("Owner: %s Requester: %s Code: %s\n", r.OwnerKey, r.RequesterKey, r.ConfirmationCode)
+				}
+			})
+		},
+	}
+
+	approveCmd := &cobra.Command{
+		Use:   "approve [owner-pubkey] [code]",
+		Short: "Release a held share after confirming the code out-of-band",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			if err := ag.ApproveShareRequest(args[0], args[1]); err != nil {
+				return err
+			}
+			res := struct {
+				OwnerKey string `json:"owner_key"`
+				Released bool   `json:"released"`
+			}{args[0], true}
+			return out.Result(res, func() { fmt.Println("Share released") })
+		},
+	}
+
+	recoverCmd := &cobra.Command{
+		Use:   "recover [owner-pubkey]",
+		Short: "Combine released shares and print the recovered passphrase",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			secret, err := ag.Recovery.Recover(args[0])
+			if err != nil {
+				return err
+			}
+			res := struct {
+				OwnerKey   string `json:"owner_key"`
+				Passphrase string `json:"passphrase"`
+			}{args[0], string(secret)}
+			return out.Result(res, func() { fmt.Printf("Recovered passphrase: %s\n", res.Passphrase) })
+		},
+	}
+
+	recoveryCmd.AddCommand(distributeCmd, requestCmd, pendingCmd, approveCmd, recoverCmd)
+
+	var pushTo string
+	pushCmd := &cobra.Command{
+		Use:   "push [snapshot-id]",
+		Short: "Replicate a snapshot and the chunks a peer lacks directly to that peer, or to the peer offering the most storage",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			res, err := ag.PushSnapshot(context.Background(), args[0], pushTo, func(sent, missing int, bytes int64) {
+				out.Printf("\rPushed %d/%d chunks (%.1f MiB)", sent, missing, float64(bytes)/(1<<20))
+			})
+			if err != nil {
+				out.Println()
+				return err
+			}
+			if res.Missing > 0 {
+				out.Println()
+			}
+			pushed := struct {
+				SnapshotID string `json:"snapshot_id"`
+				Peer       string `json:"peer"`
+				Chunks     int    `json:"chunks"`
+				Sent       int    `json:"sent"`
+				Bytes      int64  `json:"bytes"`
+				DurationMS int64  `json:"duration_ms"`
+				Digest     string `json:"digest"`
+			}{args[0], res.Peer.String(), res.Total, res.Missing, res.Bytes, res.Duration.Milliseconds(), res.Digest}
+			return out.Result(pushed, func() {
+				fmt.Printf("Snapshot %s on %s: %d chunks, %d sent, verified in %s (digest %s)\n",
+					args[0], res.Peer, res.Total, res.Missing, res.Duration.Round(time.Millisecond), res.Digest[:16])
+			})
+		},
+	}
+	pushCmd.Flags().StringVar(&pushTo, "to", "", "peer ID or multiaddr to push to (default: placed by storage offers)")
+
+	seedCmd := &cobra.Command{
+		Use:   "seed",
+		Short: "Throttled, resumable first backup of a large tree",
+	}
+
+	seedStartCmd := &cobra.Command{
+		Use:   "start [path]",
+		Short: "Seed a directory, resuming from the last checkpoint if interrupted",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			// Ctrl-C checkpoints and exits; run start again to resume
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			hours, limit := ag.Config.Seeding.ActiveHours, "unlimited"
+			if hours == "" {
+				hours = "any time"
+			}
+			if ag.Config.Seeding.MaxReadRate > 0 {
+				limit = formatRate(float64(ag.Config.Seeding.MaxReadRate))
+			}
+			out.Printf("Seeding %s (active hours: %s, read rate: %s)\n", args[0], hours, limit)
+			snap, err := ag.Seed(ctx, args[0], printSeedLine)
+			out.Println()
+			var skipped *snapshots.SkippedError
+			if err != nil && !errors.As(err, &skipped) {
+				if ctx.Err() == nil {
+					return err
+				}
+				res := &snapshotResult{Source: args[0], Skipped: []versioning.FileError{}, Interrupted: true}
+				return out.Result(res, func() { fmt.Println("Seeding interrupted; progress is checkpointed") })
+			}
+			err = out.Result(newSnapshotResult(snap), func() {
+				fmt.Printf("Seeding complete: snapshot %s (%d chunks)\n", snap.ID, len(snap.Chunks))
+				if skipped != nil {
+					printSkipped(skipped)
+				}
+			})
+			if err == nil && skipped != nil {
+				ag.Close()
+				os.Exit(render.ExitPartial)
+			}
+			return err
+		},
+	}
+
+	seedStatusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show progress of seeding runs",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			seeds, err := ag.SeedStatus()
+			if err != nil {
+				return err
+			}
+			return out.Result(seeds, func() {
+				if len(seeds) == 0 {
+					fmt.Println("No seeding runs")
+				}
+				for _, p := range seeds {
+					printSeedStatus(p)
+				}
+			})
+		},
+	}
+
+	seedCancelCmd := &cobra.Command{
+		Use:   "cancel [path]",
+		Short: "Discard the checkpoints of an unfinished seeding run",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			if err := ag.CancelSeed(args[0]); err != nil {
+				return err
+			}
+			res := struct {
+				Path      string `json:"path"`
+				Discarded bool   `json:"discarded"`
+			}{args[0], true}
+			return out.Result(res, func() { fmt.Println("Seeding run discarded") })
+		},
+	}
+
+	var seedSince, seedReceipt string
+	seedExportCmd := &cobra.Command{
+		Use:   "export [dir]",
+		Short: "Write snapshots and their chunks to a drive for an offsite node to import",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			// Ctrl-C stops; run export again to continue into the same directory
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			man, err := ag.ExportSeed(ctx, args[0], seedSince, func(done, total int) {
+				out.Printf("\rExported %d/%d chunks", done, total)
+			})
+			out.Println()
+			if err != nil {
+				return err
+			}
+			exported := struct {
+				ExportID  string `json:"export_id"`
+				Dir       string `json:"dir"`
+				Since     string `json:"since,omitempty"`
+				Snapshots int    `json:"snapshots"`
+				Chunks    int    `json:"chunks"`
+				Bytes     int64  `json:"bytes"`
+			}{man.ID, args[0], man.Since, len(man.Snapshots), len(man.Sums), man.Bytes}
+			return out.Result(exported, func() {
+				fmt.Printf("Export %s: %d snapshots, %d chunks (%.1f MiB) in %s\n",
+					man.ID, len(man.Snapshots), len(man.Sums), float64(man.Bytes)/(1<<20), args[0])
+			})
+		},
+	}
+	seedExportCmd.Flags().StringVar(&seedSince, "since", "", "export only snapshots newer than this one, which the offsite node already holds")
+
+	seedImportCmd := &cobra.Command{
+		Use:   "import [dir]",
+		Short: "Store an export from a drive and write a receipt to send back",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			receipt := seedReceipt
+			if receipt == "" {
+				receipt = filepath.Join(args[0], sneakernet.ReceiptName)
+			}
+			rec, err := ag.ImportSeed(ctx, args[0], receipt, func(done, total int) {
+				out.Printf("\rImported %d/%d chunks", done, total)
+			})
+			out.Println()
+			if err != nil {
+				return err
+			}
+			imported := struct {
+				ExportID  string `json:"export_id"`
+				Snapshots int    `json:"snapshots"`
+				Receipt   string `json:"receipt"`
+			}{rec.ExportID, len(rec.Snapshots), receipt}
+			return out.Result(imported, func() {
+				fmt.Printf("Export %s imported: %d snapshots\nReceipt written to %s; run seed ack on the exporting node with it\n",
+					rec.ExportID, len(rec.Snapshots), receipt)
+			})
+		},
+	}
+	seedImportCmd.Flags().StringVar(&seedReceipt, "receipt", "", "where to write the receipt (default: receipt.json in the export)")
+
+	seedAckCmd := &cobra.Command{
+		Use:   "ack [receipt]",
+		Short: "Count the copy an offsite node imported, from the receipt it wrote",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			rec, err := ag.AckSeed(args[0])
+			if err != nil {
+				return err
+			}
+			ids := make([]string, 0, len(rec.Snapshots))
+			for id := range rec.Snapshots {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			acked := struct {
+				ExportID  string   `json:"export_id"`
+				Peer      string   `json:"peer"`
+				Snapshots []string `json:"snapshots"`
+			}{rec.ExportID, rec.PeerID, ids}
+			return out.Result(acked, func() {
+				fmt.Printf("Export %s acknowledged: %s holds %d snapshots\n", rec.ExportID, rec.PeerID, len(ids))
+			})
+		},
+	}
+
+	seedStartCmd.Flags().StringArrayVar(&excludes, "exclude", nil, "leave out paths matching this gitignore-style pattern, besides snapshot.excludes (repeatable)")
+	seedStartCmd.Flags().BoolVar(&noDefaults, "no-default-excludes", false, "keep trash, caches and other paths left out by default, as snapshot.no_default_excludes")
+	seedCmd.AddCommand(seedStartCmd, seedStatusCmd, seedCancelCmd, seedExportCmd, seedImportCmd, seedAckCmd)
+
+	var verifyRemote, verifyRepo, verifyOut string
+	var verifySample int
+	verifyCmd := &cobra.Command{
+		Use:   "verify [snapshot-id]",
+		Short: "Challenge a peer to prove it holds a snapshot and sign an attestation of the result",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			at, err := ag.VerifyRemote(context.Background(), verifyRemote, args[0], verifyRepo, verifySample)
+			if err != nil {
+				return err
+			}
+			if err := out.Result(at, func() { printAttestation(at) }); err != nil {
+				return err
+			}
+			if verifyOut != "" {
+				data, err := json.MarshalIndent(at, "", "  ")
+				if err != nil {
+					return err
+				}
+				if err := os.WriteFile(verifyOut, data, 0644); err != nil {
+					return err
+				}
+				out.Printf("Attestation written to %s\n", verifyOut)
+			}
+			if !at.Passed {
+				// The attestation printed already reports the failure
+				if out.Structured() {
+					os.Exit(render.ExitError)
+				}
+				return fmt.Errorf("snapshot %s failed verification on %s", at.SnapshotID, at.Holder)
+			}
+			return nil
+		},
+	}
+	verifyCmd.Flags().StringVar(&verifyRemote, "remote", "", "peer ID or multiaddr of the node holding the snapshot")
+	verifyCmd.Flags().StringVar(&verifyRepo, "repo", "", "repository ID of the snapshot (default: this node's)")
+	verifyCmd.Flags().IntVar(&verifySample, "sample", 64, "number of random chunks to fetch and check (0 checks all)")
+	verifyCmd.Flags().StringVar(&verifyOut, "out", "", "write the signed attestation as JSON to this file")
+	verifyCmd.MarkFlagRequired("remote")
+
+	verifyAttestationCmd := &cobra.Command{
+		Use:   "attestation [file]",
+		Short: "Check the signature of an attestation produced by verify",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := os.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+			var at verification.Attestation
+			if err := json.Unmarshal(data, &at); err != nil {
+				return err
+			}
+			if err := at.Verify(); err != nil {
+				return err
+			}
+			return out.Result(&at, func() {
+				printAttestation(&at)
+				fmt.Printf("Signed by verifier %s\n", at.Verifier)
+			})
+		},
+	}
+
+	var localOpts verification.PassOptions
+	verifyLocalCmd := &cobra.Command{
+		Use:   "local [snapshot-id...]",
+		Short: "Decrypt and check every chunk of local snapshots",
+		Long: `Checks every chunk of the given snapshots, or of all of this repository's
+snapshots, reading chunks they share once. Progress is checkpointed: a run
+stopped by --budget, --max-read or Ctrl-C is resumed by the next one, and by
+the maintenance verify task, which runs the same pass.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			res, err := ag.VerifyLocal(ctx, args, localOpts)
+			if res == nil {
+				return err
+			}
+			if perr := out.Result(res, func() { printPass(res) }); perr != nil {
+				return perr
+			}
+			if err != nil && !errors.Is(err, verification.ErrBudget) && !errors.Is(err, context.Canceled) {
+				return err
+			}
+			if res.Failed > 0 {
+				if out.Structured() {
+					os.Exit(render.ExitError)
+				}
+				return fmt.Errorf("%d snapshot(s) failed verification", res.Failed)
+			}
+			return nil
+		},
+	}
+	verifyLocalCmd.Flags().IntVar(&localOpts.Workers, "workers", 0, "chunks verified at once (default: one per CPU)")
+	verifyLocalCmd.Flags().DurationVar(&localOpts.Budget, "budget", 0, "stop after this long, leaving the rest to the next run")
+	verifyLocalCmd.Flags().Int64Var(&localOpts.MaxBytes, "max-read", 0, "stop after reading this many chunk bytes")
+	verifyCmd.AddCommand(verifyAttestationCmd, verifyLocalCmd)
+
+	var gcLimit int
+	gcCmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Garbage collection of expired snapshots and unreferenced chunks",
+	}
+
+	gcStatusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show recent garbage collection runs and the next scheduled one",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			st, err := ag.GCStatus(gcLimit)
+			if err != nil {
+				return err
+			}
+			return out.Result(st, func() { printGCStatus(st) })
+		},
+	}
+	gcStatusCmd.Flags().IntVarP(&gcLimit, "limit", "n", 10, "number of runs to show")
+	gcCmd.AddCommand(gcStatusCmd)
+
+	repoCmd := &cobra.Command{
+		Use:   "repo",
+		Short: "Repository maintenance",
+	}
+	repoRebuildIndexCmd := &cobra.Command{
+		Use:   "rebuild-index",
+		Short: "Recount chunk references from the snapshots and correct the chunk index",
+		Long: `Garbage collection deletes the chunks whose reference count in the chunk
+index is zero, counts kept as snapshots are saved and deleted. Should they
+drift, from a crash of an older version or a repository edited by hand,
+this recounts them from every snapshot, drops entries of chunks neither
+stored nor referenced and indexes blocks the index lost. Stop the daemon
+first.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			d, err := chunkindex.Recount(ag.DB)
+			if err != nil {
+				return err
+			}
+			return out.Result(d, func() {
+				out.Printf("Checked %d index entries\n", d.Chunks)
+				out.Printf("  Reference counts fixed: %d\n", d.RefsFixed)
+				out.Printf("  Entries added:          %d\n", d.Added)
+				out.Printf("  Entries dropped:        %d\n", d.Dropped)
+			})
+		},
+	}
+	repoCmd.AddCommand(repoRebuildIndexCmd)
+
+	var pruneDryRun bool
+	pruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete the snapshots the retention policy does not keep, and the chunks only they use",
+		Long: `Runs a garbage collection cycle now. With --dry-run, lists every snapshot
+with whether storage.retention and retention_days keep it, and why, without
+deleting anything.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			st := ag.Config.Storage
+			collector := gc.NewCollector(ag.DB, ag.Store, st.RetentionDays, st.Retention, st.GCInterval, st.GCGrace)
+			if pruneDryRun {
+				plan, err := collector.Plan(time.Now())
+				if err != nil {
+					return err
+				}
+				return out.Result(plan, func() { printPrunePlan(plan, ag.RepoID) })
+			}
+			runErr := collector.RunContext(cmd.Context())
+			runs, err := gc.History(ag.DB, 1)
+			if err != nil || len(runs) == 0 {
+				return runErr
+			}
+			if err := out.Result(runs[0], func() { printGCRun(runs[0]) }); err != nil {
+				return err
+			}
+			return runErr
+		},
+	}
+	pruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "show what would be kept and deleted without deleting")
+
+	var forecastMonths int
+	var forecastWhatIf []int
+	forecastCmd := &cobra.Command{
+		Use:   "forecast",
+		Short: "Project repository usage under the configured retention and alternatives",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			f, err := ag.Forecast(forecastMonths, forecastWhatIf)
+			if err != nil {
+				return err
+			}
+			return out.Result(f, func() { printForecast(f) })
+		},
+	}
+	forecastCmd.Flags().IntVar(&forecastMonths, "months", 12, "months to project")
+	forecastCmd.Flags().IntSliceVar(&forecastWhatIf, "retention-days", nil, "also project this retention period in days (repeatable)")
+
+	metadataCmd := &cobra.Command{
+		Use:   "metadata",
+		Short: "Back up or recover the repository metadata (snapshot records, identity, key salt)",
+	}
+	metadataBackupCmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Export the metadata now as an encrypted metadata snapshot",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			snap, err := ag.BackupMetadata(true)
+			if err != nil {
+				return err
+			}
+			n, _ := strconv.Atoi(snap.Meta[metabackup.MetaSnapshots])
+			res := struct {
+				SnapshotID string `json:"snapshot_id"`
+				Snapshots  int    `json:"snapshots"` // records exported
+				Chunks     int    `json:"chunks"`
+			}{snap.ID, n, len(snap.Chunks)}
+			return out.Result(res, func() {
+				fmt.Printf("Exported metadata of %d snapshot(s) as %s (%d chunks)\n", res.Snapshots, snap.ID, len(snap.Chunks))
+				fmt.Println("Mirrors receive it with their next sync, or push it now with: push " + snap.ID)
+			})
+		},
+	}
+	var recoverFrom, recoverFile string
+	metadataRecoverCmd := &cobra.Command{
+		Use:   "recover",
+		Short: "Rebuild a lost repository's metadata from its newest export on a peer or in a file",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if (recoverFrom == "") == (recoverFile == "") {
+				return fmt.Errorf("exactly one of --from-peer and --file is required")
+			}
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			exp, err := ag.RecoverMetadata(context.Background(), recoverFrom, recoverFile, passphrase)
+			if err != nil {
+				return err
+			}
+			res := struct {
+				RepoID    string    `json:"repo_id"`
+				Snapshots int       `json:"snapshots"` // records recovered
+				Exported  time.Time `json:"exported"`
+			}{exp.RepoID, len(exp.Snapshots), exp.Created}
+			return out.Result(res, func() {
+				fmt.Printf("Recovered %d snapshot record(s) of repository %s, exported %s\n",
+					res.Snapshots, exp.RepoID, exp.Created.Local().Format(time.RFC1123))
+				fmt.Println("Restart the agent, then restore snapshots with: restore-agent restore <snapshot-id> <dir> --from-peer <peer>")
+			})
+		},
+	}
+	metadataRecoverCmd.Flags().StringVar(&recoverFrom, "from-peer", "", "peer ID or multiaddr of a mirror holding the export")
+	metadataRecoverCmd.Flags().StringVar(&recoverFile, "file", "", "export file written to metadata_backup.export_dir")
+	metadataCmd.AddCommand(metadataBackupCmd, metadataRecoverCmd)
+
+	var benchDurability []string
+	var benchBatches []int
+	var benchSize, benchReads, benchFsyncs int
+	var benchDir string
+	var bundleOutput, bundleStub string
+	exportRecoveryCmd := &cobra.Command{
+		Use:   "export-recovery [snapshot-id]",
+		Short: "Write a self-contained restore program for one snapshot, for recipients without ShadowVault",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			if bundleOutput == "" {
+				bundleOutput = "shadowvault-recovery-" + args[0]
+				if strings.HasSuffix(bundleStub, ".exe") {
+					bundleOutput += ".exe"
+				}
+			}
+			readme, err := ag.ExportRecovery(args[0], bundleStub, bundleOutput)
+			if err != nil {
+				return err
+			}
+			res := struct {
+				Bundle       string `json:"bundle"`
+				Instructions string `json:"instructions"`
+			}{bundleOutput, readme}
+			return out.Result(res, func() {
+				fmt.Printf("Wrote recovery bundle %s and instructions %s\n", bundleOutput, readme)
+				fmt.Println("Running the bundle restores the snapshot given the repository passphrase. Hand the passphrase over separately.")
+			})
 		},
 	}
+	exportRecoveryCmd.Flags().StringVarP(&bundleOutput, "output", "o", "", "bundle file to write (default: shadowvault-recovery-<snapshot-id>)")
+	exportRecoveryCmd.Flags().StringVar(&bundleStub, "stub", "", "restore binary to embed, e.g. one built for the recipient's OS (default: this executable)")
 
-	root.AddCommand(initCmd, snapCmd)
-	if err := root.Execute(); err != nil {
-		fmt.Println("Error:", err)
-		os.Exit(1)
+	var exportFormat, exportOut string
+	var exportPaths []string
+	exportCmd := &cobra.Command{
+		Use:   "export <snapshot-id>",
+		Short: "Write a snapshot as a tar or zip archive, for recipients without ShadowVault",
+		Long: `Streams the files of a snapshot into a standard archive without restoring
+them to disk first, like restore-agent export-archive. Without -o, or with
+-o -, the archive goes to stdout and logs and the summary to stderr.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			toStdout := agent.StreamsArchive(exportOut)
+			if toStdout {
+				if out.Structured() {
+					return fmt.Errorf("the archive goes to stdout; pass -o to print a %s result", out.Format.String())
+				}
+				// Nothing but the archive may reach stdout
+				monitoring.GetLogger().SetOutput(os.Stderr)
+			}
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			res, err := ag.ExportArchiveTo(cmd.Context(), args[0], exportOut, exportFormat, exportPaths)
+			if err != nil {
+				return err
+			}
+			if toStdout {
+				fmt.Fprintln(os.Stderr, res)
+				return nil
+			}
+			return out.Result(res, func() { out.Println(res) })
+		},
+	}
+	exportCmd.Flags().StringVar(&exportFormat, "format", "", "archive format: "+strings.Join(snapshots.ArchiveFormats, ", ")+" (default: from -o, else tar)")
+	exportCmd.Flags().StringVarP(&exportOut, "out", "o", "", "write the archive to this file instead of stdout")
+	exportCmd.Flags().StringArrayVar(&exportPaths, "path", nil, "export only this file or directory, relative to the source (repeatable)")
+
+	compressionCmd := &cobra.Command{
+		Use:   "compression",
+		Short: "Manage the dictionaries small chunks are compressed against",
+	}
+	var dictSize, dictSamples int
+	compressionTrainCmd := &cobra.Command{
+		Use:   "train",
+		Short: "Train a zstd dictionary per content type on a sample of the stored chunks",
+		Long: `Samples the stored chunks, trains a dictionary for each content type
+compressed at snapshot.compression_levels and saves those that compress chunks
+held out of training better than no dictionary. With snapshot.compression_dicts
+set, chunks stored from then on are compressed against the newest dictionary
+of their type. Dictionaries are kept for good: the chunks compressed against
+them cannot be read without them.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			reports, err := ag.TrainDicts(ctx, agent.DictOptions{Size: dictSize << 10, Samples: dictSamples})
+			if err != nil {
+				return err
+			}
+			return out.Result(reports, func() {
+				for _, r := range reports {
+					printDictReport(r)
+				}
+			})
+		},
+	}
+	compressionTrainCmd.Flags().IntVar(&dictSize, "size", 64, "maximum dictionary size in KiB")
+	compressionTrainCmd.Flags().IntVar(&dictSamples, "samples", 2000, "chunks sampled per content type")
+	compressionDictsCmd := &cobra.Command{
+		Use:   "dicts",
+		Short: "List the trained compression dictionaries",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			dicts, err := ag.Store.Dicts()
+			if err != nil {
+				return err
+			}
+			type dictInfo struct {
+				ID      uint32           `json:"id"`
+				Kind    compression.Kind `json:"kind"`
+				Samples int              `json:"samples"`
+				Size    int              `json:"size"`
+				Created time.Time        `json:"created"`
+			}
+			infos := make([]dictInfo, len(dicts))
+			for i, d := range dicts {
+				infos[i] = dictInfo{d.ID, d.Kind, d.Samples, len(d.Data), d.Created}
+			}
+			return out.Result(infos, func() {
+				if len(infos) == 0 {
+					fmt.Println("No compression dictionaries trained")
+				}
+				for _, d := range infos {
+					fmt.Printf("%-10d %-7s %6.1f KiB  %5d samples  %s\n", d.ID, d.Kind, float64(d.Size)/(1<<10), d.Samples, d.Created.Local().Format(time.RFC1123))
+				}
+			})
+		},
+	}
+	compressionCmd.AddCommand(compressionTrainCmd, compressionDictsCmd)
+
+	securityCmd := &cobra.Command{
+		Use:   "security",
+		Short: "Audit the cryptography and access control of the repository",
+	}
+	var securityProfile string
+	securityReportCmd := &cobra.Command{
+		Use:   "report",
+		Short: "Inventory ciphers, key derivation, key ages, signatures, transport and ACL state, and flag weak choices",
+		Long: `Lists the cryptographic mechanisms in effect for the repository, from the
+live configuration and state, and checks them against a built-in policy
+profile: baseline, or fips for NIST-approved algorithms only, SP 800-57 key
+cryptoperiods and the two-person rule. The report covers algorithms and
+parameters; it does not validate the cryptographic module.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			defer ag.Close()
+			report, err := ag.SecurityReport(securityProfile)
+			if err != nil {
+				return err
+			}
+			return out.Result(report, func() { report.WriteText(os.Stdout) })
+		},
+	}
+	securityReportCmd.Flags().StringVar(&securityProfile, "profile", "baseline", "policy profile to check against: "+strings.Join(security.ProfileNames(), ", "))
+	securityCmd.AddCommand(securityReportCmd)
+
+	benchCmd := &cobra.Command{
+		Use:   "bench",
+		Short: "Measure the performance of this machine's storage",
+	}
+	benchStoreCmd := &cobra.Command{
+		Use:   "store",
+		Short: "Measure chunk put/get throughput, latency and fsync cost on a scratch repository",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.Load(cfgFile)
+			if err != nil {
+				return err
+			}
+			if benchDir == "" {
+				benchDir = cfg.RepositoryPath
+			}
+			if err := os.MkdirAll(benchDir, 0755); err != nil {
+				return err
+			}
+			if len(benchDurability) == 0 {
+				benchDurability = []string{cfg.Storage.Durability}
+			}
+			out.Printf("Writing %d MiB per run in %s (chunks %d-%d bytes, about %d)\n",
+				benchSize, benchDir, cfg.Snapshot.MinChunkSize, cfg.Snapshot.MaxChunkSize, cfg.Snapshot.AvgChunkSize)
+			var results []*storage.BenchResult
+			for _, durability := range benchDurability {
+				if durability != storage.DurabilitySync && durability != storage.DurabilityWAL {
+					return fmt.Errorf("invalid durability: %s (must be sync or wal)", durability)
+				}
+				for _, batch := range benchBatches {
+					res, err := storage.Bench(storage.BenchOptions{
+						Dir:        benchDir,
+						Durability: durability,
+						WAL: storage.WALOptions{
+							SyncInterval: cfg.Storage.WALSyncInterval,
+							MaxPending:   cfg.Storage.WALMaxPending,
+						},
+						BatchBytes: batch << 20,
+						Bytes:      int64(benchSize) << 20,
+						Reads:      benchReads,
+						Fsyncs:     benchFsyncs,
+						MinChunk:   cfg.Snapshot.MinChunkSize,
+						AvgChunk:   cfg.Snapshot.AvgChunkSize,
+						MaxChunk:   cfg.Snapshot.MaxChunkSize,
+					})
+					if err != nil {
+						return err
+					}
+					results = append(results, res)
+					if !out.Structured() {
+						printBench(res)
+					}
+				}
+			}
+			return out.Result(results, func() {})
+		},
+	}
+	benchStoreCmd.Flags().StringSliceVar(&benchDurability, "durability", nil, "durability modes to compare, sync and/or wal (default: storage.durability)")
+	benchStoreCmd.Flags().IntSliceVar(&benchBatches, "batch", []int{1, 8, 32}, "MiB of chunks per put batch; one run per value")
+	benchStoreCmd.Flags().IntVar(&benchSize, "size", 256, "MiB of chunks written per run")
+	benchStoreCmd.Flags().IntVar(&benchReads, "reads", 2000, "random chunk reads per run")
+	benchStoreCmd.Flags().IntVar(&benchFsyncs, "fsyncs", 100, "fsyncs of a 4 KiB write, timed alone")
+	benchStoreCmd.Flags().StringVar(&benchDir, "dir", "", "where to create the scratch repository (default: repository_path)")
+	benchCmd.AddCommand(benchStoreCmd)
+
+	root.AddCommand(initCmd, snapCmd, recoveryCmd, pushCmd, seedCmd, verifyCmd, benchCmd, compressionCmd, securityCmd, gcCmd, repoCmd, forecastCmd, pruneCmd, metadataCmd, exportRecoveryCmd, exportCmd, remoteCmd(), tuiCmd(), setupCmd(), importCmd(), serviceCmd())
+	return root
+}
+
+// snapshotResult is the result of snapshot and seed start
+type snapshotResult struct {
+	SnapshotID  string                 `json:"snapshot_id"`
+	Source      string                 `json:"source"`
+	Tags        []string               `json:"tags,omitempty"`
+	Chunks      int                    `json:"chunks"`
+	Skipped     []versioning.FileError `json:"skipped"`               // unreadable files left out
+	Interrupted bool                   `json:"interrupted,omitempty"` // seeding stopped at a checkpoint
+	Progress    *progress.Report       `json:"progress,omitempty"`    // work done by snapshot
+}
+
+func newSnapshotResult(snap *versioning.Snapshot) *snapshotResult {
+	skipped := snap.Errors
+	if skipped == nil {
+		skipped = []versioning.FileError{}
+	}
+	return &snapshotResult{SnapshotID: snap.ID, Source: snap.Source(), Chunks: len(snap.Chunks), Skipped: skipped, Tags: snap.Tags()}
+}
+
+// shareRequestResult is a request for key shares awaiting approval
+type shareRequestResult struct {
+	OwnerKey         string `json:"owner_key"`
+	RequesterKey     string `json:"requester_key"`
+	ConfirmationCode string `json:"confirmation_code"`
+}
+
+// printSkipped lists the files a snapshot was saved without
+func printSkipped(e *snapshots.SkippedError) {
+	fmt.Printf("Snapshot %s saved without %d unreadable file(s):\n", e.SnapshotID, len(e.Skipped))
+	for _, f := range e.Skipped {
+		fmt.Printf("  %s: %s\n", f.Path, f.Error)
+	}
+}
+
+// printDryRun summarizes what a snapshot would store
+func printDryRun(r *snapshots.DryRunReport) {
+	fmt.Printf("%s: %d files in %d directories, %.1f MiB", r.Source, r.Files, r.Dirs, float64(r.Bytes)/(1<<20))
+	if r.Excluded > 0 {
+		fmt.Printf(", %d paths excluded", r.Excluded)
+	}
+	fmt.Println()
+	fmt.Printf("Would read %d new or changed files (%.1f MiB)\n", r.Read, float64(r.ReadBytes)/(1<<20))
+	fmt.Printf("Would store %d of %d chunks (%.1f MiB before encryption); the rest are stored already\n", r.NewChunks, r.Chunks, float64(r.NewBytes)/(1<<20))
+	if len(r.Skipped) > 0 {
+		fmt.Printf("Would leave out %d unreadable file(s):\n", len(r.Skipped))
+		for _, f := range r.Skipped {
+			fmt.Printf("  %s: %s\n", f.Path, f.Error)
+		}
+	}
+	if len(r.Flagged) > 0 {
+		fmt.Printf("Content policy flags %d file(s):\n", len(r.Flagged))
+		for _, f := range r.Flagged {
+			action := "backed up"
+			if f.Excluded {
+				action = "left out"
+			}
+			fmt.Printf("  %s: %s, %s\n", f.Path, f.Rule, action)
+		}
+	}
+}
+
+// printSeedLine redraws the one-line progress of a running seed
+func printSeedLine(p *snapshots.SeedProgress) {
+	if p.Phase == snapshots.SeedPaused {
+		out.Printf("\r\033[KPaused until %s at %.1f%%", p.ResumeAt.Local().Format("Mon 15:04"), p.Percent())
+		return
+	}
+	out.Printf("\r\033[K%.1f%%  %d/%d files  %.1f/%.1f GiB  %s  ETA %s",
+		p.Percent(), p.DoneFiles, p.TotalFiles,
+		float64(p.DoneBytes)/(1<<30), float64(p.TotalBytes)/(1<<30),
+		formatRate(p.Rate()), p.ETA().Round(time.Minute))
+}
+
+// printSeedStatus prints the checkpointed state of one seeding run
+func printSeedStatus(p *snapshots.SeedProgress) {
+	fmt.Printf("%s\n", p.Root)
+	fmt.Printf("  Phase:       %s\n", p.Phase)
+	fmt.Printf("  Progress:    %.1f%% (%d/%d files, %.1f/%.1f GiB)\n", p.Percent(),
+		p.DoneFiles, p.TotalFiles, float64(p.DoneBytes)/(1<<30), float64(p.TotalBytes)/(1<<30))
+	fmt.Printf("  Read rate:   %s over %s active\n", formatRate(p.Rate()), p.ActiveTime.Round(time.Second))
+	if p.Phase != snapshots.SeedDone {
+		fmt.Printf("  ETA:         %s of active time\n", p.ETA().Round(time.Minute))
+		if p.CurrentDir != "" {
+			fmt.Printf("  Directory:   %s\n", p.CurrentDir)
+		}
+	}
+	if !p.ResumeAt.IsZero() {
+		fmt.Printf("  Resumes at:  %s\n", p.ResumeAt.Local().Format(time.RFC1123))
+	}
+	fmt.Printf("  Started:     %s (resumed %d times)\n", p.StartedAt.Local().Format(time.RFC1123), p.Resumes)
+	fmt.Printf("  Checkpoint:  %s\n", p.LastCheckpoint.Local().Format(time.RFC1123))
+	if p.SnapshotID != "" {
+		fmt.Printf("  Snapshot:    %s\n", p.SnapshotID)
+	}
+}
+
+// printDictReport shows what training the dictionary of one content type
+// achieved
+func printDictReport(r *agent.DictReport) {
+	fmt.Printf("%s: %d chunks sampled\n", r.Kind, r.Samples)
+	if r.Bytes > 0 {
+		fmt.Printf("  Held out:    %.1f KiB\n", float64(r.Bytes)/(1<<10))
+		fmt.Printf("  Compressed:  %.1f KiB without a dictionary, %.1f KiB with (%.0f%% smaller)\n",
+			float64(r.Plain)/(1<<10), float64(r.WithDict)/(1<<10), 100*r.Gain())
+	}
+	if r.Skipped != "" {
+		fmt.Printf("  Not saved:   %s\n", r.Skipped)
+	} else {
+		fmt.Printf("  Saved:       dictionary %d\n", r.Dict)
+	}
+}
+
+// printGCStatus lists garbage collection runs, newest first
+func printGCStatus(st *agent.GCStatus) {
+	if st.NextRun != nil {
+		fmt.Printf("Next run: %s\n", st.NextRun.Local().Format(time.RFC1123))
+	} else {
+		fmt.Println("Next run: not scheduled (gc is not in maintenance.order)")
+	}
+	if len(st.History) == 0 {
+		fmt.Println("No garbage collection runs recorded")
+		return
+	}
+	for _, r := range st.History {
+		fmt.Println()
+		printGCRun(r)
+	}
+}
+
+// printGCRun shows one garbage collection run
+func printGCRun(r *gc.RunRecord) {
+	result := "completed"
+	switch {
+	case r.Interrupted:
+		result = "paused"
+	case r.Error != "":
+		result = "failed: " + r.Error
+	}
+	fmt.Printf("%s (%s): %s\n", r.Started.Local().Format(time.RFC1123), r.Finished.Sub(r.Started).Round(time.Millisecond), result)
+	fmt.Printf("  Snapshots deleted: %d\n", r.SnapshotsDeleted)
+	fmt.Printf("  Chunks deleted:    %d (%.1f MiB freed)\n", r.ChunksDeleted, float64(r.BytesFreed)/(1<<20))
+	if r.ChunksPending > 0 {
+		fmt.Printf("  Chunks pending:    %d (within the grace period)\n", r.ChunksPending)
+	}
+	if r.PacksRewritten > 0 {
+		fmt.Printf("  Packs rewritten:   %d (%.1f MiB reclaimed)\n", r.PacksRewritten, float64(r.PackBytesFreed)/(1<<20))
+	}
+	if r.ErrorCount > 0 {
+		fmt.Printf("  Errors:            %d\n", r.ErrorCount)
+		for _, e := range r.Errors {
+			fmt.Printf("    %s\n", e)
+		}
+	}
+}
+
+// printPrunePlan lists the retention decisions per repository and source,
+// newest first
+func printPrunePlan(plan []gc.Decision, repoID string) {
+	sort.SliceStable(plan, func(i, j int) bool {
+		a, b := plan[i], plan[j]
+		if a.RepoID != b.RepoID {
+			return a.RepoID < b.RepoID
+		}
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.Time.After(b.Time)
+	})
+	kept := 0
+	for i, d := range plan {
+		if i == 0 || d.RepoID != plan[i-1].RepoID || d.Source != plan[i-1].Source {
+			heading := d.Source
+			if heading == "" {
+				heading = "(no source recorded)"
+			}
+			if d.RepoID != repoID {
+				heading += " in repository " + d.RepoID
+			}
+			fmt.Printf("%s\n", heading)
+		}
+		action, when := "delete", "-"
+		if d.Keep {
+			action = "keep"
+			kept++
+		}
+		if !d.Time.IsZero() {
+			when = d.Time.Local().Format("2006-01-02 15:04")
+		}
+		line := fmt.Sprintf("  %-6s %s  %s", action, d.SnapshotID, when)
+		if len(d.Tags) > 0 {
+			line += "  [" + strings.Join(d.Tags, ", ") + "]"
+		}
+		if len(d.Reasons) > 0 {
+			line += "  " + strings.Join(d.Reasons, ", ")
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("%d snapshot(s) kept, %d would be deleted\n", kept, len(plan)-kept)
+}
+
+// printForecast shows the measured rates and, per retention period, the
+// projected usage
+func printForecast(f *gc.Forecast) {
+	mib := func(n float64) float64 { return n / (1 << 20) }
+	fmt.Printf("Measured on %d snapshots since %s\n", f.Snapshots, f.Since.Local().Format("2006-01-02"))
+	fmt.Printf("  Stored: %.1f MiB, %.1f MiB of it in the newest snapshots\n", mib(float64(f.StoredBytes)), mib(float64(f.LiveBytes)))
+	fmt.Printf("  Growth: %.2f MiB/day kept, %.2f MiB/day replaced\n", mib(f.GrowthPerDay), mib(f.ChurnPerDay))
+	for i, p := range f.Policies {
+		label := "configured"
+		if i > 0 {
+			label = "what if"
+		}
+		fmt.Printf("\nretention_days=%d (%s)\n", p.RetentionDays, label)
+		if p.Expired > 0 {
+			fmt.Printf("  Next GC deletes %d of %d snapshots\n", p.Expired, f.Snapshots)
+		}
+		for _, pt := range p.Points {
+			fmt.Printf("  %s  %10.1f MiB\n", pt.Date.Local().Format("2006-01"), mib(float64(pt.Bytes)))
+		}
+		if i > 0 {
+			verb := "saves"
+			if p.Savings < 0 {
+				verb = "costs"
+			}
+			fmt.Printf("  %s %.1f MiB by %s\n", verb, mib(math.Abs(float64(p.Savings))), p.Points[len(p.Points)-1].Date.Local().Format("2006-01"))
+		}
+	}
+}
+
+// printAttestation summarizes a remote verification
+func printAttestation(at *verification.Attestation) {
+	result := "PASSED"
+	if !at.Passed {
+		result = "FAILED"
+	}
+	fmt.Printf("Snapshot %s on %s: %s\n", at.SnapshotID, at.Holder, result)
+	fmt.Printf("  Manifest:  signed by %s, sha256 %s\n", at.SnapshotSigner, at.ManifestSum[:16])
+	if at.ManifestMismatch {
+		fmt.Println("  Manifest differs from the local copy")
+	}
+	fmt.Printf("  Sampled:   %d of %d chunks\n", at.Sampled, at.TotalChunks)
+	fmt.Printf("  Intact:    %d\n", at.Intact)
+	if at.Opaque > 0 {
+		fmt.Printf("  Opaque:    %d (present, but not checkable without the repository key)\n", at.Opaque)
+	}
+	fmt.Printf("  Missing:   %d\n", len(at.Missing))
+	fmt.Printf("  Corrupt:   %d\n", len(at.Corrupt))
+	fmt.Printf("  Verified:  %s\n", at.VerifiedAt.Local().Format(time.RFC1123))
+}
+
+// printPass reports one run of a local verification pass
+func printPass(res *verification.PassResult) {
+	for _, r := range res.Snapshots {
+		result := "PASSED"
+		if !r.Success {
+			result = fmt.Sprintf("FAILED (%d missing, %d corrupt)", len(r.MissingChunks), len(r.CorruptedChunks))
+		}
+		fmt.Printf("Snapshot %s: %d chunks, %s\n", r.SnapshotID, r.TotalChunks, result)
+	}
+	fmt.Printf("Read %d chunks (%.1f MiB) in %s; %d already checked in this pass\n",
+		res.Checked, float64(res.Bytes)/(1<<20), res.Duration.Round(time.Second), res.Reused)
+	if !res.Complete {
+		fmt.Printf("Stopped with %d snapshot(s) left; run again to resume\n", res.Remaining)
+	}
+}
+
+// printBench reports one storage benchmark run
+func printBench(res *storage.BenchResult) {
+	ms := func(l storage.Latency) string {
+		f := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+		return fmt.Sprintf("p50 %.2f  p90 %.2f  p99 %.2f  max %.2f ms", f(l.P50), f(l.P90), f(l.P99), f(l.Max))
+	}
+	fmt.Printf("\n%s, %d MiB batches: %d chunks, %.0f MiB\n", res.Durability, res.BatchBytes>>20, res.Chunks, float64(res.Bytes)/(1<<20))
+	fmt.Printf("  Put:    %-12s %s per batch\n", formatRate(res.PutRate), ms(res.PutLatency))
+	if res.Durability == storage.DurabilityWAL {
+		fmt.Printf("  Drain:  %s until every logged chunk was indexed\n", res.Drain.Round(time.Millisecond))
+	}
+	fmt.Printf("  Get:    %-12s %s per chunk\n", formatRate(res.GetRate), ms(res.GetLatency))
+	fmt.Printf("  Fsync:  %s\n", ms(res.Fsync))
+}
+
+func formatRate(bytesPerSec float64) string {
+	return fmt.Sprintf("%.1f MiB/s", bytesPerSec/(1<<20))
+}
+
+// loadAgent loads config and constructs an agent from the global flags
+func loadAgent() (*agent.Agent, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("passphrase is required")
+	}
+	cfg, err := config.Load(cfgFile)
+	if err != nil {
+		return nil, err
 	}
+	cfg.Snapshot.Excludes = append(cfg.Snapshot.Excludes, excludes...)
+	cfg.Snapshot.NoDefaultExcludes = cfg.Snapshot.NoDefaultExcludes || noDefaults
+	return agent.New(cfg, passphrase)
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/config"
+	"github.com/hoangsonww/backupagent/internal/agent"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+)
+
+// newRepo writes a config for a fresh repository holding one snapshot of a
+// small tree and returns the config path and the snapshot ID
+func newRepo(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	files := map[string]string{
+		"a.txt":     "alpha\n",
+		"sub/b.txt": strings.Repeat("beta\n", 1000),
+	}
+	for name, content := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo := filepath.Join(dir, "repo")
+	if err := os.Mkdir(repo, 0700); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	cfgPath := filepath.Join(dir, "config.yaml")
+	yaml := fmt.Sprintf("repository_path: %s\nlisten_port: %d\nsnapshot:\n  min_chunk_size: 2048\n  avg_chunk_size: 8192\n  max_chunk_size: 65536\n",
+		repo, port)
+	if err := os.WriteFile(cfgPath, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ag, err := agent.New(cfg, "test-passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := ag.CreateAndSaveSnapshot(context.Background(), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ag.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return cfgPath, snap.ID
+}
+
+// run runs backup-agent with args and returns what it wrote to stdout
+func run(t *testing.T, args ...string) []byte {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	// A fresh logger writes to the new stdout, as the process logger does
+	// to the real one
+	logger := monitoring.GetLogger()
+	monitoring.SetGlobalLogger(monitoring.NewLogger("debug", "json"))
+	format := out.Format
+	defer func() {
+		os.Stdout = stdout
+		monitoring.SetGlobalLogger(logger)
+		out.Format = format
+	}()
+	root := newRoot()
+	root.SetArgs(args)
+	if err := root.ExecuteContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestExportToStdout(t *testing.T) {
+	cfgPath, id := newRepo(t)
+	data := run(t, "export", id, "--path", "sub", "-c", cfgPath, "-p", "test-passphrase")
+
+	tr := tar.NewReader(bytes.NewReader(data))
+	var files []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("stdout is not a tar archive: %v", err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			files = append(files, h.Name[strings.Index(h.Name, "/")+1:])
+		}
+	}
+	if len(files) != 1 || files[0] != "sub/b.txt" {
+		t.Errorf("archive holds %q, want [sub/b.txt]", files)
+	}
+	if bytes.Contains(data, []byte("Wrote snapshot")) {
+		t.Error("summary written to stdout along with the archive")
+	}
+}
+
+func TestStructuredOutputIsOneDocument(t *testing.T) {
+	cfgPath, id := newRepo(t)
+	run(t, "snapshot", "hold", id, "--reason", "case 42", "-c", cfgPath, "-p", "test-passphrase")
+	data := run(t, "snapshot", "holds", "--output", "json", "-c", cfgPath, "-p", "test-passphrase")
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var holds []struct {
+		SnapshotID string `json:"snapshot_id"`
+		Reason     string `json:"reason"`
+	}
+	if err := dec.Decode(&holds); err != nil {
+		t.Fatalf("stdout is not JSON: %v\n%s", err, data)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		t.Fatalf("stdout holds more than one JSON document:\n%s", data)
+	}
+	if len(holds) != 1 || holds[0].SnapshotID != id || holds[0].Reason != "case 42" {
+		t.Errorf("holds = %+v, want %s held for case 42", holds, id)
+	}
+}
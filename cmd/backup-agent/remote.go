@@ -0,0 +1,673 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/hoangsonww/backupagent/internal/agent"
+	"github.com/hoangsonww/backupagent/internal/api"
+)
+
+// newClient connects to the daemon API at server, with token or else the
+// token in $SHADOWVAULT_API_TOKEN
+func newClient(server, token string) (*api.Client, error) {
+	if server == "" {
+		return nil, fmt.Errorf("--server is required")
+	}
+	if token == "" {
+		token = os.Getenv("SHADOWVAULT_API_TOKEN")
+	}
+	if token == "" {
+		return nil, fmt.Errorf("an API token is required (--token or SHADOWVAULT_API_TOKEN)")
+	}
+	return api.NewClient(server, token)
+}
+
+// remoteCmd builds the commands that manage a daemon through its API
+// instead of opening the repository locally
+func remoteCmd() *cobra.Command {
+	var server, token string
+	client := func() (*api.Client, error) { return newClient(server, token) }
+
+	remote := &cobra.Command{
+		Use:   "remote",
+		Short: "Manage a remote daemon through its API",
+	}
+	remote.PersistentFlags().StringVar(&server, "server", "", "API URL of the daemon, e.g. http://nas.local:8081")
+	remote.PersistentFlags().StringVar(&token, "token", "", "API token (default: $SHADOWVAULT_API_TOKEN)")
+
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the daemon's health and identity",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			st, err := c.Status(context.Background())
+			if err != nil {
+				return err
+			}
+			return out.Result(st, func() {
+				fmt.Printf("Repository: %s\n", st.RepositoryID)
+				fmt.Printf("Peer ID:    %s\n", st.P2PID)
+				fmt.Printf("Peers:      %d connected\n", st.Peers)
+				fmt.Printf("Health:     %s (up %s)\n", st.Health.Status, st.Health.Uptime.Round(time.Second))
+				for name, comp := range st.Health.Components {
+					fmt.Printf("  %-16s %s %s\n", name, comp.Status, comp.Message)
+				}
+			})
+		},
+	}
+
+	snapshotsCmd := &cobra.Command{
+		Use:   "snapshots",
+		Short: "List the daemon's snapshots",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			snaps, err := c.Snapshots(context.Background())
+			if err != nil {
+				return err
+			}
+			res := make([]snapshotSummary, 0, len(snaps))
+			for _, snap := range snaps {
+				res = append(res, snapshotSummary{
+					ID:        snap.ID,
+					Parent:    snap.Parent,
+					Timestamp: snap.Timestamp.Time(),
+					Source:    snap.Source(),
+					RepoID:    snap.RepoID,
+					Chunks:    len(snap.Chunks),
+					Skipped:   len(snap.Errors),
+					Tags:      snap.Tags(),
+				})
+			}
+			return out.Result(res, func() {
+				for _, snap := range res {
+					fmt.Printf("%s  %s  %6d chunks  %s", snap.ID, snap.Timestamp.Local().Format(time.RFC1123),
+						snap.Chunks, snap.Source)
+					if len(snap.Tags) > 0 {
+						fmt.Printf("  [%s]", strings.Join(snap.Tags, ", "))
+					}
+					fmt.Println()
+				}
+				fmt.Printf("%d snapshots\n", len(res))
+			})
+		},
+	}
+
+	var backupTags []string
+	backupCmd := &cobra.Command{
+		Use:   "backup [path-on-daemon]",
+		Short: "Start a backup of a path on the daemon's host",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			sub, err := c.Backup(context.Background(), args[0], backupTags...)
+			if err != nil {
+				return err
+			}
+			return out.Result(sub, func() { printSubmitted(sub) })
+		},
+	}
+	backupCmd.Flags().StringArrayVar(&backupTags, "tag", nil, "label the snapshot, e.g. for retention.tags rules (repeatable)")
+
+	var limitRate string
+	var ioNice bool
+	restoreCmd := &cobra.Command{
+		Use:   "restore [snapshot-id] [target-on-daemon]",
+		Short: "Start a restore to a path on the daemon's host",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			rate, err := agent.ParseRate(limitRate)
+			if err != nil {
+				return err
+			}
+			th := agent.ThrottleSettings{LimitRate: rate, IONice: ioNice}
+			sub, err := c.Restore(context.Background(), args[0], args[1], th)
+			if err != nil {
+				return err
+			}
+			return out.Result(sub, func() { printSubmitted(sub) })
+		},
+	}
+	restoreCmd.Flags().StringVar(&limitRate, "limit-rate", "0", "restore at most this many bytes per second, e.g. 20M (0 is unlimited)")
+	restoreCmd.Flags().BoolVar(&ioNice, "io-nice", false, "restore with idle I/O priority and a lowered CPU priority (Linux)")
+
+	jobsCmd := &cobra.Command{
+		Use:   "jobs [operation-id]",
+		Short: "List backups, restores and GC runs, or show one",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			if len(args) == 1 {
+				op, err := c.Operation(context.Background(), args[0])
+				if err != nil {
+					return err
+				}
+				return out.Result(op, func() { printOperation(op) })
+			}
+			ops, err := c.Operations(context.Background())
+			if err != nil {
+				return err
+			}
+			return out.Result(ops, func() {
+				for _, op := range ops {
+					printOperation(op)
+				}
+			})
+		},
+	}
+
+	jobsThrottleCmd := &cobra.Command{
+		Use:   "throttle [operation-id]",
+		Short: "Change the rate limit or priority of a queued or running restore",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !cmd.Flags().Changed("limit-rate") && !cmd.Flags().Changed("io-nice") {
+				return fmt.Errorf("--limit-rate or --io-nice is required")
+			}
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			op, err := c.Operation(context.Background(), args[0])
+			if err != nil {
+				return err
+			}
+			var th agent.ThrottleSettings
+			if op.Throttle != nil {
+				th = *op.Throttle
+			}
+			if cmd.Flags().Changed("limit-rate") {
+				if th.LimitRate, err = agent.ParseRate(limitRate); err != nil {
+					return err
+				}
+			}
+			if cmd.Flags().Changed("io-nice") {
+				th.IONice = ioNice
+			}
+			op, err = c.AdjustOperation(context.Background(), args[0], th)
+			if err != nil {
+				return err
+			}
+			return out.Result(op, func() { printOperation(op) })
+		},
+	}
+	jobsThrottleCmd.Flags().StringVar(&limitRate, "limit-rate", "0", "new rate limit in bytes per second, e.g. 5M (0 is unlimited)")
+	jobsThrottleCmd.Flags().BoolVar(&ioNice, "io-nice", false, "idle I/O priority on or off, e.g. --io-nice=false")
+	jobsCancelCmd := &cobra.Command{
+		Use:   "cancel [operation-id]",
+		Short: "Cancel a queued or running backup, restore or GC run",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			op, err := c.CancelOperation(context.Background(), args[0])
+			if err != nil {
+				return err
+			}
+			return out.Result(op, func() {
+				if op.State == agent.OpRunning {
+					fmt.Printf("Cancelling %s %s; jobs %s shows when it has stopped\n", op.Kind, op.ID, op.ID)
+					return
+				}
+				printOperation(op)
+			})
+		},
+	}
+	jobsCmd.AddCommand(jobsThrottleCmd, jobsCancelCmd)
+
+	var gcLimit int
+	gcCmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Show recent garbage collection runs and the next scheduled one",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			st, err := c.GCStatus(context.Background(), gcLimit)
+			if err != nil {
+				return err
+			}
+			return out.Result(st, func() { printGCStatus(st) })
+		},
+	}
+	gcCmd.Flags().IntVarP(&gcLimit, "limit", "n", 10, "number of runs to show")
+
+	var forecastMonths int
+	var forecastWhatIf []int
+	forecastCmd := &cobra.Command{
+		Use:   "forecast",
+		Short: "Project the daemon's repository usage under its retention and alternatives",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			f, err := c.Forecast(context.Background(), forecastMonths, forecastWhatIf)
+			if err != nil {
+				return err
+			}
+			return out.Result(f, func() { printForecast(f) })
+		},
+	}
+	forecastCmd.Flags().IntVar(&forecastMonths, "months", 12, "months to project")
+	forecastCmd.Flags().IntSliceVar(&forecastWhatIf, "retention-days", nil, "also project this retention period in days (repeatable)")
+
+	maintenanceCmd := &cobra.Command{
+		Use:   "maintenance",
+		Short: "Show when GC and verification last ran and are next due",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			tasks, err := c.Maintenance(context.Background())
+			if err != nil {
+				return err
+			}
+			return out.Result(tasks, func() {
+				for _, t := range tasks {
+					state := "idle"
+					switch {
+					case t.Interrupted:
+						state = "paused"
+					case t.LastError != "":
+						state = "failed: " + t.LastError
+					}
+					last := "never"
+					if !t.LastDone.IsZero() {
+						last = t.LastDone.Local().Format(time.RFC3339)
+					}
+					fmt.Printf("%-8s last finished %s, next due %s, %s\n",
+						t.Name, last, t.NextDue.Local().Format(time.RFC3339), state)
+				}
+			})
+		},
+	}
+
+	peersCmd := &cobra.Command{
+		Use:   "peers",
+		Short: "List the daemon's connected peers",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			peers, err := c.Peers(context.Background())
+			if err != nil {
+				return err
+			}
+			return out.Result(peers, func() {
+				for _, p := range peers {
+					fmt.Printf("%s  %v\n", p.ID, p.Addrs)
+				}
+				fmt.Printf("%d peers\n", len(peers))
+			})
+		},
+	}
+	var force bool
+	peersAddCmd := &cobra.Command{
+		Use:   "add [multiaddr]",
+		Short: "Have the daemon connect to and store a peer",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			res, err := c.ConnectPeer(context.Background(), args[0], force)
+			if err != nil {
+				return err
+			}
+			return out.Result(res, func() { fmt.Printf("Added and connected to peer %s\n", res.PeerID) })
+		},
+	}
+	peersAddCmd.Flags().BoolVar(&force, "force", false, "add back a peer removed for abuse")
+	var broadcast, abuse bool
+	var removeReason string
+	peersRemoveCmd := &cobra.Command{
+		Use:   "remove [peerID]",
+		Short: "Have the daemon archive a peer out of its stored peer list",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			res, err := c.RemovePeer(context.Background(), args[0], removeReason, abuse, broadcast)
+			if err != nil {
+				return err
+			}
+			return out.Result(res, func() {
+				if res.OperationID != "" {
+					fmt.Printf("Removal of peer %s proposed, awaiting approval: %s\n", res.PeerID, res.OperationID)
+					return
+				}
+				fmt.Printf("Removed peer %s\n", res.PeerID)
+			})
+		},
+	}
+	peersRemoveCmd.Flags().BoolVar(&broadcast, "broadcast", false, "announce the signed removal to all peers")
+	peersRemoveCmd.Flags().StringVar(&removeReason, "reason", "", "reason recorded with the removal")
+	peersRemoveCmd.Flags().BoolVar(&abuse, "abuse", false, "refuse adding the peer back without --force")
+	peersRemovedCmd := &cobra.Command{
+		Use:   "removed",
+		Short: "List the daemon's removed peers and their removal history",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			removed, err := c.RemovedPeers(context.Background())
+			if err != nil {
+				return err
+			}
+			return out.Result(removed, func() {
+				for _, rp := range removed {
+					printRemovedPeer(rp)
+				}
+			})
+		},
+	}
+	peersRestoreCmd := &cobra.Command{
+		Use:   "restore [peerID]",
+		Short: "Have the daemon put a removed peer back on its stored peer list",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			rp, err := c.RestorePeer(context.Background(), args[0], force)
+			if err != nil {
+				return err
+			}
+			return out.Result(rp, func() { fmt.Printf("Restored peer %s %v\n", rp.Info.ID, rp.Info.Addrs) })
+		},
+	}
+	peersRestoreCmd.Flags().BoolVar(&force, "force", false, "restore a peer removed for abuse")
+	peersCmd.AddCommand(peersAddCmd, peersRemoveCmd, peersRemovedCmd, peersRestoreCmd)
+
+	var unsatisfiedOnly bool
+	placementCmd := &cobra.Command{
+		Use:   "placement",
+		Short: "Show where copies of each snapshot are and which placement requirements are unmet",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			report, err := c.Placement(context.Background())
+			if err != nil {
+				return err
+			}
+			type placement struct {
+				*agent.PlacementStatus
+				Satisfied bool `json:"satisfied"`
+			}
+			res := make([]placement, 0, len(report))
+			for _, st := range report {
+				if !unsatisfiedOnly || !st.Satisfied() {
+					res = append(res, placement{st, st.Satisfied()})
+				}
+			}
+			return out.Result(res, func() {
+				for _, st := range res {
+					state := "ok"
+					if !st.Satisfied {
+						state = "UNSATISFIED"
+					}
+					fmt.Printf("%s  %d copies  %s\n", st.SnapshotID, len(st.Copies), state)
+					for _, cp := range st.Copies {
+						fmt.Printf("  %s  %s\n", cp.PeerID, strings.Join(cp.Labels, ","))
+					}
+					for _, u := range st.Unmet {
+						fmt.Printf("  needs %s\n", u)
+					}
+					for _, f := range st.Forbidden {
+						fmt.Printf("  forbidden copy on %s\n", f)
+					}
+				}
+			})
+		},
+	}
+	placementCmd.Flags().BoolVar(&unsatisfiedOnly, "unsatisfied", false, "only show snapshots whose policy is not met")
+
+	shareCmd := &cobra.Command{
+		Use:   "share",
+		Short: "Manage read-only download links for snapshots",
+	}
+	var shareTTL time.Duration
+	var sharePath string
+	shareCreateCmd := &cobra.Command{
+		Use:   "create [snapshot-id]",
+		Short: "Mint a time-limited link to download a snapshot, or a file or directory in it, without the API token",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			share, err := c.CreateShare(context.Background(), args[0], sharePath, shareTTL)
+			if err != nil {
+				return err
+			}
+			res := struct {
+				*agent.ShareLink
+				URL string `json:"url"`
+			}{share.Link, share.URL}
+			return out.Result(res, func() {
+				fmt.Printf("Share %s of %s, expires %s\n", share.Link.ID, share.Link.SnapshotID,
+					share.Link.ExpiresAt.Local().Format(time.RFC1123))
+				fmt.Println(share.URL)
+			})
+		},
+	}
+	shareCreateCmd.Flags().DurationVar(&shareTTL, "ttl", 24*time.Hour, "how long the link stays valid")
+	shareCreateCmd.Flags().StringVar(&sharePath, "path", "", "share only this file, or this directory as a tar archive, relative to the source")
+	shareListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List share links and how often they were used",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			links, err := c.Shares(context.Background())
+			if err != nil {
+				return err
+			}
+			type shareState struct {
+				*agent.ShareLink
+				State string `json:"state"` // active, revoked or expired
+			}
+			res := make([]shareState, 0, len(links))
+			for _, l := range links {
+				state := "active"
+				switch {
+				case l.RevokedAt != nil:
+					state = "revoked"
+				case time.Now().After(l.ExpiresAt):
+					state = "expired"
+				}
+				res = append(res, shareState{l, state})
+			}
+			return out.Result(res, func() {
+				for _, l := range res {
+					fmt.Printf("%s  %-7s  %s  %s  expires %s  %d downloads\n", l.ID, l.State, l.SnapshotID, l.Name,
+						l.ExpiresAt.Local().Format(time.RFC3339), l.Downloads)
+				}
+				fmt.Printf("%d share links\n", len(res))
+			})
+		},
+	}
+	shareRevokeCmd := &cobra.Command{
+		Use:   "revoke [share-id]",
+		Short: "Revoke a share link before it expires",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			link, err := c.RevokeShare(context.Background(), args[0])
+			if err != nil {
+				return err
+			}
+			return out.Result(link, func() { fmt.Printf("Revoked share %s of %s\n", link.ID, link.SnapshotID) })
+		},
+	}
+	shareCmd.AddCommand(shareCreateCmd, shareListCmd, shareRevokeCmd)
+
+	debugCmd := &cobra.Command{
+		Use:   "debug",
+		Short: "Collect diagnostics from the daemon",
+	}
+	var dumpOut string
+	debugDumpCmd := &cobra.Command{
+		Use:   "dump",
+		Short: "Save goroutine stacks, connections, jobs, queues and recent errors for a bug report",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := client()
+			if err != nil {
+				return err
+			}
+			st, err := c.DebugState(context.Background())
+			if err != nil {
+				return err
+			}
+			data, err := json.MarshalIndent(st, "", "  ")
+			if err != nil {
+				return err
+			}
+			if dumpOut == "" {
+				dumpOut = "shadowvault-dump-" + st.CapturedAt.Format("20060102-150405") + ".json"
+			}
+			if err := os.WriteFile(dumpOut, data, 0600); err != nil {
+				return err
+			}
+			res := struct {
+				File         string `json:"file"`
+				Goroutines   int    `json:"goroutines"`
+				Peers        int    `json:"peers"`
+				Operations   int    `json:"operations"`
+				RecentErrors int    `json:"recent_errors"`
+			}{dumpOut, st.Goroutines, len(st.Peers), len(st.Operations), len(st.RecentErrors)}
+			return out.Result(res, func() {
+				fmt.Printf("Wrote %s: %d goroutines, %d peers, %d operations, %d recent errors\n",
+					dumpOut, st.Goroutines, len(st.Peers), len(st.Operations), len(st.RecentErrors))
+			})
+		},
+	}
+	debugDumpCmd.Flags().StringVarP(&dumpOut, "out", "o", "", "file to write (default shadowvault-dump-<time>.json)")
+	debugCmd.AddCommand(debugDumpCmd)
+
+	remote.AddCommand(statusCmd, snapshotsCmd, backupCmd, restoreCmd, jobsCmd, gcCmd, forecastCmd, maintenanceCmd, peersCmd, placementCmd, shareCmd, debugCmd)
+	return remote
+}
+
+// snapshotSummary is a snapshot as listed, without its chunk hashes
+type snapshotSummary struct {
+	ID        string    `json:"id"`
+	Parent    string    `json:"parent,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Source    string    `json:"source"`
+	RepoID    string    `json:"repo_id,omitempty"`
+	Chunks    int       `json:"chunks"`
+	Skipped   int       `json:"skipped"` // unreadable files left out
+	Tags      []string  `json:"tags,omitempty"`
+}
+
+// printSubmitted reports an accepted backup or restore
+func printSubmitted(sub *api.Submitted) {
+	op := sub.Operation
+	if op.State == agent.OpQueued {
+		fmt.Printf("Queued %s %s at position %d (request %s)\n", op.Kind, op.ID, op.Position, sub.RequestID)
+		return
+	}
+	fmt.Printf("Started %s %s (request %s)\n", op.Kind, op.ID, sub.RequestID)
+}
+
+// printRemovedPeer prints an archived peer and each of its removals
+func printRemovedPeer(rp *agent.RemovedPeer) {
+	state := "removed"
+	if !rp.Archived() {
+		state = "restored"
+	}
+	fmt.Printf("%s  %s  %v\n", rp.Info.ID, state, rp.Info.Addrs)
+	for _, r := range rp.Removals {
+		line := fmt.Sprintf("  removed %s by %s", r.RemovedAt.Local().Format(time.RFC3339), r.SignedBy)
+		if r.Abuse {
+			line += " for abuse"
+		}
+		if r.Reason != "" {
+			line += ": " + r.Reason
+		}
+		if r.RestoredAt != nil {
+			line += fmt.Sprintf(", restored %s", r.RestoredAt.Local().Format(time.RFC3339))
+		}
+		fmt.Println(line)
+	}
+}
+
+// printOperation prints one line per operation
+func printOperation(op *agent.Operation) {
+	line := fmt.Sprintf("%-24s %-8s %-8s %s", op.ID, op.Kind, op.State, op.Target)
+	if op.State == agent.OpQueued {
+		line += fmt.Sprintf("  (position %d)", op.Position)
+	}
+	if !op.FinishedAt.IsZero() && !op.StartedAt.IsZero() {
+		line += fmt.Sprintf("  took %s", op.FinishedAt.Sub(op.StartedAt).Round(time.Second))
+	}
+	fmt.Println(line)
+	if th := op.Throttle; th != nil && (th.LimitRate > 0 || th.IONice) {
+		limit := "unlimited"
+		if th.LimitRate > 0 {
+			limit = fmt.Sprintf("%.1f MiB/s", float64(th.LimitRate)/(1<<20))
+		}
+		fmt.Printf("  throttle: %s, io nice %t\n", limit, th.IONice)
+	}
+	if p := op.Progress; p != nil && op.State == agent.OpRunning {
+		fmt.Printf("  progress: %s\n", p)
+	}
+	if op.Error != "" {
+		fmt.Printf("  error: %s\n", op.Error)
+	}
+	if op.Warning != "" {
+		fmt.Printf("  warning: %s\n", op.Warning)
+	}
+}
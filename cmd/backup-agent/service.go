@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/hoangsonww/backupagent/config"
+	"github.com/hoangsonww/backupagent/internal/service"
+)
+
+// serviceCmd builds the commands registering the daemon with the platform's
+// service manager
+func serviceCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "service",
+		Short: "Run the daemon as a Windows service or launchd daemon",
+	}
+
+	var passFile, logFile string
+	installCmd := &cobra.Command{
+		Use:   "install",
+		Short: "Register the daemon with the service manager",
+		Long: `Registers "daemon --config <config> --pass-file <file>" as a Windows service,
+started at boot and restarted after failures, or as a launchd daemon in
+/Library/LaunchDaemons. The passphrase is never written into the service
+definition: keep --pass-file readable only by the account the service runs
+as. On macOS, with the API enabled, launchd opens the API port itself and
+hands the socket to the daemon.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if passFile == "" {
+				return fmt.Errorf("--pass-file is required; the service cannot be asked for the passphrase")
+			}
+			exe, err := os.Executable()
+			if err != nil {
+				return err
+			}
+			cfgPath, err := filepath.Abs(cfgFile)
+			if err != nil {
+				return err
+			}
+			passPath, err := filepath.Abs(passFile)
+			if err != nil {
+				return err
+			}
+			cfg, err := config.Load(cfgPath)
+			if err != nil {
+				return err
+			}
+			if _, err := readPassFile(passPath); err != nil {
+				return err
+			}
+			sc := service.Config{
+				Executable: exe,
+				Args:       []string{"daemon", "--config", cfgPath, "--pass-file", passPath},
+				Dir:        filepath.Dir(cfgPath),
+				LogFile:    logFile,
+			}
+			if cfg.API.Enable {
+				sc.APIPort = cfg.API.Port
+			}
+			start, err := service.Install(sc)
+			if err != nil {
+				return err
+			}
+			out.Printf("Installed. Start it with: %s\n", start)
+			return nil
+		},
+	}
+	installCmd.Flags().StringVar(&passFile, "pass-file", "", "file the service reads the passphrase from")
+	installCmd.Flags().StringVar(&logFile, "log-file", "/Library/Logs/ShadowVault.log", "where launchd writes the daemon's output (macOS)")
+
+	uninstallCmd := &cobra.Command{
+		Use:   "uninstall",
+		Short: "Remove the daemon from the service manager",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := service.Uninstall(); err != nil {
+				return err
+			}
+			out.Println("Uninstalled. A running daemon keeps running until stopped.")
+			return nil
+		},
+	}
+
+	cmd.AddCommand(installCmd, uninstallCmd)
+	return cmd
+}
+
+// readPassFile reads a passphrase kept in a file, without its line ending
+func readPassFile(name string) (string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	pass := strings.TrimRight(string(data), "\r\n")
+	if pass == "" {
+		return "", fmt.Errorf("%s holds no passphrase", name)
+	}
+	return pass, nil
+}
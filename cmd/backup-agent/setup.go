@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/hoangsonww/backupagent/internal/agent"
+	"github.com/hoangsonww/backupagent/internal/auth"
+	"github.com/hoangsonww/backupagent/internal/setup"
+	"github.com/hoangsonww/backupagent/internal/tui"
+)
+
+// setupCmd builds the first-run wizard
+func setupCmd() *cobra.Command {
+	var force bool
+	cmd := &cobra.Command{
+		Use:   "setup",
+		Short: "Walk through creating a config and repository",
+		Long: `Asks where to keep the repository, for a passphrase, which paths to back up
+and how often, and optionally for peers to connect to and trusted peers to
+hold recovery shares of the passphrase. The answers are written to the
+--config file once they validate, and the repository is created.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			w := &wizard{in: bufio.NewReader(os.Stdin)}
+			if _, err := os.Stat(cfgFile); err == nil && !force {
+				ok, err := w.confirm(fmt.Sprintf("%s exists. Replace it?", cfgFile), false)
+				if err != nil || !ok {
+					return err
+				}
+			}
+			return w.run()
+		},
+	}
+	cmd.Flags().BoolVar(&force, "force", false, "replace an existing config file without asking")
+	return cmd
+}
+
+// wizard asks the setup questions on stdin
+type wizard struct {
+	in *bufio.Reader
+}
+
+func (w *wizard) run() error {
+	fmt.Println("ShadowVault setup. Press Enter to take the [default].")
+	var a setup.Answers
+
+	// Repository
+	fmt.Println("\n1. Repository: where encrypted chunks and snapshot records are kept.")
+	for {
+		dir, err := w.ask("Repository directory", "./data")
+		if err != nil {
+			return err
+		}
+		if a.RepositoryPath, err = filepath.Abs(dir); err == nil {
+			err = os.MkdirAll(a.RepositoryPath, 0700)
+		}
+		if err == nil {
+			break
+		}
+		fmt.Println("  Cannot use it:", err)
+	}
+	existing := false
+	if _, err := os.Stat(filepath.Join(a.RepositoryPath, "metadata.db")); err == nil {
+		existing = true
+		fmt.Println("  This directory holds a repository already. Enter the passphrase it was created with.")
+	}
+	for {
+		port, err := w.ask("Port to listen on for peers", "9000")
+		if err != nil {
+			return err
+		}
+		if a.ListenPort, err = strconv.Atoi(port); err == nil && a.ListenPort > 0 && a.ListenPort < 65536 {
+			break
+		}
+		fmt.Println("  Enter a port between 1 and 65535")
+	}
+
+	// Passphrase
+	fmt.Println("\n2. Passphrase: encrypts everything. It is not stored; without it the backups cannot be read.")
+	pass := passphrase
+	for {
+		if pass == "" {
+			var err error
+			if pass, err = w.secret("Passphrase"); err != nil {
+				return err
+			}
+		}
+		s := setup.Rate(pass)
+		fmt.Printf("  Strength: %s (about %.0f bits)\n", s.Level, s.Bits)
+		for _, h := range s.Hints {
+			fmt.Println("  -", h)
+		}
+		if s.Level == setup.Weak && !existing {
+			ok, err := w.confirm("Use this weak passphrase anyway?", false)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				pass = ""
+				continue
+			}
+		}
+		if passphrase == "" {
+			again, err := w.secret("Repeat the passphrase")
+			if err != nil {
+				return err
+			}
+			if again != pass {
+				fmt.Println("  The passphrases differ, try again.")
+				pass = ""
+				continue
+			}
+		}
+		break
+	}
+
+	// Backup paths and schedule
+	fmt.Println("\n3. What to back up: directories or files, one per line; an empty line ends the list.")
+	for {
+		p, err := w.ask("Path", "")
+		if err != nil {
+			return err
+		}
+		if p == "" {
+			break
+		}
+		abs, err := filepath.Abs(p)
+		if err == nil {
+			_, err = os.Stat(abs)
+		}
+		if err != nil {
+			fmt.Println("  Cannot use it:", err)
+			continue
+		}
+		a.BackupPaths = append(a.BackupPaths, abs)
+	}
+	if len(a.BackupPaths) > 0 {
+		fmt.Println("\n4. Schedule: the daemon snapshots these paths on its own.")
+		for {
+			s, err := w.ask("Back up hourly, daily, weekly, never, or every (e.g. 6h)", "daily")
+			if err != nil {
+				return err
+			}
+			if a.Interval, err = setup.ParseInterval(s); err == nil {
+				break
+			}
+			fmt.Println(" ", err)
+		}
+	}
+
+	// Peers
+	fmt.Println("\n5. Peers: other ShadowVault nodes that hold copies. Enter a peer's address as shown")
+	fmt.Println("   when its daemon starts, e.g. /ip4/192.168.1.20/tcp/9000/p2p/12D3KooW..., or press Enter to skip.")
+	for {
+		addr, err := w.ask("Peer address", "")
+		if err != nil {
+			return err
+		}
+		if addr == "" {
+			break
+		}
+		if !strings.HasPrefix(addr, "/") || !strings.Contains(addr, "/p2p/") {
+			fmt.Println("  A peer address is a multiaddr ending in /p2p/<peer ID>")
+			continue
+		}
+		a.Peers = append(a.Peers, addr)
+		mirror, err := w.confirm("Mirror every snapshot to this peer, and its snapshots here?", false)
+		if err != nil {
+			return err
+		}
+		if mirror {
+			id, err := w.ask("Its repository ID (printed when its daemon starts)", "")
+			if err != nil {
+				return err
+			}
+			if id == "" {
+				fmt.Println("  Not mirrored: a mirror needs the peer's repository ID")
+				continue
+			}
+			a.Mirrors = append(a.Mirrors, setup.Mirror{Peer: addr, RepositoryID: id})
+		}
+	}
+
+	// Recovery shares
+	fmt.Println("\n6. Recovery: split the passphrase among trusted peers, any few of whom can give it back.")
+	share, err := w.confirm("Set up recovery shares?", false)
+	if err != nil {
+		return err
+	}
+	for share {
+		key, err := w.ask("Public key of a trustee (the owner key its setup printed; empty to finish)", "")
+		if err != nil {
+			return err
+		}
+		if key == "" {
+			if len(a.TrustedPeers) >= 2 {
+				break
+			}
+			fmt.Println("  Recovery needs at least 2 trustees")
+			if share, err = w.confirm("Add more?", true); err != nil {
+				return err
+			}
+			if !share {
+				a.TrustedPeers = nil
+			}
+			continue
+		}
+		if _, err := auth.StringToPubKey(key); err != nil {
+			fmt.Println("  Not a public key:", err)
+			continue
+		}
+		a.TrustedPeers = append(a.TrustedPeers, key)
+	}
+	if n := len(a.TrustedPeers); n > 0 {
+		for {
+			t, err := w.ask(fmt.Sprintf("Shares needed to recover (2-%d)", n), strconv.Itoa(n/2+1))
+			if err != nil {
+				return err
+			}
+			if a.Threshold, err = strconv.Atoi(t); err == nil && a.Threshold >= 2 && a.Threshold <= n {
+				break
+			}
+			fmt.Printf("  Enter a number from 2 to %d\n", n)
+		}
+	}
+
+	// Write and create the repository
+	cfg, err := setup.Write(cfgFile, &a)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nWrote %s\n", cfgFile)
+	ag, err := agent.New(cfg, pass)
+	if err != nil {
+		return fmt.Errorf("failed to open the repository: %w", err)
+	}
+	defer ag.Close()
+	fmt.Printf("Repository: %s\n", ag.RepoID)
+	fmt.Printf("Peer ID:    %s\n", ag.P2P.Host.ID())
+	fmt.Printf("Owner key:  %s\n", auth.PubKeyToString(ag.SignerPub))
+
+	fmt.Println("\nNext steps:")
+	fmt.Printf("  Start the daemon:  backup-agent daemon -c %s -p <passphrase>\n", cfgFile)
+	if len(a.BackupPaths) > 0 {
+		fmt.Printf("  Back up now:       backup-agent snapshot %s -c %s -p <passphrase>\n", a.BackupPaths[0], cfgFile)
+	}
+	if len(a.TrustedPeers) > 0 {
+		fmt.Printf("  Once the trustees are connected, send their shares:\n")
+		fmt.Printf("                     backup-agent recovery distribute -c %s -p <passphrase>\n", cfgFile)
+	}
+	if len(a.Peers) > 0 {
+		fmt.Println("  Give the peers this node's address and repository ID so they can add it too.")
+	}
+	return nil
+}
+
+// ask prints a question and reads the answer, or def for an empty one
+func (w *wizard) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	line, err := w.in.ReadString('\n')
+	if err != nil && line == "" {
+		if errors.Is(err, io.EOF) {
+			return "", errors.New("setup cancelled")
+		}
+		return "", err
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return def, nil
+	}
+	return line, nil
+}
+
+// confirm asks a yes or no question
+func (w *wizard) confirm(question string, def bool) (bool, error) {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	for {
+		fmt.Printf("%s [%s]: ", question, hint)
+		line, err := w.in.ReadString('\n')
+		if err != nil && line == "" {
+			if errors.Is(err, io.EOF) {
+				return false, errors.New("setup cancelled")
+			}
+			return false, err
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+	}
+}
+
+// secret reads a line without echoing it when stdin is a terminal
+func (w *wizard) secret(question string) (string, error) {
+	restore, hidden, err := tui.HideInput(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("%s: ", question)
+	line, err := w.in.ReadString('\n')
+	restore()
+	if hidden {
+		fmt.Println()
+	}
+	if err != nil && line == "" {
+		if errors.Is(err, io.EOF) {
+			return "", errors.New("setup cancelled")
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/hoangsonww/backupagent/internal/tui"
+)
+
+// tuiCmd builds the command that shows a daemon in a terminal UI
+func tuiCmd() *cobra.Command {
+	var server, token string
+	var refresh time.Duration
+	cmd := &cobra.Command{
+		Use:   "tui",
+		Short: "Watch and drive a daemon from a full-screen terminal UI",
+		Long: `Shows the daemon's jobs with their progress, its snapshots, its peers with
+their latency and score, and a tail of its log, refreshed through the API.
+Snapshots can be restored whole (r) or a file at a time (f) to a path on the
+daemon's host. Switch views with 1-4 or Tab, move with j/k or the arrow keys
+and quit with q.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if refresh < 100*time.Millisecond {
+				return fmt.Errorf("--refresh must be at least 100ms")
+			}
+			c, err := newClient(server, token)
+			if err != nil {
+				return err
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return tui.Run(ctx, c, os.Stdin, os.Stdout, refresh)
+		},
+	}
+	cmd.Flags().StringVar(&server, "server", "", "API URL of the daemon, e.g. http://nas.local:8081")
+	cmd.Flags().StringVar(&token, "token", "", "API token (default: $SHADOWVAULT_API_TOKEN)")
+	cmd.Flags().DurationVar(&refresh, "refresh", 2*time.Second, "How often to refresh")
+	return cmd
+}
@@ -2,33 +2,45 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 
-	"github.com/multiformats/go-multiaddr"
 	"github.com/spf13/cobra"
-	"go.etcd.io/bbolt"
 
 	"github.com/hoangsonww/backupagent/config"
 	"github.com/hoangsonww/backupagent/internal/agent"
-	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/auth"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/p2p"
+	"github.com/hoangsonww/backupagent/internal/protocol"
+	"github.com/hoangsonww/backupagent/internal/render"
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 var (
 	cfgFile    string
 	passphrase string
+
+	out = &render.Printer{Format: render.Table}
 )
 
 func main() {
 	root := &cobra.Command{
 		Use:   "peerctl",
 		Short: "Manage peers in backupagent network",
+		// Structured results own stdout; logs go to stderr with the notes
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if out.Structured() {
+				monitoring.GetLogger().SetOutput(os.Stderr)
+			}
+		},
 	}
 	root.PersistentFlags().StringVarP(&cfgFile, "config", "c", "config.yaml", "path to config")
 	root.PersistentFlags().StringVarP(&passphrase, "pass", "p", "", "passphrase (required)")
+	root.PersistentFlags().Var(&out.Format, "output", "print results as table, json or yaml")
 
+	var force bool
 	addCmd := &cobra.Command{
 		Use:   "add [multiaddr]",
 		Short: "Add and connect to a peer (multiaddr format)",
@@ -46,34 +58,22 @@ func main() {
 			if err != nil {
 				return err
 			}
-			maddr, err := multiaddr.NewMultiaddr(maddrStr)
-			if err != nil {
-				return err
-			}
-			info, err := peer.AddrInfoFromP2pAddr(maddr)
-			if err != nil {
-				return err
-			}
-			if err := ag.P2P.Host.Connect(context.Background(), *info); err != nil {
-				return err
-			}
-			// persist peer
-			err = ag.DB.Update(func(tx *bbolt.Tx) error {
-				b := tx.Bucket([]byte(persistence.BucketPeers))
-				val, _ := json.Marshal(info)
-				return b.Put([]byte(info.ID.String()), val)
-			})
+			pid, err := ag.AddPeer(context.Background(), maddrStr, force)
 			if err != nil {
 				return err
 			}
-			fmt.Printf("Added and connected to peer %s\n", info.ID.String())
-			return nil
+			res := peerResult{PeerID: pid.String()}
+			return out.Result(res, func() { fmt.Printf("Added and connected to peer %s\n", pid.String()) })
 		},
 	}
 
+	addCmd.Flags().BoolVar(&force, "force", false, "add back a peer removed for abuse")
+
+	var broadcast, abuse bool
+	var removeReason string
 	removeCmd := &cobra.Command{
 		Use:   "remove [peerID]",
-		Short: "Remove a peer from stored peer list",
+		Short: "Remove a peer from stored peer list, keeping it archived",
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if passphrase == "" {
@@ -88,17 +88,48 @@ func main() {
 			if err != nil {
 				return err
 			}
-			err = ag.DB.Update(func(tx *bbolt.Tx) error {
-				b := tx.Bucket([]byte(persistence.BucketPeers))
-				return b.Delete([]byte(peerID))
-			})
+			if broadcast {
+				opID, err := ag.RemovePeer(peerID, removeReason, abuse)
+				if err != nil {
+					return err
+				}
+				res := peerResult{PeerID: peerID, Broadcast: opID == "", OperationID: opID}
+				return out.Result(res, func() {
+					if opID != "" {
+						fmt.Printf("Removal of peer %s proposed, awaiting approval: %s\n", peerID, opID)
+						return
+					}
+					fmt.Printf("Removed peer %s and broadcast removal\n", peerID)
+				})
+			}
+			if err := ag.ForgetPeer(peerID, removeReason, abuse); err != nil {
+				return err
+			}
+			return out.Result(peerResult{PeerID: peerID}, func() { fmt.Printf("Removed peer %s\n", peerID) })
+		},
+	}
+
+	removeCmd.Flags().BoolVar(&broadcast, "broadcast", false, "announce the signed removal to all peers")
+	removeCmd.Flags().StringVar(&removeReason, "reason", "", "reason recorded with the removal")
+	removeCmd.Flags().BoolVar(&abuse, "abuse", false, "refuse adding the peer back without --force")
+
+	restoreCmd := &cobra.Command{
+		Use:   "restore [peerID]",
+		Short: "Put a removed peer back on the stored peer list",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
 			if err != nil {
 				return err
 			}
-			fmt.Printf("Removed peer %s\n", peerID)
-			return nil
+			rp, err := ag.RestorePeer(args[0], force)
+			if err != nil {
+				return err
+			}
+			return out.Result(rp, func() { fmt.Printf("Restored peer %s %v\n", rp.Info.ID, rp.Info.Addrs) })
 		},
 	}
+	restoreCmd.Flags().BoolVar(&force, "force", false, "restore a peer removed for abuse")
 
 	listCmd := &cobra.Command{
 		Use:   "list",
@@ -115,20 +146,393 @@ func main() {
 			if err != nil {
 				return err
 			}
-			err = ag.DB.View(func(tx *bbolt.Tx) error {
-				b := tx.Bucket([]byte(persistence.BucketPeers))
-				return b.ForEach(func(k, v []byte) error {
-					fmt.Printf("PeerID: %s\n", string(k))
-					return nil
-				})
+			peers, err := ag.StoredPeers()
+			if err != nil {
+				return err
+			}
+			pins, err := p2p.LoadPins(ag.DB)
+			if err != nil {
+				return err
+			}
+			quarantines, err := p2p.LoadQuarantines(ag.DB)
+			if err != nil {
+				return err
+			}
+			offers, err := p2p.LoadOffers(ag.DB)
+			if err != nil {
+				return err
+			}
+			removed, err := ag.RemovedPeers()
+			if err != nil {
+				return err
+			}
+
+			res := peerList{
+				Peers:       make([]string, 0, len(peers)),
+				Pinned:      make([]*p2p.Pin, 0, len(pins)),
+				Quarantined: []*p2p.Quarantine{},
+				Offers:      make([]peerOffer, 0, len(offers)),
+				Removed:     []peerRemoval{},
+			}
+			for _, info := range peers {
+				res.Peers = append(res.Peers, info.ID.String())
+			}
+			res.Pinned = append(res.Pinned, pins...)
+			now := time.Now()
+			for _, q := range quarantines {
+				if now.Before(q.Until) {
+					res.Quarantined = append(res.Quarantined, q)
+				}
+			}
+			for _, o := range offers {
+				res.Offers = append(res.Offers, peerOffer{o.PeerID, o.Capacity, o.Used, o.Free(), o.IssuedAt})
+			}
+			for _, rp := range removed {
+				if rp.Archived() {
+					res.Removed = append(res.Removed, peerRemoval{rp.Info.ID.String(), rp.Latest()})
+				}
+			}
+			return out.Result(res, func() { printPeerList(&res) })
+		},
+	}
+
+	var reason, effective string
+
+	adminCmd := &cobra.Command{
+		Use:   "admin",
+		Short: "Manage admin signing keys",
+	}
+
+	adminAddCmd := &cobra.Command{
+		Use:   "add [admin-pubkey]",
+		Short: "Grant admin rights to a key",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return issueAdminUpdate(protocol.AdminActionAdd, args[0], "", reason, effective)
+		},
+	}
+
+	adminRotateCmd := &cobra.Command{
+		Use:   "rotate [old-pubkey] [new-pubkey]",
+		Short: "Replace an admin key, revoking the old one",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return issueAdminUpdate(protocol.AdminActionRotate, args[0], args[1], reason, effective)
+		},
+	}
+
+	adminRevokeCmd := &cobra.Command{
+		Use:   "revoke [admin-pubkey]",
+		Short: "Revoke an admin key",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return issueAdminUpdate(protocol.AdminActionRevoke, args[0], "", reason, effective)
+		},
+	}
+
+	adminListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List active admins and revoked keys",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			res := struct {
+				Admins  []string               `json:"admins"`
+				Revoked []auth.RevocationEntry `json:"revoked"`
+			}{append([]string{}, ag.ACL.ActiveAdmins()...), ag.ACL.Revocations()}
+			return out.Result(res, func() {
+				for _, pub := range res.Admins {
+					fmt.Printf("Admin: %s\n", pub)
+				}
+				for _, r := range res.Revoked {
+					fmt.Printf("Revoked: %s at %s\n", r.AdminPub, r.RevokedAt.Format(time.RFC3339))
+				}
 			})
-			return err
 		},
 	}
 
-	root.AddCommand(addCmd, removeCmd, listCmd)
+	for _, c := range []*cobra.Command{adminAddCmd, adminRotateCmd, adminRevokeCmd} {
+		c.Flags().StringVar(&reason, "reason", "", "reason recorded with the update")
+	}
+	for _, c := range []*cobra.Command{adminRotateCmd, adminRevokeCmd} {
+		c.Flags().StringVar(&effective, "effective", "", "RFC3339 time the revocation takes effect (default now)")
+	}
+	adminCmd.AddCommand(adminAddCmd, adminRotateCmd, adminRevokeCmd, adminListCmd)
+
+	approvalsCmd := &cobra.Command{
+		Use:   "approvals",
+		Short: "Review operations awaiting a second admin (two-person rule)",
+	}
+
+	approvalsListCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List pending operations",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			ops, err := ag.Approvals.Pending()
+			if err != nil {
+				return err
+			}
+			return out.Result(ops, func() {
+				for _, op := range ops {
+					fmt.Printf("%s  %-18s proposed by %s at %s (%d approval(s))\n",
+						op.ID, op.Proposal.Kind, op.Proposal.ProposerPub, op.Proposal.ProposedAt, len(op.Approvals))
+				}
+			})
+		},
+	}
+
+	approvalsApproveCmd := &cobra.Command{
+		Use:   "approve [operation-id]",
+		Short: "Approve a pending operation with this node's admin key",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			if err := ag.ApproveOperation(args[0]); err != nil {
+				return err
+			}
+			res := struct {
+				OperationID string `json:"operation_id"`
+				Approved    bool   `json:"approved"`
+			}{args[0], true}
+			return out.Result(res, func() { fmt.Printf("Approved operation %s\n", args[0]) })
+		},
+	}
+	approvalsCmd.AddCommand(approvalsListCmd, approvalsApproveCmd)
+
+	var pingCount int
+	pingCmd := &cobra.Command{
+		Use:   "ping [peerID|multiaddr]",
+		Short: "Measure round-trip latency to a peer with libp2p ping",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			pid, err := ag.ConnectPeer(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			res, err := p2p.Ping(ctx, ag.P2P.Host, pid, pingCount)
+			if !out.Structured() {
+				for i, rtt := range res.RTTs {
+					fmt.Printf("ping %d: %s\n", i+1, rtt)
+				}
+			}
+			if err != nil {
+				return err
+			}
+			ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+			pinged := struct {
+				PeerID    string    `json:"peer_id"`
+				RTTs      []float64 `json:"rtts_ms"`
+				AverageMS float64   `json:"average_ms"`
+			}{PeerID: pid.String(), RTTs: []float64{}, AverageMS: ms(res.Average)}
+			for _, rtt := range res.RTTs {
+				pinged.RTTs = append(pinged.RTTs, ms(rtt))
+			}
+			return out.Result(pinged, func() {
+				fmt.Printf("%d ping(s) to %s, average %s\n", len(res.RTTs), pid, res.Average)
+			})
+		},
+	}
+	pingCmd.Flags().IntVar(&pingCount, "count", 5, "number of pings to send")
+
+	var testSize int
+	fetchTestCmd := &cobra.Command{
+		Use:   "fetch-test [peerID|multiaddr]",
+		Short: "Store a random test chunk on a peer and fetch it back",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			if testSize <= 0 || testSize > ag.Config.Snapshot.MaxChunkSize {
+				return fmt.Errorf("--size must be between 1 and %d", ag.Config.Snapshot.MaxChunkSize)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			pid, err := ag.ConnectPeer(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			res, err := p2p.FetchTest(ctx, ag.P2P.Host, pid, testSize)
+			if err != nil {
+				return err
+			}
+			tested := struct {
+				PeerID    string  `json:"peer_id"`
+				Size      int     `json:"size"`
+				StoreMS   int64   `json:"store_ms"`
+				StoreRate float64 `json:"store_rate"` // bytes per second
+				FetchMS   int64   `json:"fetch_ms"`
+				FetchRate float64 `json:"fetch_rate"` // bytes per second
+				Verified  bool    `json:"verified"`
+			}{pid.String(), res.Size, res.UploadTime.Milliseconds(), res.UploadBytesSec, res.DownloadTime.Milliseconds(), res.FetchBytesSec, true}
+			return out.Result(tested, func() {
+				fmt.Printf("Round trip of %d bytes with %s verified\n", res.Size, pid)
+				fmt.Printf("  store: %s (%.1f KiB/s)\n", res.UploadTime, res.UploadBytesSec/1024)
+				fmt.Printf("  fetch: %s (%.1f KiB/s)\n", res.DownloadTime, res.FetchBytesSec/1024)
+			})
+		},
+	}
+	fetchTestCmd.Flags().IntVar(&testSize, "size", 64*1024, "test chunk size in bytes")
+
+	pinCmd := &cobra.Command{
+		Use:   "pin [peerID|multiaddr]",
+		Short: "Keep a peer connected at all times, alerting when it is unreachable",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			info, err := ag.LookupPeer(args[0])
+			if err != nil {
+				return err
+			}
+			if len(info.Addrs) == 0 {
+				return fmt.Errorf("no known address for %s; pin it by multiaddr", info.ID)
+			}
+			if err := ag.P2P.Pins.Pin(*info); err != nil {
+				return err
+			}
+			return out.Result(peerResult{PeerID: info.ID.String()}, func() { fmt.Printf("Pinned peer %s\n", info.ID) })
+		},
+	}
+
+	unpinCmd := &cobra.Command{
+		Use:   "unpin [peerID]",
+		Short: "Stop maintaining a pinned peer's connection",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			pid, err := peer.Decode(args[0])
+			if err != nil {
+				return err
+			}
+			ag, err := loadAgent()
+			if err != nil {
+				return err
+			}
+			if err := ag.P2P.Pins.Unpin(pid); err != nil {
+				return err
+			}
+			return out.Result(peerResult{PeerID: pid.String()}, func() { fmt.Printf("Unpinned peer %s\n", pid) })
+		},
+	}
+
+	root.AddCommand(addCmd, removeCmd, restoreCmd, listCmd, adminCmd, approvalsCmd, pingCmd, fetchTestCmd, pinCmd, unpinCmd)
 	if err := root.Execute(); err != nil {
-		fmt.Println("peerctl error:", err)
-		os.Exit(1)
+		out.Fail("peerctl error:", err)
+		os.Exit(render.ExitError)
+	}
+}
+
+// peerResult is the result of a change to one peer
+type peerResult struct {
+	PeerID      string `json:"peer_id"`
+	Broadcast   bool   `json:"broadcast,omitempty"`    // the removal was announced to all peers
+	OperationID string `json:"operation_id,omitempty"` // set when awaiting approval
+}
+
+// peerList is the result of list
+type peerList struct {
+	Peers       []string          `json:"peers"`
+	Pinned      []*p2p.Pin        `json:"pinned"`
+	Quarantined []*p2p.Quarantine `json:"quarantined"` // in force now
+	Offers      []peerOffer       `json:"offers"`
+	Removed     []peerRemoval     `json:"removed"` // archived, with their latest removal
+}
+
+type peerOffer struct {
+	PeerID   string `json:"peer_id"`
+	Capacity int64  `json:"capacity"` // bytes
+	Used     int64  `json:"used"`
+	Free     int64  `json:"free"`
+	IssuedAt string `json:"issued_at"`
+}
+
+type peerRemoval struct {
+	PeerID string `json:"peer_id"`
+	*agent.PeerRemoval
+}
+
+func printPeerList(l *peerList) {
+	for _, id := range l.Peers {
+		fmt.Printf("PeerID: %s\n", id)
+	}
+	for _, p := range l.Pinned {
+		fmt.Printf("Pinned: %s since %s %v\n", p.PeerID, p.PinnedAt.Format(time.RFC3339), p.Addrs)
+	}
+	for _, q := range l.Quarantined {
+		fmt.Printf("Quarantined: %s until %s (%s, score %.0f)\n",
+			q.PeerID, q.Until.Format(time.RFC3339), q.Reason, q.Score)
+	}
+	for _, o := range l.Offers {
+		fmt.Printf("Offer: %s offers %.1f GiB, %.1f GiB used, %.1f GiB free (as of %s)\n",
+			o.PeerID, float64(o.Capacity)/(1<<30), float64(o.Used)/(1<<30), float64(o.Free)/(1<<30), o.IssuedAt)
+	}
+	for _, r := range l.Removed {
+		kind := "Removed"
+		if r.Abuse {
+			kind = "Removed for abuse"
+		}
+		fmt.Printf("%s: %s at %s by %s (%s)\n", kind, r.PeerID, r.RemovedAt.Format(time.RFC3339), r.SignedBy, r.Reason)
+	}
+}
+
+// loadAgent loads config and constructs an agent from the global flags
+func loadAgent() (*agent.Agent, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("passphrase is required")
+	}
+	cfg, err := config.Load(cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	return agent.New(cfg, passphrase)
+}
+
+// issueAdminUpdate signs and gossips an admin key update with this node's key
+func issueAdminUpdate(action, adminPub, newAdminPub, reason, effective string) error {
+	var effectiveAt time.Time
+	if effective != "" {
+		t, err := time.Parse(time.RFC3339, effective)
+		if err != nil {
+			return fmt.Errorf("invalid --effective time: %w", err)
+		}
+		effectiveAt = t
+	}
+	ag, err := loadAgent()
+	if err != nil {
+		return err
+	}
+	opID, err := ag.IssueAdminKeyUpdate(action, adminPub, newAdminPub, reason, effectiveAt)
+	if err != nil {
+		return err
 	}
+	res := struct {
+		Action      string `json:"action"`
+		AdminKey    string `json:"admin_key"`
+		OperationID string `json:"operation_id,omitempty"` // set when awaiting approval
+	}{action, adminPub, opID}
+	return out.Result(res, func() {
+		if opID != "" {
+			fmt.Printf("Admin %s of %s proposed, awaiting approval: %s\n", action, adminPub, opID)
+			return
+		}
+		fmt.Printf("Admin %s of %s applied and broadcast\n", action, adminPub)
+	})
 }
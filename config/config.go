@@ -8,6 +8,13 @@ import (
 	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/hoangsonww/backupagent/internal/chunker"
+	"github.com/hoangsonww/backupagent/internal/compression"
+	"github.com/hoangsonww/backupagent/internal/contentpolicy"
+	"github.com/hoangsonww/backupagent/internal/exclude"
+	"github.com/hoangsonww/backupagent/internal/gc"
+	"github.com/hoangsonww/backupagent/internal/scheduler"
 )
 
 type NATConfig struct {
@@ -16,33 +23,118 @@ type NATConfig struct {
 }
 
 type SnapshotConfig struct {
-	MinChunkSize int  `yaml:"min_chunk_size"`
-	MaxChunkSize int  `yaml:"max_chunk_size"`
-	AvgChunkSize int  `yaml:"avg_chunk_size"`
-	Compression  bool `yaml:"compression"`
+	MinChunkSize  int      `yaml:"min_chunk_size"`
+	MaxChunkSize  int      `yaml:"max_chunk_size"`
+	AvgChunkSize  int      `yaml:"avg_chunk_size"`
+	Compression   bool     `yaml:"compression"`    // zstd-compress chunks before encryption; on unless set to false
+	ChangeJournal string   `yaml:"change_journal"` // "auto" uses the OS change journal when available, "off" always walks
+	Chunker       string   `yaml:"chunker"`        // fnv, fastcdc, buzhash or fixed; empty keeps the repository's algorithm unless it is fnv
+	OnError       string   `yaml:"on_error"`       // unreadable files: fail, skip-and-report or retry
+	PlainMetadata bool     `yaml:"plain_metadata"` // leave paths and host in manifests readable to peers, for peers predating sealed metadata
+	Excludes      []string `yaml:"excludes"`       // gitignore-style patterns of paths left out of snapshots
+	// NoDefaultExcludes stops leaving out exclude.Defaults and directories
+	// tagged with CACHEDIR.TAG
+	NoDefaultExcludes bool `yaml:"no_default_excludes"`
+	// ContentPolicy flags files that look like secrets, such as private
+	// keys and .env files with credentials, and in enforce mode leaves them
+	// out
+	ContentPolicy contentpolicy.Config `yaml:"content_policy"`
+
+	// CompressionLevels overrides the zstd level per content type (text,
+	// binary, image, video, audio, archive); 0 stores that type as it is
+	CompressionLevels map[string]int `yaml:"compression_levels"`
+	// CompressionDicts compresses each content type against the newest
+	// dictionary trained for it by compression train, if any
+	CompressionDicts bool `yaml:"compression_dicts"`
 }
 
 type ACLConfig struct {
-	Admins []string `yaml:"admins"`
+	Admins        []string      `yaml:"admins"`
+	TwoPersonRule bool          `yaml:"two_person_rule"` // destructive remote ops need two admin signatures
+	ApprovalTTL   time.Duration `yaml:"approval_ttl"`    // how long a proposal waits for its second approval
 }
 
 type P2PConfig struct {
-	MaxPeers            int           `yaml:"max_peers"`
-	ConnectionTimeout   time.Duration `yaml:"connection_timeout"`
-	DiscoveryInterval   time.Duration `yaml:"discovery_interval"`
-	HeartbeatInterval   time.Duration `yaml:"heartbeat_interval"`
-	MaxConcurrentFetch  int           `yaml:"max_concurrent_fetch"`
-	ChunkFetchTimeout   time.Duration `yaml:"chunk_fetch_timeout"`
-	ReconnectBackoff    time.Duration `yaml:"reconnect_backoff"`
-	MaxReconnectBackoff time.Duration `yaml:"max_reconnect_backoff"`
+	MaxPeers             int           `yaml:"max_peers"`
+	ConnectionTimeout    time.Duration `yaml:"connection_timeout"`
+	DiscoveryInterval    time.Duration `yaml:"discovery_interval"`
+	HeartbeatInterval    time.Duration `yaml:"heartbeat_interval"`
+	MaxConcurrentFetch   int           `yaml:"max_concurrent_fetch"`
+	ChunkFetchTimeout    time.Duration `yaml:"chunk_fetch_timeout"`     // wait for a chunk from a peer not yet measured
+	ChunkFetchTimeoutMin time.Duration `yaml:"chunk_fetch_timeout_min"` // bounds of the wait computed from a peer's measured link
+	ChunkFetchTimeoutMax time.Duration `yaml:"chunk_fetch_timeout_max"`
+	FetchAttempts        int           `yaml:"fetch_attempts"`         // providers asked in turn for a chunk before it is queued
+	MissingRetryInterval time.Duration `yaml:"missing_retry_interval"` // how often queued missing chunks are asked for again
+	FullAnnouncements    bool          `yaml:"full_announcements"`     // broadcast whole manifests instead of headers, for older peers
+	VerifyReceived       string        `yaml:"verify_received"`        // test-decrypt chunks received from peers: "all", "sample" or "off"
+	VerifySampleRate     float64       `yaml:"verify_sample_rate"`     // fraction of received chunks checked under "sample"
+	ReconnectBackoff     time.Duration `yaml:"reconnect_backoff"`
+	MaxReconnectBackoff  time.Duration `yaml:"max_reconnect_backoff"`
+	PEXTrust             string        `yaml:"pex_trust"`       // "admins", "all" or "none"
+	PEXInterval          time.Duration `yaml:"pex_interval"`    // how often to share our peer list
+	PinAlertAfter        time.Duration `yaml:"pin_alert_after"` // alert when a pinned peer is down this long
+	StorageOffer         int64         `yaml:"storage_offer"`   // bytes offered to host for the swarm; 0 advertises nothing
+	OfferInterval        time.Duration `yaml:"offer_interval"`  // how often to advertise the storage offer
+	ControlTopic         string        `yaml:"control_topic"`   // pubsub topic of announcements and peer management
+	DataTopic            string        `yaml:"data_topic"`      // pubsub topic of chunk requests and responses; the control topic carries them too when equal
+	ChunkPubsub          string        `yaml:"chunk_pubsub"`    // "compat" still exchanges chunks on the data topic with peers predating the chunk protocol, "off" never
 }
 
 type StorageConfig struct {
-	MaxCacheSize        int64         `yaml:"max_cache_size"`
+	MaxCacheSize        int64         `yaml:"max_cache_size"` // bytes of memory holding the chunks peers ask for most
 	GCInterval          time.Duration `yaml:"gc_interval"`
+	GCGrace             time.Duration `yaml:"gc_grace"` // how long a chunk stays unreferenced before GC deletes it
 	RetentionDays       int           `yaml:"retention_days"`
 	VerifyOnRestore     bool          `yaml:"verify_on_restore"`
 	EnableDeduplication bool          `yaml:"enable_deduplication"`
+	Backend             string        `yaml:"backend"`           // "bbolt" keeps chunks in the metadata DB, "filesystem" a file each under chunks/, "s3" an object each in S3, "sftp" a file each over SSH, "pack" appended to pack files under packs/
+	Durability          string        `yaml:"durability"`        // "sync" commits each ingest batch, "wal" stages chunks in a write-ahead log
+	WALSyncInterval     time.Duration `yaml:"wal_sync_interval"` // group commit window in wal mode
+	WALMaxPending       int64         `yaml:"wal_max_pending"`   // chunk bytes logged but not yet indexed in wal mode
+	RestoreReadahead    int           `yaml:"restore_readahead"` // chunks a restore reads per transaction and advises ahead
+	RestorePrewarm      bool          `yaml:"restore_prewarm"`   // load every chunk of a snapshot into the page cache before restoring
+	Retention           gc.Policy     `yaml:"retention"`         // keep_last/daily/weekly/monthly/yearly rules; snapshots without rules follow retention_days
+	S3                  S3Config      `yaml:"s3"`                // the bucket of the s3 backend
+	SFTP                SFTPConfig    `yaml:"sftp"`              // the server of the sftp backend
+	Pack                PackConfig    `yaml:"pack"`              // pack files of the pack backend
+}
+
+// PackConfig sizes the pack files of the pack backend and says when GC
+// rewrites them.
+type PackConfig struct {
+	Size            int64   `yaml:"size"`             // bytes a pack grows to before the next is started
+	RepackThreshold float64 `yaml:"repack_threshold"` // GC rewrites packs whose live share of bytes falls below this
+}
+
+// S3Config is the S3-compatible object store, such as AWS S3 or MinIO, that
+// the s3 backend keeps chunks and snapshot records in.
+type S3Config struct {
+	Endpoint        string        `yaml:"endpoint"` // e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Region          string        `yaml:"region"`
+	Bucket          string        `yaml:"bucket"`
+	Prefix          string        `yaml:"prefix"` // key prefix, so repositories can share a bucket
+	AccessKeyID     string        `yaml:"access_key_id"`
+	SecretAccessKey string        `yaml:"secret_access_key"` // prefer SHADOWVAULT_S3_SECRET_ACCESS_KEY
+	SessionToken    string        `yaml:"session_token"`
+	PathStyle       bool          `yaml:"path_style"`  // bucket in the path rather than the host name, as MinIO expects
+	MaxRetries      int           `yaml:"max_retries"` // retries of a request failing with a network error, 5xx or 429
+	RetryDelay      time.Duration `yaml:"retry_delay"` // wait before the first retry; it doubles each time
+	Timeout         time.Duration `yaml:"timeout"`     // bound on each request
+}
+
+// SFTPConfig is the SSH server the sftp backend keeps chunks on, for
+// repositories whose only off-site storage is a plain SSH account.
+type SFTPConfig struct {
+	Host       string        `yaml:"host"` // host or host:port; port 22 if omitted
+	User       string        `yaml:"user"`
+	Path       string        `yaml:"path"`        // remote directory holding the chunks
+	Password   string        `yaml:"password"`    // prefer key_file, or SHADOWVAULT_SFTP_PASSWORD
+	KeyFile    string        `yaml:"key_file"`    // unencrypted private key
+	KnownHosts string        `yaml:"known_hosts"` // host keys accepted; ~/.ssh/known_hosts if empty
+	MaxConns   int           `yaml:"max_conns"`   // connections kept open for parallel transfers
+	MaxRetries int           `yaml:"max_retries"` // retries of a transfer whose connection failed; uploads resume
+	RetryDelay time.Duration `yaml:"retry_delay"` // wait before the first retry; it doubles each time
+	Timeout    time.Duration `yaml:"timeout"`     // bound on connecting
 }
 
 type MonitoringConfig struct {
@@ -55,6 +147,12 @@ type MonitoringConfig struct {
 	LogFormat       string `yaml:"log_format"` // "json" or "text"
 	EnableTracing   bool   `yaml:"enable_tracing"`
 	TracingEndpoint string `yaml:"tracing_endpoint"`
+
+	// SlowRequestThreshold logs API requests that take longer as slow
+	SlowRequestThreshold time.Duration `yaml:"slow_request_threshold"`
+	// ProgressInterval is how often running backups and restores log their
+	// progress
+	ProgressInterval time.Duration `yaml:"progress_interval"`
 }
 
 type SchedulerConfig struct {
@@ -62,29 +160,194 @@ type SchedulerConfig struct {
 	BackupInterval   time.Duration `yaml:"backup_interval"`
 	BackupPaths      []string      `yaml:"backup_paths"`
 	MaxBackupRetries int           `yaml:"max_backup_retries"`
+	// SourceGroups are sets of paths each backed up together, on the same
+	// schedule as BackupPaths, into one snapshot with one history
+	SourceGroups []SourceGroup `yaml:"source_groups"`
+
+	// Shell commands run around every backup, scheduled or asked for by
+	// the snapshot command or the API, with SHADOWVAULT_* variables
+	// describing it
+	PreBackup   string        `yaml:"pre_backup"`   // a failure cancels the backup
+	PostBackup  string        `yaml:"post_backup"`  // after a backup that succeeded
+	OnFailure   string        `yaml:"on_failure"`   // after a backup that failed or was cancelled
+	HookTimeout time.Duration `yaml:"hook_timeout"` // per hook command
+
+	// ShutdownPaths are snapshotted, without the hooks, when the system is
+	// about to shut down or a user logs out, stopping after ShutdownBudget
+	ShutdownPaths  []string      `yaml:"shutdown_paths"`
+	ShutdownBudget time.Duration `yaml:"shutdown_budget"`
+}
+
+// SourceGroup names paths that are captured together into one snapshot,
+// e.g. the configuration and content of a web server.
+type SourceGroup struct {
+	Name  string   `yaml:"name"` // letters, digits and - _ .
+	Paths []string `yaml:"paths"`
 }
 
 type SecurityConfig struct {
-	EnableRateLimiting bool     `yaml:"enable_rate_limiting"`
-	RequestsPerSecond  int      `yaml:"requests_per_second"`
-	BurstSize          int      `yaml:"burst_size"`
-	EnableIPWhitelist  bool     `yaml:"enable_ip_whitelist"`
-	WhitelistedIPs     []string `yaml:"whitelisted_ips"`
-	MaxRequestSize     int64    `yaml:"max_request_size"`
+	EnableRateLimiting    bool     `yaml:"enable_rate_limiting"`
+	RequestsPerSecond     int      `yaml:"requests_per_second"` // per peer, on the control topic
+	BurstSize             int      `yaml:"burst_size"`
+	DataRequestsPerSecond int      `yaml:"data_requests_per_second"` // per peer, on the data topic
+	DataBurstSize         int      `yaml:"data_burst_size"`
+	EnableIPWhitelist     bool     `yaml:"enable_ip_whitelist"`
+	WhitelistedIPs        []string `yaml:"whitelisted_ips"`
+	MaxRequestSize        int64    `yaml:"max_request_size"`
+
+	// Peer misbehaviour scoring
+	QuarantineThreshold float64       `yaml:"quarantine_threshold"` // score at which a peer is quarantined
+	ScoreHalfLife       time.Duration `yaml:"score_half_life"`      // time for a peer's score to halve
+	QuarantineDuration  time.Duration `yaml:"quarantine_duration"`  // how long a quarantined peer is banned
+}
+
+type RecoveryConfig struct {
+	TrustedPeers []string `yaml:"trusted_peers"` // base64 ed25519 pub keys holding key shares
+	Threshold    int      `yaml:"threshold"`     // shares needed to recover
+}
+
+// SeedingConfig throttles the first, full backup of a large tree.
+type SeedingConfig struct {
+	ActiveHours string `yaml:"active_hours"`  // e.g. "22:00-06:00"; empty seeds at any time
+	MaxReadRate int64  `yaml:"max_read_rate"` // bytes per second read from disk; 0 is unlimited
+}
+
+// MaintenanceConfig confines background upkeep to a daily window.
+type MaintenanceConfig struct {
+	Window         string        `yaml:"window"`          // e.g. "01:00-05:00"; empty runs at any time
+	Budget         time.Duration `yaml:"budget"`          // most time spent per window; 0 is unlimited
+	Order          []string      `yaml:"order"`           // tasks by priority, highest first; unlisted tasks do not run
+	VerifyInterval time.Duration `yaml:"verify_interval"` // between full local verification passes
+	VerifyWorkers  int           `yaml:"verify_workers"`  // chunks verified at once; 0 uses one per CPU
+	VerifyBudget   time.Duration `yaml:"verify_budget"`   // most time one verification run spends; 0 is unlimited
+	VerifyMaxRead  int64         `yaml:"verify_max_read"` // most chunk bytes one verification run reads; 0 is unlimited
+}
+
+// MaintenanceTasks are the tasks maintenance.order can list, in their
+// default order.
+var MaintenanceTasks = []string{"gc", "verify"}
+
+// AdmissionConfig bounds how many heavy operations the daemon runs at once.
+type AdmissionConfig struct {
+	MaxBackups  int `yaml:"max_concurrent_backups"`
+	MaxRestores int `yaml:"max_concurrent_restores"`
+	MaxQueued   int `yaml:"max_queued"` // per operation kind; further requests are rejected
+}
+
+// ResourcesConfig sets soft limits on the daemon's own resource use. While
+// one is exceeded the daemon stops serving chunk requests from peers and
+// holds back new backups, restores and maintenance, until usage is back
+// under 90% of every limit.
+type ResourcesConfig struct {
+	MaxMemoryMB   int           `yaml:"max_memory_mb"`  // memory held from the OS; 0 is unlimited
+	MaxGoroutines int           `yaml:"max_goroutines"` // 0 is unlimited
+	CheckInterval time.Duration `yaml:"check_interval"` // how often usage is sampled and published
+	WebhookURL    string        `yaml:"webhook_url"`    // POSTed a JSON notification when a limit is exceeded and cleared
+}
+
+// APIConfig serves the management API, for the remote CLI and dashboards.
+type APIConfig struct {
+	Enable bool   `yaml:"enable"`
+	Port   int    `yaml:"port"`
+	Token  string `yaml:"token"` // required bearer token; prefer SHADOWVAULT_API_TOKEN
+
+	ShareMaxTTL time.Duration `yaml:"share_max_ttl"` // longest lifetime of a share link
+}
+
+// RestoreConfig guards what restores write.
+type RestoreConfig struct {
+	// ScanCommand is run on each restored file before it is moved into
+	// place, reading it on stdin; exit 1 quarantines the file
+	ScanCommand   string        `yaml:"scan_command"`
+	ScanTimeout   time.Duration `yaml:"scan_timeout"`   // per file
+	QuarantineDir string        `yaml:"quarantine_dir"` // where flagged files go; <repository_path>/quarantine if empty
+}
+
+// MetadataBackupConfig schedules encrypted exports of the repository metadata.
+type MetadataBackupConfig struct {
+	Disable   bool          `yaml:"disable"`
+	Interval  time.Duration `yaml:"interval"`   // how often to export when something changed
+	Keep      int           `yaml:"keep"`       // newest exports kept
+	ExportDir string        `yaml:"export_dir"` // also write the newest export here, e.g. a cloud-synced folder
+}
+
+// CacheConfig turns the node into a cache node, which keeps chunks of any
+// repository it recently fetched for peers and serves them again. Its
+// chunks are not copies: it takes no pushes and offers no storage.
+type CacheConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Dir      string `yaml:"dir"`       // <repository_path>/cache if empty
+	Size     int64  `yaml:"size"`      // bytes kept before the least recently used chunks are evicted
+	AllowWAN bool   `yaml:"allow_wan"` // also serve peers connected from outside a private network
+}
+
+// MirrorConfig declares a peer that mutually backs up with this node.
+type MirrorConfig struct {
+	Peer           string        `yaml:"peer"`            // multiaddr ending in /p2p/<peerID>
+	RepositoryID   string        `yaml:"repository_id"`   // the mirror's repository, imported here
+	SyncInterval   time.Duration `yaml:"sync_interval"`   // how often to push new snapshots
+	VerifyInterval time.Duration `yaml:"verify_interval"` // how often to re-verify everything replicated
+	MaxLag         time.Duration `yaml:"max_lag"`         // alert when a snapshot stays unreplicated this long
+}
+
+// FreshnessConfig sets how recent the newest snapshot of each source must be.
+type FreshnessConfig struct {
+	Targets       []FreshnessTarget `yaml:"targets"`
+	CheckInterval time.Duration     `yaml:"check_interval"` // how often targets are evaluated
+	WebhookURL    string            `yaml:"webhook_url"`    // POSTed a JSON notification when a target is missed or met again
+}
+
+// FreshnessTarget requires a snapshot of Source no older than MaxAge.
+type FreshnessTarget struct {
+	Source string        `yaml:"source"` // backed-up path
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// PlacementConfig labels peers by location and constrains which of them
+// hold copies of a repository's snapshots.
+type PlacementConfig struct {
+	Labels   map[string][]string `yaml:"labels"`   // peer ID -> labels, e.g. home, offsite, cloud, country:de
+	Policies []PlacementPolicy   `yaml:"policies"` // every policy matching a repository applies
+}
+
+// PlacementPolicy is a set of placement constraints for one repository.
+type PlacementPolicy struct {
+	RepositoryID string                 `yaml:"repository_id"` // empty applies to every repository
+	Require      []PlacementRequirement `yaml:"require"`       // labels copies must be spread over
+	Forbid       []string               `yaml:"forbid"`        // never place copies on peers with these labels
+}
+
+// PlacementRequirement asks for at least Min copies on peers labelled Label.
+type PlacementRequirement struct {
+	Label string `yaml:"label"`
+	Min   int    `yaml:"min"`
 }
 
 type Config struct {
-	RepositoryPath string           `yaml:"repository_path"`
-	ListenPort     int              `yaml:"listen_port"`
-	PeerBootstrap  []string         `yaml:"peer_bootstrap"`
-	NATTraversal   NATConfig        `yaml:"nat_traversal"`
-	Snapshot       SnapshotConfig   `yaml:"snapshot"`
-	ACL            ACLConfig        `yaml:"acl"`
-	P2P            P2PConfig        `yaml:"p2p"`
-	Storage        StorageConfig    `yaml:"storage"`
-	Monitoring     MonitoringConfig `yaml:"monitoring"`
-	Scheduler      SchedulerConfig  `yaml:"scheduler"`
-	Security       SecurityConfig   `yaml:"security"`
+	RepositoryPath string               `yaml:"repository_path"`
+	RepositoryID   string               `yaml:"repository_id"` // expected repository; empty accepts whatever the data dir holds
+	ListenPort     int                  `yaml:"listen_port"`
+	PeerBootstrap  []string             `yaml:"peer_bootstrap"`
+	NATTraversal   NATConfig            `yaml:"nat_traversal"`
+	Snapshot       SnapshotConfig       `yaml:"snapshot"`
+	ACL            ACLConfig            `yaml:"acl"`
+	P2P            P2PConfig            `yaml:"p2p"`
+	Storage        StorageConfig        `yaml:"storage"`
+	Monitoring     MonitoringConfig     `yaml:"monitoring"`
+	Scheduler      SchedulerConfig      `yaml:"scheduler"`
+	Security       SecurityConfig       `yaml:"security"`
+	Recovery       RecoveryConfig       `yaml:"recovery"`
+	Seeding        SeedingConfig        `yaml:"seeding"`
+	Maintenance    MaintenanceConfig    `yaml:"maintenance"`
+	Admission      AdmissionConfig      `yaml:"admission"`
+	Resources      ResourcesConfig      `yaml:"resources"`
+	API            APIConfig            `yaml:"api"`
+	Restore        RestoreConfig        `yaml:"restore"`
+	MetadataBackup MetadataBackupConfig `yaml:"metadata_backup"`
+	Mirrors        []MirrorConfig       `yaml:"mirrors"`
+	Placement      PlacementConfig      `yaml:"placement"`
+	Freshness      FreshnessConfig      `yaml:"freshness"`
+	Cache          CacheConfig          `yaml:"cache"`
 }
 
 func Load(path string) (*Config, error) {
@@ -94,7 +357,8 @@ func Load(path string) (*Config, error) {
 	}
 	defer f.Close()
 
-	var cfg Config
+	// Defaults that an explicit false in the file turns off
+	cfg := Config{Snapshot: SnapshotConfig{Compression: true}}
 	decoder := yaml.NewDecoder(f)
 	if err := decoder.Decode(&cfg); err != nil {
 		return nil, fmt.Errorf("failed to decode config: %w", err)
@@ -119,6 +383,9 @@ func (c *Config) applyEnvironmentOverrides() {
 	if val := os.Getenv("SHADOWVAULT_REPO_PATH"); val != "" {
 		c.RepositoryPath = val
 	}
+	if val := os.Getenv("SHADOWVAULT_REPO_ID"); val != "" {
+		c.RepositoryID = val
+	}
 	if val := os.Getenv("SHADOWVAULT_LISTEN_PORT"); val != "" {
 		if port, err := strconv.Atoi(val); err == nil {
 			c.ListenPort = port
@@ -135,12 +402,27 @@ func (c *Config) applyEnvironmentOverrides() {
 			c.Monitoring.MetricsPort = port
 		}
 	}
+	if val := os.Getenv("SHADOWVAULT_API_TOKEN"); val != "" {
+		c.API.Token = val
+	}
 	if val := os.Getenv("SHADOWVAULT_BOOTSTRAP_PEERS"); val != "" {
 		c.PeerBootstrap = strings.Split(val, ",")
 	}
 	if val := os.Getenv("SHADOWVAULT_ENABLE_COMPRESSION"); val != "" {
 		c.Snapshot.Compression = val == "true" || val == "1"
 	}
+	if val := os.Getenv("SHADOWVAULT_S3_ACCESS_KEY_ID"); val != "" {
+		c.Storage.S3.AccessKeyID = val
+	}
+	if val := os.Getenv("SHADOWVAULT_S3_SECRET_ACCESS_KEY"); val != "" {
+		c.Storage.S3.SecretAccessKey = val
+	}
+	if val := os.Getenv("SHADOWVAULT_S3_SESSION_TOKEN"); val != "" {
+		c.Storage.S3.SessionToken = val
+	}
+	if val := os.Getenv("SHADOWVAULT_SFTP_PASSWORD"); val != "" {
+		c.Storage.SFTP.Password = val
+	}
 }
 
 // applyDefaults sets default values for unset configuration fields
@@ -155,6 +437,20 @@ func (c *Config) applyDefaults() {
 	if c.Snapshot.AvgChunkSize == 0 {
 		c.Snapshot.AvgChunkSize = 8192
 	}
+	if c.Snapshot.ChangeJournal == "" {
+		c.Snapshot.ChangeJournal = "auto"
+	}
+	if c.Snapshot.OnError == "" {
+		c.Snapshot.OnError = "fail"
+	}
+	if c.Snapshot.ContentPolicy.Mode == "" {
+		c.Snapshot.ContentPolicy.Mode = contentpolicy.ModeReport
+	}
+
+	// ACL defaults
+	if c.ACL.ApprovalTTL == 0 {
+		c.ACL.ApprovalTTL = 24 * time.Hour
+	}
 
 	// Network defaults
 	if c.ListenPort == 0 {
@@ -185,12 +481,51 @@ func (c *Config) applyDefaults() {
 	if c.P2P.ChunkFetchTimeout == 0 {
 		c.P2P.ChunkFetchTimeout = 60 * time.Second
 	}
+	if c.P2P.ChunkFetchTimeoutMin == 0 {
+		c.P2P.ChunkFetchTimeoutMin = 5 * time.Second
+	}
+	if c.P2P.ChunkFetchTimeoutMax == 0 {
+		c.P2P.ChunkFetchTimeoutMax = 10 * time.Minute
+	}
+	if c.P2P.FetchAttempts == 0 {
+		c.P2P.FetchAttempts = 3
+	}
+	if c.P2P.MissingRetryInterval == 0 {
+		c.P2P.MissingRetryInterval = 15 * time.Minute
+	}
+	if c.P2P.VerifyReceived == "" {
+		c.P2P.VerifyReceived = "all"
+	}
+	if c.P2P.VerifySampleRate == 0 {
+		c.P2P.VerifySampleRate = 0.1
+	}
 	if c.P2P.ReconnectBackoff == 0 {
 		c.P2P.ReconnectBackoff = 5 * time.Second
 	}
 	if c.P2P.MaxReconnectBackoff == 0 {
 		c.P2P.MaxReconnectBackoff = 5 * time.Minute
 	}
+	if c.P2P.PEXTrust == "" {
+		c.P2P.PEXTrust = "admins"
+	}
+	if c.P2P.PEXInterval == 0 {
+		c.P2P.PEXInterval = 10 * time.Minute
+	}
+	if c.P2P.PinAlertAfter == 0 {
+		c.P2P.PinAlertAfter = 15 * time.Minute
+	}
+	if c.P2P.OfferInterval == 0 {
+		c.P2P.OfferInterval = 30 * time.Minute
+	}
+	if c.P2P.ControlTopic == "" {
+		c.P2P.ControlTopic = "backup-sync"
+	}
+	if c.P2P.DataTopic == "" {
+		c.P2P.DataTopic = "backup-sync-data"
+	}
+	if c.P2P.ChunkPubsub == "" {
+		c.P2P.ChunkPubsub = "compat"
+	}
 
 	// Storage defaults
 	if c.Storage.MaxCacheSize == 0 {
@@ -199,11 +534,80 @@ func (c *Config) applyDefaults() {
 	if c.Storage.GCInterval == 0 {
 		c.Storage.GCInterval = 24 * time.Hour
 	}
+	if c.Storage.GCGrace == 0 {
+		c.Storage.GCGrace = time.Hour
+	}
 	if c.Storage.RetentionDays == 0 {
 		c.Storage.RetentionDays = 30
 	}
+
+	// Maintenance defaults
+	if len(c.Maintenance.Order) == 0 {
+		c.Maintenance.Order = append([]string(nil), MaintenanceTasks...)
+	}
+	if c.Maintenance.VerifyInterval == 0 {
+		c.Maintenance.VerifyInterval = 7 * 24 * time.Hour
+	}
 	c.Storage.VerifyOnRestore = true // Always verify by default
 	c.Storage.EnableDeduplication = true
+	if c.Storage.Backend == "" {
+		c.Storage.Backend = "bbolt"
+	}
+	if c.Storage.Durability == "" {
+		c.Storage.Durability = "sync"
+	}
+	if c.Storage.WALSyncInterval == 0 {
+		c.Storage.WALSyncInterval = 10 * time.Millisecond
+	}
+	if c.Storage.WALMaxPending == 0 {
+		c.Storage.WALMaxPending = 256 * 1024 * 1024 // 256MB
+	}
+	if c.Storage.RestoreReadahead == 0 {
+		c.Storage.RestoreReadahead = 32
+	}
+	if c.Storage.S3.Region == "" {
+		c.Storage.S3.Region = "us-east-1"
+	}
+	if c.Storage.S3.MaxRetries == 0 {
+		c.Storage.S3.MaxRetries = 5
+	}
+	if c.Storage.S3.RetryDelay == 0 {
+		c.Storage.S3.RetryDelay = 500 * time.Millisecond
+	}
+	if c.Storage.S3.Timeout == 0 {
+		c.Storage.S3.Timeout = time.Minute
+	}
+	if c.Storage.Pack.Size == 0 {
+		c.Storage.Pack.Size = 16 * 1024 * 1024 // 16MB
+	}
+	if c.Storage.Pack.RepackThreshold == 0 {
+		c.Storage.Pack.RepackThreshold = 0.5
+	}
+	if c.Storage.SFTP.MaxConns == 0 {
+		c.Storage.SFTP.MaxConns = 4
+	}
+	if c.Storage.SFTP.MaxRetries == 0 {
+		c.Storage.SFTP.MaxRetries = 5
+	}
+	if c.Storage.SFTP.RetryDelay == 0 {
+		c.Storage.SFTP.RetryDelay = time.Second
+	}
+	if c.Storage.SFTP.Timeout == 0 {
+		c.Storage.SFTP.Timeout = 30 * time.Second
+	}
+
+	// Restore defaults
+	if c.Restore.ScanTimeout == 0 {
+		c.Restore.ScanTimeout = 5 * time.Minute
+	}
+
+	// Metadata backup defaults
+	if c.MetadataBackup.Interval == 0 {
+		c.MetadataBackup.Interval = 6 * time.Hour
+	}
+	if c.MetadataBackup.Keep == 0 {
+		c.MetadataBackup.Keep = 3
+	}
 
 	// Monitoring defaults
 	if c.Monitoring.MetricsPort == 0 {
@@ -221,6 +625,12 @@ func (c *Config) applyDefaults() {
 	if c.Monitoring.LogFormat == "" {
 		c.Monitoring.LogFormat = "json"
 	}
+	if c.Monitoring.SlowRequestThreshold == 0 {
+		c.Monitoring.SlowRequestThreshold = 2 * time.Second
+	}
+	if c.Monitoring.ProgressInterval == 0 {
+		c.Monitoring.ProgressInterval = 30 * time.Second
+	}
 
 	// Scheduler defaults
 	if c.Scheduler.BackupInterval == 0 {
@@ -229,6 +639,12 @@ func (c *Config) applyDefaults() {
 	if c.Scheduler.MaxBackupRetries == 0 {
 		c.Scheduler.MaxBackupRetries = 3
 	}
+	if c.Scheduler.HookTimeout == 0 {
+		c.Scheduler.HookTimeout = 10 * time.Minute
+	}
+	if c.Scheduler.ShutdownBudget == 0 {
+		c.Scheduler.ShutdownBudget = 5 * time.Second
+	}
 
 	// Security defaults
 	if c.Security.RequestsPerSecond == 0 {
@@ -237,9 +653,77 @@ func (c *Config) applyDefaults() {
 	if c.Security.BurstSize == 0 {
 		c.Security.BurstSize = 200
 	}
+	if c.Security.DataRequestsPerSecond == 0 {
+		c.Security.DataRequestsPerSecond = 500
+	}
+	if c.Security.DataBurstSize == 0 {
+		c.Security.DataBurstSize = 1000
+	}
 	if c.Security.MaxRequestSize == 0 {
 		c.Security.MaxRequestSize = 100 * 1024 * 1024 // 100MB
 	}
+	if c.Security.QuarantineThreshold == 0 {
+		c.Security.QuarantineThreshold = 100
+	}
+	if c.Security.ScoreHalfLife == 0 {
+		c.Security.ScoreHalfLife = 10 * time.Minute
+	}
+	if c.Security.QuarantineDuration == 0 {
+		c.Security.QuarantineDuration = time.Hour
+	}
+
+	// Recovery defaults: simple majority of trustees
+	if c.Recovery.Threshold == 0 && len(c.Recovery.TrustedPeers) > 0 {
+		c.Recovery.Threshold = len(c.Recovery.TrustedPeers)/2 + 1
+	}
+
+	// Admission defaults
+	if c.Admission.MaxBackups == 0 {
+		c.Admission.MaxBackups = 1
+	}
+	if c.Admission.MaxRestores == 0 {
+		c.Admission.MaxRestores = 2
+	}
+	if c.Admission.MaxQueued == 0 {
+		c.Admission.MaxQueued = 16
+	}
+
+	// API defaults
+	if c.API.Port == 0 {
+		c.API.Port = 8081
+	}
+	if c.API.ShareMaxTTL == 0 {
+		c.API.ShareMaxTTL = 7 * 24 * time.Hour
+	}
+
+	// Resource monitoring defaults
+	if c.Resources.CheckInterval == 0 {
+		c.Resources.CheckInterval = 15 * time.Second
+	}
+
+	// Freshness defaults
+	if c.Freshness.CheckInterval == 0 {
+		c.Freshness.CheckInterval = 5 * time.Minute
+	}
+
+	// Cache node defaults
+	if c.Cache.Size == 0 {
+		c.Cache.Size = 10 << 30
+	}
+
+	// Mirror defaults
+	for i := range c.Mirrors {
+		m := &c.Mirrors[i]
+		if m.SyncInterval == 0 {
+			m.SyncInterval = time.Hour
+		}
+		if m.VerifyInterval == 0 {
+			m.VerifyInterval = 7 * 24 * time.Hour
+		}
+		if m.MaxLag == 0 {
+			m.MaxLag = 24 * time.Hour
+		}
+	}
 }
 
 // Validate validates the configuration
@@ -257,6 +741,30 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("avg_chunk_size (%d) must be between min (%d) and max (%d)",
 			c.Snapshot.AvgChunkSize, c.Snapshot.MinChunkSize, c.Snapshot.MaxChunkSize)
 	}
+	if c.Snapshot.ChangeJournal != "auto" && c.Snapshot.ChangeJournal != "off" {
+		return fmt.Errorf("snapshot.change_journal must be auto or off, got %q", c.Snapshot.ChangeJournal)
+	}
+	if c.Snapshot.Chunker != "" && !chunker.Valid(c.Snapshot.Chunker) {
+		algos := chunker.Algorithms()
+		return fmt.Errorf("snapshot.chunker must be %s or %s, got %q",
+			strings.Join(algos[:len(algos)-1], ", "), algos[len(algos)-1], c.Snapshot.Chunker)
+	}
+	if levels, err := compression.ParseLevels(c.Snapshot.CompressionLevels); err != nil {
+		return fmt.Errorf("invalid snapshot.compression_levels: %w", err)
+	} else if _, err := compression.NewPolicy(levels); err != nil {
+		return fmt.Errorf("invalid snapshot.compression_levels: %w", err)
+	}
+	switch c.Snapshot.OnError {
+	case "fail", "skip-and-report", "retry":
+	default:
+		return fmt.Errorf("snapshot.on_error must be fail, skip-and-report or retry, got %q", c.Snapshot.OnError)
+	}
+	if _, err := exclude.Compile(c.Snapshot.Excludes); err != nil {
+		return fmt.Errorf("snapshot.excludes: %w", err)
+	}
+	if _, err := contentpolicy.Compile(c.Snapshot.ContentPolicy); err != nil {
+		return fmt.Errorf("snapshot.content_policy: %w", err)
+	}
 
 	// Validate ports
 	if c.ListenPort < 1 || c.ListenPort > 65535 {
@@ -284,14 +792,99 @@ func (c *Config) Validate() error {
 	if c.P2P.MaxConcurrentFetch < 1 {
 		return fmt.Errorf("max_concurrent_fetch must be >= 1, got %d", c.P2P.MaxConcurrentFetch)
 	}
+	if c.P2P.FetchAttempts < 1 {
+		return fmt.Errorf("fetch_attempts must be >= 1, got %d", c.P2P.FetchAttempts)
+	}
+	if c.P2P.ChunkFetchTimeoutMin <= 0 || c.P2P.ChunkFetchTimeoutMin > c.P2P.ChunkFetchTimeout || c.P2P.ChunkFetchTimeout > c.P2P.ChunkFetchTimeoutMax {
+		return fmt.Errorf("chunk fetch timeouts must satisfy 0 < chunk_fetch_timeout_min <= chunk_fetch_timeout <= chunk_fetch_timeout_max, got %s, %s and %s",
+			c.P2P.ChunkFetchTimeoutMin, c.P2P.ChunkFetchTimeout, c.P2P.ChunkFetchTimeoutMax)
+	}
+	switch c.P2P.PEXTrust {
+	case "admins", "all", "none":
+	default:
+		return fmt.Errorf("invalid pex_trust: %s (must be admins, all or none)", c.P2P.PEXTrust)
+	}
+	switch c.P2P.VerifyReceived {
+	case "all", "sample", "off":
+	default:
+		return fmt.Errorf("invalid verify_received: %s (must be all, sample or off)", c.P2P.VerifyReceived)
+	}
+	switch c.P2P.ChunkPubsub {
+	case "compat", "off":
+	default:
+		return fmt.Errorf("invalid chunk_pubsub: %s (must be compat or off)", c.P2P.ChunkPubsub)
+	}
+	if c.P2P.VerifySampleRate < 0 || c.P2P.VerifySampleRate > 1 {
+		return fmt.Errorf("verify_sample_rate must be between 0 and 1, got %g", c.P2P.VerifySampleRate)
+	}
+	if c.P2P.StorageOffer < 0 {
+		return fmt.Errorf("storage_offer must be >= 0, got %d", c.P2P.StorageOffer)
+	}
 
 	// Validate storage settings
 	if c.Storage.RetentionDays < 0 {
 		return fmt.Errorf("retention_days must be >= 0, got %d", c.Storage.RetentionDays)
 	}
+	if err := c.Storage.Retention.Validate(); err != nil {
+		return fmt.Errorf("storage.%w", err)
+	}
+	if c.Storage.GCGrace < 0 {
+		return fmt.Errorf("gc_grace must be >= 0, got %v", c.Storage.GCGrace)
+	}
 	if c.Storage.MaxCacheSize < 0 {
 		return fmt.Errorf("max_cache_size must be >= 0, got %d", c.Storage.MaxCacheSize)
 	}
+	if c.Storage.RestoreReadahead < 1 {
+		return fmt.Errorf("restore_readahead must be >= 1, got %d", c.Storage.RestoreReadahead)
+	}
+	switch c.Storage.Backend {
+	case "bbolt", "filesystem", "s3", "sftp", "pack":
+	default:
+		return fmt.Errorf("invalid backend: %s (must be bbolt, filesystem, s3, sftp or pack)", c.Storage.Backend)
+	}
+	if c.Storage.Pack.Size < 1024*1024 {
+		return fmt.Errorf("storage.pack.size must be at least 1MB, got %d", c.Storage.Pack.Size)
+	}
+	if t := c.Storage.Pack.RepackThreshold; t <= 0 || t >= 1 {
+		return fmt.Errorf("storage.pack.repack_threshold must be between 0 and 1, got %g", t)
+	}
+	if s3 := c.Storage.S3; c.Storage.Backend == "s3" || s3.Bucket != "" {
+		if s3.Endpoint == "" || s3.Bucket == "" {
+			return fmt.Errorf("storage.s3.endpoint and storage.s3.bucket are required for the s3 backend")
+		}
+		if !strings.HasPrefix(s3.Endpoint, "http://") && !strings.HasPrefix(s3.Endpoint, "https://") {
+			return fmt.Errorf("storage.s3.endpoint must be an http or https URL, got %q", s3.Endpoint)
+		}
+		if (s3.AccessKeyID == "") != (s3.SecretAccessKey == "") {
+			return fmt.Errorf("storage.s3.access_key_id and secret_access_key must be set together")
+		}
+		if s3.MaxRetries < 0 || s3.RetryDelay < 0 || s3.Timeout < 0 {
+			return fmt.Errorf("storage.s3.max_retries, retry_delay and timeout must not be negative")
+		}
+	}
+	if sftp := c.Storage.SFTP; c.Storage.Backend == "sftp" || sftp.Host != "" {
+		if sftp.Host == "" || sftp.User == "" || sftp.Path == "" {
+			return fmt.Errorf("storage.sftp.host, user and path are required for the sftp backend")
+		}
+		if sftp.KeyFile == "" && sftp.Password == "" {
+			return fmt.Errorf("storage.sftp needs a key_file or a password")
+		}
+		if sftp.MaxConns < 1 {
+			return fmt.Errorf("storage.sftp.max_conns must be >= 1, got %d", sftp.MaxConns)
+		}
+		if sftp.MaxRetries < 0 || sftp.RetryDelay < 0 || sftp.Timeout < 0 {
+			return fmt.Errorf("storage.sftp.max_retries, retry_delay and timeout must not be negative")
+		}
+	}
+	switch c.Storage.Durability {
+	case "sync", "wal":
+	default:
+		return fmt.Errorf("invalid durability: %s (must be sync or wal)", c.Storage.Durability)
+	}
+	if c.Storage.WALSyncInterval < 0 || c.Storage.WALMaxPending < int64(c.Snapshot.MaxChunkSize) {
+		return fmt.Errorf("wal_sync_interval must be >= 0 and wal_max_pending >= max_chunk_size, got %s and %d",
+			c.Storage.WALSyncInterval, c.Storage.WALMaxPending)
+	}
 
 	// Validate log level
 	validLogLevels := map[string]bool{
@@ -306,6 +899,33 @@ func (c *Config) Validate() error {
 	if c.Monitoring.LogFormat != "json" && c.Monitoring.LogFormat != "text" {
 		return fmt.Errorf("invalid log_format: %s (must be json or text)", c.Monitoring.LogFormat)
 	}
+	if c.Monitoring.SlowRequestThreshold < 0 {
+		return fmt.Errorf("slow_request_threshold must be >= 0, got %s", c.Monitoring.SlowRequestThreshold)
+	}
+	if c.Monitoring.ProgressInterval < 0 {
+		return fmt.Errorf("progress_interval must be >= 0, got %s", c.Monitoring.ProgressInterval)
+	}
+
+	// Validate scheduler settings
+	if c.Scheduler.HookTimeout < 0 {
+		return fmt.Errorf("scheduler.hook_timeout must be >= 0, got %s", c.Scheduler.HookTimeout)
+	}
+	if c.Scheduler.ShutdownBudget < 0 || c.Scheduler.ShutdownBudget > 3*time.Minute {
+		return fmt.Errorf("invalid scheduler.shutdown_budget: %s (must be between 0 and 3m)", c.Scheduler.ShutdownBudget)
+	}
+	groups := make(map[string]bool)
+	for _, g := range c.Scheduler.SourceGroups {
+		if g.Name == "" || strings.TrimLeft(g.Name, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.") != "" {
+			return fmt.Errorf("scheduler.source_groups name must be letters, digits and - _ ., got %q", g.Name)
+		}
+		if groups[g.Name] {
+			return fmt.Errorf("scheduler.source_groups name %q is used twice", g.Name)
+		}
+		groups[g.Name] = true
+		if len(g.Paths) == 0 {
+			return fmt.Errorf("scheduler.source_groups %q has no paths", g.Name)
+		}
+	}
 
 	// Validate security settings
 	if c.Security.EnableRateLimiting {
@@ -316,6 +936,185 @@ func (c *Config) Validate() error {
 			return fmt.Errorf("burst_size (%d) must be >= requests_per_second (%d)",
 				c.Security.BurstSize, c.Security.RequestsPerSecond)
 		}
+		if c.Security.DataRequestsPerSecond < 1 {
+			return fmt.Errorf("data_requests_per_second must be >= 1, got %d", c.Security.DataRequestsPerSecond)
+		}
+		if c.Security.DataBurstSize < c.Security.DataRequestsPerSecond {
+			return fmt.Errorf("data_burst_size (%d) must be >= data_requests_per_second (%d)",
+				c.Security.DataBurstSize, c.Security.DataRequestsPerSecond)
+		}
+	}
+
+	// A chunk response carries a base64 chunk, so the message cap must leave room for it
+	if c.Security.MaxRequestSize < 2*int64(c.Snapshot.MaxChunkSize) {
+		return fmt.Errorf("max_request_size (%d) must be >= 2 * max_chunk_size (%d)",
+			c.Security.MaxRequestSize, c.Snapshot.MaxChunkSize)
+	}
+
+	if c.Security.QuarantineThreshold < 0 {
+		return fmt.Errorf("quarantine_threshold must be > 0, got %v", c.Security.QuarantineThreshold)
+	}
+
+	// Validate ACL settings
+	if c.ACL.TwoPersonRule && len(c.ACL.Admins) < 2 {
+		return fmt.Errorf("two_person_rule requires at least 2 admins, got %d", len(c.ACL.Admins))
+	}
+
+	// Validate recovery settings
+	if n := len(c.Recovery.TrustedPeers); n > 0 {
+		if n < 2 {
+			return fmt.Errorf("recovery requires at least 2 trusted_peers, got %d", n)
+		}
+		if c.Recovery.Threshold < 2 || c.Recovery.Threshold > n {
+			return fmt.Errorf("recovery threshold must be between 2 and %d, got %d", n, c.Recovery.Threshold)
+		}
+		seen := make(map[string]bool, n)
+		for _, p := range c.Recovery.TrustedPeers {
+			if seen[p] {
+				return fmt.Errorf("recovery trusted_peers lists %s twice", p)
+			}
+			seen[p] = true
+		}
+	}
+
+	// Validate seeding settings
+	if _, err := scheduler.ParseActiveWindow(c.Seeding.ActiveHours); err != nil {
+		return fmt.Errorf("invalid seeding.active_hours: %w", err)
+	}
+	if c.Seeding.MaxReadRate < 0 {
+		return fmt.Errorf("seeding.max_read_rate must be >= 0, got %d", c.Seeding.MaxReadRate)
+	}
+
+	// Validate maintenance settings
+	if _, err := scheduler.ParseActiveWindow(c.Maintenance.Window); err != nil {
+		return fmt.Errorf("invalid maintenance.window: %w", err)
+	}
+	if c.Maintenance.Budget < 0 || c.Maintenance.VerifyInterval < 0 {
+		return fmt.Errorf("maintenance budget and verify_interval must be >= 0, got %s and %s",
+			c.Maintenance.Budget, c.Maintenance.VerifyInterval)
+	}
+	if c.Maintenance.VerifyWorkers < 0 || c.Maintenance.VerifyBudget < 0 || c.Maintenance.VerifyMaxRead < 0 {
+		return fmt.Errorf("maintenance verify_workers, verify_budget and verify_max_read must be >= 0")
+	}
+	listed := make(map[string]bool)
+	for _, task := range c.Maintenance.Order {
+		known := false
+		for _, t := range MaintenanceTasks {
+			known = known || t == task
+		}
+		if !known || listed[task] {
+			return fmt.Errorf("maintenance.order must list each of %s at most once, got %v",
+				strings.Join(MaintenanceTasks, ", "), c.Maintenance.Order)
+		}
+		listed[task] = true
+	}
+
+	// Validate metadata backup settings
+	if c.MetadataBackup.Interval < time.Minute || c.MetadataBackup.Keep < 1 {
+		return fmt.Errorf("metadata_backup interval must be >= 1m and keep >= 1, got %s and %d",
+			c.MetadataBackup.Interval, c.MetadataBackup.Keep)
+	}
+
+	// Validate admission limits
+	if c.Admission.MaxBackups < 1 || c.Admission.MaxRestores < 1 {
+		return fmt.Errorf("admission max_concurrent_backups and max_concurrent_restores must be >= 1, got %d and %d",
+			c.Admission.MaxBackups, c.Admission.MaxRestores)
+	}
+	if c.Admission.MaxQueued < 1 {
+		return fmt.Errorf("admission.max_queued must be >= 1, got %d", c.Admission.MaxQueued)
+	}
+
+	// Validate resource limits
+	if c.Resources.MaxMemoryMB < 0 || c.Resources.MaxGoroutines < 0 {
+		return fmt.Errorf("resources max_memory_mb and max_goroutines must be >= 0, got %d and %d",
+			c.Resources.MaxMemoryMB, c.Resources.MaxGoroutines)
+	}
+	if c.Resources.CheckInterval < time.Second {
+		return fmt.Errorf("resources.check_interval must be >= 1s, got %s", c.Resources.CheckInterval)
+	}
+
+	// Validate API
+	if c.API.Enable {
+		if c.API.Port < 1 || c.API.Port > 65535 {
+			return fmt.Errorf("api.port must be 1-65535, got %d", c.API.Port)
+		}
+		if len(c.API.Token) < 16 {
+			return fmt.Errorf("api.token must be at least 16 characters when the API is enabled")
+		}
+		if c.API.ShareMaxTTL < 0 {
+			return fmt.Errorf("api.share_max_ttl must not be negative, got %s", c.API.ShareMaxTTL)
+		}
+	}
+
+	if c.Restore.ScanTimeout < 0 {
+		return fmt.Errorf("restore.scan_timeout must not be negative, got %s", c.Restore.ScanTimeout)
+	}
+
+	// Validate mirrors
+	for i, m := range c.Mirrors {
+		if !strings.Contains(m.Peer, "/p2p/") {
+			return fmt.Errorf("mirrors[%d].peer must be a multiaddr ending in /p2p/<peerID>, got %q", i, m.Peer)
+		}
+		if m.RepositoryID == "" {
+			return fmt.Errorf("mirrors[%d].repository_id is required", i)
+		}
+	}
+
+	// Validate freshness targets
+	sources := make(map[string]bool, len(c.Freshness.Targets))
+	for i, t := range c.Freshness.Targets {
+		if t.Source == "" {
+			return fmt.Errorf("freshness.targets[%d].source is required", i)
+		}
+		if sources[t.Source] {
+			return fmt.Errorf("freshness.targets[%d] repeats source %s", i, t.Source)
+		}
+		sources[t.Source] = true
+		if t.MaxAge <= 0 {
+			return fmt.Errorf("freshness.targets[%d].max_age must be positive, got %s", i, t.MaxAge)
+		}
+	}
+	if c.Freshness.CheckInterval < 0 {
+		return fmt.Errorf("freshness.check_interval must not be negative, got %s", c.Freshness.CheckInterval)
+	}
+	if u := c.Freshness.WebhookURL; u != "" && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		return fmt.Errorf("freshness.webhook_url must be an http or https URL, got %q", u)
+	}
+
+	// Validate placement
+	for id, labels := range c.Placement.Labels {
+		for _, l := range labels {
+			if l == "" || strings.ContainsAny(l, " \t,") {
+				return fmt.Errorf("placement.labels[%s] has invalid label %q", id, l)
+			}
+		}
+	}
+	for i, p := range c.Placement.Policies {
+		forbidden := make(map[string]bool, len(p.Forbid))
+		for _, l := range p.Forbid {
+			forbidden[l] = true
+		}
+		for _, r := range p.Require {
+			if r.Label == "" {
+				return fmt.Errorf("placement.policies[%d].require needs a label", i)
+			}
+			if r.Min < 1 {
+				return fmt.Errorf("placement.policies[%d].require[%s].min must be at least 1, got %d", i, r.Label, r.Min)
+			}
+			if forbidden[r.Label] {
+				return fmt.Errorf("placement.policies[%d] both requires and forbids %q", i, r.Label)
+			}
+		}
+	}
+
+	// Validate cache node
+	if c.Cache.Enabled {
+		if c.Cache.Size < 1<<20 {
+			return fmt.Errorf("invalid cache.size: %d (must be at least 1MB)", c.Cache.Size)
+		}
+		if c.P2P.StorageOffer > 0 {
+			return fmt.Errorf("invalid p2p.storage_offer: %d (must be 0 on a cache node, which holds no copies)", c.P2P.StorageOffer)
+		}
 	}
 
 	return nil
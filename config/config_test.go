@@ -36,6 +36,12 @@ monitoring:
 storage:
   retention_days: 90
   verify_on_restore: true
+  retention:
+    keep_daily: 7
+    keep_monthly: 12
+    tags:
+      - tag: db
+        keep_last: 2
 security:
   enable_rate_limiting: true
   requests_per_second: 50
@@ -76,6 +82,9 @@ security:
 	if cfg.Storage.RetentionDays != 90 {
 		t.Errorf("Expected retention_days 90, got %d", cfg.Storage.RetentionDays)
 	}
+	if r := cfg.Storage.Retention; r.KeepDaily != 7 || r.KeepMonthly != 12 || len(r.Tags) != 1 || r.Tags[0].Tag != "db" || r.Tags[0].KeepLast != 2 {
+		t.Errorf("Expected retention keep_daily 7, keep_monthly 12 and keep_last 2 for db, got %+v", r)
+	}
 }
 
 func TestConfigDefaults(t *testing.T) {
@@ -123,6 +132,38 @@ repository_path: "./data"
 	if cfg.Monitoring.LogFormat != "json" {
 		t.Errorf("Expected default log_format 'json', got '%s'", cfg.Monitoring.LogFormat)
 	}
+	if cfg.Scheduler.HookTimeout != 10*time.Minute {
+		t.Errorf("Expected default hook_timeout 10m, got %v", cfg.Scheduler.HookTimeout)
+	}
+	if !cfg.Snapshot.Compression {
+		t.Error("Expected compression to be enabled by default")
+	}
+}
+
+func TestCompressionOff(t *testing.T) {
+	content := `
+repository_path: "./data"
+snapshot:
+  compression: false
+`
+	tmpFile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.WriteString(content); err != nil {
+		t.Fatalf("Failed to write temp file: %v", err)
+	}
+	tmpFile.Close()
+
+	cfg, err := Load(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.Snapshot.Compression {
+		t.Error("Expected compression: false to disable compression")
+	}
 }
 
 func TestEnvironmentOverrides(t *testing.T) {
@@ -196,6 +237,62 @@ listen_port: -1
 			expectError: true,
 			errorMsg:    "listen_port must be 1-65535",
 		},
+		{
+			name: "negative retention count",
+			config: `
+repository_path: "./data"
+storage:
+  retention:
+    keep_weekly: -1
+`,
+			expectError: true,
+			errorMsg:    "storage.retention: keep counts must be >= 0",
+		},
+		{
+			name: "negative hook timeout",
+			config: `
+repository_path: "./data"
+scheduler:
+  pre_backup: "true"
+  hook_timeout: -1s
+`,
+			expectError: true,
+			errorMsg:    "scheduler.hook_timeout must be >= 0",
+		},
+		{
+			name: "cache node offering storage",
+			config: `
+repository_path: "./data"
+p2p:
+  storage_offer: 1073741824
+cache:
+  enabled: true
+`,
+			expectError: true,
+			errorMsg:    "invalid p2p.storage_offer",
+		},
+		{
+			name: "shutdown budget too long",
+			config: `
+repository_path: "./data"
+scheduler:
+  shutdown_paths: [/etc]
+  shutdown_budget: 10m
+`,
+			expectError: true,
+			errorMsg:    "invalid scheduler.shutdown_budget",
+		},
+		{
+			name: "source group without paths",
+			config: `
+repository_path: "./data"
+scheduler:
+  source_groups:
+    - name: web
+`,
+			expectError: true,
+			errorMsg:    "scheduler.source_groups \"web\" has no paths",
+		},
 		{
 			name: "invalid port - too high",
 			config: `
@@ -236,6 +333,378 @@ monitoring:
 			expectError: true,
 			errorMsg:    "invalid log_format",
 		},
+		{
+			name: "api without token",
+			config: `
+repository_path: "./data"
+api:
+  enable: true
+`,
+			expectError: true,
+			errorMsg:    "api.token",
+		},
+		{
+			name: "negative slow request threshold",
+			config: `
+repository_path: "./data"
+monitoring:
+  slow_request_threshold: -1s
+`,
+			expectError: true,
+			errorMsg:    "slow_request_threshold",
+		},
+		{
+			name: "recovery threshold above trustees",
+			config: `
+repository_path: "./data"
+recovery:
+  trusted_peers: ["a", "b"]
+  threshold: 3
+`,
+			expectError: true,
+			errorMsg:    "recovery threshold",
+		},
+		{
+			name: "max request size below chunk size",
+			config: `
+repository_path: "./data"
+snapshot:
+  max_chunk_size: 65536
+security:
+  max_request_size: 65536
+`,
+			expectError: true,
+			errorMsg:    "max_request_size",
+		},
+		{
+			name: "invalid pex trust",
+			config: `
+repository_path: "./data"
+p2p:
+  pex_trust: everyone
+`,
+			expectError: true,
+			errorMsg:    "invalid pex_trust",
+		},
+		{
+			name: "invalid snapshot exclude",
+			config: `
+repository_path: "./data"
+snapshot:
+  excludes: ["*.tmp", "[abc"]
+`,
+			expectError: true,
+			errorMsg:    "snapshot.excludes",
+		},
+		{
+			name: "negative fetch attempts",
+			config: `
+repository_path: "./data"
+p2p:
+  fetch_attempts: -1
+`,
+			expectError: true,
+			errorMsg:    "fetch_attempts must be >= 1",
+		},
+		{
+			name: "chunk fetch timeout above max",
+			config: `
+repository_path: "./data"
+p2p:
+  chunk_fetch_timeout: 5m
+  chunk_fetch_timeout_max: 2m
+`,
+			expectError: true,
+			errorMsg:    "chunk fetch timeouts must satisfy",
+		},
+		{
+			name: "invalid verify received",
+			config: `
+repository_path: "./data"
+p2p:
+  verify_received: some
+`,
+			expectError: true,
+			errorMsg:    "invalid verify_received",
+		},
+		{
+			name: "negative storage offer",
+			config: `
+repository_path: "./data"
+p2p:
+  storage_offer: -1
+`,
+			expectError: true,
+			errorMsg:    "storage_offer must be >= 0",
+		},
+		{
+			name: "data burst below data rate",
+			config: `
+repository_path: "./data"
+security:
+  enable_rate_limiting: true
+  data_requests_per_second: 500
+  data_burst_size: 100
+`,
+			expectError: true,
+			errorMsg:    "data_burst_size (100) must be >= data_requests_per_second (500)",
+		},
+		{
+			name: "negative share max ttl",
+			config: `
+repository_path: "./data"
+api:
+  enable: true
+  token: "0123456789abcdef"
+  share_max_ttl: -1h
+`,
+			expectError: true,
+			errorMsg:    "api.share_max_ttl must not be negative",
+		},
+		{
+			name: "mirror without repository id",
+			config: `
+repository_path: "./data"
+mirrors:
+  - peer: /ip4/192.168.1.20/tcp/9000/p2p/12D3KooWExample
+`,
+			expectError: true,
+			errorMsg:    "repository_id is required",
+		},
+		{
+			name: "freshness target without max age",
+			config: `
+repository_path: "./data"
+freshness:
+  targets:
+    - source: /home
+`,
+			expectError: true,
+			errorMsg:    "freshness.targets[0].max_age must be positive",
+		},
+		{
+			name: "freshness webhook not http",
+			config: `
+repository_path: "./data"
+freshness:
+  targets:
+    - source: /home
+      max_age: 26h
+  webhook_url: "ftp://alerts.example.com/hook"
+`,
+			expectError: true,
+			errorMsg:    "freshness.webhook_url must be an http or https URL",
+		},
+		{
+			name: "placement requirement below one",
+			config: `
+repository_path: "./data"
+placement:
+  policies:
+    - require:
+        - label: offsite
+          min: 0
+`,
+			expectError: true,
+			errorMsg:    "min must be at least 1",
+		},
+		{
+			name: "placement label required and forbidden",
+			config: `
+repository_path: "./data"
+placement:
+  labels:
+    12D3KooWExample: [cloud]
+  policies:
+    - require:
+        - label: cloud
+          min: 1
+      forbid: [cloud]
+`,
+			expectError: true,
+			errorMsg:    "both requires and forbids",
+		},
+		{
+			name: "unknown maintenance task",
+			config: `
+repository_path: "./data"
+maintenance:
+  order: ["verify", "defrag"]
+`,
+			expectError: true,
+			errorMsg:    "maintenance.order must list each of gc, verify at most once",
+		},
+		{
+			name: "invalid seeding active hours",
+			config: `
+repository_path: "./data"
+seeding:
+  active_hours: "after midnight"
+`,
+			expectError: true,
+			errorMsg:    "invalid seeding.active_hours",
+		},
+		{
+			name: "invalid change journal mode",
+			config: `
+repository_path: "./data"
+snapshot:
+  change_journal: "usn"
+`,
+			expectError: true,
+			errorMsg:    "snapshot.change_journal must be auto or off",
+		},
+		{
+			name: "unknown chunker",
+			config: `
+repository_path: "./data"
+snapshot:
+  chunker: "rabin"
+`,
+			expectError: true,
+			errorMsg:    "snapshot.chunker must be fnv, fastcdc, buzhash or fixed",
+		},
+		{
+			name: "unknown error policy",
+			config: `
+repository_path: "./data"
+snapshot:
+  on_error: "ignore"
+`,
+			expectError: true,
+			errorMsg:    "snapshot.on_error must be fail, skip-and-report or retry",
+		},
+		{
+			name: "content policy rule without a pattern",
+			config: `
+repository_path: "./data"
+snapshot:
+  content_policy:
+    mode: "enforce"
+    rules:
+      - name: "vault-token"
+`,
+			expectError: true,
+			errorMsg:    "snapshot.content_policy: rule vault-token needs paths or content",
+		},
+		{
+			name: "negative admission limit",
+			config: `
+repository_path: "./data"
+admission:
+  max_concurrent_backups: -1
+`,
+			expectError: true,
+			errorMsg:    "max_concurrent_backups",
+		},
+		{
+			name: "negative resource limit",
+			config: `
+repository_path: "./data"
+resources:
+  max_memory_mb: -512
+`,
+			expectError: true,
+			errorMsg:    "resources max_memory_mb and max_goroutines must be >= 0",
+		},
+		{
+			name: "invalid durability mode",
+			config: `
+repository_path: "./data"
+storage:
+  durability: "async"
+`,
+			expectError: true,
+			errorMsg:    "invalid durability",
+		},
+		{
+			name: "invalid chunk pubsub mode",
+			config: `
+repository_path: "./data"
+p2p:
+  chunk_pubsub: "on"
+`,
+			expectError: true,
+			errorMsg:    "invalid chunk_pubsub",
+		},
+		{
+			name: "unknown storage backend",
+			config: `
+repository_path: "./data"
+storage:
+  backend: "tape"
+`,
+			expectError: true,
+			errorMsg:    "invalid backend",
+		},
+		{
+			name: "s3 backend without bucket",
+			config: `
+repository_path: "./data"
+storage:
+  backend: "s3"
+  s3:
+    endpoint: "http://minio:9000"
+`,
+			expectError: true,
+			errorMsg:    "storage.s3.endpoint and storage.s3.bucket are required",
+		},
+		{
+			name: "sftp backend without credentials",
+			config: `
+repository_path: "./data"
+storage:
+  backend: "sftp"
+  sftp:
+    host: "backup.example.com"
+    user: "shadowvault"
+    path: "/srv/backups"
+`,
+			expectError: true,
+			errorMsg:    "storage.sftp needs a key_file or a password",
+		},
+		{
+			name: "repack threshold out of range",
+			config: `
+repository_path: "./data"
+storage:
+  backend: "pack"
+  pack:
+    repack_threshold: 1.5
+`,
+			expectError: true,
+			errorMsg:    "storage.pack.repack_threshold must be between 0 and 1",
+		},
+		{
+			name: "negative gc grace",
+			config: `
+repository_path: "./data"
+storage:
+  gc_grace: -1h
+`,
+			expectError: true,
+			errorMsg:    "gc_grace must be >= 0",
+		},
+		{
+			name: "negative restore readahead",
+			config: `
+repository_path: "./data"
+storage:
+  restore_readahead: -4
+`,
+			expectError: true,
+			errorMsg:    "restore_readahead",
+		},
+		{
+			name: "metadata backup keeps nothing",
+			config: `
+repository_path: "./data"
+metadata_backup:
+  keep: -1
+`,
+			expectError: true,
+			errorMsg:    "metadata_backup",
+		},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,345 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hoangsonww/backupagent/config"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/progress"
+	"github.com/hoangsonww/backupagent/internal/snapshots"
+)
+
+// Operation kinds subject to admission control
+const (
+	OpBackup  = "backup"
+	OpRestore = "restore"
+	OpGC      = "gc"
+)
+
+// Operation states
+const (
+	OpQueued    = "queued"
+	OpRunning   = "running"
+	OpDone      = "done"
+	OpFailed    = "failed"
+	OpCancelled = "cancelled"
+)
+
+const (
+	// opHistory is how many finished operations are remembered
+	opHistory = 100
+	// defaultOpDuration is assumed for Retry-After before any run finished
+	defaultOpDuration = time.Minute
+)
+
+// ErrQueueFull is wrapped by QueueFullError
+var ErrQueueFull = errors.New("operation queue full")
+
+// ErrOperationFinished is returned for cancelling an operation that has
+// finished already.
+var ErrOperationFinished = errors.New("operation already finished")
+
+// QueueFullError rejects an operation whose queue is full.
+type QueueFullError struct {
+	Kind       string
+	RetryAfter time.Duration // estimate of when a queue slot frees up
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("%s queue full, retry after %s", e.Kind, e.RetryAfter.Round(time.Second))
+}
+
+func (e *QueueFullError) Unwrap() error { return ErrQueueFull }
+
+// Operation is a backup, restore or GC admitted by the agent.
+type Operation struct {
+	ID         string    `json:"id"`
+	Kind       string    `json:"kind"`
+	Target     string    `json:"target,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"` // of the API call that submitted it
+	State      string    `json:"state"`
+	Position   int       `json:"position,omitempty"` // 1-based place in the queue while queued
+	Error      string    `json:"error,omitempty"`
+	Warning    string    `json:"warning,omitempty"` // of an operation that finished with problems, e.g. skipped files
+	QueuedAt   time.Time `json:"queued_at"`
+	StartedAt  time.Time `json:"started_at,omitempty"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+
+	Throttle *ThrottleSettings `json:"throttle,omitempty"` // of a throttled operation
+	Progress *OpProgress       `json:"progress,omitempty"` // of a started backup or restore
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	cancelled bool // CancelOperation was called
+	run       func(ctx context.Context) error
+	throttle  *Throttle
+	progress  *progress.Tracker // set when the operation starts
+}
+
+// OpProgress is how far an operation has got.
+type OpProgress = progress.Report
+
+// opLane runs one kind of operation with bounded concurrency and queue
+type opLane struct {
+	limit   int
+	running int
+	queue   []*Operation
+	avg     time.Duration // moving average of run time
+}
+
+// admission queues operations per kind and starts them as slots free up.
+type admission struct {
+	mu       sync.Mutex
+	maxQueue int
+	lanes    map[string]*opLane
+	ops      map[string]*Operation
+	finished []string // IDs of finished operations, oldest first
+	seq      uint64
+	held     bool // queued operations wait, the agent being over a resource limit
+}
+
+func newAdmission(cfg config.AdmissionConfig) *admission {
+	return &admission{
+		maxQueue: cfg.MaxQueued,
+		lanes: map[string]*opLane{
+			OpBackup:  {limit: cfg.MaxBackups},
+			OpRestore: {limit: cfg.MaxRestores},
+			OpGC:      {limit: 1},
+		},
+		ops: make(map[string]*Operation),
+	}
+}
+
+// Submit admits an operation of kind on target. It starts at once if a slot
+// is free, is queued otherwise, and is rejected with a *QueueFullError when
+// the queue is full. The returned copy reports its initial state. The request
+// ID of ctx is recorded and handed to run, which outlives ctx itself.
+func (a *Agent) Submit(ctx context.Context, kind, target string, run func(ctx context.Context) error) (*Operation, error) {
+	return a.SubmitThrottled(ctx, kind, target, nil, run)
+}
+
+// SubmitThrottled is Submit for an operation whose throttle th can be
+// changed with AdjustOperation until it finishes.
+func (a *Agent) SubmitThrottled(ctx context.Context, kind, target string, th *Throttle, run func(ctx context.Context) error) (*Operation, error) {
+	ad := a.admission
+	ad.mu.Lock()
+	defer ad.mu.Unlock()
+
+	lane, ok := ad.lanes[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown operation kind %q", kind)
+	}
+	if (lane.running >= lane.limit || ad.held) && len(lane.queue) >= ad.maxQueue {
+		return nil, &QueueFullError{Kind: kind, RetryAfter: lane.retryAfter()}
+	}
+
+	ad.seq++
+	requestID := monitoring.RequestID(ctx)
+	opCtx, cancel := context.WithCancel(monitoring.WithRequestID(context.Background(), requestID))
+	op := &Operation{
+		ID:        fmt.Sprintf("%s-%d-%d", kind, time.Now().Unix(), ad.seq),
+		Kind:      kind,
+		Target:    target,
+		RequestID: requestID,
+		State:     OpQueued,
+		QueuedAt:  time.Now(),
+		ctx:       opCtx,
+		cancel:    cancel,
+		run:       run,
+		throttle:  th,
+	}
+	ad.ops[op.ID] = op
+	lane.queue = append(lane.queue, op)
+	ad.dispatchLocked(lane)
+
+	if op.State == OpQueued {
+		if ad.held {
+			monitoring.GetMetrics().JobsDeferred.Add(1)
+		}
+		monitoring.LoggerFor(op.ctx).WithFields(map[string]interface{}{
+			"operation": op.ID,
+			"position":  len(lane.queue),
+		}).Infof("Queued %s", kind)
+	}
+	return ad.snapshotLocked(op), nil
+}
+
+// Operations lists queued and running operations and recently finished ones.
+func (a *Agent) Operations() []*Operation {
+	ad := a.admission
+	ad.mu.Lock()
+	defer ad.mu.Unlock()
+	out := make([]*Operation, 0, len(ad.ops))
+	for _, op := range ad.ops {
+		out = append(out, ad.snapshotLocked(op))
+	}
+	return out
+}
+
+// Operation returns the current state of one operation.
+func (a *Agent) Operation(id string) (*Operation, bool) {
+	ad := a.admission
+	ad.mu.Lock()
+	defer ad.mu.Unlock()
+	op, ok := ad.ops[id]
+	if !ok {
+		return nil, false
+	}
+	return ad.snapshotLocked(op), true
+}
+
+// CancelOperation stops an operation: a queued one is dropped from its
+// queue, and a running one has its context cancelled, which aborts the
+// walk, ingest or transfer it is in. A running operation is still running
+// when this returns, and is cancelled once it has stopped. An operation
+// that has finished fails with ErrOperationFinished.
+func (a *Agent) CancelOperation(id string) (*Operation, error) {
+	ad := a.admission
+	ad.mu.Lock()
+	defer ad.mu.Unlock()
+	op, ok := ad.ops[id]
+	if !ok {
+		return nil, ErrOperationNotFound
+	}
+	switch op.State {
+	case OpQueued:
+		monitoring.LoggerFor(op.ctx).WithField("operation", op.ID).Infof("Cancelled queued %s", op.Kind)
+		lane := ad.lanes[op.Kind]
+		for i, q := range lane.queue {
+			if q == op {
+				lane.queue = append(lane.queue[:i], lane.queue[i+1:]...)
+				break
+			}
+		}
+		op.cancelled = true
+		op.cancel()
+		op.State, op.FinishedAt = OpCancelled, time.Now()
+		op.ctx, op.run, op.throttle = nil, nil, nil
+		ad.finishLocked(op)
+	case OpRunning:
+		if !op.cancelled {
+			op.cancelled = true
+			op.cancel()
+			monitoring.LoggerFor(op.ctx).WithField("operation", op.ID).Infof("Cancelling %s", op.Kind)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s is %s", ErrOperationFinished, op.ID, op.State)
+	}
+	return ad.snapshotLocked(op), nil
+}
+
+// hold stops or resumes starting queued operations; running ones go on
+func (ad *admission) hold(on bool) {
+	ad.mu.Lock()
+	defer ad.mu.Unlock()
+	ad.held = on
+	for _, lane := range ad.lanes {
+		ad.dispatchLocked(lane)
+	}
+}
+
+// dispatchLocked starts queued operations while the lane has free slots
+// and operations are not held
+func (ad *admission) dispatchLocked(lane *opLane) {
+	for !ad.held && lane.running < lane.limit && len(lane.queue) > 0 {
+		op := lane.queue[0]
+		lane.queue = lane.queue[1:]
+		lane.running++
+		op.State = OpRunning
+		op.StartedAt = time.Now()
+		if op.Kind != OpGC {
+			op.progress = progress.New()
+			op.ctx = progress.With(op.ctx, op.progress)
+		}
+		go ad.execute(lane, op)
+	}
+}
+
+func (ad *admission) execute(lane *opLane, op *Operation) {
+	logger := monitoring.LoggerFor(op.ctx).WithField("operation", op.ID)
+	logger.Debugf("Started %s", op.Kind)
+	err := op.run(op.ctx)
+
+	ad.mu.Lock()
+	defer ad.mu.Unlock()
+	op.cancel()
+	op.FinishedAt = time.Now()
+	op.ctx, op.run = nil, nil
+	if op.throttle != nil {
+		s := op.throttle.Settings()
+		op.Throttle, op.throttle = &s, nil
+	}
+	op.Progress, op.progress = op.progress.Report(), nil
+	switch {
+	case op.cancelled && err != nil:
+		op.State = OpCancelled
+		op.Error = err.Error()
+		logger.Infof("%s cancelled", op.Kind)
+	case errors.Is(err, snapshots.ErrFilesSkipped), errors.Is(err, snapshots.ErrFilesQuarantined):
+		op.State = OpDone
+		op.Warning = err.Error()
+	case err != nil:
+		op.State = OpFailed
+		op.Error = err.Error()
+		logger.WithError(err).Errorf("%s failed", op.Kind)
+	default:
+		op.State = OpDone
+	}
+	took := op.FinishedAt.Sub(op.StartedAt)
+	if lane.avg == 0 {
+		lane.avg = took
+	} else {
+		lane.avg = (lane.avg*3 + took) / 4
+	}
+	lane.running--
+	ad.finishLocked(op)
+	ad.dispatchLocked(lane)
+}
+
+// finishLocked remembers op among the finished operations, forgetting the
+// oldest beyond opHistory
+func (ad *admission) finishLocked(op *Operation) {
+	ad.finished = append(ad.finished, op.ID)
+	if len(ad.finished) > opHistory {
+		delete(ad.ops, ad.finished[0])
+		ad.finished = ad.finished[1:]
+	}
+}
+
+// snapshotLocked copies op with its current queue position filled in
+func (ad *admission) snapshotLocked(op *Operation) *Operation {
+	cp := *op
+	cp.ctx, cp.cancel, cp.run, cp.throttle, cp.progress = nil, nil, nil, nil, nil
+	if op.throttle != nil {
+		s := op.throttle.Settings()
+		cp.Throttle = &s
+	}
+	cp.Progress = op.progress.Report()
+	if op.State == OpQueued {
+		for i, q := range ad.lanes[op.Kind].queue {
+			if q == op {
+				cp.Position = i + 1
+				break
+			}
+		}
+	}
+	return &cp
+}
+
+// retryAfter estimates when the queue will have room again: the head of
+// the queue starts once one of the running operations finishes
+func (lane *opLane) retryAfter() time.Duration {
+	avg := lane.avg
+	if avg == 0 {
+		avg = defaultOpDuration
+	}
+	wait := avg / time.Duration(lane.limit)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
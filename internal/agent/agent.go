@@ -3,24 +3,51 @@ package agent
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/hoangsonww/backupagent/config"
+	"github.com/hoangsonww/backupagent/internal/approval"
 	"github.com/hoangsonww/backupagent/internal/auth"
+	"github.com/hoangsonww/backupagent/internal/chaos"
+	"github.com/hoangsonww/backupagent/internal/chunkcache"
+	"github.com/hoangsonww/backupagent/internal/chunker"
+	"github.com/hoangsonww/backupagent/internal/compression"
+	"github.com/hoangsonww/backupagent/internal/contentpolicy"
 	"github.com/hoangsonww/backupagent/internal/crypto"
+	sverrors "github.com/hoangsonww/backupagent/internal/errors"
+	"github.com/hoangsonww/backupagent/internal/exclude"
+	"github.com/hoangsonww/backupagent/internal/fspath"
+	"github.com/hoangsonww/backupagent/internal/identity"
+	"github.com/hoangsonww/backupagent/internal/journal"
+	"github.com/hoangsonww/backupagent/internal/maintenance"
 	"github.com/hoangsonww/backupagent/internal/monitoring"
 	"github.com/hoangsonww/backupagent/internal/p2p"
 	"github.com/hoangsonww/backupagent/internal/persistence"
 	"github.com/hoangsonww/backupagent/internal/protocol"
+	"github.com/hoangsonww/backupagent/internal/recovery"
+	"github.com/hoangsonww/backupagent/internal/scheduler"
 	"github.com/hoangsonww/backupagent/internal/snapshots"
 	"github.com/hoangsonww/backupagent/internal/storage"
 	"github.com/hoangsonww/backupagent/internal/versioning"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Messages waiting to be handled per subscription; pubsub drops what does
+// not fit, so the control topic gets room to ride out bursts.
+const (
+	controlBufferSize = 256
+	dataBufferSize    = 64
 )
 
 type Agent struct {
@@ -29,57 +56,411 @@ type Agent struct {
 	Store      *storage.Store
 	P2P        *p2p.P2PHost
 	ACL        *auth.ACL
+	Approvals  *approval.Manager
+	Recovery   *recovery.Manager
+	Journal    journal.Journal // nil when snapshots always walk the whole tree
+	Index      *snapshots.Index
 	SignerPub  []byte
 	SignerPriv []byte
+	RepoID     string
+	Chunking   chunker.Params        // how new snapshots split files
+	Excludes   *exclude.Set          // paths left out of new snapshots
+	Policy     *contentpolicy.Policy // flags, or withholds, files that look like secrets
+	// Maintenance runs GC and verification inside the maintenance window
+	Maintenance *maintenance.Orchestrator
+	// PostProcessors see every snapshot the agent creates before it is
+	// saved; an embedder registers its own here before the first backup
+	PostProcessors snapshots.PostProcessors
+
+	importMu    sync.RWMutex
+	importRepos map[string]bool
+
+	opMu       sync.RWMutex
+	opHandlers map[string]func(json.RawMessage) error
+
+	mirrorMu    sync.Mutex
+	mirrorKicks []chan struct{}
+
+	freshnessKick chan struct{}
+
+	admission *admission
+	resources *resourceGuard
 }
 
 func New(cfg *config.Config, passphrase string) (*Agent, error) {
+	compile := exclude.WithDefaults
+	if cfg.Snapshot.NoDefaultExcludes {
+		compile = exclude.Compile
+	}
+	excludes, err := compile(cfg.Snapshot.Excludes)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot.excludes: %w", err)
+	}
+	policy, err := contentpolicy.Compile(cfg.Snapshot.ContentPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot.content_policy: %w", err)
+	}
+
 	// Open DB
 	dbPath := filepath.Join(cfg.RepositoryPath, "metadata.db")
 	db, err := persistence.Open(dbPath)
 	if err != nil {
 		return nil, err
 	}
-	// derive master key
-	key := crypto.DeriveKey(passphrase, nil)
-	store, err := storage.New(db, key)
+	// Stamp or check the repository ID so a wrong data dir is caught early
+	repoID, err := db.RepositoryID(cfg.RepositoryID)
 	if err != nil {
 		return nil, err
 	}
-	// Load ACL
+
+	// Bring stored snapshot records up to the current schema
+	migrated, err := versioning.MigrateSnapshots(db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate snapshots: %w", err)
+	}
+	if migrated > 0 {
+		monitoring.GetLogger().Infof("Migrated %d snapshot record(s) to schema v%d", migrated, versioning.CurrentSchemaVersion)
+	}
+	// derive master key with the salt stored in the repository
+	salt, err := db.KeySalt()
+	if err != nil {
+		return nil, err
+	}
+	key := crypto.DeriveKey(passphrase, salt)
+	store, err := openStore(cfg, db, key)
+	if err != nil {
+		return nil, err
+	}
+	// Chunks compressed against a dictionary open only once it is loaded
+	dicts, err := store.LoadDicts()
+	if sverrors.GetErrorCode(err) == sverrors.ErrCodeDecryptionFailed {
+		return nil, fmt.Errorf("%w: %v", persistence.ErrStateKey, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Snapshot.Compression {
+		levels, err := compression.ParseLevels(cfg.Snapshot.CompressionLevels)
+		if err != nil {
+			return nil, err
+		}
+		policy, err := compression.NewPolicy(levels)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Snapshot.CompressionDicts {
+			// The newest dictionary of each kind wins
+			for _, d := range dicts {
+				if err := policy.UseDict(d); err != nil {
+					return nil, err
+				}
+			}
+		}
+		store.SetCompression(policy)
+	}
+	// Seal peer and mirror state at rest, making sure first that a wrong
+	// passphrase does not seal it under the wrong key
+	sealed, err := db.StateSealed()
+	if err != nil {
+		return nil, err
+	}
+	if !sealed {
+		if err := checkPassphrase(db, store, repoID); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.EnableSealing(key); err != nil {
+		return nil, err
+	}
+	// Operations awaiting approval used to sit unsealed among the ACLs
+	moved, err := approval.MigratePending(db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate pending operations: %w", err)
+	}
+	if moved > 0 {
+		monitoring.GetLogger().Infof("Sealed %d pending operation(s)", moved)
+	}
+	// Existing repositories keep the chunking their chunks were cut with
+	// unless the config picks another
+	initial, err := initialChunker(db)
+	if err != nil {
+		return nil, err
+	}
+	algo, changed, err := db.Chunker(cfg.Snapshot.Chunker, initial)
+	if err != nil {
+		return nil, err
+	}
+	// except fnv, whose boundaries all move after an edit: it is only kept
+	// while the config asks for it
+	if algo == chunker.FNV && cfg.Snapshot.Chunker == "" {
+		if algo, changed, err = db.Chunker(chunker.Default, initial); err != nil {
+			return nil, err
+		}
+	}
+	if changed {
+		monitoring.GetLogger().WithField("chunker", algo).
+			Info("Repository chunking algorithm changed; files are rechunked on their next snapshot")
+	}
+	if algo == chunker.FNV {
+		monitoring.GetLogger().WithField("chunker", algo).
+			Warn("snapshot.chunker is fnv, whose boundaries all move after an edit; edited files are stored again in full")
+	}
+	// Keep the chunks peers ask for most in memory
+	store.EnableServeCache(cfg.Storage.MaxCacheSize)
+	// Binaries built with the chaos tag inject the faults set in the
+	// environment; others ignore it
+	faults, err := chaos.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	var netFaults p2p.Faults
+	if faults != nil {
+		monitoring.GetLogger().WithField("faults", faults.Faults().String()).
+			Warn("Fault injection enabled")
+		store.SetFaults(faults)
+		netFaults = faults
+	}
+	if cfg.Storage.Durability == storage.DurabilityWAL {
+		err := store.EnableWAL(storage.WALOptions{
+			Path:         filepath.Join(cfg.RepositoryPath, "chunks.wal"),
+			SyncInterval: cfg.Storage.WALSyncInterval,
+			MaxPending:   cfg.Storage.WALMaxPending,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Load ACL and replay the stored admin key updates on top of it
 	acl := auth.NewACL(cfg.ACL.Admins)
+	updates, err := auth.LoadKeyUpdates(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, upd := range updates {
+		if err := acl.Apply(upd, false); err != nil && err != auth.ErrUpdateApplied {
+			monitoring.GetLogger().WithError(err).Warnf("Skipping stored admin update for %s", upd.AdminPub)
+		}
+	}
 
-	// Generate or load identity keypair for signing / peer identity
-	pub, priv, err := crypto.GenerateEd25519Keypair()
+	// Load or create the persistent identity used for signing and peer identity
+	idKey, _, err := identity.LoadOrCreate(cfg.RepositoryPath)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := idKey.Raw()
+	if err != nil {
+		return nil, err
+	}
+	pub, err := idKey.GetPublic().Raw()
 	if err != nil {
 		return nil, err
 	}
 
 	// Setup P2P with libp2p
-	p2phost, err := p2p.Setup(cfg, nil, store, pub, priv)
+	p2phost, err := p2p.Setup(cfg, idKey, db, store, pub, priv, netFaults)
 	if err != nil {
 		return nil, err
 	}
 
+	// Use the OS change journal to skip unchanged parts of snapshot sources
+	var changes journal.Journal
+	if cfg.Snapshot.ChangeJournal != "off" {
+		if changes, err = journal.Open(); err != nil {
+			monitoring.GetLogger().WithError(err).Info("No change journal, snapshots will walk their sources")
+			changes = nil
+		}
+	}
+
 	agent := &Agent{
 		Config:     cfg,
 		DB:         db,
 		Store:      store,
 		P2P:        p2phost,
 		ACL:        acl,
+		Approvals:  approval.NewManager(db, acl, cfg.ACL.ApprovalTTL),
+		Recovery:   recovery.NewManager(db, pub, priv),
+		Journal:    changes,
+		Index:      snapshots.NewIndex(db, changes),
 		SignerPub:  pub,
 		SignerPriv: priv,
+		RepoID:     repoID,
+		Chunking: chunker.Params{
+			Algorithm: algo,
+			Min:       cfg.Snapshot.MinChunkSize,
+			Max:       cfg.Snapshot.MaxChunkSize,
+			Avg:       cfg.Snapshot.AvgChunkSize,
+		},
+		Excludes: excludes,
+		Policy:   policy,
+
+		importRepos: make(map[string]bool),
+		opHandlers:  make(map[string]func(json.RawMessage) error),
+		admission:   newAdmission(cfg.Admission),
+		resources:   newResourceGuard(cfg.Resources),
+
+		freshnessKick: make(chan struct{}, 1),
+	}
+	// Mirrors push their snapshots to us in return
+	for _, m := range cfg.Mirrors {
+		agent.AllowImport(m.RepositoryID)
+	}
+	p2phost.ChunkFetcher.SetRepository(repoID, agent.acceptsRepository)
+	p2p.ServePush(p2phost.Host, db, store, p2phost.ChunkFetcher, agent.authorizePush)
+	p2p.ServePull(p2phost.Host, db, store, p2phost.ChunkFetcher, agent.authorizePull)
+	p2p.ServeManifests(p2phost.Host, db, p2phost.ChunkFetcher, p2phost.Scorer)
+	p2p.ServeChunks(p2phost.Host, p2phost.ChunkFetcher, p2phost.Scorer)
+	if cfg.Cache.Enabled {
+		dir := cfg.Cache.Dir
+		if dir == "" {
+			dir = filepath.Join(cfg.RepositoryPath, "cache")
+		}
+		cache, err := chunkcache.Open(dir, cfg.Cache.Size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open chunk cache: %w", err)
+		}
+		p2p.ServeCache(p2phost.Host, cache, p2phost.ChunkFetcher, p2phost.Scorer, !cfg.Cache.AllowWAN)
+	}
+	agent.RegisterOperationHandler(approval.KindPeerRemove, agent.executePeerRemove)
+	agent.RegisterOperationHandler(approval.KindAdminKeyUpdate, agent.executeAdminKeyUpdate)
+	if agent.Maintenance, err = agent.newMaintenance(); err != nil {
+		return nil, err
 	}
 	return agent, nil
 }
 
+// initialChunker is the algorithm stamped on a repository without one: FNV,
+// the only algorithm there used to be, if it already holds snapshots
+func initialChunker(db *persistence.DB) (string, error) {
+	initial := chunker.Default
+	err := db.View(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket([]byte(persistence.BucketSnapshots)).Cursor().First(); k != nil {
+			initial = chunker.FNV
+		}
+		return nil
+	})
+	return initial, err
+}
+
+// checkPassphrase decrypts a stored chunk of one of the repository's own
+// snapshots, if there is one, to tell whether the master key is right
+func checkPassphrase(db *persistence.DB, store *storage.Store, repoID string) error {
+	all, err := versioning.ListAllSnapshots(db)
+	if err != nil {
+		return err
+	}
+	for _, snap := range all {
+		if snap.RepoID != repoID && snap.RepoID != "" {
+			continue
+		}
+		for _, h := range snap.Chunks {
+			if !store.Exists(h) {
+				continue
+			}
+			_, err := store.GetChunk(h)
+			if sverrors.GetErrorCode(err) == sverrors.ErrCodeDecryptionFailed {
+				return fmt.Errorf("%w: %v", persistence.ErrStateKey, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the P2P host and the loops started with it, indexes chunks
+// still staged in the WAL and closes the metadata DB.
+func (a *Agent) Close() error {
+	// Pin keeping, pubsub handlers and the other loops of the host use the
+	// DB, so they stop first
+	a.P2P.Cancel()
+	if err := a.P2P.Host.Close(); err != nil {
+		monitoring.GetLogger().WithError(err).Warn("Failed to close P2P host")
+	}
+	a.P2P.Wait()
+	if err := a.P2P.Locations.Flush(); err != nil {
+		monitoring.GetLogger().WithError(err).Warn("Failed to save chunk location hints")
+	}
+	if err := a.Store.Close(); err != nil {
+		a.DB.Close()
+		return err
+	}
+	return a.DB.Close()
+}
+
 func (a *Agent) RunDaemon(ctx context.Context) error {
-	// Subscribe to sync topic, respond to incoming updates
-	sub, err := a.P2P.Topic.Subscribe()
+	// Subscribe to the sync topics, respond to incoming updates. Chunk
+	// traffic is read separately, so a backlog of it never delays control
+	// messages.
+	sub, err := a.P2P.Topic.Subscribe(pubsub.WithBufferSize(controlBufferSize))
 	if err != nil {
 		return err
 	}
-	go a.handlePubSub(sub)
+	go a.handlePubSub(sub, a.P2P.Topic)
+	if a.P2P.DataTopic != a.P2P.Topic {
+		dataSub, err := a.P2P.DataTopic.Subscribe(pubsub.WithBufferSize(dataBufferSize))
+		if err != nil {
+			return err
+		}
+		go a.handlePubSub(dataSub, a.P2P.DataTopic)
+	}
+
+	// SIGQUIT writes a diagnostic dump rather than killing the daemon
+	go a.dumpOnSignal(a.P2P.Ctx)
+
+	// Watch our own memory and goroutines, shedding load over the limits
+	go a.runResourceGuard(a.P2P.Ctx)
+
+	// Share our revocation list so peers that missed updates catch up
+	if err := a.GossipRevocationList(); err != nil {
+		monitoring.GetLogger().WithError(err).Warn("Failed to gossip revocation list")
+	}
+
+	// Exchange known-good peer addresses so the whole swarm is learned quickly
+	go a.runPeerExchange(a.P2P.Ctx)
+
+	// Advertise the space we host for the swarm
+	go a.runStorageOffers(a.P2P.Ctx)
+
+	// Replicate to and verify configured mirrors
+	a.runMirrors(a.P2P.Ctx)
+
+	// Alert when a source goes without a snapshot for too long
+	if len(a.Config.Freshness.Targets) > 0 {
+		go a.runFreshness(a.P2P.Ctx)
+	}
+
+	// Keep an encrypted copy of the repository metadata with the mirrors
+	if !a.Config.MetadataBackup.Disable {
+		go a.runMetadataBackups(a.P2P.Ctx)
+	}
+
+	// Pick up first backups that were still seeding when we stopped
+	go a.resumeSeeds(a.P2P.Ctx)
+
+	// Move chunks written before storage.backend changed into the new one
+	go a.migrateChunks(a.P2P.Ctx)
+
+	// Garbage collection and verification wait for the maintenance window
+	go a.Maintenance.Run(a.P2P.Ctx)
+
+	// Record changes to backup sources from now on so the next snapshot
+	// of each only reads what changed
+	watched := append([]string(nil), a.Config.Scheduler.BackupPaths...)
+	for _, g := range a.Config.Scheduler.SourceGroups {
+		watched = append(watched, g.Paths...)
+	}
+	watched = append(watched, a.Config.Scheduler.ShutdownPaths...)
+	a.Index.Watch(watched)
+
+	// Snapshot critical paths before the system shuts down or a user
+	// logs out
+	if len(a.Config.Scheduler.ShutdownPaths) > 0 {
+		a.watchSessionEnd(a.P2P.Ctx)
+	}
+
+	// Snapshot the configured paths on schedule
+	if a.Config.Scheduler.EnableAutoBackup {
+		a.runScheduledBackups(a.P2P.Ctx)
+	}
 
 	// Graceful shutdown
 	c := make(chan os.Signal, 1)
@@ -90,11 +471,54 @@ func (a *Agent) RunDaemon(ctx context.Context) error {
 		a.P2P.Cancel()
 		return nil
 	case <-ctx.Done():
+		a.P2P.Cancel()
 		return ctx.Err()
 	}
 }
 
-func (a *Agent) handlePubSub(sub *pubsub.Subscription) {
+// runScheduledBackups snapshots each of scheduler.backup_paths and
+// scheduler.source_groups every scheduler.backup_interval, between the
+// backup hooks, until ctx ends
+func (a *Agent) runScheduledBackups(ctx context.Context) {
+	cfg := a.Config.Scheduler
+	sched := scheduler.NewScheduler(func(path string) error {
+		if err := a.resources.wait(ctx, "scheduled backup of "+path); err != nil {
+			return err
+		}
+		var err error
+		if group, ok := strings.CutPrefix(path, versioning.GroupPrefix); ok {
+			var paths []string
+			if paths, err = a.SourceGroup(group); err == nil {
+				_, err = a.BackupGroupWithHooks(ctx, group, paths)
+			}
+		} else {
+			_, err = a.BackupWithHooks(ctx, path)
+		}
+		var skipped *snapshots.SkippedError
+		if errors.As(err, &skipped) {
+			return nil // saved, and the skipped files logged
+		}
+		return err
+	})
+	if err := sched.LoadFromConfig(cfg.BackupPaths, cfg.BackupInterval, cfg.MaxBackupRetries); err != nil {
+		monitoring.GetLogger().WithError(err).Error("Failed to schedule backups")
+		return
+	}
+	for _, g := range cfg.SourceGroups {
+		if err := sched.AddTask("config-group-"+g.Name, versioning.GroupSource(g.Name), cfg.BackupInterval, cfg.MaxBackupRetries); err != nil {
+			monitoring.GetLogger().WithError(err).Error("Failed to schedule backups")
+			return
+		}
+	}
+	sched.Start()
+	go func() {
+		<-ctx.Done()
+		sched.Stop()
+	}()
+}
+
+// handlePubSub handles the messages of sub, a subscription to topic
+func (a *Agent) handlePubSub(sub *pubsub.Subscription, topic *pubsub.Topic) {
 	logger := monitoring.GetLogger()
 
 	for {
@@ -108,37 +532,60 @@ func (a *Agent) handlePubSub(sub *pubsub.Subscription) {
 		monitoring.GetMetrics().RecordMessageReceived()
 
 		// Parse message
+		from := msg.GetFrom()
 		var envelope map[string]interface{}
 		if err := json.Unmarshal(msg.Data, &envelope); err != nil {
 			logger.WithError(err).Warn("Failed to parse pubsub message")
+			a.penalize(from, p2p.OffenseMalformed)
 			continue
 		}
 
 		msgType, ok := envelope["type"].(string)
 		if !ok {
 			logger.Warn("Message missing type field")
+			a.penalize(from, p2p.OffenseMalformed)
 			continue
 		}
 
 		// Handle different message types
 		switch msgType {
+		case "snapshot_header":
+			a.handleSnapshotHeader(envelope, from)
 		case "snapshot_announcement":
-			a.handleSnapshotAnnouncement(envelope, msg.GetFrom().String())
+			a.handleSnapshotAnnouncement(envelope, from)
 		case "chunk_request":
-			a.handleChunkRequest(envelope)
+			a.handleChunkRequest(envelope, from, topic)
 		case "chunk_response":
-			a.handleChunkResponse(envelope)
+			a.handleChunkResponse(envelope, from)
 		case "peer_add":
-			a.handlePeerAdd(envelope)
+			a.handlePeerAdd(envelope, from)
 		case "peer_remove":
-			a.handlePeerRemove(envelope)
+			a.handlePeerRemove(envelope, from)
+		case "peer_list":
+			a.handlePeerList(envelope, from)
+		case "storage_offer":
+			a.handleStorageOffer(envelope, from)
+		case "admin_key_update":
+			a.handleAdminKeyUpdate(envelope)
+		case "revocation_list":
+			a.handleRevocationList(envelope)
+		case "operation_proposal":
+			a.handleOperationProposal(envelope)
+		case "operation_approval":
+			a.handleOperationApproval(envelope)
+		case "key_share":
+			a.handleKeyShare(envelope)
+		case "share_request":
+			a.handleShareRequest(envelope)
+		case "share_release":
+			a.handleShareRelease(envelope)
 		default:
 			logger.Warnf("Unknown message type: %s", msgType)
 		}
 	}
 }
 
-func (a *Agent) handleSnapshotAnnouncement(envelope map[string]interface{}, peerID string) {
+func (a *Agent) handleSnapshotAnnouncement(envelope map[string]interface{}, from peer.ID) {
 	logger := monitoring.GetLogger()
 
 	annData, err := json.Marshal(envelope["announcement"])
@@ -150,17 +597,42 @@ func (a *Agent) handleSnapshotAnnouncement(envelope map[string]interface{}, peer
 	var ann protocol.SnapshotAnnouncement
 	if err := json.Unmarshal(annData, &ann); err != nil {
 		logger.WithError(err).Error("Failed to unmarshal snapshot announcement")
+		a.penalize(from, p2p.OffenseMalformed)
 		return
 	}
 
 	// Use snapshot syncer to handle announcement
 	syncer := p2p.NewSnapshotSyncer(a.Store, a.P2P.ChunkFetcher, a.SignerPub, a.SignerPriv)
-	if err := syncer.HandleSnapshotAnnouncement(a.P2P.Ctx, &ann, a.P2P.Topic, peerID, a.DB); err != nil {
+	if err := syncer.HandleSnapshotAnnouncement(a.P2P.Ctx, &ann, a.P2P.DataTopic, from.String(), a.DB); err != nil {
 		logger.WithError(err).Error("Failed to handle snapshot announcement")
+		a.penalizeErr(from, err)
 	}
 }
 
-func (a *Agent) handleChunkRequest(envelope map[string]interface{}) {
+func (a *Agent) handleSnapshotHeader(envelope map[string]interface{}, from peer.ID) {
+	logger := monitoring.GetLogger()
+
+	var hdr protocol.SnapshotHeader
+	if err := decodeEnvelope(envelope, "header", &hdr); err != nil {
+		logger.WithError(err).Error("Failed to decode snapshot header")
+		a.penalize(from, p2p.OffenseMalformed)
+		return
+	}
+	if _, err := versioning.LoadSnapshot(a.DB, hdr.ID); err == nil {
+		logger.WithField("snapshot_id", hdr.ID).Debug("Announced snapshot already held")
+		return
+	}
+
+	syncer := p2p.NewSnapshotSyncer(a.Store, a.P2P.ChunkFetcher, a.SignerPub, a.SignerPriv)
+	if err := syncer.HandleSnapshotHeader(a.P2P.Ctx, &hdr, a.P2P.Host, a.P2P.DataTopic, from); err != nil {
+		logger.WithError(err).Error("Failed to handle snapshot header")
+		a.penalizeErr(from, err)
+	}
+}
+
+// handleChunkRequest answers on topic, the one the request came on, so a
+// peer from before the data topic, asking on the control topic, hears back
+func (a *Agent) handleChunkRequest(envelope map[string]interface{}, from peer.ID, topic *pubsub.Topic) {
 	logger := monitoring.GetLogger()
 
 	reqData, err := json.Marshal(envelope["request"])
@@ -172,16 +644,18 @@ func (a *Agent) handleChunkRequest(envelope map[string]interface{}) {
 	var req protocol.ChunkRequest
 	if err := json.Unmarshal(reqData, &req); err != nil {
 		logger.WithError(err).Error("Failed to unmarshal chunk request")
+		a.penalize(from, p2p.OffenseMalformed)
 		return
 	}
 
 	// Handle request using chunk fetcher
-	if err := a.P2P.ChunkFetcher.HandleChunkRequest(a.P2P.Ctx, &req, a.P2P.Topic); err != nil {
+	if err := a.P2P.ChunkFetcher.HandleChunkRequest(a.P2P.Ctx, &req, topic); err != nil {
 		logger.WithError(err).Error("Failed to handle chunk request")
+		a.penalizeErr(from, err)
 	}
 }
 
-func (a *Agent) handleChunkResponse(envelope map[string]interface{}) {
+func (a *Agent) handleChunkResponse(envelope map[string]interface{}, from peer.ID) {
 	logger := monitoring.GetLogger()
 
 	respData, err := json.Marshal(envelope["response"])
@@ -193,16 +667,18 @@ func (a *Agent) handleChunkResponse(envelope map[string]interface{}) {
 	var resp protocol.ChunkResponse
 	if err := json.Unmarshal(respData, &resp); err != nil {
 		logger.WithError(err).Error("Failed to unmarshal chunk response")
+		a.penalize(from, p2p.OffenseMalformed)
 		return
 	}
 
 	// Handle response using chunk fetcher
-	if err := a.P2P.ChunkFetcher.HandleChunkResponse(&resp); err != nil {
+	if err := a.P2P.ChunkFetcher.HandleChunkResponse(&resp, from); err != nil {
 		logger.WithError(err).Error("Failed to handle chunk response")
+		a.penalizeErr(from, err)
 	}
 }
 
-func (a *Agent) handlePeerAdd(envelope map[string]interface{}) {
+func (a *Agent) handlePeerAdd(envelope map[string]interface{}, from peer.ID) {
 	logger := monitoring.GetLogger()
 
 	addData, err := json.Marshal(envelope["peer_add"])
@@ -214,12 +690,14 @@ func (a *Agent) handlePeerAdd(envelope map[string]interface{}) {
 	var peerAdd protocol.PeerAdd
 	if err := json.Unmarshal(addData, &peerAdd); err != nil {
 		logger.WithError(err).Error("Failed to unmarshal peer add")
+		a.penalize(from, p2p.OffenseMalformed)
 		return
 	}
 
 	// Validate signature
 	if err := peerAdd.Validate(); err != nil {
 		logger.WithError(err).Warn("Invalid peer add signature")
+		a.penalize(from, p2p.OffenseInvalidSignature)
 		return
 	}
 
@@ -233,7 +711,7 @@ func (a *Agent) handlePeerAdd(envelope map[string]interface{}) {
 	monitoring.GetMetrics().RecordPeerDiscovered()
 }
 
-func (a *Agent) handlePeerRemove(envelope map[string]interface{}) {
+func (a *Agent) handlePeerRemove(envelope map[string]interface{}, from peer.ID) {
 	logger := monitoring.GetLogger()
 
 	removeData, err := json.Marshal(envelope["peer_remove"])
@@ -245,12 +723,14 @@ func (a *Agent) handlePeerRemove(envelope map[string]interface{}) {
 	var peerRemove protocol.PeerRemove
 	if err := json.Unmarshal(removeData, &peerRemove); err != nil {
 		logger.WithError(err).Error("Failed to unmarshal peer remove")
+		a.penalize(from, p2p.OffenseMalformed)
 		return
 	}
 
 	// Validate signature
 	if err := peerRemove.Validate(); err != nil {
 		logger.WithError(err).Warn("Invalid peer remove signature")
+		a.penalize(from, p2p.OffenseInvalidSignature)
 		return
 	}
 
@@ -260,28 +740,603 @@ func (a *Agent) handlePeerRemove(envelope map[string]interface{}) {
 		return
 	}
 
+	if a.Config.ACL.TwoPersonRule {
+		logger.Warn("Peer remove without second admin approval, ignoring")
+		return
+	}
+
 	logger.Infof("Peer remove validated: %s", peerRemove.PeerID)
+	if err := a.archivePeer(&peerRemove); err != nil {
+		logger.WithError(err).Error("Failed to remove stored peer")
+	}
+}
+
+func (a *Agent) handleAdminKeyUpdate(envelope map[string]interface{}) {
+	logger := monitoring.GetLogger()
+
+	var upd protocol.AdminKeyUpdate
+	if err := decodeEnvelope(envelope, "admin_key_update", &upd); err != nil {
+		logger.WithError(err).Error("Failed to decode admin key update")
+		return
+	}
+	if a.Config.ACL.TwoPersonRule {
+		logger.Warn("Admin key update without second admin approval, ignoring")
+		return
+	}
+	if err := a.acceptAdminKeyUpdate(&upd, true); err != nil && err != auth.ErrUpdateApplied {
+		logger.WithError(err).Warn("Rejected admin key update")
+	}
+}
+
+func (a *Agent) handleRevocationList(envelope map[string]interface{}) {
+	logger := monitoring.GetLogger()
+
+	var updates []*protocol.AdminKeyUpdate
+	if err := decodeEnvelope(envelope, "updates", &updates); err != nil {
+		logger.WithError(err).Error("Failed to decode revocation list")
+		return
+	}
+	for _, upd := range updates {
+		// Entries are historical, so only signatures and signer authority are checked
+		if err := a.acceptAdminKeyUpdate(upd, false); err != nil && err != auth.ErrUpdateApplied {
+			logger.WithError(err).Debugf("Skipping revocation list entry for %s", upd.AdminPub)
+		}
+	}
+}
+
+// acceptAdminKeyUpdate applies an update to the ACL and persists it if it changed anything.
+func (a *Agent) acceptAdminKeyUpdate(upd *protocol.AdminKeyUpdate, live bool) error {
+	if err := a.ACL.Apply(upd, live); err != nil {
+		return err
+	}
+	if err := auth.SaveKeyUpdate(a.DB, upd); err != nil {
+		return err
+	}
+	monitoring.GetLogger().WithFields(map[string]interface{}{
+		"action":    upd.Action,
+		"admin":     upd.AdminPub,
+		"signer":    upd.SignerPub,
+		"effective": upd.EffectiveAt,
+	}).Info("Admin key update applied")
+	return nil
+}
+
+// IssueAdminKeyUpdate signs an admin key add/rotate/revoke with our key,
+// applies it locally, and gossips it to peers. Under the two-person rule the
+// update is proposed instead and the pending operation ID is returned.
+func (a *Agent) IssueAdminKeyUpdate(action, adminPub, newAdminPub, reason string, effectiveAt time.Time) (string, error) {
+	now := time.Now().UTC()
+	if effectiveAt.IsZero() {
+		effectiveAt = now
+	}
+	upd := &protocol.AdminKeyUpdate{
+		Action:      action,
+		AdminPub:    adminPub,
+		NewAdminPub: newAdminPub,
+		EffectiveAt: effectiveAt.UTC().Format(time.RFC3339),
+		IssuedAt:    now.Format(time.RFC3339),
+		Reason:      reason,
+		SignerPub:   auth.PubKeyToString(a.SignerPub),
+	}
+	upd.Signature = auth.PubKeyToString(auth.SignPayload(upd.SigningPayload(), a.SignerPriv))
+
+	if a.Config.ACL.TwoPersonRule {
+		return a.ProposeOperation(approval.KindAdminKeyUpdate, upd)
+	}
+	if err := a.acceptAdminKeyUpdate(upd, true); err != nil {
+		return "", err
+	}
+	return "", a.publish("admin_key_update", "admin_key_update", upd)
+}
+
+// RemovePeer announces a signed removal of peerID to the network, with the
+// reason and whether it was for abuse. Under the two-person rule it is
+// proposed instead and the pending operation ID is returned.
+func (a *Agent) RemovePeer(peerID, reason string, abuse bool) (string, error) {
+	rm := a.signedRemoval(peerID, reason, abuse)
+
+	if a.Config.ACL.TwoPersonRule {
+		return a.ProposeOperation(approval.KindPeerRemove, rm)
+	}
+	if err := a.archivePeer(rm); err != nil {
+		return "", err
+	}
+	return "", a.publish("peer_remove", "peer_remove", rm)
+}
+
+// LookupPeer parses a multiaddr, or resolves a stored peer ID to the
+// addresses it was added with.
+func (a *Agent) LookupPeer(arg string) (*peer.AddrInfo, error) {
+	if maddr, err := ma.NewMultiaddr(arg); err == nil {
+		return peer.AddrInfoFromP2pAddr(maddr)
+	}
+	pid, err := peer.Decode(arg)
+	if err != nil {
+		return nil, fmt.Errorf("not a peer ID or multiaddr: %s", arg)
+	}
+	info := &peer.AddrInfo{ID: pid}
+	err = a.DB.View(func(tx *bolt.Tx) error {
+		b, err := a.DB.Sealed(tx, persistence.BucketPeers)
+		if err != nil {
+			return err
+		}
+		v, err := b.Get([]byte(arg))
+		if v == nil || err != nil {
+			return err
+		}
+		return json.Unmarshal(v, info)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// ConnectPeer resolves arg with LookupPeer and connects to it.
+func (a *Agent) ConnectPeer(ctx context.Context, arg string) (peer.ID, error) {
+	info, err := a.LookupPeer(arg)
+	if err != nil {
+		return "", err
+	}
+	if err := a.P2P.Host.Connect(ctx, *info); err != nil {
+		return "", fmt.Errorf("connect to %s: %w", info.ID, err)
+	}
+	return info.ID, nil
+}
+
+// AddPeer connects to the peer at a multiaddr and stores it in the peer
+// list, restoring it if it was removed. A peer removed for abuse is refused
+// unless force is set.
+func (a *Agent) AddPeer(ctx context.Context, addr string, force bool) (peer.ID, error) {
+	maddr, err := ma.NewMultiaddr(addr)
+	if err != nil {
+		return "", err
+	}
+	info, err := peer.AddrInfoFromP2pAddr(maddr)
+	if err != nil {
+		return "", err
+	}
+	if !force {
+		if err := a.checkReadd(info.ID); err != nil {
+			return "", err
+		}
+	}
+	if err := a.P2P.Host.Connect(ctx, *info); err != nil {
+		return "", fmt.Errorf("connect to %s: %w", info.ID, err)
+	}
+	if err := a.unarchivePeer(*info); err != nil {
+		return "", err
+	}
+	return info.ID, nil
+}
+
+// AllowImport lets snapshots and chunks of another repository be stored,
+// for deliberately importing its data into this one.
+func (a *Agent) AllowImport(repoID string) {
+	a.importMu.Lock()
+	defer a.importMu.Unlock()
+	a.importRepos[repoID] = true
+}
+
+// acceptsRepository reports whether a foreign repository is being imported
+func (a *Agent) acceptsRepository(repoID string) bool {
+	a.importMu.RLock()
+	defer a.importMu.RUnlock()
+	return a.importRepos[repoID]
+}
+
+// penalize reports misbehaviour by the originator of a message
+func (a *Agent) penalize(from peer.ID, off p2p.Offense) {
+	if from == a.P2P.Host.ID() {
+		return
+	}
+	a.P2P.Scorer.Penalize(from, off)
+}
+
+// penalizeErr maps a sync handler error to the matching offense, if any
+func (a *Agent) penalizeErr(from peer.ID, err error) {
+	switch {
+	case errors.Is(err, p2p.ErrInvalidSignature):
+		a.penalize(from, p2p.OffenseInvalidSignature)
+	case errors.Is(err, p2p.ErrChunkHashMismatch):
+		a.penalize(from, p2p.OffenseFailedProof)
+	case errors.Is(err, p2p.ErrChunkTooLarge):
+		a.penalize(from, p2p.OffenseOversize)
+	}
+}
+
+// ForgetPeer moves a peer from the stored peer list into the archive, on
+// this node only
+func (a *Agent) ForgetPeer(peerID, reason string, abuse bool) error {
+	return a.archivePeer(a.signedRemoval(peerID, reason, abuse))
+}
+
+// StoredPeers returns the stored peer list.
+func (a *Agent) StoredPeers() ([]peer.AddrInfo, error) {
+	var out []peer.AddrInfo
+	err := a.DB.View(func(tx *bolt.Tx) error {
+		b, err := a.DB.Sealed(tx, persistence.BucketPeers)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var info peer.AddrInfo
+			if err := json.Unmarshal(v, &info); err != nil {
+				return nil
+			}
+			out = append(out, info)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// RegisterOperationHandler sets the executor for an approved operation kind.
+func (a *Agent) RegisterOperationHandler(kind string, fn func(json.RawMessage) error) {
+	a.opMu.Lock()
+	defer a.opMu.Unlock()
+	a.opHandlers[kind] = fn
+}
+
+// ProposeOperation signs a destructive operation and gossips it for a second
+// admin's approval. Returns the operation ID.
+func (a *Agent) ProposeOperation(kind string, payload interface{}) (string, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	p := &protocol.OperationProposal{
+		Kind:        kind,
+		Payload:     raw,
+		ProposedAt:  time.Now().UTC().Format(time.RFC3339),
+		ProposerPub: auth.PubKeyToString(a.SignerPub),
+	}
+	p.Signature = auth.PubKeyToString(auth.SignPayload(protocol.ApprovalPayload(p.ID()), a.SignerPriv))
+
+	op, err := a.Approvals.Propose(p)
+	if err != nil {
+		return "", err
+	}
+	if err := a.publish("operation_proposal", "proposal", p); err != nil {
+		return "", err
+	}
+	return op.ID, nil
+}
+
+// ApproveOperation adds our signature to a pending operation, executing it
+// locally once enough admins have approved.
+func (a *Agent) ApproveOperation(id string) error {
+	oa := &protocol.OperationApproval{
+		OperationID: id,
+		SignerPub:   auth.PubKeyToString(a.SignerPub),
+	}
+	oa.Signature = auth.PubKeyToString(auth.SignPayload(protocol.ApprovalPayload(id), a.SignerPriv))
+
+	if err := a.applyApproval(oa); err != nil {
+		return err
+	}
+	return a.publish("operation_approval", "approval", oa)
+}
+
+func (a *Agent) handleOperationProposal(envelope map[string]interface{}) {
+	logger := monitoring.GetLogger()
+
+	var p protocol.OperationProposal
+	if err := decodeEnvelope(envelope, "proposal", &p); err != nil {
+		logger.WithError(err).Error("Failed to decode operation proposal")
+		return
+	}
+	if _, err := a.Approvals.Propose(&p); err != nil {
+		logger.WithError(err).Warn("Rejected operation proposal")
+	}
+}
+
+func (a *Agent) handleOperationApproval(envelope map[string]interface{}) {
+	logger := monitoring.GetLogger()
+
+	var oa protocol.OperationApproval
+	if err := decodeEnvelope(envelope, "approval", &oa); err != nil {
+		logger.WithError(err).Error("Failed to decode operation approval")
+		return
+	}
+	if err := a.applyApproval(&oa); err != nil && err != approval.ErrOperationNotFound {
+		logger.WithError(err).Warn("Rejected operation approval")
+	}
+}
+
+// applyApproval records an approval and runs the operation once it is ready.
+func (a *Agent) applyApproval(oa *protocol.OperationApproval) error {
+	op, ready, err := a.Approvals.Approve(oa)
+	if err != nil || !ready {
+		return err
+	}
+
+	a.opMu.RLock()
+	fn, ok := a.opHandlers[op.Proposal.Kind]
+	a.opMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("no handler for operation kind %s", op.Proposal.Kind)
+	}
+
+	logger := monitoring.GetLogger().WithFields(map[string]interface{}{
+		"operation_id": op.ID,
+		"kind":         op.Proposal.Kind,
+		"approvals":    len(op.Approvals),
+	})
+	// Complete first so a concurrent duplicate approval cannot execute twice
+	if err := a.Approvals.Complete(op.ID); err != nil {
+		return err
+	}
+	if err := fn(op.Proposal.Payload); err != nil {
+		logger.WithError(err).Error("Approved operation failed")
+		return err
+	}
+	logger.Info("Approved operation executed")
+	return nil
+}
+
+func (a *Agent) executePeerRemove(payload json.RawMessage) error {
+	var rm protocol.PeerRemove
+	if err := json.Unmarshal(payload, &rm); err != nil {
+		return err
+	}
+	if err := rm.Validate(); err != nil {
+		return err
+	}
+	return a.archivePeer(&rm)
+}
+
+func (a *Agent) executeAdminKeyUpdate(payload json.RawMessage) error {
+	var upd protocol.AdminKeyUpdate
+	if err := json.Unmarshal(payload, &upd); err != nil {
+		return err
+	}
+	// Freshness was enforced on the proposal; approval may take longer than the skew window
+	err := a.acceptAdminKeyUpdate(&upd, false)
+	if err == auth.ErrUpdateApplied {
+		return nil
+	}
+	return err
+}
+
+// GossipRevocationList publishes every stored admin update.
+func (a *Agent) GossipRevocationList() error {
+	updates, err := auth.LoadKeyUpdates(a.DB)
+	if err != nil {
+		return err
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	return a.publish("revocation_list", "updates", updates)
+}
+
+func (a *Agent) handleKeyShare(envelope map[string]interface{}) {
+	logger := monitoring.GetLogger()
+
+	var ks protocol.KeyShare
+	if err := decodeEnvelope(envelope, "key_share", &ks); err != nil {
+		logger.WithError(err).Error("Failed to decode key share")
+		return
+	}
+	if err := a.Recovery.HandleKeyShare(&ks); err != nil {
+		logger.WithError(err).Warn("Rejected key share")
+	}
+}
+
+func (a *Agent) handleShareRequest(envelope map[string]interface{}) {
+	logger := monitoring.GetLogger()
+
+	var req protocol.ShareRequest
+	if err := decodeEnvelope(envelope, "share_request", &req); err != nil {
+		logger.WithError(err).Error("Failed to decode share request")
+		return
+	}
+	if err := a.Recovery.HandleShareRequest(&req); err != nil {
+		logger.WithError(err).Warn("Rejected share request")
+	}
+}
+
+func (a *Agent) handleShareRelease(envelope map[string]interface{}) {
+	logger := monitoring.GetLogger()
+
+	var rel protocol.ShareRelease
+	if err := decodeEnvelope(envelope, "share_release", &rel); err != nil {
+		logger.WithError(err).Error("Failed to decode share release")
+		return
+	}
+	if err := a.Recovery.HandleShareRelease(&rel); err != nil {
+		logger.WithError(err).Warn("Rejected share release")
+	}
+}
+
+// DistributeKeyShares splits secret across the configured trusted peers and
+// publishes each sealed share.
+func (a *Agent) DistributeKeyShares(secret []byte) error {
+	trustees := a.Config.Recovery.TrustedPeers
+	if len(trustees) == 0 {
+		return fmt.Errorf("no recovery trusted_peers configured")
+	}
+	shares, err := a.Recovery.BuildShares(secret, trustees, a.Config.Recovery.Threshold)
+	if err != nil {
+		return err
+	}
+	for _, ks := range shares {
+		if err := a.publish("key_share", "key_share", ks); err != nil {
+			return fmt.Errorf("failed to publish share for %s: %w", ks.RecipientPub, err)
+		}
+	}
+	monitoring.GetLogger().WithFields(map[string]interface{}{
+		"trustees":  len(shares),
+		"threshold": a.Config.Recovery.Threshold,
+	}).Info("Recovery shares distributed")
+	return nil
 }
 
-func (a *Agent) CreateAndSaveSnapshot(path string) error {
-	logger := monitoring.GetLogger().WithField("path", path)
+// RequestKeyShares asks trustees to return their shares of ownerPub's secret.
+func (a *Agent) RequestKeyShares(ownerPub string) (*protocol.ShareRequest, error) {
+	req, err := a.Recovery.NewRequest(ownerPub)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.publish("share_request", "share_request", req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// ApproveShareRequest releases our held share after out-of-band confirmation.
+func (a *Agent) ApproveShareRequest(ownerPub, code string) error {
+	rel, err := a.Recovery.Approve(ownerPub, code)
+	if err != nil {
+		return err
+	}
+	return a.publish("share_release", "share_release", rel)
+}
+
+// publish wraps payload in the standard pubsub envelope and sends it.
+func (a *Agent) publish(msgType, key string, payload interface{}) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"type": msgType,
+		key:    payload,
+	})
+	if err != nil {
+		return err
+	}
+	if err := a.P2P.Topic.Publish(a.P2P.Ctx, data); err != nil {
+		return err
+	}
+	monitoring.GetMetrics().RecordMessageSent()
+	return nil
+}
+
+// decodeEnvelope extracts the payload stored under key into v.
+func decodeEnvelope(envelope map[string]interface{}, key string, v interface{}) error {
+	data, err := json.Marshal(envelope[key])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// announceSnapshot tells peers about snap by its header, or with the whole
+// manifest under p2p.full_announcements for peers that predate headers.
+func (a *Agent) announceSnapshot(snap *versioning.Snapshot) error {
+	syncer := p2p.NewSnapshotSyncer(a.Store, a.P2P.ChunkFetcher, a.SignerPub, a.SignerPriv)
+	if a.Config.P2P.FullAnnouncements {
+		return syncer.BroadcastSnapshot(a.P2P.Ctx, snap, a.P2P.Topic)
+	}
+	return syncer.BroadcastSnapshotHeader(a.P2P.Ctx, snap, a.P2P.Topic)
+}
+
+// metaSealer returns the sealer of new snapshots' metadata, nil when
+// snapshot.plain_metadata leaves it readable to peers
+func (a *Agent) metaSealer() func([]byte) ([]byte, error) {
+	if a.Config.Snapshot.PlainMetadata {
+		return nil
+	}
+	return a.Store.Seal
+}
+
+// parentSnapshot returns the newest snapshot we took of path, which must be
+// resolved, or nil if there is none
+func (a *Agent) parentSnapshot(path string) (*versioning.Snapshot, error) {
+	history, err := versioning.ListSnapshotsByTime(a.DB, fspath.Key(path))
+	if err != nil {
+		return nil, err
+	}
+	self := auth.PubKeyToString(a.SignerPub)
+	for i := len(history) - 1; i >= 0; i-- {
+		if snap := history[i]; snap.SignerPub == self && snap.RepoID == a.RepoID && !snap.IsMetadata() {
+			return snap, nil
+		}
+	}
+	return nil, nil
+}
+
+// CreateAndSaveSnapshot backs up path and returns the snapshot saved. If
+// files were skipped under the snapshot.on_error policy the snapshot is still
+// saved and announced, and a *snapshots.SkippedError lists them. The
+// snapshot is labelled with tags, which versioning.CheckTag must accept.
+func (a *Agent) CreateAndSaveSnapshot(ctx context.Context, path string, tags ...string) (*versioning.Snapshot, error) {
+	logger := monitoring.LoggerFor(ctx).WithField("path", path)
 	startTime := time.Now()
 
 	logger.Info("Creating snapshot")
-	snap, err := snapshots.CreateSnapshot(path, a.Store, a.SignerPub, a.SignerPriv, "", a.Config.Snapshot.MinChunkSize, a.Config.Snapshot.MaxChunkSize, a.Config.Snapshot.AvgChunkSize)
+	for _, t := range tags {
+		if err := versioning.CheckTag(t); err != nil {
+			return nil, err
+		}
+	}
+	path, err := fspath.Resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := a.parentSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	end, err := a.Store.BeginWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	ctx, tracker, stop := a.trackProgress(ctx, "Backup progress", map[string]interface{}{"path": path})
+	defer stop()
+	if parent != nil {
+		tracker.Expect(0, sourceSize(parent))
+	}
+	chunks, files, stats, err := a.Index.Scan(ctx, path, a.Store, a.Chunking, a.Excludes, a.Policy, a.Config.Snapshot.OnError)
+	stop()
 	if err != nil {
 		logger.WithError(err).Error("Failed to create snapshot")
 		monitoring.GetMetrics().RecordBackupFailed()
-		return err
+		return nil, err
+	}
+	done := tracker.Report()
+	logger.WithFields(map[string]interface{}{
+		"bytes_new":     done.NewBytes,
+		"bytes_deduped": done.DedupBytes,
+		"journal":       stats.Journal,
+		"changed":       stats.Changed,
+		"dirs_listed":   stats.Listed,
+		"dirs_reused":   stats.Reused,
+		"files_read":    stats.Read,
+		"bytes_read":    stats.Bytes,
+		"files_resumed": stats.Resumed,
+		"flagged":       len(stats.Flagged),
+		"skipped":       len(stats.Skipped),
+	}).Info("Scanned snapshot source")
+	snap, err := snapshots.NewSnapshot(path, chunks, files, a.Chunking, stats.Skipped, tags, a.metaSealer(), a.SignerPub, a.SignerPriv, parent, a.RepoID)
+	if err != nil {
+		monitoring.GetMetrics().RecordBackupFailed()
+		return nil, err
 	}
 
-	logger.WithField("snapshot_id", snap.ID).Info("Saving snapshot to database")
+	if err := a.saveSnapshot(ctx, snap, startTime); err != nil {
+		return nil, err
+	}
+	return snap, skippedError(snap)
+}
+
+// saveSnapshot stores a snapshot just built, records the backup started at
+// startTime in the metrics and announces it to peers
+func (a *Agent) saveSnapshot(ctx context.Context, snap *versioning.Snapshot, startTime time.Time) error {
+	logger := monitoring.LoggerFor(ctx).WithField("snapshot_id", snap.ID)
+	if err := a.PostProcessors.Run(ctx, snap); err != nil {
+		logger.WithError(err).Error("Snapshot post-processing failed; snapshot discarded")
+		monitoring.GetMetrics().RecordBackupFailed()
+		return err
+	}
+	logger.Info("Saving snapshot to database")
 	if err := versioning.SaveSnapshot(a.DB, snap); err != nil {
 		logger.WithError(err).Error("Failed to save snapshot")
 		monitoring.GetMetrics().RecordBackupFailed()
 		return err
 	}
 
+	a.uploadSnapshot(ctx, snap)
+
 	// Calculate total bytes backed up
 	var totalBytes uint64
 	for _, chunkHash := range snap.Chunks {
@@ -296,18 +1351,50 @@ func (a *Agent) CreateAndSaveSnapshot(path string) error {
 
 	// Broadcast metadata to peers
 	logger.Info("Broadcasting snapshot to peers")
-	syncer := p2p.NewSnapshotSyncer(a.Store, a.P2P.ChunkFetcher, a.SignerPub, a.SignerPriv)
-	if err := syncer.BroadcastSnapshot(a.P2P.Ctx, snap, a.P2P.Topic); err != nil {
+	if err := a.announceSnapshot(snap); err != nil {
 		logger.WithError(err).Warn("Failed to broadcast snapshot (snapshot saved locally)")
 		// Don't fail the entire operation if broadcast fails
 	}
+	a.kickMirrors()
+	a.kickFreshness()
 
 	logger.WithFields(map[string]interface{}{
-		"snapshot_id": snap.ID,
-		"chunks":      len(snap.Chunks),
-		"bytes":       totalBytes,
-		"duration":    duration.Seconds(),
+		"chunks":   len(snap.Chunks),
+		"bytes":    totalBytes,
+		"duration": duration.Seconds(),
 	}).Info("Snapshot created and broadcasted successfully")
 
 	return nil
 }
+
+// sourceSize is the size of the files of snap, from which the progress of
+// the next snapshot of its source is estimated; 0 when unknown
+func sourceSize(snap *versioning.Snapshot) int64 {
+	files, err := snap.Files()
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, f := range files {
+		if !f.IsDir() {
+			size += f.Size
+		}
+	}
+	return size
+}
+
+// DryRunSnapshot reports what CreateAndSaveSnapshot would read and store
+// for path, writing nothing.
+func (a *Agent) DryRunSnapshot(ctx context.Context, path string) (*snapshots.DryRunReport, error) {
+	return a.Index.DryRun(ctx, path, a.Store, a.Chunking, a.Excludes, a.Policy, a.Config.Snapshot.OnError)
+}
+
+// skippedError reports the unreadable files snap was saved without, if any
+func skippedError(snap *versioning.Snapshot) error {
+	if len(snap.Errors) == 0 {
+		return nil
+	}
+	monitoring.GetLogger().WithField("snapshot_id", snap.ID).
+		Warnf("Snapshot saved without %d unreadable file(s)", len(snap.Errors))
+	return &snapshots.SkippedError{SnapshotID: snap.ID, Skipped: snap.Errors}
+}
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hoangsonww/backupagent/internal/bundle"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// ExportRecovery writes a recovery bundle of a snapshot to output: the
+// restore binary at stub, or this executable if stub is empty, with the
+// snapshot and its chunks appended. Instructions for the recipient are
+// written next to it. Returns the path of the instructions.
+func (a *Agent) ExportRecovery(snapshotID, stub, output string) (string, error) {
+	snap, err := versioning.LoadSnapshot(a.DB, snapshotID)
+	if err != nil {
+		return "", err
+	}
+	if err := versioning.CheckRepository(snap, a.RepoID); err != nil {
+		return "", err
+	}
+	missing, err := a.Store.Missing(snap.Chunks)
+	if err != nil {
+		return "", err
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("%d chunks of snapshot %s are not stored locally; pull them first", len(missing), snap.ID)
+	}
+	salt, err := a.DB.KeySalt()
+	if err != nil {
+		return "", err
+	}
+	dicts, err := a.Store.Dicts()
+	if err != nil {
+		return "", err
+	}
+
+	if stub == "" {
+		if stub, err = os.Executable(); err != nil {
+			return "", err
+		}
+	}
+	if b, err := bundle.Open(stub); err == nil {
+		b.Close()
+		return "", fmt.Errorf("%s is a recovery bundle itself, not a restore binary", stub)
+	} else if !errors.Is(err, bundle.ErrNoBundle) {
+		return "", err
+	}
+	in, err := os.Open(stub)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	tmp := output + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+	if err := bundle.Create(out, in, snap, dicts, salt, a.Store.Seal, a.Store.Get); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, output); err != nil {
+		return "", err
+	}
+
+	readme := strings.TrimSuffix(output, ".exe") + ".txt"
+	if err := os.WriteFile(readme, []byte(bundle.Instructions(filepath.Base(output), snap)), 0644); err != nil {
+		return "", err
+	}
+	monitoring.GetLogger().WithFields(map[string]interface{}{
+		"snapshot_id": snap.ID,
+		"bundle":      output,
+		"chunks":      len(snap.Chunks),
+	}).Info("Exported recovery bundle")
+	return readme, nil
+}
@@ -0,0 +1,66 @@
+package agent_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/config"
+	"github.com/hoangsonww/backupagent/internal/agent"
+	"github.com/hoangsonww/backupagent/internal/chunker"
+)
+
+func TestRepositoryChunker(t *testing.T) {
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := os.Mkdir(repo, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// open opens the repository with snapshot.chunker set to algo, or unset
+	// when empty, and returns the algorithm new snapshots chunk with
+	open := func(algo string) string {
+		t.Helper()
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		yaml := fmt.Sprintf("repository_path: %s\nlisten_port: %d\n", repo, port)
+		if algo != "" {
+			yaml += fmt.Sprintf("snapshot:\n  chunker: %s\n", algo)
+		}
+		cfgPath := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(cfgPath, []byte(yaml), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := config.Load(cfgPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ag, err := agent.New(cfg, "test-passphrase")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ag.Close()
+		return ag.Chunking.Algorithm
+	}
+
+	steps := []struct {
+		config, want string
+	}{
+		{"", chunker.Default},
+		{chunker.FNV, chunker.FNV},
+		// fnv is only kept while the config asks for it
+		{"", chunker.Default},
+		{chunker.FastCDC, chunker.FastCDC},
+		// other algorithms stay without it
+		{"", chunker.FastCDC},
+	}
+	for i, s := range steps {
+		if got := open(s.config); got != s.want {
+			t.Fatalf("step %d: opened with snapshot.chunker %q, repository chunks with %s, want %s", i, s.config, got, s.want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hoangsonww/backupagent/config"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/storage"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// openStore opens the chunk store of the repository under key, storing new
+// chunks in the backend storage.backend names. Chunks the other backend
+// still holds stay readable until migrateChunks has moved them.
+func openStore(cfg *config.Config, db *persistence.DB, key []byte) (*storage.Store, error) {
+	store, err := storage.New(db, key)
+	if err != nil {
+		return nil, err
+	}
+	backends := []storage.Backend{
+		storage.NewFileBackend(filepath.Join(cfg.RepositoryPath, "chunks")),
+		storage.NewPackBackend(filepath.Join(cfg.RepositoryPath, "packs"), cfg.Storage.Pack.Size, cfg.Storage.Pack.RepackThreshold),
+	}
+	if s3 := cfg.Storage.S3; s3.Bucket != "" {
+		objects, err := storage.NewS3Backend(storage.S3Options{
+			Endpoint:        s3.Endpoint,
+			Region:          s3.Region,
+			Bucket:          s3.Bucket,
+			Prefix:          s3.Prefix,
+			AccessKeyID:     s3.AccessKeyID,
+			SecretAccessKey: s3.SecretAccessKey,
+			SessionToken:    s3.SessionToken,
+			PathStyle:       s3.PathStyle,
+			MaxRetries:      s3.MaxRetries,
+			RetryDelay:      s3.RetryDelay,
+			Timeout:         s3.Timeout,
+		})
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, objects)
+	}
+	if cfg.Storage.SFTP.Host != "" {
+		remote, err := openSFTP(cfg.Storage.SFTP)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, remote)
+	}
+	for _, b := range backends {
+		if b.Name() == cfg.Storage.Backend {
+			store.UseBackend(b)
+		} else {
+			store.AddBackend(b)
+		}
+	}
+	return store, nil
+}
+
+// openSFTP returns the sftp backend of c. It checks the key and known hosts
+// now; the server is contacted on first use.
+func openSFTP(c config.SFTPConfig) (*storage.SFTPBackend, error) {
+	knownHosts := c.KnownHosts
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("locating known_hosts for the sftp backend: %w", err)
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("loading known hosts of the sftp backend: %w", err)
+	}
+	var auth []ssh.AuthMethod
+	if c.KeyFile != "" {
+		pem, err := os.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading sftp key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("parsing sftp key %s: %w", c.KeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if c.Password != "" {
+		auth = append(auth, ssh.Password(c.Password))
+	}
+	addr := c.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	return storage.NewSFTPBackend(storage.SFTPOptions{
+		Addr: addr,
+		Dir:  c.Path,
+		Config: &ssh.ClientConfig{
+			User:            c.User,
+			Auth:            auth,
+			HostKeyCallback: hostKeys,
+			Timeout:         c.Timeout,
+		},
+		MaxConns:   c.MaxConns,
+		MaxRetries: c.MaxRetries,
+		RetryDelay: c.RetryDelay,
+	}), nil
+}
+
+// uploadSnapshot writes the record of snap beside its chunks when they are
+// kept in an object store, so the bucket alone holds a restorable copy.
+// Metadata sealed to the repository stays sealed.
+func (a *Agent) uploadSnapshot(ctx context.Context, snap *versioning.Snapshot) {
+	objects, ok := a.Store.Backend().(*storage.S3Backend)
+	if !ok {
+		return
+	}
+	logger := monitoring.LoggerFor(ctx).WithField("snapshot_id", snap.ID)
+	record, err := json.Marshal(snap.Public())
+	if err == nil {
+		err = objects.PutSnapshot(ctx, snap.ID, record)
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Failed to upload snapshot record to the object store")
+	}
+}
+
+// migrateChunks moves the chunks another backend holds into the one
+// storage.backend names, in the background so the daemon serves meanwhile.
+func (a *Agent) migrateChunks(ctx context.Context) {
+	logger := monitoring.GetLogger().WithField("backend", a.Store.Backend().Name())
+	start := time.Now()
+	moved, err := a.Store.MigrateBackend(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.WithError(err).WithField("moved", moved).Error("Failed to migrate chunks to the storage backend")
+		}
+		return
+	}
+	if moved > 0 {
+		logger.WithFields(map[string]interface{}{
+			"moved":    moved,
+			"duration": time.Since(start).Round(time.Millisecond),
+		}).Info("Migrated chunks to the storage backend")
+	}
+}
@@ -0,0 +1,24 @@
+package agent_test
+
+import "testing"
+
+func TestChunksCompressedByDefault(t *testing.T) {
+	// The config of newAgent leaves snapshot.compression unset
+	ag, snap := newAgent(t)
+	var plain, stored int
+	for _, h := range snap.Chunks {
+		data, err := ag.Store.GetChunk(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob, err := ag.Store.Get(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain += len(data)
+		stored += len(blob)
+	}
+	if stored >= plain/4 {
+		t.Fatalf("%d bytes of repetitive text stored in %d bytes, want them compressed", plain, stored)
+	}
+}
@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/p2p"
+)
+
+// DebugState is a snapshot of the daemon's internals for bug reports.
+type DebugState struct {
+	CapturedAt   time.Time              `json:"captured_at"`
+	PeerID       string                 `json:"peer_id"`
+	RepositoryID string                 `json:"repository_id"`
+	GoVersion    string                 `json:"go_version"`
+	Health       monitoring.HealthCheck `json:"health"`
+	Peers        []DebugPeer            `json:"peers"`
+	Operations   []*Operation           `json:"operations"`
+	Queues       map[string]int         `json:"queues"`
+	RecentErrors []monitoring.LogEntry  `json:"recent_errors"`
+	Goroutines   int                    `json:"goroutines"`
+	Stacks       string                 `json:"stacks"` // every goroutine, as a panic prints them
+}
+
+// DebugPeer is a connected peer and its open connections.
+type DebugPeer struct {
+	ID        string        `json:"id"`
+	Agent     string        `json:"agent,omitempty"`     // libp2p agent version it identified with
+	Protocols []string      `json:"protocols,omitempty"` // ShadowVault stream protocols it identified with
+	Latency   time.Duration `json:"latency"`
+	Score     float64       `json:"score"`
+	Pinned    bool          `json:"pinned,omitempty"`
+	Conns     []DebugConn   `json:"conns"`
+}
+
+// DebugConn is one open connection to a peer.
+type DebugConn struct {
+	Addr      string    `json:"addr"`
+	Direction string    `json:"direction"`
+	Opened    time.Time `json:"opened"`
+	Streams   int       `json:"streams"`
+}
+
+// DebugState captures goroutine stacks, connections, operations, queue
+// depths and recent warnings and errors.
+func (a *Agent) DebugState() (*DebugState, error) {
+	st := &DebugState{
+		CapturedAt:   time.Now().UTC(),
+		PeerID:       a.P2P.Host.ID().String(),
+		RepositoryID: a.RepoID,
+		GoVersion:    runtime.Version(),
+		Health:       monitoring.GetHealthChecker().GetHealth(),
+		Operations:   a.Operations(),
+		Queues:       make(map[string]int),
+		RecentErrors: monitoring.RecentErrors(),
+		Goroutines:   runtime.NumGoroutine(),
+	}
+	sort.Slice(st.Operations, func(i, j int) bool { return st.Operations[i].QueuedAt.Before(st.Operations[j].QueuedAt) })
+
+	h := a.P2P.Host
+	for _, pid := range h.Network().Peers() {
+		p := DebugPeer{
+			ID:      pid.String(),
+			Latency: h.Peerstore().LatencyEWMA(pid),
+			Score:   a.P2P.Scorer.Score(pid),
+			Pinned:  a.P2P.Pins.IsPinned(pid),
+		}
+		if v, err := h.Peerstore().Get(pid, "AgentVersion"); err == nil {
+			p.Agent, _ = v.(string)
+		}
+		if protos, err := h.Peerstore().SupportsProtocols(pid, p2p.Protocols()...); err == nil {
+			for _, proto := range protos {
+				p.Protocols = append(p.Protocols, string(proto))
+			}
+		}
+		for _, c := range h.Network().ConnsToPeer(pid) {
+			stat := c.Stat()
+			p.Conns = append(p.Conns, DebugConn{
+				Addr:      c.RemoteMultiaddr().String(),
+				Direction: stat.Direction.String(),
+				Opened:    stat.Opened,
+				Streams:   stat.NumStreams,
+			})
+		}
+		st.Peers = append(st.Peers, p)
+	}
+	sort.Slice(st.Peers, func(i, j int) bool { return st.Peers[i].ID < st.Peers[j].ID })
+
+	a.admission.mu.Lock()
+	for kind, lane := range a.admission.lanes {
+		st.Queues[kind+"_queued"] = len(lane.queue)
+		st.Queues[kind+"_running"] = lane.running
+	}
+	a.admission.mu.Unlock()
+	st.Queues["chunk_fetches_in_flight"] = a.P2P.ChunkFetcher.InFlight()
+	st.Queues["received_verification"] = a.P2P.Verifier.Pending()
+	missing, err := a.P2P.Missing.List()
+	if err != nil {
+		return nil, err
+	}
+	st.Queues["missing_chunks"] = len(missing)
+
+	var stacks bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&stacks, 2); err != nil {
+		return nil, err
+	}
+	st.Stacks = stacks.String()
+	return st, nil
+}
+
+// WriteDebugDump writes DebugState as JSON under the repository's debug
+// directory and returns the file's path.
+func (a *Agent) WriteDebugDump() (string, error) {
+	st, err := a.DebugState()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(a.Config.RepositoryPath, "debug")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "dump-"+st.CapturedAt.Format("20060102-150405")+".json")
+	return path, os.WriteFile(path, data, 0600)
+}
+
+// dumpOnSignal writes a debug dump on every SIGQUIT until ctx ends, instead
+// of the runtime printing stacks and exiting.
+func (a *Agent) dumpOnSignal(ctx context.Context) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGQUIT)
+	defer signal.Stop(c)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c:
+		}
+		path, err := a.WriteDebugDump()
+		if err != nil {
+			monitoring.GetLogger().WithError(err).Error("Failed to write debug dump")
+			continue
+		}
+		monitoring.GetLogger().Infof("Wrote debug dump to %s", path)
+	}
+}
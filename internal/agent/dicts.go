@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"context"
+	"math/rand"
+
+	"github.com/hoangsonww/backupagent/internal/compression"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+)
+
+// minDictSamples is how many chunks of a kind a dictionary is trained on at
+// least
+const minDictSamples = 32
+
+// DictOptions tune TrainDicts.
+type DictOptions struct {
+	Size    int // maximum dictionary size in bytes
+	Samples int // chunks sampled per content type
+}
+
+// DictReport is the outcome of training a dictionary for one content type.
+// One in ten sampled chunks is held out of training and compressed with and
+// without the dictionary to tell what it gains.
+type DictReport struct {
+	Kind     compression.Kind `json:"kind"`
+	Samples  int              `json:"samples"`
+	Dict     uint32           `json:"dict,omitempty"`    // ID of the saved dictionary, 0 when none was
+	Bytes    int64            `json:"bytes"`             // of the held-out chunks
+	Plain    int64            `json:"plain"`             // they compress to without a dictionary
+	WithDict int64            `json:"with_dict"`         // they compress to against it
+	Skipped  string           `json:"skipped,omitempty"` // why no dictionary was saved
+}
+
+// Gain is the share of the compressed size the dictionary saves.
+func (r *DictReport) Gain() float64 {
+	if r.Plain == 0 {
+		return 0
+	}
+	return 1 - float64(r.WithDict)/float64(r.Plain)
+}
+
+// TrainDicts samples the stored chunks and trains a compression dictionary
+// for each content type compressed at snapshot.compression_levels, saving
+// those that make held-out chunks smaller. With snapshot.compression_dicts
+// set, chunks stored from then on are compressed against them.
+func (a *Agent) TrainDicts(ctx context.Context, opts DictOptions) ([]*DictReport, error) {
+	levels, err := compression.ParseLevels(a.Config.Snapshot.CompressionLevels)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := compression.NewPolicy(levels)
+	if err != nil {
+		return nil, err
+	}
+	samples := make(map[compression.Kind][][]byte)
+	var kinds []compression.Kind
+	for _, k := range []compression.Kind{compression.Text, compression.Binary} {
+		if policy.Level(k) > 0 {
+			kinds = append(kinds, k)
+		}
+	}
+
+	hashes, err := a.Store.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	rand.Shuffle(len(hashes), func(i, j int) { hashes[i], hashes[j] = hashes[j], hashes[i] })
+	full := 0
+	for _, h := range hashes {
+		if full == len(kinds) {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, err := a.Store.GetChunk(h)
+		if err != nil {
+			monitoring.LoggerFor(ctx).WithError(err).WithField("chunk_hash", h).Debug("Skipping unreadable chunk")
+			continue
+		}
+		kind := compression.Detect(data)
+		if policy.Level(kind) == 0 || len(samples[kind]) == opts.Samples {
+			continue
+		}
+		samples[kind] = append(samples[kind], data)
+		if len(samples[kind]) == opts.Samples {
+			full++
+		}
+	}
+
+	var reports []*DictReport
+	for _, kind := range kinds {
+		r, err := a.trainDict(ctx, policy, kind, samples[kind], opts.Size)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
+
+// trainDict trains and saves the dictionary of kind on samples
+func (a *Agent) trainDict(ctx context.Context, policy *compression.Policy, kind compression.Kind, samples [][]byte, size int) (*DictReport, error) {
+	r := &DictReport{Kind: kind, Samples: len(samples)}
+	if len(samples) < minDictSamples {
+		r.Skipped = "too few chunks to train on"
+		return r, nil
+	}
+	var train, test [][]byte
+	for i, s := range samples {
+		if i%10 == 9 {
+			test = append(test, s)
+		} else {
+			train = append(train, s)
+		}
+	}
+	d, err := compression.TrainDict(kind, train, size)
+	if err != nil {
+		r.Skipped = err.Error()
+		return r, nil
+	}
+	with, err := compression.NewPolicy(map[compression.Kind]int{kind: policy.Level(kind)})
+	if err != nil {
+		return nil, err
+	}
+	if err := with.UseDict(d); err != nil {
+		return nil, err
+	}
+	for _, s := range test {
+		r.Bytes += int64(len(s))
+		r.Plain += int64(len(policy.Pack(s, kind)))
+		r.WithDict += int64(len(with.Pack(s, kind)))
+	}
+	if r.WithDict >= r.Plain {
+		r.Skipped = "no smaller than without a dictionary"
+		return r, nil
+	}
+
+	if err := a.Store.SaveDict(d); err != nil {
+		return nil, err
+	}
+	if err := compression.RegisterDict(d); err != nil {
+		return nil, err
+	}
+	if a.Config.Snapshot.CompressionDicts {
+		if err := a.Store.UseDict(d); err != nil {
+			return nil, err
+		}
+	}
+	r.Dict = d.ID
+	monitoring.LoggerFor(ctx).WithFields(map[string]interface{}{
+		"kind":    kind.String(),
+		"dict":    d.ID,
+		"samples": len(train),
+		"gain":    r.Gain(),
+	}).Info("Trained compression dictionary")
+	return r, nil
+}
@@ -0,0 +1,144 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/fspath"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// FreshnessStatus measures one freshness target against our snapshots.
+type FreshnessStatus struct {
+	Source       string        `json:"source"`
+	MaxAge       time.Duration `json:"max_age"`
+	SnapshotID   string        `json:"snapshot_id,omitempty"` // newest snapshot of the source, empty if none
+	LastSnapshot time.Time     `json:"last_snapshot,omitempty"`
+	Age          time.Duration `json:"age"`
+	Violated     bool          `json:"violated"`
+}
+
+// Freshness evaluates every configured freshness target. A source never
+// backed up violates its target.
+func (a *Agent) Freshness() ([]*FreshnessStatus, error) {
+	own, err := a.ownSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	newest := make(map[string]*versioning.Snapshot)
+	for _, snap := range own {
+		if !snap.IsMetadata() {
+			newest[snap.Source()] = snap
+		}
+	}
+
+	now := time.Now()
+	out := make([]*FreshnessStatus, 0, len(a.Config.Freshness.Targets))
+	for _, t := range a.Config.Freshness.Targets {
+		st := &FreshnessStatus{Source: t.Source, MaxAge: t.MaxAge, Violated: true}
+		key := t.Source
+		if p, err := fspath.Resolve(t.Source); err == nil {
+			key = fspath.Key(p)
+		}
+		if snap := newest[key]; snap != nil {
+			st.SnapshotID = snap.ID
+			st.LastSnapshot = snap.Timestamp.Time()
+			st.Age = now.Sub(st.LastSnapshot)
+			st.Violated = st.Age > t.MaxAge
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+// runFreshness evaluates freshness targets every check interval and after
+// each snapshot until ctx ends.
+func (a *Agent) runFreshness(ctx context.Context) {
+	ticker := time.NewTicker(a.Config.Freshness.CheckInterval)
+	defer ticker.Stop()
+
+	notifier := monitoring.NewNotifier(a.Config.Freshness.WebhookURL)
+	violated := make(map[string]bool)
+	for {
+		a.checkFreshness(ctx, notifier, violated)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-a.freshnessKick:
+		}
+	}
+}
+
+// kickFreshness re-evaluates freshness targets now, e.g. after a new snapshot
+func (a *Agent) kickFreshness() {
+	select {
+	case a.freshnessKick <- struct{}{}:
+	default:
+	}
+}
+
+// checkFreshness publishes freshness metrics and health, and logs and
+// notifies each target that was missed or met again since the last check.
+// violated holds each source's state as of that check.
+func (a *Agent) checkFreshness(ctx context.Context, notifier *monitoring.Notifier, violated map[string]bool) {
+	logger := monitoring.GetLogger()
+	statuses, err := a.Freshness()
+	if err != nil {
+		logger.WithError(err).Warn("Failed to evaluate freshness targets")
+		return
+	}
+
+	metrics := monitoring.GetMetrics()
+	var missed []string
+	for _, st := range statuses {
+		if st.SnapshotID == "" {
+			metrics.BackupFreshness.Delete(st.Source)
+		} else {
+			metrics.BackupFreshness.Set(st.Source, int64(st.Age.Seconds()))
+		}
+		if st.Violated {
+			missed = append(missed, st.Source)
+		}
+		if st.Violated == violated[st.Source] {
+			continue
+		}
+		violated[st.Source] = st.Violated
+
+		fields := map[string]interface{}{
+			"source":   st.Source,
+			"max_age":  st.MaxAge.String(),
+			"snapshot": st.SnapshotID,
+			"age":      st.Age.Round(time.Second).String(),
+		}
+		note := monitoring.Notification{Event: "freshness_missed", Details: fields}
+		switch {
+		case !st.Violated:
+			note.Event = "freshness_met"
+			note.Message = fmt.Sprintf("%s has a snapshot within %s again", st.Source, st.MaxAge)
+			logger.WithFields(fields).Info("Freshness target met")
+		case st.SnapshotID == "":
+			note.Message = fmt.Sprintf("%s has no snapshot", st.Source)
+			logger.WithFields(fields).Error("Freshness target missed")
+		default:
+			note.Message = fmt.Sprintf("%s was last backed up %s ago, target %s", st.Source, st.Age.Round(time.Second), st.MaxAge)
+			logger.WithFields(fields).Error("Freshness target missed")
+		}
+		if err := notifier.Notify(ctx, note); err != nil {
+			logger.WithError(err).Warn("Failed to send freshness notification")
+		}
+	}
+	metrics.FreshnessViolations.Store(int64(len(missed)))
+
+	status, msg := monitoring.StatusHealthy, ""
+	if len(missed) > 0 {
+		status = monitoring.StatusDegraded
+		msg = fmt.Sprintf("%d source(s) missed their freshness target", len(missed))
+	}
+	monitoring.GetHealthChecker().UpdateComponent("freshness", status, msg, map[string]interface{}{
+		"targets": len(statuses),
+		"missed":  missed,
+	})
+}
@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/fspath"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/snapshots"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// ErrUnknownGroup is returned for a source group scheduler.source_groups
+// does not define.
+var ErrUnknownGroup = errors.New("no such source group")
+
+// SourceGroup returns the paths of name, a group of scheduler.source_groups.
+func (a *Agent) SourceGroup(name string) ([]string, error) {
+	for _, g := range a.Config.Scheduler.SourceGroups {
+		if g.Name == name {
+			return g.Paths, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownGroup, name)
+}
+
+// CreateAndSaveGroupSnapshot backs up paths together into one snapshot of
+// group, each under its own section of the manifest, and returns it. Either
+// every path is captured or no snapshot is saved. Snapshots of the same
+// group form one history; without a group, the paths name it, so backing up
+// the same paths again continues it. Skipped files and tags are as for
+// CreateAndSaveSnapshot.
+func (a *Agent) CreateAndSaveGroupSnapshot(ctx context.Context, group string, paths []string, tags ...string) (*versioning.Snapshot, error) {
+	logger := monitoring.LoggerFor(ctx).WithField("paths", paths)
+	startTime := time.Now()
+
+	logger.Info("Creating snapshot of several paths")
+	for _, t := range tags {
+		if err := versioning.CheckTag(t); err != nil {
+			return nil, err
+		}
+	}
+	resolved := make([]string, len(paths))
+	for i, p := range paths {
+		var err error
+		if resolved[i], err = fspath.Resolve(p); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(resolved)
+	set, err := snapshots.NewRootSet(resolved)
+	if err != nil {
+		return nil, err
+	}
+	if group == "" {
+		names := make([]string, len(set.Roots()))
+		for i, r := range set.Roots() {
+			names[i] = r.Name
+		}
+		group = strings.Join(names, ",")
+	}
+	logger = logger.WithField("group", group)
+
+	parent, err := a.parentSnapshot(versioning.GroupSource(group))
+	if err != nil {
+		return nil, err
+	}
+	end, err := a.Store.BeginWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	ctx, tracker, stop := a.trackProgress(ctx, "Backup progress", map[string]interface{}{"group": group})
+	defer stop()
+	if parent != nil {
+		tracker.Expect(0, sourceSize(parent))
+	}
+	var skipped []versioning.FileError
+	for i, p := range set.Paths() {
+		chunks, files, stats, err := a.Index.Scan(ctx, p, a.Store, a.Chunking, a.Excludes, a.Policy, a.Config.Snapshot.OnError)
+		if err == nil {
+			err = set.Add(i, chunks, files)
+		}
+		if err != nil {
+			stop()
+			logger.WithError(err).WithField("path", p).Error("Failed to create snapshot")
+			monitoring.GetMetrics().RecordBackupFailed()
+			return nil, err
+		}
+		skipped = append(skipped, stats.Skipped...)
+		logger.WithFields(map[string]interface{}{
+			"path":        p,
+			"journal":     stats.Journal,
+			"changed":     stats.Changed,
+			"dirs_listed": stats.Listed,
+			"dirs_reused": stats.Reused,
+			"files_read":  stats.Read,
+			"bytes_read":  stats.Bytes,
+			"flagged":     len(stats.Flagged),
+			"skipped":     len(stats.Skipped),
+		}).Info("Scanned snapshot source")
+	}
+	stop()
+	done := tracker.Report()
+	logger.WithFields(map[string]interface{}{
+		"bytes_new":     done.NewBytes,
+		"bytes_deduped": done.DedupBytes,
+	}).Info("Scanned every path of the snapshot")
+
+	snap, err := snapshots.NewGroupSnapshot(group, set, a.Chunking, skipped, tags, a.metaSealer(), a.SignerPub, a.SignerPriv, parent, a.RepoID)
+	if err != nil {
+		monitoring.GetMetrics().RecordBackupFailed()
+		return nil, err
+	}
+	if err := a.saveSnapshot(ctx, snap, startTime); err != nil {
+		return nil, err
+	}
+	return snap, skippedError(snap)
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/hoangsonww/backupagent/internal/progress"
+	"github.com/hoangsonww/backupagent/internal/scheduler"
+	"github.com/hoangsonww/backupagent/internal/snapshots"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// BackupWithHooks is CreateAndSaveSnapshot run between the backup hooks of
+// the scheduler config. A failed pre_backup hook cancels the snapshot.
+func (a *Agent) BackupWithHooks(ctx context.Context, path string, tags ...string) (*versioning.Snapshot, error) {
+	return a.withHooks(ctx, path, func(ctx context.Context) (*versioning.Snapshot, error) {
+		return a.CreateAndSaveSnapshot(ctx, path, tags...)
+	})
+}
+
+// BackupGroupWithHooks is CreateAndSaveGroupSnapshot run between the
+// backup hooks of the scheduler config. The hooks see the group's source,
+// or the paths separated by the OS path list separator when group is empty.
+func (a *Agent) BackupGroupWithHooks(ctx context.Context, group string, paths []string, tags ...string) (*versioning.Snapshot, error) {
+	source := strings.Join(paths, string(os.PathListSeparator))
+	if group != "" {
+		source = versioning.GroupSource(group)
+	}
+	return a.withHooks(ctx, source, func(ctx context.Context) (*versioning.Snapshot, error) {
+		return a.CreateAndSaveGroupSnapshot(ctx, group, paths, tags...)
+	})
+}
+
+// BackupStreamWithHooks is CreateAndSaveSnapshotFrom run between the backup
+// hooks of the scheduler config.
+func (a *Agent) BackupStreamWithHooks(ctx context.Context, r io.Reader, name string, tags ...string) (*versioning.Snapshot, error) {
+	return a.withHooks(ctx, name, func(ctx context.Context) (*versioning.Snapshot, error) {
+		return a.CreateAndSaveSnapshotFrom(ctx, r, name, tags...)
+	})
+}
+
+// withHooks runs backup of source between the backup hooks
+func (a *Agent) withHooks(ctx context.Context, source string, backup func(context.Context) (*versioning.Snapshot, error)) (*versioning.Snapshot, error) {
+	cfg := a.Config.Scheduler
+	hooks := &scheduler.Hooks{
+		PreBackup:  cfg.PreBackup,
+		PostBackup: cfg.PostBackup,
+		OnFailure:  cfg.OnFailure,
+		Timeout:    cfg.HookTimeout,
+	}
+	tracker := progress.From(ctx)
+	if tracker == nil {
+		tracker = progress.New()
+		ctx = progress.With(ctx, tracker)
+	}
+	var snap *versioning.Snapshot
+	var saveErr error
+	err := hooks.Run(ctx, source, func(ctx context.Context) (*scheduler.BackupStats, error) {
+		snap, saveErr = backup(ctx)
+		var skipped *snapshots.SkippedError
+		if saveErr != nil && !errors.As(saveErr, &skipped) {
+			return nil, saveErr
+		}
+		r := tracker.Report()
+		return &scheduler.BackupStats{
+			SnapshotID: snap.ID,
+			Files:      r.Files,
+			Bytes:      r.Bytes,
+			NewBytes:   r.NewBytes,
+			Chunks:     len(snap.Chunks),
+			Skipped:    len(snap.Errors),
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Saved, perhaps without some unreadable files
+	return snap, saveErr
+}
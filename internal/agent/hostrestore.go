@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/fspath"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/snapshots"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// ErrNoHostSnapshots is returned when a host has nothing to restore
+var ErrNoHostSnapshots = errors.New("no snapshots of host")
+
+// HostPlan is the recovery plan of a whole host: the newest snapshot of each
+// of its sources at a point in time.
+type HostPlan struct {
+	Host    string
+	At      time.Time
+	Entries []*HostPlanEntry // ordered by source
+}
+
+// HostPlanEntry restores one source of a HostPlan.
+type HostPlanEntry struct {
+	Source   string
+	Snapshot *versioning.Snapshot
+	Target   string // directory the snapshot is restored into
+}
+
+// Chunks returns the number of chunks the plan restores.
+func (p *HostPlan) Chunks() int {
+	n := 0
+	for _, e := range p.Entries {
+		n += len(e.Snapshot.Chunks)
+	}
+	return n
+}
+
+// HostProgress reports a running host restore.
+type HostProgress struct {
+	Entry       int // 1-based index of the entry being restored
+	Entries     int
+	Source      string
+	Chunks      int // restored so far, across entries
+	TotalChunks int
+	Bytes       int64
+}
+
+// PlanHostRestore picks the newest snapshot taken on host at or before at for
+// every source it backed up, or only for sources if given. Each is restored
+// into its original path, or below target mirroring that path if target is
+// set. Metadata exports and snapshots that predate host records are left out.
+func (a *Agent) PlanHostRestore(host string, at time.Time, sources []string, target string) (*HostPlan, error) {
+	want := make(map[string]bool, len(sources))
+	for _, src := range sources {
+		p, err := fspath.Resolve(src)
+		if err != nil {
+			return nil, err
+		}
+		want[fspath.Key(p)] = true
+	}
+
+	all, err := versioning.ListAllSnapshots(a.DB)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]*versioning.Snapshot)
+	for _, snap := range all {
+		if snap.Host() != host || snap.IsMetadata() || snap.RepoID != a.RepoID || snap.Timestamp.Time().After(at) {
+			continue
+		}
+		if len(want) > 0 && !want[snap.Source()] {
+			continue
+		}
+		if cur, ok := latest[snap.Source()]; !ok || cur.Timestamp.Before(snap.Timestamp) {
+			latest[snap.Source()] = snap
+		}
+	}
+	for src := range want {
+		if latest[src] == nil {
+			return nil, fmt.Errorf("%w %s for %s at %s", ErrNoHostSnapshots, host, src, at.Format(time.RFC3339))
+		}
+	}
+	if len(latest) == 0 {
+		return nil, fmt.Errorf("%w %s at %s", ErrNoHostSnapshots, host, at.Format(time.RFC3339))
+	}
+
+	plan := &HostPlan{Host: host, At: at}
+	for src, snap := range latest {
+		dir := snap.OriginalSource()
+		if snap.Group() != "" {
+			// Each path of a group is recorded relative to the filesystem root
+			dir = string(filepath.Separator)
+		} else if files, _ := snap.Files(); len(files) == 1 && files[0].Path == versioning.SourcePath {
+			// A single file is restored under its own name into its directory
+			dir = filepath.Dir(dir)
+		}
+		if target != "" {
+			dir = filepath.Join(target, mirrorPath(dir))
+		}
+		plan.Entries = append(plan.Entries, &HostPlanEntry{Source: src, Snapshot: snap, Target: dir})
+	}
+	sort.Slice(plan.Entries, func(i, j int) bool { return plan.Entries[i].Source < plan.Entries[j].Source })
+	return plan, nil
+}
+
+// RestoreHost restores every entry of plan in turn, mapping recorded owners
+// with owners, passing files by scan if set and reporting combined progress
+// to progress if set. An entry
+// that fails does not stop the others; their errors are returned together.
+// It returns the restored paths.
+func (a *Agent) RestoreHost(ctx context.Context, plan *HostPlan, th *Throttle, owners *snapshots.Owners, scan *snapshots.Scanner, progress func(HostProgress)) ([]string, error) {
+	logger := monitoring.GetLogger().WithField("host", plan.Host)
+	logger.Infof("Restoring %d source(s) of host %s as of %s", len(plan.Entries), plan.Host, plan.At.Format(time.RFC3339))
+
+	var (
+		outputs []string
+		errs    []error
+	)
+	st := HostProgress{Entries: len(plan.Entries), TotalChunks: plan.Chunks()}
+	err := th.run(func() error {
+		for i, e := range plan.Entries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			st.Entry, st.Source = i+1, e.Source
+			if progress != nil {
+				progress(st)
+			}
+			output, err := a.restore(ctx, e.Snapshot, e.Target, th, owners, scan, func(n int) {
+				st.Chunks++
+				st.Bytes += int64(n)
+				if progress != nil {
+					progress(st)
+				}
+			})
+			if err != nil {
+				logger.WithError(err).WithField("snapshot_id", e.Snapshot.ID).Errorf("Failed to restore %s", e.Source)
+				errs = append(errs, fmt.Errorf("%s (%s): %w", e.Source, e.Snapshot.ID, err))
+				continue
+			}
+			outputs = append(outputs, output)
+		}
+		return nil
+	})
+	if err != nil {
+		return outputs, err
+	}
+	return outputs, errors.Join(errs...)
+}
+
+// mirrorPath turns an absolute path into one relative to a restore target,
+// keeping a Windows drive as its own directory: C:\Users becomes C/Users
+func mirrorPath(p string) string {
+	vol := filepath.VolumeName(p)
+	rest := strings.TrimLeft(p[len(vol):], `/\`)
+	vol = strings.Trim(strings.NewReplacer(":", "", `\\`, "", `\`, "_", "/", "_").Replace(vol), "_")
+	return filepath.Join(vol, rest)
+}
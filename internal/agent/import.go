@@ -0,0 +1,361 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/hoangsonww/backupagent/internal/fspath"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/restic"
+	"github.com/hoangsonww/backupagent/internal/snapshots"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// ImportOptions select the restic snapshots ImportRestic converts.
+type ImportOptions struct {
+	Snapshots []string // IDs or ID prefixes; empty imports every snapshot
+	Host      string   // only snapshots taken on this host
+	Tags      []string // added to every imported snapshot
+}
+
+// ImportedSnapshot is one restic snapshot and what became of it.
+type ImportedSnapshot struct {
+	ResticID    string    `json:"restic_id"`
+	SnapshotID  string    `json:"snapshot_id"`
+	Time        time.Time `json:"time"`
+	Host        string    `json:"host,omitempty"`
+	Source      string    `json:"source"`
+	Tags        []string  `json:"tags,omitempty"`
+	Files       int       `json:"files"`
+	Bytes       int64     `json:"bytes"`
+	Skipped     int       `json:"skipped,omitempty"`      // symlinks, devices and other entries without content
+	DroppedTags []string  `json:"dropped_tags,omitempty"` // restic tags versioning.CheckTag rejects
+	Existing    bool      `json:"existing,omitempty"`     // imported by an earlier run
+}
+
+// ImportReport sums up an import.
+type ImportReport struct {
+	Repository string              `json:"repository"` // the restic repository ID
+	Snapshots  []*ImportedSnapshot `json:"snapshots"`
+}
+
+// ImportRestic converts the snapshots of the restic repository in dir,
+// oldest first, into snapshots of this repository. File content is read
+// from restic and chunked as a backup would; each snapshot keeps its
+// original time, host, paths, tags and file attributes. Snapshots imported
+// before are skipped, so an interrupted import can be run again. progress,
+// if set, is called after each snapshot.
+func (a *Agent) ImportRestic(ctx context.Context, dir, password string, opts ImportOptions, progress func(*ImportedSnapshot)) (*ImportReport, error) {
+	for _, t := range opts.Tags {
+		if err := versioning.CheckTag(t); err != nil {
+			return nil, err
+		}
+	}
+	if isBorg(dir) {
+		return nil, fmt.Errorf("%s is a borg repository; only restic repositories can be imported", dir)
+	}
+	repo, err := restic.Open(dir, password)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+	snaps, err := repo.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	snaps, err = selectResticSnapshots(snaps, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := a.Store.BeginWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	logger := monitoring.LoggerFor(ctx).WithField("restic_repository", repo.ID)
+	logger.Infof("Importing %d restic snapshot(s)", len(snaps))
+	im := &importer{
+		agent:   a,
+		repo:    repo,
+		content: make(map[[sha256.Size]byte][]string),
+		parents: make(map[string]*versioning.Snapshot),
+	}
+	report := &ImportReport{Repository: repo.ID, Snapshots: []*ImportedSnapshot{}}
+	for _, rs := range snaps {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		res, err := im.importSnapshot(ctx, rs, opts.Tags)
+		if err != nil {
+			return report, fmt.Errorf("restic snapshot %s: %w", rs.ShortID(), err)
+		}
+		report.Snapshots = append(report.Snapshots, res)
+		logger.WithFields(map[string]interface{}{
+			"restic_id":   rs.ShortID(),
+			"snapshot_id": res.SnapshotID,
+			"files":       res.Files,
+			"existing":    res.Existing,
+		}).Info("Imported restic snapshot")
+		if progress != nil {
+			progress(res)
+		}
+	}
+	a.kickMirrors()
+	a.kickFreshness()
+	return report, nil
+}
+
+// selectResticSnapshots keeps the snapshots opts asks for
+func selectResticSnapshots(snaps []*restic.Snapshot, opts ImportOptions) ([]*restic.Snapshot, error) {
+	var selected []*restic.Snapshot
+	for _, s := range snaps {
+		if opts.Host != "" && s.Hostname != opts.Host {
+			continue
+		}
+		if len(opts.Snapshots) > 0 {
+			match := false
+			for _, id := range opts.Snapshots {
+				match = match || strings.HasPrefix(s.ID, id)
+			}
+			if !match {
+				continue
+			}
+		}
+		selected = append(selected, s)
+	}
+	for _, id := range opts.Snapshots {
+		found := false
+		for _, s := range selected {
+			found = found || strings.HasPrefix(s.ID, id)
+		}
+		if !found {
+			return nil, fmt.Errorf("no restic snapshot %s", id)
+		}
+	}
+	return selected, nil
+}
+
+// importer converts the snapshots of one restic repository
+type importer struct {
+	agent *Agent
+	repo  *restic.Repository
+	// content maps the blob list of each file read so far to its chunks,
+	// so files unchanged between snapshots are read once
+	content map[[sha256.Size]byte][]string
+	// parents is the last snapshot imported per source
+	parents map[string]*versioning.Snapshot
+}
+
+func (im *importer) importSnapshot(ctx context.Context, rs *restic.Snapshot, extraTags []string) (*ImportedSnapshot, error) {
+	a := im.agent
+	res := &ImportedSnapshot{ResticID: rs.ID, Time: rs.Time, Host: rs.Hostname}
+	for _, t := range append(append([]string{}, rs.Tags...), extraTags...) {
+		if versioning.CheckTag(t) != nil {
+			res.DroppedTags = append(res.DroppedTags, t)
+			continue
+		}
+		res.Tags = append(res.Tags, t)
+	}
+	if len(rs.Paths) == 0 {
+		return nil, errors.New("it records no paths")
+	}
+	res.Source = commonDir(rs.Paths)
+
+	key := []byte("restic/" + im.repo.ID + "/" + rs.ID)
+	var existing []byte
+	a.DB.View(func(tx *bolt.Tx) error {
+		existing = tx.Bucket([]byte(persistence.BucketImports)).Get(key)
+		return nil
+	})
+	if existing != nil {
+		res.SnapshotID, res.Existing = string(existing), true
+		return res, nil
+	}
+
+	// Find the source in the tree, which holds every path from the root
+	node := &restic.Node{Name: path.Base(res.Source), Type: restic.NodeDir, Mode: fs.ModeDir | 0755, Subtree: rs.Tree}
+	for _, name := range strings.Split(strings.Trim(res.Source, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if node.Type != restic.NodeDir {
+			return nil, fmt.Errorf("%s is not a directory in the snapshot", res.Source)
+		}
+		nodes, err := im.repo.Tree(node.Subtree)
+		if err != nil {
+			return nil, err
+		}
+		node = nil
+		for _, n := range nodes {
+			if n.Name == name {
+				node = n
+				break
+			}
+		}
+		if node == nil {
+			return nil, fmt.Errorf("%s is missing from the snapshot", res.Source)
+		}
+	}
+
+	var chunks []string
+	var files []versioning.FileEntry
+	switch node.Type {
+	case restic.NodeFile:
+		e, hashes, err := im.file(ctx, node, versioning.SourcePath)
+		if err != nil {
+			return nil, err
+		}
+		e.Count = len(hashes)
+		files, chunks = append(files, e), hashes
+		res.Files, res.Bytes = 1, node.Size
+	case restic.NodeDir:
+		var walk func(tree, dir string) error
+		walk = func(tree, dir string) error {
+			nodes, err := im.repo.Tree(tree)
+			if err != nil {
+				return err
+			}
+			for _, n := range nodes {
+				rel := path.Join(dir, n.Name)
+				switch n.Type {
+				case restic.NodeDir:
+					files = append(files, entry(n, rel, n.Mode.Perm()|fs.ModeDir))
+					if err := walk(n.Subtree, rel); err != nil {
+						return err
+					}
+				case restic.NodeFile:
+					e, hashes, err := im.file(ctx, n, rel)
+					if err != nil {
+						return fmt.Errorf("%s: %w", rel, err)
+					}
+					e.First, e.Count = len(chunks), len(hashes)
+					files, chunks = append(files, e), append(chunks, hashes...)
+					res.Files++
+					res.Bytes += n.Size
+				default:
+					res.Skipped++
+				}
+			}
+			return nil
+		}
+		if err := walk(node.Subtree, ""); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%s is a %s, not a file or directory", res.Source, node.Type)
+	}
+
+	parent := im.parents[res.Source]
+	snap, err := snapshots.NewSnapshot(res.Source, chunks, files, a.Chunking, nil, res.Tags, nil, a.SignerPub, a.SignerPriv, parent, a.RepoID)
+	if err != nil {
+		return nil, err
+	}
+	id, err := im.snapshotID(rs.Time)
+	if err != nil {
+		return nil, err
+	}
+	if err := snapshots.Backdate(snap, id, rs.Time, rs.Hostname, a.metaSealer(), a.SignerPriv); err != nil {
+		return nil, err
+	}
+	if err := versioning.SaveSnapshot(a.DB, snap); err != nil {
+		return nil, err
+	}
+	err = a.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistence.BucketImports)).Put(key, []byte(snap.ID))
+	})
+	if err != nil {
+		return nil, err
+	}
+	im.parents[res.Source] = snap
+	res.SnapshotID = snap.ID
+	if err := a.announceSnapshot(snap); err != nil {
+		monitoring.GetLogger().WithError(err).Warn("Failed to broadcast snapshot (snapshot saved locally)")
+	}
+	return res, nil
+}
+
+// file stores the content of a file node unless an earlier snapshot had the
+// same, and returns its manifest entry at rel and its chunks
+func (im *importer) file(ctx context.Context, n *restic.Node, rel string) (versioning.FileEntry, []string, error) {
+	e := entry(n, rel, n.Mode.Perm())
+	if err := ctx.Err(); err != nil {
+		return e, nil, err
+	}
+	e.Size, e.ModTime = n.Size, n.ModTime.UTC()
+	sum := sha256.Sum256([]byte(strings.Join(n.Content, ",")))
+	if hashes, ok := im.content[sum]; ok {
+		return e, hashes, nil
+	}
+	hashes, err := snapshots.StoreReader(ctx, im.agent.Store, im.repo.NewReader(n), im.agent.Chunking)
+	if err != nil {
+		return e, nil, err
+	}
+	im.content[sum] = hashes
+	return e, hashes, nil
+}
+
+// entry is the manifest entry of a node at rel
+func entry(n *restic.Node, rel string, mode fs.FileMode) versioning.FileEntry {
+	e := versioning.FileEntry{Path: fspath.Key(rel), Original: fspath.Original(rel), Mode: mode}
+	if n.User != "" || n.UID != 0 || n.GID != 0 {
+		e.Owner = &versioning.FileOwner{UID: n.UID, GID: n.GID, User: n.User, Group: n.Group}
+	}
+	return e
+}
+
+// snapshotID names a snapshot taken at t like NewSnapshot does, moving to
+// the next free second when the name is taken
+func (im *importer) snapshotID(t time.Time) (string, error) {
+	for sec := t.Unix(); ; sec++ {
+		id := fmt.Sprintf("snap-%d", sec)
+		_, err := versioning.LoadSnapshot(im.agent.DB, id)
+		if errors.Is(err, versioning.ErrSnapshotNotFound) {
+			return id, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// commonDir is the deepest directory holding every path, or the path itself
+// when there is one. Windows paths are given as restic lays them out in its
+// trees, C:\Users as /C/Users.
+func commonDir(paths []string) string {
+	split := func(p string) []string {
+		p = strings.ReplaceAll(p, `\`, "/")
+		if len(p) >= 2 && p[1] == ':' {
+			p = "/" + p[:1] + p[2:]
+		}
+		return strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/")
+	}
+	common := split(paths[0])
+	for _, p := range paths[1:] {
+		parts := split(p)
+		n := 0
+		for n < len(common) && n < len(parts) && common[n] == parts[n] {
+			n++
+		}
+		common = common[:n]
+	}
+	return path.Clean("/" + strings.Join(common, "/"))
+}
+
+// isBorg reports whether dir looks like a borg repository
+func isBorg(dir string) bool {
+	data, err := os.ReadFile(filepath.Join(dir, "README"))
+	return err == nil && bytes.HasPrefix(data, []byte("This is a Borg Backup repository"))
+}
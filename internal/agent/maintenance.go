@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/gc"
+	"github.com/hoangsonww/backupagent/internal/maintenance"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/scheduler"
+	"github.com/hoangsonww/backupagent/internal/verification"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// newMaintenance registers the tasks listed in maintenance.order, highest
+// priority first
+func (a *Agent) newMaintenance() (*maintenance.Orchestrator, error) {
+	cfg := a.Config.Maintenance
+	window, err := scheduler.ParseActiveWindow(cfg.Window)
+	if err != nil {
+		return nil, err
+	}
+	o := maintenance.New(a.DB, window, cfg.Budget)
+	for _, name := range cfg.Order {
+		switch name {
+		case "gc":
+			collector := gc.NewCollector(a.DB, a.Store, a.Config.Storage.RetentionDays, a.Config.Storage.Retention, a.Config.Storage.GCInterval, a.Config.Storage.GCGrace)
+			o.Register(maintenance.Task{Name: name, Interval: a.Config.Storage.GCInterval, Run: a.unlessOverLimit(name, collector.RunContext)})
+		case "verify":
+			o.Register(maintenance.Task{Name: name, Interval: cfg.VerifyInterval, Run: a.unlessOverLimit(name, a.verifyPass)})
+		}
+	}
+	return o, nil
+}
+
+// unlessOverLimit pauses a maintenance task that is due while the agent is
+// over a resource limit, so it resumes at the next check after that
+func (a *Agent) unlessOverLimit(name string, run func(context.Context) error) func(context.Context) error {
+	return func(ctx context.Context) error {
+		if over := a.resources.exceeded(); over != nil {
+			monitoring.GetMetrics().JobsDeferred.Add(1)
+			monitoring.GetLogger().WithField("limits", over).Warnf("Deferring maintenance task %s until resource use drops", name)
+			return maintenance.ErrPaused
+		}
+		return run(ctx)
+	}
+}
+
+// verifyPass decrypts and checks every chunk of the repository's own
+// snapshots, oldest first, reading chunks they share once. A run stopped by
+// ctx or its verify budget resumes the pass where it stopped.
+func (a *Agent) verifyPass(ctx context.Context) error {
+	logger := monitoring.GetLogger()
+	own, err := a.ownSnapshots()
+	if err != nil {
+		return err
+	}
+	cfg := a.Config.Maintenance
+	res, err := verification.NewVerifier(a.DB, a.Store).VerifySnapshots(ctx, own, verification.PassOptions{
+		Workers:  cfg.VerifyWorkers,
+		Budget:   cfg.VerifyBudget,
+		MaxBytes: cfg.VerifyMaxRead,
+	})
+	if res != nil {
+		for _, r := range res.Snapshots {
+			if !r.Success {
+				logger.WithFields(map[string]interface{}{
+					"snapshot_id": r.SnapshotID,
+					"missing":     len(r.MissingChunks),
+					"corrupted":   len(r.CorruptedChunks),
+				}).Error("Snapshot failed verification")
+			}
+		}
+	}
+	if errors.Is(err, verification.ErrBudget) {
+		return maintenance.ErrPaused
+	}
+	if err != nil {
+		return err
+	}
+	if res.Failed > 0 {
+		return fmt.Errorf("%d snapshot(s) failed verification", res.Failed)
+	}
+	return nil
+}
+
+// VerifyLocal checks every chunk of the snapshots ids, or of the
+// repository's own snapshots when ids is empty, in the pass the maintenance
+// task runs: an interrupted pass is resumed and one stopped by opts leaves
+// its progress to the next run.
+func (a *Agent) VerifyLocal(ctx context.Context, ids []string, opts verification.PassOptions) (*verification.PassResult, error) {
+	var snaps []*versioning.Snapshot
+	if len(ids) == 0 {
+		own, err := a.ownSnapshots()
+		if err != nil {
+			return nil, err
+		}
+		snaps = own
+	}
+	for _, id := range ids {
+		snap, err := versioning.LoadSnapshot(a.DB, id)
+		if err != nil {
+			return nil, err
+		}
+		snaps = append(snaps, snap)
+	}
+	return verification.NewVerifier(a.DB, a.Store).VerifySnapshots(ctx, snaps, opts)
+}
+
+// GCStatus is the recent garbage collection history and the next run.
+type GCStatus struct {
+	LastRun *gc.RunRecord   `json:"last_run,omitempty"`
+	NextRun *time.Time      `json:"next_run,omitempty"` // unset when gc is not in maintenance.order
+	History []*gc.RunRecord `json:"history"`            // newest first
+}
+
+// Forecast projects repository usage over the next months under the
+// configured retention and under each of the retention periods of whatIf.
+func (a *Agent) Forecast(months int, whatIf []int) (*gc.Forecast, error) {
+	return gc.Project(a.DB, a.Config.Storage.RetentionDays, whatIf, months, time.Now())
+}
+
+// GCStatus returns the last n garbage collection runs and when the
+// maintenance window next runs one.
+func (a *Agent) GCStatus(n int) (*GCStatus, error) {
+	runs, err := gc.History(a.DB, n)
+	if err != nil {
+		return nil, err
+	}
+	st := &GCStatus{History: runs}
+	if len(runs) > 0 {
+		st.LastRun = runs[0]
+	}
+	tasks, err := a.Maintenance.Status()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tasks {
+		if t.Name == "gc" {
+			next := t.NextDue
+			st.NextRun = &next
+		}
+	}
+	return st, nil
+}
@@ -0,0 +1,316 @@
+package agent
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/auth"
+	"github.com/hoangsonww/backupagent/internal/crypto"
+	"github.com/hoangsonww/backupagent/internal/identity"
+	"github.com/hoangsonww/backupagent/internal/metabackup"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/p2p"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/protocol"
+	"github.com/hoangsonww/backupagent/internal/snapshots"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// ErrMetadataUnchanged is returned when nothing changed since the last export
+	ErrMetadataUnchanged = errors.New("metadata unchanged since the last export")
+	// ErrRepositoryNotEmpty is returned when recovering into a repository that has snapshots
+	ErrRepositoryNotEmpty = errors.New("repository already has snapshots")
+)
+
+// keyMetadataSum records in the meta bucket what the last export contained
+const keyMetadataSum = "metadata_backup_sum"
+
+// metadataFile is the export written to metadata_backup.export_dir
+type metadataFile struct {
+	Snapshot *versioning.Snapshot `json:"snapshot"`
+	Chunks   [][]byte             `json:"chunks"` // stored form, in snapshot order
+}
+
+// runMetadataBackups exports the repository metadata every interval when it
+// changed.
+func (a *Agent) runMetadataBackups(ctx context.Context) {
+	cfg := a.Config.MetadataBackup
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := a.BackupMetadata(false); err != nil && !errors.Is(err, ErrMetadataUnchanged) {
+			monitoring.GetLogger().WithError(err).Error("Metadata backup failed")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// BackupMetadata exports the snapshot records and node identity as an
+// encrypted metadata snapshot, unless nothing changed since the last export
+// and force is not set. Mirrors receive it like any other snapshot, and the
+// newest export is also written to metadata_backup.export_dir if set.
+func (a *Agent) BackupMetadata(force bool) (*versioning.Snapshot, error) {
+	cfg := a.Config.MetadataBackup
+	identityKey, err := os.ReadFile(identity.KeyPath(a.Config.RepositoryPath))
+	if err != nil {
+		return nil, err
+	}
+	exp, err := metabackup.Collect(a.DB, a.RepoID, identityKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := exp.Sum()
+	if !force {
+		var last string
+		a.DB.View(func(tx *bolt.Tx) error {
+			last = string(tx.Bucket([]byte(persistence.BucketMeta)).Get([]byte(keyMetadataSum)))
+			return nil
+		})
+		if last == sum {
+			return nil, ErrMetadataUnchanged
+		}
+	}
+
+	pieces, err := exp.Pieces()
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := a.Store.PutChunks(pieces)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := a.DB.KeySalt()
+	if err != nil {
+		return nil, err
+	}
+	snap := &versioning.Snapshot{
+		ID:        fmt.Sprintf("metadata-%d", time.Now().Unix()),
+		Timestamp: versioning.NewTimestamp(time.Now()),
+		Chunks:    hashes,
+		Meta: map[string]string{
+			"source":                 versioning.MetadataSource,
+			metabackup.MetaKDF:       metabackup.KDF,
+			metabackup.MetaSalt:      base64.StdEncoding.EncodeToString(salt),
+			metabackup.MetaSnapshots: strconv.Itoa(len(exp.Snapshots)),
+		},
+		SignerPub: auth.PubKeyToString(a.SignerPub),
+		RepoID:    a.RepoID,
+	}
+	snapshots.Sign(snap, a.SignerPriv)
+	if err := versioning.SaveSnapshot(a.DB, snap); err != nil {
+		return nil, err
+	}
+
+	if cfg.ExportDir != "" {
+		if err := a.writeMetadataFile(snap, cfg.ExportDir); err != nil {
+			return nil, fmt.Errorf("failed to write metadata export: %w", err)
+		}
+	}
+	if err := a.pruneMetadataBackups(cfg.Keep); err != nil {
+		return nil, err
+	}
+	err = a.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistence.BucketMeta)).Put([]byte(keyMetadataSum), []byte(sum))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	monitoring.GetLogger().WithFields(map[string]interface{}{
+		"snapshot_id": snap.ID,
+		"snapshots":   len(exp.Snapshots),
+		"chunks":      len(hashes),
+	}).Info("Exported repository metadata")
+	a.kickMirrors()
+	return snap, nil
+}
+
+// writeMetadataFile replaces <dir>/<repository ID>.metadata with snap and
+// its encrypted chunks
+func (a *Agent) writeMetadataFile(snap *versioning.Snapshot, dir string) error {
+	file := metadataFile{Snapshot: snap}
+	for _, h := range snap.Chunks {
+		data, err := a.Store.Get(h)
+		if err != nil {
+			return err
+		}
+		file.Chunks = append(file.Chunks, data)
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, a.RepoID+".metadata")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// pruneMetadataBackups deletes all but the keep newest exports. Their chunks
+// are left to GC.
+func (a *Agent) pruneMetadataBackups(keep int) error {
+	var own []*versioning.Snapshot
+	err := versioning.ForEachSnapshotByTime(a.DB, versioning.MetadataSource, func(snap *versioning.Snapshot) error {
+		if snap.RepoID == a.RepoID {
+			own = append(own, snap)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(own)-keep; i++ {
+		if err := versioning.DeleteSnapshot(a.DB, own[i].ID); err != nil && !errors.Is(err, versioning.ErrSnapshotHeld) {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecoverMetadata rebuilds the metadata of this repository from its newest
+// export, pulled from the peer named by from or read from file. The
+// repository must have no snapshots yet and be stamped with the lost
+// repository's ID. The export is decrypted with the key passphrase derives
+// under the salt recorded in it, which proves it authentic; that salt and the
+// exported identity then replace this node's, so the agent must be
+// restarted afterwards.
+func (a *Agent) RecoverMetadata(ctx context.Context, from, file, passphrase string) (*metabackup.Export, error) {
+	all, err := versioning.ListAllSnapshots(a.DB)
+	if err != nil {
+		return nil, err
+	}
+	for _, snap := range all {
+		if !snap.IsMetadata() {
+			return nil, ErrRepositoryNotEmpty
+		}
+	}
+
+	var snap *versioning.Snapshot
+	if file != "" {
+		snap, err = a.loadMetadataFile(file)
+	} else {
+		snap, err = a.pullMetadata(ctx, from)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if snap.Meta[metabackup.MetaKDF] != metabackup.KDF {
+		return nil, fmt.Errorf("metadata export uses unknown key derivation %q", snap.Meta[metabackup.MetaKDF])
+	}
+	salt, err := base64.StdEncoding.DecodeString(snap.Meta[metabackup.MetaSalt])
+	if err != nil {
+		return nil, fmt.Errorf("metadata export has a malformed key salt: %w", err)
+	}
+
+	// Read the export with the key it was written under
+	key := crypto.DeriveKey(passphrase, salt)
+	old, err := openStore(a.Config, a.DB, key)
+	if err != nil {
+		return nil, err
+	}
+	pieces := make([][]byte, len(snap.Chunks))
+	for i, h := range snap.Chunks {
+		if pieces[i], err = old.GetChunk(h); err != nil {
+			return nil, fmt.Errorf("cannot decrypt metadata export (wrong passphrase?): %w", err)
+		}
+	}
+	exp, err := metabackup.Decode(pieces)
+	if err != nil {
+		return nil, err
+	}
+	if exp.RepoID != a.RepoID {
+		return nil, fmt.Errorf("%w: export is of %s", versioning.ErrForeignSnapshot, exp.RepoID)
+	}
+
+	if err := a.DB.SetKeySalt(salt); err != nil {
+		return nil, err
+	}
+	if err := a.DB.Reseal(key); err != nil {
+		return nil, err
+	}
+	if len(exp.Identity) > 0 {
+		if err := os.WriteFile(identity.KeyPath(a.Config.RepositoryPath), exp.Identity, 0600); err != nil {
+			return nil, err
+		}
+	}
+	n, err := exp.Apply(a.DB)
+	if err != nil {
+		return nil, err
+	}
+	monitoring.GetLogger().WithFields(map[string]interface{}{
+		"export":    snap.ID,
+		"created":   exp.Created,
+		"snapshots": n,
+	}).Info("Recovered repository metadata")
+	return exp, nil
+}
+
+// pullMetadata fetches the newest metadata export of this repository from a
+// peer. Any signer is accepted: only the passphrase decrypts the export.
+func (a *Agent) pullMetadata(ctx context.Context, from string) (*versioning.Snapshot, error) {
+	pid, err := a.ConnectPeer(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	trust := func(snap *versioning.Snapshot) error {
+		if !snap.IsMetadata() {
+			return fmt.Errorf("snapshot %s is not a metadata export", snap.ID)
+		}
+		return versioning.CheckRepository(snap, a.RepoID)
+	}
+	res, err := p2p.PullSnapshot(ctx, a.P2P.Host, pid, a.DB, a.Store, versioning.LatestMetadataID, a.RepoID, trust, nil)
+	if err != nil {
+		return nil, err
+	}
+	a.P2P.Locations.Record(pid, res.Snapshot.Chunks...)
+	return res.Snapshot, nil
+}
+
+// loadMetadataFile stores the export snapshot and chunks of a metadata file
+func (a *Agent) loadMetadataFile(path string) (*versioning.Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file metadataFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	snap := file.Snapshot
+	if snap == nil || !snap.IsMetadata() || len(file.Chunks) != len(snap.Chunks) {
+		return nil, fmt.Errorf("%s is not a metadata export", path)
+	}
+	if err := (&protocol.SnapshotAnnouncement{Snapshot: *snap}).Validate(); err != nil {
+		return nil, err
+	}
+	if err := versioning.CheckRepository(snap, a.RepoID); err != nil {
+		return nil, err
+	}
+	for i, h := range snap.Chunks {
+		if err := a.Store.Put(h, file.Chunks[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := versioning.SaveSnapshot(a.DB, snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
@@ -0,0 +1,274 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hoangsonww/backupagent/config"
+	"github.com/hoangsonww/backupagent/internal/auth"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/p2p"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	bolt "go.etcd.io/bbolt"
+)
+
+// MirrorStatus is the replication state of this node's snapshots on one mirror.
+type MirrorStatus struct {
+	PeerID       string               `json:"peer_id"`
+	Replicated   map[string]time.Time `json:"replicated"` // snapshot ID -> last confirmed on the mirror
+	LastSync     time.Time            `json:"last_sync,omitempty"`
+	LastVerify   time.Time            `json:"last_verify,omitempty"`
+	VerifyFailed []string             `json:"verify_failed,omitempty"`
+	Lag          time.Duration        `json:"lag"`
+	Alerting     bool                 `json:"alerting"`
+}
+
+// runMirrors starts replication to every configured mirror.
+func (a *Agent) runMirrors(ctx context.Context) {
+	logger := monitoring.GetLogger()
+
+	for _, m := range a.Config.Mirrors {
+		info, err := peer.AddrInfoFromString(m.Peer)
+		if err != nil {
+			logger.WithError(err).Errorf("Invalid mirror address: %s", m.Peer)
+			continue
+		}
+		a.P2P.Pins.Keep(*info)
+
+		kick := make(chan struct{}, 1)
+		a.mirrorMu.Lock()
+		a.mirrorKicks = append(a.mirrorKicks, kick)
+		a.mirrorMu.Unlock()
+
+		logger.Infof("Mirroring with %s (repository %s)", info.ID, m.RepositoryID)
+		go a.runMirror(ctx, m, info.ID, kick)
+	}
+}
+
+func (a *Agent) runMirror(ctx context.Context, m config.MirrorConfig, pid peer.ID, kick chan struct{}) {
+	ticker := time.NewTicker(m.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.syncMirror(ctx, m, pid); err != nil {
+			monitoring.GetLogger().WithError(err).Warnf("Mirror sync with %s failed", pid)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-kick:
+		}
+	}
+}
+
+// kickMirrors asks every mirror to sync now, e.g. after a new snapshot
+func (a *Agent) kickMirrors() {
+	a.mirrorMu.Lock()
+	defer a.mirrorMu.Unlock()
+	for _, kick := range a.mirrorKicks {
+		select {
+		case kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// syncMirror pushes our snapshots the mirror does not have yet and, when
+// verification is due, re-pushes every replicated one so the mirror proves by
+// digest that it still holds all chunks.
+func (a *Agent) syncMirror(ctx context.Context, m config.MirrorConfig, pid peer.ID) error {
+	logger := monitoring.GetLogger().WithField("mirror", pid.String())
+
+	if err := a.checkPlacement(a.RepoID, pid); err != nil {
+		a.updatePlacementHealth()
+		return err
+	}
+	st, err := a.loadMirrorStatus(pid)
+	if err != nil {
+		return err
+	}
+	own, err := a.ownSnapshots()
+	if err != nil {
+		return err
+	}
+
+	// Forget snapshots that were pruned locally
+	exists := make(map[string]bool, len(own))
+	for _, snap := range own {
+		exists[snap.ID] = true
+	}
+	for id := range st.Replicated {
+		if !exists[id] {
+			delete(st.Replicated, id)
+		}
+	}
+
+	now := time.Now()
+	verifying := now.Sub(st.LastVerify) >= m.VerifyInterval
+	if verifying {
+		st.VerifyFailed = nil
+	}
+
+	var syncErr error
+	for _, snap := range own {
+		_, done := st.Replicated[snap.ID]
+		if done && !verifying {
+			continue
+		}
+		if _, err := p2p.PushSnapshot(ctx, a.P2P.Host, pid, a.Store, snap, nil); err != nil {
+			if !errors.Is(err, p2p.ErrPushRejected) && !errors.Is(err, p2p.ErrPushVerifyFailed) {
+				// Mirror unreachable; retry the whole pass later
+				syncErr = err
+				break
+			}
+			if done {
+				delete(st.Replicated, snap.ID)
+				st.VerifyFailed = append(st.VerifyFailed, snap.ID)
+				monitoring.GetMetrics().MirrorVerifyFailures.Add(1)
+				logger.WithError(err).Errorf("Mirror failed verification of snapshot %s", snap.ID)
+			} else {
+				logger.WithError(err).Warnf("Mirror rejected snapshot %s", snap.ID)
+			}
+			continue
+		}
+		st.Replicated[snap.ID] = time.Now()
+		a.P2P.Locations.Record(pid, snap.Chunks...)
+	}
+
+	if syncErr == nil {
+		st.LastSync = now
+		if verifying {
+			st.LastVerify = now
+		}
+	}
+
+	// Lag is the age of the oldest snapshot the mirror does not hold
+	st.Lag = 0
+	for _, snap := range own {
+		if _, ok := st.Replicated[snap.ID]; !ok {
+			st.Lag = now.Sub(snap.Timestamp.Time())
+			break
+		}
+	}
+	wasAlerting := st.Alerting
+	st.Alerting = st.Lag > m.MaxLag || len(st.VerifyFailed) > 0
+	if st.Alerting && !wasAlerting {
+		logger.WithFields(map[string]interface{}{
+			"lag":           st.Lag.String(),
+			"max_lag":       m.MaxLag.String(),
+			"verify_failed": len(st.VerifyFailed),
+		}).Error("Mirror out of sync")
+	} else if wasAlerting && !st.Alerting {
+		logger.Info("Mirror back in sync")
+	}
+
+	if err := a.saveMirrorStatus(st); err != nil {
+		return err
+	}
+	a.updateMirrorHealth()
+	a.updatePlacementHealth()
+	return syncErr
+}
+
+// ownSnapshots returns this node's snapshots of its own repository, oldest first
+func (a *Agent) ownSnapshots() ([]*versioning.Snapshot, error) {
+	all, err := versioning.ListAllSnapshots(a.DB)
+	if err != nil {
+		return nil, err
+	}
+	self := auth.PubKeyToString(a.SignerPub)
+	var own []*versioning.Snapshot
+	for _, snap := range all {
+		if snap.SignerPub == self && snap.RepoID == a.RepoID {
+			own = append(own, snap)
+		}
+	}
+	versioning.SortByTime(own)
+	return own, nil
+}
+
+// MirrorStatuses returns the replication state of every configured mirror.
+func (a *Agent) MirrorStatuses() ([]*MirrorStatus, error) {
+	var out []*MirrorStatus
+	for _, m := range a.Config.Mirrors {
+		info, err := peer.AddrInfoFromString(m.Peer)
+		if err != nil {
+			continue
+		}
+		st, err := a.loadMirrorStatus(info.ID)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+// updateMirrorHealth publishes the worst lag and any alerting mirrors
+func (a *Agent) updateMirrorHealth() {
+	statuses, err := a.MirrorStatuses()
+	if err != nil {
+		return
+	}
+	var maxLag time.Duration
+	var alerting []string
+	for _, st := range statuses {
+		if st.Lag > maxLag {
+			maxLag = st.Lag
+		}
+		if st.Alerting {
+			alerting = append(alerting, st.PeerID)
+		}
+	}
+	monitoring.GetMetrics().MirrorLagSeconds.Store(int64(maxLag.Seconds()))
+
+	status, msg := monitoring.StatusHealthy, ""
+	if len(alerting) > 0 {
+		status = monitoring.StatusDegraded
+		msg = fmt.Sprintf("%d mirror(s) lagging or failing verification", len(alerting))
+	}
+	monitoring.GetHealthChecker().UpdateComponent("mirrors", status, msg, map[string]interface{}{
+		"mirrors":  len(statuses),
+		"alerting": alerting,
+		"max_lag":  maxLag.String(),
+	})
+}
+
+func (a *Agent) loadMirrorStatus(pid peer.ID) (*MirrorStatus, error) {
+	st := &MirrorStatus{PeerID: pid.String()}
+	err := a.DB.View(func(tx *bolt.Tx) error {
+		b, err := a.DB.Sealed(tx, persistence.BucketMirrors)
+		if err != nil {
+			return err
+		}
+		v, err := b.Get([]byte(pid.String()))
+		if v == nil || err != nil {
+			return err
+		}
+		return json.Unmarshal(v, st)
+	})
+	if st.Replicated == nil {
+		st.Replicated = make(map[string]time.Time)
+	}
+	return st, err
+}
+
+func (a *Agent) saveMirrorStatus(st *MirrorStatus) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return a.DB.Update(func(tx *bolt.Tx) error {
+		b, err := a.DB.Sealed(tx, persistence.BucketMirrors)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(st.PeerID), data)
+	})
+}
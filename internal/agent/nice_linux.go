@@ -0,0 +1,24 @@
+package agent
+
+import "golang.org/x/sys/unix"
+
+const (
+	ioprioWhoProcess = 1 // with ID 0, the calling thread
+	ioprioClassShift = 13
+	ioprioClassIdle  = 3
+	niceLevel        = 10
+)
+
+// setNice moves the calling thread to the idle I/O class and lowers its
+// CPU priority, or back to the defaults. Raising the CPU priority again
+// needs CAP_SYS_NICE, so without it the thread stays at niceLevel.
+func setNice(on bool) error {
+	prio, cpu := 0, 0
+	if on {
+		prio, cpu = ioprioClassIdle<<ioprioClassShift, niceLevel
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio)); errno != 0 {
+		return errno
+	}
+	return unix.Setpriority(unix.PRIO_PROCESS, 0, cpu)
+}
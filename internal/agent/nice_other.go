@@ -0,0 +1,12 @@
+//go:build !linux
+
+package agent
+
+import "errors"
+
+func setNice(on bool) error {
+	if on {
+		return errors.New("io nice is only supported on Linux")
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/auth"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/p2p"
+	"github.com/hoangsonww/backupagent/internal/protocol"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// maxOfferAge is how long a storage offer is trusted after it was issued
+const maxOfferAge = 24 * time.Hour
+
+// ErrNoStorageOffer is returned when no peer offers room for a placement
+var ErrNoStorageOffer = errors.New("no peer offers enough storage")
+
+// runStorageOffers advertises our storage offer periodically, if we make one.
+func (a *Agent) runStorageOffers(ctx context.Context) {
+	if a.Config.P2P.StorageOffer == 0 {
+		return
+	}
+	ticker := time.NewTicker(a.Config.P2P.OfferInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.AdvertiseStorage(); err != nil {
+			monitoring.GetLogger().WithError(err).Warn("Failed to advertise storage offer")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// AdvertiseStorage signs and publishes the space we offer to the swarm and
+// how much of it the chunk store already takes.
+func (a *Agent) AdvertiseStorage() error {
+	used, err := a.Store.Size(nil)
+	if err != nil {
+		return err
+	}
+	offer := &protocol.StorageOffer{
+		PeerID:    a.P2P.Host.ID().String(),
+		Capacity:  a.Config.P2P.StorageOffer,
+		Used:      used,
+		IssuedAt:  time.Now().UTC().Format(time.RFC3339),
+		SignerPub: auth.PubKeyToString(a.SignerPub),
+	}
+	offer.Signature = auth.PubKeyToString(auth.SignPayload(offer.SigningPayload(), a.SignerPriv))
+	return a.publish("storage_offer", "storage_offer", offer)
+}
+
+func (a *Agent) handleStorageOffer(envelope map[string]interface{}, from peer.ID) {
+	logger := monitoring.GetLogger()
+
+	var offer protocol.StorageOffer
+	if err := decodeEnvelope(envelope, "storage_offer", &offer); err != nil {
+		logger.WithError(err).Error("Failed to decode storage offer")
+		a.penalize(from, p2p.OffenseMalformed)
+		return
+	}
+	if err := offer.Validate(); err != nil {
+		logger.WithError(err).Warn("Invalid storage offer")
+		a.penalize(from, p2p.OffenseInvalidSignature)
+		return
+	}
+	if from == a.P2P.Host.ID() {
+		return
+	}
+	// A peer may only speak for its own space
+	if pub, err := peerSignerPub(from); err != nil || offer.PeerID != from.String() || offer.SignerPub != pub {
+		logger.WithField("peer", from.String()).Warn("Storage offer not signed by the offering peer")
+		a.penalize(from, p2p.OffenseInvalidSignature)
+		return
+	}
+	issued, _ := time.Parse(time.RFC3339, offer.IssuedAt)
+	if age := time.Since(issued); age > maxOfferAge || age < -pexMinGap {
+		logger.Debugf("Storage offer issued at %s outside accepted window, ignoring", offer.IssuedAt)
+		return
+	}
+	if _, err := p2p.SaveOffer(a.DB, &offer); err != nil {
+		logger.WithError(err).Warn("Failed to store storage offer")
+	}
+}
+
+// PlaceReplicas returns up to n peers to hold need more bytes of a snapshot
+// of repoID, chosen from current storage offers, most free space first.
+// Quarantined peers, cache nodes, peers in held (which already have a copy)
+// and peers the repository's placement policy forbids are left out. While a
+// placement requirement is short of copies, only peers that fill it are
+// chosen.
+func (a *Agent) PlaceReplicas(repoID string, need int64, n int, held map[peer.ID]time.Time) ([]peer.ID, error) {
+	offers, err := p2p.LoadOffers(a.DB)
+	if err != nil {
+		return nil, err
+	}
+	pol := a.placementPolicy(repoID)
+	var heldLabels [][]string
+	for pid := range held {
+		heldLabels = append(heldLabels, a.peerLabels(pid))
+	}
+	missing := pol.missing(heldLabels)
+
+	self := a.P2P.Host.ID()
+	pids := p2p.PlaceOnOffers(offers, need, n, maxOfferAge, func(pid peer.ID) bool {
+		if pid == self || a.P2P.Scorer.IsQuarantined(pid) || p2p.IsCacheNode(a.P2P.Host, pid) {
+			return false
+		}
+		if _, ok := held[pid]; ok {
+			return false
+		}
+		labels := a.peerLabels(pid)
+		if !pol.allows(labels) {
+			return false
+		}
+		if len(missing) == 0 {
+			return true
+		}
+		for label := range missing {
+			if hasLabel(labels, label) {
+				return true
+			}
+		}
+		return false
+	})
+	if len(pids) == 0 && len(missing) > 0 {
+		labels := make([]string, 0, len(missing))
+		for label := range missing {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		err := fmt.Errorf("%w: no peer labelled %s offers %d bytes", ErrPlacementUnsatisfiable, strings.Join(labels, " or "), need)
+		monitoring.GetLogger().WithFields(map[string]interface{}{
+			"repository": repoID,
+			"missing":    missing,
+		}).WithError(err).Warn("Placement requirement unsatisfiable")
+		return nil, err
+	}
+	if len(pids) == 0 {
+		return nil, fmt.Errorf("%w (%d bytes)", ErrNoStorageOffer, need)
+	}
+	return pids, nil
+}
+
+// peerSignerPub returns the signer key of a peer, which is its identity key
+func peerSignerPub(pid peer.ID) (string, error) {
+	pub, err := pid.ExtractPublicKey()
+	if err != nil {
+		return "", err
+	}
+	raw, err := pub.Raw()
+	if err != nil {
+		return "", err
+	}
+	return auth.PubKeyToString(raw), nil
+}
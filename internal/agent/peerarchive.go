@@ -0,0 +1,242 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/auth"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/protocol"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// ErrPeerNotRemoved is returned when restoring a peer that is not archived
+	ErrPeerNotRemoved = errors.New("peer is not removed")
+	// ErrPeerRemovedForAbuse is returned when adding back a peer removed for
+	// abuse without an override
+	ErrPeerRemovedForAbuse = errors.New("peer was removed for abuse")
+)
+
+// PeerRemoval is one removal of a peer from the stored peer list.
+type PeerRemoval struct {
+	Reason     string     `json:"reason,omitempty"`
+	Abuse      bool       `json:"abuse,omitempty"`
+	SignedBy   string     `json:"signed_by"` // key that signed the removal
+	RemovedAt  time.Time  `json:"removed_at"`
+	RestoredAt *time.Time `json:"restored_at,omitempty"`
+}
+
+// RemovedPeer is the archived entry of a peer that was removed at least
+// once, with the addresses it was stored with and every removal.
+type RemovedPeer struct {
+	Info     peer.AddrInfo  `json:"info"`
+	Removals []*PeerRemoval `json:"removals"`
+}
+
+// Latest returns the most recent removal.
+func (rp *RemovedPeer) Latest() *PeerRemoval {
+	return rp.Removals[len(rp.Removals)-1]
+}
+
+// Archived reports whether the peer is removed and not restored since.
+func (rp *RemovedPeer) Archived() bool {
+	return len(rp.Removals) > 0 && rp.Latest().RestoredAt == nil
+}
+
+// signedRemoval returns a removal of peerID signed with our key
+func (a *Agent) signedRemoval(peerID, reason string, abuse bool) *protocol.PeerRemove {
+	rm := &protocol.PeerRemove{
+		PeerID:    peerID,
+		Reason:    reason,
+		Abuse:     abuse,
+		SignerPub: auth.PubKeyToString(a.SignerPub),
+	}
+	rm.Signature = auth.PubKeyToString(auth.SignPayload(rm.SigningPayload(), a.SignerPriv))
+	return rm
+}
+
+// archivePeer moves a peer from the stored peer list into the archive,
+// recording the removal rm
+func (a *Agent) archivePeer(rm *protocol.PeerRemove) error {
+	pid, err := peer.Decode(rm.PeerID)
+	if err != nil {
+		return err
+	}
+	err = a.DB.Update(func(tx *bolt.Tx) error {
+		peers, err := a.DB.Sealed(tx, persistence.BucketPeers)
+		if err != nil {
+			return err
+		}
+		removed, err := a.DB.Sealed(tx, persistence.BucketRemoved)
+		if err != nil {
+			return err
+		}
+
+		rp := RemovedPeer{Info: peer.AddrInfo{ID: pid}}
+		if v, err := removed.Get([]byte(rm.PeerID)); err != nil {
+			return err
+		} else if v != nil {
+			if err := json.Unmarshal(v, &rp); err != nil {
+				return err
+			}
+		}
+		if v, err := peers.Get([]byte(rm.PeerID)); err != nil {
+			return err
+		} else if v != nil {
+			var info peer.AddrInfo
+			if json.Unmarshal(v, &info) == nil && len(info.Addrs) > 0 {
+				rp.Info = info
+			}
+		}
+		rp.Removals = append(rp.Removals, &PeerRemoval{
+			Reason:    rm.Reason,
+			Abuse:     rm.Abuse,
+			SignedBy:  rm.SignerPub,
+			RemovedAt: time.Now().UTC(),
+		})
+
+		val, err := json.Marshal(&rp)
+		if err != nil {
+			return err
+		}
+		if err := removed.Put([]byte(rm.PeerID), val); err != nil {
+			return err
+		}
+		return peers.Delete([]byte(rm.PeerID))
+	})
+	if err != nil {
+		return err
+	}
+	monitoring.GetLogger().WithFields(map[string]interface{}{
+		"peer":   rm.PeerID,
+		"reason": rm.Reason,
+		"abuse":  rm.Abuse,
+		"signer": rm.SignerPub,
+	}).Info("Peer removed and archived")
+	return nil
+}
+
+// RemovedPeers returns every archived peer, most recently removed first,
+// including those restored since.
+func (a *Agent) RemovedPeers() ([]*RemovedPeer, error) {
+	var out []*RemovedPeer
+	err := a.DB.View(func(tx *bolt.Tx) error {
+		b, err := a.DB.Sealed(tx, persistence.BucketRemoved)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var rp RemovedPeer
+			if err := json.Unmarshal(v, &rp); err != nil || len(rp.Removals) == 0 {
+				return nil
+			}
+			out = append(out, &rp)
+			return nil
+		})
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].Latest().RemovedAt.After(out[j].Latest().RemovedAt) })
+	return out, err
+}
+
+// RestorePeer puts an archived peer back on the stored peer list with the
+// addresses it had. A peer removed for abuse needs force.
+func (a *Agent) RestorePeer(peerID string, force bool) (*RemovedPeer, error) {
+	rp, err := a.removedPeer(peerID)
+	if err != nil {
+		return nil, err
+	}
+	if rp == nil || !rp.Archived() {
+		return nil, fmt.Errorf("%w: %s", ErrPeerNotRemoved, peerID)
+	}
+	if rp.Latest().Abuse && !force {
+		return nil, fmt.Errorf("%w (%s); restore it with force", ErrPeerRemovedForAbuse, rp.Latest().Reason)
+	}
+	if err := a.unarchivePeer(rp.Info); err != nil {
+		return nil, err
+	}
+	monitoring.GetLogger().WithFields(map[string]interface{}{
+		"peer":  peerID,
+		"force": force,
+	}).Info("Removed peer restored")
+	return a.removedPeer(peerID)
+}
+
+// unarchivePeer stores info on the peer list and marks its latest removal,
+// if any, as restored
+func (a *Agent) unarchivePeer(info peer.AddrInfo) error {
+	return a.DB.Update(func(tx *bolt.Tx) error {
+		peers, err := a.DB.Sealed(tx, persistence.BucketPeers)
+		if err != nil {
+			return err
+		}
+		removed, err := a.DB.Sealed(tx, persistence.BucketRemoved)
+		if err != nil {
+			return err
+		}
+		val, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		if err := peers.Put([]byte(info.ID.String()), val); err != nil {
+			return err
+		}
+
+		v, err := removed.Get([]byte(info.ID.String()))
+		if v == nil || err != nil {
+			return err
+		}
+		var rp RemovedPeer
+		if err := json.Unmarshal(v, &rp); err != nil {
+			return err
+		}
+		if !rp.Archived() {
+			return nil
+		}
+		now := time.Now().UTC()
+		rp.Latest().RestoredAt = &now
+		if val, err = json.Marshal(&rp); err != nil {
+			return err
+		}
+		return removed.Put([]byte(info.ID.String()), val)
+	})
+}
+
+// removedPeer returns the archive entry of a peer, or nil if it has none
+func (a *Agent) removedPeer(peerID string) (*RemovedPeer, error) {
+	var rp *RemovedPeer
+	err := a.DB.View(func(tx *bolt.Tx) error {
+		b, err := a.DB.Sealed(tx, persistence.BucketRemoved)
+		if err != nil {
+			return err
+		}
+		v, err := b.Get([]byte(peerID))
+		if v == nil || err != nil {
+			return err
+		}
+		rp = &RemovedPeer{}
+		return json.Unmarshal(v, rp)
+	})
+	return rp, err
+}
+
+// checkReadd refuses adding back a peer whose latest removal was for abuse
+func (a *Agent) checkReadd(pid peer.ID) error {
+	rp, err := a.removedPeer(pid.String())
+	if err != nil || rp == nil || !rp.Archived() || !rp.Latest().Abuse {
+		return err
+	}
+	return fmt.Errorf("%w (%s) on %s; add it with force",
+		ErrPeerRemovedForAbuse, rp.Latest().Reason, rp.Latest().RemovedAt.Format(time.RFC3339))
+}
+
+// isArchived reports whether a peer is removed and not restored since
+func (a *Agent) isArchived(pid peer.ID) bool {
+	rp, err := a.removedPeer(pid.String())
+	return err == nil && rp != nil && rp.Archived()
+}
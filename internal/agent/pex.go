@@ -0,0 +1,232 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/auth"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/p2p"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/protocol"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// maxPeerListAge rejects replayed or stale peer lists
+	maxPeerListAge = time.Hour
+
+	// pexSettle gives a new connection time to join the topic before we gossip
+	pexSettle = 5 * time.Second
+	// pexMinGap limits how often new connections trigger an extra gossip
+	pexMinGap = time.Minute
+)
+
+// runPeerExchange periodically gossips our known-good peers, and also shortly
+// after new connections so a freshly bootstrapped node learns the swarm.
+func (a *Agent) runPeerExchange(ctx context.Context) {
+	if a.Config.P2P.PEXTrust == "none" {
+		return
+	}
+	logger := monitoring.GetLogger()
+
+	kick := make(chan struct{}, 1)
+	a.P2P.Host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, _ network.Conn) {
+			select {
+			case kick <- struct{}{}:
+			default:
+			}
+		},
+	})
+
+	ticker := time.NewTicker(a.Config.P2P.PEXInterval)
+	defer ticker.Stop()
+
+	var last time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-kick:
+			if time.Since(last) < pexMinGap {
+				continue
+			}
+			select {
+			case <-time.After(pexSettle):
+			case <-ctx.Done():
+				return
+			}
+		}
+		last = time.Now()
+		if err := a.GossipPeerList(); err != nil {
+			logger.WithError(err).Warn("Failed to gossip peer list")
+		}
+	}
+}
+
+// GossipPeerList signs and publishes the addresses of known peers this node
+// is currently connected to.
+func (a *Agent) GossipPeerList() error {
+	addrs, err := a.knownGoodPeers()
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+	pl := &protocol.PeerList{
+		Peers:     addrs,
+		IssuedAt:  time.Now().UTC().Format(time.RFC3339),
+		SignerPub: auth.PubKeyToString(a.SignerPub),
+	}
+	pl.Signature = auth.PubKeyToString(auth.SignPayload(pl.SigningPayload(), a.SignerPriv))
+	return a.publish("peer_list", "peer_list", pl)
+}
+
+// knownGoodPeers returns a dialable address for each stored or bootstrap peer
+// we hold a live, non-quarantined connection to.
+func (a *Agent) knownGoodPeers() ([]string, error) {
+	known := make(map[peer.ID]bool)
+	stored, err := a.StoredPeers()
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range stored {
+		known[info.ID] = true
+	}
+	for _, addr := range a.Config.PeerBootstrap {
+		if info, err := peer.AddrInfoFromString(addr); err == nil {
+			known[info.ID] = true
+		}
+	}
+
+	h := a.P2P.Host
+	var addrs []string
+	for pid := range known {
+		if len(addrs) >= protocol.MaxPeerListEntries {
+			break
+		}
+		if h.Network().Connectedness(pid) != network.Connected || a.P2P.Scorer.IsQuarantined(pid) {
+			continue
+		}
+		addr := dialableAddr(h.Network().ConnsToPeer(pid), h.Peerstore().Addrs(pid))
+		if addr == nil {
+			continue
+		}
+		full, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: pid, Addrs: []ma.Multiaddr{addr}})
+		if err != nil || len(full) == 0 {
+			continue
+		}
+		addrs = append(addrs, full[0].String())
+	}
+	return addrs, nil
+}
+
+// dialableAddr prefers the address of an outbound connection, which is known
+// to work; inbound connections only reveal an ephemeral source port.
+func dialableAddr(conns []network.Conn, stored []ma.Multiaddr) ma.Multiaddr {
+	for _, c := range conns {
+		if c.Stat().Direction == network.DirOutbound {
+			return c.RemoteMultiaddr()
+		}
+	}
+	if len(stored) > 0 {
+		return stored[0]
+	}
+	return nil
+}
+
+func (a *Agent) handlePeerList(envelope map[string]interface{}, from peer.ID) {
+	logger := monitoring.GetLogger()
+
+	trust := a.Config.P2P.PEXTrust
+	if trust == "none" {
+		return
+	}
+
+	var pl protocol.PeerList
+	if err := decodeEnvelope(envelope, "peer_list", &pl); err != nil {
+		logger.WithError(err).Error("Failed to decode peer list")
+		a.penalize(from, p2p.OffenseMalformed)
+		return
+	}
+	if err := pl.Validate(); err != nil {
+		logger.WithError(err).Warn("Invalid peer list")
+		a.penalize(from, p2p.OffenseInvalidSignature)
+		return
+	}
+	if pl.SignerPub == auth.PubKeyToString(a.SignerPub) {
+		return
+	}
+	if trust == "admins" && !a.ACL.IsAdmin(pl.SignerPub) {
+		logger.Debug("Peer list from non-admin, ignoring")
+		return
+	}
+
+	issued, _ := time.Parse(time.RFC3339, pl.IssuedAt)
+	if age := time.Since(issued); age > maxPeerListAge || age < -pexMinGap {
+		logger.Debugf("Peer list issued at %s outside accepted window, ignoring", pl.IssuedAt)
+		return
+	}
+
+	go a.learnPeers(pl.Peers)
+}
+
+// learnPeers dials unknown peers from a trusted list until MaxPeers are
+// connected, storing the ones that answer.
+func (a *Agent) learnPeers(addrs []string) {
+	logger := monitoring.GetLogger()
+	h := a.P2P.Host
+
+	for _, addr := range addrs {
+		if len(h.Network().Peers()) >= a.Config.P2P.MaxPeers {
+			logger.Debugf("Reached max_peers (%d), not dialing further PEX peers", a.Config.P2P.MaxPeers)
+			return
+		}
+		info, err := peer.AddrInfoFromString(addr)
+		if err != nil {
+			logger.WithError(err).Debugf("Skipping invalid PEX address: %s", addr)
+			continue
+		}
+		// Removed peers come back only by hand
+		if info.ID == h.ID() || a.P2P.Scorer.IsQuarantined(info.ID) || a.isArchived(info.ID) ||
+			h.Network().Connectedness(info.ID) == network.Connected {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(a.P2P.Ctx, a.Config.P2P.ConnectionTimeout)
+		err = h.Connect(ctx, *info)
+		cancel()
+		if err != nil {
+			logger.WithError(err).Debugf("Failed to connect to PEX peer: %s", info.ID)
+			continue
+		}
+		logger.Infof("Connected to peer learned via PEX: %s", info.ID)
+		monitoring.GetMetrics().RecordPeerConnected()
+		monitoring.GetMetrics().RecordPeerDiscovered()
+
+		err = a.DB.Update(func(tx *bolt.Tx) error {
+			b, err := a.DB.Sealed(tx, persistence.BucketPeers)
+			if err != nil {
+				return err
+			}
+			if v, err := b.Get([]byte(info.ID.String())); v != nil || err != nil {
+				return err
+			}
+			val, err := json.Marshal(info)
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(info.ID.String()), val)
+		})
+		if err != nil {
+			logger.WithError(err).Warn("Failed to store PEX peer")
+		}
+	}
+}
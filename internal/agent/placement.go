@@ -0,0 +1,304 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// ErrPlacementForbidden is returned when pushing to a peer whose labels
+	// the repository's placement policy forbids
+	ErrPlacementForbidden = errors.New("placement policy forbids peer")
+	// ErrPlacementUnsatisfiable is returned when no offering peer can meet a
+	// placement requirement that is still short of copies
+	ErrPlacementUnsatisfiable = errors.New("placement policy cannot be satisfied")
+)
+
+// placementRecord lists the peers a snapshot was pushed to, placed or by hand
+type placementRecord struct {
+	SnapshotID string               `json:"snapshot_id"`
+	Peers      map[string]time.Time `json:"peers"` // peer ID -> last pushed
+}
+
+// PlacementCopy is a peer holding a copy of a snapshot.
+type PlacementCopy struct {
+	PeerID string    `json:"peer_id"`
+	Labels []string  `json:"labels,omitempty"`
+	Placed time.Time `json:"placed"`
+}
+
+// PlacementStatus measures the copies of one snapshot against the placement
+// policy of its repository.
+type PlacementStatus struct {
+	SnapshotID string          `json:"snapshot_id"`
+	Copies     []PlacementCopy `json:"copies"`
+	Unmet      []string        `json:"unmet,omitempty"`     // requirements short of copies, as "label (n more)"
+	Forbidden  []string        `json:"forbidden,omitempty"` // peers holding a copy the policy forbids
+}
+
+// Satisfied reports whether the snapshot's copies meet its policy.
+func (s *PlacementStatus) Satisfied() bool {
+	return len(s.Unmet) == 0 && len(s.Forbidden) == 0
+}
+
+// placementPolicy merges every configured policy matching one repository
+type placementPolicy struct {
+	require map[string]int // label -> minimum copies
+	forbid  map[string]bool
+}
+
+func (a *Agent) placementPolicy(repoID string) *placementPolicy {
+	pol := &placementPolicy{require: make(map[string]int), forbid: make(map[string]bool)}
+	for _, p := range a.Config.Placement.Policies {
+		if p.RepositoryID != "" && p.RepositoryID != repoID {
+			continue
+		}
+		for _, r := range p.Require {
+			if r.Min > pol.require[r.Label] {
+				pol.require[r.Label] = r.Min
+			}
+		}
+		for _, l := range p.Forbid {
+			pol.forbid[l] = true
+		}
+	}
+	return pol
+}
+
+// allows reports whether a peer with labels may hold a copy
+func (p *placementPolicy) allows(labels []string) bool {
+	for _, l := range labels {
+		if p.forbid[l] {
+			return false
+		}
+	}
+	return true
+}
+
+// missing returns how many more copies each requirement needs, given the
+// labels of the peers already holding one
+func (p *placementPolicy) missing(held [][]string) map[string]int {
+	out := make(map[string]int)
+	for label, min := range p.require {
+		have := 0
+		for _, labels := range held {
+			if hasLabel(labels, label) {
+				have++
+			}
+		}
+		if have < min {
+			out[label] = min - have
+		}
+	}
+	return out
+}
+
+func hasLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// peerLabels returns the configured location labels of a peer
+func (a *Agent) peerLabels(pid peer.ID) []string {
+	return a.Config.Placement.Labels[pid.String()]
+}
+
+// checkPlacement refuses a peer the placement policy of repoID forbids
+func (a *Agent) checkPlacement(repoID string, pid peer.ID) error {
+	labels := a.peerLabels(pid)
+	if a.placementPolicy(repoID).allows(labels) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is labelled %s", ErrPlacementForbidden, pid, strings.Join(labels, ", "))
+}
+
+// PlacementReport measures every snapshot of our own repository against its
+// placement policy, counting copies on mirrors and placed or manual pushes.
+func (a *Agent) PlacementReport() ([]*PlacementStatus, error) {
+	own, err := a.ownSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	copies, err := a.snapshotCopies()
+	if err != nil {
+		return nil, err
+	}
+	pol := a.placementPolicy(a.RepoID)
+
+	out := make([]*PlacementStatus, 0, len(own))
+	for _, snap := range own {
+		st := &PlacementStatus{SnapshotID: snap.ID}
+		var held [][]string
+		for pid, at := range copies[snap.ID] {
+			labels := a.peerLabels(pid)
+			st.Copies = append(st.Copies, PlacementCopy{PeerID: pid.String(), Labels: labels, Placed: at})
+			held = append(held, labels)
+			if !pol.allows(labels) {
+				st.Forbidden = append(st.Forbidden, pid.String())
+			}
+		}
+		sort.Slice(st.Copies, func(i, j int) bool { return st.Copies[i].PeerID < st.Copies[j].PeerID })
+		sort.Strings(st.Forbidden)
+		for label, n := range pol.missing(held) {
+			st.Unmet = append(st.Unmet, fmt.Sprintf("%s (%d more)", label, n))
+		}
+		sort.Strings(st.Unmet)
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+// snapshotCopies returns, per snapshot ID, the peers holding a copy and when
+// it was last pushed or confirmed there
+func (a *Agent) snapshotCopies() (map[string]map[peer.ID]time.Time, error) {
+	out := make(map[string]map[peer.ID]time.Time)
+	add := func(snapID string, pid peer.ID, at time.Time) {
+		if out[snapID] == nil {
+			out[snapID] = make(map[peer.ID]time.Time)
+		}
+		if at.After(out[snapID][pid]) {
+			out[snapID][pid] = at
+		}
+	}
+
+	err := a.DB.View(func(tx *bolt.Tx) error {
+		b, err := a.DB.Sealed(tx, persistence.BucketPlacements)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var rec placementRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return nil
+			}
+			for id, at := range rec.Peers {
+				if pid, err := peer.Decode(id); err == nil {
+					add(rec.SnapshotID, pid, at)
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mirrors, err := a.MirrorStatuses()
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range mirrors {
+		pid, err := peer.Decode(st.PeerID)
+		if err != nil {
+			continue
+		}
+		for snapID, at := range st.Replicated {
+			add(snapID, pid, at)
+		}
+	}
+	return out, nil
+}
+
+// recordPlacement notes that pid now holds a copy of a snapshot
+func (a *Agent) recordPlacement(snapID string, pid peer.ID) error {
+	return a.DB.Update(func(tx *bolt.Tx) error {
+		b, err := a.DB.Sealed(tx, persistence.BucketPlacements)
+		if err != nil {
+			return err
+		}
+		rec := placementRecord{SnapshotID: snapID}
+		if v, err := b.Get([]byte(snapID)); err != nil {
+			return err
+		} else if v != nil {
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+		}
+		if rec.Peers == nil {
+			rec.Peers = make(map[string]time.Time)
+		}
+		rec.Peers[pid.String()] = time.Now().UTC()
+
+		val, err := json.Marshal(&rec)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(snapID), val)
+	})
+}
+
+// prunePlacements forgets the copies of snapshots deleted locally
+func (a *Agent) prunePlacements() error {
+	all, err := versioning.ListAllSnapshots(a.DB)
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool, len(all))
+	for _, snap := range all {
+		exists[snap.ID] = true
+	}
+	return a.DB.Update(func(tx *bolt.Tx) error {
+		b, err := a.DB.Sealed(tx, persistence.BucketPlacements)
+		if err != nil {
+			return err
+		}
+		var stale []string
+		err = b.ForEach(func(k, v []byte) error {
+			var rec placementRecord
+			if json.Unmarshal(v, &rec) == nil && !exists[rec.SnapshotID] {
+				stale = append(stale, rec.SnapshotID)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range stale {
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// updatePlacementHealth publishes how many snapshots violate their policy
+func (a *Agent) updatePlacementHealth() {
+	if err := a.prunePlacements(); err != nil {
+		monitoring.GetLogger().WithError(err).Warn("Failed to prune placement records")
+	}
+	report, err := a.PlacementReport()
+	if err != nil {
+		return
+	}
+	var unsatisfied []string
+	for _, st := range report {
+		if !st.Satisfied() {
+			unsatisfied = append(unsatisfied, st.SnapshotID)
+		}
+	}
+
+	status, msg := monitoring.StatusHealthy, ""
+	if len(unsatisfied) > 0 {
+		status = monitoring.StatusDegraded
+		msg = fmt.Sprintf("%d snapshot(s) do not meet their placement policy", len(unsatisfied))
+	}
+	monitoring.GetHealthChecker().UpdateComponent("placement", status, msg, map[string]interface{}{
+		"snapshots":   len(report),
+		"unsatisfied": unsatisfied,
+	})
+}
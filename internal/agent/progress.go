@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/progress"
+)
+
+// trackProgress returns ctx carrying a progress tracker, the caller's when
+// ctx already has one, and logs what it counts as msg every
+// monitoring.progress_interval until stop is called.
+func (a *Agent) trackProgress(ctx context.Context, msg string, fields map[string]interface{}) (context.Context, *progress.Tracker, func()) {
+	t := progress.From(ctx)
+	if t == nil {
+		t = progress.New()
+		ctx = progress.With(ctx, t)
+	}
+	logger := monitoring.LoggerFor(ctx).WithFields(fields)
+	stop := t.Watch(a.Config.Monitoring.ProgressInterval, func(r *progress.Report) {
+		logger.WithFields(progressFields(r)).Info(msg)
+	})
+	return ctx, t, stop
+}
+
+// progressFields are the log fields of a progress report
+func progressFields(r *progress.Report) map[string]interface{} {
+	fields := map[string]interface{}{
+		"bytes":   r.Bytes,
+		"chunks":  r.Done,
+		"rate":    int64(r.Rate),
+		"elapsed": r.Elapsed.Round(time.Second).Seconds(),
+		"new":     r.NewBytes,
+		"deduped": r.DedupBytes,
+		"files":   r.Files,
+	}
+	if pct := r.Percent(); pct >= 0 {
+		fields["percent"] = int(pct)
+	}
+	if r.ETA > 0 {
+		fields["eta"] = r.ETA.Round(time.Second).Seconds()
+	}
+	if r.Current != "" {
+		fields["current"] = r.Current
+	}
+	return fields
+}
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hoangsonww/backupagent/internal/auth"
+	"github.com/hoangsonww/backupagent/internal/p2p"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// ErrPullNotAuthorized is returned to peers that may not pull snapshots
+	ErrPullNotAuthorized = errors.New("only admins and stored or pinned peers may pull snapshots")
+	// ErrUntrustedSigner is returned for pulled snapshots signed by an unknown key
+	ErrUntrustedSigner = errors.New("snapshot signer is not trusted")
+)
+
+// PullSnapshot makes snapshotID available locally, fetching its manifest and
+// any missing chunks from the peer named by from. The manifest must belong to
+// this repository and be signed by this node, an admin, or a key in
+// trustedSigners. A snapshot already complete locally is returned as is.
+func (a *Agent) PullSnapshot(ctx context.Context, snapshotID, from string, trustedSigners []string, progress p2p.PushProgress) (*versioning.Snapshot, error) {
+	if snap, err := versioning.LoadSnapshot(a.DB, snapshotID); err == nil && a.hasAllChunks(snap) {
+		return snap, nil
+	}
+
+	trust := func(snap *versioning.Snapshot) error {
+		if err := versioning.CheckRepository(snap, a.RepoID); err != nil {
+			return err
+		}
+		if snap.SignerPub == auth.PubKeyToString(a.SignerPub) || a.ACL.IsAdmin(snap.SignerPub) {
+			return nil
+		}
+		for _, k := range trustedSigners {
+			if k == snap.SignerPub {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s", ErrUntrustedSigner, snap.SignerPub)
+	}
+
+	pid, err := a.ConnectPeer(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p2p.PullSnapshot(ctx, a.P2P.Host, pid, a.DB, a.Store, snapshotID, a.RepoID, trust, progress)
+	if err != nil {
+		return nil, err
+	}
+	// The holder served every chunk we lacked
+	a.P2P.Locations.Record(pid, res.Snapshot.Chunks...)
+	return res.Snapshot, nil
+}
+
+func (a *Agent) hasAllChunks(snap *versioning.Snapshot) bool {
+	for _, h := range snap.Chunks {
+		if !a.Store.Exists(h) {
+			return false
+		}
+	}
+	return true
+}
+
+// authorizePull serves snapshots to admins and to peers the operator added
+// or pinned, since manifests reveal backed-up paths and file layout.
+func (a *Agent) authorizePull(from peer.ID) error {
+	pub, err := from.ExtractPublicKey()
+	if err != nil {
+		return err
+	}
+	raw, err := pub.Raw()
+	if err != nil {
+		return err
+	}
+	if a.ACL.IsAdmin(auth.PubKeyToString(raw)) || a.P2P.Pins.IsPinned(from) {
+		return nil
+	}
+	known := false
+	err = a.DB.View(func(tx *bolt.Tx) error {
+		b, err := a.DB.Sealed(tx, persistence.BucketPeers)
+		if err != nil {
+			return err
+		}
+		v, err := b.Get([]byte(from.String()))
+		known = v != nil
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !known {
+		return ErrPullNotAuthorized
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"context"
+	"errors"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/p2p"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ErrPushNotAuthorized is returned to peers pushing snapshots they may not
+var ErrPushNotAuthorized = errors.New("only the snapshot signer or an admin may push it")
+
+// ErrCacheNode is returned to peers pushing snapshots to a cache node
+var ErrCacheNode = errors.New("cache nodes hold no copies of snapshots")
+
+// maxPlacementCandidates bounds the offering peers a placed push tries
+const maxPlacementCandidates = 3
+
+// PushSnapshot proactively replicates a stored snapshot and its missing
+// chunks to the peer named by to (a stored peer ID or multiaddr). With to
+// empty, the snapshot goes to the reachable peer whose storage offer has the
+// most room for it among those its placement policy allows.
+func (a *Agent) PushSnapshot(ctx context.Context, snapshotID, to string, progress p2p.PushProgress) (*p2p.PushResult, error) {
+	snap, err := versioning.LoadSnapshot(a.DB, snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	if to == "" {
+		return a.pushPlaced(ctx, snap, progress)
+	}
+	pid, err := a.ConnectPeer(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkPlacement(snap.RepoID, pid); err != nil {
+		return nil, err
+	}
+	return a.pushRecorded(ctx, pid, snap, progress)
+}
+
+// pushPlaced pushes snap to the first peer chosen by PlaceReplicas that we
+// can connect to
+func (a *Agent) pushPlaced(ctx context.Context, snap *versioning.Snapshot, progress p2p.PushProgress) (*p2p.PushResult, error) {
+	size, err := a.Store.Size(snap.Chunks)
+	if err != nil {
+		return nil, err
+	}
+	copies, err := a.snapshotCopies()
+	if err != nil {
+		return nil, err
+	}
+	pids, err := a.PlaceReplicas(snap.RepoID, size, maxPlacementCandidates, copies[snap.ID])
+	if err != nil {
+		if errors.Is(err, ErrPlacementUnsatisfiable) {
+			a.updatePlacementHealth()
+		}
+		return nil, err
+	}
+	var errs []error
+	for _, pid := range pids {
+		if _, err := a.ConnectPeer(ctx, pid.String()); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return a.pushRecorded(ctx, pid, snap, progress)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// pushRecorded pushes snap to pid and records the copy for placement
+func (a *Agent) pushRecorded(ctx context.Context, pid peer.ID, snap *versioning.Snapshot, progress p2p.PushProgress) (*p2p.PushResult, error) {
+	res, err := p2p.PushSnapshot(ctx, a.P2P.Host, pid, a.Store, snap, progress)
+	if err != nil {
+		return res, err
+	}
+	if err := a.recordPlacement(snap.ID, pid); err != nil {
+		monitoring.GetLogger().WithError(err).Warnf("Failed to record placement of snapshot %s", snap.ID)
+	}
+	a.P2P.Locations.Record(pid, snap.Chunks...)
+	a.updatePlacementHealth()
+	return res, nil
+}
+
+// authorizePush accepts pushes of snapshots signed by the pushing peer's own
+// identity or by an admin, since pushed chunks cannot be checked against
+// their plaintext hash without the repository key. A cache node takes none.
+func (a *Agent) authorizePush(from peer.ID, snap *versioning.Snapshot) error {
+	if a.Config.Cache.Enabled {
+		return ErrCacheNode
+	}
+	if a.ACL.IsAdmin(snap.SignerPub) {
+		return nil
+	}
+	pub, err := peerSignerPub(from)
+	if err != nil {
+		return err
+	}
+	if pub != snap.SignerPub {
+		return ErrPushNotAuthorized
+	}
+	return nil
+}
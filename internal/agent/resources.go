@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hoangsonww/backupagent/config"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/ratelimit"
+)
+
+// resourceHeadroom is the share of every limit usage must drop under before
+// work held back resumes, so the agent does not flap at a limit
+const resourceHeadroom = 0.9
+
+// resourceGuard tracks whether the agent is over its soft resource limits,
+// and lets work wait until it is back within them.
+type resourceGuard struct {
+	limiter *ratelimit.ResourceLimiter
+
+	mu    sync.Mutex
+	over  []string      // limits exceeded; nil while within them
+	clear chan struct{} // closed once usage is back within the limits
+}
+
+func newResourceGuard(cfg config.ResourcesConfig) *resourceGuard {
+	return &resourceGuard{limiter: ratelimit.NewResourceLimiter(cfg.MaxMemoryMB, 0, cfg.MaxGoroutines)}
+}
+
+// exceeded returns the limits usage was over at the last check, nil if none
+func (g *resourceGuard) exceeded() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.over
+}
+
+// update records measured usage and reports whether it just went over a
+// limit or, with headroom, back within them all
+func (g *resourceGuard) update(memory int64, goroutines int) (tripped, cleared bool) {
+	g.limiter.Observe(memory, goroutines)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.over == nil {
+		if g.over = g.limiter.Exceeded(); g.over != nil {
+			g.clear = make(chan struct{})
+			return true, false
+		}
+		return false, false
+	}
+	if !g.limiter.Within(resourceHeadroom) {
+		// Still over; name every limit it is over now
+		if over := g.limiter.Exceeded(); over != nil {
+			g.over = over
+		}
+		return false, false
+	}
+	g.over = nil
+	close(g.clear)
+	return false, true
+}
+
+// wait returns once usage is within the limits, holding back job until then
+func (g *resourceGuard) wait(ctx context.Context, job string) error {
+	g.mu.Lock()
+	over, clear := g.over, g.clear
+	g.mu.Unlock()
+	if over == nil {
+		return nil
+	}
+	monitoring.GetMetrics().JobsDeferred.Add(1)
+	monitoring.LoggerFor(ctx).WithField("limits", over).Warnf("Deferring %s until resource use drops", job)
+	select {
+	case <-clear:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runResourceGuard samples the agent's memory, goroutines and metadata DB
+// every resources.check_interval until ctx ends, publishing them as metrics
+// and shedding load while a soft limit is exceeded.
+func (a *Agent) runResourceGuard(ctx context.Context) {
+	cfg := a.Config.Resources
+	ticker := time.NewTicker(cfg.CheckInterval)
+	defer ticker.Stop()
+
+	notifier := monitoring.NewNotifier(cfg.WebhookURL)
+	for {
+		a.checkResources(ctx, notifier)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkResources publishes resource metrics and health. Going over a limit
+// stops serving chunk requests and starting queued operations; coming back
+// within them resumes both. Either is logged and notified.
+func (a *Agent) checkResources(ctx context.Context, notifier *monitoring.Notifier) {
+	logger := monitoring.GetLogger()
+	metrics := monitoring.GetMetrics()
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	held := int64(ms.Sys - ms.HeapReleased)
+	goroutines := runtime.NumGoroutine()
+	metrics.MemoryHeapBytes.Store(int64(ms.HeapAlloc))
+	metrics.MemoryHeldBytes.Store(held)
+	metrics.Goroutines.Store(int64(goroutines))
+	metrics.GCCycles.Store(uint64(ms.NumGC))
+	metrics.GCPauseNanos.Store(ms.PauseTotalNs)
+	if st, err := a.DB.Stats(); err != nil {
+		logger.WithError(err).Debug("Failed to read metadata DB stats")
+	} else {
+		metrics.DBSizeBytes.Store(st.Size)
+		metrics.DBOpenTxs.Store(int64(st.OpenTxs))
+		metrics.DBTxs.Store(uint64(st.Txs))
+		metrics.DBFreePages.Store(int64(st.FreePages))
+	}
+
+	cfg := a.Config.Resources
+	fields := map[string]interface{}{
+		"memory_mb":      held >> 20,
+		"max_memory_mb":  cfg.MaxMemoryMB,
+		"goroutines":     goroutines,
+		"max_goroutines": cfg.MaxGoroutines,
+	}
+	tripped, cleared := a.resources.update(held, goroutines)
+	over := a.resources.exceeded()
+
+	status, msg := monitoring.StatusHealthy, ""
+	if over != nil {
+		status = monitoring.StatusDegraded
+		msg = fmt.Sprintf("over the %s limit; shedding chunk requests and deferring jobs", strings.Join(over, " and "))
+	}
+	monitoring.GetHealthChecker().UpdateComponent("resources", status, msg, fields)
+	if !tripped && !cleared {
+		return
+	}
+
+	a.P2P.ChunkFetcher.Shed(tripped)
+	a.admission.hold(tripped)
+	note := monitoring.Notification{Details: fields}
+	if tripped {
+		metrics.ResourcesOverLimit.Store(1)
+		note.Event = "resources_exceeded"
+		note.Message = "Agent " + msg
+		logger.WithFields(fields).Errorf("Resource limit exceeded (%s); shedding chunk requests and deferring jobs", strings.Join(over, ", "))
+	} else {
+		metrics.ResourcesOverLimit.Store(0)
+		note.Event = "resources_recovered"
+		note.Message = "Agent resource use is back within its limits"
+		logger.WithFields(fields).Info("Resource use back within limits; resuming chunk requests and jobs")
+	}
+	if err := notifier.Notify(ctx, note); err != nil {
+		logger.WithError(err).Warn("Failed to send resource notification")
+	}
+}
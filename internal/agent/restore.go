@@ -0,0 +1,327 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/fspath"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/progress"
+	"github.com/hoangsonww/backupagent/internal/snapshots"
+	"github.com/hoangsonww/backupagent/internal/storage"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// RestoreSnapshot writes the decrypted content of snap into target and
+// returns the path of what was restored: the source directory rebuilt as
+// target itself, a single-file source under its own name in target, or for
+// snapshots without a file manifest one file holding every chunk. A non-nil
+// th limits its rate and priority; owners maps the recorded owners, nil
+// leaves everything to the restoring user; scan, from RestoreScanner, passes
+// each file before it is moved into place, nil none. The chunks restored
+// are counted by the progress tracker of ctx, and logged.
+func (a *Agent) RestoreSnapshot(ctx context.Context, snap *versioning.Snapshot, target string, th *Throttle, owners *snapshots.Owners, scan *snapshots.Scanner) (string, error) {
+	ctx, tracker, stop := a.trackProgress(ctx, "Restore progress", map[string]interface{}{"snapshot_id": snap.ID})
+	defer stop()
+	var output string
+	// Chunks are read on the calling thread, which run niced alone
+	err := th.run(func() error {
+		var err error
+		output, err = a.restore(ctx, snap, target, th, owners, scan, tracker.Chunks(len(snap.Chunks)))
+		return err
+	})
+	return output, err
+}
+
+// restore runs restoreSnapshot and records its outcome in the metrics
+func (a *Agent) restore(ctx context.Context, snap *versioning.Snapshot, target string, th *Throttle, owners *snapshots.Owners, scan *snapshots.Scanner, onChunk func(n int)) (string, error) {
+	start := time.Now()
+	output, bytes, err := a.restoreSnapshot(ctx, snap, target, th, owners, scan, onChunk)
+	if err != nil {
+		monitoring.GetMetrics().RecordRestoreFailed()
+		return "", err
+	}
+	monitoring.GetMetrics().RecordRestoreCompleted(bytes, time.Since(start))
+	return output, nil
+}
+
+func (a *Agent) restoreSnapshot(ctx context.Context, snap *versioning.Snapshot, target string, th *Throttle, owners *snapshots.Owners, scan *snapshots.Scanner, onChunk func(n int)) (string, uint64, error) {
+	if err := versioning.CheckRepository(snap, a.RepoID); err != nil {
+		return "", 0, err
+	}
+	target, err := fspath.Resolve(target)
+	if err != nil {
+		return "", 0, err
+	}
+	files, err := snap.Files()
+	if err != nil {
+		return "", 0, err
+	}
+	if files != nil {
+		tw, err := snapshots.NewTreeWriter(snap, target, owners)
+		if err != nil {
+			return "", 0, err
+		}
+		tw.SetScanner(scan)
+		bytes, err := a.copyChunks(ctx, snap.Chunks, tw, th, onChunk)
+		if cerr := tw.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		return tw.Root(), bytes, nil
+	}
+
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return "", 0, err
+	}
+	output := filepath.Join(target, fmt.Sprintf("restored_%s.bin", snap.ID))
+	f, err := os.Create(output)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	bytes, err := a.copyChunks(ctx, snap.Chunks, f, th, onChunk)
+	if err != nil {
+		return "", 0, err
+	}
+	return output, bytes, f.Close()
+}
+
+// RestoreScanner returns the scanner restore.scan_command sets up, nil when
+// restored files are not scanned. Its report covers every restore it is
+// passed to.
+func (a *Agent) RestoreScanner() *snapshots.Scanner {
+	cfg := a.Config.Restore
+	if cfg.ScanCommand == "" {
+		return nil
+	}
+	dir := cfg.QuarantineDir
+	if dir == "" {
+		dir = filepath.Join(a.Config.RepositoryPath, "quarantine")
+	}
+	return snapshots.NewScanner(cfg.ScanCommand, cfg.ScanTimeout, dir)
+}
+
+// copyChunks writes the decrypted content of the chunks hashes to w and
+// returns how many bytes it wrote
+func (a *Agent) copyChunks(ctx context.Context, hashes []string, w io.Writer, th *Throttle, onChunk func(n int)) (uint64, error) {
+	var bytes uint64
+	opts := storage.ReadOptions{
+		Readahead: a.Config.Storage.RestoreReadahead,
+		Prewarm:   a.Config.Storage.RestorePrewarm,
+	}
+	err := a.Store.ReadChunks(hashes, opts, func(_ string, data []byte) error {
+		if err := th.wait(ctx, len(data)); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		bytes += uint64(len(data))
+		if onChunk != nil {
+			onChunk(len(data))
+		}
+		return nil
+	})
+	return bytes, err
+}
+
+// RestoreFile writes the file at name in snap, slash-separated and relative
+// to its source, to target and returns the path written: target itself, or
+// the file under its own name when target is a directory. Only the chunks of
+// that file are read; a symlink is restored as one. th, owners, scan and
+// progress are as for RestoreSnapshot.
+func (a *Agent) RestoreFile(ctx context.Context, snap *versioning.Snapshot, name, target string, th *Throttle, owners *snapshots.Owners, scan *snapshots.Scanner) (string, error) {
+	var output string
+	err := th.run(func() error {
+		start := time.Now()
+		var bytes uint64
+		var err error
+		output, bytes, err = a.restoreFile(ctx, snap, name, target, th, owners, scan)
+		if err != nil {
+			monitoring.GetMetrics().RecordRestoreFailed()
+			return err
+		}
+		monitoring.GetMetrics().RecordRestoreCompleted(bytes, time.Since(start))
+		return nil
+	})
+	return output, err
+}
+
+func (a *Agent) restoreFile(ctx context.Context, snap *versioning.Snapshot, name, target string, th *Throttle, owners *snapshots.Owners, scan *snapshots.Scanner) (string, uint64, error) {
+	if err := versioning.CheckRepository(snap, a.RepoID); err != nil {
+		return "", 0, err
+	}
+	e, err := snap.File(name)
+	if err != nil {
+		return "", 0, err
+	}
+	if e.IsDir() {
+		return "", 0, fmt.Errorf("%q is a directory of snapshot %s, restore the snapshot instead", name, snap.ID)
+	}
+	target, err = fspath.Resolve(target)
+	if err != nil {
+		return "", 0, err
+	}
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		target = filepath.Join(target, fileName(snap, e))
+	} else if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", 0, err
+	}
+
+	if e.IsSymlink() {
+		return target, 0, snapshots.CreateLink(target, e, owners)
+	}
+	f, err := snapshots.CreateFile(target, e, owners, scan)
+	if err != nil {
+		return "", 0, err
+	}
+	span := snap.Span(e)
+	bytes, err := a.copyChunks(ctx, span, f, th, progress.From(ctx).Chunks(len(span)))
+	if err != nil {
+		f.Abort()
+		return "", 0, err
+	}
+	return target, bytes, f.Close()
+}
+
+// ExportArchive writes snap to w as an archive in one of
+// snapshots.ArchiveFormats, limited to paths if any are given, and returns
+// how many entries and bytes of content it wrote. Only the chunks of the
+// selected files are read.
+func (a *Agent) ExportArchive(ctx context.Context, snap *versioning.Snapshot, w io.Writer, format string, paths []string) (int, uint64, error) {
+	if err := versioning.CheckRepository(snap, a.RepoID); err != nil {
+		return 0, 0, err
+	}
+	aw, err := snapshots.NewArchiveWriter(w, format, snap, paths)
+	if err != nil {
+		return 0, 0, err
+	}
+	start := time.Now()
+	bytes, err := a.copyChunks(ctx, aw.Chunks(), aw, nil, progress.From(ctx).Chunks(len(aw.Chunks())))
+	if err == nil {
+		err = aw.Close()
+	}
+	if err != nil {
+		monitoring.GetMetrics().RecordRestoreFailed()
+		return 0, 0, err
+	}
+	monitoring.GetMetrics().RecordRestoreCompleted(bytes, time.Since(start))
+	return aw.Files(), bytes, nil
+}
+
+// ArchiveResult is what ExportArchiveTo wrote.
+type ArchiveResult struct {
+	SnapshotID string `json:"snapshot_id"`
+	Format     string `json:"format"`
+	Target     string `json:"target"` // the file written, or stdout
+	Files      int    `json:"files"`  // entries written, directories included
+	Bytes      uint64 `json:"bytes"`  // of file content
+}
+
+// String is the summary printed after an export.
+func (r *ArchiveResult) String() string {
+	mib := float64(r.Bytes) / (1 << 20)
+	if r.Target == "stdout" {
+		return fmt.Sprintf("Wrote snapshot %s as %s: %d entries, %.1f MiB", r.SnapshotID, r.Format, r.Files, mib)
+	}
+	return fmt.Sprintf("Wrote snapshot %s to %s (%s): %d entries, %.1f MiB", r.SnapshotID, r.Target, r.Format, r.Files, mib)
+}
+
+// StreamsArchive reports whether an archive exported to out goes to
+// stdout, that is whether out is empty or "-". Nothing else may be written
+// there then, logs included.
+func StreamsArchive(out string) bool {
+	return out == "" || out == "-"
+}
+
+// ExportArchiveTo writes the snapshot id as ExportArchive does, to the file
+// out or, when StreamsArchive(out), to stdout, with the logger moved to
+// stderr. An empty format is the one the extension of out names, else tar.
+// The file of a failed export is removed.
+func (a *Agent) ExportArchiveTo(ctx context.Context, id, out, format string, paths []string) (*ArchiveResult, error) {
+	toStdout := StreamsArchive(out)
+	if format == "" && !toStdout {
+		format = snapshots.ArchiveFormatOf(out)
+	}
+	if format == "" {
+		format = snapshots.ArchiveTar
+	}
+	snap, err := versioning.LoadSnapshot(a.DB, id)
+	if err != nil {
+		return nil, err
+	}
+	res := &ArchiveResult{SnapshotID: snap.ID, Format: format, Target: "stdout"}
+	if toStdout {
+		monitoring.GetLogger().SetOutput(os.Stderr)
+		res.Files, res.Bytes, err = a.ExportArchive(ctx, snap, os.Stdout, format, paths)
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return nil, err
+	}
+	res.Target = out
+	res.Files, res.Bytes, err = a.ExportArchive(ctx, snap, f, format, paths)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out)
+		return nil, err
+	}
+	return res, nil
+}
+
+// fileName returns the name a restored file of snap is given in a directory
+func fileName(snap *versioning.Snapshot, e *versioning.FileEntry) string {
+	p := e.Path
+	if e.Path == versioning.SourcePath {
+		p = filepath.ToSlash(snap.OriginalSource())
+	} else if e.Original != "" {
+		if orig, err := fspath.DecodeOriginal(e.Original); err == nil {
+			p = orig
+		}
+	}
+	if name := path.Base(p); name != "." && name != "/" && name != "" {
+		return name
+	}
+	return fmt.Sprintf("restored_%s.bin", snap.ID)
+}
+
+// FileVersion is one file as a snapshot along a parent chain recorded it.
+type FileVersion struct {
+	Snapshot *versioning.Snapshot
+	Entry    *versioning.FileEntry // nil where the snapshot lacks the file or a manifest
+}
+
+// FileHistory walks the parent chain of snap and returns, newest first, how
+// each snapshot recorded the file at name, slash-separated and relative to
+// the source.
+func (a *Agent) FileHistory(snap *versioning.Snapshot, name string) ([]FileVersion, error) {
+	chain, err := versioning.ParentChain(a.DB, snap)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]FileVersion, 0, len(chain))
+	for _, s := range chain {
+		e, err := s.File(name)
+		if err != nil && !errors.Is(err, versioning.ErrFileNotInSnapshot) {
+			return nil, err
+		}
+		out = append(out, FileVersion{Snapshot: s, Entry: e})
+	}
+	return out, nil
+}
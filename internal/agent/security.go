@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/chunkindex"
+	"github.com/hoangsonww/backupagent/internal/identity"
+	"github.com/hoangsonww/backupagent/internal/security"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	libp2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	bolt "go.etcd.io/bbolt"
+)
+
+// SecurityReport inventories the cryptography and access control in effect
+// for the repository and checks it against the named built-in profile.
+func (a *Agent) SecurityReport(profile string) (*security.Report, error) {
+	p, ok := security.Profiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown security profile %q (must be one of %s)", profile, strings.Join(security.ProfileNames(), ", "))
+	}
+	st, err := a.securityState()
+	if err != nil {
+		return nil, err
+	}
+	return security.Generate(a.Config, st, p, time.Now()), nil
+}
+
+// securityState collects what the security report reads from the repository
+func (a *Agent) securityState() (*security.State, error) {
+	st := &security.State{
+		RepoID:  a.RepoID,
+		Admins:  a.ACL.ActiveAdmins(),
+		Revoked: a.ACL.Revocations(),
+	}
+	salt, err := a.DB.KeySalt()
+	if err != nil {
+		return nil, err
+	}
+	st.SaltSize = len(salt)
+	if st.StateSealed, err = a.DB.StateSealed(); err != nil {
+		return nil, err
+	}
+	err = a.DB.View(func(tx *bolt.Tx) error {
+		return chunkindex.ForEach(tx, func(_ string, e chunkindex.Entry) error {
+			if e.Stored() {
+				st.Chunks++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	all, err := versioning.ListAllSnapshots(a.DB)
+	if err != nil {
+		return nil, err
+	}
+	for _, snap := range all {
+		if snap.RepoID != a.RepoID && snap.RepoID != "" {
+			continue
+		}
+		if t := snap.Timestamp.Time(); !t.IsZero() && (st.KeySince.IsZero() || t.Before(st.KeySince)) {
+			st.KeySince = t
+		}
+	}
+	dicts, err := a.Store.Dicts()
+	if err != nil {
+		return nil, err
+	}
+	st.Dicts = len(dicts)
+
+	path := identity.KeyPath(a.Config.RepositoryPath)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	st.IdentitySince = info.ModTime()
+	// Windows has no permission bits; ACLs guard the file there
+	if runtime.GOOS != "windows" {
+		st.IdentityMode = info.Mode()
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := libp2pcrypto.UnmarshalPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("identity key: %w", err)
+	}
+	st.IdentityKey = key.Type().String()
+	return st, nil
+}
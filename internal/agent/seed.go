@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"context"
+
+	"github.com/hoangsonww/backupagent/internal/fspath"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/scheduler"
+	"github.com/hoangsonww/backupagent/internal/snapshots"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// Seed runs or resumes the throttled first backup of path and, once every
+// file is stored, announces the snapshot like CreateAndSaveSnapshot does,
+// returning it along with any *snapshots.SkippedError.
+func (a *Agent) Seed(ctx context.Context, path string, progress func(*snapshots.SeedProgress)) (*versioning.Snapshot, error) {
+	logger := monitoring.GetLogger().WithField("path", path)
+
+	window, err := scheduler.ParseActiveWindow(a.Config.Seeding.ActiveHours)
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := a.Store.BeginWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	snap, err := snapshots.Seed(ctx, a.DB, a.Store, path, snapshots.SeedOptions{
+		Window:         window,
+		MaxReadRate:    a.Config.Seeding.MaxReadRate,
+		Chunking:       a.Chunking,
+		OnError:        a.Config.Snapshot.OnError,
+		Excludes:       a.Excludes,
+		Policy:         a.Policy,
+		RepoID:         a.RepoID,
+		Seal:           a.metaSealer(),
+		SignerPub:      a.SignerPub,
+		SignerPriv:     a.SignerPriv,
+		OnProgress:     progress,
+		PostProcessors: &a.PostProcessors,
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.WithError(err).Error("Seeding failed; rerun to resume from the last checkpoint")
+			monitoring.GetMetrics().RecordBackupFailed()
+		}
+		return nil, err
+	}
+	a.uploadSnapshot(ctx, snap)
+	if seed, err := snapshots.LoadSeed(a.DB, snap.OriginalSource()); err == nil {
+		monitoring.GetMetrics().RecordBackupCreated(uint64(seed.DoneBytes), seed.ActiveTime)
+	}
+
+	// Chunks were never announced while seeding; peers learn of them once
+	logger.WithField("snapshot_id", snap.ID).Info("Seeding complete, broadcasting snapshot")
+	if err := a.announceSnapshot(snap); err != nil {
+		logger.WithError(err).Warn("Failed to broadcast snapshot (snapshot saved locally)")
+	}
+	a.kickMirrors()
+	a.kickFreshness()
+	return snap, skippedError(snap)
+}
+
+// SeedStatus returns every seeding run, finished or not.
+func (a *Agent) SeedStatus() ([]*snapshots.SeedProgress, error) {
+	return snapshots.ListSeeds(a.DB)
+}
+
+// CancelSeed discards the checkpoints of an unfinished seeding run.
+func (a *Agent) CancelSeed(path string) error {
+	root, err := fspath.Resolve(path)
+	if err != nil {
+		return err
+	}
+	return snapshots.CancelSeed(a.DB, root)
+}
+
+// resumeSeeds continues, one at a time, seeding runs interrupted by a restart
+func (a *Agent) resumeSeeds(ctx context.Context) {
+	seeds, err := snapshots.ListSeeds(a.DB)
+	if err != nil {
+		monitoring.GetLogger().WithError(err).Warn("Failed to list seeding runs")
+		return
+	}
+	for _, seed := range seeds {
+		if seed.Phase == snapshots.SeedDone {
+			continue
+		}
+		monitoring.GetLogger().WithField("path", seed.Root).Info("Resuming interrupted seeding")
+		if _, err := a.Seed(ctx, seed.Root, nil); err != nil && ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/crypto"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/snapshots"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// ErrShareInvalid is returned for share tokens we did not sign
+	ErrShareInvalid = errors.New("invalid share token")
+	// ErrShareExpired is returned for share tokens past their lifetime
+	ErrShareExpired = errors.New("share link expired")
+	// ErrShareRevoked is returned for share links revoked by the owner
+	ErrShareRevoked = errors.New("share link revoked")
+	// ErrShareNotFound is returned when no share link has the given ID
+	ErrShareNotFound = errors.New("share link not found")
+)
+
+// ShareLink is a read-only link to download the decrypted content of one
+// snapshot, or of one file or directory in it, without the API token. A
+// shared file is sent as its content, and a shared directory or whole
+// snapshot as a tar archive of it.
+type ShareLink struct {
+	ID           string     `json:"id"`
+	SnapshotID   string     `json:"snapshot_id"`
+	Path         string     `json:"path,omitempty"` // file or directory shared, relative to the source; empty for the whole snapshot
+	Dir          bool       `json:"dir,omitempty"`  // Path is a directory, sent as a tar archive
+	Name         string     `json:"name"`           // file name offered to the downloader
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	Downloads    int        `json:"downloads"`
+	LastDownload *time.Time `json:"last_download,omitempty"`
+}
+
+// Archive reports whether the link is sent as a tar archive, as a directory
+// or whole snapshot is.
+func (l *ShareLink) Archive() bool {
+	return l.Dir || l.Path == ""
+}
+
+// shareClaims is what a share token carries, signed with the node's key
+type shareClaims struct {
+	ID         string `json:"id"`
+	SnapshotID string `json:"snapshot_id"`
+	Path       string `json:"path,omitempty"`
+	Expires    int64  `json:"expires"`
+}
+
+// CreateShare mints a link to snapshotID valid for ttl, and returns it with
+// its token. With name, a slash-separated path relative to the source as
+// restore file takes, the link covers only that file or directory. Either
+// way it needs the snapshot's file manifest. The token is only returned here; the
+// link is recorded so it can be listed and revoked.
+func (a *Agent) CreateShare(snapshotID, name string, ttl time.Duration) (*ShareLink, string, error) {
+	if ttl <= 0 || ttl > a.Config.API.ShareMaxTTL {
+		return nil, "", fmt.Errorf("share lifetime must be between 0 and %s, got %s", a.Config.API.ShareMaxTTL, ttl)
+	}
+	snap, err := versioning.LoadSnapshot(a.DB, snapshotID)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := versioning.CheckRepository(snap, a.RepoID); err != nil {
+		return nil, "", err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	now := time.Now().UTC()
+	link := &ShareLink{
+		ID:         hex.EncodeToString(id),
+		SnapshotID: snap.ID,
+		Name:       shareName(snap) + ".tar",
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(ttl).Truncate(time.Second),
+	}
+	if name == "" {
+		files, err := snap.Files()
+		if err != nil {
+			return nil, "", err
+		}
+		if files == nil {
+			return nil, "", fmt.Errorf("%w: snapshot %s has none", versioning.ErrBadFileManifest, snap.ID)
+		}
+	} else {
+		link.Path = path.Clean(filepath.ToSlash(name))
+		e, err := snap.File(link.Path)
+		if err != nil {
+			return nil, "", err
+		}
+		if e.IsSymlink() {
+			return nil, "", fmt.Errorf("%s is a symbolic link", link.Path)
+		}
+		link.Dir = e.IsDir()
+		link.Name = fileName(snap, e)
+		if link.Dir {
+			link.Name += ".tar"
+		}
+	}
+	claims, err := json.Marshal(shareClaims{ID: link.ID, SnapshotID: link.SnapshotID, Path: link.Path, Expires: link.ExpiresAt.Unix()})
+	if err != nil {
+		return nil, "", err
+	}
+	if err := a.saveShare(link); err != nil {
+		return nil, "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(claims) + "." +
+		base64.RawURLEncoding.EncodeToString(crypto.Sign(claims, a.SignerPriv))
+
+	monitoring.GetLogger().WithFields(map[string]interface{}{
+		"audit":    "share",
+		"event":    "created",
+		"share_id": link.ID,
+		"snapshot": link.SnapshotID,
+		"path":     link.Path,
+		"expires":  link.ExpiresAt,
+	}).Info("Share link created")
+	return link, token, nil
+}
+
+// Shares returns every recorded share link, newest first.
+func (a *Agent) Shares() ([]*ShareLink, error) {
+	var out []*ShareLink
+	err := a.DB.View(func(tx *bolt.Tx) error {
+		b, err := a.DB.Sealed(tx, persistence.BucketShares)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var link ShareLink
+			if err := json.Unmarshal(v, &link); err != nil {
+				return nil
+			}
+			out = append(out, &link)
+			return nil
+		})
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, err
+}
+
+// RevokeShare makes a share link unusable before it expires.
+func (a *Agent) RevokeShare(id string) (*ShareLink, error) {
+	link, err := a.loadShare(id)
+	if err != nil {
+		return nil, err
+	}
+	if link.RevokedAt == nil {
+		now := time.Now().UTC()
+		link.RevokedAt = &now
+		if err := a.saveShare(link); err != nil {
+			return nil, err
+		}
+	}
+	monitoring.GetLogger().WithFields(map[string]interface{}{
+		"audit":    "share",
+		"event":    "revoked",
+		"share_id": link.ID,
+		"snapshot": link.SnapshotID,
+	}).Info("Share link revoked")
+	return link, nil
+}
+
+// OpenShare checks a share token presented by remote and returns its link
+// and snapshot. Every refusal is logged for audit.
+func (a *Agent) OpenShare(token, remote string) (*ShareLink, *versioning.Snapshot, error) {
+	link, snap, err := a.openShare(token)
+	if err != nil {
+		fields := map[string]interface{}{
+			"audit":  "share",
+			"event":  "denied",
+			"remote": remote,
+		}
+		if link != nil {
+			fields["share_id"] = link.ID
+		}
+		monitoring.GetLogger().WithFields(fields).WithError(err).Warn("Share link refused")
+		return nil, nil, err
+	}
+	return link, snap, nil
+}
+
+func (a *Agent) openShare(token string) (*ShareLink, *versioning.Snapshot, error) {
+	enc, encSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, nil, ErrShareInvalid
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, nil, ErrShareInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encSig)
+	if err != nil || !crypto.Verify(claims, sig, a.SignerPub) {
+		return nil, nil, ErrShareInvalid
+	}
+	var c shareClaims
+	if err := json.Unmarshal(claims, &c); err != nil {
+		return nil, nil, ErrShareInvalid
+	}
+
+	link, err := a.loadShare(c.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if link.SnapshotID != c.SnapshotID || link.Path != c.Path {
+		return link, nil, ErrShareInvalid
+	}
+	if time.Now().After(time.Unix(c.Expires, 0)) {
+		return link, nil, ErrShareExpired
+	}
+	if link.RevokedAt != nil {
+		return link, nil, ErrShareRevoked
+	}
+	snap, err := versioning.LoadSnapshot(a.DB, link.SnapshotID)
+	if err != nil {
+		return link, nil, err
+	}
+	return link, snap, nil
+}
+
+// ServeShare writes what a link opened with OpenShare covers to w: the
+// decrypted content of the shared file, or a tar archive of the shared
+// directory or whole snapshot. It records the download.
+func (a *Agent) ServeShare(ctx context.Context, link *ShareLink, snap *versioning.Snapshot, w io.Writer, remote string) error {
+	n, err := a.serveShare(ctx, link, snap, w)
+
+	logger := monitoring.GetLogger().WithFields(map[string]interface{}{
+		"audit":    "share",
+		"event":    "download",
+		"share_id": link.ID,
+		"snapshot": link.SnapshotID,
+		"path":     link.Path,
+		"remote":   remote,
+		"bytes":    n,
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Share download failed")
+		return err
+	}
+	logger.Info("Share link downloaded")
+
+	// Count the download on the stored record, which may have been revoked
+	// in the meantime
+	if cur, err := a.loadShare(link.ID); err == nil {
+		now := time.Now().UTC()
+		cur.Downloads++
+		cur.LastDownload = &now
+		if err := a.saveShare(cur); err != nil {
+			logger.WithError(err).Warn("Failed to record share download")
+		}
+	}
+	return nil
+}
+
+func (a *Agent) serveShare(ctx context.Context, link *ShareLink, snap *versioning.Snapshot, w io.Writer) (uint64, error) {
+	if link.Archive() {
+		var paths []string
+		if link.Path != "" {
+			paths = []string{link.Path}
+		}
+		_, n, err := a.ExportArchive(ctx, snap, w, snapshots.ArchiveTar, paths)
+		return n, err
+	}
+	e, err := snap.File(link.Path)
+	if err != nil {
+		return 0, err
+	}
+	return a.copyChunks(ctx, snap.Span(e), w, nil, nil)
+}
+
+func (a *Agent) loadShare(id string) (*ShareLink, error) {
+	var link ShareLink
+	err := a.DB.View(func(tx *bolt.Tx) error {
+		b, err := a.DB.Sealed(tx, persistence.BucketShares)
+		if err != nil {
+			return err
+		}
+		v, err := b.Get([]byte(id))
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return ErrShareNotFound
+		}
+		return json.Unmarshal(v, &link)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+func (a *Agent) saveShare(link *ShareLink) error {
+	data, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+	return a.DB.Update(func(tx *bolt.Tx) error {
+		b, err := a.DB.Sealed(tx, persistence.BucketShares)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(link.ID), data)
+	})
+}
+
+// shareName is the name a shared snapshot's archive is offered under: the
+// base name of its source, or the snapshot ID when the source is unknown,
+// as the archive's top directory is named
+func shareName(snap *versioning.Snapshot) string {
+	if src := snap.OriginalSource(); src != "" {
+		if name := filepath.Base(src); name != "." && name != string(filepath.Separator) {
+			return name
+		}
+	}
+	return snap.ID
+}
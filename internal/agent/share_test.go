@@ -0,0 +1,181 @@
+package agent_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/config"
+	"github.com/hoangsonww/backupagent/internal/agent"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// newAgent opens an agent on a fresh repository holding one snapshot of a
+// small tree, and returns it with the snapshot
+func newAgent(t *testing.T) (*agent.Agent, *versioning.Snapshot) {
+	t.Helper()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	files := map[string]string{
+		"a.txt":       "alpha\n",
+		"sub/b.txt":   strings.Repeat("beta\n", 4000),
+		"sub/c/d.txt": "delta\n",
+		"other.txt":   "other\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo := filepath.Join(dir, "repo")
+	if err := os.Mkdir(repo, 0700); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	cfgPath := filepath.Join(dir, "config.yaml")
+	yaml := fmt.Sprintf("repository_path: %s\nlisten_port: %d\nsnapshot:\n  min_chunk_size: 2048\n  avg_chunk_size: 8192\n  max_chunk_size: 65536\n",
+		repo, port)
+	if err := os.WriteFile(cfgPath, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ag, err := agent.New(cfg, "test-passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ag.Close() })
+	snap, err := ag.CreateAndSaveSnapshot(context.Background(), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ag, snap
+}
+
+// download opens the link of token and returns what it serves
+func download(t *testing.T, ag *agent.Agent, token string) []byte {
+	t.Helper()
+	link, snap, err := ag.OpenShare(token, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := ag.ServeShare(context.Background(), link, snap, &buf, "test"); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// untar returns the content of each regular file in a tar archive, by its
+// path below the archive's top directory
+func untar(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	tr := tar.NewReader(bytes.NewReader(data))
+	got := make(map[string]string)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return got
+		}
+		if err != nil {
+			t.Fatalf("not a tar archive: %v", err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[h.Name[strings.Index(h.Name, "/")+1:]] = string(content)
+	}
+}
+
+func TestShareFile(t *testing.T) {
+	ag, snap := newAgent(t)
+	link, token, err := ag.CreateShare(snap.ID, "sub/b.txt", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Name != "b.txt" || link.Dir {
+		t.Errorf("link = %+v, want the file b.txt", link)
+	}
+	if got, want := string(download(t, ag, token)), strings.Repeat("beta\n", 4000); got != want {
+		t.Errorf("served %d bytes, want the %d of sub/b.txt", len(got), len(want))
+	}
+
+	if _, _, err := ag.CreateShare(snap.ID, "missing.txt", time.Hour); err == nil {
+		t.Error("shared a file the snapshot lacks")
+	}
+}
+
+func TestShareSubtree(t *testing.T) {
+	ag, snap := newAgent(t)
+	link, token, err := ag.CreateShare(snap.ID, "sub", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Name != "sub.tar" || !link.Dir {
+		t.Errorf("link = %+v, want the directory sub as sub.tar", link)
+	}
+
+	got := untar(t, download(t, ag, token))
+	want := map[string]string{
+		"sub/b.txt":   strings.Repeat("beta\n", 4000),
+		"sub/c/d.txt": "delta\n",
+	}
+	if len(got) != len(want) {
+		t.Errorf("archive holds %d files, want %d", len(got), len(want))
+	}
+	for name, content := range want {
+		if got[name] != content {
+			t.Errorf("%s: %d bytes in the archive, want %d", name, len(got[name]), len(content))
+		}
+	}
+}
+
+func TestShareSnapshot(t *testing.T) {
+	ag, snap := newAgent(t)
+	link, token, err := ag.CreateShare(snap.ID, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Name != "src.tar" || !link.Archive() {
+		t.Errorf("link = %+v, want the snapshot as src.tar", link)
+	}
+
+	got := untar(t, download(t, ag, token))
+	want := map[string]string{
+		"a.txt":       "alpha\n",
+		"sub/b.txt":   strings.Repeat("beta\n", 4000),
+		"sub/c/d.txt": "delta\n",
+		"other.txt":   "other\n",
+	}
+	if len(got) != len(want) {
+		t.Errorf("archive holds %d files, want %d", len(got), len(want))
+	}
+	for name, content := range want {
+		if got[name] != content {
+			t.Errorf("%s: %d bytes in the archive, want %d", name, len(got[name]), len(content))
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/service"
+	"github.com/hoangsonww/backupagent/internal/snapshots"
+)
+
+// watchSessionEnd snapshots scheduler.shutdown_paths when the system is
+// about to shut down or a user logs out, until ctx ends
+func (a *Agent) watchSessionEnd(ctx context.Context) {
+	cfg := a.Config.Scheduler
+	err := service.WatchSessionEnd(ctx, cfg.ShutdownBudget, a.snapshotOnSessionEnd)
+	if err != nil {
+		monitoring.GetLogger().WithError(err).Warn("Shutdown snapshots are not available")
+	}
+}
+
+// snapshotOnSessionEnd snapshots each shutdown path in turn until ctx ends,
+// tagging the snapshots with reason, "shutdown" or "logout". The change
+// journal keeps these quick, and the hooks are skipped so nothing outside
+// the budget holds up shutdown.
+func (a *Agent) snapshotOnSessionEnd(ctx context.Context, reason string) {
+	logger := monitoring.GetLogger().WithField("reason", reason)
+	start := time.Now()
+	logger.Info("Snapshotting shutdown paths")
+	saved := 0
+	for _, path := range a.Config.Scheduler.ShutdownPaths {
+		if ctx.Err() != nil {
+			break
+		}
+		_, err := a.CreateAndSaveSnapshot(ctx, path, reason)
+		var skipped *snapshots.SkippedError
+		if err != nil && !errors.As(err, &skipped) {
+			logger.WithError(err).Warnf("Shutdown snapshot of %s failed", path)
+			continue
+		}
+		saved++
+	}
+	fields := map[string]interface{}{
+		"saved":    saved,
+		"paths":    len(a.Config.Scheduler.ShutdownPaths),
+		"duration": time.Since(start).Seconds(),
+	}
+	if ctx.Err() != nil {
+		logger.WithFields(fields).Warn("Shutdown snapshots ran out of time")
+		return
+	}
+	logger.WithFields(fields).Info("Shutdown snapshots completed")
+}
@@ -0,0 +1,247 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/p2p"
+	"github.com/hoangsonww/backupagent/internal/protocol"
+	"github.com/hoangsonww/backupagent/internal/sneakernet"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ErrNothingToExport is returned by ExportSeed when no snapshot is newer
+// than the one given
+var ErrNothingToExport = errors.New("no snapshots to export")
+
+// ExportSeed writes our snapshots and their chunks to dir, for carrying to
+// an offsite node that imports them with ImportSeed. With since set, only
+// snapshots newer than it are exported, leaving out the chunks it shares
+// with them, which the offsite node holds from an earlier export.
+func (a *Agent) ExportSeed(ctx context.Context, dir, since string, progress func(done, total int)) (*sneakernet.Manifest, error) {
+	own, err := a.ownSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	held := make(map[string]bool)
+	if since != "" {
+		base, err := versioning.LoadSnapshot(a.DB, since)
+		if err != nil {
+			return nil, err
+		}
+		for _, hash := range base.Chunks {
+			held[hash] = true
+		}
+		var newer []*versioning.Snapshot
+		for _, snap := range own {
+			if snap.Timestamp.Time().After(base.Timestamp.Time()) {
+				newer = append(newer, snap)
+			}
+		}
+		own = newer
+	}
+	if len(own) == 0 {
+		return nil, ErrNothingToExport
+	}
+
+	id := make([]byte, 4)
+	rand.Read(id)
+	man := &sneakernet.Manifest{
+		ID:      time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(id),
+		RepoID:  a.RepoID,
+		Origin:  a.P2P.Host.ID().String(),
+		Created: time.Now().UTC(),
+		Since:   since,
+	}
+	var hashes []string
+	for _, snap := range own {
+		man.Snapshots = append(man.Snapshots, snap.Public())
+		for _, hash := range snap.Chunks {
+			if !held[hash] {
+				held[hash] = true
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+
+	w, err := sneakernet.Create(dir, man)
+	if err != nil {
+		return nil, err
+	}
+	for i, hash := range hashes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, err := a.Store.Get(hash)
+		if err != nil {
+			return nil, fmt.Errorf("chunk %s: %w", hash, err)
+		}
+		if err := w.Add(hash, data); err != nil {
+			return nil, err
+		}
+		if progress != nil {
+			progress(i+1, len(hashes))
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	monitoring.GetLogger().WithFields(map[string]interface{}{
+		"export_id": man.ID,
+		"snapshots": len(man.Snapshots),
+		"chunks":    len(hashes),
+		"bytes":     man.Bytes,
+	}).Info("Seed export written")
+	return man, nil
+}
+
+// ImportSeed stores the snapshots and chunks of the export in dir, checking
+// them as a pushed snapshot is checked, and writes a signed receipt to
+// receipt, or into dir if empty, for the exporting node's AckSeed.
+func (a *Agent) ImportSeed(ctx context.Context, dir, receipt string, progress func(done, total int)) (*sneakernet.Receipt, error) {
+	man, err := sneakernet.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	origin, err := peer.Decode(man.Origin)
+	if err != nil {
+		return nil, fmt.Errorf("malformed export origin %q: %w", man.Origin, err)
+	}
+	for _, snap := range man.Snapshots {
+		if err := (&protocol.SnapshotAnnouncement{Snapshot: *snap}).Validate(); err != nil {
+			return nil, fmt.Errorf("snapshot %s: %w", snap.ID, err)
+		}
+		if snap.RepoID != a.RepoID && !a.acceptsRepository(snap.RepoID) {
+			return nil, fmt.Errorf("snapshot %s: foreign repository %q", snap.ID, snap.RepoID)
+		}
+		if err := a.authorizePush(origin, snap); err != nil {
+			return nil, fmt.Errorf("snapshot %s: %w", snap.ID, err)
+		}
+	}
+
+	end, err := a.Store.BeginWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	hashes := man.Hashes()
+	for i, hash := range hashes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !a.Store.Exists(hash) {
+			data, err := sneakernet.ReadChunk(dir, man, hash)
+			if err != nil {
+				return nil, err
+			}
+			if err := a.Store.Put(hash, data); err != nil {
+				return nil, err
+			}
+		}
+		if progress != nil {
+			progress(i+1, len(hashes))
+		}
+	}
+
+	rec := &sneakernet.Receipt{
+		ExportID:  man.ID,
+		RepoID:    man.RepoID,
+		PeerID:    a.P2P.Host.ID().String(),
+		Imported:  time.Now().UTC(),
+		Snapshots: make(map[string]string, len(man.Snapshots)),
+	}
+	for _, snap := range man.Snapshots {
+		missing, err := a.Store.Missing(snap.Chunks)
+		if err != nil {
+			return nil, err
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("snapshot %s lacks %d chunks; import the export before this one first", snap.ID, len(missing))
+		}
+		digest, err := p2p.ChunkDigest(a.Store, snap.Chunks)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := versioning.LoadSnapshot(a.DB, snap.ID); err != nil {
+			if err := snap.OpenMeta(a.Store.Unseal); err != nil && !errors.Is(err, versioning.ErrMetaSealed) {
+				monitoring.GetLogger().WithError(err).WithField("snapshot_id", snap.ID).Warn("Malformed sealed snapshot metadata")
+			}
+			if err := versioning.SaveSnapshot(a.DB, snap); err != nil {
+				return nil, err
+			}
+		}
+		// The exporting node holds every chunk it exported
+		a.P2P.Locations.Record(origin, snap.Chunks...)
+		rec.Snapshots[snap.ID] = digest
+	}
+	rec.Sign(a.SignerPub, a.SignerPriv)
+
+	if receipt == "" {
+		receipt = filepath.Join(dir, sneakernet.ReceiptName)
+	}
+	if err := sneakernet.WriteReceipt(receipt, rec); err != nil {
+		return nil, err
+	}
+	monitoring.GetLogger().WithFields(map[string]interface{}{
+		"export_id": man.ID,
+		"origin":    man.Origin,
+		"snapshots": len(rec.Snapshots),
+		"receipt":   receipt,
+	}).Info("Seed export imported")
+	return rec, nil
+}
+
+// AckSeed reads the receipt an offsite node wrote on importing our export
+// and, once its digests match our chunks, records the node as holding a copy
+// of each snapshot, as a push does, so placement counts it.
+func (a *Agent) AckSeed(path string) (*sneakernet.Receipt, error) {
+	rec, err := sneakernet.ReadReceipt(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := rec.Validate(); err != nil {
+		return nil, err
+	}
+	pid, err := peer.Decode(rec.PeerID)
+	if err != nil {
+		return nil, fmt.Errorf("malformed receipt peer %q: %w", rec.PeerID, err)
+	}
+	if pub, err := peerSignerPub(pid); err != nil || pub != rec.SignerPub {
+		return nil, fmt.Errorf("receipt not signed by %s", pid)
+	}
+	if rec.RepoID != a.RepoID {
+		return nil, fmt.Errorf("receipt is for repository %q", rec.RepoID)
+	}
+	for id, digest := range rec.Snapshots {
+		snap, err := versioning.LoadSnapshot(a.DB, id)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot %s: %w", id, err)
+		}
+		ours, err := p2p.ChunkDigest(a.Store, snap.Chunks)
+		if err != nil {
+			return nil, err
+		}
+		if ours != digest {
+			return nil, fmt.Errorf("snapshot %s: %w", id, p2p.ErrPushVerifyFailed)
+		}
+	}
+	for id := range rec.Snapshots {
+		if err := a.recordPlacement(id, pid); err != nil {
+			return nil, err
+		}
+	}
+	a.updatePlacementHealth()
+	monitoring.GetLogger().WithFields(map[string]interface{}{
+		"export_id": rec.ExportID,
+		"peer":      rec.PeerID,
+		"snapshots": len(rec.Snapshots),
+	}).Info("Seed import acknowledged")
+	return rec, nil
+}
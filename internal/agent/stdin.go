@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/snapshots"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// stdinMode is the permission a file backed up from a stream is restored with
+const stdinMode = 0600
+
+// ErrBadStreamName is returned for a stream name that is not a plain file name.
+var ErrBadStreamName = errors.New("stream name must be a file name without directories")
+
+// CreateAndSaveSnapshotFrom backs up everything r yields, e.g. a database
+// dump piped to the agent, as a snapshot of the single file name, without
+// staging it on disk. Snapshots of the same name form one history, as those
+// of a path do. The snapshot is labelled with tags, which
+// versioning.CheckTag must accept.
+func (a *Agent) CreateAndSaveSnapshotFrom(ctx context.Context, r io.Reader, name string, tags ...string) (*versioning.Snapshot, error) {
+	logger := monitoring.LoggerFor(ctx).WithField("stream", name)
+	startTime := time.Now()
+
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("%w: %q", ErrBadStreamName, name)
+	}
+	for _, t := range tags {
+		if err := versioning.CheckTag(t); err != nil {
+			return nil, err
+		}
+	}
+	logger.Info("Creating snapshot from stream")
+	parent, err := a.parentSnapshot(name)
+	if err != nil {
+		return nil, err
+	}
+	end, err := a.Store.BeginWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	ctx, tracker, stop := a.trackProgress(ctx, "Backup progress", map[string]interface{}{"stream": name})
+	defer stop()
+	if parent != nil {
+		tracker.Expect(0, sourceSize(parent))
+	}
+	tracker.File(name)
+
+	counted := &countingReader{r: r}
+	chunks, err := snapshots.StoreReader(ctx, a.Store, bufio.NewReaderSize(counted, 1<<20), a.Chunking)
+	stop()
+	if err != nil {
+		logger.WithError(err).Error("Failed to create snapshot")
+		monitoring.GetMetrics().RecordBackupFailed()
+		return nil, err
+	}
+	files := []versioning.FileEntry{{
+		Path:    versioning.SourcePath,
+		Mode:    stdinMode,
+		Size:    counted.n,
+		ModTime: startTime.UTC(),
+		Count:   len(chunks),
+	}}
+	done := tracker.Report()
+	logger.WithFields(map[string]interface{}{
+		"bytes_read":    counted.n,
+		"bytes_new":     done.NewBytes,
+		"bytes_deduped": done.DedupBytes,
+	}).Info("Read snapshot stream")
+
+	snap, err := snapshots.NewSnapshot(name, chunks, files, a.Chunking, nil, tags, a.metaSealer(), a.SignerPub, a.SignerPriv, parent, a.RepoID)
+	if err != nil {
+		monitoring.GetMetrics().RecordBackupFailed()
+		return nil, err
+	}
+	if err := a.saveSnapshot(ctx, snap, startTime); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"golang.org/x/time/rate"
+)
+
+var (
+	ErrOperationNotFound = errors.New("operation not found")
+	ErrNotThrottled      = errors.New("operation cannot be throttled")
+)
+
+// ThrottleSettings are the limits of a throttled operation.
+type ThrottleSettings struct {
+	LimitRate int64 `json:"limit_rate"` // bytes per second; 0 is unlimited
+	IONice    bool  `json:"io_nice"`    // idle I/O class and lowered CPU priority
+}
+
+// Throttle limits how hard a restore works the disk. Its settings can be
+// changed while the restore runs.
+type Throttle struct {
+	mu      sync.Mutex
+	set     ThrottleSettings
+	limiter *rate.Limiter
+	niced   bool // priority currently lowered on the worker thread
+}
+
+// NewThrottle returns a throttle with settings s.
+func NewThrottle(s ThrottleSettings) *Throttle {
+	t := &Throttle{}
+	t.Set(s)
+	return t
+}
+
+// Set changes the limits; a running operation follows from its next chunk.
+func (t *Throttle) Set(s ThrottleSettings) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.set = s
+	if s.LimitRate <= 0 {
+		t.limiter = nil
+		return
+	}
+	if t.limiter == nil {
+		t.limiter = rate.NewLimiter(rate.Limit(s.LimitRate), int(s.LimitRate))
+		return
+	}
+	t.limiter.SetLimit(rate.Limit(s.LimitRate))
+	t.limiter.SetBurst(int(s.LimitRate))
+}
+
+// Settings returns the current limits.
+func (t *Throttle) Settings() ThrottleSettings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.set
+}
+
+// run calls fn on an OS thread of its own, so lowering its priority affects
+// nothing else. The thread is never unlocked, so it exits with fn instead of
+// returning to the runtime with a lowered priority. A nil t calls fn directly.
+func (t *Throttle) run(fn func() error) error {
+	if t == nil {
+		return fn()
+	}
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		t.renice()
+		errc <- fn()
+	}()
+	return <-errc
+}
+
+// renice brings the priority of the worker thread in line with IONice
+func (t *Throttle) renice() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.set.IONice == t.niced {
+		return
+	}
+	if err := setNice(t.set.IONice); err != nil {
+		monitoring.GetLogger().WithError(err).Warn("Failed to change restore priority")
+	}
+	t.niced = t.set.IONice
+}
+
+// wait follows a changed priority on the worker thread and blocks until n
+// more bytes are allowed. A nil t only checks ctx.
+func (t *Throttle) wait(ctx context.Context, n int) error {
+	if t == nil {
+		return ctx.Err()
+	}
+	t.renice()
+	t.mu.Lock()
+	limiter := t.limiter
+	t.mu.Unlock()
+
+	if limiter == nil {
+		return nil
+	}
+	// WaitN refuses more than the burst at once
+	for n > 0 {
+		k := n
+		if b := limiter.Burst(); k > b {
+			k = b
+		}
+		if err := limiter.WaitN(ctx, k); err != nil {
+			return err
+		}
+		n -= k
+	}
+	return nil
+}
+
+// AdjustOperation changes the throttle of a queued or running operation.
+func (a *Agent) AdjustOperation(id string, s ThrottleSettings) (*Operation, error) {
+	ad := a.admission
+	ad.mu.Lock()
+	defer ad.mu.Unlock()
+	op, ok := ad.ops[id]
+	if !ok {
+		return nil, ErrOperationNotFound
+	}
+	if op.throttle == nil {
+		if op.State == OpDone || op.State == OpFailed || op.State == OpCancelled {
+			return nil, fmt.Errorf("%w: %s has finished", ErrNotThrottled, op.ID)
+		}
+		return nil, fmt.Errorf("%w: %s is a %s", ErrNotThrottled, op.ID, op.Kind)
+	}
+	op.throttle.Set(s)
+	monitoring.LoggerFor(op.ctx).WithFields(map[string]interface{}{
+		"operation":  op.ID,
+		"limit_rate": s.LimitRate,
+		"io_nice":    s.IONice,
+	}).Info("Throttle changed")
+	return ad.snapshotLocked(op), nil
+}
+
+// ParseRate reads a rate in bytes per second, with an optional K, M or G
+// suffix in powers of 1024, as in "20M". "0" is unlimited.
+func ParseRate(s string) (int64, error) {
+	s = strings.TrimSpace(strings.TrimSuffix(strings.ToUpper(s), "B"))
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int64(v * float64(mult)), nil
+}
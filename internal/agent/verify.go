@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"context"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/p2p"
+	"github.com/hoangsonww/backupagent/internal/verification"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// VerifyRemote challenges the peer named by holder to serve snapshotID of
+// repository repoID (this node's when empty) and a random sample of its
+// chunks, and returns an attestation of the outcome signed by this node.
+// sample <= 0 checks every chunk.
+func (a *Agent) VerifyRemote(ctx context.Context, holder, snapshotID, repoID string, sample int) (*verification.Attestation, error) {
+	if repoID == "" {
+		repoID = a.RepoID
+	}
+	pid, err := a.ConnectPeer(ctx, holder)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p2p.SampleSnapshot(ctx, a.P2P.Host, pid, snapshotID, repoID, func(snap *versioning.Snapshot) []string {
+		return verification.SampleChunks(snap, sample)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	local, _ := versioning.LoadSnapshot(a.DB, snapshotID)
+	at := verification.CheckSample(pid.String(), res, a.Store, local)
+	at.Sign(a.SignerPub, a.SignerPriv)
+
+	logger := monitoring.GetLogger().WithFields(map[string]interface{}{
+		"holder":      at.Holder,
+		"snapshot_id": at.SnapshotID,
+		"sampled":     at.Sampled,
+		"intact":      at.Intact,
+		"opaque":      at.Opaque,
+		"missing":     len(at.Missing),
+		"corrupt":     len(at.Corrupt),
+	})
+	if at.Passed {
+		logger.Info("Remote verification passed")
+	} else {
+		logger.Error("Remote verification failed")
+	}
+	return at, nil
+}
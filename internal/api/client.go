@@ -0,0 +1,330 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/agent"
+	"github.com/hoangsonww/backupagent/internal/gc"
+	"github.com/hoangsonww/backupagent/internal/maintenance"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// Client calls the management API of a remote daemon.
+type Client struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+// NewClient returns a client for the API at server, e.g.
+// "http://nas.local:8081", authenticating with token.
+func NewClient(server, token string) (*Client, error) {
+	u, err := url.Parse(server)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("server must be an http(s) URL, got %q", server)
+	}
+	return &Client{
+		server: strings.TrimRight(server, "/"),
+		token:  token,
+		http:   &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// StatusError is a non-success response of the API.
+type StatusError struct {
+	Status    int
+	Message   string
+	RequestID string
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" (request %s)", e.RequestID)
+	}
+	return msg
+}
+
+// Submitted is the response to a backup or restore request.
+type Submitted struct {
+	Status    string           `json:"status"`
+	Operation *agent.Operation `json:"operation"`
+	RequestID string           `json:"request_id"`
+}
+
+// Status is the overall state of the daemon.
+type Status struct {
+	Health       monitoring.HealthCheck `json:"health"`
+	P2PID        string                 `json:"p2p_id"`
+	RepositoryID string                 `json:"repository_id"`
+	Peers        int                    `json:"peers"`
+}
+
+// Peer is a connected peer.
+type Peer struct {
+	ID      string        `json:"id"`
+	Addrs   []string      `json:"addrs"`
+	Latency time.Duration `json:"latency"` // 0 until measured
+	Score   float64       `json:"score"`
+	Pinned  bool          `json:"pinned,omitempty"`
+}
+
+// PeerChange is the outcome of connecting or removing a peer.
+type PeerChange struct {
+	Status      string `json:"status"`
+	PeerID      string `json:"peer_id"`
+	OperationID string `json:"operation_id,omitempty"` // set when awaiting approval
+}
+
+// Share is a newly minted share link with its token. URL is where the
+// snapshot can be downloaded without the API token.
+type Share struct {
+	Link  *agent.ShareLink `json:"share"`
+	Token string           `json:"token"`
+	Path  string           `json:"path"`
+	URL   string           `json:"-"`
+}
+
+// Status returns the daemon's health and identity.
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	var out Status
+	return &out, c.do(ctx, http.MethodGet, "/api/v1/status", nil, &out)
+}
+
+// DebugState captures the daemon's goroutines, connections, operations,
+// queue depths and recent errors.
+func (c *Client) DebugState(ctx context.Context) (*agent.DebugState, error) {
+	var out agent.DebugState
+	return &out, c.do(ctx, http.MethodGet, "/api/v1/debug/state", nil, &out)
+}
+
+// Logs returns the entries the daemon logged after since at or above level,
+// oldest first. An empty level means every level.
+func (c *Client) Logs(ctx context.Context, since time.Time, level string) ([]monitoring.LogEntry, error) {
+	q := url.Values{}
+	if !since.IsZero() {
+		q.Set("since", since.Format(time.RFC3339Nano))
+	}
+	if level != "" {
+		q.Set("level", level)
+	}
+	var out struct {
+		Entries []monitoring.LogEntry `json:"entries"`
+	}
+	return out.Entries, c.do(ctx, http.MethodGet, "/api/v1/logs?"+q.Encode(), nil, &out)
+}
+
+// Snapshots lists the snapshots of the remote repository, oldest first.
+func (c *Client) Snapshots(ctx context.Context) ([]*versioning.Snapshot, error) {
+	var out struct {
+		Snapshots []*versioning.Snapshot `json:"snapshots"`
+	}
+	return out.Snapshots, c.do(ctx, http.MethodGet, "/api/v1/snapshots", nil, &out)
+}
+
+// Backup asks the daemon to snapshot path, which is a path on the daemon's
+// host, labelled with tags.
+func (c *Client) Backup(ctx context.Context, path string, tags ...string) (*Submitted, error) {
+	var out Submitted
+	body := map[string]interface{}{"path": path, "tags": tags}
+	return &out, c.do(ctx, http.MethodPost, "/api/v1/snapshots/create", body, &out)
+}
+
+// Restore asks the daemon to restore a snapshot to target on its host.
+func (c *Client) Restore(ctx context.Context, snapshotID, target string, th agent.ThrottleSettings) (*Submitted, error) {
+	var out Submitted
+	req := struct {
+		SnapshotID string `json:"snapshot_id"`
+		TargetPath string `json:"target_path"`
+		agent.ThrottleSettings
+	}{snapshotID, target, th}
+	return &out, c.do(ctx, http.MethodPost, "/api/v1/restore", req, &out)
+}
+
+// RestoreFile asks the daemon to restore the file at path in a snapshot to
+// target on its host.
+func (c *Client) RestoreFile(ctx context.Context, snapshotID, path, target string, th agent.ThrottleSettings) (*Submitted, error) {
+	var out Submitted
+	req := struct {
+		SnapshotID string `json:"snapshot_id"`
+		Path       string `json:"path"`
+		TargetPath string `json:"target_path"`
+		agent.ThrottleSettings
+	}{snapshotID, path, target, th}
+	return &out, c.do(ctx, http.MethodPost, "/api/v1/restore/file", req, &out)
+}
+
+// Operations lists queued, running and recently finished operations.
+func (c *Client) Operations(ctx context.Context) ([]*agent.Operation, error) {
+	var out struct {
+		Operations []*agent.Operation `json:"operations"`
+	}
+	return out.Operations, c.do(ctx, http.MethodGet, "/api/v1/operations", nil, &out)
+}
+
+// Operation returns one operation.
+func (c *Client) Operation(ctx context.Context, id string) (*agent.Operation, error) {
+	var out agent.Operation
+	return &out, c.do(ctx, http.MethodGet, "/api/v1/operations/"+url.PathEscape(id), nil, &out)
+}
+
+// AdjustOperation changes the throttle of a queued or running restore.
+func (c *Client) AdjustOperation(ctx context.Context, id string, th agent.ThrottleSettings) (*agent.Operation, error) {
+	var out agent.Operation
+	return &out, c.do(ctx, http.MethodPatch, "/api/v1/operations/"+url.PathEscape(id), th, &out)
+}
+
+// CancelOperation cancels a queued or running operation. A running one is
+// returned still running, until it has stopped.
+func (c *Client) CancelOperation(ctx context.Context, id string) (*agent.Operation, error) {
+	var out agent.Operation
+	return &out, c.do(ctx, http.MethodDelete, "/api/v1/operations/"+url.PathEscape(id), nil, &out)
+}
+
+// GCStatus returns the daemon's last limit garbage collection runs and its
+// next scheduled one.
+func (c *Client) GCStatus(ctx context.Context, limit int) (*agent.GCStatus, error) {
+	var out agent.GCStatus
+	return &out, c.do(ctx, http.MethodGet, fmt.Sprintf("/api/v1/gc/status?limit=%d", limit), nil, &out)
+}
+
+// Forecast projects the daemon's repository usage over the next months under
+// its configured retention and each of the retention periods of whatIf.
+func (c *Client) Forecast(ctx context.Context, months int, whatIf []int) (*gc.Forecast, error) {
+	q := url.Values{"months": {strconv.Itoa(months)}}
+	for _, days := range whatIf {
+		q.Add("retention_days", strconv.Itoa(days))
+	}
+	var out gc.Forecast
+	return &out, c.do(ctx, http.MethodGet, "/api/v1/forecast?"+q.Encode(), nil, &out)
+}
+
+// Maintenance returns the state of the daemon's maintenance tasks.
+func (c *Client) Maintenance(ctx context.Context) ([]*maintenance.State, error) {
+	var out struct {
+		Tasks []*maintenance.State `json:"tasks"`
+	}
+	return out.Tasks, c.do(ctx, http.MethodGet, "/api/v1/maintenance", nil, &out)
+}
+
+// Peers lists the daemon's connected peers.
+func (c *Client) Peers(ctx context.Context) ([]Peer, error) {
+	var out struct {
+		Peers []Peer `json:"peers"`
+	}
+	return out.Peers, c.do(ctx, http.MethodGet, "/api/v1/peers", nil, &out)
+}
+
+// ConnectPeer has the daemon connect to the peer at a multiaddr and store
+// it. force adds back a peer removed for abuse.
+func (c *Client) ConnectPeer(ctx context.Context, addr string, force bool) (*PeerChange, error) {
+	var out PeerChange
+	req := map[string]interface{}{"addr": addr, "force": force}
+	return &out, c.do(ctx, http.MethodPost, "/api/v1/peers/connect", req, &out)
+}
+
+// RemovePeer has the daemon archive a peer with a reason, and with broadcast
+// announce the removal to every node.
+func (c *Client) RemovePeer(ctx context.Context, peerID, reason string, abuse, broadcast bool) (*PeerChange, error) {
+	var out PeerChange
+	req := map[string]interface{}{"peer_id": peerID, "reason": reason, "abuse": abuse, "broadcast": broadcast}
+	return &out, c.do(ctx, http.MethodPost, "/api/v1/peers/remove", req, &out)
+}
+
+// RemovedPeers lists the daemon's archived peers with their removals.
+func (c *Client) RemovedPeers(ctx context.Context) ([]*agent.RemovedPeer, error) {
+	var out struct {
+		Removed []*agent.RemovedPeer `json:"removed"`
+	}
+	return out.Removed, c.do(ctx, http.MethodGet, "/api/v1/peers/removed", nil, &out)
+}
+
+// RestorePeer has the daemon put an archived peer back on its peer list.
+// force restores a peer removed for abuse.
+func (c *Client) RestorePeer(ctx context.Context, peerID string, force bool) (*agent.RemovedPeer, error) {
+	var out agent.RemovedPeer
+	req := map[string]interface{}{"peer_id": peerID, "force": force}
+	return &out, c.do(ctx, http.MethodPost, "/api/v1/peers/restore", req, &out)
+}
+
+// Placement measures the daemon's snapshots against their placement policy.
+func (c *Client) Placement(ctx context.Context) ([]*agent.PlacementStatus, error) {
+	var out struct {
+		Snapshots []*agent.PlacementStatus `json:"snapshots"`
+	}
+	return out.Snapshots, c.do(ctx, http.MethodGet, "/api/v1/placement", nil, &out)
+}
+
+// CreateShare mints a link to download a snapshot for ttl, or only the file
+// or directory at path in it when path is not empty.
+func (c *Client) CreateShare(ctx context.Context, snapshotID, path string, ttl time.Duration) (*Share, error) {
+	var out Share
+	req := map[string]string{"snapshot_id": snapshotID, "path": path, "ttl": ttl.String()}
+	if err := c.do(ctx, http.MethodPost, "/api/v1/shares/create", req, &out); err != nil {
+		return nil, err
+	}
+	out.URL = c.server + out.Path
+	return &out, nil
+}
+
+// Shares lists the daemon's share links, newest first.
+func (c *Client) Shares(ctx context.Context) ([]*agent.ShareLink, error) {
+	var out struct {
+		Shares []*agent.ShareLink `json:"shares"`
+	}
+	return out.Shares, c.do(ctx, http.MethodGet, "/api/v1/shares", nil, &out)
+}
+
+// RevokeShare revokes a share link before it expires.
+func (c *Client) RevokeShare(ctx context.Context, id string) (*agent.ShareLink, error) {
+	var out agent.ShareLink
+	return &out, c.do(ctx, http.MethodPost, "/api/v1/shares/revoke", map[string]string{"id": id}, &out)
+}
+
+// do sends a request with body encoded as JSON and decodes the response into out
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.server+path, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if id := monitoring.RequestID(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &StatusError{
+			Status:    resp.StatusCode,
+			Message:   strings.TrimSpace(string(msg)),
+			RequestID: resp.Header.Get("X-Request-ID"),
+		}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
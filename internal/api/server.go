@@ -2,12 +2,22 @@ package api
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hoangsonww/backupagent/internal/agent"
+	"github.com/hoangsonww/backupagent/internal/approval"
+	"github.com/hoangsonww/backupagent/internal/auth"
 	"github.com/hoangsonww/backupagent/internal/gc"
 	"github.com/hoangsonww/backupagent/internal/monitoring"
 	"github.com/hoangsonww/backupagent/internal/versioning"
@@ -31,6 +41,10 @@ func NewServer(agent *agent.Agent, gcCollector *gc.Collector, port int) *Server
 		healthChecker: monitoring.GetHealthChecker(),
 	}
 
+	agent.RegisterOperationHandler(approval.KindPrune, func(json.RawMessage) error {
+		return gcCollector.RunOnce()
+	})
+
 	mux := http.NewServeMux()
 
 	// Snapshot management
@@ -41,21 +55,50 @@ func NewServer(agent *agent.Agent, gcCollector *gc.Collector, port int) *Server
 	// Backup operations
 	mux.HandleFunc("/api/v1/backup", s.handleBackup)
 	mux.HandleFunc("/api/v1/restore", s.handleRestore)
+	mux.HandleFunc("/api/v1/restore/file", s.handleRestoreFile)
+	mux.HandleFunc("/api/v1/seeding", s.handleSeeding)
+	mux.HandleFunc("/api/v1/operations", s.handleOperations)
+	mux.HandleFunc("/api/v1/operations/", s.handleOperations)
 
 	// Garbage collection
 	mux.HandleFunc("/api/v1/gc/run", s.handleRunGC)
 	mux.HandleFunc("/api/v1/gc/status", s.handleGCStatus)
+	mux.HandleFunc("/api/v1/forecast", s.handleForecast)
+	mux.HandleFunc("/api/v1/maintenance", s.handleMaintenance)
 
 	// Metrics and monitoring
 	mux.HandleFunc("/api/v1/metrics/summary", s.handleMetricsSummary)
 	mux.HandleFunc("/api/v1/status", s.handleStatus)
+	mux.HandleFunc("/api/v1/debug/state", s.handleDebugState)
+	mux.HandleFunc("/api/v1/logs", s.handleLogs)
 
 	// Peer management
 	mux.HandleFunc("/api/v1/peers", s.handlePeers)
+	mux.HandleFunc("/api/v1/peers/connect", s.handleConnectPeer)
+	mux.HandleFunc("/api/v1/peers/remove", s.handleRemovePeer)
+	mux.HandleFunc("/api/v1/peers/removed", s.handleRemovedPeers)
+	mux.HandleFunc("/api/v1/peers/restore", s.handleRestorePeer)
+	mux.HandleFunc("/api/v1/mirrors", s.handleMirrors)
+	mux.HandleFunc("/api/v1/placement", s.handlePlacement)
+
+	// Two-person rule approvals
+	mux.HandleFunc("/api/v1/approvals", s.handleApprovals)
+	mux.HandleFunc("/api/v1/approvals/approve", s.handleApproveOperation)
+
+	// Share links
+	mux.HandleFunc("/api/v1/shares", s.handleShares)
+	mux.HandleFunc("/api/v1/shares/create", s.handleCreateShare)
+	mux.HandleFunc("/api/v1/shares/revoke", s.handleRevokeShare)
+
+	// Share downloads carry their own signed token instead of the API token.
+	// It goes in the query, which is never logged.
+	root := http.NewServeMux()
+	root.HandleFunc("/share", s.handleShareDownload)
+	root.Handle("/", s.authMiddleware(mux))
 
 	s.server = &http.Server{
 		Addr:         fmt.Sprintf(":%d", port),
-		Handler:      s.loggingMiddleware(s.corsMiddleware(mux)),
+		Handler:      s.requestIDMiddleware(s.loggingMiddleware(s.corsMiddleware(root))),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 	}
@@ -70,16 +113,65 @@ func (s *Server) Start() error {
 	return s.server.ListenAndServe()
 }
 
+// Serve serves the API on l, a socket the service manager opened, instead
+// of listening on the configured port
+func (s *Server) Serve(l net.Listener) error {
+	monitoring.GetLogger().Infof("Starting API server on %s", l.Addr())
+	return s.server.Serve(l)
+}
+
 // Stop gracefully stops the API server
 func (s *Server) Stop(ctx context.Context) error {
 	return s.server.Shutdown(ctx)
 }
 
+// requestIDMiddleware tags each request with an ID, taken from a well-formed
+// X-Request-ID header or generated, and echoes it in the response
+func (s *Server) requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = monitoring.NewRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(monitoring.WithRequestID(r.Context(), id)))
+	})
+}
+
+// validRequestID accepts caller-chosen IDs that are safe to log
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 // Middleware for logging
 func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		logger := monitoring.GetLogger()
+		logger := monitoring.LoggerFor(r.Context())
 
 		logger.WithFields(map[string]interface{}{
 			"method": r.Method,
@@ -87,13 +179,38 @@ func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 			"remote": r.RemoteAddr,
 		}).Debug("API request")
 
-		next.ServeHTTP(w, r)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
 
-		logger.WithFields(map[string]interface{}{
+		took := time.Since(start)
+		fields := logger.WithFields(map[string]interface{}{
 			"method":   r.Method,
 			"path":     r.URL.Path,
-			"duration": time.Since(start).Milliseconds(),
-		}).Info("API request completed")
+			"status":   rec.status,
+			"duration": took.Milliseconds(),
+		})
+		if threshold := s.agent.Config.Monitoring.SlowRequestThreshold; threshold > 0 && took > threshold {
+			fields.WithFields(map[string]interface{}{
+				"remote":       r.RemoteAddr,
+				"threshold_ms": threshold.Milliseconds(),
+			}).Warn("Slow API request")
+			return
+		}
+		fields.Info("API request completed")
+	})
+}
+
+// authMiddleware requires the configured API token as a bearer token
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	token := []byte("Bearer " + s.agent.Config.API.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if s.agent.Config.API.Token == "" || subtle.ConstantTimeCompare(got, token) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="shadowvault"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
 	})
 }
 
@@ -101,7 +218,7 @@ func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 func (s *Server) corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
 		if r.Method == "OPTIONS" {
@@ -125,6 +242,7 @@ func (s *Server) handleSnapshots(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Failed to list snapshots: %v", err), http.StatusInternalServerError)
 		return
 	}
+	versioning.SortByTime(snapshots)
 
 	respondJSON(w, http.StatusOK, map[string]interface{}{
 		"snapshots": snapshots,
@@ -140,7 +258,10 @@ func (s *Server) handleCreateSnapshot(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Path string `json:"path"`
+		Path  string   `json:"path"`
+		Paths []string `json:"paths"` // captured together into one snapshot
+		Group string   `json:"group"` // of scheduler.source_groups, or naming the history of paths
+		Tags  []string `json:"tags"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -148,20 +269,42 @@ func (s *Server) handleCreateSnapshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Path == "" {
+	if req.Path != "" {
+		req.Paths = append([]string{req.Path}, req.Paths...)
+	}
+	if len(req.Paths) == 0 && req.Group == "" {
 		http.Error(w, "Path is required", http.StatusBadRequest)
 		return
 	}
-
-	go func() {
-		if err := s.agent.CreateAndSaveSnapshot(req.Path); err != nil {
-			monitoring.GetLogger().WithError(err).Error("Failed to create snapshot")
+	for _, t := range req.Tags {
+		if err := versioning.CheckTag(t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-	}()
+	}
 
-	respondJSON(w, http.StatusAccepted, map[string]string{
-		"status":  "accepted",
-		"message": "Snapshot creation started",
+	if len(req.Paths) == 1 && req.Group == "" {
+		s.submit(w, r, agent.OpBackup, req.Paths[0], nil, func(ctx context.Context) error {
+			_, err := s.agent.BackupWithHooks(ctx, req.Paths[0], req.Tags...)
+			return err
+		})
+		return
+	}
+	if len(req.Paths) == 0 {
+		paths, err := s.agent.SourceGroup(req.Group)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		req.Paths = paths
+	}
+	target := strings.Join(req.Paths, " ")
+	if req.Group != "" {
+		target = versioning.GroupSource(req.Group)
+	}
+	s.submit(w, r, agent.OpBackup, target, nil, func(ctx context.Context) error {
+		_, err := s.agent.BackupGroupWithHooks(ctx, req.Group, req.Paths, req.Tags...)
+		return err
 	})
 }
 
@@ -206,6 +349,7 @@ func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		SnapshotID string `json:"snapshot_id"`
 		TargetPath string `json:"target_path"`
+		agent.ThrottleSettings
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -217,10 +361,88 @@ func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "snapshot_id and target_path are required", http.StatusBadRequest)
 		return
 	}
+	if req.LimitRate < 0 {
+		http.Error(w, "limit_rate must not be negative", http.StatusBadRequest)
+		return
+	}
 
-	respondJSON(w, http.StatusAccepted, map[string]string{
-		"status":  "accepted",
-		"message": "Restore operation started",
+	snap, err := versioning.LoadSnapshot(s.agent.DB, req.SnapshotID)
+	if err != nil {
+		if err == versioning.ErrSnapshotNotFound {
+			http.Error(w, "Snapshot not found", http.StatusNotFound)
+		} else {
+			http.Error(w, fmt.Sprintf("Failed to load snapshot: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Every restore gets a throttle so it can be slowed down once running
+	th := agent.NewThrottle(req.ThrottleSettings)
+	s.submit(w, r, agent.OpRestore, req.SnapshotID, th, func(ctx context.Context) error {
+		scan := s.agent.RestoreScanner()
+		if _, err := s.agent.RestoreSnapshot(ctx, snap, req.TargetPath, th, nil, scan); err != nil {
+			return err
+		}
+		return scan.Err()
+	})
+}
+
+// handleRestoreFile restores one file of a snapshot
+func (s *Server) handleRestoreFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		SnapshotID string `json:"snapshot_id"`
+		Path       string `json:"path"`
+		TargetPath string `json:"target_path"`
+		agent.ThrottleSettings
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.SnapshotID == "" || req.Path == "" || req.TargetPath == "" {
+		http.Error(w, "snapshot_id, path and target_path are required", http.StatusBadRequest)
+		return
+	}
+	if req.LimitRate < 0 {
+		http.Error(w, "limit_rate must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	snap, err := versioning.LoadSnapshot(s.agent.DB, req.SnapshotID)
+	if err != nil {
+		if err == versioning.ErrSnapshotNotFound {
+			http.Error(w, "Snapshot not found", http.StatusNotFound)
+		} else {
+			http.Error(w, fmt.Sprintf("Failed to load snapshot: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+	// Fail now rather than in the queued operation when the file is missing
+	e, err := snap.File(req.Path)
+	switch {
+	case errors.Is(err, versioning.ErrFileNotInSnapshot):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	case e.IsDir():
+		http.Error(w, fmt.Sprintf("%q is a directory", req.Path), http.StatusBadRequest)
+		return
+	}
+
+	th := agent.NewThrottle(req.ThrottleSettings)
+	s.submit(w, r, agent.OpRestore, req.SnapshotID+":"+req.Path, th, func(ctx context.Context) error {
+		scan := s.agent.RestoreScanner()
+		if _, err := s.agent.RestoreFile(ctx, snap, req.Path, req.TargetPath, th, nil, scan); err != nil {
+			return err
+		}
+		return scan.Err()
 	})
 }
 
@@ -231,28 +453,246 @@ func (s *Server) handleRunGC(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go func() {
-		if err := s.gc.RunOnce(); err != nil {
-			monitoring.GetLogger().WithError(err).Error("Manual GC failed")
+	if s.agent.Config.ACL.TwoPersonRule {
+		opID, err := s.agent.ProposeOperation(approval.KindPrune, struct{}{})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-	}()
+		respondJSON(w, http.StatusAccepted, map[string]string{
+			"status":       "pending_approval",
+			"operation_id": opID,
+			"message":      "Garbage collection proposed, awaiting second admin approval",
+		})
+		return
+	}
 
-	respondJSON(w, http.StatusAccepted, map[string]string{
-		"status":  "accepted",
-		"message": "Garbage collection started",
+	s.submit(w, r, agent.OpGC, "", nil, func(context.Context) error {
+		return s.gc.RunOnce()
 	})
 }
 
-// handleGCStatus returns GC status
+// submit hands an operation to the agent's admission control and reports
+// whether it started or was queued, or rejects it with Retry-After. The
+// operation records the request ID, so its outcome can be traced back.
+func (s *Server) submit(w http.ResponseWriter, r *http.Request, kind, target string, th *agent.Throttle, run func(ctx context.Context) error) {
+	op, err := s.agent.SubmitThrottled(r.Context(), kind, target, th, run)
+	var full *agent.QueueFullError
+	if errors.As(err, &full) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(full.RetryAfter.Seconds()+0.5)))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, http.StatusAccepted, map[string]interface{}{
+		"status":     op.State,
+		"operation":  op,
+		"request_id": op.RequestID,
+	})
+}
+
+// handleOperations lists admitted operations, or one of them by ID. PATCH
+// on an ID changes the throttle of a queued or running restore, and DELETE
+// cancels a queued or running operation.
+func (s *Server) handleOperations(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/operations/")
+	if id == r.URL.Path {
+		id = ""
+	}
+	if r.Method == http.MethodPatch && id != "" {
+		s.handleAdjustOperation(w, r, id)
+		return
+	}
+	if r.Method == http.MethodDelete && id != "" {
+		s.handleCancelOperation(w, r, id)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if id != "" {
+		op, ok := s.agent.Operation(id)
+		if !ok {
+			http.Error(w, "Operation not found", http.StatusNotFound)
+			return
+		}
+		respondJSON(w, http.StatusOK, op)
+		return
+	}
+
+	ops := s.agent.Operations()
+	sort.Slice(ops, func(i, j int) bool { return ops[i].QueuedAt.Before(ops[j].QueuedAt) })
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"operations": ops,
+		"count":      len(ops),
+	})
+}
+
+// handleAdjustOperation applies {"limit_rate", "io_nice"}; fields left out
+// keep their current value
+func (s *Server) handleAdjustOperation(w http.ResponseWriter, r *http.Request, id string) {
+	op, ok := s.agent.Operation(id)
+	if !ok {
+		http.Error(w, "Operation not found", http.StatusNotFound)
+		return
+	}
+	var set agent.ThrottleSettings
+	if op.Throttle != nil {
+		set = *op.Throttle
+	}
+	if err := json.NewDecoder(r.Body).Decode(&set); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if set.LimitRate < 0 {
+		http.Error(w, "limit_rate must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	op, err := s.agent.AdjustOperation(id, set)
+	switch {
+	case errors.Is(err, agent.ErrOperationNotFound):
+		http.Error(w, "Operation not found", http.StatusNotFound)
+	case errors.Is(err, agent.ErrNotThrottled):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		respondJSON(w, http.StatusOK, op)
+	}
+}
+
+// handleCancelOperation cancels an operation, answering 202 while a running
+// one winds down
+func (s *Server) handleCancelOperation(w http.ResponseWriter, r *http.Request, id string) {
+	op, err := s.agent.CancelOperation(id)
+	switch {
+	case errors.Is(err, agent.ErrOperationNotFound):
+		http.Error(w, "Operation not found", http.StatusNotFound)
+	case errors.Is(err, agent.ErrOperationFinished):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	case op.State == agent.OpRunning:
+		respondJSON(w, http.StatusAccepted, op)
+	default:
+		respondJSON(w, http.StatusOK, op)
+	}
+}
+
+// handleGCStatus returns the GC counters, the last ?limit runs (default 10)
+// and when the next one is scheduled
 func (s *Server) handleGCStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	st, err := s.agent.GCStatus(limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load GC history: %v", err), http.StatusInternalServerError)
+		return
+	}
+
 	respondJSON(w, http.StatusOK, map[string]interface{}{
 		"gc_runs":        s.metrics.GarbageCollectionRuns.Load(),
 		"blocks_deleted": s.metrics.BlocksDeleted.Load(),
+		"last_run":       st.LastRun,
+		"next_run":       st.NextRun,
+		"history":        st.History,
+	})
+}
+
+// handleForecast projects repository usage over ?months (default 12) under
+// the configured retention and each ?retention_days given
+func (s *Server) handleForecast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	months := 12
+	if v := q.Get("months"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 120 {
+			http.Error(w, "months must be a number from 1 to 120", http.StatusBadRequest)
+			return
+		}
+		months = n
+	}
+	var whatIf []int
+	for _, v := range q["retention_days"] {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "retention_days must be a positive number", http.StatusBadRequest)
+			return
+		}
+		whatIf = append(whatIf, n)
+	}
+
+	f, err := s.agent.Forecast(months, whatIf)
+	if errors.Is(err, gc.ErrShortHistory) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to forecast usage: %v", err), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, http.StatusOK, f)
+}
+
+// handleLogs returns the entries logged after the RFC 3339 time since, oldest
+// first, at or above level
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			http.Error(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	min := monitoring.DebugLevel
+	if v := q.Get("level"); v != "" {
+		l, ok := monitoring.ParseLevel(v)
+		if !ok {
+			http.Error(w, "level must be debug, info, warn or error", http.StatusBadRequest)
+			return
+		}
+		min = l
+	}
+
+	entries := make([]monitoring.LogEntry, 0)
+	for _, e := range monitoring.RecentLogs(since) {
+		if l, _ := monitoring.ParseLevel(e.Level); l >= min {
+			entries = append(entries, e)
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"entries": entries,
 	})
 }
 
@@ -308,12 +748,29 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 	health := s.healthChecker.GetHealth()
 
 	respondJSON(w, http.StatusOK, map[string]interface{}{
-		"health": health,
-		"p2p_id": s.agent.P2P.Host.ID().String(),
-		"peers":  len(s.agent.P2P.Host.Network().Peers()),
+		"health":        health,
+		"p2p_id":        s.agent.P2P.Host.ID().String(),
+		"repository_id": s.agent.RepoID,
+		"peers":         len(s.agent.P2P.Host.Network().Peers()),
 	})
 }
 
+// handleDebugState returns goroutine stacks, connections, operations, queue
+// depths and recent errors in one bundle for bug reports
+func (s *Server) handleDebugState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	st, err := s.agent.DebugState()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to capture debug state: %v", err), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, http.StatusOK, st)
+}
+
 // handlePeers returns connected peers
 func (s *Server) handlePeers(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -327,17 +784,420 @@ func (s *Server) handlePeers(w http.ResponseWriter, r *http.Request) {
 	for _, peerID := range peers {
 		peerInfo := s.agent.P2P.Host.Peerstore().PeerInfo(peerID)
 		peerList = append(peerList, map[string]interface{}{
-			"id":    peerID.String(),
-			"addrs": peerInfo.Addrs,
+			"id":      peerID.String(),
+			"addrs":   peerInfo.Addrs,
+			"latency": s.agent.P2P.Host.Peerstore().LatencyEWMA(peerID),
+			"score":   s.agent.P2P.Scorer.Score(peerID),
+			"pinned":  s.agent.P2P.Pins.IsPinned(peerID),
+		})
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"peers":  peerList,
+		"count":  len(peerList),
+		"pinned": s.agent.P2P.Pins.Status(),
+	})
+}
+
+// handleConnectPeer connects to a peer and adds it to the stored peer list
+func (s *Server) handleConnectPeer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Addr  string `json:"addr"`
+		Force bool   `json:"force"` // add back a peer removed for abuse
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Addr == "" {
+		http.Error(w, "addr is required", http.StatusBadRequest)
+		return
+	}
+
+	pid, err := s.agent.AddPeer(r.Context(), req.Addr, req.Force)
+	if errors.Is(err, agent.ErrPeerRemovedForAbuse) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{
+		"status":  "connected",
+		"peer_id": pid.String(),
+	})
+}
+
+// handleRemovePeer archives a peer out of the stored peer list, and out of
+// every node's with broadcast
+func (s *Server) handleRemovePeer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		PeerID    string `json:"peer_id"`
+		Reason    string `json:"reason"`
+		Abuse     bool   `json:"abuse"`
+		Broadcast bool   `json:"broadcast"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PeerID == "" {
+		http.Error(w, "peer_id is required", http.StatusBadRequest)
+		return
+	}
+
+	if !req.Broadcast {
+		if err := s.agent.ForgetPeer(req.PeerID, req.Reason, req.Abuse); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]string{"status": "removed", "peer_id": req.PeerID})
+		return
+	}
+
+	opID, err := s.agent.RemovePeer(req.PeerID, req.Reason, req.Abuse)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if opID != "" {
+		respondJSON(w, http.StatusAccepted, map[string]string{
+			"status":       "pending_approval",
+			"operation_id": opID,
+			"peer_id":      req.PeerID,
 		})
+		return
 	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "removed", "peer_id": req.PeerID})
+}
 
+// handleRemovedPeers lists archived peers with their removal history
+func (s *Server) handleRemovedPeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	removed, err := s.agent.RemovedPeers()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load removed peers: %v", err), http.StatusInternalServerError)
+		return
+	}
 	respondJSON(w, http.StatusOK, map[string]interface{}{
-		"peers": peerList,
-		"count": len(peerList),
+		"removed": removed,
+		"count":   len(removed),
 	})
 }
 
+// handleRestorePeer puts an archived peer back on the stored peer list
+func (s *Server) handleRestorePeer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		PeerID string `json:"peer_id"`
+		Force  bool   `json:"force"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PeerID == "" {
+		http.Error(w, "peer_id is required", http.StatusBadRequest)
+		return
+	}
+
+	rp, err := s.agent.RestorePeer(req.PeerID, req.Force)
+	switch {
+	case errors.Is(err, agent.ErrPeerNotRemoved):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, agent.ErrPeerRemovedForAbuse):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		respondJSON(w, http.StatusOK, rp)
+	}
+}
+
+// handleSeeding returns the progress of initial seeding runs
+func (s *Server) handleSeeding(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	seeds, err := s.agent.SeedStatus()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load seeding status: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	runs := make([]map[string]interface{}, 0, len(seeds))
+	for _, p := range seeds {
+		runs = append(runs, map[string]interface{}{
+			"progress":    p,
+			"percent":     p.Percent(),
+			"rate_bps":    p.Rate(),
+			"eta_seconds": p.ETA().Seconds(),
+		})
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"runs":  runs,
+		"count": len(runs),
+	})
+}
+
+// handleMirrors returns the replication state of configured mirrors
+func (s *Server) handleMirrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statuses, err := s.agent.MirrorStatuses()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load mirror status: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"mirrors": statuses,
+		"count":   len(statuses),
+	})
+}
+
+// handlePlacement measures our snapshots' copies against their placement policy
+func (s *Server) handlePlacement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := s.agent.PlacementReport()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to check placement: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	unsatisfied := 0
+	for _, st := range report {
+		if !st.Satisfied() {
+			unsatisfied++
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"snapshots":   report,
+		"count":       len(report),
+		"unsatisfied": unsatisfied,
+	})
+}
+
+// handleMaintenance returns the state of every maintenance task
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tasks, err := s.agent.Maintenance.Status()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load maintenance status: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	cfg := s.agent.Config.Maintenance
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"window": cfg.Window,
+		"budget": cfg.Budget.String(),
+		"tasks":  tasks,
+	})
+}
+
+// handleApprovals lists operations awaiting a second admin
+func (s *Server) handleApprovals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ops, err := s.agent.Approvals.Pending()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"operations": ops,
+		"count":      len(ops),
+	})
+}
+
+// handleApproveOperation approves a pending operation with this node's key
+func (s *Server) handleApproveOperation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		OperationID string `json:"operation_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.agent.ApproveOperation(req.OperationID); err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, approval.ErrOperationNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, auth.ErrNotAuthorized):
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{
+		"status":       "approved",
+		"operation_id": req.OperationID,
+	})
+}
+
+// handleShares lists share links, including expired and revoked ones
+func (s *Server) handleShares(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	links, err := s.agent.Shares()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list share links: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"shares": links,
+		"count":  len(links),
+	})
+}
+
+// handleCreateShare mints a share link for {"snapshot_id", "path", "ttl"};
+// path, a file or directory in the snapshot, is optional, and ttl is a
+// duration such as "72h" that defaults to a day
+func (s *Server) handleCreateShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		SnapshotID string `json:"snapshot_id"`
+		Path       string `json:"path"`
+		TTL        string `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SnapshotID == "" {
+		http.Error(w, "snapshot_id is required", http.StatusBadRequest)
+		return
+	}
+	ttl := 24 * time.Hour
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			http.Error(w, "ttl must be a duration, e.g. 72h", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	if ttl <= 0 || ttl > s.agent.Config.API.ShareMaxTTL {
+		http.Error(w, fmt.Sprintf("ttl must be positive and at most %s", s.agent.Config.API.ShareMaxTTL), http.StatusBadRequest)
+		return
+	}
+
+	link, token, err := s.agent.CreateShare(req.SnapshotID, req.Path, ttl)
+	switch {
+	case errors.Is(err, versioning.ErrSnapshotNotFound):
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+	case errors.Is(err, versioning.ErrFileNotInSnapshot):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, versioning.ErrForeignSnapshot):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		respondJSON(w, http.StatusCreated, map[string]interface{}{
+			"share": link,
+			"token": token,
+			"path":  "/share?token=" + url.QueryEscape(token),
+		})
+	}
+}
+
+// handleRevokeShare revokes the share link {"id"}
+func (s *Server) handleRevokeShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+
+	link, err := s.agent.RevokeShare(req.ID)
+	if errors.Is(err, agent.ErrShareNotFound) {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, http.StatusOK, link)
+}
+
+// handleShareDownload streams what a valid share token covers
+func (s *Server) handleShareDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	link, snap, err := s.agent.OpenShare(r.URL.Query().Get("token"), r.RemoteAddr)
+	switch {
+	case errors.Is(err, agent.ErrShareExpired), errors.Is(err, agent.ErrShareRevoked):
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	case errors.Is(err, agent.ErrShareInvalid), errors.Is(err, agent.ErrShareNotFound),
+		errors.Is(err, versioning.ErrSnapshotNotFound):
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, "Failed to open share link", http.StatusInternalServerError)
+		return
+	}
+
+	// A large snapshot takes longer to send than the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if link.Archive() {
+		w.Header().Set("Content-Type", "application/x-tar")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": link.Name}))
+	w.Header().Set("Cache-Control", "no-store")
+	// The status is already sent if this fails; ServeShare logs the failure
+	s.agent.ServeShare(r.Context(), link, snap, w, r.RemoteAddr)
+}
+
 // respondJSON writes a JSON response
 func respondJSON(w http.ResponseWriter, statusCode int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/config"
+	"github.com/hoangsonww/backupagent/internal/agent"
+	"github.com/hoangsonww/backupagent/internal/approval"
+	"github.com/hoangsonww/backupagent/internal/auth"
+	"github.com/hoangsonww/backupagent/internal/crypto"
+	"github.com/hoangsonww/backupagent/internal/gc"
+)
+
+const testToken = "test-api-token-0123456789"
+
+// openAgent opens the repository under dir with acl added to its config
+func openAgent(t *testing.T, dir, acl string) *agent.Agent {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	cfgPath := filepath.Join(dir, "config.yaml")
+	yaml := fmt.Sprintf("repository_path: %s\nlisten_port: %d\napi:\n  token: %s\n%s",
+		filepath.Join(dir, "repo"), port, testToken, acl)
+	if err := os.WriteFile(cfgPath, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ag, err := agent.New(cfg, "test-passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ag
+}
+
+// newTestServer returns an API server over a fresh repository; with
+// twoPerson its node is one of two admins that must both approve
+// destructive operations
+func newTestServer(t *testing.T, twoPerson bool) (*Server, *agent.Agent) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "repo"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	ag := openAgent(t, dir, "")
+	if twoPerson {
+		// The node's key exists once the repository does
+		self := auth.PubKeyToString(ag.SignerPub)
+		if err := ag.Close(); err != nil {
+			t.Fatal(err)
+		}
+		other, _, err := crypto.GenerateEd25519Keypair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ag = openAgent(t, dir, fmt.Sprintf("acl:\n  two_person_rule: true\n  admins: [%q, %q]\n", self, auth.PubKeyToString(other)))
+	}
+	t.Cleanup(func() { ag.Close() })
+	collector := gc.NewCollector(ag.DB, ag.Store, 30, gc.Policy{}, time.Hour, time.Hour)
+	return NewServer(ag, collector, 0), ag
+}
+
+func serve(s *Server, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestShareDownloadWithoutToken(t *testing.T) {
+	s, ag := newTestServer(t, false)
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.MkdirAll(src, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("shared content\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := ag.CreateAndSaveSnapshot(context.Background(), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, token, err := ag.CreateShare(snap.ID, "a.txt", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The link's own signature stands in for the API token
+	w := serve(s, httptest.NewRequest(http.MethodGet, "/share?token="+url.QueryEscape(token), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("download without a bearer token: %d %s", w.Code, w.Body)
+	}
+	if body, _ := io.ReadAll(w.Body); string(body) != "shared content\n" {
+		t.Fatalf("downloaded %q", body)
+	}
+
+	// A token with every character of its signature changed, one without
+	// a signature and none at all
+	claims, sig, _ := strings.Cut(token, ".")
+	forged := claims + "." + strings.Map(func(r rune) rune {
+		if r == 'A' {
+			return 'B'
+		}
+		return 'A'
+	}, sig)
+	for _, bad := range []string{forged, claims, ""} {
+		w := serve(s, httptest.NewRequest(http.MethodGet, "/share?token="+url.QueryEscape(bad), nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("download with token %q: %d, want %d", bad, w.Code, http.StatusNotFound)
+		}
+	}
+
+	// Everything else still needs the API token
+	if w := serve(s, httptest.NewRequest(http.MethodGet, "/api/v1/shares", nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("share list without a bearer token: %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestGCNeedsApproval(t *testing.T) {
+	s, ag := newTestServer(t, true)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/gc/run", nil)
+	r.Header.Set("Authorization", "Bearer "+testToken)
+	w := serve(s, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("gc run: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Status      string `json:"status"`
+		OperationID string `json:"operation_id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "pending_approval" || resp.OperationID == "" {
+		t.Fatalf("gc run answered %+v, want a pending operation", resp)
+	}
+
+	ops, err := ag.Approvals.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || ops[0].ID != resp.OperationID || ops[0].Proposal.Kind != approval.KindPrune {
+		t.Fatalf("pending operations %+v, want the proposed prune", ops)
+	}
+	// Nothing was collected while the second admin has not approved
+	if running := ag.Operations(); len(running) != 0 {
+		t.Fatalf("gc run admitted %d operations before approval", len(running))
+	}
+}
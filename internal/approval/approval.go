@@ -0,0 +1,261 @@
+package approval
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/auth"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/protocol"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Operation kinds gated by the two-person rule
+const (
+	KindPeerRemove     = "peer_remove"
+	KindAdminKeyUpdate = "admin_key_update"
+	KindPrune          = "prune"
+)
+
+// RequiredApprovals is the number of distinct admins that must sign an operation.
+const RequiredApprovals = 2
+
+// legacyPendingPrefix keys operations kept in the ACLs bucket, before they
+// moved to their own sealed bucket
+const legacyPendingPrefix = "pending-op/"
+
+var (
+	ErrOperationNotFound = errors.New("pending operation not found")
+	ErrOperationExpired  = errors.New("pending operation expired")
+)
+
+// Operation is a proposal together with the admin signatures collected so far.
+type Operation struct {
+	ID        string                     `json:"id"`
+	Proposal  protocol.OperationProposal `json:"proposal"`
+	Approvals map[string]string          `json:"approvals"` // signer pub -> signature
+	CreatedAt time.Time                  `json:"created_at"`
+}
+
+// Manager tracks pending destructive operations in the sealed pending_ops
+// bucket until enough distinct admins have signed them.
+type Manager struct {
+	mu     sync.Mutex
+	db     *persistence.DB
+	acl    *auth.ACL
+	ttl    time.Duration
+	logger *monitoring.Logger
+}
+
+// NewManager creates an approval manager
+func NewManager(db *persistence.DB, acl *auth.ACL, ttl time.Duration) *Manager {
+	return &Manager{
+		db:     db,
+		acl:    acl,
+		ttl:    ttl,
+		logger: monitoring.GetLogger(),
+	}
+}
+
+// Propose records a new proposal. The proposer must be an active admin and
+// their signature counts as the first approval.
+func (m *Manager) Propose(p *protocol.OperationProposal) (*Operation, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	proposedAt, _ := time.Parse(time.RFC3339, p.ProposedAt)
+	if time.Since(proposedAt) > m.ttl {
+		return nil, ErrOperationExpired
+	}
+	if !m.acl.IsAdmin(p.ProposerPub) {
+		return nil, auth.ErrNotAuthorized
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := p.ID()
+	op, err := m.load(id)
+	if err == nil {
+		return op, nil
+	}
+	if !errors.Is(err, ErrOperationNotFound) {
+		return nil, err
+	}
+	op = &Operation{
+		ID:        id,
+		Proposal:  *p,
+		Approvals: map[string]string{p.ProposerPub: p.Signature},
+		CreatedAt: proposedAt,
+	}
+	if err := m.save(op); err != nil {
+		return nil, err
+	}
+	m.logger.WithFields(map[string]interface{}{
+		"operation_id": id,
+		"kind":         p.Kind,
+		"proposer":     p.ProposerPub,
+	}).Warn("Destructive operation proposed; awaiting second admin approval")
+	return op, nil
+}
+
+// Approve adds an admin signature to a pending operation. It reports whether
+// the operation now has enough distinct active-admin approvals to execute.
+func (m *Manager) Approve(a *protocol.OperationApproval) (*Operation, bool, error) {
+	if err := a.Validate(); err != nil {
+		return nil, false, err
+	}
+	if !m.acl.IsAdmin(a.SignerPub) {
+		return nil, false, auth.ErrNotAuthorized
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	op, err := m.load(a.OperationID)
+	if err != nil {
+		return nil, false, err
+	}
+	if time.Since(op.CreatedAt) > m.ttl {
+		m.delete(op.ID)
+		return nil, false, ErrOperationExpired
+	}
+	op.Approvals[a.SignerPub] = a.Signature
+	if err := m.save(op); err != nil {
+		return nil, false, err
+	}
+	return op, m.approvedBy(op) >= RequiredApprovals, nil
+}
+
+// Complete removes an operation once it has been executed.
+func (m *Manager) Complete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.delete(id)
+}
+
+// Pending returns unexpired operations, oldest first. Expired entries are purged.
+func (m *Manager) Pending() ([]*Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ops, expired []*Operation
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b, err := m.db.Sealed(tx, persistence.BucketPendingOps)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var op Operation
+			if err := json.Unmarshal(v, &op); err != nil {
+				return err
+			}
+			if time.Since(op.CreatedAt) > m.ttl {
+				expired = append(expired, &op)
+				return nil
+			}
+			ops = append(ops, &op)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range expired {
+		if err := m.delete(op.ID); err != nil {
+			m.logger.WithError(err).Warnf("Failed to purge expired operation %s", op.ID)
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].CreatedAt.Before(ops[j].CreatedAt) })
+	return ops, nil
+}
+
+// approvedBy counts signatures from distinct admins that are still active.
+func (m *Manager) approvedBy(op *Operation) int {
+	n := 0
+	for signer := range op.Approvals {
+		if m.acl.IsAdmin(signer) {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *Manager) load(id string) (*Operation, error) {
+	var op Operation
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b, err := m.db.Sealed(tx, persistence.BucketPendingOps)
+		if err != nil {
+			return err
+		}
+		v, err := b.Get([]byte(id))
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return ErrOperationNotFound
+		}
+		return json.Unmarshal(v, &op)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+func (m *Manager) save(op *Operation) error {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return fmt.Errorf("failed to encode operation: %w", err)
+	}
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b, err := m.db.Sealed(tx, persistence.BucketPendingOps)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(op.ID), data)
+	})
+}
+
+func (m *Manager) delete(id string) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b, err := m.db.Sealed(tx, persistence.BucketPendingOps)
+		if err != nil {
+			return err
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// MigratePending moves operations stored in the ACLs bucket by earlier
+// versions into the sealed pending_ops bucket, and returns how many moved.
+// The DB must be sealed first.
+func MigratePending(db *persistence.DB) (int, error) {
+	moved := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := db.Sealed(tx, persistence.BucketPendingOps)
+		if err != nil {
+			return err
+		}
+		acls := tx.Bucket([]byte(persistence.BucketACLs))
+		prefix := []byte(legacyPendingPrefix)
+		c := acls.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Seek(prefix) {
+			if err := b.Put(k[len(prefix):], v); err != nil {
+				return err
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			moved++
+		}
+		return nil
+	})
+	return moved, err
+}
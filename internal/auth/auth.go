@@ -2,12 +2,16 @@ package auth
 
 import (
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/hoangsonww/backupagent/internal/crypto"
 )
 
 type ACL struct {
-	Admins map[string]bool // base64-encoded pub keys
+	mu      sync.RWMutex
+	Admins  map[string]bool      // base64-encoded pub keys
+	revoked map[string]time.Time // pub key -> revocation effective time
 }
 
 // Load from list
@@ -16,11 +20,25 @@ func NewACL(admins []string) *ACL {
 	for _, a := range admins {
 		m[a] = true
 	}
-	return &ACL{Admins: m}
+	return &ACL{Admins: m, revoked: make(map[string]time.Time)}
 }
 
+// IsAdmin reports whether pubKey is an admin that has not been revoked.
 func (a *ACL) IsAdmin(pubKey string) bool {
-	return a.Admins[pubKey]
+	return a.IsAdminAt(pubKey, time.Now())
+}
+
+// IsAdminAt reports whether pubKey held admin rights at time t.
+func (a *ACL) IsAdminAt(pubKey string, t time.Time) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if !a.Admins[pubKey] {
+		return false
+	}
+	if revokedAt, ok := a.revoked[pubKey]; ok && !t.Before(revokedAt) {
+		return false
+	}
+	return true
 }
 
 // Peer authentication: verifying signed messages
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/protocol"
+	bolt "go.etcd.io/bbolt"
+)
+
+// MaxUpdateSkew bounds how far IssuedAt of a live admin update may drift from now.
+const MaxUpdateSkew = 10 * time.Minute
+
+const keyUpdatePrefix = "update/"
+
+var (
+	// ErrUpdateApplied is returned when an admin update changes nothing.
+	ErrUpdateApplied = errors.New("admin update already applied")
+	// ErrLastAdmin prevents revoking the only remaining active admin.
+	ErrLastAdmin = errors.New("cannot revoke the last active admin")
+)
+
+// RevocationEntry describes one revoked admin key.
+type RevocationEntry struct {
+	AdminPub  string    `json:"admin_pub"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// Apply validates and applies a signed admin key update. Live updates arriving
+// from the network must be fresh; replayed updates from storage skip that check.
+func (a *ACL) Apply(upd *protocol.AdminKeyUpdate, live bool) error {
+	if err := upd.Validate(); err != nil {
+		return err
+	}
+	issuedAt, _ := time.Parse(time.RFC3339, upd.IssuedAt)
+	effectiveAt, _ := time.Parse(time.RFC3339, upd.EffectiveAt)
+
+	if live {
+		if skew := time.Since(issuedAt); skew > MaxUpdateSkew || skew < -MaxUpdateSkew {
+			return fmt.Errorf("admin update issued_at outside allowed skew: %s", upd.IssuedAt)
+		}
+	}
+	if !a.IsAdminAt(upd.SignerPub, issuedAt) {
+		return ErrNotAuthorized
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch upd.Action {
+	case protocol.AdminActionAdd:
+		if _, ok := a.revoked[upd.AdminPub]; ok {
+			return fmt.Errorf("admin key %s was revoked and cannot be re-added", upd.AdminPub)
+		}
+		if a.Admins[upd.AdminPub] {
+			return ErrUpdateApplied
+		}
+		a.Admins[upd.AdminPub] = true
+	case protocol.AdminActionRevoke:
+		if !a.hasOtherActiveLocked(upd.AdminPub) {
+			return ErrLastAdmin
+		}
+		if !a.revokeLocked(upd.AdminPub, effectiveAt) {
+			return ErrUpdateApplied
+		}
+	case protocol.AdminActionRotate:
+		if _, ok := a.revoked[upd.NewAdminPub]; ok {
+			return fmt.Errorf("replacement key %s was revoked", upd.NewAdminPub)
+		}
+		added := !a.Admins[upd.NewAdminPub]
+		a.Admins[upd.NewAdminPub] = true
+		if !a.revokeLocked(upd.AdminPub, effectiveAt) && !added {
+			return ErrUpdateApplied
+		}
+	}
+	return nil
+}
+
+// revokeLocked records a revocation, keeping the earliest effective time.
+// Returns false when nothing changed.
+func (a *ACL) revokeLocked(pub string, at time.Time) bool {
+	if prev, ok := a.revoked[pub]; ok && !at.Before(prev) {
+		return false
+	}
+	a.revoked[pub] = at
+	return true
+}
+
+// hasOtherActiveLocked reports whether an admin other than pub is still active.
+func (a *ACL) hasOtherActiveLocked(pub string) bool {
+	now := time.Now()
+	for admin := range a.Admins {
+		if admin == pub {
+			continue
+		}
+		if revokedAt, ok := a.revoked[admin]; !ok || now.Before(revokedAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// ActiveAdmins returns the admin keys that are currently not revoked.
+func (a *ACL) ActiveAdmins() []string {
+	now := time.Now()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	admins := make([]string, 0, len(a.Admins))
+	for pub := range a.Admins {
+		if revokedAt, ok := a.revoked[pub]; ok && !now.Before(revokedAt) {
+			continue
+		}
+		admins = append(admins, pub)
+	}
+	sort.Strings(admins)
+	return admins
+}
+
+// Revocations returns revoked keys ordered by revocation time.
+func (a *ACL) Revocations() []RevocationEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	entries := make([]RevocationEntry, 0, len(a.revoked))
+	for pub, at := range a.revoked {
+		entries = append(entries, RevocationEntry{AdminPub: pub, RevokedAt: at})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].RevokedAt.Before(entries[j].RevokedAt) })
+	return entries
+}
+
+// SaveKeyUpdate appends a signed admin update to the ACLs bucket.
+func SaveKeyUpdate(db *persistence.DB, upd *protocol.AdminKeyUpdate) error {
+	data, err := json.Marshal(upd)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(persistence.BucketACLs))
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(fmt.Sprintf("%s%020d", keyUpdatePrefix, seq)), data)
+	})
+}
+
+// LoadKeyUpdates returns the stored signed admin updates in the order they were accepted.
+func LoadKeyUpdates(db *persistence.DB) ([]*protocol.AdminKeyUpdate, error) {
+	var updates []*protocol.AdminKeyUpdate
+	err := db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(persistence.BucketACLs)).Cursor()
+		prefix := []byte(keyUpdatePrefix)
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var upd protocol.AdminKeyUpdate
+			if err := json.Unmarshal(v, &upd); err != nil {
+				return err
+			}
+			updates = append(updates, &upd)
+		}
+		return nil
+	})
+	return updates, err
+}
@@ -0,0 +1,299 @@
+// Package bundle builds and opens recovery bundles: a restore binary with one
+// snapshot appended to it, so whoever holds the passphrase can restore the
+// snapshot by running a single file, without a repository, configuration or
+// network. The snapshot record is encrypted under the repository key; the
+// chunks are appended in their stored, encrypted form. Only the key salt and
+// derivation are in the clear.
+//
+// Layout after the executable:
+//
+//	chunks | sealed manifest | header JSON | trailer
+//
+// The trailer is start(8) | manifest length(8) | header length(4) | magic(8),
+// so a bundle is recognised from its last bytes and the executable part is
+// left untouched.
+package bundle
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/compression"
+	"github.com/hoangsonww/backupagent/internal/crypto"
+	"github.com/hoangsonww/backupagent/internal/fspath"
+	"github.com/hoangsonww/backupagent/internal/metabackup"
+	"github.com/hoangsonww/backupagent/internal/snapshots"
+	"github.com/hoangsonww/backupagent/internal/storage"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+const (
+	// Version is the bundle format
+	Version = 1
+
+	magic       = "SVBUNDL1"
+	trailerSize = 8 + 8 + 4 + 8
+	nonceSize   = 12
+)
+
+var (
+	// ErrNoBundle means the file has no bundle appended
+	ErrNoBundle = errors.New("no recovery bundle attached")
+	// ErrWrongPassphrase means the manifest did not decrypt
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+	// ErrLocked is returned by Restore before Unlock succeeded
+	ErrLocked = errors.New("bundle is locked")
+)
+
+// Header is the unencrypted part of a bundle.
+type Header struct {
+	Version int       `json:"version"`
+	KDF     string    `json:"kdf"`
+	Salt    []byte    `json:"salt"`
+	Created time.Time `json:"created"`
+	Chunks  int       `json:"chunks"`
+}
+
+// Manifest is the encrypted part of a bundle.
+type Manifest struct {
+	Snapshot *versioning.Snapshot `json:"snapshot"`
+	Sizes    []int64              `json:"sizes"`           // stored size of each chunk, in snapshot order
+	Dicts    []*compression.Dict  `json:"dicts,omitempty"` // the repository's compression dictionaries
+}
+
+// Create writes the executable read from stub followed by snap, whose chunks
+// in stored form are read with get, and the dictionaries they may be
+// compressed against. seal encrypts like storage.Store.Seal, under the
+// repository key derived with crypto.DeriveKey from salt.
+func Create(w io.Writer, stub io.Reader, snap *versioning.Snapshot, dicts []*compression.Dict, salt []byte, seal func([]byte) ([]byte, error), get func(hash string) ([]byte, error)) error {
+	start, err := io.Copy(w, stub)
+	if err != nil {
+		return err
+	}
+	man := Manifest{Snapshot: snap, Sizes: make([]int64, len(snap.Chunks)), Dicts: dicts}
+	for i, h := range snap.Chunks {
+		data, err := get(h)
+		if err != nil {
+			return fmt.Errorf("chunk %s: %w", h, err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		man.Sizes[i] = int64(len(data))
+	}
+
+	plain, err := json.Marshal(man)
+	if err != nil {
+		return err
+	}
+	sealed, err := seal(plain)
+	if err != nil {
+		return err
+	}
+	header, err := json.Marshal(Header{
+		Version: Version,
+		KDF:     metabackup.KDF,
+		Salt:    salt,
+		Created: time.Now().UTC(),
+		Chunks:  len(snap.Chunks),
+	})
+	if err != nil {
+		return err
+	}
+
+	trailer := make([]byte, trailerSize)
+	binary.BigEndian.PutUint64(trailer[0:8], uint64(start))
+	binary.BigEndian.PutUint64(trailer[8:16], uint64(len(sealed)))
+	binary.BigEndian.PutUint32(trailer[16:20], uint32(len(header)))
+	copy(trailer[20:], magic)
+	for _, b := range [][]byte{sealed, header, trailer} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bundle is an opened recovery bundle.
+type Bundle struct {
+	Header Header
+
+	f          *os.File
+	start      int64 // offset of the first chunk
+	manifestAt int64
+	sealed     []byte
+	key        []byte
+	manifest   *Manifest
+}
+
+// Open opens the bundle attached to the file at path, returning ErrNoBundle
+// if there is none.
+func Open(path string) (*Bundle, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := open(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func open(f *os.File) (*Bundle, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size < trailerSize {
+		return nil, ErrNoBundle
+	}
+	trailer := make([]byte, trailerSize)
+	if _, err := f.ReadAt(trailer, size-trailerSize); err != nil {
+		return nil, err
+	}
+	if string(trailer[20:]) != magic {
+		return nil, ErrNoBundle
+	}
+	start := int64(binary.BigEndian.Uint64(trailer[0:8]))
+	sealedLen := int64(binary.BigEndian.Uint64(trailer[8:16]))
+	headerLen := int64(binary.BigEndian.Uint32(trailer[16:20]))
+	headerAt := size - trailerSize - headerLen
+	manifestAt := headerAt - sealedLen
+	if start < 0 || sealedLen < nonceSize || manifestAt < start {
+		return nil, fmt.Errorf("recovery bundle is truncated or corrupt")
+	}
+
+	b := &Bundle{f: f, start: start, manifestAt: manifestAt}
+	header := make([]byte, headerLen)
+	if _, err := f.ReadAt(header, headerAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(header, &b.Header); err != nil {
+		return nil, fmt.Errorf("recovery bundle header: %w", err)
+	}
+	if b.Header.Version != Version {
+		return nil, fmt.Errorf("unsupported recovery bundle version %d", b.Header.Version)
+	}
+	if b.Header.KDF != metabackup.KDF || len(b.Header.Salt) == 0 {
+		return nil, fmt.Errorf("recovery bundle uses unknown key derivation %q", b.Header.KDF)
+	}
+	b.sealed = make([]byte, sealedLen)
+	if _, err := f.ReadAt(b.sealed, manifestAt); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Close closes the bundle file.
+func (b *Bundle) Close() error {
+	return b.f.Close()
+}
+
+// Unlock derives the repository key from passphrase, decrypts the manifest
+// with it and registers the compression dictionaries it carries.
+func (b *Bundle) Unlock(passphrase string) (*Manifest, error) {
+	key := crypto.DeriveKey(passphrase, b.Header.Salt)
+	plain, err := crypto.Decrypt(b.sealed[nonceSize:], key, b.sealed[:nonceSize])
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	var man Manifest
+	if err := json.Unmarshal(plain, &man); err != nil {
+		return nil, fmt.Errorf("recovery bundle manifest: %w", err)
+	}
+	if man.Snapshot == nil || len(man.Sizes) != len(man.Snapshot.Chunks) {
+		return nil, fmt.Errorf("recovery bundle manifest is inconsistent")
+	}
+	var total int64
+	for _, n := range man.Sizes {
+		if n < nonceSize {
+			return nil, fmt.Errorf("recovery bundle manifest is inconsistent")
+		}
+		total += n
+	}
+	if b.start+total != b.manifestAt {
+		return nil, fmt.Errorf("recovery bundle is truncated or corrupt")
+	}
+	for _, d := range man.Dicts {
+		if err := compression.RegisterDict(d); err != nil {
+			return nil, fmt.Errorf("recovery bundle manifest: %w", err)
+		}
+	}
+	b.key, b.manifest = key, &man
+	return &man, nil
+}
+
+// Restore decrypts the snapshot into target the way the agent restores it,
+// checking every chunk against its hash, and returns the restored path.
+// progress, if set, is called after each chunk.
+func (b *Bundle) Restore(target string, progress func(done, total int, bytes int64)) (string, error) {
+	if b.manifest == nil {
+		return "", ErrLocked
+	}
+	snap := b.manifest.Snapshot
+	target, err := fspath.Resolve(target)
+	if err != nil {
+		return "", err
+	}
+	files, err := snap.Files()
+	if err != nil {
+		return "", err
+	}
+	var (
+		w      io.Writer
+		output string
+		finish func() error
+	)
+	if files != nil {
+		tw, err := snapshots.NewTreeWriter(snap, target, nil)
+		if err != nil {
+			return "", err
+		}
+		w, output, finish = tw, tw.Root(), tw.Close
+	} else {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return "", err
+		}
+		output = filepath.Join(target, fmt.Sprintf("restored_%s.bin", snap.ID))
+		f, err := os.Create(output)
+		if err != nil {
+			return "", err
+		}
+		w, finish = f, f.Close
+	}
+	defer finish()
+
+	r := io.NewSectionReader(b.f, b.start, b.manifestAt-b.start)
+	var written int64
+	for i, h := range snap.Chunks {
+		stored := make([]byte, b.manifest.Sizes[i])
+		if _, err := io.ReadFull(r, stored); err != nil {
+			return "", err
+		}
+		plain, err := storage.OpenChunk(stored, b.key)
+		if err != nil {
+			return "", fmt.Errorf("chunk %s: %w", h, err)
+		}
+		if hex.EncodeToString(crypto.Hash(plain)) != h {
+			return "", fmt.Errorf("chunk %s does not match its hash", h)
+		}
+		if _, err := w.Write(plain); err != nil {
+			return "", err
+		}
+		written += int64(len(plain))
+		if progress != nil {
+			progress(i+1, len(snap.Chunks), written)
+		}
+	}
+	return output, finish()
+}
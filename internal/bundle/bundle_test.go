@@ -0,0 +1,88 @@
+package bundle_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/bundle"
+	"github.com/hoangsonww/backupagent/internal/crypto"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	key := crypto.DeriveKey("correct horse", salt)
+	seal := func(plain []byte) ([]byte, error) {
+		enc, nonce, err := crypto.Encrypt(plain, key)
+		return append(nonce, enc...), err
+	}
+
+	stored := map[string][]byte{}
+	var want []byte
+	snap := &versioning.Snapshot{ID: "snap-1", Meta: map[string]string{"source": "/home/alice"}}
+	for _, part := range []string{"first chunk ", "second chunk ", "first chunk "} {
+		h := hex.EncodeToString(crypto.Hash([]byte(part)))
+		s, err := seal([]byte(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored[h] = s
+		snap.Chunks = append(snap.Chunks, h)
+		want = append(want, part...)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bundle")
+	var buf bytes.Buffer
+	get := func(h string) ([]byte, error) { return stored[h], nil }
+	if err := bundle.Create(&buf, bytes.NewReader([]byte("#!stub executable")), snap, nil, salt, seal, get); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("#!stub executable")) {
+		t.Fatal("bundle does not start with the stub")
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := bundle.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err := b.Restore(dir, nil); !errors.Is(err, bundle.ErrLocked) {
+		t.Fatalf("restore before unlock: %v", err)
+	}
+	if _, err := b.Unlock("wrong"); !errors.Is(err, bundle.ErrWrongPassphrase) {
+		t.Fatalf("unlock with wrong passphrase: %v", err)
+	}
+	man, err := b.Unlock("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if man.Snapshot.ID != "snap-1" {
+		t.Fatalf("manifest snapshot %q", man.Snapshot.ID)
+	}
+	output, err := b.Restore(filepath.Join(dir, "out"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("restored %q, want %q", got, want)
+	}
+
+	if err := os.WriteFile(path, []byte("plain executable"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bundle.Open(path); !errors.Is(err, bundle.ErrNoBundle) {
+		t.Fatalf("open plain executable: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package bundle
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// passphraseAttempts is how often Run asks before giving up
+const passphraseAttempts = 3
+
+// Self opens the bundle attached to the running executable.
+// An executable that cannot be read counts as having none.
+func Self() (*Bundle, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, ErrNoBundle
+	}
+	f, err := os.Open(exe)
+	if err != nil {
+		return nil, ErrNoBundle
+	}
+	b, err := open(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// Main runs the bundle attached to the executable, if there is one, and
+// exits. Restore binaries call it first thing in main.
+func Main() {
+	b, err := Self()
+	if errors.Is(err, ErrNoBundle) {
+		return
+	}
+	code := 0
+	if err == nil {
+		err = Run(b, os.Stdin, os.Stdout)
+		b.Close()
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		code = 1
+	}
+	if runtime.GOOS == "windows" {
+		// Keep the console of a double-clicked bundle open
+		fmt.Print("\nPress Enter to close.")
+		bufio.NewReader(os.Stdin).ReadString('\n')
+	}
+	os.Exit(code)
+}
+
+// Run walks the user through restoring the bundle: it asks for the
+// passphrase, unless SHADOWVAULT_PASSPHRASE is set, and for a folder to
+// restore into, then restores with a progress line.
+func Run(b *Bundle, in io.Reader, out io.Writer) error {
+	r := bufio.NewReader(in)
+	fmt.Fprintln(out, "ShadowVault recovery bundle")
+	fmt.Fprintf(out, "Created %s, %d chunks.\n\n", b.Header.Created.Local().Format(time.RFC1123), b.Header.Chunks)
+
+	var man *Manifest
+	pass := os.Getenv("SHADOWVAULT_PASSPHRASE")
+	for attempt := 0; man == nil; attempt++ {
+		if pass == "" || attempt > 0 {
+			if attempt >= passphraseAttempts {
+				return ErrWrongPassphrase
+			}
+			var err error
+			if pass, err = prompt(r, out, "Passphrase: "); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintln(out, "Unlocking...")
+		m, err := b.Unlock(pass)
+		if errors.Is(err, ErrWrongPassphrase) {
+			fmt.Fprintln(out, "That passphrase does not unlock this bundle.")
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		man = m
+	}
+	fmt.Fprintf(out, "\nSnapshot %s of %s, taken %s.\n", man.Snapshot.ID, man.Snapshot.Source(),
+		man.Snapshot.Timestamp.Time().Local().Format(time.RFC1123))
+
+	def, _ := filepath.Abs("restored")
+	target, err := prompt(r, out, fmt.Sprintf("Restore into folder [%s]: ", def))
+	if err != nil {
+		return err
+	}
+	if target == "" {
+		target = def
+	}
+
+	output, err := b.Restore(target, func(done, total int, bytes int64) {
+		fmt.Fprintf(out, "\r%d/%d chunks, %.1f MiB", done, total, float64(bytes)/(1<<20))
+	})
+	fmt.Fprintln(out)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Restored to %s\n", output)
+	return nil
+}
+
+// prompt prints question and reads one line
+func prompt(r *bufio.Reader, out io.Writer, question string) (string, error) {
+	fmt.Fprint(out, question)
+	line, err := r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// Instructions is the text shipped next to a bundle for whoever receives it.
+func Instructions(name string, snap *versioning.Snapshot) string {
+	return fmt.Sprintf(`Recovering your files
+=====================
+
+%[1]s contains an encrypted backup of %[2]s taken %[3]s,
+together with the program to restore it. Nothing else needs to be installed
+and no network connection is needed.
+
+1. Copy %[1]s to a computer with enough free disk space.
+2. Run it. On Linux or macOS, open a terminal in its folder and run
+   chmod +x %[1]s && ./%[1]s
+   On Windows, double-click it.
+3. Enter the passphrase you were given.
+4. Choose a folder to restore into, or press Enter for "restored".
+
+Without the passphrase the backup cannot be read by anyone. Keep this file and
+the passphrase apart.
+
+Snapshot: %[4]s
+`, name, snap.Source(), snap.Timestamp.Time().Local().Format("2 January 2006 15:04 MST"), snap.ID)
+}
@@ -0,0 +1,107 @@
+// Package chaos injects faults into the P2P and storage layers, so tests can
+// check that the agent recovers from lost messages, slow streams, damaged
+// chunks and interrupted writes. The injector only exists in binaries built
+// with the chaos tag; other builds get one that injects nothing.
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvVar names the environment variable an agent built with the chaos tag
+// reads its faults from, as ParseFaults takes them.
+const EnvVar = "BACKUPAGENT_CHAOS"
+
+// ErrInjected is the error of a write failed on purpose.
+var ErrInjected = errors.New("injected fault")
+
+// Faults is what to inject.
+type Faults struct {
+	Drop       float64       // share of pubsub messages dropped on receipt
+	Delay      time.Duration // added before every stream is opened
+	Corrupt    int           // chunks damaged as they are written to the store
+	FailWrites int           // chunk write transactions aborted after their first chunk
+	Seed       int64         // of the random drops; 0 picks one
+}
+
+// ParseFaults reads faults written as comma-separated settings, e.g.
+// "drop=0.1,delay=200ms,corrupt=5,fail_writes=2,seed=1".
+func ParseFaults(spec string) (Faults, error) {
+	var f Faults
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return f, fmt.Errorf("chaos: %q is not name=value", field)
+		}
+		var err error
+		switch name {
+		case "drop":
+			f.Drop, err = strconv.ParseFloat(value, 64)
+			if err == nil && (f.Drop < 0 || f.Drop > 1) {
+				err = errors.New("must be between 0 and 1")
+			}
+		case "delay":
+			f.Delay, err = time.ParseDuration(value)
+			if err == nil && f.Delay < 0 {
+				err = errors.New("must not be negative")
+			}
+		case "corrupt":
+			f.Corrupt, err = parseCount(value)
+		case "fail_writes":
+			f.FailWrites, err = parseCount(value)
+		case "seed":
+			f.Seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return f, fmt.Errorf("chaos: unknown fault %q", name)
+		}
+		if err != nil {
+			return f, fmt.Errorf("chaos: %s: %w", name, err)
+		}
+	}
+	return f, nil
+}
+
+func parseCount(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err == nil && n < 0 {
+		err = errors.New("must not be negative")
+	}
+	return n, err
+}
+
+// String returns f as ParseFaults reads it.
+func (f Faults) String() string {
+	var parts []string
+	if f.Drop > 0 {
+		parts = append(parts, "drop="+strconv.FormatFloat(f.Drop, 'g', -1, 64))
+	}
+	if f.Delay > 0 {
+		parts = append(parts, "delay="+f.Delay.String())
+	}
+	if f.Corrupt > 0 {
+		parts = append(parts, "corrupt="+strconv.Itoa(f.Corrupt))
+	}
+	if f.FailWrites > 0 {
+		parts = append(parts, "fail_writes="+strconv.Itoa(f.FailWrites))
+	}
+	if f.Seed != 0 {
+		parts = append(parts, "seed="+strconv.FormatInt(f.Seed, 10))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Stats counts the faults injected.
+type Stats struct {
+	Dropped      int64 `json:"dropped"`
+	Delayed      int64 `json:"delayed"`
+	Corrupted    int64 `json:"corrupted"`
+	FailedWrites int64 `json:"failed_writes"`
+}
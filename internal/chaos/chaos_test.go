@@ -0,0 +1,44 @@
+package chaos_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/chaos"
+)
+
+func TestParseFaults(t *testing.T) {
+	f, err := chaos.ParseFaults(" drop=0.25, delay=200ms,corrupt=5,fail_writes=2,seed=7,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := chaos.Faults{Drop: 0.25, Delay: 200 * time.Millisecond, Corrupt: 5, FailWrites: 2, Seed: 7}
+	if f != want {
+		t.Fatalf("got %+v, want %+v", f, want)
+	}
+	again, err := chaos.ParseFaults(f.String())
+	if err != nil || again != f {
+		t.Fatalf("round trip of %q: %+v, %v", f.String(), again, err)
+	}
+	if f, err := chaos.ParseFaults(""); err != nil || f != (chaos.Faults{}) || f.String() != "" {
+		t.Fatalf("empty spec: %+v, %v", f, err)
+	}
+}
+
+func TestParseFaultsErrors(t *testing.T) {
+	for _, spec := range []string{
+		"drop",
+		"drop=1.5",
+		"drop=-0.1",
+		"delay=soon",
+		"delay=-1s",
+		"corrupt=-1",
+		"fail_writes=x",
+		"seed=1.5",
+		"flood=1",
+	} {
+		if _, err := chaos.ParseFaults(spec); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+}
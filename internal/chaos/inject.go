@@ -0,0 +1,156 @@
+//go:build chaos
+
+package chaos
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Enabled reports whether this binary was built with the chaos tag.
+const Enabled = true
+
+// counters count the faults injected
+type counters struct {
+	dropped, delayed, corrupted, failed atomic.Int64
+}
+
+func (c *counters) stats() Stats {
+	return Stats{
+		Dropped:      c.dropped.Load(),
+		Delayed:      c.delayed.Load(),
+		Corrupted:    c.corrupted.Load(),
+		FailedWrites: c.failed.Load(),
+	}
+}
+
+// totals counts the faults of every injector of the process
+var totals counters
+
+// Totals returns the faults every injector of the process has injected.
+func Totals() Stats {
+	return totals.stats()
+}
+
+// Injector injects one set of faults. It implements p2p.Faults and
+// storage.Faults.
+type Injector struct {
+	faults Faults
+
+	mu  sync.Mutex
+	rng *rand.Rand
+
+	corrupt, fail atomic.Int64 // left to inject
+	counts        counters
+}
+
+// New returns an injector of f.
+func New(f Faults) *Injector {
+	seed := f.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	in := &Injector{faults: f, rng: rand.New(rand.NewSource(seed))}
+	in.corrupt.Store(int64(f.Corrupt))
+	in.fail.Store(int64(f.FailWrites))
+	return in
+}
+
+// FromEnv returns an injector of the faults set in EnvVar, nil when it is
+// unset or empty.
+func FromEnv() (*Injector, error) {
+	spec := os.Getenv(EnvVar)
+	if spec == "" {
+		return nil, nil
+	}
+	f, err := ParseFaults(spec)
+	if err != nil {
+		return nil, err
+	}
+	return New(f), nil
+}
+
+// Faults returns what in injects.
+func (in *Injector) Faults() Faults {
+	return in.faults
+}
+
+// Stats returns the faults in has injected so far.
+func (in *Injector) Stats() Stats {
+	return in.counts.stats()
+}
+
+// DropMessage reports whether a pubsub message received on topic is dropped.
+func (in *Injector) DropMessage(topic string) bool {
+	if in.faults.Drop <= 0 {
+		return false
+	}
+	in.mu.Lock()
+	drop := in.rng.Float64() < in.faults.Drop
+	in.mu.Unlock()
+	if drop {
+		in.counts.dropped.Add(1)
+		totals.dropped.Add(1)
+	}
+	return drop
+}
+
+// DelayStream waits before a stream is opened, failing with ctx's error if
+// it ends first.
+func (in *Injector) DelayStream(ctx context.Context) error {
+	if in.faults.Delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(in.faults.Delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		in.counts.delayed.Add(1)
+		totals.delayed.Add(1)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CorruptChunk returns a damaged copy of stored, the stored form of chunk
+// hash about to be written, while chunks are left to corrupt, and stored
+// itself after. The last byte, part of the authentication tag, is flipped,
+// so the chunk fails to decrypt.
+func (in *Injector) CorruptChunk(hash string, stored []byte) []byte {
+	if len(stored) == 0 || !take(&in.corrupt) {
+		return stored
+	}
+	bad := append([]byte(nil), stored...)
+	bad[len(bad)-1] ^= 0xFF
+	in.counts.corrupted.Add(1)
+	totals.corrupted.Add(1)
+	return bad
+}
+
+// FailWrite returns ErrInjected while writes are left to fail, nil after.
+func (in *Injector) FailWrite() error {
+	if !take(&in.fail) {
+		return nil
+	}
+	in.counts.failed.Add(1)
+	totals.failed.Add(1)
+	return ErrInjected
+}
+
+// take uses up one of the faults left in n, reporting whether there was one
+func take(n *atomic.Int64) bool {
+	for {
+		v := n.Load()
+		if v <= 0 {
+			return false
+		}
+		if n.CompareAndSwap(v, v-1) {
+			return true
+		}
+	}
+}
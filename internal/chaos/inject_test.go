@@ -0,0 +1,77 @@
+//go:build chaos
+
+package chaos_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/chaos"
+)
+
+func TestInjector(t *testing.T) {
+	in := chaos.New(chaos.Faults{Drop: 0.5, Delay: time.Millisecond, Corrupt: 1, FailWrites: 2, Seed: 1})
+
+	for i := 0; i < 2; i++ {
+		if err := in.FailWrite(); !errors.Is(err, chaos.ErrInjected) {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	if err := in.FailWrite(); err != nil {
+		t.Fatalf("write past the budget: %v", err)
+	}
+
+	stored := []byte("nonce-and-ciphertext")
+	bad := in.CorruptChunk("h1", stored)
+	if string(bad) == string(stored) || string(stored) != "nonce-and-ciphertext" {
+		t.Fatalf("corrupted %q into %q", stored, bad)
+	}
+	if got := in.CorruptChunk("h2", stored); string(got) != string(stored) {
+		t.Fatalf("corrupted past the budget: %q", got)
+	}
+
+	dropped := 0
+	for i := 0; i < 1000; i++ {
+		if in.DropMessage("chunks") {
+			dropped++
+		}
+	}
+	if dropped < 400 || dropped > 600 {
+		t.Fatalf("dropped %d of 1000 at 0.5", dropped)
+	}
+
+	if err := in.DelayStream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := chaos.New(chaos.Faults{Delay: time.Hour}).DelayStream(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled delay: %v", err)
+	}
+
+	want := chaos.Stats{Dropped: int64(dropped), Delayed: 1, Corrupted: 1, FailedWrites: 2}
+	if got := in.Stats(); got != want {
+		t.Fatalf("stats %+v, want %+v", got, want)
+	}
+	if got := chaos.Totals(); got.Dropped < want.Dropped || got.FailedWrites < want.FailedWrites {
+		t.Fatalf("totals %+v below %+v", got, want)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv(chaos.EnvVar, "")
+	if in, err := chaos.FromEnv(); in != nil || err != nil {
+		t.Fatalf("unset: %v, %v", in, err)
+	}
+	t.Setenv(chaos.EnvVar, "corrupt=2")
+	in, err := chaos.FromEnv()
+	if err != nil || in == nil || in.Faults().Corrupt != 2 {
+		t.Fatalf("set: %v, %v", in, err)
+	}
+	t.Setenv(chaos.EnvVar, "corrupt=lots")
+	if _, err := chaos.FromEnv(); err == nil {
+		t.Fatal("bad spec: no error")
+	}
+}
@@ -0,0 +1,43 @@
+//go:build !chaos
+
+package chaos
+
+import (
+	"context"
+	"os"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+)
+
+// Enabled reports whether this binary was built with the chaos tag.
+const Enabled = false
+
+// Totals returns the faults every injector of the process has injected:
+// none without the chaos tag.
+func Totals() Stats {
+	return Stats{}
+}
+
+// Injector injects nothing in builds without the chaos tag.
+type Injector struct{}
+
+// New returns an injector that ignores f.
+func New(f Faults) *Injector {
+	return &Injector{}
+}
+
+// FromEnv returns nil: builds without the chaos tag inject no faults, even
+// with EnvVar set.
+func FromEnv() (*Injector, error) {
+	if os.Getenv(EnvVar) != "" {
+		monitoring.GetLogger().Warnf("%s is set but this binary was built without the chaos tag, no faults are injected", EnvVar)
+	}
+	return nil, nil
+}
+
+func (in *Injector) Faults() Faults                                 { return Faults{} }
+func (in *Injector) Stats() Stats                                   { return Stats{} }
+func (in *Injector) DropMessage(string) bool                        { return false }
+func (in *Injector) DelayStream(context.Context) error              { return nil }
+func (in *Injector) CorruptChunk(hash string, stored []byte) []byte { return stored }
+func (in *Injector) FailWrite() error                               { return nil }
@@ -0,0 +1,219 @@
+// Package chunkcache is the chunk cache of a cache node: sealed chunks of
+// any repository, kept on disk up to a size and evicted least recently used
+// first. Nothing in it counts as a copy; a chunk may go at any time and is
+// fetched again from the peers holding it.
+package chunkcache
+
+import (
+	"container/list"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Stats describes what the cache holds and has done since it was opened.
+type Stats struct {
+	Chunks    int   `json:"chunks"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"max_bytes"`
+	Evictions int64 `json:"evictions"`
+}
+
+type entry struct {
+	hash string
+	size int64
+}
+
+// Cache is a size-bounded LRU of chunks under a directory, a file per chunk.
+// Last use is kept as the file's modification time, so the order survives a
+// restart.
+type Cache struct {
+	dir string
+	max int64
+
+	mu        sync.Mutex
+	order     *list.List // most recently used first
+	entries   map[string]*list.Element
+	bytes     int64
+	evictions int64
+}
+
+// Open opens the cache in dir, creating it if needed, and evicts what no
+// longer fits in max bytes.
+func Open(dir string, max int64) (*Cache, error) {
+	if max <= 0 {
+		return nil, fmt.Errorf("invalid cache size %d", max)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &Cache{
+		dir:     dir,
+		max:     max,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	type found struct {
+		entry
+		used time.Time
+	}
+	var all []found
+	err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		hash := filepath.Dir(rel) + filepath.Base(rel)
+		if !validHash(hash) {
+			// A write cut short, or not ours
+			return os.Remove(p)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		all = append(all, found{entry{hash, info.Size()}, info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].used.After(all[j].used) })
+	for _, f := range all {
+		e := f.entry
+		c.entries[e.hash] = c.order.PushBack(&e)
+		c.bytes += e.size
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c, c.evict()
+}
+
+// Get returns the cached chunk hash, marking it used, or false when it is
+// not cached.
+func (c *Cache) Get(hash string) ([]byte, bool) {
+	c.mu.Lock()
+	el, ok := c.entries[hash]
+	if ok {
+		c.order.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	p := c.path(hash)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		c.drop(hash)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return data, true
+}
+
+// Put caches chunk hash, evicting the least recently used chunks beyond the
+// size. The caller has checked data against hash.
+func (c *Cache) Put(hash string, data []byte) error {
+	if !validHash(hash) {
+		return fmt.Errorf("invalid chunk hash %q", hash)
+	}
+	size := int64(len(data))
+	if size > c.max {
+		return nil
+	}
+	c.mu.Lock()
+	if el, ok := c.entries[hash]; ok {
+		c.order.MoveToFront(el)
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+
+	p := c.path(hash)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.dir, ".put-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[hash]; ok {
+		return nil
+	}
+	c.entries[hash] = c.order.PushFront(&entry{hash, size})
+	c.bytes += size
+	return c.evict()
+}
+
+// Stats returns what the cache holds.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{Chunks: len(c.entries), Bytes: c.bytes, MaxBytes: c.max, Evictions: c.evictions}
+}
+
+// evict removes least recently used chunks until the cache fits. The caller
+// holds mu.
+func (c *Cache) evict() error {
+	var errs []error
+	for c.bytes > c.max {
+		el := c.order.Back()
+		e := el.Value.(*entry)
+		c.order.Remove(el)
+		delete(c.entries, e.hash)
+		c.bytes -= e.size
+		c.evictions++
+		if err := os.Remove(c.path(e.hash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// drop forgets a chunk whose file went missing
+func (c *Cache) drop(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[hash]; ok {
+		c.order.Remove(el)
+		delete(c.entries, hash)
+		c.bytes -= el.Value.(*entry).size
+	}
+}
+
+func (c *Cache) path(hash string) string {
+	return filepath.Join(c.dir, hash[:2], hash[2:])
+}
+
+// validHash reports whether hash names a chunk: a hex SHA-256
+func validHash(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
@@ -0,0 +1,66 @@
+package chunkcache_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/chunkcache"
+)
+
+func chunk(i int) (string, []byte) {
+	data := bytes.Repeat([]byte(fmt.Sprintf("chunk %d;", i)), 10)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), data
+}
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	_, first := chunk(0)
+	size := int64(len(first))
+	c, err := chunkcache.Open(dir, 3*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes []string
+	for i := 0; i < 3; i++ {
+		hash, data := chunk(i)
+		if err := c.Put(hash, data); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	// Using chunk 0 leaves chunk 1 the least recently used
+	if _, ok := c.Get(hashes[0]); !ok {
+		t.Fatal("chunk 0 not cached")
+	}
+	hash, data := chunk(3)
+	if err := c.Put(hash, data); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get(hashes[1]); ok {
+		t.Error("least recently used chunk not evicted")
+	}
+	for _, h := range []string{hashes[0], hashes[2], hash} {
+		if _, ok := c.Get(h); !ok {
+			t.Errorf("chunk %s evicted", h[:8])
+		}
+	}
+	if st := c.Stats(); st.Chunks != 3 || st.Bytes != 3*size || st.Evictions != 1 {
+		t.Errorf("Stats = %+v", st)
+	}
+
+	// Reopened smaller, the cache keeps the most recently used
+	c, err = chunkcache.Open(dir, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := c.Stats(); st.Chunks != 1 {
+		t.Fatalf("reopened cache holds %d chunks, want 1", st.Chunks)
+	}
+	if got, ok := c.Get(hash); !ok || !bytes.Equal(got, data) {
+		t.Error("most recently used chunk lost on reopening")
+	}
+}
@@ -1,62 +1,310 @@
 package chunker
 
 import (
-	"hash"
-	"hash/fnv"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"math/bits"
 )
 
-// Simple content-defined chunking using rolling hash (simplified).
-// Breaks when lower bits of rolling hash hit a pattern to get average size.
+// Content-defined chunking: a chunk ends where a hash of its data hits a
+// pattern, so identical content chunks identically wherever it sits in a
+// file. Boundaries are part of a repository's deduplication, so an
+// algorithm's cut points must never change once released.
+
+// Algorithms a repository can chunk with.
+const (
+	FNV     = "fnv"     // FNV-1a over the chunk so far, the original algorithm
+	FastCDC = "fastcdc" // gear hash with normalized chunk sizes
+	Buzhash = "buzhash" // cyclic polynomial hash over a sliding window
+	Fixed   = "fixed"   // chunks of exactly the average size
+)
+
+// Default is the algorithm new repositories chunk with, and repositories
+// that chunked with FNV without asking for it.
+const Default = Buzhash
+
+// ErrUnknownAlgorithm is returned for an algorithm name this build lacks.
+var ErrUnknownAlgorithm = errors.New("unknown chunking algorithm")
+
+// Algorithm finds chunk boundaries. Cut must depend on nothing but data, so
+// a stream is chunked the same way however it is read.
+type Algorithm interface {
+	// Cut returns the length of the chunk that data starts with. data holds
+	// at most the maximum chunk size; when it holds less, it is all that is
+	// left of the stream.
+	Cut(data []byte) int
+}
+
+// Factory returns the Algorithm of p.
+type Factory func(p Params) Algorithm
+
+// CutFunc adapts a function to Algorithm.
+type CutFunc func(data []byte) int
+
+// Cut calls f.
+func (f CutFunc) Cut(data []byte) int { return f(data) }
+
+var (
+	factories = make(map[string]Factory)
+	names     []string // in registration order
+)
+
+func init() {
+	Register(FNV, func(p Params) Algorithm { return CutFunc(newFNV(p.Min)) })
+	Register(FastCDC, func(p Params) Algorithm { return CutFunc(newFastCDC(p.Min, p.Avg)) })
+	Register(Buzhash, func(p Params) Algorithm { return CutFunc(newBuzhash(p.Min, p.Avg)) })
+	Register(Fixed, func(p Params) Algorithm { return CutFunc(newFixed(p.Avg)) })
+}
+
+// Register makes an algorithm available under name, for Params and the
+// snapshot.chunker setting. Registering a name twice panics.
+func Register(name string, f Factory) {
+	if _, ok := factories[name]; ok {
+		panic("chunker: algorithm " + name + " registered twice")
+	}
+	factories[name] = f
+	names = append(names, name)
+}
+
+// Algorithms returns the names of the registered algorithms.
+func Algorithms() []string {
+	return append([]string(nil), names...)
+}
+
+// Valid reports whether name is a known algorithm.
+func Valid(name string) bool {
+	_, ok := factories[name]
+	return ok
+}
+
+// Params selects an algorithm and its chunk sizes.
+type Params struct {
+	Algorithm     string
+	Min, Max, Avg int
+}
+
+// String identifies p in snapshot manifests, e.g. "fastcdc:2048/8192/65536".
+func (p Params) String() string {
+	return fmt.Sprintf("%s:%d/%d/%d", p.Algorithm, p.Min, p.Avg, p.Max)
+}
+
+// New returns the Algorithm p selects.
+func (p Params) New() (Algorithm, error) {
+	f, ok := factories[p.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownAlgorithm, p.Algorithm)
+	}
+	return f(p), nil
+}
 
 type Chunker struct {
-	r             io.Reader
-	min, max, avg int
-	window        []byte
+	r   io.Reader
+	max int
+	alg Algorithm
+	buf []byte // buf[pos:] is read but not yet returned
+	pos int
+	err error // from the last read
 }
 
 const (
 	defaultMaskBits = 13 // ~8192 average chunk size
+	// bufferChunks sizes read buffers in max-sized chunks, so most chunks
+	// are cut from the buffer without copying the lookahead
+	bufferChunks = 4
 )
 
+// New returns an FNV chunker, the algorithm of repositories that predate
+// the choice.
 func New(r io.Reader, min, max, avg int) *Chunker {
-	return &Chunker{
-		r:      r,
-		min:    min,
-		max:    max,
-		avg:    avg,
-		window: make([]byte, 0, max),
+	c, _ := NewAlgorithm(r, Params{Algorithm: FNV, Min: min, Max: max, Avg: avg})
+	return c
+}
+
+// NewAlgorithm returns a chunker of r using p.
+func NewAlgorithm(r io.Reader, p Params) (*Chunker, error) {
+	alg, err := p.New()
+	if err != nil {
+		return nil, err
 	}
+	return NewWith(r, alg, p.Max), nil
+}
+
+// NewWith returns a chunker of r cutting with alg chunks of at most max
+// bytes.
+func NewWith(r io.Reader, alg Algorithm, max int) *Chunker {
+	return &Chunker{r: r, max: max, alg: alg}
 }
 
 func boundary(hash uint32, mask uint32) bool {
 	return (hash & mask) == 0
 }
 
+// Next returns the next chunk, or io.EOF after the last one. The chunk is
+// not reused by later calls.
 func (c *Chunker) Next() ([]byte, error) {
-	buf := make([]byte, c.max)
-	n, err := c.r.Read(buf)
-	if n == 0 && err != nil {
-		return nil, err
+	// Cut points need up to max bytes of lookahead, so fill the buffer
+	// across short reads. Chunks already returned share the buffer, so
+	// once it runs out the lookahead moves to a new one rather than to the
+	// front of this one.
+	if len(c.buf)-c.pos < c.max && c.err == nil {
+		if cap(c.buf)-c.pos < c.max {
+			buf := make([]byte, len(c.buf)-c.pos, bufferChunks*c.max)
+			copy(buf, c.buf[c.pos:])
+			c.buf, c.pos = buf, 0
+		}
+		for len(c.buf)-c.pos < c.max && c.err == nil {
+			n, err := c.r.Read(c.buf[len(c.buf):cap(c.buf)])
+			c.buf = c.buf[:len(c.buf)+n]
+			c.err = err
+		}
+	}
+	if c.err != nil && c.err != io.EOF {
+		return nil, c.err
+	}
+	data := c.buf[c.pos:]
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+	if len(data) > c.max {
+		data = data[:c.max]
 	}
-	data := buf[:n]
-	// rolling scan to find boundary
-	var h hash.Hash32 = fnv.New32a()
-	chunkEnd := len(data)
+
+	n := c.alg.Cut(data)
+	c.pos += n
+	return data[:n:n], nil
+}
+
+// newFNV ends a chunk past min where the FNV-1a hash of the chunk so far
+// has its low defaultMaskBits bits clear. The mask ignores avg, and as the
+// hash does not roll, boundaries after an edit in a file all move.
+func newFNV(min int) func([]byte) int {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
 	mask := uint32((1 << (defaultMaskBits)) - 1)
-	if chunkEnd > c.max {
-		chunkEnd = c.max
+	return func(data []byte) int {
+		h := uint32(offset32)
+		for i, b := range data {
+			h ^= uint32(b)
+			h *= prime32
+			if i >= min && boundary(h, mask) {
+				return i + 1
+			}
+		}
+		return len(data)
 	}
-	for i := 0; i < len(data); i++ {
-		h.Write([]byte{data[i]})
-		if i >= c.min && boundary(h.Sum32(), mask) {
-			chunkEnd = i + 1
-			break
+}
+
+// newFixed cuts every avg bytes
+func newFixed(avg int) func([]byte) int {
+	return func(data []byte) int {
+		if len(data) < avg {
+			return len(data)
+		}
+		return avg
+	}
+}
+
+// gear maps each byte to a random 64-bit value. It is generated from a
+// fixed seed and must stay as it is.
+var gear = byteTable(0x5368616457566c74) // "ShadWVlt"
+
+// buzTable is the byte table of Buzhash, which must stay as it is too.
+var buzTable = byteTable(0x42757a4861736821) // "BuzHash!"
+
+// byteTable maps each byte to a 64-bit value drawn with splitmix64 from seed
+func byteTable(seed uint64) (t [256]uint64) {
+	s := seed
+	for i := range t {
+		s += 0x9e3779b97f4a7c15
+		z := s
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}
+
+// newFastCDC returns the FastCDC cut function: up to avg a boundary needs
+// two more hash bits than the average implies, past it two fewer, which
+// pulls chunk sizes towards avg. The masks test the high bits of the gear
+// hash, which depend on the last 64 bytes.
+func newFastCDC(min, avg int) func([]byte) int {
+	b := bits.Len(uint(avg)) - 1
+	mask := func(n int) uint64 {
+		if n < 1 {
+			n = 1
+		}
+		return ^uint64(0) << (64 - n)
+	}
+	maskS, maskL := mask(b+2), mask(b-2)
+	return func(data []byte) int {
+		n := len(data)
+		if n <= min {
+			return n
+		}
+		normal := avg
+		if normal > n {
+			normal = n
+		}
+		var fp uint64
+		i := min
+		for ; i < normal; i++ {
+			fp = fp<<1 + gear[data[i]]
+			if fp&maskS == 0 {
+				return i + 1
+			}
+		}
+		for ; i < n; i++ {
+			fp = fp<<1 + gear[data[i]]
+			if fp&maskL == 0 {
+				return i + 1
+			}
+		}
+		return n
+	}
+}
+
+// buzWindow is how many bytes the Buzhash of a position covers.
+const buzWindow = 48
+
+// newBuzhash returns the Buzhash cut function: a chunk ends past min where
+// the hash of the buzWindow bytes up to there has its low bits clear. Past
+// min a boundary turns up every 2^b bytes on average, with b picked so that
+// chunks average about avg. The hash is primed with the window before min,
+// so where a chunk ends depends on nothing but the bytes around it and an
+// edit only moves the boundaries within a window of it.
+func newBuzhash(min, avg int) func([]byte) int {
+	b := 1
+	if avg-min > 2 {
+		b = int(math.Round(math.Log2(float64(avg - min))))
+	}
+	mask := uint64(1)<<b - 1
+	return func(data []byte) int {
+		n := len(data)
+		if n <= min {
+			return n
+		}
+		start := min - buzWindow
+		if start < 0 {
+			start = 0
+		}
+		var h uint64
+		for _, x := range data[start:min] {
+			h = bits.RotateLeft64(h, 1) ^ buzTable[x]
 		}
-		if i >= c.max-1 {
-			chunkEnd = c.max
-			break
+		for i := min; i < n; i++ {
+			h = bits.RotateLeft64(h, 1) ^ buzTable[data[i]]
+			if out := i - buzWindow; out >= start {
+				h ^= bits.RotateLeft64(buzTable[data[out]], buzWindow)
+			}
+			if h&mask == 0 {
+				return i + 1
+			}
 		}
+		return n
 	}
-	return data[:chunkEnd], nil
 }
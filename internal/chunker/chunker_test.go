@@ -2,9 +2,13 @@ package chunker_test
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"math"
+	"math/rand"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/hoangsonww/backupagent/internal/chunker"
 )
@@ -53,3 +57,213 @@ func TestChunkerEOF(t *testing.T) {
 		t.Fatalf("expected EOF on empty reader")
 	}
 }
+
+func chunkAll(t *testing.T, r io.Reader, p chunker.Params) [][]byte {
+	t.Helper()
+	ch, err := chunker.NewAlgorithm(r, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks [][]byte
+	for {
+		b, err := ch.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, b)
+	}
+}
+
+func TestChunkerAlgorithms(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	edited := append([]byte("a few inserted bytes"), data...)
+
+	for _, algo := range []string{chunker.FNV, chunker.FastCDC, chunker.Buzhash, chunker.Fixed} {
+		t.Run(algo, func(t *testing.T) {
+			p := chunker.Params{Algorithm: algo, Min: 2048, Avg: 8192, Max: 65536}
+			chunks := chunkAll(t, bytes.NewReader(data), p)
+			if got := bytes.Join(chunks, nil); !bytes.Equal(got, data) {
+				t.Fatalf("chunks join to %d bytes, want the %d input bytes", len(got), len(data))
+			}
+			seen := map[string]bool{}
+			for i, c := range chunks {
+				if len(c) > p.Max || (len(c) < p.Min && i < len(chunks)-1) {
+					t.Fatalf("chunk %d has %d bytes", i, len(c))
+				}
+				seen[string(c)] = true
+			}
+
+			// Boundaries do not depend on how the reader splits its reads
+			short := chunkAll(t, iotest.HalfReader(bytes.NewReader(data)), p)
+			if len(short) != len(chunks) {
+				t.Fatalf("%d chunks from short reads, want %d", len(short), len(chunks))
+			}
+
+			shared := 0
+			for _, c := range chunkAll(t, bytes.NewReader(edited), p) {
+				if seen[string(c)] {
+					shared++
+				}
+			}
+			// FNV hashes from the chunk start, so its boundaries never
+			// resynchronize after an edit
+			if algo != chunker.FNV && algo != chunker.Fixed && shared < len(chunks)*9/10 {
+				t.Fatalf("only %d of %d chunks survive an insertion", shared, len(chunks))
+			}
+		})
+	}
+
+	if _, err := chunker.NewAlgorithm(bytes.NewReader(data), chunker.Params{Algorithm: "rabin", Min: 1, Avg: 2, Max: 3}); !errors.Is(err, chunker.ErrUnknownAlgorithm) {
+		t.Fatalf("unknown algorithm: %v", err)
+	}
+}
+
+func TestChunkerEdits(t *testing.T) {
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	mid := len(data) / 2
+	edits := map[string][]byte{
+		"insert":  append(append(append([]byte(nil), data[:mid]...), "inserted"...), data[mid:]...),
+		"delete":  append(append([]byte(nil), data[:mid]...), data[mid+100:]...),
+		"replace": append(append(append([]byte(nil), data[:mid]...), bytes.Repeat([]byte{0}, 300)...), data[mid+300:]...),
+	}
+
+	for _, algo := range []string{chunker.FastCDC, chunker.Buzhash} {
+		t.Run(algo, func(t *testing.T) {
+			p := chunker.Params{Algorithm: algo, Min: 2048, Avg: 8192, Max: 65536}
+			chunks := chunkAll(t, bytes.NewReader(data), p)
+			if avg := len(data) / len(chunks); avg < p.Avg/2 || avg > p.Avg*2 {
+				t.Fatalf("chunks average %d bytes, want about %d", avg, p.Avg)
+			}
+			seen := map[string]bool{}
+			for _, c := range chunks {
+				seen[string(c)] = true
+			}
+			// A local edit changes only the chunks around it
+			for name, edited := range edits {
+				changed := 0
+				for _, c := range chunkAll(t, bytes.NewReader(edited), p) {
+					if !seen[string(c)] {
+						changed++
+					}
+				}
+				if changed > 3 {
+					t.Errorf("%s: %d new chunks, want at most 3", name, changed)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkerSizes(t *testing.T) {
+	data := make([]byte, 32<<20)
+	rand.New(rand.NewSource(4)).Read(data)
+	p := chunker.Params{Min: 2048, Avg: 8192, Max: 65536}
+	sizes := func(algo string) []int {
+		p.Algorithm = algo
+		var n []int
+		for _, c := range chunkAll(t, bytes.NewReader(data), p) {
+			n = append(n, len(c))
+		}
+		return n
+	}
+	// below returns the share of sizes under n
+	below := func(sizes []int, n int) float64 {
+		k := 0
+		for _, s := range sizes {
+			if s < n {
+				k++
+			}
+		}
+		return float64(k) / float64(len(sizes))
+	}
+
+	// Past min, each byte of random data ends a Buzhash chunk with the same
+	// odds, so sizes follow an exponential distribution of mean 2^b
+	buz := sizes(chunker.Buzhash)
+	mean := math.Exp2(math.Round(math.Log2(float64(p.Avg - p.Min))))
+	for _, n := range []int{p.Min + p.Avg/8, p.Min + p.Avg/2, p.Avg, 2 * p.Avg, 4 * p.Avg} {
+		want := 1 - math.Exp(-float64(n-p.Min)/mean)
+		if got := below(buz, n); math.Abs(got-want) > 0.03 {
+			t.Errorf("buzhash: %.3f of chunks under %d bytes, want %.3f", got, n, want)
+		}
+	}
+	if got := 1 - below(buz, p.Max); got > 0.005 {
+		t.Errorf("buzhash: %.3f of chunks cut at the maximum size", got)
+	}
+
+	// FastCDC's normalization gathers sizes around avg
+	fast := sizes(chunker.FastCDC)
+	if got := below(fast, 2*p.Avg) - below(fast, p.Avg/2); got < 0.8 {
+		t.Errorf("fastcdc: %.3f of chunks within half and twice the average size", got)
+	}
+	if got := below(buz, 2*p.Avg) - below(buz, p.Avg/2); got > 0.7 {
+		t.Errorf("buzhash: %.3f of chunks within half and twice the average size, want them spread wider than fastcdc's", got)
+	}
+}
+
+func TestChunkerChunksKept(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(3)).Read(data)
+	p := chunker.Params{Algorithm: chunker.Buzhash, Min: 512, Avg: 2048, Max: 8192}
+	ch, err := chunker.NewAlgorithm(iotest.OneByteReader(bytes.NewReader(data)), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Chunks stay intact while later ones are cut
+	var chunks [][]byte
+	var copies [][]byte
+	for {
+		b, err := ch.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, b)
+		copies = append(copies, append([]byte(nil), b...))
+	}
+	for i := range chunks {
+		if !bytes.Equal(chunks[i], copies[i]) {
+			t.Fatalf("chunk %d changed after it was returned", i)
+		}
+	}
+	if got := bytes.Join(chunks, nil); !bytes.Equal(got, data) {
+		t.Fatalf("chunks join to %d bytes, want the %d input bytes", len(got), len(data))
+	}
+}
+
+func TestChunkerRegister(t *testing.T) {
+	// Cuts after every newline
+	chunker.Register("lines", func(p chunker.Params) chunker.Algorithm {
+		return chunker.CutFunc(func(data []byte) int {
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				return i + 1
+			}
+			return len(data)
+		})
+	})
+	if !chunker.Valid("lines") {
+		t.Fatal("registered algorithm is not valid")
+	}
+	if algos := chunker.Algorithms(); algos[len(algos)-1] != "lines" {
+		t.Fatalf("algorithms %v do not end with the registered one", algos)
+	}
+
+	p := chunker.Params{Algorithm: "lines", Min: 1, Avg: 4, Max: 8}
+	chunks := chunkAll(t, strings.NewReader("one\ntwo\nthree\nan overlong line"), p)
+	want := []string{"one\n", "two\n", "three\n", "an overl", "ong line"}
+	if len(chunks) != len(want) {
+		t.Fatalf("%d chunks, want %d", len(chunks), len(want))
+	}
+	for i, c := range chunks {
+		if string(c) != want[i] {
+			t.Fatalf("chunk %d is %q, want %q", i, c, want[i])
+		}
+	}
+}
@@ -0,0 +1,313 @@
+// Package chunkindex is the dedup index: for every chunk hash, where its
+// bytes live, their stored size and how many snapshots reference it. It has
+// its own bucket of small fixed-size records, apart from the chunk data, so
+// existence checks and GC never touch chunk pages and the bytes can move to
+// another backend without rewriting the index.
+package chunkindex
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hoangsonww/backupagent/internal/chunklist"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Location says where a chunk's bytes are kept.
+type Location uint8
+
+const (
+	// Absent chunks are referenced by a snapshot but not stored here
+	Absent Location = 0
+	// Blocks is the local blocks bucket
+	Blocks Location = 1
+	// Files is a file per chunk under the repository's chunks directory
+	Files Location = 2
+	// ObjectStore is an object per chunk in an S3-compatible bucket
+	ObjectStore Location = 3
+	// SFTP is a file per chunk on an SSH server
+	SFTP Location = 4
+	// Packs is a span of a pack file under the repository's packs directory
+	Packs Location = 5
+)
+
+func (l Location) String() string {
+	switch l {
+	case Absent:
+		return "absent"
+	case Blocks:
+		return "blocks"
+	case Files:
+		return "files"
+	case ObjectStore:
+		return "object store"
+	case SFTP:
+		return "sftp"
+	case Packs:
+		return "packs"
+	}
+	return fmt.Sprintf("location %d", uint8(l))
+}
+
+const (
+	// entrySize is location(1) | size(8) | refs(8)
+	entrySize = 17
+	// keyVersion marks in the meta bucket that the index has been built
+	keyVersion = "chunk_index_version"
+	version    = "1"
+)
+
+// Entry is the index record of one chunk.
+type Entry struct {
+	Location Location
+	Size     int64 // stored bytes, including encryption overhead
+	Refs     int64 // snapshots referencing the chunk
+}
+
+// Stored reports whether the chunk's bytes are held somewhere.
+func (e Entry) Stored() bool {
+	return e.Location != Absent
+}
+
+func (e Entry) encode() []byte {
+	v := make([]byte, entrySize)
+	v[0] = byte(e.Location)
+	binary.BigEndian.PutUint64(v[1:9], uint64(e.Size))
+	binary.BigEndian.PutUint64(v[9:17], uint64(e.Refs))
+	return v
+}
+
+func decode(v []byte) (Entry, bool) {
+	if len(v) != entrySize {
+		return Entry{}, false
+	}
+	return Entry{
+		Location: Location(v[0]),
+		Size:     int64(binary.BigEndian.Uint64(v[1:9])),
+		Refs:     int64(binary.BigEndian.Uint64(v[9:17])),
+	}, true
+}
+
+func bucket(tx *bolt.Tx) *bolt.Bucket {
+	return tx.Bucket([]byte(persistence.BucketChunkIndex))
+}
+
+// Get returns the entry of hash.
+func Get(tx *bolt.Tx, hash string) (Entry, bool) {
+	return decode(bucket(tx).Get([]byte(hash)))
+}
+
+// Stored reports whether the bytes of hash are held.
+func Stored(tx *bolt.Tx, hash string) bool {
+	e, ok := Get(tx, hash)
+	return ok && e.Stored()
+}
+
+// SetStored records where the bytes of hash now live, keeping its references.
+func SetStored(tx *bolt.Tx, hash string, loc Location, size int64) error {
+	e, _ := Get(tx, hash)
+	e.Location, e.Size = loc, size
+	return bucket(tx).Put([]byte(hash), e.encode())
+}
+
+// Unstore records that the bytes of hash were removed. The entry stays as
+// long as snapshots reference it.
+func Unstore(tx *bolt.Tx, hash string) error {
+	e, ok := Get(tx, hash)
+	if !ok {
+		return nil
+	}
+	if e.Refs == 0 {
+		return bucket(tx).Delete([]byte(hash))
+	}
+	e.Location, e.Size = Absent, 0
+	return bucket(tx).Put([]byte(hash), e.encode())
+}
+
+// AddRefs adds delta references to each distinct hash, as when a snapshot
+// listing them is saved (+1) or deleted (-1).
+func AddRefs(tx *bolt.Tx, hashes []string, delta int64) error {
+	b := bucket(tx)
+	seen := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		e, _ := decode(b.Get([]byte(hash)))
+		e.Refs += delta
+		if e.Refs < 0 {
+			e.Refs = 0
+		}
+		var err error
+		if e.Refs == 0 && !e.Stored() {
+			err = b.Delete([]byte(hash))
+		} else {
+			err = b.Put([]byte(hash), e.encode())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForEach calls fn for every entry in hash order.
+func ForEach(tx *bolt.Tx, fn func(hash string, e Entry) error) error {
+	c := bucket(tx).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		e, ok := decode(v)
+		if !ok {
+			return fmt.Errorf("malformed chunk index entry %x", k)
+		}
+		if err := fn(string(k), e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Build creates the index from the blocks and snapshot buckets unless it
+// already exists. Returns whether it was built.
+func Build(db *persistence.DB) (bool, error) {
+	built := false
+	err := db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(persistence.BucketMeta))
+		if string(meta.Get([]byte(keyVersion))) == version {
+			return nil
+		}
+		if err := rebuild(tx); err != nil {
+			return err
+		}
+		built = true
+		return meta.Put([]byte(keyVersion), []byte(version))
+	})
+	return built, err
+}
+
+// rebuild replaces the index with one derived from stored chunks and snapshots
+func rebuild(tx *bolt.Tx) error {
+	if err := tx.DeleteBucket([]byte(persistence.BucketChunkIndex)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	if _, err := tx.CreateBucket([]byte(persistence.BucketChunkIndex)); err != nil {
+		return err
+	}
+
+	err := tx.Bucket([]byte(persistence.BucketBlocks)).ForEach(func(k, v []byte) error {
+		return SetStored(tx, string(k), Blocks, int64(len(v)))
+	})
+	if err != nil {
+		return err
+	}
+	return forEachSnapshot(tx, func(chunks []string) error {
+		return AddRefs(tx, chunks, 1)
+	})
+}
+
+// forEachSnapshot calls fn with the chunks each snapshot lists
+func forEachSnapshot(tx *bolt.Tx, fn func(chunks []string) error) error {
+	return tx.Bucket([]byte(persistence.BucketSnapshots)).ForEach(func(k, v []byte) error {
+		var snap struct {
+			Chunks    []string `json:"chunks"`
+			ChunkRuns []byte   `json:"chunk_runs"`
+		}
+		if err := json.Unmarshal(v, &snap); err != nil {
+			return fmt.Errorf("snapshot %s: %w", k, err)
+		}
+		if snap.ChunkRuns != nil {
+			chunks, err := chunklist.Decode(snap.ChunkRuns)
+			if err != nil {
+				return fmt.Errorf("snapshot %s: %w", k, err)
+			}
+			snap.Chunks = chunks
+		}
+		return fn(snap.Chunks)
+	})
+}
+
+// Drift is what Recount found wrong in the index and corrected.
+type Drift struct {
+	Chunks    int `json:"chunks"`     // entries checked
+	RefsFixed int `json:"refs_fixed"` // entries whose reference count was wrong
+	Added     int `json:"added"`      // chunks referenced or in the blocks bucket but not indexed
+	Dropped   int `json:"dropped"`    // entries of chunks neither stored nor referenced
+}
+
+// Recount recounts every chunk's references from the snapshots, in case
+// they drifted from the counts kept on save and delete, and indexes chunks
+// of the blocks bucket it lost. Where the bytes of other chunks live is
+// only known to the index, so stored entries keep their location.
+func Recount(db *persistence.DB) (Drift, error) {
+	var d Drift
+	err := db.Update(func(tx *bolt.Tx) error {
+		d = Drift{}
+		refs := make(map[string]int64)
+		err := forEachSnapshot(tx, func(chunks []string) error {
+			seen := make(map[string]bool, len(chunks))
+			for _, hash := range chunks {
+				if !seen[hash] {
+					seen[hash] = true
+					refs[hash]++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Collect the corrections first; the bucket cannot change under
+		// its cursor
+		fixed := make(map[string]Entry)
+		var dropped []string
+		err = ForEach(tx, func(hash string, e Entry) error {
+			d.Chunks++
+			want := refs[hash]
+			delete(refs, hash)
+			switch {
+			case want == 0 && !e.Stored():
+				dropped = append(dropped, hash)
+			case e.Refs != want:
+				e.Refs = want
+				fixed[hash] = e
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		b := bucket(tx)
+		for hash, e := range fixed {
+			if err := b.Put([]byte(hash), e.encode()); err != nil {
+				return err
+			}
+		}
+		for _, hash := range dropped {
+			if err := b.Delete([]byte(hash)); err != nil {
+				return err
+			}
+		}
+		d.RefsFixed, d.Dropped = len(fixed), len(dropped)
+		for hash, n := range refs {
+			if err := b.Put([]byte(hash), Entry{Refs: n}.encode()); err != nil {
+				return err
+			}
+			d.Added++
+		}
+
+		return tx.Bucket([]byte(persistence.BucketBlocks)).ForEach(func(k, v []byte) error {
+			e, ok := Get(tx, string(k))
+			if ok && e.Stored() {
+				return nil
+			}
+			if !ok {
+				d.Added++
+			}
+			return SetStored(tx, string(k), Blocks, int64(len(v)))
+		})
+	})
+	return d, err
+}
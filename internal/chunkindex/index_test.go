@@ -0,0 +1,130 @@
+package chunkindex_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/chunkindex"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBuildCountsReferences(t *testing.T) {
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// A repository from before the index: two stored chunks, one referenced
+	// twice, and a snapshot naming a chunk that was never received
+	err = db.Update(func(tx *bolt.Tx) error {
+		blocks := tx.Bucket([]byte(persistence.BucketBlocks))
+		blocks.Put([]byte("aa"), make([]byte, 40))
+		blocks.Put([]byte("bb"), make([]byte, 50))
+		snaps := tx.Bucket([]byte(persistence.BucketSnapshots))
+		snaps.Put([]byte("s1"), []byte(`{"id":"s1","chunks":["aa","aa","cc"]}`))
+		return snaps.Put([]byte("s2"), []byte(`{"id":"s2","chunks":["aa"]}`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	built, err := chunkindex.Build(db)
+	if err != nil || !built {
+		t.Fatalf("Build = %v, %v", built, err)
+	}
+	if built, _ := chunkindex.Build(db); built {
+		t.Fatal("index rebuilt although already present")
+	}
+
+	want := map[string]chunkindex.Entry{
+		"aa": {Location: chunkindex.Blocks, Size: 40, Refs: 2},
+		"bb": {Location: chunkindex.Blocks, Size: 50, Refs: 0},
+		"cc": {Location: chunkindex.Absent, Size: 0, Refs: 1},
+	}
+	db.View(func(tx *bolt.Tx) error {
+		for hash, w := range want {
+			if got, ok := chunkindex.Get(tx, hash); !ok || got != w {
+				t.Errorf("%s: got %+v, want %+v", hash, got, w)
+			}
+		}
+		return nil
+	})
+
+	// Dropping s1 forgets the absent chunk and keeps the shared one
+	err = db.Update(func(tx *bolt.Tx) error {
+		return chunkindex.AddRefs(tx, []string{"aa", "aa", "cc"}, -1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if _, ok := chunkindex.Get(tx, "cc"); ok {
+			t.Error("unreferenced absent chunk still indexed")
+		}
+		if e, _ := chunkindex.Get(tx, "aa"); e.Refs != 1 {
+			t.Errorf("aa refs = %d, want 1", e.Refs)
+		}
+		return nil
+	})
+}
+
+func TestRecountFixesDrift(t *testing.T) {
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := chunkindex.Build(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// Counts that drifted from the snapshots: aa over-counted, bb in an
+	// object store and referenced without a count, a stale absent entry,
+	// and a block the index lost
+	err = db.Update(func(tx *bolt.Tx) error {
+		tx.Bucket([]byte(persistence.BucketBlocks)).Put([]byte("dd"), make([]byte, 30))
+		snaps := tx.Bucket([]byte(persistence.BucketSnapshots))
+		snaps.Put([]byte("s1"), []byte(`{"id":"s1","chunks":["aa","bb","cc"]}`))
+		if err := chunkindex.SetStored(tx, "aa", chunkindex.Files, 10); err != nil {
+			return err
+		}
+		if err := chunkindex.AddRefs(tx, []string{"aa", "ee"}, 3); err != nil {
+			return err
+		}
+		return chunkindex.SetStored(tx, "bb", chunkindex.ObjectStore, 20)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := chunkindex.Recount(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (chunkindex.Drift{Chunks: 3, RefsFixed: 2, Added: 2, Dropped: 1}); d != want {
+		t.Errorf("Recount = %+v, want %+v", d, want)
+	}
+	want := map[string]chunkindex.Entry{
+		"aa": {Location: chunkindex.Files, Size: 10, Refs: 1},
+		"bb": {Location: chunkindex.ObjectStore, Size: 20, Refs: 1},
+		"cc": {Location: chunkindex.Absent, Size: 0, Refs: 1},
+		"dd": {Location: chunkindex.Blocks, Size: 30, Refs: 0},
+	}
+	db.View(func(tx *bolt.Tx) error {
+		for hash, w := range want {
+			if got, ok := chunkindex.Get(tx, hash); !ok || got != w {
+				t.Errorf("%s: got %+v, want %+v", hash, got, w)
+			}
+		}
+		if _, ok := chunkindex.Get(tx, "ee"); ok {
+			t.Error("entry of a chunk neither stored nor referenced kept")
+		}
+		return nil
+	})
+
+	if d, err := chunkindex.Recount(db); err != nil || d.RefsFixed+d.Added+d.Dropped != 0 {
+		t.Errorf("second Recount = %+v, %v, want no drift", d, err)
+	}
+}
@@ -0,0 +1,225 @@
+// Package chunklist packs the chunk hash list of a snapshot manifest into a
+// compact binary form. Each distinct hash is stored once as 32 raw bytes;
+// the list itself becomes operations over dictionary indices: runs of
+// consecutive new chunks (a freshly chunked file), copies of an earlier
+// stretch of the list (a file repeated elsewhere in the tree) and literals.
+//
+// Layout: version byte, uvarint list length, uvarint dictionary size, the
+// dictionary, then ops. Each op starts with uvarint length<<2 | kind.
+package chunklist
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+const (
+	version  = 1
+	hashSize = 32
+
+	opLiteral    = 0 // length uvarint indices follow
+	opSequential = 1 // uvarint start; indices start, start+1, ...
+	opCopy       = 2 // uvarint distance; repeat the indices that far back
+
+	// minCopy is the shortest repeat worth encoding as a copy
+	minCopy = 4
+	// maxChunks bounds decoding, about 1 PiB of 8 KiB chunks
+	maxChunks = 1 << 27
+)
+
+var ErrMalformed = errors.New("malformed packed chunk list")
+
+// Encode packs hashes. ok is false when some hash is not 32 bytes of hex,
+// in which case the list must be kept in its plain form.
+func Encode(hashes []string) (data []byte, ok bool) {
+	dict := make(map[string]uint64)
+	var raw []byte
+	seq := make([]uint64, len(hashes))
+	var buf [hashSize]byte
+	for i, h := range hashes {
+		idx, seen := dict[h]
+		if !seen {
+			if len(h) != 2*hashSize {
+				return nil, false
+			}
+			if _, err := hex.Decode(buf[:], []byte(h)); err != nil || hex.EncodeToString(buf[:]) != h {
+				// Only canonical lowercase hex survives a round trip
+				return nil, false
+			}
+			idx = uint64(len(dict))
+			dict[h] = idx
+			raw = append(raw, buf[:]...)
+		}
+		seq[i] = idx
+	}
+
+	out := []byte{version}
+	out = binary.AppendUvarint(out, uint64(len(hashes)))
+	out = binary.AppendUvarint(out, uint64(len(dict)))
+	out = append(out, raw...)
+
+	var literal []uint64
+	flush := func() {
+		if len(literal) == 0 {
+			return
+		}
+		out = binary.AppendUvarint(out, uint64(len(literal))<<2|opLiteral)
+		for _, idx := range literal {
+			out = binary.AppendUvarint(out, idx)
+		}
+		literal = literal[:0]
+	}
+
+	// Last position at which each run of minCopy indices started
+	seen := make(map[[minCopy]uint64]int)
+	key := func(i int) ([minCopy]uint64, bool) {
+		var k [minCopy]uint64
+		if i+minCopy > len(seq) {
+			return k, false
+		}
+		copy(k[:], seq[i:i+minCopy])
+		return k, true
+	}
+
+	for i := 0; i < len(seq); {
+		run := 1
+		for i+run < len(seq) && seq[i+run] == seq[i]+uint64(run) {
+			run++
+		}
+		match, from := 0, 0
+		if k, ok := key(i); ok {
+			if p, found := seen[k]; found {
+				for i+match < len(seq) && seq[p+match] == seq[i+match] {
+					match++
+				}
+				from = p
+			}
+			seen[k] = i
+		}
+
+		switch {
+		case match >= minCopy && match >= run:
+			flush()
+			out = binary.AppendUvarint(out, uint64(match)<<2|opCopy)
+			out = binary.AppendUvarint(out, uint64(i-from))
+			i += match
+		case run >= 2:
+			flush()
+			out = binary.AppendUvarint(out, uint64(run)<<2|opSequential)
+			out = binary.AppendUvarint(out, seq[i])
+			i += run
+		default:
+			literal = append(literal, seq[i])
+			i++
+		}
+	}
+	flush()
+	return out, true
+}
+
+// Packable reports whether Encode accepts hashes.
+func Packable(hashes []string) bool {
+	for _, h := range hashes {
+		if len(h) != 2*hashSize {
+			return false
+		}
+		for i := 0; i < len(h); i++ {
+			if c := h[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Decode unpacks a list produced by Encode.
+func Decode(data []byte) ([]string, error) {
+	if len(data) == 0 || data[0] != version {
+		return nil, fmt.Errorf("%w: unknown version", ErrMalformed)
+	}
+	r := data[1:]
+	next := func() (uint64, error) {
+		v, n := binary.Uvarint(r)
+		if n <= 0 {
+			return 0, fmt.Errorf("%w: truncated", ErrMalformed)
+		}
+		r = r[n:]
+		return v, nil
+	}
+
+	total, err := next()
+	if err != nil {
+		return nil, err
+	}
+	dictSize, err := next()
+	if err != nil {
+		return nil, err
+	}
+	if total > maxChunks || dictSize > total || uint64(len(r)) < dictSize*hashSize {
+		return nil, fmt.Errorf("%w: bad sizes", ErrMalformed)
+	}
+	dict := make([]string, dictSize)
+	for i := range dict {
+		dict[i] = hex.EncodeToString(r[:hashSize])
+		r = r[hashSize:]
+	}
+
+	// Copies expand, so only the input size bounds the initial allocation
+	seq := make([]uint64, 0, min(total, uint64(len(data))))
+	for uint64(len(seq)) < total {
+		tag, err := next()
+		if err != nil {
+			return nil, err
+		}
+		n, kind := tag>>2, tag&3
+		if n == 0 || n > total-uint64(len(seq)) {
+			return nil, fmt.Errorf("%w: bad op length", ErrMalformed)
+		}
+		switch kind {
+		case opLiteral:
+			for j := uint64(0); j < n; j++ {
+				idx, err := next()
+				if err != nil {
+					return nil, err
+				}
+				seq = append(seq, idx)
+			}
+		case opSequential:
+			start, err := next()
+			if err != nil {
+				return nil, err
+			}
+			for j := uint64(0); j < n; j++ {
+				seq = append(seq, start+j)
+			}
+		case opCopy:
+			dist, err := next()
+			if err != nil {
+				return nil, err
+			}
+			if dist == 0 || dist > uint64(len(seq)) {
+				return nil, fmt.Errorf("%w: bad copy distance", ErrMalformed)
+			}
+			from := len(seq) - int(dist)
+			for j := 0; j < int(n); j++ {
+				seq = append(seq, seq[from+j])
+			}
+		default:
+			return nil, fmt.Errorf("%w: unknown op %d", ErrMalformed, kind)
+		}
+	}
+	if len(r) != 0 {
+		return nil, fmt.Errorf("%w: trailing data", ErrMalformed)
+	}
+
+	hashes := make([]string, len(seq))
+	for i, idx := range seq {
+		if idx >= dictSize {
+			return nil, fmt.Errorf("%w: index out of range", ErrMalformed)
+		}
+		hashes[i] = dict[idx]
+	}
+	return hashes, nil
+}
@@ -0,0 +1,94 @@
+package chunklist_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/chunklist"
+)
+
+func hashes(n int) []string {
+	out := make([]string, n)
+	for i := range out {
+		sum := sha256.Sum256([]byte{byte(i), byte(i >> 8)})
+		out[i] = hex.EncodeToString(sum[:])
+	}
+	return out
+}
+
+func TestRoundTripAndSize(t *testing.T) {
+	h := hashes(600)
+	// Two fresh files, the first copied again later, and a few scattered
+	// chunks shared with other files
+	var list []string
+	list = append(list, h[:300]...)
+	list = append(list, h[300:500]...)
+	list = append(list, h[:300]...)
+	list = append(list, h[550], h[7], h[550], h[42])
+	list = append(list, h[500:600]...)
+
+	data, ok := chunklist.Encode(list)
+	if !ok {
+		t.Fatal("Encode refused canonical hashes")
+	}
+	got, err := chunklist.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, list) {
+		t.Fatal("decoded list differs")
+	}
+
+	plain, _ := json.Marshal(list)
+	if len(data)*2 > len(plain) {
+		t.Errorf("packed %d bytes, plain JSON %d", len(data), len(plain))
+	}
+
+	if got, err := chunklist.Decode(mustEncode(t, nil)); err != nil || len(got) != 0 {
+		t.Errorf("empty list: %v, %v", got, err)
+	}
+}
+
+func TestEncodeRejectsNonCanonical(t *testing.T) {
+	for _, h := range []string{"abc", hashes(1)[0][:62] + "AB", hashes(1)[0] + "00"} {
+		if _, ok := chunklist.Encode([]string{h}); ok {
+			t.Errorf("Encode accepted %q", h)
+		}
+		if chunklist.Packable([]string{h}) {
+			t.Errorf("Packable accepted %q", h)
+		}
+	}
+}
+
+func TestDecodeRejectsMalformed(t *testing.T) {
+	valid := mustEncode(t, append(hashes(10), hashes(10)...))
+	cases := map[string][]byte{
+		"empty":     nil,
+		"version":   append([]byte{9}, valid[1:]...),
+		"truncated": valid[:len(valid)-1],
+		"trailing":  append(append([]byte{}, valid...), 0),
+		"huge":      {1, 0xff, 0xff, 0xff, 0xff, 0x0f, 0},
+		// one chunk, one hash, then a copy reaching before the start
+		"distance": append(append([]byte{1, 1, 1}, make([]byte, 32)...), 1<<2|2, 5),
+		// one chunk, one hash, then a literal naming a missing hash
+		"index": append(append([]byte{1, 1, 1}, make([]byte, 32)...), 1<<2|0, 3),
+	}
+	for name, data := range cases {
+		if _, err := chunklist.Decode(data); !errors.Is(err, chunklist.ErrMalformed) {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+}
+
+func mustEncode(t *testing.T, list []string) []byte {
+	t.Helper()
+	data, ok := chunklist.Encode(list)
+	if !ok {
+		t.Fatal("Encode failed")
+	}
+	return data
+}
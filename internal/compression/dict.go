@@ -0,0 +1,118 @@
+package compression
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrUnknownDict means data was packed against a dictionary not registered
+// with RegisterDict.
+var ErrUnknownDict = errors.New("compression dictionary not loaded")
+
+// Dict is a zstd dictionary trained on chunks of one content type. Small
+// chunks, which carry too little context to compress well alone, compress
+// against it as if it came before them.
+type Dict struct {
+	ID      uint32    `json:"id"` // derived from Data, so the same dictionary gets the same ID anywhere
+	Kind    Kind      `json:"kind"`
+	Samples int       `json:"samples"` // chunks it was trained on
+	Created time.Time `json:"created"`
+	Data    []byte    `json:"data"` // in zstd dictionary format
+}
+
+const (
+	// maxSampleSize is how much of each sample TrainDict learns from
+	maxSampleSize = 64 << 10
+	// minDictID keeps IDs out of the range zstd reserves for registered
+	// dictionaries
+	minDictID = 1 << 15
+	// dictMagic leads a dictionary in zstd format
+	dictMagic = 0xEC30A437
+)
+
+// TrainDict builds a dictionary of at most maxSize bytes for kind from
+// samples of it, e.g. chunks of the repository.
+func TrainDict(kind Kind, samples [][]byte, maxSize int) (*Dict, error) {
+	if len(samples) == 0 {
+		return nil, errors.New("no samples to train a dictionary on")
+	}
+	input := make([][]byte, len(samples))
+	for i, s := range samples {
+		input[i] = s[:min(len(s), maxSampleSize)]
+	}
+	data, err := dict.BuildZstdDict(input, dict.Options{
+		MaxDictSize: maxSize,
+		HashBytes:   6,
+		ZstdDictID:  1,
+		ZstdLevel:   zstd.SpeedBestCompression,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to train %s dictionary: %w", kind, err)
+	}
+	// Replace the placeholder ID with one derived from the rest
+	sum := sha256.Sum256(data[8:])
+	id := minDictID + binary.BigEndian.Uint32(sum[:4])%(1<<31-minDictID)
+	binary.LittleEndian.PutUint32(data[4:8], id)
+	return &Dict{ID: id, Kind: kind, Samples: len(samples), Created: time.Now().UTC(), Data: data}, nil
+}
+
+// Check returns an error if d is not a dictionary zstd can use under its ID.
+func (d *Dict) Check() error {
+	if len(d.Data) < 8 || binary.LittleEndian.Uint32(d.Data) != dictMagic {
+		return fmt.Errorf("dictionary %d is not in zstd format", d.ID)
+	}
+	if id := binary.LittleEndian.Uint32(d.Data[4:8]); id != d.ID {
+		return fmt.Errorf("dictionary %d carries ID %d", d.ID, id)
+	}
+	if _, err := zstd.InspectDictionary(d.Data); err != nil {
+		return fmt.Errorf("dictionary %d: %w", d.ID, err)
+	}
+	return nil
+}
+
+// dicts holds the registered dictionaries and their decoders by ID
+var dicts sync.Map // uint32 -> *dictDecoder
+
+type dictDecoder struct {
+	dict *Dict
+	once sync.Once
+	dec  *zstd.Decoder
+	err  error
+}
+
+// RegisterDict makes data packed against d unpackable, e.g. once loaded
+// from the repository. Registering a dictionary again does nothing.
+func RegisterDict(d *Dict) error {
+	if err := d.Check(); err != nil {
+		return err
+	}
+	dicts.LoadOrStore(d.ID, &dictDecoder{dict: d})
+	return nil
+}
+
+// unpackDict decompresses a frame packed against the dictionary id
+func unpackDict(id uint32, frame []byte) ([]byte, error) {
+	v, ok := dicts.Load(id)
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownDict, id)
+	}
+	dd := v.(*dictDecoder)
+	dd.once.Do(func() {
+		dd.dec, dd.err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderDicts(dd.dict.Data))
+	})
+	if dd.err != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder for dictionary %d: %w", id, dd.err)
+	}
+	data, err := dd.dec.DecodeAll(frame, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress zstd data: %w", err)
+	}
+	return data, nil
+}
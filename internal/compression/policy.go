@@ -0,0 +1,381 @@
+package compression
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Kind is a content type told apart by its leading magic bytes
+type Kind uint8
+
+const (
+	Unknown Kind = iota // not detected yet; Pack detects it
+	Binary              // nothing recognised
+	Text                // valid UTF-8 without NUL bytes, e.g. source code
+	Image               // jpeg, png, gif, webp
+	Video               // mp4, mov, heic and other ISO media, mkv, webm, avi
+	Audio               // mp3, ogg, flac
+	Archive             // zip (and docx, jar...), gzip, zstd, xz, bzip2, 7z, rar
+)
+
+var kindNames = map[Kind]string{
+	Binary:  "binary",
+	Text:    "text",
+	Image:   "image",
+	Video:   "video",
+	Audio:   "audio",
+	Archive: "archive",
+}
+
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+func (k Kind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *Kind) UnmarshalText(text []byte) error {
+	parsed, err := ParseKind(string(text))
+	if err != nil {
+		return err
+	}
+	*k = parsed
+	return nil
+}
+
+// ParseKind returns the kind named s, as written by String.
+func ParseKind(s string) (Kind, error) {
+	for k, name := range kindNames {
+		if name == s {
+			return k, nil
+		}
+	}
+	names := make([]string, 0, len(kindNames))
+	for _, name := range kindNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return Unknown, fmt.Errorf("unknown content type %q (must be one of %s)", s, strings.Join(names, ", "))
+}
+
+// ParseLevels turns levels keyed by kind name, as in the config, into
+// levels for NewPolicy.
+func ParseLevels(levels map[string]int) (map[Kind]int, error) {
+	parsed := make(map[Kind]int, len(levels))
+	for name, level := range levels {
+		k, err := ParseKind(name)
+		if err != nil {
+			return nil, err
+		}
+		parsed[k] = level
+	}
+	return parsed, nil
+}
+
+// magic lists the signatures Detect looks for
+var magic = []struct {
+	offset int
+	sig    []byte
+	kind   Kind
+}{
+	{0, []byte{0xFF, 0xD8, 0xFF}, Image},
+	{0, []byte("\x89PNG\r\n\x1a\n"), Image},
+	{0, []byte("GIF8"), Image},
+	{8, []byte("WEBP"), Image},
+	{4, []byte("ftyp"), Video},
+	{0, []byte{0x1A, 0x45, 0xDF, 0xA3}, Video},
+	{8, []byte("AVI "), Video},
+	{0, []byte("ID3"), Audio},
+	{0, []byte{0xFF, 0xFB}, Audio},
+	{0, []byte{0xFF, 0xF3}, Audio},
+	{0, []byte("OggS"), Audio},
+	{0, []byte("fLaC"), Audio},
+	{0, []byte("PK\x03\x04"), Archive},
+	{0, []byte{0x1F, 0x8B}, Archive},
+	{0, []byte{0x28, 0xB5, 0x2F, 0xFD}, Archive},
+	{0, []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}, Archive},
+	{0, []byte("BZh"), Archive},
+	{0, []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C}, Archive},
+	{0, []byte("Rar!\x1a\x07"), Archive},
+}
+
+// textSample is how much of data Detect checks for text
+const textSample = 4096
+
+// Detect tells the kind of content starting with data, e.g. the first
+// chunk of a file.
+func Detect(data []byte) Kind {
+	for _, m := range magic {
+		if len(data) >= m.offset+len(m.sig) && bytes.Equal(data[m.offset:m.offset+len(m.sig)], m.sig) {
+			return m.kind
+		}
+	}
+	if len(data) == 0 {
+		return Binary
+	}
+	sample, cut := data, false
+	if len(sample) > textSample {
+		sample, cut = sample[:textSample], true
+	}
+	if bytes.IndexByte(sample, 0) >= 0 {
+		return Binary
+	}
+	// A sample cut inside a multi-byte rune is still text
+	for i := 0; i < utf8.UTFMax; i++ {
+		if utf8.Valid(sample[:len(sample)-i]) {
+			return Text
+		}
+		if !cut {
+			break
+		}
+	}
+	return Binary
+}
+
+// DefaultLevels are the zstd levels each kind is compressed at; 0 stores
+// it as it is. Media and archives are compressed already.
+func DefaultLevels() map[Kind]int {
+	return map[Kind]int{
+		Binary:  3,
+		Text:    9,
+		Image:   0,
+		Video:   0,
+		Audio:   0,
+		Archive: 0,
+	}
+}
+
+// Codecs recorded in front of packed data
+const (
+	codecNone byte = 0
+	codecZstd byte = 1
+	// codecZstdDict is followed by the ID of the dictionary, 4 bytes big
+	// endian, then the zstd frame
+	codecZstdDict byte = 2
+)
+
+// Policy compresses data at the level set for its kind.
+type Policy struct {
+	levels map[Kind]int
+
+	mu       sync.Mutex
+	dicts    map[Kind]*Dict
+	encoders map[encoderKey]*zstd.Encoder
+}
+
+// encoderKey tells the shared encoders apart; dict is 0 for none
+type encoderKey struct {
+	level int
+	dict  uint32
+}
+
+// NewPolicy returns a policy compressing each kind at levels[kind], or at
+// its DefaultLevels level when unset. Levels go from 0, stored as is, to
+// 22.
+func NewPolicy(levels map[Kind]int) (*Policy, error) {
+	p := &Policy{levels: DefaultLevels(), dicts: make(map[Kind]*Dict), encoders: make(map[encoderKey]*zstd.Encoder)}
+	for k, level := range levels {
+		if level < 0 || level > 22 {
+			return nil, fmt.Errorf("compression level for %s must be between 0 and 22, got %d", k, level)
+		}
+		p.levels[k] = level
+	}
+	return p, nil
+}
+
+// Level returns the level kind is compressed at.
+func (p *Policy) Level(kind Kind) int {
+	return p.levels[kind]
+}
+
+// UseDict makes the policy compress d.Kind against d, which must be
+// registered for the data to be unpacked. It replaces the kind's earlier
+// dictionary.
+func (p *Policy) UseDict(d *Dict) error {
+	if err := d.Check(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dicts[d.Kind] = d
+	return nil
+}
+
+// Dict returns the dictionary kind is compressed against, nil when none.
+func (p *Policy) Dict(kind Kind) *Dict {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dicts[kind]
+}
+
+// Pack compresses data as the policy says for kind, detecting it when
+// Unknown, and returns it behind a codec byte telling Unpack how to undo
+// it. Data that does not shrink is kept as it is, and so is data that
+// looks compressed already, without spending the time to compress it.
+func (p *Policy) Pack(data []byte, kind Kind) []byte {
+	if kind == Unknown {
+		kind = Detect(data)
+	}
+	if level := p.levels[kind]; level > 0 {
+		if p.incompressible(data) {
+			monitoring.GetMetrics().IncompressibleChunks.Add(1)
+			return append([]byte{codecNone}, data...)
+		}
+		d := p.Dict(kind)
+		enc, err := p.encoder(level, d)
+		if err == nil {
+			var out []byte
+			if d != nil {
+				out = append(make([]byte, 0, len(data)+5), codecZstdDict)
+				out = binary.BigEndian.AppendUint32(out, d.ID)
+			} else {
+				out = append(make([]byte, 0, len(data)+1), codecZstd)
+			}
+			out = enc.EncodeAll(data, out)
+			if len(out) < len(data)+1 {
+				return out
+			}
+		}
+	}
+	return append([]byte{codecNone}, data...)
+}
+
+const (
+	// entropySample is how much of a chunk Incompressible looks at, in
+	// entropyWindows windows spread over it
+	entropySample  = 16 << 10
+	entropyWindows = 4
+	// entropyRaw is the entropy, in bits per byte, above which a sample is
+	// taken to be compressed or encrypted already
+	entropyRaw = 7.9
+	// entropyTrial is the entropy above which the sample is compressed
+	// quickly to decide; below it the chunk is worth compressing
+	entropyTrial = 7.2
+	// trialSaving is the share of the sample a trial must save for the
+	// chunk to be compressed
+	trialSaving = 0.03
+)
+
+// incompressible reports whether data, e.g. a chunk of a video or archive
+// whose file was not recognised as one, looks compressed or encrypted
+// already. It estimates the entropy of a sample of data and, when that is
+// borderline, compresses the sample at the fastest level.
+func (p *Policy) incompressible(data []byte) bool {
+	sample := data
+	if len(data) > entropySample {
+		// Windows spread over the chunk, so a compressible header or
+		// trailer does not decide for all of it
+		win := entropySample / entropyWindows
+		sample = make([]byte, 0, entropySample)
+		for i := 0; i < entropyWindows; i++ {
+			off := (len(data) - win) * i / (entropyWindows - 1)
+			sample = append(sample, data[off:off+win]...)
+		}
+	}
+	if len(sample) < 512 {
+		// Too short to estimate; compressing it is cheap anyway
+		return false
+	}
+	h := entropy(sample)
+	if h >= entropyRaw {
+		return true
+	}
+	if h < entropyTrial {
+		return false
+	}
+	enc, err := p.encoder(1, nil)
+	if err != nil {
+		return false
+	}
+	trial := enc.EncodeAll(sample, make([]byte, 0, len(sample)))
+	return float64(len(trial)) > float64(len(sample))*(1-trialSaving)
+}
+
+// entropy returns the Shannon entropy of the bytes of data, in bits per byte
+func entropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	n := float64(len(data))
+	var h float64
+	for _, c := range counts {
+		if c > 0 {
+			f := float64(c) / n
+			h -= f * math.Log2(f)
+		}
+	}
+	return h
+}
+
+// encoder returns the shared encoder for level against d, which may be nil;
+// EncodeAll may be called concurrently
+func (p *Policy) encoder(level int, d *Dict) (*zstd.Encoder, error) {
+	key := encoderKey{level: level}
+	opts := []zstd.EOption{zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(1)}
+	if d != nil {
+		key.dict = d.ID
+		opts = append(opts, zstd.WithEncoderDict(d.Data))
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if enc, ok := p.encoders[key]; ok {
+		return enc, nil
+	}
+	enc, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+	}
+	p.encoders[key] = enc
+	return enc, nil
+}
+
+var (
+	decoderOnce sync.Once
+	decoder     *zstd.Decoder
+	decoderErr  error
+)
+
+// Unpack returns the data packed by Pack. Data packed against a dictionary
+// not registered fails with ErrUnknownDict.
+func Unpack(packed []byte) ([]byte, error) {
+	if len(packed) == 0 {
+		return nil, fmt.Errorf("packed data is empty")
+	}
+	switch packed[0] {
+	case codecNone:
+		return packed[1:], nil
+	case codecZstd:
+		decoderOnce.Do(func() {
+			decoder, decoderErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+		})
+		if decoderErr != nil {
+			return nil, fmt.Errorf("failed to create zstd decoder: %w", decoderErr)
+		}
+		data, err := decoder.DecodeAll(packed[1:], nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress zstd data: %w", err)
+		}
+		return data, nil
+	case codecZstdDict:
+		if len(packed) < 5 {
+			return nil, fmt.Errorf("packed data is truncated")
+		}
+		return unpackDict(binary.BigEndian.Uint32(packed[1:5]), packed[5:])
+	default:
+		return nil, fmt.Errorf("unknown codec %d", packed[0])
+	}
+}
@@ -0,0 +1,223 @@
+// Package contentpolicy flags files that look like secrets while a snapshot
+// source is walked: private keys, .env files holding credentials, cloud
+// tokens and the like. Snapshots are replicated to peers, so a key backed
+// up by accident travels the swarm, sealed but out of its owner's hands.
+//
+// A rule matches a file by path, with gitignore-style patterns as in
+// package exclude, by content, with a regular expression over the first
+// bytes of the file, or by both. In report mode a flagged file is still
+// backed up; in enforce mode it is left out.
+package contentpolicy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/hoangsonww/backupagent/internal/exclude"
+)
+
+// Modes of a policy
+const (
+	ModeOff     = "off"
+	ModeReport  = "report"
+	ModeEnforce = "enforce"
+)
+
+// DefaultMaxRead is how much of a file content rules look at by default
+const DefaultMaxRead = 256 * 1024
+
+// Rule flags the files matching both its Paths and its Content, or the one
+// of them it sets.
+type Rule struct {
+	Name    string   `yaml:"name" json:"name"`
+	Paths   []string `yaml:"paths,omitempty" json:"paths,omitempty"`     // gitignore-style patterns relative to the source
+	Content string   `yaml:"content,omitempty" json:"content,omitempty"` // regular expression over the start of the file
+}
+
+// Config is the content policy of snapshot.content_policy.
+type Config struct {
+	Mode           string   `yaml:"mode"`             // off, report or enforce
+	Rules          []Rule   `yaml:"rules"`            // checked after the built-in rules
+	NoBuiltinRules bool     `yaml:"no_builtin_rules"` // check only Rules
+	Allow          []string `yaml:"allow"`            // gitignore-style patterns of paths never flagged
+	MaxRead        int64    `yaml:"max_read"`         // bytes of each file content rules look at
+}
+
+// Builtin returns the rules checked unless turned off.
+func Builtin() []Rule {
+	return []Rule{
+		{Name: "private-key", Content: `-----BEGIN (?:RSA |DSA |EC |OPENSSH |ENCRYPTED |PGP )?PRIVATE KEY(?: BLOCK)?-----`},
+		{Name: "ssh-private-key", Paths: []string{"**/.ssh/id_*", "!*.pub"}},
+		{
+			Name:    "dotenv-credentials",
+			Paths:   []string{".env", ".env.*", "*.env"},
+			Content: `(?im)^\s*(?:export\s+)?[A-Z0-9_]*(?:SECRET|PASSWORD|PASSWD|TOKEN|API_KEY|APIKEY|ACCESS_KEY|PRIVATE_KEY|CREDENTIALS?)[A-Z0-9_]*\s*=\s*['"]?[^\s'"#]`,
+		},
+		{Name: "aws-credentials", Paths: []string{"**/.aws/credentials"}},
+		{Name: "aws-access-key", Content: `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`},
+		{Name: "gcp-service-account", Content: `"type"\s*:\s*"service_account"`},
+		{Name: "github-token", Content: `\b(?:gh[pousr]_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{82})\b`},
+		{Name: "slack-token", Content: `\bxox[abposr]-[A-Za-z0-9-]{10,}`},
+		{Name: "google-api-key", Content: `\bAIza[0-9A-Za-z_-]{35}\b`},
+		{Name: "netrc", Paths: []string{".netrc", "_netrc"}},
+		{Name: "kube-config", Paths: []string{"**/.kube/config"}},
+	}
+}
+
+// Finding is a file a rule flagged.
+type Finding struct {
+	Path     string `json:"path"`
+	Rule     string `json:"rule"`
+	Excluded bool   `json:"excluded"` // left out of the snapshot, in enforce mode
+}
+
+// Policy is a compiled Config. The nil Policy flags nothing.
+type Policy struct {
+	mode    string
+	rules   []rule
+	allow   *exclude.Set
+	maxRead int64
+	key     string
+}
+
+type rule struct {
+	name    string
+	paths   *exclude.Set // nil matches every path
+	content *regexp.Regexp
+}
+
+// Compile checks c and compiles its rules. It returns nil when the mode is
+// off.
+func Compile(c Config) (*Policy, error) {
+	switch c.Mode {
+	case "", ModeOff:
+		return nil, nil
+	case ModeReport, ModeEnforce:
+	default:
+		return nil, fmt.Errorf("invalid mode %q (must be off, report or enforce)", c.Mode)
+	}
+	if c.MaxRead < 0 {
+		return nil, fmt.Errorf("max_read must be >= 0, got %d", c.MaxRead)
+	}
+	p := &Policy{mode: c.Mode, maxRead: c.MaxRead}
+	if p.maxRead == 0 {
+		p.maxRead = DefaultMaxRead
+	}
+	rules := c.Rules
+	if !c.NoBuiltinRules {
+		rules = append(Builtin(), rules...)
+	}
+	var err error
+	if p.allow, err = exclude.Compile(c.Allow); err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	names := make(map[string]bool)
+	for _, r := range rules {
+		if r.Name == "" {
+			return nil, errors.New("rule without a name")
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("rule %s defined twice", r.Name)
+		}
+		names[r.Name] = true
+		if len(r.Paths) == 0 && r.Content == "" {
+			return nil, fmt.Errorf("rule %s needs paths or content", r.Name)
+		}
+		cr := rule{name: r.Name}
+		if cr.paths, err = exclude.Compile(r.Paths); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+		if r.Content != "" {
+			if cr.content, err = regexp.Compile(r.Content); err != nil {
+				return nil, fmt.Errorf("rule %s: invalid content: %v", r.Name, err)
+			}
+		}
+		p.rules = append(p.rules, cr)
+	}
+	var key strings.Builder
+	fmt.Fprintf(&key, "%s %d\n%s", p.mode, p.maxRead, p.allow)
+	for _, r := range rules {
+		fmt.Fprintf(&key, "\n%s %q %q", r.Name, r.Paths, r.Content)
+	}
+	p.key = key.String()
+	return p, nil
+}
+
+// Enforced reports whether flagged files are left out.
+func (p *Policy) Enforced() bool {
+	return p != nil && p.mode == ModeEnforce
+}
+
+// String describes the policy; equal strings mean equal policies.
+func (p *Policy) String() string {
+	if p == nil {
+		return ""
+	}
+	return p.key
+}
+
+// Check returns the finding for the regular file at path, whose path relative
+// to the source is rel, slash-separated, or nil when no rule flags it. Only
+// the first max_read bytes are read, and only if a content rule needs them.
+func (p *Policy) Check(path, rel string) (*Finding, error) {
+	if p == nil || p.allowed(rel) {
+		return nil, nil
+	}
+	var head []byte
+	read := false
+	for _, r := range p.rules {
+		if r.paths != nil && !r.paths.Excluded(rel, false) {
+			continue
+		}
+		if r.content != nil {
+			if !read {
+				var err error
+				if head, err = readHead(path, p.maxRead); err != nil {
+					return nil, err
+				}
+				read = true
+			}
+			if !r.content.Match(head) {
+				continue
+			}
+		}
+		return &Finding{Path: path, Rule: r.name, Excluded: p.Enforced()}, nil
+	}
+	return nil, nil
+}
+
+// allowed reports whether an allow pattern matches rel or a directory
+// above it
+func (p *Policy) allowed(rel string) bool {
+	if p.allow.Excluded(rel, false) {
+		return true
+	}
+	for i := strings.IndexByte(rel, '/'); i >= 0; i = nextSlash(rel, i) {
+		if p.allow.Excluded(rel[:i], true) {
+			return true
+		}
+	}
+	return false
+}
+
+func nextSlash(s string, i int) int {
+	j := strings.IndexByte(s[i+1:], '/')
+	if j < 0 {
+		return -1
+	}
+	return i + 1 + j
+}
+
+// readHead returns up to n bytes from the start of the file at path
+func readHead(path string, n int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, n))
+}
@@ -16,13 +16,21 @@ const (
 	saltSize = 16
 )
 
+// Argon2id parameters DeriveKey uses
+const (
+	KDFTime    = 1         // passes
+	KDFMemory  = 64 * 1024 // KiB
+	KDFThreads = 4
+	KeySize    = 32 // bytes, an AES-256 key
+)
+
 func DeriveKey(passphrase string, salt []byte) []byte {
 	if salt == nil {
 		salt = make([]byte, saltSize)
 		rand.Read(salt)
 	}
 	// Using Argon2id
-	return argon2.IDKey([]byte(passphrase), salt, 1, 64*1024, 4, 32)
+	return argon2.IDKey([]byte(passphrase), salt, KDFTime, KDFMemory, KDFThreads, KeySize)
 }
 
 func Encrypt(plaintext, key []byte) (ciphertext, nonce []byte, err error) {
@@ -0,0 +1,123 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"math/big"
+)
+
+// curve25519P is the field prime 2^255 - 19 shared by Ed25519 and X25519.
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// Ed25519PublicToX25519 converts an Ed25519 public key to its Montgomery
+// (X25519) form using the birational map u = (1 + y) / (1 - y).
+func Ed25519PublicToX25519(pub []byte) ([]byte, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid ed25519 public key size")
+	}
+	// y is encoded little-endian with the sign of x in the top bit
+	le := make([]byte, 32)
+	copy(le, pub)
+	le[31] &= 0x7f
+	y := new(big.Int).SetBytes(reverse(le))
+
+	one := big.NewInt(1)
+	num := new(big.Int).Add(one, y)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 {
+		return nil, errors.New("ed25519 public key has no x25519 equivalent")
+	}
+	den.ModInverse(den, curve25519P)
+	u := num.Mul(num, den)
+	u.Mod(u, curve25519P)
+
+	out := make([]byte, 32)
+	u.FillBytes(out)
+	return reverse(out), nil
+}
+
+// Ed25519PrivateToX25519 derives the X25519 scalar matching an Ed25519 private key.
+func Ed25519PrivateToX25519(priv []byte) ([]byte, error) {
+	if len(priv) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid ed25519 private key size")
+	}
+	h := sha512.Sum512(priv[:ed25519.SeedSize])
+	return h[:32], nil
+}
+
+// SealTo encrypts plaintext so that only the holder of the Ed25519 private key
+// matching recipientPub can open it. Output is ephemeralPub || nonce || ciphertext.
+func SealTo(plaintext, recipientPub []byte) ([]byte, error) {
+	xpub, err := Ed25519PublicToX25519(recipientPub)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := ecdh.X25519().NewPublicKey(xpub)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(remote)
+	if err != nil {
+		return nil, err
+	}
+	key := sealKey(shared, eph.PublicKey().Bytes(), xpub)
+	ciphertext, nonce, err := Encrypt(plaintext, key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, 32+len(nonce)+len(ciphertext))
+	out = append(out, eph.PublicKey().Bytes()...)
+	out = append(out, nonce...)
+	return append(out, ciphertext...), nil
+}
+
+// OpenSealed reverses SealTo using the recipient's Ed25519 private key.
+func OpenSealed(sealed, recipientPriv []byte) ([]byte, error) {
+	// 32 byte ephemeral key + 12 byte GCM nonce
+	if len(sealed) < 44 {
+		return nil, errors.New("sealed box too short")
+	}
+	scalar, err := Ed25519PrivateToX25519(recipientPriv)
+	if err != nil {
+		return nil, err
+	}
+	local, err := ecdh.X25519().NewPrivateKey(scalar)
+	if err != nil {
+		return nil, err
+	}
+	ephPub, err := ecdh.X25519().NewPublicKey(sealed[:32])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := local.ECDH(ephPub)
+	if err != nil {
+		return nil, err
+	}
+	key := sealKey(shared, sealed[:32], local.PublicKey().Bytes())
+	return Decrypt(sealed[44:], key, sealed[32:44])
+}
+
+func sealKey(shared, ephPub, recipientPub []byte) []byte {
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(ephPub)
+	h.Write(recipientPub)
+	return h.Sum(nil)
+}
+
+func reverse(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[len(b)-1-i] = b[i]
+	}
+	return out
+}
@@ -14,6 +14,7 @@ const (
 	ErrCodeStorageCorrupted ErrorCode = "STORAGE_CORRUPTED"
 	ErrCodeChunkNotFound    ErrorCode = "CHUNK_NOT_FOUND"
 	ErrCodeChunkInvalid     ErrorCode = "CHUNK_INVALID"
+	ErrCodeStorageIO        ErrorCode = "STORAGE_IO"
 
 	// Network errors
 	ErrCodeNetworkTimeout     ErrorCode = "NETWORK_TIMEOUT"
@@ -132,6 +133,10 @@ func NewStorageFullError(message string) *ShadowVaultError {
 	return NewError(ErrCodeStorageFull, message)
 }
 
+func NewStorageIOError(err error) *ShadowVaultError {
+	return WrapError(ErrCodeStorageIO, "storage read failed", err)
+}
+
 func NewChunkNotFoundError(hash string) *ShadowVaultError {
 	return NewError(ErrCodeChunkNotFound, fmt.Sprintf("chunk not found: %s", hash))
 }
@@ -0,0 +1,233 @@
+// Package exclude matches paths below a snapshot source against exclude
+// patterns with gitignore semantics:
+//
+//   - Blank lines and lines starting with # are ignored.
+//   - A pattern containing a slash, other than a trailing one, is anchored
+//     to the source; otherwise it matches a name at any depth.
+//   - A trailing slash matches directories only.
+//   - * and ? match within one path component, [...] matches a class and
+//     ** matches any number of components.
+//   - A pattern starting with ! includes again what an earlier pattern
+//     excluded. The last matching pattern decides.
+//   - An excluded directory is not entered, so nothing below it can be
+//     included again.
+//
+// WithDefaults adds the patterns of Defaults and leaves out directories
+// marked with a CACHEDIR.TAG file.
+package exclude
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// CacheDirTag is the file marking a directory as a cache, see
+// https://bford.info/cachedir/
+const CacheDirTag = "CACHEDIR.TAG"
+
+// cacheDirSignature starts every valid CACHEDIR.TAG
+var cacheDirSignature = []byte("Signature: 8a477f597d28d172789f06886806bc55")
+
+// cacheTagsLine stands for CACHEDIR.TAG detection in String
+const cacheTagsLine = "# " + CacheDirTag
+
+// Defaults are left out of snapshots unless turned off: trash, caches,
+// dependency trees that are installed again, and OS swap and hibernation
+// files. A ! pattern of snapshot.excludes includes one of them again.
+func Defaults() []string {
+	return []string{
+		// Trash
+		".Trash/",
+		".Trash-*/",
+		".Trashes/",
+		"**/.local/share/Trash/",
+		"$RECYCLE.BIN/",
+		// Caches, including those of other backup tools, e.g. restic and borg
+		".cache/",
+		"**/Library/Caches/",
+		"**/AppData/Local/Temp/",
+		// Browser and Electron caches
+		"cache2/",
+		"Code Cache/",
+		"GPUCache/",
+		"**/AppData/Local/Google/Chrome/User Data/*/Cache/",
+		"**/AppData/Local/Microsoft/Edge/User Data/*/Cache/",
+		// Dependency trees
+		"node_modules/",
+		// Swap and hibernation
+		"pagefile.sys",
+		"hiberfil.sys",
+		"swapfile.sys",
+		"/swapfile",
+		"/private/var/vm/",
+	}
+}
+
+// Set is a compiled list of patterns. The nil Set excludes nothing.
+type Set struct {
+	patterns  []string
+	rules     []rule
+	cacheTags bool // directories holding a valid CACHEDIR.TAG are excluded
+}
+
+type rule struct {
+	re      *regexp.Regexp
+	include bool // a ! pattern
+	dirOnly bool
+}
+
+// Compile parses patterns, in order of increasing precedence.
+func Compile(patterns []string) (*Set, error) {
+	var s Set
+	for _, p := range patterns {
+		line := strings.TrimSpace(p)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var r rule
+		if strings.HasPrefix(line, "!") {
+			r.include = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			return nil, fmt.Errorf("invalid exclude pattern %q", p)
+		}
+		expr, err := translate(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %v", p, err)
+		}
+		if r.re, err = regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %v", p, err)
+		}
+		s.patterns = append(s.patterns, p)
+		s.rules = append(s.rules, r)
+	}
+	if len(s.rules) == 0 {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+// WithDefaults is Compile for the patterns of Defaults followed by patterns,
+// which can include some of them again. Directories marked with a valid
+// CACHEDIR.TAG are excluded too, by ExcludedAt.
+func WithDefaults(patterns []string) (*Set, error) {
+	s, err := Compile(append(Defaults(), patterns...))
+	if err != nil {
+		return nil, err
+	}
+	s.cacheTags = true
+	return s, nil
+}
+
+// ExcludedAt is Excluded for rel, found at p on disk. It also excludes a
+// directory holding a valid CACHEDIR.TAG when the set looks for them.
+func (s *Set) ExcludedAt(p, rel string, dir bool) bool {
+	if s.Excluded(rel, dir) {
+		return true
+	}
+	return dir && s != nil && s.cacheTags && isCacheDir(p)
+}
+
+// isCacheDir reports whether dir holds a CACHEDIR.TAG starting with its
+// signature
+func isCacheDir(dir string) bool {
+	f, err := os.Open(filepath.Join(dir, CacheDirTag))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, len(cacheDirSignature))
+	if _, err := io.ReadFull(f, head); err != nil {
+		return false
+	}
+	return bytes.Equal(head, cacheDirSignature)
+}
+
+// Excluded reports whether rel, slash-separated and relative to the source,
+// is excluded. dir tells whether it names a directory.
+func (s *Set) Excluded(rel string, dir bool) bool {
+	if s == nil {
+		return false
+	}
+	excluded := false
+	for _, r := range s.rules {
+		if r.dirOnly && !dir {
+			continue
+		}
+		if r.re.MatchString(rel) {
+			excluded = !r.include
+		}
+	}
+	return excluded
+}
+
+// String returns the patterns, one per line; equal strings mean equal sets.
+func (s *Set) String() string {
+	if s == nil {
+		return ""
+	}
+	if s.cacheTags {
+		return strings.Join(append(s.patterns, cacheTagsLine), "\n")
+	}
+	return strings.Join(s.patterns, "\n")
+}
+
+// translate turns a pattern into an anchored regular expression over
+// slash-separated relative paths
+func translate(p string) (string, error) {
+	var b strings.Builder
+	if strings.Contains(p, "/") {
+		b.WriteString("^")
+		p = strings.TrimPrefix(p, "/")
+	} else {
+		b.WriteString("^(?:.*/)?")
+	}
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case strings.HasPrefix(p[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "/**") && i+3 == len(p):
+			b.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(p[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated [")
+			}
+			class := p[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(p):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(p[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String(), nil
+}
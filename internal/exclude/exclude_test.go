@@ -0,0 +1,129 @@
+package exclude_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/exclude"
+)
+
+func TestExcluded(t *testing.T) {
+	set, err := exclude.Compile([]string{
+		"# caches",
+		"*.tmp",
+		"node_modules/",
+		"/build",
+		"docs/**/*.pdf",
+		"logs/**",
+		"!logs/keep.log",
+		"secret?.txt",
+		"[ab].bin",
+		"",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path string
+		dir  bool
+		want bool
+	}{
+		{"a.tmp", false, true},
+		{"src/deep/a.tmp", false, true},
+		{"a.tmpx", false, false},
+		{"node_modules", true, true},
+		{"web/node_modules", true, true},
+		{"node_modules", false, false}, // a file of that name
+		{"build", true, true},
+		{"src/build", true, false}, // anchored
+		{"docs/a.pdf", false, true},
+		{"docs/x/y/a.pdf", false, true},
+		{"docs/a.txt", false, false},
+		{"logs/app.log", false, true},
+		{"logs/keep.log", false, false},
+		{"secret1.txt", false, true},
+		{"secret10.txt", false, false},
+		{"a.bin", false, true},
+		{"c.bin", false, false},
+		{"# caches", false, false},
+	}
+	for _, c := range cases {
+		if got := set.Excluded(c.path, c.dir); got != c.want {
+			t.Errorf("Excluded(%q, dir=%v) = %v, want %v", c.path, c.dir, got, c.want)
+		}
+	}
+
+	var none *exclude.Set
+	if none.Excluded("a.tmp", false) || none.ExcludedAt(t.TempDir(), "dir", true) || none.String() != "" {
+		t.Error("nil set excludes something")
+	}
+	if s, err := exclude.Compile([]string{" ", "# only a comment"}); s != nil || err != nil {
+		t.Errorf("Compile of no patterns = %v, %v, want nil", s, err)
+	}
+	for _, bad := range []string{"[abc", "!", "/"} {
+		if _, err := exclude.Compile([]string{bad}); err == nil {
+			t.Errorf("Compile(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestWithDefaults(t *testing.T) {
+	set, err := exclude.WithDefaults([]string{"!node_modules/", "*.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path string
+		dir  bool
+		want bool
+	}{
+		{".cache", true, true},
+		{"home/me/.local/share/Trash", true, true},
+		{".Trash-1000", true, true},
+		{"Users/me/Library/Caches", true, true},
+		{"pagefile.sys", false, true},
+		{"swapfile", false, true},
+		{"src/swapfile", false, false},
+		{"node_modules", true, false},
+		{"app.log", false, true},
+		{".git/objects", true, false},
+	}
+	for _, c := range cases {
+		if got := set.Excluded(c.path, c.dir); got != c.want {
+			t.Errorf("Excluded(%q, dir=%v) = %v, want %v", c.path, c.dir, got, c.want)
+		}
+	}
+
+	root := t.TempDir()
+	tagged, fake := filepath.Join(root, "tagged"), filepath.Join(root, "fake")
+	for _, d := range []string{tagged, fake} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tag := "Signature: 8a477f597d28d172789f06886806bc55\n# This file is a cache directory tag.\n"
+	if err := os.WriteFile(filepath.Join(tagged, exclude.CacheDirTag), []byte(tag), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(fake, exclude.CacheDirTag), []byte("Signature: 0"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !set.ExcludedAt(tagged, "tagged", true) {
+		t.Error("directory with CACHEDIR.TAG not excluded")
+	}
+	if set.ExcludedAt(fake, "fake", true) {
+		t.Error("directory with an unsigned CACHEDIR.TAG excluded")
+	}
+	plain, err := exclude.Compile([]string{"*.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.ExcludedAt(tagged, "tagged", true) {
+		t.Error("Compile excludes CACHEDIR.TAG directories")
+	}
+	if !strings.Contains(set.String(), exclude.CacheDirTag) || strings.Contains(plain.String(), exclude.CacheDirTag) {
+		t.Error("String does not tell whether CACHEDIR.TAG directories are excluded")
+	}
+}
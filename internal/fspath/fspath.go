@@ -0,0 +1,88 @@
+// Package fspath turns the paths users give into the spelling a filesystem
+// stores and the key a repository records, so one source keeps one history
+// across spellings and platforms.
+//
+// Three spellings can name the same directory: a Windows long path with the
+// \\?\ prefix and one without; NFC and NFD forms of the same accented name,
+// which macOS treats as one and Linux as two; and, on case-insensitive
+// filesystems, names differing only in case.
+package fspath
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Resolve returns the absolute form of p spelled as the filesystem lists it.
+// Components that exist under another case or normalization, as on a
+// case-insensitive volume or when p is a repository key of an NFD name, take
+// the listed spelling. Missing components are kept as given.
+//
+// The \\?\ prefix is dropped: the os package adds it back to long absolute
+// paths on Windows.
+func Resolve(p string) (string, error) {
+	abs, err := filepath.Abs(stripLongPrefix(p))
+	if err != nil {
+		return "", err
+	}
+	vol := filepath.VolumeName(abs)
+	rest := strings.TrimPrefix(abs[len(vol):], string(filepath.Separator))
+	dir := vol + string(filepath.Separator)
+	if rest == "" {
+		return dir, nil
+	}
+	for _, comp := range strings.Split(rest, string(filepath.Separator)) {
+		dir = filepath.Join(dir, listedName(dir, comp))
+	}
+	return dir, nil
+}
+
+// listedName returns the entry of dir that comp refers to
+func listedName(dir, comp string) string {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return comp
+	}
+	for _, de := range des {
+		if de.Name() == comp {
+			return comp
+		}
+	}
+	// Found by the filesystem but not listed as spelled: it matched another
+	// case or normalization, and the listed name is the real one
+	_, err = os.Lstat(filepath.Join(dir, comp))
+	insensitive := err == nil
+	want := norm.NFC.String(comp)
+	for _, de := range des {
+		got := norm.NFC.String(de.Name())
+		if got == want || (insensitive && strings.EqualFold(got, want)) {
+			return de.Name()
+		}
+	}
+	return comp
+}
+
+// Key is the form of a resolved path recorded in manifests and indexes:
+// NFC, with bytes that are not UTF-8 replaced so the key survives JSON.
+func Key(p string) string {
+	return norm.NFC.String(strings.ToValidUTF8(p, "\uFFFD"))
+}
+
+// Original encodes p for a manifest if Key changes it, so the exact bytes
+// can be recovered; it returns "" otherwise.
+func Original(p string) string {
+	if Key(p) == p {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(p))
+}
+
+// DecodeOriginal reverses Original.
+func DecodeOriginal(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	return string(b), err
+}
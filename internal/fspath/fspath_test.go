@@ -0,0 +1,64 @@
+package fspath_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/fspath"
+)
+
+func TestResolve(t *testing.T) {
+	const (
+		nfc = "caf\u00e9"  // é as one code point
+		nfd = "cafe\u0301" // e and a combining accent
+	)
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, nfd), 0755); err != nil {
+		t.Fatal(err)
+	}
+	root, err := fspath.Resolve(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A key recorded in NFC finds the NFD directory again
+	got, err := fspath.Resolve(filepath.Join(root, nfc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(root, nfd); got != want {
+		t.Errorf("Resolve(nfc) = %q, want %q", got, want)
+	}
+	if _, err := os.Stat(got); err != nil {
+		t.Errorf("resolved path: %v", err)
+	}
+	if key := fspath.Key(got); key != filepath.Join(root, nfc) {
+		t.Errorf("Key = %q, want NFC", key)
+	}
+
+	// Missing components keep their spelling
+	missing := filepath.Join(root, "Missing", nfd)
+	if got, _ := fspath.Resolve(missing); got != missing {
+		t.Errorf("Resolve(missing) = %q", got)
+	}
+	if got, _ := fspath.Resolve(filepath.Join(root, nfd, "..", nfd)); got != filepath.Join(root, nfd) {
+		t.Errorf("Resolve did not clean: %q", got)
+	}
+}
+
+func TestOriginal(t *testing.T) {
+	if enc := fspath.Original("/srv/caf\u00e9"); enc != "" {
+		t.Errorf("NFC path encoded as %q", enc)
+	}
+	for _, p := range []string{"/srv/cafe\u0301", "/srv/latin1-\xe9"} {
+		enc := fspath.Original(p)
+		if enc == "" {
+			t.Fatalf("%q not encoded", p)
+		}
+		dec, err := fspath.DecodeOriginal(enc)
+		if err != nil || dec != p {
+			t.Errorf("DecodeOriginal = %q, %v; want %q", dec, err, p)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !windows
+
+package fspath
+
+func stripLongPrefix(p string) string {
+	return p
+}
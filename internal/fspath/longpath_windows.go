@@ -0,0 +1,15 @@
+package fspath
+
+import "strings"
+
+// stripLongPrefix turns \\?\C:\dir into C:\dir and \\?\UNC\host\share into
+// \\host\share
+func stripLongPrefix(p string) string {
+	switch {
+	case strings.HasPrefix(p, `\\?\UNC\`):
+		return `\\` + p[len(`\\?\UNC\`):]
+	case strings.HasPrefix(p, `\\?\`):
+		return p[len(`\\?\`):]
+	}
+	return p
+}
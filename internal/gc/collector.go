@@ -2,13 +2,18 @@ package gc
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"time"
 
+	"github.com/hoangsonww/backupagent/internal/chunkindex"
 	"github.com/hoangsonww/backupagent/internal/monitoring"
 	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/snapshots"
 	"github.com/hoangsonww/backupagent/internal/storage"
 	"github.com/hoangsonww/backupagent/internal/versioning"
+	bolt "go.etcd.io/bbolt"
 )
 
 // Collector handles garbage collection of old snapshots and unreferenced chunks
@@ -16,20 +21,26 @@ type Collector struct {
 	db            *persistence.DB
 	store         *storage.Store
 	retentionDays int
+	policy        Policy
 	gcInterval    time.Duration
+	grace         time.Duration
 	metrics       *monitoring.Metrics
 	ctx           context.Context
 	cancel        context.CancelFunc
 }
 
-// NewCollector creates a new garbage collector
-func NewCollector(db *persistence.DB, store *storage.Store, retentionDays int, gcInterval time.Duration) *Collector {
+// NewCollector creates a new garbage collector. Snapshots are kept by
+// policy, or for retentionDays where it has no rules. Chunks are deleted
+// once no snapshot has referenced them for grace.
+func NewCollector(db *persistence.DB, store *storage.Store, retentionDays int, policy Policy, gcInterval, grace time.Duration) *Collector {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Collector{
 		db:            db,
 		store:         store,
 		retentionDays: retentionDays,
+		policy:        policy,
 		gcInterval:    gcInterval,
+		grace:         grace,
 		metrics:       monitoring.GetMetrics(),
 		ctx:           ctx,
 		cancel:        cancel,
@@ -72,133 +83,241 @@ func (gc *Collector) Stop() {
 
 // Run performs a garbage collection cycle
 func (gc *Collector) Run() error {
+	return gc.RunContext(context.Background())
+}
+
+// RunContext performs a garbage collection cycle, stopping early with
+// ctx.Err() when ctx ends. What was deleted stays deleted, so the next cycle
+// picks up where this one stopped. Every cycle is recorded in the history.
+func (gc *Collector) RunContext(ctx context.Context) error {
 	logger := monitoring.GetLogger()
-	startTime := time.Now()
+	rec := &RunRecord{Started: time.Now()}
 
 	logger.Info("Starting garbage collection cycle")
+	err := gc.cycle(ctx, rec)
+	rec.Finished = time.Now()
+	if err != nil {
+		rec.Error = err.Error()
+		rec.Interrupted = ctx.Err() != nil && errors.Is(err, ctx.Err())
+	}
+	if serr := saveRun(gc.db, rec); serr != nil {
+		logger.WithError(serr).Warn("Failed to record garbage collection run")
+	}
 
-	// Step 1: Find and delete old snapshots
-	deletedSnapshots, err := gc.deleteOldSnapshots()
+	// Record metrics
+	gc.metrics.RecordGarbageCollection(uint64(rec.ChunksDeleted), rec.BytesFreed)
 	if err != nil {
-		return fmt.Errorf("failed to delete old snapshots: %w", err)
+		return err
 	}
 
-	logger.Infof("Deleted %d old snapshots", deletedSnapshots)
+	logger.WithFields(map[string]interface{}{
+		"deleted_snapshots": rec.SnapshotsDeleted,
+		"deleted_chunks":    rec.ChunksDeleted,
+		"bytes_freed":       rec.BytesFreed,
+		"errors":            rec.ErrorCount,
+		"duration":          rec.Finished.Sub(rec.Started).Seconds(),
+	}).Info("Garbage collection completed")
+	return nil
+}
+
+// cycle runs the steps of a collection, counting its work in rec
+func (gc *Collector) cycle(ctx context.Context, rec *RunRecord) error {
+	logger := monitoring.GetLogger()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	// Step 2: Find referenced chunks
-	referencedChunks, err := gc.findReferencedChunks()
-	if err != nil {
-		return fmt.Errorf("failed to find referenced chunks: %w", err)
+	// Step 1: Find and delete old snapshots
+	if err := gc.deleteOldSnapshots(ctx, rec); err != nil {
+		return fmt.Errorf("failed to delete old snapshots: %w", err)
 	}
 
-	logger.Infof("Found %d referenced chunks", len(referencedChunks))
+	logger.Infof("Deleted %d old snapshots", rec.SnapshotsDeleted)
 
-	// Step 3: Delete unreferenced chunks
-	deletedChunks, bytesFreed, err := gc.deleteUnreferencedChunks(referencedChunks)
+	// Step 2: Mark chunks no snapshot references, from the dedup index.
+	// Only those unreferenced since a mark at least grace ago are garbage.
+	garbage, err := gc.markUnreferenced(time.Now(), rec)
 	if err != nil {
-		return fmt.Errorf("failed to delete unreferenced chunks: %w", err)
+		return fmt.Errorf("failed to find unreferenced chunks: %w", err)
 	}
 
-	// Record metrics
-	gc.metrics.RecordGarbageCollection(uint64(deletedChunks), int64(bytesFreed))
+	logger.Infof("Found %d unreferenced chunks past the grace period, %d within it", len(garbage), rec.ChunksPending)
 
-	duration := time.Since(startTime)
-	logger.WithFields(map[string]interface{}{
-		"deleted_snapshots": deletedSnapshots,
-		"deleted_chunks":    deletedChunks,
-		"bytes_freed":       bytesFreed,
-		"duration":          duration.Seconds(),
-	}).Info("Garbage collection completed")
+	// Step 3: Sweep them once no backup is writing to the repository
+	if err := gc.sweep(ctx, garbage, rec); err != nil {
+		return fmt.Errorf("failed to delete unreferenced chunks: %w", err)
+	}
 
+	// Step 4: Rewrite packs left mostly empty by the deletions
+	packs, freed, err := gc.store.Repack(ctx)
+	rec.PacksRewritten += packs
+	rec.PackBytesFreed += freed
+	if err != nil {
+		return fmt.Errorf("failed to repack sparse packs: %w", err)
+	}
+	if packs > 0 {
+		logger.Infof("Rewrote %d sparse packs, reclaiming %d bytes", packs, freed)
+	}
 	return nil
 }
 
-// deleteOldSnapshots deletes snapshots older than retention period
-func (gc *Collector) deleteOldSnapshots() (int, error) {
+// deleteOldSnapshots deletes the snapshots the retention policy does not keep
+func (gc *Collector) deleteOldSnapshots(ctx context.Context, rec *RunRecord) error {
 	logger := monitoring.GetLogger()
-	cutoffTime := time.Now().AddDate(0, 0, -gc.retentionDays)
-
-	// Get all snapshots
-	snapshots, err := gc.getAllSnapshots()
+	decisions, err := gc.Plan(time.Now())
 	if err != nil {
-		return 0, fmt.Errorf("failed to get snapshots: %w", err)
+		return fmt.Errorf("failed to get snapshots: %w", err)
 	}
 
-	deletedCount := 0
-	for _, snap := range snapshots {
-		// Parse snapshot timestamp
-		snapTime, err := time.Parse(time.RFC3339, snap.Timestamp)
-		if err != nil {
-			logger.WithError(err).Warnf("Failed to parse snapshot timestamp: %s", snap.ID)
+	for _, d := range decisions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.Time.IsZero() {
+			logger.Warnf("Snapshot has no timestamp: %s", d.SnapshotID)
 			continue
 		}
-
-		// Delete if older than cutoff
-		if snapTime.Before(cutoffTime) {
-			if err := versioning.DeleteSnapshot(gc.db, snap.ID); err != nil {
-				logger.WithError(err).Warnf("Failed to delete snapshot: %s", snap.ID)
-				continue
-			}
-			logger.Infof("Deleted old snapshot: %s (age: %s)", snap.ID, time.Since(snapTime))
-			deletedCount++
+		if d.Keep {
+			continue
 		}
+		if err := versioning.DeleteSnapshot(gc.db, d.SnapshotID); err != nil {
+			logger.WithError(err).Warnf("Failed to delete snapshot: %s", d.SnapshotID)
+			rec.addError(fmt.Errorf("snapshot %s: %w", d.SnapshotID, err))
+			continue
+		}
+		logger.Infof("Deleted old snapshot: %s (age: %s)", d.SnapshotID, time.Since(d.Time))
+		rec.SnapshotsDeleted++
 	}
 
-	return deletedCount, nil
+	return nil
 }
 
-// findReferencedChunks returns a set of all chunk hashes referenced by active snapshots
-func (gc *Collector) findReferencedChunks() (map[string]bool, error) {
+// Plan decides which snapshots the retention policy keeps at now, without
+// deleting any. Held snapshots are always kept.
+func (gc *Collector) Plan(now time.Time) ([]Decision, error) {
 	snapshots, err := gc.getAllSnapshots()
 	if err != nil {
 		return nil, err
 	}
-
-	referenced := make(map[string]bool)
-	for _, snap := range snapshots {
-		for _, chunkHash := range snap.Chunks {
-			referenced[chunkHash] = true
+	holds, err := versioning.ListHolds(gc.db)
+	if err != nil {
+		return nil, err
+	}
+	held := make(map[string]bool, len(holds))
+	for _, h := range holds {
+		held[h.SnapshotID] = true
+	}
+	decisions := Plan(snapshots, gc.retentionDays, gc.policy, now)
+	for i := range decisions {
+		if held[decisions[i].SnapshotID] {
+			decisions[i].keep("hold")
 		}
 	}
-
-	return referenced, nil
+	return decisions, nil
 }
 
-// deleteUnreferencedChunks deletes chunks not referenced by any snapshot
-func (gc *Collector) deleteUnreferencedChunks(referenced map[string]bool) (int, int64, error) {
-	logger := monitoring.GetLogger()
-
-	// Get all stored chunks
-	allChunks, err := gc.store.ListAll()
-	if err != nil {
-		return 0, 0, fmt.Errorf("failed to list chunks: %w", err)
-	}
-
-	deletedCount := 0
-	var bytesFreed int64
-
-	for _, chunkHash := range allChunks {
-		if !referenced[chunkHash] {
-			// Get chunk size before deletion
-			data, err := gc.store.Get(chunkHash)
-			if err != nil {
-				logger.WithError(err).Warnf("Failed to get chunk for size: %s", chunkHash)
-				continue
+// markUnreferenced records when each stored chunk whose reference count is
+// zero was first found so, forgetting chunks referenced or deleted since,
+// and returns the stored size of those first found at least grace before
+// now. Only the index is read, not snapshots or chunks.
+func (gc *Collector) markUnreferenced(now time.Time, rec *RunRecord) (map[string]int64, error) {
+	garbage := make(map[string]int64)
+	err := gc.db.Update(func(tx *bolt.Tx) error {
+		unreferenced := make(map[string]int64)
+		err := chunkindex.ForEach(tx, func(hash string, e chunkindex.Entry) error {
+			if e.Refs == 0 && e.Stored() {
+				unreferenced[hash] = e.Size
 			}
-			chunkSize := int64(len(data))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 
-			// Delete unreferenced chunk
-			if err := gc.store.Delete(chunkHash); err != nil {
-				logger.WithError(err).Warnf("Failed to delete chunk: %s", chunkHash)
+		b := tx.Bucket([]byte(persistence.BucketGCPending))
+		var stale [][]byte
+		err = b.ForEach(func(k, v []byte) error {
+			size, ok := unreferenced[string(k)]
+			if !ok {
+				stale = append(stale, append([]byte(nil), k...))
+				return nil
+			}
+			delete(unreferenced, string(k))
+			if len(v) == 8 && now.Sub(time.Unix(0, int64(binary.BigEndian.Uint64(v)))) >= gc.grace {
+				garbage[string(k)] = size
+			} else {
+				rec.ChunksPending++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		seen := binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()))
+		for hash, size := range unreferenced {
+			if gc.grace <= 0 {
+				garbage[hash] = size
 				continue
 			}
+			if err := b.Put([]byte(hash), seen); err != nil {
+				return err
+			}
+			rec.ChunksPending++
+		}
+		return nil
+	})
+	return garbage, err
+}
+
+// sweep deletes the given chunks unless a snapshot saved since the mark
+// phase references them, or an interrupted scan or seeding run checkpointed
+// them. It waits for the backups writing to the repository, whose chunks
+// are unreferenced until their snapshot is saved, and holds off new ones
+// meanwhile.
+func (gc *Collector) sweep(ctx context.Context, garbage map[string]int64, rec *RunRecord) error {
+	logger := monitoring.GetLogger()
+	if len(garbage) == 0 {
+		return nil
+	}
+	if n := gc.store.Writes(); n > 0 {
+		logger.Infof("Waiting for %d backups in progress before deleting chunks", n)
+	}
+	release, err := gc.store.BeginSweep(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
 
-			deletedCount++
-			bytesFreed += chunkSize
+	checkpointed, err := snapshots.CheckpointedChunks(gc.db)
+	if err != nil {
+		return err
+	}
+	for chunkHash, chunkSize := range garbage {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if checkpointed[chunkHash] {
+			rec.ChunksPending++
+			continue
+		}
+		deleted, err := gc.store.DeleteUnreferenced(chunkHash)
+		if err != nil {
+			logger.WithError(err).Warnf("Failed to delete chunk: %s", chunkHash)
+			rec.addError(fmt.Errorf("chunk %s: %w", chunkHash, err))
+			continue
+		}
+		if deleted {
+			rec.ChunksDeleted++
+			rec.BytesFreed += chunkSize
 		}
 	}
 
-	return deletedCount, bytesFreed, nil
+	return nil
 }
 
 // getAllSnapshots returns all snapshots from the database
@@ -0,0 +1,88 @@
+package gc_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/gc"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/storage"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+func TestGraceKeepsNewChunks(t *testing.T) {
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.EnableSealing(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.New(db, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stored by a backup whose snapshot is not saved yet
+	hash := "aa" + string(bytes.Repeat([]byte("0"), 62))
+	if err := store.Put(hash, []byte("chunk")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gc.NewCollector(db, store, 30, gc.Policy{}, 0, time.Hour).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !store.Exists(hash) {
+		t.Fatal("chunk deleted within the grace period")
+	}
+	runs, err := gc.History(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs[0].ChunksPending != 1 || runs[0].ChunksDeleted != 0 {
+		t.Fatalf("run %+v, want the chunk pending", runs[0])
+	}
+
+	if err := gc.NewCollector(db, store, 30, gc.Policy{}, 0, 0).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if store.Exists(hash) {
+		t.Fatal("chunk kept past the grace period")
+	}
+}
+
+func TestHeldSnapshotOutlivesRetention(t *testing.T) {
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.EnableSealing(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.New(db, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := versioning.NewTimestamp(time.Now().AddDate(0, 0, -90))
+	for _, id := range []string{"held", "expired"} {
+		if err := versioning.SaveSnapshot(db, &versioning.Snapshot{ID: id, Timestamp: old}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := versioning.PlaceHold(db, "held", "audit"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gc.NewCollector(db, store, 30, gc.Policy{}, 0, 0).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := versioning.LoadSnapshot(db, "held"); err != nil {
+		t.Errorf("held snapshot deleted: %v", err)
+	}
+	if _, err := versioning.LoadSnapshot(db, "expired"); err == nil {
+		t.Error("expired snapshot kept")
+	}
+}
@@ -0,0 +1,155 @@
+package gc
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/chunkindex"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrShortHistory is returned when the snapshots held span less than a day,
+// too little to measure growth on.
+var ErrShortHistory = errors.New("snapshots span less than a day, too little history to forecast")
+
+// Forecast projects repository usage from the growth its snapshots show.
+// Every snapshot held is a sample: the chunks it added over the snapshots
+// before it are new data. New data the newest snapshot of its source still
+// references is growth, which no retention frees; the rest is churn, which
+// is held only as long as retention keeps the snapshots referencing it.
+type Forecast struct {
+	Generated    time.Time    `json:"generated"`
+	Snapshots    int          `json:"snapshots"` // samples the rates are measured on
+	Since        time.Time    `json:"since"`     // time of the oldest snapshot
+	StoredBytes  int64        `json:"stored_bytes"`
+	LiveBytes    int64        `json:"live_bytes"`     // referenced by the newest snapshot of each source
+	GrowthPerDay float64      `json:"growth_per_day"` // bytes
+	ChurnPerDay  float64      `json:"churn_per_day"`  // bytes
+	Policies     []Projection `json:"policies"`       // the configured retention first
+}
+
+// Projection is the usage expected under one retention policy.
+type Projection struct {
+	RetentionDays int          `json:"retention_days"`
+	Expired       int          `json:"expired"` // snapshots the next collection would delete
+	Points        []UsagePoint `json:"points"`  // now, then monthly
+	Savings       int64        `json:"savings"` // bytes below the configured retention at the last point
+}
+
+// UsagePoint is the stored size expected at a date.
+type UsagePoint struct {
+	Date  time.Time `json:"date"`
+	Bytes int64     `json:"bytes"`
+}
+
+// Project forecasts the usage of the repository in db over the next months
+// under retentionDays, the configured retention, and under each of whatIf.
+func Project(db *persistence.DB, retentionDays int, whatIf []int, months int, now time.Time) (*Forecast, error) {
+	snaps, err := versioning.ListAllSnapshots(db)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64)
+	err = db.View(func(tx *bolt.Tx) error {
+		return chunkindex.ForEach(tx, func(hash string, e chunkindex.Entry) error {
+			if e.Stored() {
+				sizes[hash] = e.Size
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewForecast(snaps, sizes, retentionDays, whatIf, months, now)
+}
+
+// NewForecast forecasts usage from snaps, whose chunks are stored with the
+// sizes given, as Project does.
+func NewForecast(snaps []*versioning.Snapshot, sizes map[string]int64, retentionDays int, whatIf []int, months int, now time.Time) (*Forecast, error) {
+	var held []*versioning.Snapshot
+	for _, s := range snaps {
+		if !s.Timestamp.IsZero() {
+			held = append(held, s)
+		}
+	}
+	sort.SliceStable(held, func(i, j int) bool { return held[i].Timestamp.Before(held[j].Timestamp) })
+	if len(held) < 2 || held[len(held)-1].Timestamp.Time().Sub(held[0].Timestamp.Time()) < 24*time.Hour {
+		return nil, ErrShortHistory
+	}
+	first, last := held[0].Timestamp.Time(), held[len(held)-1].Timestamp.Time()
+
+	// The first snapshot of a source uploads what was there already; only
+	// what later snapshots add is growth or churn
+	latest := make(map[string]*versioning.Snapshot)
+	added := make(map[string]bool) // chunks added after the first snapshot of their source
+	seen := make(map[string]bool)
+	for _, s := range held {
+		key := s.RepoID + "\x00" + s.Source()
+		_, later := latest[key]
+		latest[key] = s
+		for _, hash := range s.Chunks {
+			if !seen[hash] {
+				seen[hash] = true
+				added[hash] = later
+			}
+		}
+	}
+	live := make(map[string]bool)
+	for _, s := range latest {
+		for _, hash := range s.Chunks {
+			live[hash] = true
+		}
+	}
+
+	f := &Forecast{Generated: now, Snapshots: len(held), Since: first}
+	var growth, churn int64
+	for hash := range seen {
+		size := sizes[hash]
+		f.StoredBytes += size
+		switch {
+		case live[hash]:
+			f.LiveBytes += size
+			if added[hash] {
+				growth += size
+			}
+		case added[hash]:
+			churn += size
+		}
+	}
+	days := last.Sub(first).Hours() / 24
+	f.GrowthPerDay = float64(growth) / days
+	f.ChurnPerDay = float64(churn) / days
+
+	// Data no longer live is held until the snapshots referencing it expire
+	age := now.Sub(first).Hours() / 24
+	for i, r := range append([]int{retentionDays}, whatIf...) {
+		p := Projection{RetentionDays: r}
+		cutoff := now.AddDate(0, 0, -r)
+		for _, s := range held {
+			if s.Timestamp.Time().Before(cutoff) {
+				p.Expired++
+			}
+		}
+		p.Points = append(p.Points, UsagePoint{Date: now, Bytes: f.StoredBytes})
+		for m := 1; m <= months; m++ {
+			at := now.AddDate(0, m, 0)
+			t := at.Sub(now).Hours() / 24
+			kept := age + t
+			if kept > float64(r) {
+				kept = float64(r)
+			}
+			bytes := float64(f.LiveBytes) + f.GrowthPerDay*t + f.ChurnPerDay*kept
+			p.Points = append(p.Points, UsagePoint{Date: at, Bytes: int64(bytes)})
+		}
+		if i > 0 {
+			base := f.Policies[0].Points
+			p.Savings = base[len(base)-1].Bytes - p.Points[len(p.Points)-1].Bytes
+		}
+		f.Policies = append(f.Policies, p)
+	}
+	return f, nil
+}
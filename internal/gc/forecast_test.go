@@ -0,0 +1,63 @@
+package gc_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/gc"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+func TestForecast(t *testing.T) {
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	snap := func(id string, age time.Duration, chunks ...string) *versioning.Snapshot {
+		return &versioning.Snapshot{
+			ID:        id,
+			Timestamp: versioning.NewTimestamp(now.Add(-age)),
+			Chunks:    chunks,
+			Meta:      map[string]string{"source": "/data"},
+		}
+	}
+	// "base" is uploaded first; "kept" is added and stays, "old" is added and
+	// replaced by "new" ten days later
+	snaps := []*versioning.Snapshot{
+		snap("s1", 20*day, "base"),
+		snap("s2", 15*day, "base", "kept", "old"),
+		snap("s3", 10*day, "base", "kept", "new"),
+	}
+	sizes := map[string]int64{"base": 1000, "kept": 100, "old": 50, "new": 50}
+
+	f, err := gc.NewForecast(snaps, sizes, 30, []int{5}, 2, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.StoredBytes != 1200 || f.LiveBytes != 1150 {
+		t.Errorf("stored %d, live %d bytes, want 1200 and 1150", f.StoredBytes, f.LiveBytes)
+	}
+	if f.GrowthPerDay != 15 || f.ChurnPerDay != 5 {
+		t.Errorf("growth %v, churn %v bytes per day, want 15 and 5", f.GrowthPerDay, f.ChurnPerDay)
+	}
+	if len(f.Policies) != 2 || f.Policies[0].RetentionDays != 30 || f.Policies[1].RetentionDays != 5 {
+		t.Fatalf("policies %+v", f.Policies)
+	}
+	cur, alt := f.Policies[0], f.Policies[1]
+	if len(cur.Points) != 3 || cur.Points[0].Bytes != 1200 {
+		t.Fatalf("points %+v, want now and two months", cur.Points)
+	}
+	if cur.Expired != 0 || alt.Expired != 3 {
+		t.Errorf("expired %d and %d snapshots, want 0 and 3", cur.Expired, alt.Expired)
+	}
+	// Churn is held 30 days against 5: 125 bytes less
+	if alt.Savings != 125 || cur.Savings != 0 {
+		t.Errorf("savings %d and %d, want 0 and 125", cur.Savings, alt.Savings)
+	}
+	if cur.Points[2].Bytes <= cur.Points[1].Bytes {
+		t.Errorf("usage does not grow: %+v", cur.Points)
+	}
+
+	if _, err := gc.NewForecast(snaps[:1], sizes, 30, nil, 2, now); !errors.Is(err, gc.ErrShortHistory) {
+		t.Errorf("forecast from one snapshot: %v, want ErrShortHistory", err)
+	}
+}
@@ -0,0 +1,87 @@
+package gc
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// historySize is how many runs are kept
+	historySize = 50
+	// maxRunErrors is how many per-item errors a run record keeps
+	maxRunErrors = 10
+)
+
+// RunRecord describes one garbage collection cycle.
+type RunRecord struct {
+	Started          time.Time `json:"started"`
+	Finished         time.Time `json:"finished"`
+	SnapshotsDeleted int       `json:"snapshots_deleted"`
+	ChunksDeleted    int       `json:"chunks_deleted"`
+	BytesFreed       int64     `json:"bytes_freed"`
+	ChunksPending    int       `json:"chunks_pending,omitempty"`   // unreferenced, but within the grace period or checkpointed
+	PacksRewritten   int       `json:"packs_rewritten,omitempty"`  // sparse packs whose live chunks were moved
+	PackBytesFreed   int64     `json:"pack_bytes_freed,omitempty"` // space of deleted chunks reclaimed from them
+	Interrupted      bool      `json:"interrupted,omitempty"`      // stopped early, e.g. by the maintenance window
+	Error            string    `json:"error,omitempty"`
+	Errors           []string  `json:"errors,omitempty"` // snapshots and chunks that could not be deleted
+	ErrorCount       int       `json:"error_count,omitempty"`
+}
+
+// addError notes a failed deletion, keeping the first few messages
+func (r *RunRecord) addError(err error) {
+	r.ErrorCount++
+	if len(r.Errors) < maxRunErrors {
+		r.Errors = append(r.Errors, err.Error())
+	}
+}
+
+// saveRun stores r and drops runs beyond historySize
+func saveRun(db *persistence.DB, r *RunRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(persistence.BucketGCRuns))
+		key := binary.BigEndian.AppendUint64(nil, uint64(r.Started.UnixNano()))
+		if err := b.Put(key, data); err != nil {
+			return err
+		}
+		var old [][]byte
+		c := b.Cursor()
+		n := 0
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			if n++; n > historySize {
+				old = append(old, append([]byte(nil), k...))
+			}
+		}
+		for _, k := range old {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// History returns up to n recorded runs, newest first.
+func History(db *persistence.DB, n int) ([]*RunRecord, error) {
+	var runs []*RunRecord
+	err := db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(persistence.BucketGCRuns)).Cursor()
+		for k, v := c.Last(); k != nil && len(runs) < n; k, v = c.Prev() {
+			var r RunRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			runs = append(runs, &r)
+		}
+		return nil
+	})
+	return runs, err
+}
@@ -0,0 +1,54 @@
+package gc_test
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/gc"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/storage"
+)
+
+func TestRunHistory(t *testing.T) {
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.EnableSealing(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.New(db, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := gc.NewCollector(db, store, 30, gc.Policy{}, 0, 0)
+
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.RunContext(ctx); err == nil {
+		t.Fatal("cancelled run succeeded")
+	}
+
+	runs, err := gc.History(db, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("%d runs recorded, want 2", len(runs))
+	}
+	if !runs[0].Interrupted || runs[0].Error == "" {
+		t.Fatalf("newest run %+v, want the interrupted one", runs[0])
+	}
+	if runs[1].Interrupted || runs[1].Error != "" || runs[1].Finished.Before(runs[1].Started) {
+		t.Fatalf("first run %+v", runs[1])
+	}
+	if runs, _ := gc.History(db, 1); len(runs) != 1 {
+		t.Fatalf("History(1) returned %d runs", len(runs))
+	}
+}
@@ -0,0 +1,172 @@
+package gc
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// Policy keeps snapshots by count and by calendar period, as restic's
+// forget does, on top of the flat retention in days. Snapshots are ruled on
+// per repository and source. A snapshot is kept when any rule keeps it.
+type Policy struct {
+	Rules    `yaml:",inline"`
+	KeepTags []string   `yaml:"keep_tags" json:"keep_tags,omitempty"` // snapshots with any of these tags are always kept
+	Tags     []TagRules `yaml:"tags" json:"tags,omitempty"`           // rules for tagged snapshots instead of the ones above; the first matching tag applies
+}
+
+// Rules keep the newest snapshots and the newest snapshot of each of the
+// latest days, weeks, months and years that have one. With no rules set,
+// the retention in days applies instead.
+type Rules struct {
+	KeepLast    int `yaml:"keep_last" json:"keep_last,omitempty"`
+	KeepDaily   int `yaml:"keep_daily" json:"keep_daily,omitempty"`
+	KeepWeekly  int `yaml:"keep_weekly" json:"keep_weekly,omitempty"` // ISO weeks
+	KeepMonthly int `yaml:"keep_monthly" json:"keep_monthly,omitempty"`
+	KeepYearly  int `yaml:"keep_yearly" json:"keep_yearly,omitempty"`
+}
+
+// TagRules are the rules for snapshots tagged Tag.
+type TagRules struct {
+	Tag   string `yaml:"tag" json:"tag"`
+	Rules `yaml:",inline"`
+}
+
+// Empty reports whether no rule is set.
+func (r Rules) Empty() bool {
+	return r == Rules{}
+}
+
+// Validate checks that counts are not negative and each tag has rules once.
+func (p Policy) Validate() error {
+	check := func(what string, r Rules) error {
+		if r.KeepLast < 0 || r.KeepDaily < 0 || r.KeepWeekly < 0 || r.KeepMonthly < 0 || r.KeepYearly < 0 {
+			return fmt.Errorf("%s: keep counts must be >= 0, got %+v", what, r)
+		}
+		return nil
+	}
+	if err := check("retention", p.Rules); err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(p.Tags))
+	for i, t := range p.Tags {
+		if t.Tag == "" {
+			return fmt.Errorf("retention.tags[%d] needs a tag", i)
+		}
+		if seen[t.Tag] {
+			return fmt.Errorf("retention.tags[%d] repeats tag %s", i, t.Tag)
+		}
+		seen[t.Tag] = true
+		if t.Empty() {
+			return fmt.Errorf("retention.tags[%d] (%s) sets no keep rule", i, t.Tag)
+		}
+		if err := check(fmt.Sprintf("retention.tags[%d]", i), t.Rules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decision is whether a snapshot survives the retention policy, and why.
+type Decision struct {
+	SnapshotID string    `json:"snapshot_id"`
+	Time       time.Time `json:"time"`
+	Source     string    `json:"source,omitempty"`
+	RepoID     string    `json:"repo_id,omitempty"`
+	Tags       []string  `json:"tags,omitempty"`
+	Keep       bool      `json:"keep"`
+	Reasons    []string  `json:"reasons,omitempty"` // the rules keeping it, e.g. daily or tag:db
+}
+
+// Plan decides which of snaps to keep under policy and retentionDays at
+// now. Periods are calendar days, weeks, months and years in now's time
+// zone. Decisions are in the order of snaps.
+func Plan(snaps []*versioning.Snapshot, retentionDays int, policy Policy, now time.Time) []Decision {
+	cutoff := now.AddDate(0, 0, -retentionDays)
+	decisions := make([]Decision, len(snaps))
+	groups := make(map[string][]*Decision)
+	rules := make(map[string]Rules)
+	for i, s := range snaps {
+		d := &decisions[i]
+		d.SnapshotID, d.Source, d.RepoID, d.Tags = s.ID, s.Source(), s.RepoID, s.Tags()
+		if s.Timestamp.IsZero() {
+			d.keep("no timestamp")
+			continue
+		}
+		d.Time = s.Timestamp.Time()
+		for _, t := range d.Tags {
+			for _, k := range policy.KeepTags {
+				if t == k {
+					d.keep("tag:" + t)
+				}
+			}
+		}
+		r, name := policy.rulesFor(d.Tags)
+		if r.Empty() {
+			if !d.Time.Before(cutoff) {
+				d.keep(fmt.Sprintf("within %d days", retentionDays))
+			}
+			continue
+		}
+		key := name + "\x00" + s.RepoID + "\x00" + d.Source
+		groups[key] = append(groups[key], d)
+		rules[key] = r
+	}
+	for key, group := range groups {
+		rules[key].apply(group, now.Location())
+	}
+	return decisions
+}
+
+// rulesFor returns the rules for a snapshot with tags, and the tag whose
+// rules they are
+func (p Policy) rulesFor(tags []string) (Rules, string) {
+	for _, t := range p.Tags {
+		for _, tag := range tags {
+			if tag == t.Tag {
+				return t.Rules, t.Tag
+			}
+		}
+	}
+	return p.Rules, ""
+}
+
+// apply keeps the snapshots of group, which share a source, that r keeps
+func (r Rules) apply(group []*Decision, loc *time.Location) {
+	sort.SliceStable(group, func(i, j int) bool { return group[i].Time.After(group[j].Time) })
+	periods := []struct {
+		name   string
+		n      int
+		period func(t time.Time) string // "" for every snapshot its own
+	}{
+		{"last", r.KeepLast, func(t time.Time) string { return "" }},
+		{"daily", r.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", r.KeepWeekly, func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", y, w)
+		}},
+		{"monthly", r.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", r.KeepYearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+	for _, p := range periods {
+		left, last := p.n, ""
+		for _, d := range group {
+			if left == 0 {
+				break
+			}
+			// The newest snapshot of each period counts
+			if period := p.period(d.Time.In(loc)); period == "" || period != last {
+				d.keep(p.name)
+				last = period
+				left--
+			}
+		}
+	}
+}
+
+func (d *Decision) keep(reason string) {
+	d.Keep = true
+	d.Reasons = append(d.Reasons, reason)
+}
@@ -0,0 +1,117 @@
+package gc_test
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/gc"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+func TestPlan(t *testing.T) {
+	// Thursday
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	var snaps []*versioning.Snapshot
+	add := func(id string, age time.Duration, source string, tags ...string) {
+		s := &versioning.Snapshot{
+			ID:        id,
+			Timestamp: versioning.NewTimestamp(now.Add(-age)),
+			Meta:      map[string]string{"source": source},
+		}
+		s.SetTags(tags)
+		snaps = append(snaps, s)
+	}
+	// Two snapshots a day of /home for the last 60 days
+	for d := 0; d < 60; d++ {
+		add(id("home", d, 0), time.Duration(d)*day, "/home")
+		add(id("home", d, 1), time.Duration(d)*day+6*time.Hour, "/home")
+	}
+	// /db daily for 10 days, tagged
+	for d := 0; d < 10; d++ {
+		add(id("db", d, 0), time.Duration(d)*day, "/db", "db")
+	}
+	add("pinned", 400*day, "/home", "keep")
+	add("old-etc", 40*day, "/etc")
+	add("new-etc", 2*day, "/etc")
+	snaps = append(snaps, &versioning.Snapshot{ID: "undated", Meta: map[string]string{"source": "/home"}})
+
+	policy := gc.Policy{
+		Rules:    gc.Rules{KeepLast: 3, KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 2},
+		KeepTags: []string{"keep"},
+		Tags:     []gc.TagRules{{Tag: "db", Rules: gc.Rules{KeepLast: 2}}},
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	decisions := gc.Plan(snaps, 30, policy, now)
+
+	var kept []string
+	reasons := make(map[string][]string)
+	for _, d := range decisions {
+		if d.Keep {
+			kept = append(kept, d.SnapshotID)
+			reasons[d.SnapshotID] = d.Reasons
+		}
+	}
+	sort.Strings(kept)
+	want := []string{
+		// /db: the last two
+		"db-00-0", "db-01-0",
+		// /home: the last three (two today, one yesterday), the newest of each
+		// of the last 7 days, of the last 4 ISO weeks (each ending on a
+		// Sunday) and of October and September
+		"home-00-0", "home-00-1", "home-01-0", "home-02-0", "home-03-0", "home-04-0", "home-05-0", "home-06-0",
+		"home-11-0", "home-18-0",
+		// /etc: the last three
+		"new-etc", "old-etc",
+		"pinned", "undated",
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(kept, want) {
+		t.Errorf("kept\n%v\nwant\n%v", kept, want)
+	}
+	if r := reasons["home-00-0"]; !reflect.DeepEqual(r, []string{"last", "daily", "weekly", "monthly"}) {
+		t.Errorf("reasons for the newest snapshot %v", r)
+	}
+	if r := reasons["home-01-0"]; !reflect.DeepEqual(r, []string{"last", "daily", "monthly"}) {
+		t.Errorf("reasons for the last snapshot of September %v", r)
+	}
+	if r := reasons["pinned"]; !reflect.DeepEqual(r, []string{"tag:keep"}) {
+		t.Errorf("reasons for the pinned snapshot %v", r)
+	}
+
+	// Without rules of their own, snapshots follow the retention in days
+	policy.Rules = gc.Rules{}
+	for _, d := range gc.Plan(snaps, 30, policy, now) {
+		switch d.SnapshotID {
+		case "new-etc", "home-30-0":
+			if !reflect.DeepEqual(d.Reasons, []string{"within 30 days"}) {
+				t.Errorf("%s kept for %v, want within 30 days", d.SnapshotID, d.Reasons)
+			}
+		case "old-etc", "home-31-0", "db-02-0":
+			if d.Keep {
+				t.Errorf("%s kept for %v", d.SnapshotID, d.Reasons)
+			}
+		}
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	for _, p := range []gc.Policy{
+		{Rules: gc.Rules{KeepDaily: -1}},
+		{Tags: []gc.TagRules{{Tag: "db"}}},
+		{Tags: []gc.TagRules{{Tag: "db", Rules: gc.Rules{KeepLast: 1}}, {Tag: "db", Rules: gc.Rules{KeepLast: 2}}}},
+	} {
+		if err := p.Validate(); err == nil {
+			t.Errorf("%+v is valid", p)
+		}
+	}
+}
+
+func id(source string, day, n int) string {
+	return fmt.Sprintf("%s-%02d-%d", source, day, n)
+}
@@ -12,12 +12,17 @@ import (
 
 const keyFileName = "identity.key"
 
+// KeyPath returns where the identity key of the repository at repoPath is kept.
+func KeyPath(repoPath string) string {
+	return filepath.Join(repoPath, keyFileName)
+}
+
 // LoadOrCreate loads a libp2p identity key from repoPath or creates & persists a new one.
 func LoadOrCreate(repoPath string) (libp2pcrypto.PrivKey, string, error) {
 	if err := os.MkdirAll(repoPath, 0700); err != nil {
 		return nil, "", err
 	}
-	keyPath := filepath.Join(repoPath, keyFileName)
+	keyPath := KeyPath(repoPath)
 	if _, err := os.Stat(keyPath); err == nil {
 		b, err := os.ReadFile(keyPath)
 		if err != nil {
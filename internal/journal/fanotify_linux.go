@@ -0,0 +1,277 @@
+package journal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// fanotifyMask covers every change that alters a snapshot
+	fanotifyMask = unix.FAN_MODIFY | unix.FAN_ATTRIB | unix.FAN_CREATE | unix.FAN_DELETE |
+		unix.FAN_MOVE | unix.FAN_DELETE_SELF | unix.FAN_MOVE_SELF | unix.FAN_ONDIR
+	// fanotifyMaxTracked bounds memory; past it every outstanding cursor expires
+	fanotifyMaxTracked = 1 << 20
+)
+
+// fanotify has no persistent history, so this journal records changes while
+// the process runs. Cursors carry the process epoch and expire on restart.
+type fanotifyJournal struct {
+	f     *os.File
+	epoch string
+
+	mu       sync.Mutex
+	seq      uint64
+	expired  uint64            // cursors below this seq are no longer covered
+	changes  map[string]uint64 // path -> seq of its latest change
+	watched  map[string]uint64 // root -> seq when watching started
+	roots    map[string]string // root with symlinks resolved -> root as watched
+	mountFDs map[[8]byte]int   // fsid -> fd for open_by_handle_at
+	resolved map[string]string // fsid + directory handle -> path
+}
+
+func open() (Journal, error) {
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK|unix.FAN_REPORT_DFID_NAME, unix.O_RDONLY|unix.O_LARGEFILE)
+	if err != nil {
+		// EPERM without CAP_SYS_ADMIN, EINVAL before Linux 5.9
+		return nil, fmt.Errorf("%w: fanotify: %v", ErrUnavailable, err)
+	}
+	j := &fanotifyJournal{
+		f:        os.NewFile(uintptr(fd), "fanotify"),
+		epoch:    strconv.FormatInt(time.Now().UnixNano(), 36),
+		changes:  make(map[string]uint64),
+		watched:  make(map[string]uint64),
+		roots:    make(map[string]string),
+		mountFDs: make(map[[8]byte]int),
+		resolved: make(map[string]string),
+	}
+	go j.run()
+	return j, nil
+}
+
+func (j *fanotifyJournal) Name() string { return "fanotify" }
+
+// Watch marks the whole filesystem holding root; events elsewhere on it are
+// discarded.
+func (j *fanotifyJournal) Watch(root string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.watched[root]; ok {
+		return nil
+	}
+
+	target, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(target, &st); err != nil {
+		return err
+	}
+	fsid := fsidKey(st.Fsid)
+	if _, marked := j.mountFDs[fsid]; !marked {
+		if err := unix.FanotifyMark(int(j.f.Fd()), unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, fanotifyMask, unix.AT_FDCWD, target); err != nil {
+			return fmt.Errorf("%w: fanotify mark %s: %v", ErrUnavailable, root, err)
+		}
+		mfd, err := unix.Open(target, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		j.mountFDs[fsid] = mfd
+	}
+	j.watched[root] = j.seq
+	j.roots[target] = root
+	return nil
+}
+
+func (j *fanotifyJournal) Cursor(root string) (string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.watched[root]; !ok {
+		return "", fmt.Errorf("%s is not watched", root)
+	}
+	return j.cursorLocked(), nil
+}
+
+func (j *fanotifyJournal) Changes(root, since string) ([]string, string, error) {
+	epoch, seqStr, ok := strings.Cut(since, ":")
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if !ok || err != nil {
+		return nil, "", fmt.Errorf("%w: malformed cursor %q", ErrCursorExpired, since)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	start, watching := j.watched[root]
+	if epoch != j.epoch || !watching || seq < start || seq < j.expired {
+		return nil, "", ErrCursorExpired
+	}
+	var paths []string
+	for p, s := range j.changes {
+		if s > seq && within(root, p) {
+			paths = append(paths, p)
+		}
+	}
+	return paths, j.cursorLocked(), nil
+}
+
+func (j *fanotifyJournal) Close() error {
+	j.mu.Lock()
+	for _, fd := range j.mountFDs {
+		unix.Close(fd)
+	}
+	j.mu.Unlock()
+	return j.f.Close()
+}
+
+func (j *fanotifyJournal) cursorLocked() string {
+	return j.epoch + ":" + strconv.FormatUint(j.seq, 10)
+}
+
+// run reads events until the journal is closed
+func (j *fanotifyJournal) run() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := j.f.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				monitoring.GetLogger().WithError(err).Warn("fanotify journal stopped")
+				j.mu.Lock()
+				j.expired = j.seq + 1
+				j.mu.Unlock()
+			}
+			return
+		}
+		j.parse(buf[:n])
+	}
+}
+
+func (j *fanotifyJournal) parse(buf []byte) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for len(buf) >= unix.FAN_EVENT_METADATA_LEN {
+		meta := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[0]))
+		if meta.Vers != unix.FANOTIFY_METADATA_VERSION || int(meta.Event_len) > len(buf) || meta.Event_len < unix.FAN_EVENT_METADATA_LEN {
+			j.overflowLocked()
+			return
+		}
+		event := buf[:meta.Event_len]
+		buf = buf[meta.Event_len:]
+		if meta.Fd >= 0 {
+			unix.Close(int(meta.Fd))
+		}
+		if meta.Mask&unix.FAN_Q_OVERFLOW != 0 {
+			j.overflowLocked()
+			continue
+		}
+
+		// Info records follow the fixed metadata
+		info := event[meta.Metadata_len:]
+		for len(info) >= 4 {
+			infoType, infoLen := info[0], int(binary.LittleEndian.Uint16(info[2:4]))
+			if infoLen < 4 || infoLen > len(info) {
+				break
+			}
+			if infoType == unix.FAN_EVENT_INFO_TYPE_DFID_NAME {
+				if p, ok := j.resolveLocked(info[4:infoLen]); ok {
+					j.recordLocked(p)
+				}
+			}
+			info = info[infoLen:]
+		}
+
+		// A moved or deleted directory invalidates cached handle paths
+		if meta.Mask&unix.FAN_ONDIR != 0 && meta.Mask&(unix.FAN_MOVE|unix.FAN_MOVE_SELF|unix.FAN_DELETE_SELF) != 0 {
+			j.resolved = make(map[string]string)
+		}
+	}
+}
+
+// resolveLocked turns an fsid + directory handle + name record into a path
+func (j *fanotifyJournal) resolveLocked(rec []byte) (string, bool) {
+	// __kernel_fsid_t, then struct file_handle, then a NUL-terminated name
+	if len(rec) < 16 {
+		return "", false
+	}
+	var fsid [8]byte
+	copy(fsid[:], rec[:8])
+	size := int(binary.LittleEndian.Uint32(rec[8:12]))
+	htype := int32(binary.LittleEndian.Uint32(rec[12:16]))
+	if len(rec) < 16+size {
+		return "", false
+	}
+	handle := rec[16 : 16+size]
+	name := rec[16+size:]
+	if i := strings.IndexByte(string(name), 0); i >= 0 {
+		name = name[:i]
+	}
+
+	key := string(fsid[:]) + string(handle)
+	dir, ok := j.resolved[key]
+	if !ok {
+		mfd, known := j.mountFDs[fsid]
+		if !known {
+			return "", false
+		}
+		fd, err := unix.OpenByHandleAt(mfd, unix.NewFileHandle(htype, handle), unix.O_PATH)
+		if err != nil {
+			// ESTALE: the directory is gone and its parent reports the delete
+			return "", false
+		}
+		dir, err = os.Readlink("/proc/self/fd/" + strconv.Itoa(fd))
+		unix.Close(fd)
+		if err != nil {
+			return "", false
+		}
+		if len(j.resolved) > 4096 {
+			j.resolved = make(map[string]string)
+		}
+		j.resolved[key] = dir
+	}
+
+	p := dir
+	if len(name) > 0 && string(name) != "." {
+		p = filepath.Join(dir, string(name))
+	}
+	// Report paths under the root as it was watched, not its symlink target
+	for target, root := range j.roots {
+		if within(target, p) {
+			return filepath.Join(root, strings.TrimPrefix(p, target)), true
+		}
+	}
+	return "", false
+}
+
+func (j *fanotifyJournal) recordLocked(p string) {
+	j.seq++
+	j.changes[p] = j.seq
+	if len(j.changes) > fanotifyMaxTracked {
+		j.overflowLocked()
+	}
+}
+
+// overflowLocked forgets tracked changes; every outstanding cursor expires
+func (j *fanotifyJournal) overflowLocked() {
+	j.seq++
+	j.expired = j.seq
+	j.changes = make(map[string]uint64)
+	j.resolved = make(map[string]string)
+}
+
+func fsidKey(f unix.Fsid) [8]byte {
+	var k [8]byte
+	binary.LittleEndian.PutUint32(k[0:4], uint32(f.Val[0]))
+	binary.LittleEndian.PutUint32(k[4:8], uint32(f.Val[1]))
+	return k
+}
@@ -0,0 +1,225 @@
+//go:build darwin && cgo
+
+package journal
+
+/*
+#cgo LDFLAGS: -framework CoreServices -framework CoreFoundation
+#include <CoreServices/CoreServices.h>
+#include <dispatch/dispatch.h>
+#include <stdlib.h>
+#include <sys/stat.h>
+
+extern void fseventsCallback(uintptr_t info, size_t n, char **paths, FSEventStreamEventFlags *flags);
+
+static void fsevents_trampoline(ConstFSEventStreamRef stream, void *info, size_t n, void *paths,
+		const FSEventStreamEventFlags flags[], const FSEventStreamEventId ids[]) {
+	fseventsCallback((uintptr_t)info, n, (char **)paths, (FSEventStreamEventFlags *)flags);
+}
+
+static FSEventStreamRef fsevents_create(uintptr_t handle, const char *root, FSEventStreamEventId since) {
+	FSEventStreamContext ctx = {0, (void *)handle, NULL, NULL, NULL};
+	CFStringRef path = CFStringCreateWithCString(NULL, root, kCFStringEncodingUTF8);
+	CFArrayRef paths = CFArrayCreate(NULL, (const void **)&path, 1, &kCFTypeArrayCallBacks);
+	FSEventStreamRef stream = FSEventStreamCreate(NULL, fsevents_trampoline, &ctx, paths, since, 0,
+		kFSEventStreamCreateFlagFileEvents | kFSEventStreamCreateFlagNoDefer);
+	CFRelease(paths);
+	CFRelease(path);
+	return stream;
+}
+
+static dispatch_queue_t fsevents_start(FSEventStreamRef stream) {
+	dispatch_queue_t q = dispatch_queue_create("shadowvault.fsevents", DISPATCH_QUEUE_SERIAL);
+	FSEventStreamSetDispatchQueue(stream, q);
+	if (!FSEventStreamStart(stream)) {
+		FSEventStreamInvalidate(stream);
+		FSEventStreamRelease(stream);
+		dispatch_release(q);
+		return NULL;
+	}
+	return q;
+}
+
+static void fsevents_noop(void *ctx) {}
+
+static void fsevents_stop(FSEventStreamRef stream, dispatch_queue_t q) {
+	FSEventStreamStop(stream);
+	FSEventStreamInvalidate(stream);
+	// Drain callbacks still queued before the Go handle goes away
+	dispatch_sync_f(q, NULL, fsevents_noop);
+	FSEventStreamRelease(stream);
+	dispatch_release(q);
+}
+
+// fsevents_device_uuid writes the event store UUID of the device holding path
+static int fsevents_device_uuid(const char *path, char *buf, size_t len) {
+	struct stat st;
+	if (stat(path, &st) != 0) {
+		return -1;
+	}
+	CFUUIDRef uuid = FSEventsCopyUUIDForDevice(st.st_dev);
+	if (uuid == NULL) {
+		return -1;
+	}
+	CFStringRef s = CFUUIDCreateString(NULL, uuid);
+	Boolean ok = CFStringGetCString(s, buf, len, kCFStringEncodingUTF8);
+	CFRelease(s);
+	CFRelease(uuid);
+	return ok ? 0 : -1;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime/cgo"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// FSEventStreamEventFlags values from FSEvents.h
+const (
+	fseventsMustScanSubDirs = 0x01
+	fseventsUserDropped     = 0x02
+	fseventsKernelDropped   = 0x04
+	fseventsIdsWrapped      = 0x08
+	fseventsHistoryDone     = 0x10
+	fseventsRootChanged     = 0x20
+
+	// fseventsLost means history was lost and the tree must be walked again
+	fseventsLost = fseventsMustScanSubDirs | fseventsUserDropped | fseventsKernelDropped |
+		fseventsIdsWrapped | fseventsRootChanged
+)
+
+// fseventsHistoryTimeout bounds replaying a long history
+const fseventsHistoryTimeout = 10 * time.Minute
+
+// fseventsJournal replays the persistent per-volume FSEvents store, so
+// cursors survive restarts as long as the store is not purged.
+type fseventsJournal struct{}
+
+// fseventsReplay collects the paths replayed by one stream
+type fseventsReplay struct {
+	mu      sync.Mutex
+	target  string // root with symlinks resolved, as FSEvents reports it
+	root    string
+	seen    map[string]bool
+	paths   []string
+	lost    bool
+	done    chan struct{}
+	stopped bool
+}
+
+func open() (Journal, error) {
+	return fseventsJournal{}, nil
+}
+
+func (fseventsJournal) Name() string { return "fsevents" }
+
+func (fseventsJournal) Watch(root string) error { return nil }
+
+func (fseventsJournal) Cursor(root string) (string, error) {
+	uuid, err := deviceUUID(root)
+	if err != nil {
+		return "", err
+	}
+	return uuid + ":" + strconv.FormatUint(uint64(C.FSEventsGetCurrentEventId()), 10), nil
+}
+
+func (fseventsJournal) Changes(root, since string) ([]string, string, error) {
+	uuid, idStr, ok := strings.Cut(since, ":")
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if !ok || err != nil {
+		return nil, "", fmt.Errorf("%w: malformed cursor %q", ErrCursorExpired, since)
+	}
+	current, err := deviceUUID(root)
+	if err != nil {
+		return nil, "", err
+	}
+	// A new UUID means the volume's event store was reset
+	if current != uuid {
+		return nil, "", ErrCursorExpired
+	}
+	target, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, "", err
+	}
+
+	next := current + ":" + strconv.FormatUint(uint64(C.FSEventsGetCurrentEventId()), 10)
+	replay := &fseventsReplay{target: target, root: root, seen: make(map[string]bool), done: make(chan struct{})}
+	handle := cgo.NewHandle(replay)
+	defer handle.Delete()
+
+	croot := C.CString(target)
+	defer C.free(unsafe.Pointer(croot))
+	stream := C.fsevents_create(C.uintptr_t(handle), croot, C.FSEventStreamEventId(id))
+	if stream == nil {
+		return nil, "", fmt.Errorf("%w: cannot create FSEvents stream", ErrUnavailable)
+	}
+	queue := C.fsevents_start(stream)
+	if queue == nil {
+		return nil, "", fmt.Errorf("%w: cannot start FSEvents stream", ErrUnavailable)
+	}
+
+	select {
+	case <-replay.done:
+	case <-time.After(fseventsHistoryTimeout):
+	}
+	C.fsevents_stop(stream, queue)
+
+	replay.mu.Lock()
+	defer replay.mu.Unlock()
+	replay.stopped = true
+	if replay.lost {
+		return nil, "", ErrCursorExpired
+	}
+	select {
+	case <-replay.done:
+	default:
+		return nil, "", fmt.Errorf("FSEvents history replay timed out")
+	}
+	return replay.paths, next, nil
+}
+
+func (fseventsJournal) Close() error { return nil }
+
+// add is called on the stream's dispatch queue
+func (r *fseventsReplay) add(path string, flags uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return
+	}
+	switch {
+	case flags&fseventsHistoryDone != 0:
+		select {
+		case <-r.done:
+		default:
+			close(r.done)
+		}
+	case flags&fseventsLost != 0:
+		r.lost = true
+	default:
+		path = strings.TrimSuffix(path, "/")
+		if within(r.target, path) {
+			p := filepath.Join(r.root, strings.TrimPrefix(path, r.target))
+			if !r.seen[p] {
+				r.seen[p] = true
+				r.paths = append(r.paths, p)
+			}
+		}
+	}
+}
+
+func deviceUUID(root string) (string, error) {
+	cpath := C.CString(root)
+	defer C.free(unsafe.Pointer(cpath))
+	var buf [64]C.char
+	if C.fsevents_device_uuid(cpath, &buf[0], C.size_t(len(buf))) != 0 {
+		return "", fmt.Errorf("%w: no FSEvents store for %s", ErrUnavailable, root)
+	}
+	return C.GoString(&buf[0]), nil
+}
@@ -0,0 +1,26 @@
+//go:build darwin && cgo
+
+package journal
+
+/*
+#include <CoreServices/CoreServices.h>
+*/
+import "C"
+
+import (
+	"runtime/cgo"
+	"unsafe"
+)
+
+// fseventsCallback receives FSEvents batches. It lives apart from the C
+// helpers because a file with //export may only declare C functions.
+//
+//export fseventsCallback
+func fseventsCallback(info C.uintptr_t, n C.size_t, paths **C.char, flags *C.FSEventStreamEventFlags) {
+	replay := cgo.Handle(info).Value().(*fseventsReplay)
+	ps := unsafe.Slice(paths, int(n))
+	fs := unsafe.Slice(flags, int(n))
+	for i := range ps {
+		replay.add(C.GoString(ps[i]), uint32(fs[i]))
+	}
+}
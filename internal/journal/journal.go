@@ -0,0 +1,54 @@
+// Package journal lists the paths that changed under a directory since a
+// previous point in time using the operating system's change journal: the
+// NTFS USN journal on Windows, FSEvents on macOS and fanotify on Linux. It
+// lets incremental snapshots skip listing and stat-ing unchanged parts of
+// very large trees.
+package journal
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrUnavailable means no change journal can be used on this system, for
+	// example for lack of privileges; callers fall back to a full walk.
+	ErrUnavailable = errors.New("change journal unavailable")
+	// ErrCursorExpired means the journal no longer covers the requested
+	// position, because it wrapped, dropped events or was restarted.
+	ErrCursorExpired = errors.New("change journal cursor expired")
+)
+
+// Journal reports changed paths under watched roots.
+type Journal interface {
+	// Name identifies the mechanism. Cursors are only meaningful to the
+	// journal that issued them.
+	Name() string
+	// Watch makes sure changes under root are recorded from now on.
+	// Persistent journals need no setup.
+	Watch(root string) error
+	// Cursor returns the current position of the journal for root.
+	Cursor(root string) (string, error)
+	// Changes returns the paths under root created, modified, deleted or
+	// renamed after since, and the cursor to pass next time.
+	Changes(root, since string) ([]string, string, error)
+	Close() error
+}
+
+// Open returns the change journal of this platform, or ErrUnavailable.
+func Open() (Journal, error) {
+	return open()
+}
+
+// within reports whether path is root or lies below it
+func within(root, path string) bool {
+	if path == root {
+		return true
+	}
+	prefix := root
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	return strings.HasPrefix(path, prefix)
+}
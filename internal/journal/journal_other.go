@@ -0,0 +1,7 @@
+//go:build !linux && !windows && !(darwin && cgo)
+
+package journal
+
+func open() (Journal, error) {
+	return nil, ErrUnavailable
+}
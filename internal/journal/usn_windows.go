@@ -0,0 +1,277 @@
+package journal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	fsctlQueryUsnJournal = 0x000900f4
+	fsctlReadUsnJournal  = 0x000900bb
+)
+
+var procOpenFileById = windows.NewLazySystemDLL("kernel32.dll").NewProc("OpenFileById")
+
+// usnJournalData is USN_JOURNAL_DATA_V0
+type usnJournalData struct {
+	UsnJournalID    uint64
+	FirstUsn        int64
+	NextUsn         int64
+	LowestValidUsn  int64
+	MaxUsn          int64
+	MaximumSize     uint64
+	AllocationDelta uint64
+}
+
+// readUsnJournalData is READ_USN_JOURNAL_DATA_V0
+type readUsnJournalData struct {
+	StartUsn          int64
+	ReasonMask        uint32
+	ReturnOnlyOnClose uint32
+	Timeout           uint64
+	BytesToWaitFor    uint64
+	UsnJournalID      uint64
+}
+
+// usnRecordV2 is the fixed part of USN_RECORD_V2; the UTF-16 name follows
+type usnRecordV2 struct {
+	RecordLength              uint32
+	MajorVersion              uint16
+	MinorVersion              uint16
+	FileReferenceNumber       uint64
+	ParentFileReferenceNumber uint64
+	Usn                       int64
+	TimeStamp                 int64
+	Reason                    uint32
+	SourceInfo                uint32
+	SecurityId                uint32
+	FileAttributes            uint32
+	FileNameLength            uint16
+	FileNameOffset            uint16
+}
+
+// fileIDDescriptor is FILE_ID_DESCRIPTOR with Type FileIdType
+type fileIDDescriptor struct {
+	Size   uint32
+	Type   uint32
+	FileID [16]byte
+}
+
+// usnJournal reads the NTFS change journal, which persists across reboots.
+// Reading it requires administrator rights.
+type usnJournal struct {
+	mu      sync.Mutex
+	volumes map[string]*usnVolume // volume name such as "C:"
+}
+
+type usnVolume struct {
+	handle windows.Handle // \\.\C:
+	root   windows.Handle // C:\, the hint for OpenFileById
+}
+
+func open() (Journal, error) {
+	return &usnJournal{volumes: make(map[string]*usnVolume)}, nil
+}
+
+func (j *usnJournal) Name() string { return "usn" }
+
+func (j *usnJournal) Watch(root string) error {
+	_, err := j.volume(root)
+	return err
+}
+
+func (j *usnJournal) Cursor(root string) (string, error) {
+	vol, err := j.volume(root)
+	if err != nil {
+		return "", err
+	}
+	data, err := vol.query()
+	if err != nil {
+		return "", err
+	}
+	return formatUsnCursor(data.UsnJournalID, data.NextUsn), nil
+}
+
+func (j *usnJournal) Changes(root, since string) ([]string, string, error) {
+	id, usn, err := parseUsnCursor(since)
+	if err != nil {
+		return nil, "", err
+	}
+	vol, err := j.volume(root)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := vol.query()
+	if err != nil {
+		return nil, "", err
+	}
+	// The journal was recreated or has been trimmed past our position
+	if data.UsnJournalID != id || usn < data.FirstUsn {
+		return nil, "", ErrCursorExpired
+	}
+
+	parents := make(map[uint64]string)
+	seen := make(map[string]bool)
+	var paths []string
+
+	rd := readUsnJournalData{StartUsn: usn, ReasonMask: 0xffffffff, UsnJournalID: id}
+	buf := make([]byte, 64<<10)
+	for rd.StartUsn < data.NextUsn {
+		var n uint32
+		err := windows.DeviceIoControl(vol.handle, fsctlReadUsnJournal,
+			(*byte)(unsafe.Pointer(&rd)), uint32(unsafe.Sizeof(rd)),
+			&buf[0], uint32(len(buf)), &n, nil)
+		if errors.Is(err, windows.ERROR_JOURNAL_ENTRY_DELETED) {
+			return nil, "", ErrCursorExpired
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("read USN journal: %w", err)
+		}
+		if n <= 8 {
+			break
+		}
+		next := int64(binary.LittleEndian.Uint64(buf[:8]))
+
+		for off := uint32(8); off+uint32(unsafe.Sizeof(usnRecordV2{})) <= n; {
+			rec := (*usnRecordV2)(unsafe.Pointer(&buf[off]))
+			if rec.RecordLength == 0 || off+rec.RecordLength > n {
+				break
+			}
+			if rec.MajorVersion == 2 && rec.Usn < data.NextUsn {
+				nameStart := off + uint32(rec.FileNameOffset)
+				name := windows.UTF16ToString(unsafe.Slice((*uint16)(unsafe.Pointer(&buf[nameStart])), rec.FileNameLength/2))
+				parent, ok := parents[rec.ParentFileReferenceNumber]
+				if !ok {
+					// A deleted parent shows up as a change of its own parent
+					parent, _ = vol.pathOf(rec.ParentFileReferenceNumber)
+					parents[rec.ParentFileReferenceNumber] = parent
+				}
+				if parent != "" {
+					if p, ok := underRoot(root, filepath.Join(parent, name)); ok && !seen[p] {
+						seen[p] = true
+						paths = append(paths, p)
+					}
+				}
+			}
+			off += rec.RecordLength
+		}
+		if next <= rd.StartUsn {
+			break
+		}
+		rd.StartUsn = next
+	}
+	return paths, formatUsnCursor(id, data.NextUsn), nil
+}
+
+func (j *usnJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, vol := range j.volumes {
+		windows.CloseHandle(vol.handle)
+		windows.CloseHandle(vol.root)
+	}
+	j.volumes = make(map[string]*usnVolume)
+	return nil
+}
+
+// volume opens, once, the volume holding root
+func (j *usnJournal) volume(root string) (*usnVolume, error) {
+	name := strings.ToUpper(filepath.VolumeName(root))
+	if len(name) != 2 || name[1] != ':' {
+		return nil, fmt.Errorf("%w: %s is not on a local drive", ErrUnavailable, root)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if vol, ok := j.volumes[name]; ok {
+		return vol, nil
+	}
+
+	share := uint32(windows.FILE_SHARE_READ | windows.FILE_SHARE_WRITE | windows.FILE_SHARE_DELETE)
+	h, err := windows.CreateFile(windows.StringToUTF16Ptr(`\\.\`+name), windows.GENERIC_READ, share, nil, windows.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: open volume %s: %v", ErrUnavailable, name, err)
+	}
+	hint, err := windows.CreateFile(windows.StringToUTF16Ptr(name+`\`), 0, share, nil, windows.OPEN_EXISTING, windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		windows.CloseHandle(h)
+		return nil, fmt.Errorf("%w: open %s\\: %v", ErrUnavailable, name, err)
+	}
+	vol := &usnVolume{handle: h, root: hint}
+	if _, err := vol.query(); err != nil {
+		windows.CloseHandle(h)
+		windows.CloseHandle(hint)
+		return nil, err
+	}
+	j.volumes[name] = vol
+	return vol, nil
+}
+
+func (vol *usnVolume) query() (*usnJournalData, error) {
+	var data usnJournalData
+	var n uint32
+	err := windows.DeviceIoControl(vol.handle, fsctlQueryUsnJournal, nil, 0,
+		(*byte)(unsafe.Pointer(&data)), uint32(unsafe.Sizeof(data)), &n, nil)
+	if errors.Is(err, windows.ERROR_JOURNAL_NOT_ACTIVE) || errors.Is(err, windows.ERROR_INVALID_FUNCTION) {
+		// No journal on this volume, or not NTFS/ReFS
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	if errors.Is(err, windows.ERROR_JOURNAL_DELETE_IN_PROGRESS) {
+		return nil, ErrCursorExpired
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// pathOf resolves a file reference number to its current path
+func (vol *usnVolume) pathOf(frn uint64) (string, error) {
+	desc := fileIDDescriptor{Size: uint32(unsafe.Sizeof(fileIDDescriptor{}))}
+	binary.LittleEndian.PutUint64(desc.FileID[:8], frn)
+	r, _, e := procOpenFileById.Call(uintptr(vol.root), uintptr(unsafe.Pointer(&desc)), 0,
+		uintptr(windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE), 0,
+		uintptr(windows.FILE_FLAG_BACKUP_SEMANTICS))
+	h := windows.Handle(r)
+	if h == windows.InvalidHandle {
+		return "", e
+	}
+	defer windows.CloseHandle(h)
+
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	n, err := windows.GetFinalPathNameByHandle(h, &buf[0], uint32(len(buf)), 0)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(windows.UTF16ToString(buf[:n]), `\\?\`), nil
+}
+
+// underRoot matches case-insensitively and rewrites p to root's spelling
+func underRoot(root, p string) (string, bool) {
+	if !within(strings.ToLower(root), strings.ToLower(p)) {
+		return "", false
+	}
+	return root + p[len(root):], true
+}
+
+func formatUsnCursor(id uint64, usn int64) string {
+	return strconv.FormatUint(id, 16) + ":" + strconv.FormatInt(usn, 10)
+}
+
+func parseUsnCursor(s string) (uint64, int64, error) {
+	idStr, usnStr, ok := strings.Cut(s, ":")
+	id, err1 := strconv.ParseUint(idStr, 16, 64)
+	usn, err2 := strconv.ParseInt(usnStr, 10, 64)
+	if !ok || err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("%w: malformed cursor %q", ErrCursorExpired, s)
+	}
+	return id, usn, nil
+}
@@ -0,0 +1,222 @@
+package maintenance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/scheduler"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// stateKey prefixes each task's state in the meta bucket
+	stateKey = "maintenance:"
+	// checkInterval is how often the orchestrator looks for due tasks
+	checkInterval = time.Minute
+)
+
+// ErrPaused is returned by a task's Run that stopped on a limit of its own
+// before finishing; like a closed window, the next run resumes it.
+var ErrPaused = errors.New("maintenance task paused")
+
+// Task is one kind of background upkeep.
+type Task struct {
+	Name     string
+	Interval time.Duration // between the starts of finished runs
+	// Run works until it is done or ctx ends because the window closed or
+	// the budget is spent. It must leave its work so the next Run resumes.
+	Run func(ctx context.Context) error
+}
+
+// State is what the orchestrator remembers of a task.
+type State struct {
+	Name        string    `json:"name"`
+	LastStart   time.Time `json:"last_start,omitempty"`
+	LastDone    time.Time `json:"last_done,omitempty"`
+	Interrupted bool      `json:"interrupted,omitempty"` // paused by the window or budget, resumes first
+	LastError   string    `json:"last_error,omitempty"`
+	NextDue     time.Time `json:"next_due"`
+}
+
+// Orchestrator runs the registered tasks one at a time, in registration
+// order, while the maintenance window is open, spending at most budget of
+// each window on them.
+type Orchestrator struct {
+	db     *persistence.DB
+	window *scheduler.ActiveWindow
+	budget time.Duration
+
+	mu    sync.Mutex
+	tasks []Task
+
+	runMu     sync.Mutex    // held while tasks run
+	windowEnd time.Time     // close of the window the budget is counted in
+	spent     time.Duration // of the budget in that window
+}
+
+// New returns an orchestrator keeping its state in db. A nil window allows
+// maintenance at any time, with the budget applying per day; a zero budget
+// is unlimited.
+func New(db *persistence.DB, window *scheduler.ActiveWindow, budget time.Duration) *Orchestrator {
+	return &Orchestrator{db: db, window: window, budget: budget}
+}
+
+// Register adds t after the tasks registered before, which take priority.
+func (o *Orchestrator) Register(t Task) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.tasks = append(o.tasks, t)
+}
+
+// Run runs due tasks whenever the window is open until ctx is cancelled.
+func (o *Orchestrator) Run(ctx context.Context) {
+	logger := monitoring.GetLogger()
+	logger.WithFields(map[string]interface{}{
+		"window": o.window.String(),
+		"budget": o.budget.String(),
+	}).Info("Maintenance scheduler started")
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		if o.window.Contains(time.Now()) {
+			if err := o.RunDue(ctx); err != nil && ctx.Err() == nil {
+				logger.WithError(err).Error("Maintenance failed")
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunDue runs the tasks that are due, highest priority first, until the
+// window closes or its budget is spent. Interrupted tasks are always due.
+func (o *Orchestrator) RunDue(ctx context.Context) error {
+	o.runMu.Lock()
+	defer o.runMu.Unlock()
+
+	now := time.Now()
+	if !o.window.Contains(now) {
+		return nil
+	}
+	deadline := o.window.Closes(now)
+	if !deadline.Equal(o.windowEnd) {
+		o.windowEnd, o.spent = deadline, 0
+	}
+	if o.budget > 0 {
+		if o.spent >= o.budget {
+			return nil
+		}
+		if end := now.Add(o.budget - o.spent); end.Before(deadline) {
+			deadline = end
+		}
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	defer func() { o.spent += time.Since(now) }()
+
+	for _, t := range o.registered() {
+		if ctx.Err() != nil {
+			return nil
+		}
+		st, err := o.state(t)
+		if err != nil {
+			return err
+		}
+		if !st.Interrupted && !st.LastStart.IsZero() && time.Since(st.LastStart) < t.Interval {
+			continue
+		}
+		o.runTask(ctx, t, st)
+		if err := o.saveState(st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *Orchestrator) runTask(ctx context.Context, t Task, st *State) {
+	logger := monitoring.GetLogger().WithField("task", t.Name)
+	if st.Interrupted {
+		logger.Info("Resuming maintenance task")
+	} else {
+		logger.Info("Starting maintenance task")
+	}
+	start := time.Now()
+	err := t.Run(ctx)
+	if !st.Interrupted {
+		st.LastStart = start
+	}
+	st.Interrupted = false
+	st.LastError = ""
+	switch {
+	case err == nil:
+		st.LastDone = time.Now()
+		logger.WithField("duration", time.Since(start).Seconds()).Info("Maintenance task finished")
+	case ctx.Err() != nil && errors.Is(err, ctx.Err()), errors.Is(err, ErrPaused):
+		st.Interrupted = true
+		logger.Info("Maintenance task paused, resuming in the next window")
+	default:
+		st.LastError = err.Error()
+		logger.WithError(err).Error("Maintenance task failed")
+	}
+}
+
+// Status returns the state of every registered task in priority order.
+func (o *Orchestrator) Status() ([]*State, error) {
+	tasks := o.registered()
+	states := make([]*State, 0, len(tasks))
+	for _, t := range tasks {
+		st, err := o.state(t)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, st)
+	}
+	return states, nil
+}
+
+func (o *Orchestrator) registered() []Task {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]Task(nil), o.tasks...)
+}
+
+// state loads the state of t and works out when it is next due
+func (o *Orchestrator) state(t Task) (*State, error) {
+	st := &State{Name: t.Name}
+	err := o.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(persistence.BucketMeta)).Get([]byte(stateKey + t.Name)); v != nil {
+			return json.Unmarshal(v, st)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	due := time.Now()
+	if !st.Interrupted && !st.LastStart.IsZero() {
+		if next := st.LastStart.Add(t.Interval); next.After(due) {
+			due = next
+		}
+	}
+	st.NextDue = o.window.NextStart(due)
+	return st, nil
+}
+
+func (o *Orchestrator) saveState(st *State) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return o.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistence.BucketMeta)).Put([]byte(stateKey+st.Name), data)
+	})
+}
@@ -0,0 +1,96 @@
+package maintenance_test
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/maintenance"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+)
+
+func TestOrchestratorPriorityAndIntervals(t *testing.T) {
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var ran []string
+	task := func(name string) maintenance.Task {
+		return maintenance.Task{Name: name, Interval: time.Hour, Run: func(ctx context.Context) error {
+			ran = append(ran, name)
+			return nil
+		}}
+	}
+	o := maintenance.New(db, nil, 0)
+	o.Register(task("gc"))
+	o.Register(task("verify"))
+	if err := o.RunDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.RunDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"gc", "verify"}; !reflect.DeepEqual(ran, want) {
+		t.Fatalf("ran %v, want %v once each", ran, want)
+	}
+	states, err := o.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if states[0].LastDone.IsZero() || time.Until(states[0].NextDue) < 59*time.Minute {
+		t.Fatalf("gc state %+v", states[0])
+	}
+}
+
+func TestOrchestratorBudgetPausesAndResumes(t *testing.T) {
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var verified bool
+	block := maintenance.Task{Name: "gc", Interval: time.Hour, Run: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	verify := maintenance.Task{Name: "verify", Interval: time.Hour, Run: func(ctx context.Context) error {
+		verified = true
+		return nil
+	}}
+	o := maintenance.New(db, nil, 20*time.Millisecond)
+	o.Register(block)
+	o.Register(verify)
+	if err := o.RunDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if verified {
+		t.Fatal("lower priority task ran after the budget was spent")
+	}
+	states, err := o.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !states[0].Interrupted {
+		t.Fatalf("gc state %+v, want interrupted", states[0])
+	}
+
+	// The next window resumes the paused task despite its interval
+	resumed := false
+	o = maintenance.New(db, nil, 0)
+	o.Register(maintenance.Task{Name: "gc", Interval: time.Hour, Run: func(ctx context.Context) error {
+		resumed = true
+		return nil
+	}})
+	o.Register(verify)
+	if err := o.RunDue(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !resumed || !verified {
+		t.Fatalf("resumed %v, verified %v", resumed, verified)
+	}
+}
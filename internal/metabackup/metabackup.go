@@ -0,0 +1,184 @@
+// Package metabackup exports what a repository cannot be read without: its
+// snapshot records, which map files to chunks, the node identity and the
+// dictionaries chunks were compressed against. The
+// export is gzipped JSON split into pieces, which the agent stores as
+// ordinary encrypted chunks of a metadata snapshot and replicates like any
+// other snapshot. The salt of the master key rides in that snapshot's
+// metadata, so the passphrase alone recovers everything.
+package metabackup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// Version is the export format
+	Version = 1
+	// pieceSize is the size of the pieces an export is split into
+	pieceSize = 1 << 20
+)
+
+// Metadata keys of an export snapshot. The salt and KDF are not secret.
+const (
+	MetaKDF       = "kdf"
+	MetaSalt      = "key_salt"
+	MetaSnapshots = "snapshots"
+
+	// KDF names the key derivation of crypto.DeriveKey
+	KDF = "argon2id-1-65536-4"
+)
+
+var ErrVersion = errors.New("unsupported metadata export version")
+
+// Export is the metadata of one repository.
+type Export struct {
+	Version   int               `json:"version"`
+	RepoID    string            `json:"repo_id"`
+	Created   time.Time         `json:"created"`
+	Identity  []byte            `json:"identity,omitempty"` // marshalled libp2p private key
+	Snapshots []json.RawMessage `json:"snapshots"`          // records as stored, signatures intact
+	Dicts     map[uint32][]byte `json:"dicts,omitempty"`    // compression dictionaries by ID, as stored: encrypted under the master key
+}
+
+// Collect exports the snapshot records of repoID from db, leaving out earlier
+// metadata exports, and the compression dictionaries.
+func Collect(db *persistence.DB, repoID string, identity []byte) (*Export, error) {
+	exp := &Export{Version: Version, RepoID: repoID, Created: time.Now().UTC(), Identity: identity}
+	err := db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket([]byte(persistence.BucketSnapshots)).ForEach(func(k, v []byte) error {
+			var snap versioning.Snapshot
+			if err := json.Unmarshal(v, &snap); err != nil {
+				return fmt.Errorf("snapshot %s: %w", k, err)
+			}
+			if snap.IsMetadata() || snap.RepoID != repoID && snap.RepoID != "" {
+				return nil
+			}
+			exp.Snapshots = append(exp.Snapshots, append(json.RawMessage(nil), v...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(persistence.BucketDicts)).ForEach(func(k, v []byte) error {
+			if len(k) != 4 {
+				return fmt.Errorf("compression dictionary key %x is malformed", k)
+			}
+			if exp.Dicts == nil {
+				exp.Dicts = make(map[uint32][]byte)
+			}
+			exp.Dicts[binary.BigEndian.Uint32(k)] = append([]byte(nil), v...)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return exp, nil
+}
+
+// Sum identifies the content of the export, ignoring when it was made.
+func (e *Export) Sum() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%s\x00", e.Version, e.RepoID)
+	h.Write(e.Identity)
+	for _, rec := range e.Snapshots {
+		fmt.Fprintf(h, "\x00%d\x00", len(rec))
+		h.Write(rec)
+	}
+	ids := make([]uint32, 0, len(e.Dicts))
+	for id := range e.Dicts {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		fmt.Fprintf(h, "\x00dict %d\x00", id)
+		h.Write(e.Dicts[id])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Pieces encodes the export and splits it into chunk-sized pieces.
+func (e *Export) Pieces() ([][]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(e); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	var pieces [][]byte
+	for len(data) > 0 {
+		n := min(len(data), pieceSize)
+		pieces = append(pieces, data[:n])
+		data = data[n:]
+	}
+	return pieces, nil
+}
+
+// Decode reassembles an export from its pieces, in order.
+func Decode(pieces [][]byte) (*Export, error) {
+	zr, err := gzip.NewReader(io.MultiReader(readers(pieces)...))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var exp Export
+	if err := json.NewDecoder(zr).Decode(&exp); err != nil {
+		return nil, err
+	}
+	if exp.Version != Version {
+		return nil, fmt.Errorf("%w: %d", ErrVersion, exp.Version)
+	}
+	return &exp, nil
+}
+
+// Apply saves the exported snapshot records and compression dictionaries
+// into db and returns how many records there were.
+func (e *Export) Apply(db *persistence.DB) (int, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(persistence.BucketDicts))
+		for id, rec := range e.Dicts {
+			if err := b.Put(binary.BigEndian.AppendUint32(nil, id), rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, rec := range e.Snapshots {
+		var snap versioning.Snapshot
+		if err := json.Unmarshal(rec, &snap); err != nil {
+			return 0, err
+		}
+		if err := versioning.SaveSnapshot(db, &snap); err != nil {
+			return 0, fmt.Errorf("snapshot %s: %w", snap.ID, err)
+		}
+	}
+	return len(e.Snapshots), nil
+}
+
+func readers(pieces [][]byte) []io.Reader {
+	rs := make([]io.Reader, len(pieces))
+	for i, p := range pieces {
+		rs[i] = bytes.NewReader(p)
+	}
+	return rs
+}
@@ -0,0 +1,83 @@
+package metabackup_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/metabackup"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	bolt "go.etcd.io/bbolt"
+)
+
+func openDB(t *testing.T) *persistence.DB {
+	t.Helper()
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	src := openDB(t)
+	hash := strings.Repeat("ab", 32)
+	for _, snap := range []*versioning.Snapshot{
+		{ID: "s1", Chunks: []string{hash}, Meta: map[string]string{"source": "/home"}, RepoID: "r1"},
+		{ID: "s2", Chunks: []string{hash, hash}, Meta: map[string]string{"source": "/home"}, RepoID: "r1"},
+		{ID: "m1", Chunks: []string{hash}, Meta: map[string]string{"source": versioning.MetadataSource}, RepoID: "r1"},
+		{ID: "x1", Chunks: []string{hash}, Meta: map[string]string{"source": "/other"}, RepoID: "r2"},
+	} {
+		if err := versioning.SaveSnapshot(src, snap); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dictKey := []byte{0, 1, 0, 2}
+	err := src.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistence.BucketDicts)).Put(dictKey, []byte("sealed dictionary"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp, err := metabackup.Collect(src, "r1", []byte("identity"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exp.Snapshots) != 2 || len(exp.Dicts) != 1 {
+		t.Fatalf("exported %d records, want 2 (no exports, no foreign snapshots), and %d dictionaries", len(exp.Snapshots), len(exp.Dicts))
+	}
+	again, _ := metabackup.Collect(src, "r1", []byte("identity"))
+	if exp.Sum() != again.Sum() {
+		t.Error("sum depends on export time")
+	}
+
+	pieces, err := exp.Pieces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := metabackup.Decode(pieces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Sum() != exp.Sum() || string(got.Identity) != "identity" {
+		t.Fatal("decoded export differs")
+	}
+
+	dst := openDB(t)
+	if n, err := got.Apply(dst); err != nil || n != 2 {
+		t.Fatalf("Apply = %d, %v", n, err)
+	}
+	snap, err := versioning.LoadSnapshot(dst, "s2")
+	if err != nil || len(snap.Chunks) != 2 {
+		t.Fatalf("recovered s2: %+v, %v", snap, err)
+	}
+	dst.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(persistence.BucketDicts)).Get(dictKey); string(v) != "sealed dictionary" {
+			t.Errorf("recovered dictionary = %q", v)
+		}
+		return nil
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -147,17 +148,18 @@ func (h *HealthChecker) LivenessHandler() http.HandlerFunc {
 }
 
 // Global health checker
-var globalHealthChecker *HealthChecker
+var globalHealthChecker atomic.Pointer[HealthChecker]
 
 // InitHealthChecker initializes the global health checker
 func InitHealthChecker(version string) {
-	globalHealthChecker = NewHealthChecker(version)
+	globalHealthChecker.Store(NewHealthChecker(version))
 }
 
 // GetHealthChecker returns the global health checker
 func GetHealthChecker() *HealthChecker {
-	if globalHealthChecker == nil {
-		globalHealthChecker = NewHealthChecker("unknown")
+	if h := globalHealthChecker.Load(); h != nil {
+		return h
 	}
-	return globalHealthChecker
+	globalHealthChecker.CompareAndSwap(nil, NewHealthChecker("unknown"))
+	return globalHealthChecker.Load()
 }
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -38,6 +40,23 @@ func (l LogLevel) String() string {
 	}
 }
 
+// ParseLevel reads a level name such as "warn" or "WARN".
+func ParseLevel(s string) (LogLevel, bool) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return DebugLevel, true
+	case "info":
+		return InfoLevel, true
+	case "warn":
+		return WarnLevel, true
+	case "error":
+		return ErrorLevel, true
+	case "fatal":
+		return FatalLevel, true
+	}
+	return InfoLevel, false
+}
+
 // LogEntry represents a structured log entry
 type LogEntry struct {
 	Timestamp time.Time              `json:"timestamp"`
@@ -58,21 +77,7 @@ type Logger struct {
 
 // NewLogger creates a new Logger instance
 func NewLogger(level string, format string) *Logger {
-	var logLevel LogLevel
-	switch level {
-	case "debug":
-		logLevel = DebugLevel
-	case "info":
-		logLevel = InfoLevel
-	case "warn":
-		logLevel = WarnLevel
-	case "error":
-		logLevel = ErrorLevel
-	case "fatal":
-		logLevel = FatalLevel
-	default:
-		logLevel = InfoLevel
-	}
+	logLevel, _ := ParseLevel(level)
 
 	return &Logger{
 		level:  logLevel,
@@ -82,6 +87,13 @@ func NewLogger(level string, format string) *Logger {
 	}
 }
 
+// SetOutput sends the entries logged from now on to w.
+func (l *Logger) SetOutput(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.output = w
+}
+
 // WithField adds a field to the logger context
 func (l *Logger) WithField(key string, value interface{}) *Logger {
 	l.mu.Lock()
@@ -206,6 +218,10 @@ func (l *Logger) log(level LogLevel, msg string, err error) {
 	if err != nil {
 		entry.Error = err.Error()
 	}
+	recordRecent(level, entry)
+	if fn := sink.Load(); fn != nil {
+		(*fn)(level, entry)
+	}
 
 	var output string
 	if l.format == "json" {
@@ -240,68 +256,86 @@ func (l *Logger) formatText(entry LogEntry) string {
 	return output + "\n"
 }
 
-// Global logger instance
-var globalLogger = NewLogger("info", "json")
+// sink also receives every entry logged, e.g. for the Windows event log
+var sink atomic.Pointer[func(LogLevel, LogEntry)]
+
+// SetSink passes every entry logged from now on, by any logger, to fn as
+// well as to the logger's output. nil stops.
+func SetSink(fn func(level LogLevel, entry LogEntry)) {
+	if fn == nil {
+		sink.Store(nil)
+		return
+	}
+	sink.Store(&fn)
+}
+
+// Global logger instance, swapped atomically as loops started before
+// SetGlobalLogger may still be logging
+var globalLogger atomic.Pointer[Logger]
+
+func init() {
+	globalLogger.Store(NewLogger("info", "json"))
+}
 
 // SetGlobalLogger sets the global logger instance
 func SetGlobalLogger(logger *Logger) {
-	globalLogger = logger
+	globalLogger.Store(logger)
 }
 
 // GetLogger returns the global logger instance
 func GetLogger() *Logger {
-	return globalLogger
+	return globalLogger.Load()
 }
 
 // Convenience functions for global logger
 func Debug(msg string) {
-	globalLogger.Debug(msg)
+	GetLogger().Debug(msg)
 }
 
 func Debugf(format string, args ...interface{}) {
-	globalLogger.Debugf(format, args...)
+	GetLogger().Debugf(format, args...)
 }
 
 func Info(msg string) {
-	globalLogger.Info(msg)
+	GetLogger().Info(msg)
 }
 
 func Infof(format string, args ...interface{}) {
-	globalLogger.Infof(format, args...)
+	GetLogger().Infof(format, args...)
 }
 
 func Warn(msg string) {
-	globalLogger.Warn(msg)
+	GetLogger().Warn(msg)
 }
 
 func Warnf(format string, args ...interface{}) {
-	globalLogger.Warnf(format, args...)
+	GetLogger().Warnf(format, args...)
 }
 
 func Error(msg string) {
-	globalLogger.Error(msg)
+	GetLogger().Error(msg)
 }
 
 func Errorf(format string, args ...interface{}) {
-	globalLogger.Errorf(format, args...)
+	GetLogger().Errorf(format, args...)
 }
 
 func Fatal(msg string) {
-	globalLogger.Fatal(msg)
+	GetLogger().Fatal(msg)
 }
 
 func Fatalf(format string, args ...interface{}) {
-	globalLogger.Fatalf(format, args...)
+	GetLogger().Fatalf(format, args...)
 }
 
 func WithField(key string, value interface{}) *Logger {
-	return globalLogger.WithField(key, value)
+	return GetLogger().WithField(key, value)
 }
 
 func WithFields(fields map[string]interface{}) *Logger {
-	return globalLogger.WithFields(fields)
+	return GetLogger().WithFields(fields)
 }
 
 func WithError(err error) *Logger {
-	return globalLogger.WithError(err)
+	return GetLogger().WithError(err)
 }
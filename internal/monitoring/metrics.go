@@ -18,15 +18,74 @@ type Metrics struct {
 	ChunksStored       atomic.Uint64
 	ChunksFetched      atomic.Uint64
 	DeduplicatedChunks atomic.Uint64
+	// IncompressibleChunks were stored without compression because they
+	// looked compressed already
+	IncompressibleChunks atomic.Uint64
+	// PostProcessFailures counts snapshot post-processors that failed,
+	// whatever their error policy
+	PostProcessFailures atomic.Uint64
+	// FilesQuarantined counts restored files restore.scan_command flagged
+	FilesQuarantined atomic.Uint64
+	// FilesReported counts files snapshot.content_policy flagged as
+	// secrets but backed up, FilesWithheld those it left out of snapshots
+	FilesReported atomic.Uint64
+	FilesWithheld atomic.Uint64
+
+	// Freshness metrics
+	BackupFreshness     *SourceGauge // age in seconds of the newest snapshot of each source with a target
+	FreshnessViolations atomic.Int64 // sources whose newest snapshot is older than their target
 
 	// P2P metrics
-	PeersConnected        atomic.Int64
-	PeersDiscovered       atomic.Uint64
-	MessagesReceived      atomic.Uint64
-	MessagesSent          atomic.Uint64
-	ChunkRequestsReceived atomic.Uint64
-	ChunkRequestsSent     atomic.Uint64
-	ChunkRequestsFailed   atomic.Uint64
+	PeersConnected              atomic.Int64
+	PeersDiscovered             atomic.Uint64
+	MessagesReceived            atomic.Uint64
+	MessagesSent                atomic.Uint64
+	MessagesDropped             atomic.Uint64
+	PeerPenalties               atomic.Uint64
+	PeersQuarantined            atomic.Int64
+	PinsUnreachable             atomic.Int64
+	MirrorLagSeconds            atomic.Int64
+	MirrorVerifyFailures        atomic.Uint64
+	ChunkRequestsReceived       atomic.Uint64
+	ChunkRequestsSent           atomic.Uint64
+	ChunkRequestsFailed         atomic.Uint64
+	ChunkFetchRetries           atomic.Uint64 // requests to a further provider after one failed
+	ChunkStreamFetches          atomic.Uint64 // chunks fetched from a peer over the chunk stream protocol
+	LegacyChunkRequestsSent     atomic.Uint64 // chunk requests published on pubsub, for peers without the chunk protocol
+	LegacyChunkRequestsReceived atomic.Uint64 // chunk requests received on pubsub from peers still using it
+	LegacyChunkMessagesDropped  atomic.Uint64 // pubsub chunk requests and responses ignored with p2p.chunk_pubsub off
+	LocationHintHits            atomic.Uint64 // chunks fetched from a peer hinted to hold them
+	ChunkFetchesInFlight        atomic.Int64  // chunk requests awaiting a response
+	ChunkFetchesInFlightMax     atomic.Int64  // most chunk requests ever awaiting a response at once
+	ChunkFetchesJoined          atomic.Uint64 // fetches that waited on an identical request in flight
+	ChunkFetchesReaped          atomic.Uint64 // requests abandoned after outliving twice the fetch timeout
+	ChunksUnfetchable           atomic.Int64  // chunks queued because no provider returned them
+	ChunksRecovered             atomic.Uint64 // queued chunks fetched on a later retry
+	ReceivedVerified            atomic.Uint64 // chunks from peers that test-decrypted cleanly
+	ReceivedQuarantined         atomic.Uint64 // chunks from peers that failed to decrypt and were set aside
+	TransferCorruptions         atomic.Uint64 // chunks that failed a frame checksum or their hash while streamed
+	ServeCacheHits              atomic.Uint64 // chunks served to peers from memory
+	ServeCacheMisses            atomic.Uint64 // chunks served to peers from the database
+	ServeCacheBytes             atomic.Int64  // chunk bytes held in memory for serving
+	CacheNodeHits               atomic.Uint64 // chunks a cache node served from its cache
+	CacheNodeMisses             atomic.Uint64 // chunks a cache node had to fetch before serving
+	CacheNodeBytes              atomic.Int64  // chunk bytes held by a cache node
+	CacheNodeEvictions          atomic.Int64  // chunks a cache node evicted since it started
+	CacheNodeFetches            atomic.Uint64 // chunks fetched from a cache node
+
+	// Agent resource metrics, sampled every resources.check_interval
+	MemoryHeapBytes    atomic.Int64 // bytes of live and not yet collected heap objects
+	MemoryHeldBytes    atomic.Int64 // bytes obtained from the OS and not returned
+	Goroutines         atomic.Int64
+	GCCycles           atomic.Uint64 // completed garbage collections
+	GCPauseNanos       atomic.Uint64 // total stop-the-world pause
+	DBSizeBytes        atomic.Int64
+	DBOpenTxs          atomic.Int64
+	DBTxs              atomic.Uint64 // read transactions started
+	DBFreePages        atomic.Int64
+	ResourcesOverLimit atomic.Int64  // 1 while a soft resource limit is exceeded
+	ChunkRequestsShed  atomic.Uint64 // chunk requests from peers left unanswered over a resource limit
+	JobsDeferred       atomic.Uint64 // backups, restores and maintenance runs held back over a resource limit
 
 	// Storage metrics
 	TotalStorageUsed      atomic.Int64
@@ -60,6 +119,7 @@ func NewMetrics() *Metrics {
 		BackupDuration:     NewDurationHistogram(),
 		RestoreDuration:    NewDurationHistogram(),
 		ChunkFetchDuration: NewDurationHistogram(),
+		BackupFreshness:    NewSourceGauge(),
 	}
 }
 
@@ -126,6 +186,43 @@ func (h *DurationHistogram) Snapshot() map[string]uint64 {
 	return snapshot
 }
 
+// SourceGauge holds one value per backup source
+type SourceGauge struct {
+	mu     sync.RWMutex
+	values map[string]int64
+}
+
+// NewSourceGauge creates an empty source gauge
+func NewSourceGauge() *SourceGauge {
+	return &SourceGauge{values: make(map[string]int64)}
+}
+
+// Set records the value of a source
+func (g *SourceGauge) Set(source string, v int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[source] = v
+}
+
+// Delete drops a source, e.g. one that has no snapshot yet
+func (g *SourceGauge) Delete(source string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.values, source)
+}
+
+// Snapshot returns a copy of every source's value
+func (g *SourceGauge) Snapshot() map[string]int64 {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	snapshot := make(map[string]int64, len(g.values))
+	for k, v := range g.values {
+		snapshot[k] = v
+	}
+	return snapshot
+}
+
 // RecordBackupCreated increments backup created counter
 func (m *Metrics) RecordBackupCreated(bytes uint64, duration time.Duration) {
 	m.BackupsCreated.Add(1)
@@ -194,6 +291,16 @@ func (m *Metrics) RecordMessageSent() {
 	m.MessagesSent.Add(1)
 }
 
+// RecordMessageDropped increments dropped (rejected) message counter
+func (m *Metrics) RecordMessageDropped() {
+	m.MessagesDropped.Add(1)
+}
+
+// RecordPeerPenalized increments peer penalty counter
+func (m *Metrics) RecordPeerPenalized() {
+	m.PeerPenalties.Add(1)
+}
+
 // RecordChunkRequest tracks chunk request metrics
 func (m *Metrics) RecordChunkRequest(sent bool, failed bool) {
 	if sent {
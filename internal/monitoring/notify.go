@@ -0,0 +1,60 @@
+package monitoring
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Notification is an alert for operators, POSTed to a webhook as JSON.
+type Notification struct {
+	Event   string                 `json:"event"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	Time    time.Time              `json:"time"`
+}
+
+// Notifier delivers notifications to a webhook.
+type Notifier struct {
+	url    string
+	client *http.Client
+}
+
+// NewNotifier creates a notifier for url; with url empty it sends nothing.
+func NewNotifier(url string) *Notifier {
+	return &Notifier{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Notify POSTs note to the webhook and fails unless it answers 2xx.
+func (n *Notifier) Notify(ctx context.Context, note Notification) error {
+	if n.url == "" {
+		return nil
+	}
+	if note.Time.IsZero() {
+		note.Time = time.Now().UTC()
+	}
+	body, err := json.Marshal(note)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package monitoring
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// recentErrorsSize is how many warnings and errors are kept for diagnostics
+	recentErrorsSize = 100
+	// recentLogsSize is how many entries of any level are kept for log tails
+	recentLogsSize = 500
+)
+
+// logRing keeps the latest entries logged by any logger
+type logRing struct {
+	mu      sync.Mutex
+	size    int
+	entries []LogEntry
+	next    int
+}
+
+var (
+	// recentErrors holds warnings and errors, for diagnostic dumps
+	recentErrors = &logRing{size: recentErrorsSize}
+	// recentLogs holds every entry logged, for log tails
+	recentLogs = &logRing{size: recentLogsSize}
+)
+
+func recordRecent(level LogLevel, entry LogEntry) {
+	if level >= WarnLevel {
+		recentErrors.add(entry)
+	}
+	recentLogs.add(entry)
+}
+
+func (r *logRing) add(entry LogEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) < r.size {
+		r.entries = append(r.entries, entry)
+		return
+	}
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % r.size
+}
+
+// list returns the entries, oldest first
+func (r *logRing) list() []LogEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]LogEntry, 0, len(r.entries))
+	out = append(out, r.entries[r.next:]...)
+	return append(out, r.entries[:r.next]...)
+}
+
+// RecentErrors returns the latest warnings and errors logged, oldest first.
+func RecentErrors() []LogEntry {
+	return recentErrors.list()
+}
+
+// RecentLogs returns the latest entries logged after since, oldest first.
+func RecentLogs(since time.Time) []LogEntry {
+	all := recentLogs.list()
+	for i, e := range all {
+		if e.Timestamp.After(since) {
+			return all[i:]
+		}
+	}
+	return all[:0]
+}
@@ -0,0 +1,37 @@
+package monitoring
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+type requestIDKey struct{}
+
+// NewRequestID returns a random ID for correlating the log entries of one
+// request and the work it starts.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WithRequestID returns a copy of ctx carrying the request ID id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// LoggerFor returns the global logger, tagged with the request ID of ctx if
+// it carries one.
+func LoggerFor(ctx context.Context) *Logger {
+	if id := RequestID(ctx); id != "" {
+		return GetLogger().WithField("request_id", id)
+	}
+	return GetLogger()
+}
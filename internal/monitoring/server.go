@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/pprof"
+	"sort"
 	"time"
 )
 
@@ -161,10 +162,23 @@ func (ms *MetricsServer) metricsHandler() http.HandlerFunc {
 		fmt.Fprintf(w, "# TYPE shadowvault_backups_failed_total counter\n")
 		fmt.Fprintf(w, "shadowvault_backups_failed_total %d\n", ms.metrics.BackupsFailed.Load())
 
+		fmt.Fprintf(w, "# HELP shadowvault_post_process_failures_total Snapshot post-processors that failed\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_post_process_failures_total counter\n")
+		fmt.Fprintf(w, "shadowvault_post_process_failures_total %d\n", ms.metrics.PostProcessFailures.Load())
+
 		fmt.Fprintf(w, "# HELP shadowvault_restores_completed_total Total number of completed restores\n")
 		fmt.Fprintf(w, "# TYPE shadowvault_restores_completed_total counter\n")
 		fmt.Fprintf(w, "shadowvault_restores_completed_total %d\n", ms.metrics.RestoresCompleted.Load())
 
+		fmt.Fprintf(w, "# HELP shadowvault_restore_files_quarantined_total Restored files the scan command flagged and quarantined\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_restore_files_quarantined_total counter\n")
+		fmt.Fprintf(w, "shadowvault_restore_files_quarantined_total %d\n", ms.metrics.FilesQuarantined.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_content_policy_files_total Files the content policy flagged as secrets, by whether they were left out\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_content_policy_files_total counter\n")
+		fmt.Fprintf(w, "shadowvault_content_policy_files_total{action=\"reported\"} %d\n", ms.metrics.FilesReported.Load())
+		fmt.Fprintf(w, "shadowvault_content_policy_files_total{action=\"excluded\"} %d\n", ms.metrics.FilesWithheld.Load())
+
 		fmt.Fprintf(w, "# HELP shadowvault_restores_failed_total Total number of failed restores\n")
 		fmt.Fprintf(w, "# TYPE shadowvault_restores_failed_total counter\n")
 		fmt.Fprintf(w, "shadowvault_restores_failed_total %d\n", ms.metrics.RestoresFailed.Load())
@@ -177,6 +191,23 @@ func (ms *MetricsServer) metricsHandler() http.HandlerFunc {
 		fmt.Fprintf(w, "# TYPE shadowvault_bytes_restored_total counter\n")
 		fmt.Fprintf(w, "shadowvault_bytes_restored_total %d\n", ms.metrics.BytesRestored.Load())
 
+		// Freshness metrics
+		fmt.Fprintf(w, "# HELP shadowvault_backup_freshness_seconds Age of the newest snapshot of each source with a freshness target\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_backup_freshness_seconds gauge\n")
+		freshness := ms.metrics.BackupFreshness.Snapshot()
+		sources := make([]string, 0, len(freshness))
+		for src := range freshness {
+			sources = append(sources, src)
+		}
+		sort.Strings(sources)
+		for _, src := range sources {
+			fmt.Fprintf(w, "shadowvault_backup_freshness_seconds{source=%q} %d\n", src, freshness[src])
+		}
+
+		fmt.Fprintf(w, "# HELP shadowvault_backup_freshness_violations Sources whose newest snapshot is older than their freshness target\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_backup_freshness_violations gauge\n")
+		fmt.Fprintf(w, "shadowvault_backup_freshness_violations %d\n", ms.metrics.FreshnessViolations.Load())
+
 		// Chunk metrics
 		fmt.Fprintf(w, "# HELP shadowvault_chunks_stored_total Total number of chunks stored\n")
 		fmt.Fprintf(w, "# TYPE shadowvault_chunks_stored_total counter\n")
@@ -190,6 +221,10 @@ func (ms *MetricsServer) metricsHandler() http.HandlerFunc {
 		fmt.Fprintf(w, "# TYPE shadowvault_deduplicated_chunks_total counter\n")
 		fmt.Fprintf(w, "shadowvault_deduplicated_chunks_total %d\n", ms.metrics.DeduplicatedChunks.Load())
 
+		fmt.Fprintf(w, "# HELP shadowvault_incompressible_chunks_total Chunks stored uncompressed because they looked compressed already\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_incompressible_chunks_total counter\n")
+		fmt.Fprintf(w, "shadowvault_incompressible_chunks_total %d\n", ms.metrics.IncompressibleChunks.Load())
+
 		// P2P metrics
 		fmt.Fprintf(w, "# HELP shadowvault_peers_connected Current number of connected peers\n")
 		fmt.Fprintf(w, "# TYPE shadowvault_peers_connected gauge\n")
@@ -207,6 +242,165 @@ func (ms *MetricsServer) metricsHandler() http.HandlerFunc {
 		fmt.Fprintf(w, "# TYPE shadowvault_messages_sent_total counter\n")
 		fmt.Fprintf(w, "shadowvault_messages_sent_total %d\n", ms.metrics.MessagesSent.Load())
 
+		fmt.Fprintf(w, "# HELP shadowvault_messages_dropped_total Total messages rejected by validation\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_messages_dropped_total counter\n")
+		fmt.Fprintf(w, "shadowvault_messages_dropped_total %d\n", ms.metrics.MessagesDropped.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_peer_penalties_total Total misbehaviour penalties applied to peers\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_peer_penalties_total counter\n")
+		fmt.Fprintf(w, "shadowvault_peer_penalties_total %d\n", ms.metrics.PeerPenalties.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_peers_quarantined Current number of quarantined peers\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_peers_quarantined gauge\n")
+		fmt.Fprintf(w, "shadowvault_peers_quarantined %d\n", ms.metrics.PeersQuarantined.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_pinned_peers_unreachable Pinned peers unreachable beyond the alert threshold\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_pinned_peers_unreachable gauge\n")
+		fmt.Fprintf(w, "shadowvault_pinned_peers_unreachable %d\n", ms.metrics.PinsUnreachable.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_mirror_lag_seconds Age of the oldest snapshot not yet on every mirror\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_mirror_lag_seconds gauge\n")
+		fmt.Fprintf(w, "shadowvault_mirror_lag_seconds %d\n", ms.metrics.MirrorLagSeconds.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_mirror_verify_failures_total Snapshots that failed periodic mirror verification\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_mirror_verify_failures_total counter\n")
+		fmt.Fprintf(w, "shadowvault_mirror_verify_failures_total %d\n", ms.metrics.MirrorVerifyFailures.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_chunk_fetch_retries_total Chunk requests failed over to another provider\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_chunk_fetch_retries_total counter\n")
+		fmt.Fprintf(w, "shadowvault_chunk_fetch_retries_total %d\n", ms.metrics.ChunkFetchRetries.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_chunk_stream_fetches_total Chunks fetched from a peer over the chunk stream protocol\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_chunk_stream_fetches_total counter\n")
+		fmt.Fprintf(w, "shadowvault_chunk_stream_fetches_total %d\n", ms.metrics.ChunkStreamFetches.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_legacy_chunk_requests_sent_total Chunk requests published on pubsub, for peers without the chunk protocol\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_legacy_chunk_requests_sent_total counter\n")
+		fmt.Fprintf(w, "shadowvault_legacy_chunk_requests_sent_total %d\n", ms.metrics.LegacyChunkRequestsSent.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_legacy_chunk_requests_received_total Chunk requests received on pubsub from peers still using it\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_legacy_chunk_requests_received_total counter\n")
+		fmt.Fprintf(w, "shadowvault_legacy_chunk_requests_received_total %d\n", ms.metrics.LegacyChunkRequestsReceived.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_legacy_chunk_messages_dropped_total Pubsub chunk requests and responses ignored with p2p.chunk_pubsub off\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_legacy_chunk_messages_dropped_total counter\n")
+		fmt.Fprintf(w, "shadowvault_legacy_chunk_messages_dropped_total %d\n", ms.metrics.LegacyChunkMessagesDropped.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_chunk_location_hint_hits_total Chunks fetched from a peer recorded as holding them\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_chunk_location_hint_hits_total counter\n")
+		fmt.Fprintf(w, "shadowvault_chunk_location_hint_hits_total %d\n", ms.metrics.LocationHintHits.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_chunk_fetches_in_flight Chunk requests awaiting a response\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_chunk_fetches_in_flight gauge\n")
+		fmt.Fprintf(w, "shadowvault_chunk_fetches_in_flight %d\n", ms.metrics.ChunkFetchesInFlight.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_chunk_fetches_in_flight_max Most chunk requests awaiting a response at once since start\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_chunk_fetches_in_flight_max gauge\n")
+		fmt.Fprintf(w, "shadowvault_chunk_fetches_in_flight_max %d\n", ms.metrics.ChunkFetchesInFlightMax.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_chunk_fetches_joined_total Fetches that waited on an identical request already in flight\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_chunk_fetches_joined_total counter\n")
+		fmt.Fprintf(w, "shadowvault_chunk_fetches_joined_total %d\n", ms.metrics.ChunkFetchesJoined.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_chunk_fetches_reaped_total Chunk requests abandoned after outliving twice the fetch timeout\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_chunk_fetches_reaped_total counter\n")
+		fmt.Fprintf(w, "shadowvault_chunk_fetches_reaped_total %d\n", ms.metrics.ChunkFetchesReaped.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_chunks_unfetchable Chunks of announced snapshots no provider has returned\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_chunks_unfetchable gauge\n")
+		fmt.Fprintf(w, "shadowvault_chunks_unfetchable %d\n", ms.metrics.ChunksUnfetchable.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_chunks_recovered_total Queued missing chunks fetched on a later retry\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_chunks_recovered_total counter\n")
+		fmt.Fprintf(w, "shadowvault_chunks_recovered_total %d\n", ms.metrics.ChunksRecovered.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_received_chunks_verified_total Chunks received from peers that test-decrypted cleanly\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_received_chunks_verified_total counter\n")
+		fmt.Fprintf(w, "shadowvault_received_chunks_verified_total %d\n", ms.metrics.ReceivedVerified.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_received_chunks_quarantined_total Chunks received from peers that failed to decrypt and were quarantined\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_received_chunks_quarantined_total counter\n")
+		fmt.Fprintf(w, "shadowvault_received_chunks_quarantined_total %d\n", ms.metrics.ReceivedQuarantined.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_transfer_corruptions_total Chunks that failed a frame checksum or their hash while streamed from a peer\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_transfer_corruptions_total counter\n")
+		fmt.Fprintf(w, "shadowvault_transfer_corruptions_total %d\n", ms.metrics.TransferCorruptions.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_serve_cache_requests_total Chunks served to peers, by whether they came from the hot-chunk cache\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_serve_cache_requests_total counter\n")
+		fmt.Fprintf(w, "shadowvault_serve_cache_requests_total{result=\"hit\"} %d\n", ms.metrics.ServeCacheHits.Load())
+		fmt.Fprintf(w, "shadowvault_serve_cache_requests_total{result=\"miss\"} %d\n", ms.metrics.ServeCacheMisses.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_serve_cache_bytes Chunk bytes held in memory for serving to peers\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_serve_cache_bytes gauge\n")
+		fmt.Fprintf(w, "shadowvault_serve_cache_bytes %d\n", ms.metrics.ServeCacheBytes.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_cache_node_requests_total Chunks a cache node served, by whether they were cached\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_cache_node_requests_total counter\n")
+		fmt.Fprintf(w, "shadowvault_cache_node_requests_total{result=\"hit\"} %d\n", ms.metrics.CacheNodeHits.Load())
+		fmt.Fprintf(w, "shadowvault_cache_node_requests_total{result=\"miss\"} %d\n", ms.metrics.CacheNodeMisses.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_cache_node_bytes Chunk bytes held by this cache node\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_cache_node_bytes gauge\n")
+		fmt.Fprintf(w, "shadowvault_cache_node_bytes %d\n", ms.metrics.CacheNodeBytes.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_cache_node_evictions_total Chunks this cache node evicted to stay within cache.size\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_cache_node_evictions_total counter\n")
+		fmt.Fprintf(w, "shadowvault_cache_node_evictions_total %d\n", ms.metrics.CacheNodeEvictions.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_cache_node_fetches_total Chunks fetched from a cache node\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_cache_node_fetches_total counter\n")
+		fmt.Fprintf(w, "shadowvault_cache_node_fetches_total %d\n", ms.metrics.CacheNodeFetches.Load())
+
+		// Agent resource metrics
+		fmt.Fprintf(w, "# HELP shadowvault_memory_heap_bytes Bytes of allocated heap objects, as of the last resource check\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_memory_heap_bytes gauge\n")
+		fmt.Fprintf(w, "shadowvault_memory_heap_bytes %d\n", ms.metrics.MemoryHeapBytes.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_memory_held_bytes Bytes of memory obtained from the OS and not returned, as of the last resource check\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_memory_held_bytes gauge\n")
+		fmt.Fprintf(w, "shadowvault_memory_held_bytes %d\n", ms.metrics.MemoryHeldBytes.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_goroutines Goroutines, as of the last resource check\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_goroutines gauge\n")
+		fmt.Fprintf(w, "shadowvault_goroutines %d\n", ms.metrics.Goroutines.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_gc_cycles_total Completed garbage collection cycles\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_gc_cycles_total counter\n")
+		fmt.Fprintf(w, "shadowvault_gc_cycles_total %d\n", ms.metrics.GCCycles.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_gc_pause_seconds_total Time the program was paused for garbage collection\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_gc_pause_seconds_total counter\n")
+		fmt.Fprintf(w, "shadowvault_gc_pause_seconds_total %.6f\n", float64(ms.metrics.GCPauseNanos.Load())/1e9)
+
+		fmt.Fprintf(w, "# HELP shadowvault_db_size_bytes Size of the metadata DB\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_db_size_bytes gauge\n")
+		fmt.Fprintf(w, "shadowvault_db_size_bytes %d\n", ms.metrics.DBSizeBytes.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_db_open_transactions Read transactions open on the metadata DB\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_db_open_transactions gauge\n")
+		fmt.Fprintf(w, "shadowvault_db_open_transactions %d\n", ms.metrics.DBOpenTxs.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_db_transactions_total Read transactions started on the metadata DB\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_db_transactions_total counter\n")
+		fmt.Fprintf(w, "shadowvault_db_transactions_total %d\n", ms.metrics.DBTxs.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_db_free_pages Pages of the metadata DB free for reuse\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_db_free_pages gauge\n")
+		fmt.Fprintf(w, "shadowvault_db_free_pages %d\n", ms.metrics.DBFreePages.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_resources_over_limit Whether a soft resource limit is exceeded\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_resources_over_limit gauge\n")
+		fmt.Fprintf(w, "shadowvault_resources_over_limit %d\n", ms.metrics.ResourcesOverLimit.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_chunk_requests_shed_total Chunk requests from peers left unanswered over a resource limit\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_chunk_requests_shed_total counter\n")
+		fmt.Fprintf(w, "shadowvault_chunk_requests_shed_total %d\n", ms.metrics.ChunkRequestsShed.Load())
+
+		fmt.Fprintf(w, "# HELP shadowvault_jobs_deferred_total Backups, restores and maintenance runs held back over a resource limit\n")
+		fmt.Fprintf(w, "# TYPE shadowvault_jobs_deferred_total counter\n")
+		fmt.Fprintf(w, "shadowvault_jobs_deferred_total %d\n", ms.metrics.JobsDeferred.Load())
+
 		// Storage metrics
 		fmt.Fprintf(w, "# HELP shadowvault_storage_used_bytes Current storage usage in bytes\n")
 		fmt.Fprintf(w, "# TYPE shadowvault_storage_used_bytes gauge\n")
@@ -0,0 +1,106 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hoangsonww/backupagent/internal/chunkcache"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// ErrNotLocal is returned to peers asking a cache node that serves only its
+// local network from outside it
+var ErrNotLocal = errors.New("cache serves the local network only")
+
+// ServeCache makes this node a cache node. It installs the CacheProtocol
+// stream handler, which answers requests for chunks of any repository from
+// cache, first fetching those it lacks from the peers speaking
+// ChunkProtocol. With lanOnly, peers not connected from a private network
+// are refused.
+func ServeCache(h host.Host, cache *chunkcache.Cache, fetcher *ChunkFetcher, scorer *PeerScorer, lanOnly bool) {
+	metrics := fetcher.metrics
+	h.SetStreamHandler(CacheProtocol, func(s network.Stream) {
+		defer s.Close()
+		from := s.Conn().RemotePeer()
+		logger := monitoring.GetLogger().WithField("peer", from.String())
+		r := bufio.NewReader(s)
+		w := bufio.NewWriter(s)
+
+		reject := func(err error) {
+			logger.WithError(err).Debug("Rejected cache request")
+			writePushFrame(s, w, &pushFrame{Kind: pushError, Error: err.Error()})
+		}
+
+		req, err := readPushFrame(s, r)
+		if err != nil {
+			return
+		}
+		metrics.RecordChunkRequest(false, false)
+		switch {
+		case req.Kind != pullChunks:
+			reject(errors.New("expected chunk request"))
+			return
+		case scorer.IsQuarantined(from):
+			reject(errors.New("peer is quarantined"))
+			return
+		case lanOnly && !manet.IsPrivateAddr(s.Conn().RemoteMultiaddr()):
+			reject(ErrNotLocal)
+			return
+		case fetcher.Shedding():
+			metrics.ChunkRequestsShed.Add(1)
+			reject(ErrShedding)
+			return
+		}
+		for _, hash := range req.Hashes {
+			data, ok := cache.Get(hash)
+			if ok {
+				metrics.CacheNodeHits.Add(1)
+			} else {
+				metrics.CacheNodeMisses.Add(1)
+				if data, err = fetcher.fetchThrough(hash, req.RepoID, from); err != nil {
+					logger.WithError(err).Debugf("Cache could not fetch chunk %s", hash)
+					continue
+				}
+				if err := cache.Put(hash, data); err != nil {
+					logger.WithError(err).Warnf("Failed to cache chunk %s", hash)
+				}
+				st := cache.Stats()
+				metrics.CacheNodeBytes.Store(st.Bytes)
+				metrics.CacheNodeEvictions.Store(st.Evictions)
+			}
+			if err := writeChunk(s, w, hash, data); err != nil {
+				metrics.RecordChunkRequest(false, true)
+				return
+			}
+		}
+		writePushFrame(s, w, &pushFrame{Kind: pullDone})
+	})
+}
+
+// fetchThrough fetches hash of repoID for a cache node from every peer that
+// may hold it at once, without storing it. The requester, which lacks it,
+// and other cache nodes are not asked.
+func (cf *ChunkFetcher) fetchThrough(hash, repoID string, requester peer.ID) ([]byte, error) {
+	var peers []peer.ID
+	for _, p := range cf.chunkPeers() {
+		if p != requester && !IsCacheNode(cf.host, p) {
+			peers = append(peers, p)
+		}
+	}
+	if len(peers) == 0 {
+		return nil, ErrNoChunkProviders
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cf.timeout)
+	defer cancel()
+	_, data, err := cf.firstCopy(ctx, peers, hash, repoID)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", hash, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,251 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/crypto"
+	sverrors "github.com/hoangsonww/backupagent/internal/errors"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	libp2pproto "github.com/libp2p/go-libp2p/core/protocol"
+)
+
+var (
+	// errChunkStream means no ChunkProtocol stream could be opened to a
+	// peer, e.g. one predating it, which the data topic may still reach
+	errChunkStream = errors.New("cannot open chunk stream")
+	// ErrChunkNotHeld is returned when the asked peer does not hold a chunk
+	ErrChunkNotHeld = errors.New("peer does not hold the chunk")
+	// ErrNoChunkProviders is returned when no connected peer speaks
+	// ChunkProtocol and chunk requests may not go on the data topic
+	ErrNoChunkProviders = errors.New("no connected peer serves chunks over the chunk protocol")
+)
+
+// SetChunkProtocol lets the fetcher ask peers over ChunkProtocol through h.
+// With legacy, chunks are still requested on the data topic from peers that
+// do not speak it, and requests from such peers are answered there.
+func (cf *ChunkFetcher) SetChunkProtocol(h host.Host, legacy bool) {
+	cf.host = h
+	cf.legacy = legacy
+}
+
+// streamChunk fetches hash of repoID from pid over proto, ChunkProtocol or
+// CacheProtocol, and checks it against its hash. The stream is reset when
+// ctx ends.
+func (cf *ChunkFetcher) streamChunk(ctx context.Context, pid peer.ID, proto libp2pproto.ID, hash, repoID string) ([]byte, error) {
+	s, err := cf.host.NewStream(ctx, pid, proto)
+	if err != nil {
+		return nil, fmt.Errorf("%w to %s: %v", errChunkStream, pid, err)
+	}
+	defer s.Close()
+	stop := context.AfterFunc(ctx, func() { s.Reset() })
+	defer stop()
+	r := bufio.NewReader(s)
+	w := bufio.NewWriter(s)
+
+	if err := writePushFrame(s, w, &pushFrame{Kind: pullChunks, RepoID: repoID, Hashes: []string{hash}}); err != nil {
+		return nil, err
+	}
+	f, err := readPushFrame(s, r)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	switch {
+	case f.Kind == pushError:
+		return nil, fmt.Errorf("%w: %s", ErrPushRejected, f.Error)
+	case f.Kind == pullDone:
+		return nil, ErrChunkNotHeld
+	case f.Kind != pushChunk || f.Hash != hash:
+		return nil, fmt.Errorf("unexpected %q frame for chunk %s", f.Kind, f.Hash)
+	}
+	data, err := readChunk(s, r, f, cf.maxChunkSize)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if hex.EncodeToString(crypto.Hash(data)) != hash {
+		return nil, ErrChunkHashMismatch
+	}
+	return data, nil
+}
+
+// requestStream fetches hash from provider over proto, within the timeout
+// fitting its link, and stores it
+func (cf *ChunkFetcher) requestStream(ctx context.Context, pid peer.ID, proto libp2pproto.ID, hash, repoID string) ([]byte, error) {
+	logger := monitoring.GetLogger().WithField("chunk_hash", hash)
+	cf.metrics.RecordChunkRequest(true, false)
+
+	sent := time.Now()
+	timeout := cf.timer.timeout(pid.String())
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	data, err := cf.streamChunk(ctx, pid, proto, hash, repoID)
+	if err != nil {
+		cf.metrics.RecordChunkRequest(true, true)
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.WithField("timeout", timeout.String()).Warn("Chunk fetch timeout")
+			cf.timer.timedOut(pid.String())
+			return nil, errors.New("chunk fetch timeout")
+		}
+		return nil, err
+	}
+	cf.timer.observe(pid.String(), len(data), time.Since(sent))
+	if err := cf.received(hash, repoID, pid.String(), pid, data); err != nil {
+		return nil, err
+	}
+	cf.metrics.ChunkStreamFetches.Add(1)
+	if proto == CacheProtocol {
+		cf.metrics.CacheNodeFetches.Add(1)
+	}
+	logger.Debug("Chunk received from peer")
+	return data, nil
+}
+
+// requestAll asks every connected peer speaking ChunkProtocol for hash at
+// once and stores the first copy to arrive
+func (cf *ChunkFetcher) requestAll(ctx context.Context, hash, repoID string) ([]byte, error) {
+	peers := cf.chunkPeers()
+	if len(peers) == 0 {
+		return nil, ErrNoChunkProviders
+	}
+	cf.metrics.RecordChunkRequest(true, false)
+	from, data, err := cf.firstCopy(ctx, peers, hash, repoID)
+	if err != nil {
+		cf.metrics.RecordChunkRequest(true, true)
+		return nil, err
+	}
+	if err := cf.received(hash, repoID, from.String(), from, data); err != nil {
+		return nil, err
+	}
+	cf.metrics.ChunkStreamFetches.Add(1)
+	return data, nil
+}
+
+// chunkPeers returns the connected peers speaking ChunkProtocol, but not
+// ourselves
+func (cf *ChunkFetcher) chunkPeers() []peer.ID {
+	var peers []peer.ID
+	if cf.providers != nil {
+		for _, p := range cf.providers() {
+			if p != cf.self && speaks(cf.host, p, ChunkProtocol) {
+				peers = append(peers, p)
+			}
+		}
+	}
+	return peers
+}
+
+// firstCopy asks every one of peers for hash at once over ChunkProtocol
+// and returns the first copy to arrive and who sent it
+func (cf *ChunkFetcher) firstCopy(ctx context.Context, peers []peer.ID, hash, repoID string) (peer.ID, []byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		from peer.ID
+		data []byte
+		err  error
+	}
+	results := make(chan result, len(peers))
+	for _, p := range peers {
+		go func(p peer.ID) {
+			data, err := cf.streamChunk(ctx, p, ChunkProtocol, hash, repoID)
+			results <- result{p, data, err}
+		}(p)
+	}
+	var err error
+	for range peers {
+		res := <-results
+		if res.err != nil {
+			err = res.err
+			continue
+		}
+		return res.from, res.data, nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return "", nil, ctxErr
+	}
+	return "", nil, err
+}
+
+// received stores a chunk of repoID from peer from, whose copy signer vouched
+// for, and records where it came from
+func (cf *ChunkFetcher) received(hash, repoID, signer string, from peer.ID, data []byte) error {
+	if err := cf.store.Put(hash, data); err != nil {
+		monitoring.GetLogger().WithField("chunk_hash", hash).WithError(err).Error("Failed to store chunk")
+		return fmt.Errorf("failed to store chunk: %w", err)
+	}
+	if cf.verify != nil {
+		cf.verify.Add(hash, repoID, signer)
+	}
+	if cf.locations != nil {
+		cf.locations.Record(from, hash)
+	}
+	return nil
+}
+
+// ServeChunks installs the ChunkProtocol stream handler. Like chunk requests
+// on the data topic, it serves chunks of our own repository to any peer that
+// is not quarantined.
+func ServeChunks(h host.Host, fetcher *ChunkFetcher, scorer *PeerScorer) {
+	h.SetStreamHandler(ChunkProtocol, func(s network.Stream) {
+		defer s.Close()
+		from := s.Conn().RemotePeer()
+		logger := monitoring.GetLogger().WithField("peer", from.String())
+		r := bufio.NewReader(s)
+		w := bufio.NewWriter(s)
+
+		reject := func(err error) {
+			logger.WithError(err).Debug("Rejected chunk request")
+			writePushFrame(s, w, &pushFrame{Kind: pushError, Error: err.Error()})
+		}
+
+		req, err := readPushFrame(s, r)
+		if err != nil {
+			return
+		}
+		fetcher.metrics.RecordChunkRequest(false, false)
+		if req.Kind != pullChunks {
+			reject(errors.New("expected chunk request"))
+			return
+		}
+		if scorer.IsQuarantined(from) {
+			reject(errors.New("peer is quarantined"))
+			return
+		}
+		if req.RepoID != fetcher.repoID {
+			reject(fmt.Errorf("repository %q not served", req.RepoID))
+			return
+		}
+		if fetcher.Shedding() {
+			fetcher.metrics.ChunkRequestsShed.Add(1)
+			reject(ErrShedding)
+			return
+		}
+		for _, hash := range req.Hashes {
+			data, err := fetcher.store.Serve(hash)
+			if err != nil {
+				if sverrors.GetErrorCode(err) != sverrors.ErrCodeChunkNotFound {
+					logger.WithError(err).Warnf("Failed to read requested chunk %s", hash)
+				}
+				continue
+			}
+			if err := writeChunk(s, w, hash, data); err != nil {
+				fetcher.metrics.RecordChunkRequest(false, true)
+				return
+			}
+		}
+		writePushFrame(s, w, &pushFrame{Kind: pullDone})
+	})
+}
@@ -0,0 +1,126 @@
+package p2p
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// chunkFrameSize is the most chunk data carried by one data frame
+const chunkFrameSize = 64 << 10
+
+// ErrChunkCorrupt is returned when chunk data fails its frame checksum or
+// its hash while being received
+var ErrChunkCorrupt = errors.New("chunk corrupted in transit")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// framed reports whether s carries chunk data in data frames
+func framed(s network.Stream) bool {
+	p := s.Protocol()
+	return p != legacyPushProtocol && p != legacyPullProtocol
+}
+
+// writeChunk sends one stored chunk: a chunk frame announcing its hash, size
+// and sha256, then on framed streams its data split into frames of
+// length(4) | crc32c(4) | data, ended by an empty frame
+func writeChunk(s network.Stream, w *bufio.Writer, hash string, data []byte) error {
+	sum := sha256.Sum256(data)
+	f := &pushFrame{Kind: pushChunk, Hash: hash, Size: len(data), Sum: hex.EncodeToString(sum[:])}
+	if !framed(s) {
+		f.Data = data
+		return writePushFrame(s, w, f)
+	}
+	if err := writePushFrame(s, w, f); err != nil {
+		return err
+	}
+	var hdr [8]byte
+	for off := 0; ; {
+		end := off + chunkFrameSize
+		if end > len(data) {
+			end = len(data)
+		}
+		part := data[off:end]
+		off = end
+		binary.BigEndian.PutUint32(hdr[:4], uint32(len(part)))
+		binary.BigEndian.PutUint32(hdr[4:], crc32.Checksum(part, crcTable))
+		s.SetWriteDeadline(time.Now().Add(pushIdleTimeout))
+		if _, err := w.Write(hdr[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+		if len(part) == 0 {
+			return w.Flush()
+		}
+	}
+}
+
+// readChunk returns the data of the chunk announced by f. On framed streams
+// each data frame is checked as it arrives and hashed incrementally, so a
+// corrupt frame or data beyond the announced size or max aborts the
+// transfer without waiting for the rest of the chunk.
+func readChunk(s network.Stream, r *bufio.Reader, f *pushFrame, max int) ([]byte, error) {
+	if !framed(s) {
+		if len(f.Data) > max {
+			return nil, ErrChunkTooLarge
+		}
+		sum := sha256.Sum256(f.Data)
+		if hex.EncodeToString(sum[:]) != f.Sum {
+			return nil, corrupt(s, "chunk %s fails its hash", f.Hash)
+		}
+		return f.Data, nil
+	}
+	if f.Size < 0 || f.Size > max {
+		return nil, ErrChunkTooLarge
+	}
+
+	data := make([]byte, 0, f.Size)
+	h := sha256.New()
+	var hdr [8]byte
+	for {
+		s.SetReadDeadline(time.Now().Add(pushIdleTimeout))
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		n := int(binary.BigEndian.Uint32(hdr[:4]))
+		if n == 0 {
+			break
+		}
+		if n > chunkFrameSize || len(data)+n > f.Size {
+			return nil, corrupt(s, "chunk %s runs past its announced %d bytes", f.Hash, f.Size)
+		}
+		part := data[len(data) : len(data)+n]
+		if _, err := io.ReadFull(r, part); err != nil {
+			return nil, err
+		}
+		if crc32.Checksum(part, crcTable) != binary.BigEndian.Uint32(hdr[4:]) {
+			return nil, corrupt(s, "chunk %s fails the checksum of bytes %d-%d", f.Hash, len(data), len(data)+n)
+		}
+		h.Write(part)
+		data = data[:len(data)+n]
+	}
+	if len(data) != f.Size {
+		return nil, corrupt(s, "chunk %s ended after %d of %d bytes", f.Hash, len(data), f.Size)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != f.Sum {
+		return nil, corrupt(s, "chunk %s fails its hash", f.Hash)
+	}
+	return data, nil
+}
+
+// corrupt counts and returns an ErrChunkCorrupt received over s
+func corrupt(s network.Stream, format string, args ...interface{}) error {
+	monitoring.GetMetrics().TransferCorruptions.Add(1)
+	return fmt.Errorf("%w from %s: %s", ErrChunkCorrupt, s.Conn().RemotePeer(), fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,65 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/crypto"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+)
+
+func newTestHost(t *testing.T) host.Host {
+	t.Helper()
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestChunkFrames(t *testing.T) {
+	local, remote := newTestHost(t), newTestHost(t)
+	local.Peerstore().AddAddrs(remote.ID(), remote.Addrs(), peerstore.PermanentAddrTTL)
+
+	// Empty, shorter than a frame, one frame exactly and past several
+	var chunks [][]byte
+	for _, n := range []int{0, 34, chunkFrameSize, 2*chunkFrameSize + 5} {
+		chunks = append(chunks, bytes.Repeat([]byte{byte(n)}, n))
+	}
+	remote.SetStreamHandler(ChunkProtocol, func(s network.Stream) {
+		defer s.Close()
+		w := bufio.NewWriter(s)
+		for _, c := range chunks {
+			if err := writeChunk(s, w, hex.EncodeToString(crypto.Hash(c)), c); err != nil {
+				return
+			}
+		}
+	})
+
+	s, err := local.NewStream(context.Background(), remote.ID(), ChunkProtocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	r := bufio.NewReader(s)
+	for i, c := range chunks {
+		f, err := readPushFrame(s, r)
+		if err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		data, err := readChunk(s, r, f, 4*chunkFrameSize)
+		if err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		if !bytes.Equal(data, c) {
+			t.Fatalf("chunk %d: received %d bytes, want the %d sent", i, len(data), len(c))
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/crypto"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+)
+
+const (
+	fetchTestPut byte = 1
+	fetchTestGet byte = 2
+
+	fetchTestOK       byte = 0
+	fetchTestRejected byte = 1
+
+	// Test chunks live in memory only, never in the repository store
+	fetchTestMaxHeld = 16
+	fetchTestTTL     = time.Minute
+	fetchTestTimeout = 30 * time.Second
+)
+
+var (
+	ErrTestChunkRejected = errors.New("peer rejected test chunk")
+	ErrTestChunkMissing  = errors.New("peer did not return test chunk")
+	ErrTestChunkCorrupt  = errors.New("test chunk returned corrupted")
+)
+
+// PingResult summarizes a series of libp2p pings.
+type PingResult struct {
+	RTTs    []time.Duration
+	Average time.Duration
+}
+
+// Ping sends count libp2p pings to pid and returns their round-trip times.
+func Ping(ctx context.Context, h host.Host, pid peer.ID, count int) (*PingResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	res := &PingResult{}
+	results := ping.Ping(ctx, h, pid)
+	var total time.Duration
+	for len(res.RTTs) < count {
+		select {
+		case r := <-results:
+			if r.Error != nil {
+				return res, r.Error
+			}
+			res.RTTs = append(res.RTTs, r.RTT)
+			total += r.RTT
+		case <-ctx.Done():
+			return res, ctx.Err()
+		}
+	}
+	res.Average = total / time.Duration(len(res.RTTs))
+	return res, nil
+}
+
+// FetchTestResult reports a test chunk round trip with a peer.
+type FetchTestResult struct {
+	Size           int
+	UploadTime     time.Duration
+	DownloadTime   time.Duration
+	UploadBytesSec float64
+	FetchBytesSec  float64
+}
+
+// FetchTest stores a random chunk of size bytes on pid and fetches it back,
+// verifying its hash and measuring throughput in both directions.
+func FetchTest(ctx context.Context, h host.Host, pid peer.ID, size int) (*FetchTestResult, error) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return nil, err
+	}
+	hash := crypto.Hash(data)
+
+	res := &FetchTestResult{Size: size}
+
+	// Upload
+	start := time.Now()
+	if err := fetchTestRoundTrip(ctx, h, pid, func(w *bufio.Writer, r *bufio.Reader) error {
+		w.WriteByte(fetchTestPut)
+		binary.Write(w, binary.BigEndian, uint32(len(data)))
+		w.Write(data)
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		status, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if status != fetchTestOK {
+			return ErrTestChunkRejected
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("upload failed: %w", err)
+	}
+	res.UploadTime = time.Since(start)
+
+	// Fetch back over a fresh stream
+	var got []byte
+	start = time.Now()
+	if err := fetchTestRoundTrip(ctx, h, pid, func(w *bufio.Writer, r *bufio.Reader) error {
+		w.WriteByte(fetchTestGet)
+		w.Write(hash)
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrTestChunkMissing
+		}
+		if int(n) != size {
+			return ErrTestChunkCorrupt
+		}
+		got = make([]byte, n)
+		_, err := io.ReadFull(r, got)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("fetch failed: %w", err)
+	}
+	res.DownloadTime = time.Since(start)
+
+	if !bytes.Equal(crypto.Hash(got), hash) {
+		return nil, ErrTestChunkCorrupt
+	}
+
+	res.UploadBytesSec = float64(size) / res.UploadTime.Seconds()
+	res.FetchBytesSec = float64(size) / res.DownloadTime.Seconds()
+	return res, nil
+}
+
+func fetchTestRoundTrip(ctx context.Context, h host.Host, pid peer.ID, fn func(*bufio.Writer, *bufio.Reader) error) error {
+	s, err := h.NewStream(ctx, pid, FetchTestProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(fetchTestTimeout))
+	return fn(bufio.NewWriter(s), bufio.NewReader(s))
+}
+
+// fetchTestServer answers fetch-test streams from peers, holding test chunks
+// in a small in-memory cache so they never touch the repository.
+type fetchTestServer struct {
+	mu       sync.Mutex
+	held     map[string]heldChunk
+	maxChunk int
+}
+
+type heldChunk struct {
+	data    []byte
+	expires time.Time
+}
+
+// registerFetchTest installs the fetch-test stream handler on h
+func registerFetchTest(h host.Host, maxChunk int) {
+	srv := &fetchTestServer{
+		held:     make(map[string]heldChunk),
+		maxChunk: maxChunk,
+	}
+	h.SetStreamHandler(FetchTestProtocol, srv.handle)
+}
+
+func (srv *fetchTestServer) handle(s network.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(fetchTestTimeout))
+	logger := monitoring.GetLogger().WithField("peer", s.Conn().RemotePeer().String())
+
+	r := bufio.NewReader(s)
+	w := bufio.NewWriter(s)
+	defer w.Flush()
+
+	op, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+
+	switch op {
+	case fetchTestPut:
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return
+		}
+		if n == 0 || int(n) > srv.maxChunk {
+			w.WriteByte(fetchTestRejected)
+			return
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return
+		}
+		srv.put(hex.EncodeToString(crypto.Hash(data)), data)
+		w.WriteByte(fetchTestOK)
+		logger.Debugf("Holding %d byte fetch-test chunk", n)
+	case fetchTestGet:
+		hash := make([]byte, 32)
+		if _, err := io.ReadFull(r, hash); err != nil {
+			return
+		}
+		data := srv.take(hex.EncodeToString(hash))
+		binary.Write(w, binary.BigEndian, uint32(len(data)))
+		w.Write(data)
+	default:
+		s.Reset()
+	}
+}
+
+func (srv *fetchTestServer) put(key string, data []byte) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	now := time.Now()
+	for k, c := range srv.held {
+		if now.After(c.expires) {
+			delete(srv.held, k)
+		}
+	}
+	if len(srv.held) >= fetchTestMaxHeld {
+		return
+	}
+	srv.held[key] = heldChunk{data: data, expires: now.Add(fetchTestTTL)}
+}
+
+// take returns and forgets a held chunk
+func (srv *fetchTestServer) take(key string) []byte {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	c, ok := srv.held[key]
+	if !ok || time.Now().After(c.expires) {
+		return nil
+	}
+	delete(srv.held, key)
+	return c.data
+}
@@ -0,0 +1,32 @@
+package p2p
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Faults injects network failures, so tests can check how sync recovers
+// from them. The chaos package provides one.
+type Faults interface {
+	// DropMessage reports whether a pubsub message received on topic is dropped
+	DropMessage(topic string) bool
+	// DelayStream waits before a stream is opened
+	DelayStream(ctx context.Context) error
+}
+
+// faultyHost delays every stream it opens
+type faultyHost struct {
+	host.Host
+	faults Faults
+}
+
+func (h *faultyHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	if err := h.faults.DelayStream(ctx); err != nil {
+		return nil, err
+	}
+	return h.Host.NewStream(ctx, p, pids...)
+}
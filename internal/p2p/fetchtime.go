@@ -0,0 +1,129 @@
+package p2p
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// fetchTimeoutSlack multiplies the expected duration of a fetch, leaving
+	// room for gossip hops and a busy provider
+	fetchTimeoutSlack = 3
+	// linkWeight is the weight of the newest sample in link estimates
+	linkWeight = 0.3
+	// fetchRetryBase and fetchRetryMax bound the jittered pause between the
+	// requests of one chunk
+	fetchRetryBase = 250 * time.Millisecond
+	fetchRetryMax  = 5 * time.Second
+)
+
+// linkEstimate is what answered fetches have shown of the link to a peer
+type linkEstimate struct {
+	rate float64 // bytes per second
+}
+
+// fetchTimer derives the wait for a chunk from the RTT and measured
+// throughput of the peer asked and the size chunks are expected to have.
+// Requests to every peer, and to peers not yet measured, wait the base
+// timeout.
+type fetchTimer struct {
+	base, min, max time.Duration
+	rtt            func(peer.ID) time.Duration // 0 when unknown
+
+	mu    sync.Mutex
+	links map[peer.ID]*linkEstimate
+	size  float64 // expected chunk size in bytes
+}
+
+func newFetchTimer(base, min, max time.Duration, size int) *fetchTimer {
+	if min <= 0 || min > base {
+		min = base
+	}
+	if max < base {
+		max = base
+	}
+	return &fetchTimer{base: base, min: min, max: max, links: make(map[peer.ID]*linkEstimate), size: float64(size)}
+}
+
+// timeout returns how long to wait for a chunk requested from provider,
+// "" standing for every peer
+func (t *fetchTimer) timeout(provider string) time.Duration {
+	pid, err := peer.Decode(provider)
+	if err != nil {
+		return t.base
+	}
+	t.mu.Lock()
+	l, ok := t.links[pid]
+	size := t.size
+	t.mu.Unlock()
+	if !ok {
+		return t.base
+	}
+	var rtt time.Duration
+	if t.rtt != nil {
+		rtt = t.rtt(pid)
+	}
+	d := fetchTimeoutSlack * (rtt + time.Duration(size/l.rate*float64(time.Second)))
+	if d < t.min {
+		return t.min
+	}
+	if d > t.max {
+		return t.max
+	}
+	return d
+}
+
+// observe records a chunk of n bytes received elapsed after it was
+// requested from provider
+func (t *fetchTimer) observe(provider string, n int, elapsed time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.size += linkWeight * (float64(n) - t.size)
+
+	pid, err := peer.Decode(provider)
+	if err != nil {
+		return
+	}
+	// The RTT is spent once, whatever the size
+	if t.rtt != nil {
+		elapsed -= t.rtt(pid)
+	}
+	if elapsed < time.Millisecond {
+		elapsed = time.Millisecond
+	}
+	rate := float64(n) / elapsed.Seconds()
+	if l, ok := t.links[pid]; ok {
+		l.rate += linkWeight * (rate - l.rate)
+	} else {
+		t.links[pid] = &linkEstimate{rate: rate}
+	}
+}
+
+// timedOut halves the throughput estimated for provider after a request to
+// it went unanswered, so that a slowed link is given longer next time
+// rather than failing again
+func (t *fetchTimer) timedOut(provider string) {
+	pid, err := peer.Decode(provider)
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l, ok := t.links[pid]; ok {
+		l.rate /= 2
+	}
+}
+
+// retryDelay returns the pause before request attempt+1 of a chunk: an
+// exponential backoff with jitter, so that fetchers which failed together
+// do not ask again together
+func retryDelay(attempt int) time.Duration {
+	d := fetchRetryBase << attempt
+	if d > fetchRetryMax || d <= 0 {
+		d = fetchRetryMax
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
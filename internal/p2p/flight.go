@@ -0,0 +1,127 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrFetchStale is returned to waiters of a fetch that outlived its TTL
+// without being answered or timing out.
+var ErrFetchStale = errors.New("chunk fetch abandoned")
+
+// fetchFlight is one outstanding request for a chunk. Concurrent fetches of
+// the same hash wait on it instead of publishing requests of their own.
+type fetchFlight struct {
+	started time.Time
+	resp    chan []byte // the first matching response
+	done    chan struct{}
+	once    sync.Once
+	data    []byte
+	err     error
+}
+
+func (f *fetchFlight) finish(data []byte, err error) {
+	f.once.Do(func() {
+		f.data, f.err = data, err
+		close(f.done)
+	})
+}
+
+// wait returns the outcome of the flight, or ctx's error if it ends first
+func (f *fetchFlight) wait(ctx context.Context) ([]byte, error) {
+	select {
+	case <-f.done:
+		return f.data, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// joinFlight returns the flight for hash and whether the caller leads it,
+// i.e. must publish the request and finish the flight with endFlight.
+func (cf *ChunkFetcher) joinFlight(hash string) (*fetchFlight, bool) {
+	cf.flightMu.Lock()
+	defer cf.flightMu.Unlock()
+	if f, ok := cf.flights[hash]; ok {
+		cf.metrics.ChunkFetchesJoined.Add(1)
+		return f, false
+	}
+	if cf.flights == nil {
+		cf.flights = make(map[string]*fetchFlight)
+	}
+	f := &fetchFlight{started: time.Now(), resp: make(chan []byte, 1), done: make(chan struct{})}
+	cf.flights[hash] = f
+	n := cf.metrics.ChunkFetchesInFlight.Add(1)
+	for {
+		peak := cf.metrics.ChunkFetchesInFlightMax.Load()
+		if n <= peak || cf.metrics.ChunkFetchesInFlightMax.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	return f, true
+}
+
+// endFlight finishes f and forgets it, unless a newer flight replaced it
+func (cf *ChunkFetcher) endFlight(hash string, f *fetchFlight, data []byte, err error) {
+	f.finish(data, err)
+	cf.flightMu.Lock()
+	defer cf.flightMu.Unlock()
+	if cf.flights[hash] == f {
+		delete(cf.flights, hash)
+		cf.metrics.ChunkFetchesInFlight.Add(-1)
+	}
+}
+
+// InFlight returns how many chunk requests are outstanding.
+func (cf *ChunkFetcher) InFlight() int {
+	cf.flightMu.Lock()
+	defer cf.flightMu.Unlock()
+	return len(cf.flights)
+}
+
+// deliver hands a received chunk to the flight waiting for it, if any
+func (cf *ChunkFetcher) deliver(hash string, data []byte) {
+	cf.flightMu.Lock()
+	f, ok := cf.flights[hash]
+	cf.flightMu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case f.resp <- data:
+	default:
+	}
+}
+
+// reapFlights fails and forgets flights older than twice the longest fetch
+// timeout until ctx ends. Their leader should have finished them long before, so
+// whatever holds it up, its waiters are released.
+func (cf *ChunkFetcher) reapFlights(ctx context.Context) {
+	ticker := time.NewTicker(cf.timeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cutoff := time.Now().Add(-2 * cf.timer.max)
+		var stale []*fetchFlight
+		cf.flightMu.Lock()
+		for hash, f := range cf.flights {
+			if f.started.Before(cutoff) {
+				delete(cf.flights, hash)
+				stale = append(stale, f)
+			}
+		}
+		cf.flightMu.Unlock()
+		for _, f := range stale {
+			f.finish(nil, ErrFetchStale)
+			cf.metrics.ChunkFetchesInFlight.Add(-1)
+			cf.metrics.ChunkFetchesReaped.Add(1)
+		}
+	}
+}
@@ -3,41 +3,92 @@ package p2p
 import (
 	"context"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/hoangsonww/backupagent/config"
 	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/ratelimit"
 	"github.com/hoangsonww/backupagent/internal/storage"
 	libp2p "github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	peer "github.com/libp2p/go-libp2p/core/peer"
 	peerstore "github.com/libp2p/go-libp2p/core/peerstore"
 	discovery "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
 type P2PHost struct {
 	Host         host.Host
 	PubSub       *pubsub.PubSub
-	Topic        *pubsub.Topic
+	Topic        *pubsub.Topic // control: announcements and peer management
+	DataTopic    *pubsub.Topic // chunk requests and responses; Topic itself unless split
 	DHT          *dht.IpfsDHT
 	Ctx          context.Context
 	Cancel       context.CancelFunc
 	ChunkFetcher *ChunkFetcher
+	Missing      *MissingQueue
+	Locations    *ChunkLocations
+	Verifier     *ReceivedVerifier
+	Scorer       *PeerScorer
+	Pins         *PinKeeper
+
+	loops *sync.WaitGroup // background loops started by Setup
 }
 
-func Setup(cfg *config.Config, privKey crypto.PrivKey, store *storage.Store, signerPub, signerPriv []byte) (*P2PHost, error) {
-	ctx, cancel := context.WithCancel(context.Background())
+// Wait blocks until the background loops of the host return, after Cancel.
+func (p *P2PHost) Wait() {
+	p.loops.Wait()
+}
+
+func Setup(cfg *config.Config, privKey crypto.PrivKey, db *persistence.DB, store *storage.Store, signerPub, signerPriv []byte, faults Faults) (*P2PHost, error) {
 	logger := monitoring.GetLogger()
 
+	// Misbehaving peers are scored and quarantined; the scorer gates connections
+	scorer, err := NewPeerScorer(db, cfg.Security.QuarantineThreshold,
+		cfg.Security.ScoreHalfLife, cfg.Security.QuarantineDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	// Trim connections above max_peers; pinned peers are protected from pruning
+	low := cfg.P2P.MaxPeers * 3 / 4
+	if low < 1 {
+		low = 1
+	}
+	cm, err := connmgr.NewConnManager(low, cfg.P2P.MaxPeers, connmgr.WithGracePeriod(time.Minute))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	loops := new(sync.WaitGroup)
+	background := func(run func(context.Context)) {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			run(ctx)
+		}()
+	}
+
 	opts := []libp2p.Option{
 		libp2p.ListenAddrStrings(
 			"/ip4/0.0.0.0/tcp/" + fmt.Sprint(cfg.ListenPort),
 		),
 		libp2p.NATPortMap(),
+		libp2p.ConnectionGater(scorer),
+		libp2p.ConnectionManager(cm),
+	}
+
+	if privKey != nil {
+		opts = append(opts, libp2p.Identity(privKey))
 	}
 
 	if cfg.NATTraversal.EnableAutoRelay {
@@ -54,6 +105,24 @@ func Setup(cfg *config.Config, privKey crypto.PrivKey, store *storage.Store, sig
 
 	logger.Infof("P2P host started with ID: %s", h.ID().String())
 
+	// Fault-injection tests slow down every stream opened from here on
+	if faults != nil {
+		h = &faultyHost{Host: h, faults: faults}
+		logger.Warn("Injecting network faults")
+	}
+
+	// Keep pinned peers connected
+	pins, err := NewPinKeeper(h, db, scorer, cfg.P2P.ConnectionTimeout,
+		cfg.P2P.ReconnectBackoff, cfg.P2P.MaxReconnectBackoff, cfg.P2P.PinAlertAfter)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	background(pins.Run)
+
+	// Answer fetch-test diagnostics without touching the chunk store
+	registerFetchTest(h, MaxChunkWireSize(cfg.Snapshot.MaxChunkSize))
+
 	// DHT for peer discovery
 	kadDHT, err := dht.New(ctx, h)
 	if err != nil {
@@ -90,18 +159,58 @@ func Setup(cfg *config.Config, privKey crypto.PrivKey, store *storage.Store, sig
 	}
 
 	// Setup PubSub
-	ps, err := pubsub.NewFloodSub(ctx, h)
+	ps, err := pubsub.NewFloodSub(ctx, h,
+		pubsub.WithMaxMessageSize(int(cfg.Security.MaxRequestSize)),
+		pubsub.WithBlacklist(scorer),
+	)
 	if err != nil {
 		cancel()
 		return nil, err
 	}
-	topic, err := ps.Join("backup-sync")
+	scorer.onQuarantine = func(pid peer.ID) {
+		h.Network().ClosePeer(pid)
+	}
+
+	// Drop bad payloads before they reach handlers or are forwarded. Chunk
+	// traffic gets its own topic and quota so it cannot crowd out control
+	// messages, unless both topics are configured the same. The control
+	// topic still carries it from peers that predate the split.
+	split := cfg.P2P.DataTopic != cfg.P2P.ControlTopic
+	guard := &messageGuard{
+		self:       h.ID(),
+		maxMessage: int(cfg.Security.MaxRequestSize),
+		maxChunk:   MaxChunkWireSize(cfg.Snapshot.MaxChunkSize),
+		limiter: ratelimit.NewLimiter(cfg.Security.RequestsPerSecond, cfg.Security.BurstSize,
+			nil, cfg.Security.EnableRateLimiting),
+		scorer: scorer,
+		faults: faults,
+	}
+	if split {
+		legacy := &legacyData{peers: ps.ListPeers, control: cfg.P2P.ControlTopic, data: cfg.P2P.DataTopic, warned: make(map[peer.ID]bool)}
+		guard.accept = legacy.accept
+	}
+	topic, err := joinTopic(ps, cfg.P2P.ControlTopic, guard)
 	if err != nil {
 		cancel()
 		return nil, err
 	}
-
-	logger.Info("Joined pubsub topic: backup-sync")
+	dataTopic := topic
+	if split {
+		dataGuard := &messageGuard{
+			self:       h.ID(),
+			maxMessage: min(int(cfg.Security.MaxRequestSize), dataMessageSize(guard.maxChunk)),
+			maxChunk:   guard.maxChunk,
+			limiter: ratelimit.NewLimiter(cfg.Security.DataRequestsPerSecond, cfg.Security.DataBurstSize,
+				nil, cfg.Security.EnableRateLimiting),
+			scorer: scorer,
+			faults: faults,
+			accept: func(_ peer.ID, msgType string) bool { return dataMessages[msgType] },
+		}
+		if dataTopic, err = joinTopic(ps, cfg.P2P.DataTopic, dataGuard); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
 
 	// Rendezvous
 	routingDiscovery := discovery.NewRoutingDiscovery(kadDHT)
@@ -148,16 +257,67 @@ func Setup(cfg *config.Config, privKey crypto.PrivKey, store *storage.Store, sig
 		signerPub,
 		signerPriv,
 		cfg.P2P.MaxConcurrentFetch,
+		MaxChunkWireSize(cfg.Snapshot.MaxChunkSize),
 		cfg.P2P.ChunkFetchTimeout,
 	)
+	chunkFetcher.self = h.ID()
+	chunkFetcher.timer = newFetchTimer(cfg.P2P.ChunkFetchTimeout, cfg.P2P.ChunkFetchTimeoutMin, cfg.P2P.ChunkFetchTimeoutMax, cfg.Snapshot.AvgChunkSize)
+	chunkFetcher.timer.rtt = h.Peerstore().LatencyEWMA
+	chunkFetcher.attempts = cfg.P2P.FetchAttempts
+	chunkFetcher.SetChunkProtocol(h, cfg.P2P.ChunkPubsub != ChunkPubsubOff)
+	chunkFetcher.providers = func() []peer.ID {
+		peers := dataTopic.ListPeers()
+		sort.SliceStable(peers, func(i, j int) bool {
+			return scorer.Score(peers[i]) > scorer.Score(peers[j])
+		})
+		return peers
+	}
+
+	// Retry chunks no provider had, also whenever a peer connects
+	missing := NewMissingQueue(db, chunkFetcher, dataTopic, cfg.P2P.MissingRetryInterval)
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(network.Network, network.Conn) { missing.Kick() },
+	})
+	background(missing.Run)
+	background(chunkFetcher.reapFlights)
+
+	// Remember which peers hold which chunks, to ask them first next time
+	locations := NewChunkLocations(db)
+	chunkFetcher.locations = locations
+	background(locations.Run)
+
+	// Test-decrypt chunks of our repository received from peers
+	verifier := NewReceivedVerifier(db, chunkFetcher, dataTopic, cfg.P2P.VerifyReceived, cfg.P2P.VerifySampleRate)
+	background(verifier.Run)
 
 	return &P2PHost{
 		Host:         h,
 		PubSub:       ps,
 		Topic:        topic,
+		DataTopic:    dataTopic,
 		DHT:          kadDHT,
 		Ctx:          ctx,
 		Cancel:       cancel,
 		ChunkFetcher: chunkFetcher,
+		Missing:      missing,
+		Locations:    locations,
+		Verifier:     verifier,
+		Scorer:       scorer,
+		Pins:         pins,
+		loops:        loops,
 	}, nil
 }
+
+// joinTopic registers guard as the validator of a pubsub topic and joins it
+func joinTopic(ps *pubsub.PubSub, name string, guard *messageGuard) (*pubsub.Topic, error) {
+	guard.topic = name
+	if err := ps.RegisterTopicValidator(name, guard.validate); err != nil {
+		return nil, err
+	}
+	topic, err := ps.Join(name)
+	if err != nil {
+		return nil, err
+	}
+	monitoring.GetLogger().Infof("Joined pubsub topic: %s", name)
+	return topic, nil
+}
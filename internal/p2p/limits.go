@@ -0,0 +1,136 @@
+package p2p
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/ratelimit"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ChunkEnvelopeOverhead bounds what encryption (nonce, tag) and compression
+// framing may add to a chunk of MaxChunkSize.
+const ChunkEnvelopeOverhead = 1024
+
+// MaxChunkWireSize returns the largest stored chunk a peer may send us.
+func MaxChunkWireSize(maxChunkSize int) int {
+	return maxChunkSize + ChunkEnvelopeOverhead
+}
+
+// dataMessages are the message types carried by the data topic when it is
+// separate from the control topic.
+var dataMessages = map[string]bool{
+	"chunk_request":  true,
+	"chunk_response": true,
+}
+
+// legacyData lets chunk messages through on the control topic from a peer
+// that has not joined the data topic, as nodes from before the split have
+// not, so they can still fetch and serve chunks. Upgraded peers must use the
+// data topic. It logs each legacy peer once.
+type legacyData struct {
+	peers   func(topic string) []peer.ID // subscribers of topic, as pubsub knows them
+	control string
+	data    string
+
+	mu     sync.Mutex
+	warned map[peer.ID]bool
+}
+
+// accept reports whether from may send msgType on the control topic
+func (l *legacyData) accept(from peer.ID, msgType string) bool {
+	if !dataMessages[msgType] {
+		return true
+	}
+	if !subscribed(l.peers(l.control), from) || subscribed(l.peers(l.data), from) {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.warned[from] {
+		l.warned[from] = true
+		monitoring.GetLogger().WithFields(map[string]interface{}{
+			"peer":  from.String(),
+			"topic": l.control,
+		}).Warnf("Peer has not joined %s; accepting its chunk messages on %s, which is deprecated", l.data, l.control)
+	}
+	return true
+}
+
+func subscribed(peers []peer.ID, p peer.ID) bool {
+	for _, q := range peers {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
+
+// dataMessageSize bounds a message of the data topic: a chunk response
+// carrying a chunk of maxChunk bytes in base64, plus its envelope.
+func dataMessageSize(maxChunk int) int {
+	return base64.StdEncoding.EncodedLen(maxChunk) + ChunkEnvelopeOverhead
+}
+
+// messageGuard rejects oversize, malformed and over-quota pubsub messages
+// before they are handled or forwarded, penalizing the peer that sent them.
+type messageGuard struct {
+	topic      string
+	self       peer.ID
+	maxMessage int
+	maxChunk   int
+	limiter    *ratelimit.Limiter
+	scorer     *PeerScorer
+	accept     func(from peer.ID, msgType string) bool // message types from may send on the topic; nil allows all
+	faults     Faults                                  // nil outside fault-injection tests
+}
+
+// validate is registered as the topic validator for the sync topics
+func (g *messageGuard) validate(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	if from == g.self {
+		return pubsub.ValidationAccept
+	}
+
+	if g.faults != nil && g.faults.DropMessage(g.topic) {
+		return pubsub.ValidationIgnore
+	}
+
+	if len(msg.Data) > g.maxMessage {
+		g.drop(from, OffenseOversize)
+		return pubsub.ValidationReject
+	}
+
+	if !g.limiter.Allow(from.String()) {
+		g.drop(from, OffenseQuota)
+		return pubsub.ValidationIgnore
+	}
+
+	var peek struct {
+		Type     string `json:"type"`
+		Response *struct {
+			Data string `json:"data"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(msg.Data, &peek); err != nil || peek.Type == "" ||
+		(g.accept != nil && !g.accept(from, peek.Type)) {
+		g.drop(from, OffenseMalformed)
+		return pubsub.ValidationReject
+	}
+
+	if peek.Type == "chunk_response" && peek.Response != nil &&
+		base64.StdEncoding.DecodedLen(len(peek.Response.Data)) > g.maxChunk {
+		g.drop(from, OffenseOversize)
+		return pubsub.ValidationReject
+	}
+
+	return pubsub.ValidationAccept
+}
+
+func (g *messageGuard) drop(from peer.ID, off Offense) {
+	monitoring.GetMetrics().RecordMessageDropped()
+	g.scorer.Penalize(from, off)
+}
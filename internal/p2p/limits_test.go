@@ -0,0 +1,72 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/ratelimit"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestControlTopicMixedMesh(t *testing.T) {
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.EnableSealing(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	scorer, err := NewPeerScorer(db, 1000, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both peers are on the control topic; only the upgraded one also
+	// joined the data topic
+	legacyPeer, upgradedPeer := peer.ID("legacy"), peer.ID("upgraded")
+	subs := map[string][]peer.ID{
+		"backup-sync":      {legacyPeer, upgradedPeer},
+		"backup-sync-data": {upgradedPeer},
+	}
+	legacy := &legacyData{
+		peers:   func(topic string) []peer.ID { return subs[topic] },
+		control: "backup-sync",
+		data:    "backup-sync-data",
+		warned:  make(map[peer.ID]bool),
+	}
+	guard := &messageGuard{
+		topic:      "backup-sync",
+		self:       peer.ID("self"),
+		maxMessage: 1 << 20,
+		maxChunk:   1 << 16,
+		limiter:    ratelimit.NewLimiter(100, 100, nil, false),
+		scorer:     scorer,
+		accept:     legacy.accept,
+	}
+	message := func(data string) *pubsub.Message {
+		return &pubsub.Message{Message: &pb.Message{Data: []byte(data)}}
+	}
+	request := `{"type":"chunk_request","request":{"hash":"abc"}}`
+
+	if got := guard.validate(context.Background(), upgradedPeer, message(request)); got != pubsub.ValidationReject {
+		t.Errorf("upgraded peer's chunk request on the control topic: %v, want reject", got)
+	}
+	if got := guard.validate(context.Background(), legacyPeer, message(request)); got != pubsub.ValidationAccept {
+		t.Errorf("legacy peer's chunk request on the control topic: %v, want accept", got)
+	}
+	if got := guard.validate(context.Background(), upgradedPeer, message(`{"type":"snapshot_header"}`)); got != pubsub.ValidationAccept {
+		t.Errorf("upgraded peer's control message: %v, want accept", got)
+	}
+
+	// A peer we have no subscription for is not taken for a legacy one
+	if legacy.accept(peer.ID("stranger"), "chunk_response") {
+		t.Error("accepted a chunk response from a peer not on the control topic")
+	}
+}
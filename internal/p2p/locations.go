@@ -0,0 +1,278 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// locationPeers bounds the peers remembered per chunk; the least
+	// recently seen go first
+	locationPeers = 8
+	// locationMaxAge is how long a peer stays a hint for a chunk after it
+	// last served or confirmed it
+	locationMaxAge = 30 * 24 * time.Hour
+	// locationFlushInterval and locationFlushSize bound how long and how
+	// many sightings are held in memory before they are written
+	locationFlushInterval = 30 * time.Second
+	locationFlushSize     = 4096
+	// locationPruneInterval is how often expired hints are dropped
+	locationPruneInterval = 24 * time.Hour
+)
+
+// ChunkLocations remembers which peers recently served a chunk or confirmed
+// holding it, so a fetch asks them before the other peers instead of
+// working through them best scored first. Sightings are buffered and
+// written in batches; hints are advisory, so losing the last few on a crash
+// only costs a slower fetch.
+type ChunkLocations struct {
+	db      *persistence.DB
+	mu      sync.Mutex
+	pending map[string]map[string]time.Time // chunk hash -> peer ID -> seen
+	size    int
+}
+
+// NewChunkLocations returns the location hints kept in db.
+func NewChunkLocations(db *persistence.DB) *ChunkLocations {
+	return &ChunkLocations{
+		db:      db,
+		pending: make(map[string]map[string]time.Time),
+	}
+}
+
+// Record notes that pid served or holds each of hashes.
+func (l *ChunkLocations) Record(pid peer.ID, hashes ...string) {
+	if pid == "" || len(hashes) == 0 {
+		return
+	}
+	now := time.Now().UTC()
+	l.mu.Lock()
+	for _, hash := range hashes {
+		seen := l.pending[hash]
+		if seen == nil {
+			seen = make(map[string]time.Time)
+			l.pending[hash] = seen
+		}
+		if _, ok := seen[pid.String()]; !ok {
+			l.size++
+		}
+		seen[pid.String()] = now
+	}
+	full := l.size >= locationFlushSize
+	l.mu.Unlock()
+	if full {
+		l.flushLogged()
+	}
+}
+
+// Forget drops pid as a hint for hash, after it failed to return it.
+func (l *ChunkLocations) Forget(pid peer.ID, hash string) {
+	l.mu.Lock()
+	if seen := l.pending[hash]; seen != nil {
+		if _, ok := seen[pid.String()]; ok {
+			delete(seen, pid.String())
+			l.size--
+		}
+	}
+	l.mu.Unlock()
+	err := l.update(hash, func(seen map[string]time.Time) {
+		delete(seen, pid.String())
+	})
+	if err != nil {
+		monitoring.GetLogger().WithError(err).Warn("Failed to drop chunk location hint")
+	}
+}
+
+// Lookup returns the peers hinted for hash, most recently seen first.
+func (l *ChunkLocations) Lookup(hash string) []peer.ID {
+	seen := make(map[string]time.Time)
+	err := l.db.View(func(tx *bolt.Tx) error {
+		b, err := l.db.Sealed(tx, persistence.BucketLocations)
+		if err != nil {
+			return err
+		}
+		v, err := b.Get([]byte(hash))
+		if err != nil || v == nil {
+			return err
+		}
+		return json.Unmarshal(v, &seen)
+	})
+	if err != nil {
+		monitoring.GetLogger().WithError(err).Debug("Failed to read chunk location hints")
+	}
+	l.mu.Lock()
+	for id, at := range l.pending[hash] {
+		if at.After(seen[id]) {
+			seen[id] = at
+		}
+	}
+	l.mu.Unlock()
+
+	type hint struct {
+		pid peer.ID
+		at  time.Time
+	}
+	var hints []hint
+	for id, at := range seen {
+		pid, err := peer.Decode(id)
+		if err != nil || time.Since(at) > locationMaxAge {
+			continue
+		}
+		hints = append(hints, hint{pid, at})
+	}
+	sort.Slice(hints, func(i, j int) bool { return hints[i].at.After(hints[j].at) })
+	out := make([]peer.ID, len(hints))
+	for i, h := range hints {
+		out[i] = h.pid
+	}
+	return out
+}
+
+// Flush writes the buffered sightings.
+func (l *ChunkLocations) Flush() error {
+	l.mu.Lock()
+	pending := l.pending
+	l.pending = make(map[string]map[string]time.Time)
+	l.size = 0
+	l.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	return l.db.Update(func(tx *bolt.Tx) error {
+		b, err := l.db.Sealed(tx, persistence.BucketLocations)
+		if err != nil {
+			return err
+		}
+		for hash, recent := range pending {
+			if err := updateLocation(b, hash, func(seen map[string]time.Time) {
+				for id, at := range recent {
+					seen[id] = at
+				}
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (l *ChunkLocations) flushLogged() {
+	if err := l.Flush(); err != nil {
+		monitoring.GetLogger().WithError(err).Warn("Failed to save chunk location hints")
+	}
+}
+
+// Prune drops hints older than locationMaxAge and returns how many chunks
+// were left without any.
+func (l *ChunkLocations) Prune() (int, error) {
+	dropped := 0
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		b, err := l.db.Sealed(tx, persistence.BucketLocations)
+		if err != nil {
+			return err
+		}
+		var stale []string
+		err = b.ForEach(func(k, v []byte) error {
+			var seen map[string]time.Time
+			if json.Unmarshal(v, &seen) != nil {
+				stale = append(stale, string(k))
+				return nil
+			}
+			for _, at := range seen {
+				if time.Since(at) <= locationMaxAge {
+					return nil
+				}
+			}
+			stale = append(stale, string(k))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, hash := range stale {
+			if err := b.Delete([]byte(hash)); err != nil {
+				return err
+			}
+		}
+		dropped = len(stale)
+		return nil
+	})
+	return dropped, err
+}
+
+// Run writes buffered sightings every locationFlushInterval and prunes
+// expired hints daily until ctx ends. Sightings still buffered then are
+// written by Flush.
+func (l *ChunkLocations) Run(ctx context.Context) {
+	flush := time.NewTicker(locationFlushInterval)
+	defer flush.Stop()
+	prune := time.NewTicker(locationPruneInterval)
+	defer prune.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flush.C:
+			l.flushLogged()
+		case <-prune.C:
+			if n, err := l.Prune(); err != nil {
+				monitoring.GetLogger().WithError(err).Warn("Failed to prune chunk location hints")
+			} else if n > 0 {
+				monitoring.GetLogger().Debugf("Dropped expired location hints of %d chunks", n)
+			}
+		}
+	}
+}
+
+// update applies fn to the stored hints of hash
+func (l *ChunkLocations) update(hash string, fn func(map[string]time.Time)) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		b, err := l.db.Sealed(tx, persistence.BucketLocations)
+		if err != nil {
+			return err
+		}
+		return updateLocation(b, hash, fn)
+	})
+}
+
+// updateLocation applies fn to the hints of hash in b, keeping the
+// locationPeers most recent and deleting the record once none are left
+func updateLocation(b *persistence.SealedBucket, hash string, fn func(map[string]time.Time)) error {
+	seen := make(map[string]time.Time)
+	v, err := b.Get([]byte(hash))
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		json.Unmarshal(v, &seen)
+	}
+	fn(seen)
+	for len(seen) > locationPeers {
+		oldest := ""
+		for id, at := range seen {
+			if oldest == "" || at.Before(seen[oldest]) {
+				oldest = id
+			}
+		}
+		delete(seen, oldest)
+	}
+	if len(seen) == 0 {
+		if v == nil {
+			return nil
+		}
+		return b.Delete([]byte(hash))
+	}
+	val, err := json.Marshal(seen)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(hash), val)
+}
@@ -0,0 +1,82 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/protocol"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// FetchManifest asks pid for the manifest hdr announced and checks it
+// against the header.
+func FetchManifest(ctx context.Context, h host.Host, pid peer.ID, hdr *protocol.SnapshotHeader) (*versioning.Snapshot, error) {
+	s, err := h.NewStream(ctx, pid, ManifestProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	r := bufio.NewReader(s)
+	w := bufio.NewWriter(s)
+
+	if err := writePushFrame(s, w, &pushFrame{Kind: pullWant, SnapshotID: hdr.ID, RepoID: hdr.RepoID}); err != nil {
+		return nil, err
+	}
+	f, err := readPushFrame(s, r)
+	if err != nil {
+		return nil, err
+	}
+	if f.Kind == pushError {
+		return nil, fmt.Errorf("%w: %s", ErrPushRejected, f.Error)
+	}
+	if f.Kind != pullSnapshot || f.Snapshot == nil {
+		return nil, fmt.Errorf("unexpected %q frame", f.Kind)
+	}
+	if err := hdr.Matches(f.Snapshot); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	return f.Snapshot, nil
+}
+
+// ServeManifests installs the manifest stream handler. Manifests used to be
+// broadcast whole to every peer on the topic, so any peer that is not
+// quarantined may fetch those of repositories we hold or import.
+func ServeManifests(h host.Host, db *persistence.DB, fetcher *ChunkFetcher, scorer *PeerScorer) {
+	h.SetStreamHandler(ManifestProtocol, func(s network.Stream) {
+		defer s.Close()
+		from := s.Conn().RemotePeer()
+		r := bufio.NewReader(s)
+		w := bufio.NewWriter(s)
+
+		reject := func(err error) {
+			monitoring.GetLogger().WithField("peer", from.String()).WithError(err).Debug("Rejected manifest request")
+			writePushFrame(s, w, &pushFrame{Kind: pushError, Error: err.Error()})
+		}
+
+		want, err := readPushFrame(s, r)
+		if err != nil {
+			return
+		}
+		if want.Kind != pullWant {
+			reject(errors.New("expected manifest request"))
+			return
+		}
+		if scorer.IsQuarantined(from) {
+			reject(errors.New("peer is quarantined"))
+			return
+		}
+		snap, err := versioning.LoadSnapshot(db, want.SnapshotID)
+		if err != nil || snap.RepoID != want.RepoID || !fetcher.acceptsRepository(snap.RepoID) {
+			reject(fmt.Errorf("snapshot %s of repository %q not held", want.SnapshotID, want.RepoID))
+			return
+		}
+		writePushFrame(s, w, &pushFrame{Kind: pullSnapshot, Snapshot: snap.Public()})
+	})
+}
@@ -0,0 +1,224 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// missingSettle gives a new connection time to join the topic before
+	// its chunks are asked for
+	missingSettle = 5 * time.Second
+	// missingMinGap limits how often new connections trigger a retry pass
+	missingMinGap = time.Minute
+	// missingMaxAge is how long a chunk is retried before it is given up
+	missingMaxAge = 30 * 24 * time.Hour
+)
+
+// MissingChunk is a chunk of an announced snapshot no provider returned.
+type MissingChunk struct {
+	Hash        string    `json:"hash"`
+	RepoID      string    `json:"repo_id,omitempty"`
+	Snapshots   []string  `json:"snapshots"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastAttempt time.Time `json:"last_attempt"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// MissingQueue persists chunks that could not be fetched and retries them
+// on a timer and whenever a peer connects, which may be the one holding
+// them.
+type MissingQueue struct {
+	db       *persistence.DB
+	fetcher  *ChunkFetcher
+	topic    *pubsub.Topic
+	interval time.Duration
+	kick     chan struct{}
+	metrics  *monitoring.Metrics
+}
+
+// NewMissingQueue returns the queue of fetcher, retrying every interval.
+func NewMissingQueue(db *persistence.DB, fetcher *ChunkFetcher, topic *pubsub.Topic, interval time.Duration) *MissingQueue {
+	q := &MissingQueue{
+		db:       db,
+		fetcher:  fetcher,
+		topic:    topic,
+		interval: interval,
+		kick:     make(chan struct{}, 1),
+		metrics:  monitoring.GetMetrics(),
+	}
+	fetcher.missing = q
+	if chunks, err := q.List(); err == nil {
+		q.metrics.ChunksUnfetchable.Store(int64(len(chunks)))
+	}
+	return q
+}
+
+// Add queues hash of snapshot snapID after a failed fetch.
+func (q *MissingQueue) Add(hash, repoID, snapID string, fetchErr error) error {
+	now := time.Now().UTC()
+	added := false
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(persistence.BucketMissing))
+		mc := &MissingChunk{Hash: hash, RepoID: repoID, FirstSeen: now}
+		if v := b.Get([]byte(hash)); v != nil {
+			if err := json.Unmarshal(v, mc); err != nil {
+				return err
+			}
+		} else {
+			added = true
+		}
+		if !containsString(mc.Snapshots, snapID) {
+			mc.Snapshots = append(mc.Snapshots, snapID)
+		}
+		mc.LastAttempt = now
+		mc.Attempts++
+		mc.LastError = fetchErr.Error()
+		return putMissing(b, mc)
+	})
+	if err == nil && added {
+		q.metrics.ChunksUnfetchable.Add(1)
+	}
+	return err
+}
+
+// List returns every queued chunk.
+func (q *MissingQueue) List() ([]*MissingChunk, error) {
+	var chunks []*MissingChunk
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistence.BucketMissing)).ForEach(func(k, v []byte) error {
+			var mc MissingChunk
+			if err := json.Unmarshal(v, &mc); err != nil {
+				return err
+			}
+			chunks = append(chunks, &mc)
+			return nil
+		})
+	})
+	return chunks, err
+}
+
+// Kick asks for a retry pass soon, as when a peer connects.
+func (q *MissingQueue) Kick() {
+	select {
+	case q.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run retries the queue every interval and after kicks until ctx ends.
+func (q *MissingQueue) Run(ctx context.Context) {
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+
+	var last time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.kick:
+			if time.Since(last) < missingMinGap {
+				continue
+			}
+			select {
+			case <-time.After(missingSettle):
+			case <-ctx.Done():
+				return
+			}
+		}
+		last = time.Now()
+		if err := q.Retry(ctx); err != nil && ctx.Err() == nil {
+			monitoring.GetLogger().WithError(err).Warn("Missing chunk retry failed")
+		}
+	}
+}
+
+// Retry asks providers once more for every queued chunk, dropping those
+// that arrived meanwhile or have been missing for longer than missingMaxAge.
+func (q *MissingQueue) Retry(ctx context.Context) error {
+	chunks, err := q.List()
+	if err != nil || len(chunks) == 0 {
+		return err
+	}
+	logger := monitoring.GetLogger()
+	logger.Infof("Retrying %d missing chunk(s)", len(chunks))
+
+	sem := make(chan struct{}, q.fetcher.maxConcurrent)
+	done := make(chan *MissingChunk, len(chunks))
+	for _, mc := range chunks {
+		if q.fetcher.store.Exists(mc.Hash) {
+			done <- mc
+			continue
+		}
+		if time.Since(mc.FirstSeen) > missingMaxAge {
+			logger.WithField("chunk_hash", mc.Hash).Warnf("Giving up on chunk missing since %s", mc.FirstSeen.Format(time.RFC3339))
+			done <- mc
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		go func(mc *MissingChunk) {
+			defer func() { <-sem }()
+			_, err := q.fetcher.FetchChunkFailover(ctx, mc.Hash, mc.RepoID, q.topic, "")
+			if err == nil {
+				q.metrics.ChunksRecovered.Add(1)
+				done <- mc
+				return
+			}
+			if ctx.Err() == nil {
+				// Counts the attempt; the snapshot is already listed
+				q.Add(mc.Hash, mc.RepoID, mc.Snapshots[0], err)
+			}
+		}(mc)
+	}
+	for i := 0; i < cap(sem); i++ {
+		sem <- struct{}{}
+	}
+	close(done)
+
+	removed := 0
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(persistence.BucketMissing))
+		for mc := range done {
+			if err := b.Delete([]byte(mc.Hash)); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	q.metrics.ChunksUnfetchable.Add(-int64(removed))
+	logger.Infof("Recovered or dropped %d of %d missing chunk(s)", removed, len(chunks))
+	return nil
+}
+
+func putMissing(b *bolt.Bucket, mc *MissingChunk) error {
+	data, err := json.Marshal(mc)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(mc.Hash), data)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package p2p
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/protocol"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	bolt "go.etcd.io/bbolt"
+)
+
+// SaveOffer stores the storage offer of a peer unless a newer one is already
+// held. It returns whether the offer was stored.
+func SaveOffer(db *persistence.DB, offer *protocol.StorageOffer) (bool, error) {
+	saved := false
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := db.Sealed(tx, persistence.BucketOffers)
+		if err != nil {
+			return err
+		}
+		if v, err := b.Get([]byte(offer.PeerID)); err != nil {
+			return err
+		} else if v != nil {
+			var cur protocol.StorageOffer
+			if json.Unmarshal(v, &cur) == nil && !offerTime(&cur).Before(offerTime(offer)) {
+				return nil
+			}
+		}
+		val, err := json.Marshal(offer)
+		if err != nil {
+			return err
+		}
+		saved = true
+		return b.Put([]byte(offer.PeerID), val)
+	})
+	return saved, err
+}
+
+// LoadOffers returns the latest storage offer of every peer heard from.
+func LoadOffers(db *persistence.DB) ([]*protocol.StorageOffer, error) {
+	var out []*protocol.StorageOffer
+	err := db.View(func(tx *bolt.Tx) error {
+		b, err := db.Sealed(tx, persistence.BucketOffers)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var o protocol.StorageOffer
+			if err := json.Unmarshal(v, &o); err != nil {
+				return nil
+			}
+			out = append(out, &o)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// PlaceOnOffers picks up to n peers to host need more bytes: those whose
+// offer was issued within maxAge and has that much free, most free space
+// first. eligible, if set, filters out peers that cannot be used right now.
+func PlaceOnOffers(offers []*protocol.StorageOffer, need int64, n int, maxAge time.Duration, eligible func(peer.ID) bool) []peer.ID {
+	var fit []*protocol.StorageOffer
+	for _, o := range offers {
+		if time.Since(offerTime(o)) > maxAge || o.Free() < need {
+			continue
+		}
+		pid, err := peer.Decode(o.PeerID)
+		if err != nil || (eligible != nil && !eligible(pid)) {
+			continue
+		}
+		fit = append(fit, o)
+	}
+	sort.Slice(fit, func(i, j int) bool { return fit[i].Free() > fit[j].Free() })
+
+	var out []peer.ID
+	for _, o := range fit {
+		if len(out) == n {
+			break
+		}
+		pid, _ := peer.Decode(o.PeerID)
+		out = append(out, pid)
+	}
+	return out
+}
+
+// offerTime returns when an offer was issued; validated offers always parse
+func offerTime(o *protocol.StorageOffer) time.Time {
+	t, _ := time.Parse(time.RFC3339, o.IssuedAt)
+	return t
+}
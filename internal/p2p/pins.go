@@ -0,0 +1,403 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	peerstore "github.com/libp2p/go-libp2p/core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+	bolt "go.etcd.io/bbolt"
+)
+
+// pinTag protects pinned peers from connection manager pruning
+const pinTag = "pinned"
+
+const (
+	// pinCheckInterval is how often the keeper looks for pins to redial
+	pinCheckInterval = 5 * time.Second
+	// pinMaxBackoff caps redial backoff for pins below the general reconnect cap
+	pinMaxBackoff = time.Minute
+)
+
+var ErrNotPinned = errors.New("peer is not pinned")
+
+// Pin is a peer this node keeps connected at all times.
+type Pin struct {
+	PeerID   string    `json:"peer_id"`
+	Addrs    []string  `json:"addrs"`
+	PinnedAt time.Time `json:"pinned_at"`
+}
+
+// PinStatus is the live connection state of a pinned peer.
+type PinStatus struct {
+	PeerID    string    `json:"peer_id"`
+	Connected bool      `json:"connected"`
+	LastSeen  time.Time `json:"last_seen,omitempty"`
+	DownSince time.Time `json:"down_since,omitempty"`
+	Attempts  int       `json:"attempts"`
+	Alerting  bool      `json:"alerting"`
+}
+
+type pinState struct {
+	info      peer.AddrInfo
+	connected bool
+	dialing   bool
+	lastSeen  time.Time
+	downSince time.Time
+	nextTry   time.Time
+	backoff   time.Duration
+	attempts  int
+	alerted   bool
+}
+
+// PinKeeper keeps pinned peers connected: it protects them from pruning,
+// redials with capped exponential backoff as soon as they drop, and alerts
+// when one stays unreachable for longer than alertAfter.
+type PinKeeper struct {
+	mu         sync.Mutex
+	h          host.Host
+	db         *persistence.DB
+	scorer     *PeerScorer
+	pins       map[peer.ID]*pinState
+	timeout    time.Duration
+	base       time.Duration
+	max        time.Duration
+	alertAfter time.Duration
+	wake       chan struct{}
+	metrics    *monitoring.Metrics
+}
+
+// NewPinKeeper restores stored pins and starts watching their connections.
+// Redials back off from base up to max, never beyond pinMaxBackoff.
+func NewPinKeeper(h host.Host, db *persistence.DB, scorer *PeerScorer, timeout, base, max, alertAfter time.Duration) (*PinKeeper, error) {
+	if max > pinMaxBackoff {
+		max = pinMaxBackoff
+	}
+	k := &PinKeeper{
+		h:          h,
+		db:         db,
+		scorer:     scorer,
+		pins:       make(map[peer.ID]*pinState),
+		timeout:    timeout,
+		base:       base,
+		max:        max,
+		alertAfter: alertAfter,
+		wake:       make(chan struct{}, 1),
+		metrics:    monitoring.GetMetrics(),
+	}
+
+	stored, err := LoadPins(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range stored {
+		info, err := p.AddrInfo()
+		if err != nil {
+			monitoring.GetLogger().WithError(err).Warnf("Skipping invalid pin: %s", p.PeerID)
+			continue
+		}
+		k.track(*info)
+	}
+
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF:    func(_ network.Network, c network.Conn) { k.onConnected(c.RemotePeer()) },
+		DisconnectedF: func(n network.Network, c network.Conn) { k.onDisconnected(n, c.RemotePeer()) },
+	})
+	return k, nil
+}
+
+// Pin stores info as pinned and starts maintaining its connection.
+func (k *PinKeeper) Pin(info peer.AddrInfo) error {
+	p := &Pin{PeerID: info.ID.String(), PinnedAt: time.Now().UTC()}
+	for _, a := range info.Addrs {
+		p.Addrs = append(p.Addrs, a.String())
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	err = k.db.Update(func(tx *bolt.Tx) error {
+		b, err := k.db.Sealed(tx, persistence.BucketPins)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(p.PeerID), data)
+	})
+	if err != nil {
+		return err
+	}
+	k.track(info)
+	k.kick()
+	return nil
+}
+
+// Keep maintains info's connection like a pin without storing it, for peers
+// pinned by configuration such as mirrors.
+func (k *PinKeeper) Keep(info peer.AddrInfo) {
+	k.track(info)
+	k.kick()
+}
+
+// Unpin forgets a pinned peer without disconnecting it.
+func (k *PinKeeper) Unpin(pid peer.ID) error {
+	err := k.db.Update(func(tx *bolt.Tx) error {
+		b, err := k.db.Sealed(tx, persistence.BucketPins)
+		if err != nil {
+			return err
+		}
+		v, err := b.Get([]byte(pid.String()))
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return ErrNotPinned
+		}
+		return b.Delete([]byte(pid.String()))
+	})
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	if st, ok := k.pins[pid]; ok && st.alerted {
+		k.metrics.PinsUnreachable.Add(-1)
+	}
+	delete(k.pins, pid)
+	k.mu.Unlock()
+
+	k.h.ConnManager().Unprotect(pid, pinTag)
+	return nil
+}
+
+// IsPinned reports whether pid is pinned.
+func (k *PinKeeper) IsPinned(pid peer.ID) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	_, ok := k.pins[pid]
+	return ok
+}
+
+// Status returns the connection state of every pin.
+func (k *PinKeeper) Status() []PinStatus {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	out := make([]PinStatus, 0, len(k.pins))
+	for pid, st := range k.pins {
+		out = append(out, PinStatus{
+			PeerID:    pid.String(),
+			Connected: st.connected,
+			LastSeen:  st.lastSeen,
+			DownSince: st.downSince,
+			Attempts:  st.attempts,
+			Alerting:  st.alerted,
+		})
+	}
+	return out
+}
+
+// Run redials disconnected pins until ctx is done.
+func (k *PinKeeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(pinCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		k.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-k.wake:
+		}
+	}
+}
+
+func (k *PinKeeper) track(info peer.AddrInfo) {
+	k.h.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
+	k.h.ConnManager().Protect(info.ID, pinTag)
+
+	now := time.Now()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if st, ok := k.pins[info.ID]; ok {
+		st.info = info
+		return
+	}
+	st := &pinState{info: info, backoff: k.base, downSince: now}
+	if k.h.Network().Connectedness(info.ID) == network.Connected {
+		st.connected = true
+		st.lastSeen = now
+		st.downSince = time.Time{}
+	}
+	k.pins[info.ID] = st
+}
+
+func (k *PinKeeper) kick() {
+	select {
+	case k.wake <- struct{}{}:
+	default:
+	}
+}
+
+// check dials every due pin and raises alerts for long outages
+func (k *PinKeeper) check(ctx context.Context) {
+	logger := monitoring.GetLogger()
+	now := time.Now()
+
+	k.mu.Lock()
+	var due []*pinState
+	for pid, st := range k.pins {
+		if st.connected || st.dialing {
+			continue
+		}
+		if !st.alerted && k.alertAfter > 0 && now.Sub(st.downSince) >= k.alertAfter {
+			st.alerted = true
+			k.metrics.PinsUnreachable.Add(1)
+			logger.WithFields(map[string]interface{}{
+				"peer":       pid.String(),
+				"down_since": st.downSince.Format(time.RFC3339),
+				"attempts":   st.attempts,
+			}).Error("Pinned peer unreachable")
+		}
+		if now.Before(st.nextTry) || k.scorer.IsQuarantined(pid) {
+			continue
+		}
+		st.dialing = true
+		st.attempts++
+		due = append(due, st)
+	}
+	k.updateHealthLocked()
+	k.mu.Unlock()
+
+	for _, st := range due {
+		go k.dial(ctx, st)
+	}
+}
+
+func (k *PinKeeper) dial(ctx context.Context, st *pinState) {
+	dialCtx, cancel := context.WithTimeout(ctx, k.timeout)
+	err := k.h.Connect(dialCtx, st.info)
+	cancel()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	st.dialing = false
+	if err == nil {
+		// onConnected records the recovery
+		return
+	}
+	monitoring.GetLogger().WithError(err).Debugf("Redial of pinned peer %s failed", st.info.ID)
+	st.nextTry = time.Now().Add(st.backoff)
+	st.backoff *= 2
+	if st.backoff > k.max {
+		st.backoff = k.max
+	}
+}
+
+func (k *PinKeeper) onConnected(pid peer.ID) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	st, ok := k.pins[pid]
+	if !ok || st.connected {
+		return
+	}
+	if st.alerted {
+		k.metrics.PinsUnreachable.Add(-1)
+		monitoring.GetLogger().WithField("peer", pid.String()).Info("Pinned peer reachable again")
+	}
+	st.connected = true
+	st.lastSeen = time.Now()
+	st.downSince = time.Time{}
+	st.backoff = k.base
+	st.nextTry = time.Time{}
+	st.attempts = 0
+	st.alerted = false
+	k.updateHealthLocked()
+}
+
+func (k *PinKeeper) onDisconnected(n network.Network, pid peer.ID) {
+	// Other connections to the peer may still be open
+	if n.Connectedness(pid) == network.Connected {
+		return
+	}
+	k.mu.Lock()
+	st, ok := k.pins[pid]
+	if ok && st.connected {
+		now := time.Now()
+		st.connected = false
+		st.lastSeen = now
+		st.downSince = now
+		st.nextTry = now
+		monitoring.GetLogger().WithField("peer", pid.String()).Warn("Pinned peer disconnected, redialing")
+	}
+	k.mu.Unlock()
+	if ok {
+		k.kick()
+	}
+}
+
+// updateHealthLocked reflects alerting pins in the health endpoint
+func (k *PinKeeper) updateHealthLocked() {
+	var down []string
+	for pid, st := range k.pins {
+		if st.alerted {
+			down = append(down, pid.String())
+		}
+	}
+	status, msg := monitoring.StatusHealthy, ""
+	if len(down) > 0 {
+		status = monitoring.StatusDegraded
+		msg = fmt.Sprintf("%d pinned peer(s) unreachable for over %s", len(down), k.alertAfter)
+	}
+	monitoring.GetHealthChecker().UpdateComponent("pinned_peers", status, msg, map[string]interface{}{
+		"pinned":      len(k.pins),
+		"unreachable": down,
+	})
+}
+
+// AddrInfo parses the stored pin addresses.
+func (p *Pin) AddrInfo() (*peer.AddrInfo, error) {
+	pid, err := peer.Decode(p.PeerID)
+	if err != nil {
+		return nil, err
+	}
+	info := &peer.AddrInfo{ID: pid}
+	for _, s := range p.Addrs {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return nil, err
+		}
+		info.Addrs = append(info.Addrs, addr)
+	}
+	return info, nil
+}
+
+// LoadPins returns every stored pin.
+func LoadPins(db *persistence.DB) ([]*Pin, error) {
+	var out []*Pin
+	err := db.View(func(tx *bolt.Tx) error {
+		b, err := db.Sealed(tx, persistence.BucketPins)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var p Pin
+			if err := json.Unmarshal(v, &p); err != nil {
+				return nil
+			}
+			out = append(out, &p)
+			return nil
+		})
+	})
+	return out, err
+}
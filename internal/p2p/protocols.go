@@ -0,0 +1,79 @@
+package p2p
+
+import (
+	"github.com/libp2p/go-libp2p/core/host"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	libp2pproto "github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// Stream protocols of ShadowVault. Every ID carries its version. A change
+// peers of the previous version cannot follow gets a new ID, served beside
+// the old one for as long as such peers may still be around.
+const (
+	// PushProtocol is the stream protocol for proactively replicating a
+	// snapshot.
+	PushProtocol = libp2pproto.ID("/shadowvault/push/1.1.0")
+	// PullProtocol is the stream protocol for fetching a snapshot held by a
+	// peer.
+	PullProtocol = libp2pproto.ID("/shadowvault/pull/1.1.0")
+	// ManifestProtocol is the stream protocol for fetching the manifest of a
+	// snapshot announced by header. It uses the pull frames: one want,
+	// answered by one snapshot frame.
+	ManifestProtocol = libp2pproto.ID("/shadowvault/manifest/1.0.0")
+	// ChunkProtocol is the stream protocol for fetching single chunks from
+	// one peer, replacing chunk requests and responses on the data topic.
+	ChunkProtocol = libp2pproto.ID("/shadowvault/chunk/1.0.0")
+	// CacheProtocol is the stream protocol of cache nodes. It uses the
+	// chunk frames of ChunkProtocol, for chunks of any repository, which a
+	// cache node fetches from the peers holding them when it has no copy.
+	CacheProtocol = libp2pproto.ID("/shadowvault/cache/1.0.0")
+	// FetchTestProtocol is the stream protocol used by fetch-test round
+	// trips.
+	FetchTestProtocol = libp2pproto.ID("/shadowvault/fetch-test/1.0.0")
+)
+
+// Protocol versions before chunk data was framed; their chunks travel inside
+// the JSON frame and are only checked once complete
+const (
+	legacyPushProtocol = libp2pproto.ID("/shadowvault/push/1.0.0")
+	legacyPullProtocol = libp2pproto.ID("/shadowvault/pull/1.0.0")
+)
+
+// Chunk pubsub modes: whether chunks are still requested and served on the
+// data topic, the way peers before ChunkProtocol exchange them.
+const (
+	// ChunkPubsubCompat answers chunk requests on the topic and asks there
+	// when a peer does not speak ChunkProtocol, or every peer is asked
+	ChunkPubsubCompat = "compat"
+	// ChunkPubsubOff exchanges chunks over ChunkProtocol only
+	ChunkPubsubOff = "off"
+)
+
+// Protocols returns every stream protocol a node may serve, current
+// versions first.
+func Protocols() []libp2pproto.ID {
+	return []libp2pproto.ID{PushProtocol, PullProtocol, ManifestProtocol, ChunkProtocol, CacheProtocol, FetchTestProtocol, legacyPushProtocol, legacyPullProtocol}
+}
+
+// speaks reports whether pid may serve proto. Identify records the
+// protocols of a peer once connected; before that, or for a peer not
+// connected, it is worth trying.
+func speaks(h host.Host, pid peer.ID, proto libp2pproto.ID) bool {
+	known, err := h.Peerstore().GetProtocols(pid)
+	if err != nil || len(known) == 0 {
+		return true
+	}
+	for _, p := range known {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// IsCacheNode reports whether pid is known to be a cache node, whose chunks
+// are no copies
+func IsCacheNode(h host.Host, pid peer.ID) bool {
+	protos, err := h.Peerstore().SupportsProtocols(pid, CacheProtocol)
+	return err == nil && len(protos) > 0
+}
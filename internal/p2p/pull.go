@@ -0,0 +1,257 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	sverrors "github.com/hoangsonww/backupagent/internal/errors"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/protocol"
+	"github.com/hoangsonww/backupagent/internal/storage"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Pull frame kinds. The puller asks for a snapshot, checks the returned
+// manifest, then asks for the chunks it lacks; the holder streams them.
+const (
+	pullWant     = "want"
+	pullSnapshot = "snapshot"
+	pullChunks   = "chunks"
+	pullDone     = "done"
+)
+
+var ErrPullIncomplete = errors.New("peer did not send every missing chunk")
+
+// ErrShedding rejects pulls while the node is over its resource limits
+var ErrShedding = errors.New("node is over its resource limits, try again later")
+
+// pullCorruptRetries is how often a pull starts over after a chunk arrived
+// corrupt; chunks stored by the aborted attempt are not asked for again
+const pullCorruptRetries = 2
+
+// PullResult summarizes a completed pull.
+type PullResult struct {
+	Snapshot *versioning.Snapshot
+	Total    int
+	Missing  int
+	Bytes    int64
+	Duration time.Duration
+}
+
+// PullSnapshot fetches snapshot id of repository repoID from pid. The
+// manifest must carry a valid signature and pass trust before any chunk is
+// requested; it is saved locally only once every chunk is stored. A chunk
+// corrupted in transit aborts the transfer at once, which is then retried.
+func PullSnapshot(ctx context.Context, h host.Host, pid peer.ID, db *persistence.DB, store *storage.Store, id, repoID string, trust func(*versioning.Snapshot) error, progress PushProgress) (*PullResult, error) {
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		res, err := pullOnce(ctx, h, pid, db, store, id, repoID, trust, progress)
+		if err == nil {
+			res.Duration = time.Since(start)
+			return res, nil
+		}
+		if !errors.Is(err, ErrChunkCorrupt) || attempt == pullCorruptRetries || ctx.Err() != nil {
+			return nil, err
+		}
+		monitoring.GetLogger().WithError(err).WithField("snapshot_id", id).Warn("Snapshot pull aborted, retrying")
+	}
+}
+
+func pullOnce(ctx context.Context, h host.Host, pid peer.ID, db *persistence.DB, store *storage.Store, id, repoID string, trust func(*versioning.Snapshot) error, progress PushProgress) (*PullResult, error) {
+	s, err := h.NewStream(ctx, pid, PullProtocol, legacyPullProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	r := bufio.NewReader(s)
+	w := bufio.NewWriter(s)
+
+	read := func() (*pushFrame, error) {
+		f, err := readPushFrame(s, r)
+		if err != nil {
+			return nil, err
+		}
+		if f.Kind == pushError {
+			return nil, fmt.Errorf("%w: %s", ErrPushRejected, f.Error)
+		}
+		return f, nil
+	}
+
+	if err := writePushFrame(s, w, &pushFrame{Kind: pullWant, SnapshotID: id, RepoID: repoID}); err != nil {
+		return nil, err
+	}
+	f, err := read()
+	if err != nil {
+		return nil, err
+	}
+	if f.Kind != pullSnapshot || f.Snapshot == nil {
+		return nil, fmt.Errorf("unexpected %q frame", f.Kind)
+	}
+	snap := f.Snapshot
+	if snap.ID != id && !(id == versioning.LatestMetadataID && snap.IsMetadata()) {
+		return nil, fmt.Errorf("peer returned snapshot %s, asked for %s", snap.ID, id)
+	}
+	if err := (&protocol.SnapshotAnnouncement{Snapshot: *snap}).Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	if err := trust(snap); err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool)
+	var missing []string
+	for _, hash := range snap.Chunks {
+		if wanted[hash] || store.Exists(hash) {
+			continue
+		}
+		wanted[hash] = true
+		missing = append(missing, hash)
+	}
+	if err := writePushFrame(s, w, &pushFrame{Kind: pullChunks, Hashes: missing}); err != nil {
+		return nil, err
+	}
+
+	res := &PullResult{Snapshot: snap, Total: len(snap.Chunks), Missing: len(missing)}
+	received := 0
+	for {
+		f, err := read()
+		if err != nil {
+			return nil, err
+		}
+		if f.Kind == pullDone {
+			break
+		}
+		if f.Kind != pushChunk || !wanted[f.Hash] {
+			return nil, fmt.Errorf("unexpected %q frame for chunk %s", f.Kind, f.Hash)
+		}
+		data, err := readChunk(s, r, f, maxPushFrame)
+		if err != nil {
+			return nil, err
+		}
+		if err := store.Put(f.Hash, data); err != nil {
+			return nil, err
+		}
+		delete(wanted, f.Hash)
+		received++
+		res.Bytes += int64(len(data))
+		if progress != nil {
+			progress(received, res.Missing, res.Bytes)
+		}
+	}
+	if len(wanted) > 0 {
+		return nil, fmt.Errorf("%w: %d missing", ErrPullIncomplete, len(wanted))
+	}
+
+	openMeta(store, snap)
+	if err := versioning.SaveSnapshot(db, snap); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// pullServer serves snapshots and chunks to authorized peers
+type pullServer struct {
+	db        *persistence.DB
+	store     *storage.Store
+	fetcher   *ChunkFetcher
+	authorize func(peer.ID) error
+}
+
+// ServePull installs the pull stream handler. Only snapshots of repositories
+// we hold or import are served, and only to peers passing authorize.
+func ServePull(h host.Host, db *persistence.DB, store *storage.Store, fetcher *ChunkFetcher, authorize func(peer.ID) error) {
+	srv := &pullServer{db: db, store: store, fetcher: fetcher, authorize: authorize}
+	h.SetStreamHandler(PullProtocol, srv.handle)
+	h.SetStreamHandler(legacyPullProtocol, srv.handle)
+}
+
+func (srv *pullServer) handle(s network.Stream) {
+	defer s.Close()
+	from := s.Conn().RemotePeer()
+	logger := monitoring.GetLogger().WithField("peer", from.String())
+	r := bufio.NewReader(s)
+	w := bufio.NewWriter(s)
+
+	reject := func(err error) {
+		logger.WithError(err).Warn("Rejected snapshot pull")
+		writePushFrame(s, w, &pushFrame{Kind: pushError, Error: err.Error()})
+	}
+
+	want, err := readPushFrame(s, r)
+	if err != nil {
+		return
+	}
+	if want.Kind != pullWant {
+		reject(errors.New("expected snapshot request"))
+		return
+	}
+	if err := srv.authorize(from); err != nil {
+		reject(err)
+		return
+	}
+	if srv.fetcher.Shedding() {
+		monitoring.GetMetrics().ChunkRequestsShed.Add(1)
+		reject(ErrShedding)
+		return
+	}
+	var snap *versioning.Snapshot
+	if want.SnapshotID == versioning.LatestMetadataID {
+		snap, err = versioning.LatestMetadata(srv.db, want.RepoID)
+	} else {
+		snap, err = versioning.LoadSnapshot(srv.db, want.SnapshotID)
+	}
+	if err != nil || snap.RepoID != want.RepoID || !srv.fetcher.acceptsRepository(snap.RepoID) {
+		reject(fmt.Errorf("snapshot %s of repository %q not held", want.SnapshotID, want.RepoID))
+		return
+	}
+	logger = logger.WithField("snapshot_id", snap.ID)
+
+	if err := writePushFrame(s, w, &pushFrame{Kind: pullSnapshot, Snapshot: snap.Public()}); err != nil {
+		return
+	}
+	req, err := readPushFrame(s, r)
+	if err != nil || req.Kind != pullChunks {
+		return
+	}
+
+	// Only chunks of the requested snapshot may be read through a pull
+	inSnap := make(map[string]bool, len(snap.Chunks))
+	for _, hash := range snap.Chunks {
+		inSnap[hash] = true
+	}
+	for _, hash := range req.Hashes {
+		if !inSnap[hash] {
+			reject(fmt.Errorf("chunk %s is not part of snapshot %s", hash, snap.ID))
+			return
+		}
+		data, err := srv.store.Serve(hash)
+		if err != nil {
+			// The puller reports chunks we lack as incomplete
+			if sverrors.GetErrorCode(err) != sverrors.ErrCodeChunkNotFound {
+				logger.WithError(err).Warnf("Failed to read chunk %s", hash)
+			}
+			continue
+		}
+		if err := writeChunk(s, w, hash, data); err != nil {
+			logger.WithError(err).Warn("Snapshot pull aborted")
+			return
+		}
+	}
+	writePushFrame(s, w, &pushFrame{Kind: pullDone})
+	logger.Infof("Served snapshot pull, %d chunk(s) requested", len(req.Hashes))
+}
+
+// openMeta restores the sealed metadata of a received snapshot when it is
+// sealed under our repository key; that of other repositories stays sealed
+func openMeta(store *storage.Store, snap *versioning.Snapshot) {
+	if err := snap.OpenMeta(store.Unseal); err != nil && !errors.Is(err, versioning.ErrMetaSealed) {
+		monitoring.GetLogger().WithError(err).WithField("snapshot_id", snap.ID).Warn("Malformed sealed snapshot metadata")
+	}
+}
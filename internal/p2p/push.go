@@ -0,0 +1,321 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/protocol"
+	"github.com/hoangsonww/backupagent/internal/storage"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// maxPushFrame bounds one frame; manifests of large snapshots dominate
+	maxPushFrame = 64 << 20
+	// pushIdleTimeout aborts a push when either side stalls
+	pushIdleTimeout = 2 * time.Minute
+)
+
+// Push frame kinds. The pusher offers a manifest, the receiver answers with
+// the chunks it lacks, the pusher streams those and asks for verification.
+const (
+	pushOffer    = "offer"
+	pushMissing  = "missing"
+	pushChunk    = "chunk"
+	pushVerify   = "verify"
+	pushVerified = "verified"
+	pushError    = "error"
+)
+
+var (
+	ErrPushRejected     = errors.New("peer rejected push")
+	ErrPushVerifyFailed = errors.New("remote verification failed")
+)
+
+// pushFrame is one message of the push and pull stream protocols
+type pushFrame struct {
+	Kind       string               `json:"kind"`
+	SnapshotID string               `json:"snapshot_id,omitempty"`
+	RepoID     string               `json:"repo_id,omitempty"`
+	Snapshot   *versioning.Snapshot `json:"snapshot,omitempty"`
+	Hashes     []string             `json:"hashes,omitempty"`
+	Hash       string               `json:"hash,omitempty"`
+	Data       []byte               `json:"data,omitempty"` // chunk data on legacy streams, see writeChunk
+	Size       int                  `json:"size,omitempty"`
+	Sum        string               `json:"sum,omitempty"` // sha256 of the chunk as stored
+	Error      string               `json:"error,omitempty"`
+}
+
+// PushResult summarizes a completed push.
+type PushResult struct {
+	Peer     peer.ID
+	Total    int
+	Missing  int
+	Bytes    int64
+	Duration time.Duration
+	Digest   string
+}
+
+// PushProgress is called after each chunk is sent.
+type PushProgress func(sent, missing int, bytes int64)
+
+// PushSnapshot offers snap to pid, sends the chunks the peer lacks and has it
+// confirm, by digest, that it now stores every chunk of the snapshot.
+func PushSnapshot(ctx context.Context, h host.Host, pid peer.ID, store *storage.Store, snap *versioning.Snapshot, progress PushProgress) (*PushResult, error) {
+	start := time.Now()
+
+	// Fail before contacting the peer if we cannot serve every chunk
+	for _, hash := range snap.Chunks {
+		if !store.Exists(hash) {
+			return nil, fmt.Errorf("chunk %s of snapshot %s not stored locally", hash, snap.ID)
+		}
+	}
+
+	s, err := h.NewStream(ctx, pid, PushProtocol, legacyPushProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	r := bufio.NewReader(s)
+	w := bufio.NewWriter(s)
+
+	exchange := func(out *pushFrame) (*pushFrame, error) {
+		if err := writePushFrame(s, w, out); err != nil {
+			return nil, err
+		}
+		in, err := readPushFrame(s, r)
+		if err != nil {
+			return nil, err
+		}
+		if in.Kind == pushError {
+			return nil, fmt.Errorf("%w: %s", ErrPushRejected, in.Error)
+		}
+		return in, nil
+	}
+
+	resp, err := exchange(&pushFrame{Kind: pushOffer, Snapshot: snap.Public()})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Kind != pushMissing {
+		return nil, fmt.Errorf("unexpected %q frame", resp.Kind)
+	}
+
+	res := &PushResult{Peer: pid, Total: len(snap.Chunks), Missing: len(resp.Hashes)}
+	for i, hash := range resp.Hashes {
+		data, err := store.Get(hash)
+		if err != nil {
+			return nil, fmt.Errorf("peer asked for unknown chunk %s: %w", hash, err)
+		}
+		if err := writeChunk(s, w, hash, data); err != nil {
+			return nil, err
+		}
+		res.Bytes += int64(len(data))
+		if progress != nil {
+			progress(i+1, res.Missing, res.Bytes)
+		}
+	}
+
+	resp, err = exchange(&pushFrame{Kind: pushVerify})
+	if err != nil {
+		return nil, err
+	}
+	want, err := ChunkDigest(store, snap.Chunks)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Kind != pushVerified || resp.Sum != want {
+		return nil, ErrPushVerifyFailed
+	}
+
+	res.Digest = want
+	res.Duration = time.Since(start)
+	return res, nil
+}
+
+// ChunkDigest hashes the stored form of each chunk in order. Chunks are
+// replicated byte for byte, so two nodes holding the same chunks agree on it.
+func ChunkDigest(store *storage.Store, hashes []string) (string, error) {
+	d := sha256.New()
+	for _, hash := range hashes {
+		data, err := store.Get(hash)
+		if err != nil {
+			return "", fmt.Errorf("chunk %s: %w", hash, err)
+		}
+		sum := sha256.Sum256(data)
+		d.Write(sum[:])
+	}
+	return hex.EncodeToString(d.Sum(nil)), nil
+}
+
+// pushServer receives pushed snapshots
+type pushServer struct {
+	db        *persistence.DB
+	store     *storage.Store
+	fetcher   *ChunkFetcher
+	authorize func(peer.ID, *versioning.Snapshot) error
+}
+
+// ServePush installs the push stream handler. Offers must carry a valid
+// signature for a repository we hold or import, and pass authorize.
+func ServePush(h host.Host, db *persistence.DB, store *storage.Store, fetcher *ChunkFetcher, authorize func(peer.ID, *versioning.Snapshot) error) {
+	srv := &pushServer{db: db, store: store, fetcher: fetcher, authorize: authorize}
+	h.SetStreamHandler(PushProtocol, srv.handle)
+	h.SetStreamHandler(legacyPushProtocol, srv.handle)
+}
+
+func (srv *pushServer) handle(s network.Stream) {
+	defer s.Close()
+	from := s.Conn().RemotePeer()
+	logger := monitoring.GetLogger().WithField("peer", from.String())
+	r := bufio.NewReader(s)
+	w := bufio.NewWriter(s)
+
+	reject := func(err error) {
+		logger.WithError(err).Warn("Rejected snapshot push")
+		writePushFrame(s, w, &pushFrame{Kind: pushError, Error: err.Error()})
+	}
+
+	offer, err := readPushFrame(s, r)
+	if err != nil {
+		return
+	}
+	if offer.Kind != pushOffer || offer.Snapshot == nil {
+		reject(errors.New("expected snapshot offer"))
+		return
+	}
+	snap := offer.Snapshot
+	if err := (&protocol.SnapshotAnnouncement{Snapshot: *snap}).Validate(); err != nil {
+		reject(err)
+		return
+	}
+	if !srv.fetcher.acceptsRepository(snap.RepoID) {
+		reject(fmt.Errorf("foreign repository %q", snap.RepoID))
+		return
+	}
+	if err := srv.authorize(from, snap); err != nil {
+		reject(err)
+		return
+	}
+	logger = logger.WithField("snapshot_id", snap.ID)
+
+	// Chunks received stay unreferenced until the snapshot is saved, so GC
+	// must not sweep meanwhile
+	ctx, cancel := context.WithTimeout(context.Background(), pushIdleTimeout)
+	end, err := srv.store.BeginWrite(ctx)
+	cancel()
+	if err != nil {
+		reject(fmt.Errorf("repository busy: %w", err))
+		return
+	}
+	defer end()
+
+	// HasChunks negotiation: only ask for what we lack
+	wanted := make(map[string]bool)
+	var missing []string
+	for _, hash := range snap.Chunks {
+		if wanted[hash] || srv.store.Exists(hash) {
+			continue
+		}
+		wanted[hash] = true
+		missing = append(missing, hash)
+	}
+	if err := writePushFrame(s, w, &pushFrame{Kind: pushMissing, Hashes: missing}); err != nil {
+		return
+	}
+	logger.Infof("Receiving pushed snapshot, %d of %d chunks missing", len(missing), len(snap.Chunks))
+
+	for {
+		f, err := readPushFrame(s, r)
+		if err != nil {
+			logger.WithError(err).Warn("Snapshot push aborted")
+			return
+		}
+		switch f.Kind {
+		case pushChunk:
+			if !wanted[f.Hash] {
+				reject(fmt.Errorf("unsolicited chunk %s", f.Hash))
+				return
+			}
+			data, err := readChunk(s, r, f, srv.fetcher.maxChunkSize)
+			if err != nil {
+				reject(err)
+				return
+			}
+			if err := srv.store.Put(f.Hash, data); err != nil {
+				reject(err)
+				return
+			}
+			delete(wanted, f.Hash)
+		case pushVerify:
+			digest, err := ChunkDigest(srv.store, snap.Chunks)
+			if err != nil {
+				reject(err)
+				return
+			}
+			openMeta(srv.store, snap)
+			if err := versioning.SaveSnapshot(srv.db, snap); err != nil {
+				reject(err)
+				return
+			}
+			// The pusher could serve every chunk, so it holds them
+			if srv.fetcher.locations != nil {
+				srv.fetcher.locations.Record(from, snap.Chunks...)
+			}
+			writePushFrame(s, w, &pushFrame{Kind: pushVerified, Sum: digest})
+			logger.Info("Pushed snapshot stored and verified")
+			return
+		default:
+			reject(fmt.Errorf("unexpected %q frame", f.Kind))
+			return
+		}
+	}
+}
+
+func writePushFrame(s network.Stream, w *bufio.Writer, f *pushFrame) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	s.SetWriteDeadline(time.Now().Add(pushIdleTimeout))
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func readPushFrame(s network.Stream, r *bufio.Reader) (*pushFrame, error) {
+	s.SetReadDeadline(time.Now().Add(pushIdleTimeout))
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if n > maxPushFrame {
+		return nil, fmt.Errorf("push frame of %d bytes exceeds limit", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	var f pushFrame
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
@@ -0,0 +1,177 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"time"
+
+	sverrors "github.com/hoangsonww/backupagent/internal/errors"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// receivedQueueSize bounds the chunks waiting for verification; more
+	// are left unchecked until restore
+	receivedQueueSize = 1024
+	// maxBadCopies is how many corrupt copies of a chunk are quarantined
+	// before it is no longer asked for again
+	maxBadCopies = 3
+)
+
+// QuarantinedChunk is a chunk received from a peer that did not decrypt to
+// its hash. The last bad copy is kept for inspection.
+type QuarantinedChunk struct {
+	Hash     string    `json:"hash"`
+	RepoID   string    `json:"repo_id,omitempty"`
+	Signer   string    `json:"signer"` // of the chunk response that delivered it
+	Error    string    `json:"error"`
+	Copies   int       `json:"copies"` // bad copies received so far
+	LastSeen time.Time `json:"last_seen"`
+	Data     []byte    `json:"data"`
+}
+
+type receivedChunk struct {
+	hash, repoID, signer string
+}
+
+// ReceivedVerifier test-decrypts chunks of our repository received from
+// peers in the background. Chunks are only hash-checked as ciphertext on
+// arrival, so ciphertext corrupted at its source would otherwise surface at
+// restore. A chunk that fails is moved out of the store into quarantine and
+// fetched again.
+type ReceivedVerifier struct {
+	db      *persistence.DB
+	fetcher *ChunkFetcher
+	topic   *pubsub.Topic
+	rate    float64 // fraction of received chunks checked
+	queue   chan receivedChunk
+	metrics *monitoring.Metrics
+}
+
+// NewReceivedVerifier returns the verifier of fetcher checking mode "all",
+// "sample" at sampleRate, or "off".
+func NewReceivedVerifier(db *persistence.DB, fetcher *ChunkFetcher, topic *pubsub.Topic, mode string, sampleRate float64) *ReceivedVerifier {
+	v := &ReceivedVerifier{
+		db:      db,
+		fetcher: fetcher,
+		topic:   topic,
+		queue:   make(chan receivedChunk, receivedQueueSize),
+		metrics: monitoring.GetMetrics(),
+	}
+	switch mode {
+	case "all":
+		v.rate = 1
+	case "sample":
+		v.rate = sampleRate
+	}
+	fetcher.verify = v
+	return v
+}
+
+// Add queues a chunk just stored from a peer. Chunks of imported
+// repositories are skipped: they are sealed under keys we do not hold.
+func (v *ReceivedVerifier) Add(hash, repoID, signer string) {
+	if repoID != v.fetcher.repoID || v.rate <= 0 || (v.rate < 1 && rand.Float64() >= v.rate) {
+		return
+	}
+	select {
+	case v.queue <- receivedChunk{hash, repoID, signer}:
+	default:
+		monitoring.GetLogger().WithField("chunk_hash", hash).Debug("Verification queue full, chunk left unchecked")
+	}
+}
+
+// Pending returns how many received chunks wait to be verified.
+func (v *ReceivedVerifier) Pending() int {
+	return len(v.queue)
+}
+
+// Run verifies queued chunks until ctx ends.
+func (v *ReceivedVerifier) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case rc := <-v.queue:
+			v.verify(ctx, rc)
+		}
+	}
+}
+
+func (v *ReceivedVerifier) verify(ctx context.Context, rc receivedChunk) {
+	logger := monitoring.GetLogger().WithField("chunk_hash", rc.hash)
+	store := v.fetcher.store
+
+	data, err := store.Get(rc.hash)
+	if err != nil {
+		// Collected meanwhile, or unreadable for reasons of our own
+		if sverrors.GetErrorCode(err) != sverrors.ErrCodeChunkNotFound {
+			logger.WithError(err).Warn("Failed to read received chunk for verification")
+		}
+		return
+	}
+	_, openErr := store.Open(rc.hash, data)
+	switch sverrors.GetErrorCode(openErr) {
+	case "":
+		v.metrics.ReceivedVerified.Add(1)
+		return
+	case sverrors.ErrCodeChunkInvalid, sverrors.ErrCodeDecryptionFailed:
+	default:
+		logger.WithError(openErr).Warn("Failed to verify received chunk")
+		return
+	}
+
+	copies, err := v.quarantine(rc, data, openErr)
+	if err != nil {
+		logger.WithError(err).Error("Failed to quarantine corrupt chunk")
+		return
+	}
+	v.metrics.ReceivedQuarantined.Add(1)
+	logger.WithError(openErr).WithField("signer", rc.signer).Warnf("Quarantined corrupt chunk received from a peer (copy %d)", copies)
+	if copies >= maxBadCopies {
+		logger.Errorf("Giving up on chunk after %d corrupt copies", copies)
+		return
+	}
+
+	// Ask again; the new copy is verified in turn
+	go func() {
+		_, err := v.fetcher.FetchChunkFailover(ctx, rc.hash, rc.repoID, v.topic, "")
+		if err == nil || ctx.Err() != nil || v.fetcher.missing == nil {
+			return
+		}
+		if err := v.fetcher.missing.Add(rc.hash, rc.repoID, "", err); err != nil {
+			logger.WithError(err).Error("Failed to queue missing chunk")
+		}
+	}()
+}
+
+// quarantine moves data out of the store into the quarantine bucket and
+// returns how many bad copies of the chunk have arrived
+func (v *ReceivedVerifier) quarantine(rc receivedChunk, data []byte, cause error) (int, error) {
+	qc := &QuarantinedChunk{Hash: rc.hash}
+	err := v.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(persistence.BucketBadChunks))
+		if val := b.Get([]byte(rc.hash)); val != nil {
+			if err := json.Unmarshal(val, qc); err != nil {
+				return err
+			}
+		}
+		qc.RepoID, qc.Signer, qc.Error = rc.repoID, rc.signer, cause.Error()
+		qc.Copies++
+		qc.LastSeen = time.Now().UTC()
+		qc.Data = data
+		val, err := json.Marshal(qc)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(rc.hash), val)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return qc.Copies, v.fetcher.store.Delete(rc.hash)
+}
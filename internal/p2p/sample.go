@@ -0,0 +1,91 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+
+	"github.com/hoangsonww/backupagent/internal/protocol"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	"github.com/libp2p/go-libp2p/core/host"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+// SampleResult is a snapshot manifest and some of its chunks exactly as the
+// holding peer stores them.
+type SampleResult struct {
+	Snapshot  *versioning.Snapshot
+	Requested []string
+	Chunks    map[string][]byte // chunks the holder returned, by hash
+}
+
+// SampleSnapshot fetches snapshot id of repository repoID from pid over the
+// pull protocol without storing anything. The chunks to request are chosen
+// by pick only once the signed manifest is in hand, so the holder cannot
+// know in advance which ones will be checked.
+func SampleSnapshot(ctx context.Context, h host.Host, pid peer.ID, id, repoID string, pick func(*versioning.Snapshot) []string) (*SampleResult, error) {
+	s, err := h.NewStream(ctx, pid, PullProtocol, legacyPullProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	r := bufio.NewReader(s)
+	w := bufio.NewWriter(s)
+
+	read := func() (*pushFrame, error) {
+		f, err := readPushFrame(s, r)
+		if err != nil {
+			return nil, err
+		}
+		if f.Kind == pushError {
+			return nil, fmt.Errorf("%w: %s", ErrPushRejected, f.Error)
+		}
+		return f, nil
+	}
+
+	if err := writePushFrame(s, w, &pushFrame{Kind: pullWant, SnapshotID: id, RepoID: repoID}); err != nil {
+		return nil, err
+	}
+	f, err := read()
+	if err != nil {
+		return nil, err
+	}
+	if f.Kind != pullSnapshot || f.Snapshot == nil {
+		return nil, fmt.Errorf("unexpected %q frame", f.Kind)
+	}
+	snap := f.Snapshot
+	if snap.ID != id {
+		return nil, fmt.Errorf("peer returned snapshot %s, asked for %s", snap.ID, id)
+	}
+	if err := (&protocol.SnapshotAnnouncement{Snapshot: *snap}).Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	res := &SampleResult{Snapshot: snap, Requested: pick(snap), Chunks: make(map[string][]byte)}
+	wanted := make(map[string]bool, len(res.Requested))
+	for _, hash := range res.Requested {
+		wanted[hash] = true
+	}
+	if err := writePushFrame(s, w, &pushFrame{Kind: pullChunks, Hashes: res.Requested}); err != nil {
+		return nil, err
+	}
+	for {
+		f, err := read()
+		if err != nil {
+			return nil, err
+		}
+		if f.Kind == pullDone {
+			break
+		}
+		if f.Kind != pushChunk || !wanted[f.Hash] {
+			return nil, fmt.Errorf("unexpected %q frame for chunk %s", f.Kind, f.Hash)
+		}
+		data, err := readChunk(s, r, f, maxPushFrame)
+		if err != nil {
+			return nil, err
+		}
+		delete(wanted, f.Hash)
+		res.Chunks[f.Hash] = data
+	}
+	return res, nil
+}
@@ -0,0 +1,342 @@
+package p2p
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Offense is a category of peer misbehaviour.
+type Offense string
+
+const (
+	OffenseInvalidSignature Offense = "invalid_signature"
+	OffenseMalformed        Offense = "malformed_message"
+	OffenseQuota            Offense = "quota_violation"
+	OffenseFailedProof      Offense = "failed_proof"
+	OffenseOversize         Offense = "oversize_message"
+	OffenseBlacklisted      Offense = "blacklisted"
+)
+
+// offenseWeights is the score each offense adds. Failed proofs (data that
+// does not match its hash) are the strongest signal of a malicious peer.
+var offenseWeights = map[Offense]float64{
+	OffenseInvalidSignature: 20,
+	OffenseMalformed:        10,
+	OffenseQuota:            5,
+	OffenseFailedProof:      50,
+	OffenseOversize:         40,
+}
+
+// Quarantine records a peer that is disconnected and refused until Until.
+// It is local-only and never gossiped, so a node cannot be tricked into
+// banning honest peers.
+type Quarantine struct {
+	PeerID string    `json:"peer_id"`
+	Reason Offense   `json:"reason"`
+	Score  float64   `json:"score"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+}
+
+// PeerScore is the current standing of one peer.
+type PeerScore struct {
+	PeerID   string             `json:"peer_id"`
+	Score    float64            `json:"score"`
+	Offenses map[Offense]uint64 `json:"offenses"`
+}
+
+type peerScore struct {
+	score    float64
+	updated  time.Time
+	offenses map[Offense]uint64
+}
+
+// PeerScorer accumulates decaying misbehaviour scores per peer and
+// quarantines peers whose score reaches the threshold. It doubles as the
+// pubsub blacklist and the libp2p connection gater.
+type PeerScorer struct {
+	mu          sync.Mutex
+	db          *persistence.DB
+	peers       map[peer.ID]*peerScore
+	quarantined map[peer.ID]*Quarantine
+	threshold   float64
+	halfLife    time.Duration
+	banFor      time.Duration
+	metrics     *monitoring.Metrics
+
+	// onQuarantine is called outside the lock when a peer is quarantined
+	onQuarantine func(peer.ID)
+}
+
+// NewPeerScorer creates a scorer and restores unexpired quarantines from db.
+func NewPeerScorer(db *persistence.DB, threshold float64, halfLife, banFor time.Duration) (*PeerScorer, error) {
+	s := &PeerScorer{
+		db:          db,
+		peers:       make(map[peer.ID]*peerScore),
+		quarantined: make(map[peer.ID]*Quarantine),
+		threshold:   threshold,
+		halfLife:    halfLife,
+		banFor:      banFor,
+		metrics:     monitoring.GetMetrics(),
+	}
+
+	entries, err := LoadQuarantines(db)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, q := range entries {
+		pid, err := peer.Decode(q.PeerID)
+		if err != nil || !now.Before(q.Until) {
+			continue
+		}
+		s.quarantined[pid] = q
+		s.metrics.PeersQuarantined.Add(1)
+	}
+	return s, nil
+}
+
+// Penalize adds the weight of off to pid's score and quarantines the peer if
+// the threshold is reached. Reports whether the peer got quarantined.
+func (s *PeerScorer) Penalize(pid peer.ID, off Offense) bool {
+	now := time.Now()
+
+	s.mu.Lock()
+	ps, ok := s.peers[pid]
+	if !ok {
+		ps = &peerScore{offenses: make(map[Offense]uint64)}
+		s.peers[pid] = ps
+	}
+	s.decayLocked(ps, now)
+	ps.score += offenseWeights[off]
+	ps.offenses[off]++
+	score := ps.score
+
+	var q *Quarantine
+	if score >= s.threshold && s.activeLocked(pid, now) == nil {
+		q = s.quarantineLocked(pid, off, score, now)
+	}
+	s.mu.Unlock()
+
+	s.metrics.RecordPeerPenalized()
+	monitoring.GetLogger().WithFields(map[string]interface{}{
+		"peer":    pid.String(),
+		"offense": string(off),
+		"score":   score,
+	}).Warn("Peer penalized")
+
+	if q == nil {
+		return false
+	}
+	s.finishQuarantine(pid, q)
+	return true
+}
+
+// Quarantine bans pid immediately regardless of score.
+func (s *PeerScorer) Quarantine(pid peer.ID, reason Offense) {
+	now := time.Now()
+	s.mu.Lock()
+	if s.activeLocked(pid, now) != nil {
+		s.mu.Unlock()
+		return
+	}
+	var score float64
+	if ps, ok := s.peers[pid]; ok {
+		s.decayLocked(ps, now)
+		score = ps.score
+	}
+	q := s.quarantineLocked(pid, reason, score, now)
+	s.mu.Unlock()
+
+	s.finishQuarantine(pid, q)
+}
+
+// Release lifts a quarantine early and clears the peer's score.
+func (s *PeerScorer) Release(pid peer.ID) error {
+	s.mu.Lock()
+	_, was := s.quarantined[pid]
+	delete(s.quarantined, pid)
+	delete(s.peers, pid)
+	s.mu.Unlock()
+
+	if was {
+		s.metrics.PeersQuarantined.Add(-1)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := s.db.Sealed(tx, persistence.BucketQuarantine)
+		if err != nil {
+			return err
+		}
+		return b.Delete([]byte(pid.String()))
+	})
+}
+
+// IsQuarantined reports whether pid is currently quarantined.
+func (s *PeerScorer) IsQuarantined(pid peer.ID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.activeLocked(pid, time.Now()) != nil
+}
+
+// Score returns pid's current decayed score.
+func (s *PeerScorer) Score(pid peer.ID) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps, ok := s.peers[pid]
+	if !ok {
+		return 0
+	}
+	s.decayLocked(ps, time.Now())
+	return ps.score
+}
+
+// Scores returns the standing of every peer with a non-zero score.
+func (s *PeerScorer) Scores() []PeerScore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	out := make([]PeerScore, 0, len(s.peers))
+	for pid, ps := range s.peers {
+		s.decayLocked(ps, now)
+		offenses := make(map[Offense]uint64, len(ps.offenses))
+		for k, v := range ps.offenses {
+			offenses[k] = v
+		}
+		out = append(out, PeerScore{PeerID: pid.String(), Score: ps.score, Offenses: offenses})
+	}
+	return out
+}
+
+// Add implements pubsub.Blacklist.
+func (s *PeerScorer) Add(pid peer.ID) bool {
+	s.Quarantine(pid, OffenseBlacklisted)
+	return true
+}
+
+// Contains implements pubsub.Blacklist.
+func (s *PeerScorer) Contains(pid peer.ID) bool {
+	return s.IsQuarantined(pid)
+}
+
+// InterceptPeerDial implements connmgr.ConnectionGater.
+func (s *PeerScorer) InterceptPeerDial(pid peer.ID) bool {
+	return !s.IsQuarantined(pid)
+}
+
+// InterceptAddrDial implements connmgr.ConnectionGater.
+func (s *PeerScorer) InterceptAddrDial(pid peer.ID, _ ma.Multiaddr) bool {
+	return !s.IsQuarantined(pid)
+}
+
+// InterceptAccept implements connmgr.ConnectionGater. The peer is not known
+// yet, so the check happens in InterceptSecured.
+func (s *PeerScorer) InterceptAccept(network.ConnMultiaddrs) bool {
+	return true
+}
+
+// InterceptSecured implements connmgr.ConnectionGater.
+func (s *PeerScorer) InterceptSecured(_ network.Direction, pid peer.ID, _ network.ConnMultiaddrs) bool {
+	return !s.IsQuarantined(pid)
+}
+
+// InterceptUpgraded implements connmgr.ConnectionGater.
+func (s *PeerScorer) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+// decayLocked halves the score every halfLife since the last update
+func (s *PeerScorer) decayLocked(ps *peerScore, now time.Time) {
+	if !ps.updated.IsZero() && s.halfLife > 0 {
+		elapsed := now.Sub(ps.updated)
+		ps.score *= math.Pow(0.5, float64(elapsed)/float64(s.halfLife))
+	}
+	ps.updated = now
+}
+
+// activeLocked returns pid's unexpired quarantine, dropping an expired one
+func (s *PeerScorer) activeLocked(pid peer.ID, now time.Time) *Quarantine {
+	q, ok := s.quarantined[pid]
+	if !ok {
+		return nil
+	}
+	if now.Before(q.Until) {
+		return q
+	}
+	delete(s.quarantined, pid)
+	s.metrics.PeersQuarantined.Add(-1)
+	return nil
+}
+
+func (s *PeerScorer) quarantineLocked(pid peer.ID, reason Offense, score float64, now time.Time) *Quarantine {
+	q := &Quarantine{
+		PeerID: pid.String(),
+		Reason: reason,
+		Score:  score,
+		Since:  now,
+		Until:  now.Add(s.banFor),
+	}
+	s.quarantined[pid] = q
+	// The peer starts from a clean score once the quarantine expires
+	delete(s.peers, pid)
+	s.metrics.PeersQuarantined.Add(1)
+	return q
+}
+
+// finishQuarantine persists q and runs the disconnect hook
+func (s *PeerScorer) finishQuarantine(pid peer.ID, q *Quarantine) {
+	logger := monitoring.GetLogger().WithFields(map[string]interface{}{
+		"peer":   q.PeerID,
+		"reason": string(q.Reason),
+		"until":  q.Until.Format(time.RFC3339),
+	})
+	logger.Warn("Peer quarantined")
+
+	data, err := json.Marshal(q)
+	if err == nil {
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			b, err := s.db.Sealed(tx, persistence.BucketQuarantine)
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(q.PeerID), data)
+		})
+	}
+	if err != nil {
+		logger.WithError(err).Error("Failed to persist quarantine")
+	}
+
+	if s.onQuarantine != nil {
+		s.onQuarantine(pid)
+	}
+}
+
+// LoadQuarantines returns the stored quarantine records, including expired ones.
+func LoadQuarantines(db *persistence.DB) ([]*Quarantine, error) {
+	var out []*Quarantine
+	err := db.View(func(tx *bolt.Tx) error {
+		b, err := db.Sealed(tx, persistence.BucketQuarantine)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var q Quarantine
+			if err := json.Unmarshal(v, &q); err != nil {
+				return nil
+			}
+			out = append(out, &q)
+			return nil
+		})
+	})
+	return out, err
+}
@@ -8,41 +8,186 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hoangsonww/backupagent/internal/crypto"
+	sverrors "github.com/hoangsonww/backupagent/internal/errors"
 	"github.com/hoangsonww/backupagent/internal/monitoring"
 	"github.com/hoangsonww/backupagent/internal/protocol"
 	"github.com/hoangsonww/backupagent/internal/storage"
 	"github.com/hoangsonww/backupagent/internal/versioning"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/host"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+)
+
+var (
+	// ErrChunkTooLarge is returned for chunk responses above the configured limit
+	ErrChunkTooLarge = errors.New("chunk exceeds maximum size")
+	// ErrInvalidSignature is returned for chunk messages failing verification
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrChunkHashMismatch is returned when chunk data does not match its hash
+	ErrChunkHashMismatch = errors.New("chunk hash mismatch")
+	// ErrForeignRepository is returned for chunks of a repository we do not import
+	ErrForeignRepository = errors.New("chunk belongs to a different repository")
 )
 
 // ChunkFetcher handles fetching missing chunks from peers
 type ChunkFetcher struct {
-	store          *storage.Store
-	signerPub      []byte
-	signerPriv     []byte
-	maxConcurrent  int
-	timeout        time.Duration
-	pendingFetches sync.Map // hash -> chan []byte
-	metrics        *monitoring.Metrics
+	store         *storage.Store
+	signerPub     []byte
+	signerPriv    []byte
+	maxConcurrent int
+	maxChunkSize  int
+	repoID        string
+	acceptRepo    func(repoID string) bool
+	timeout       time.Duration // wait for peers not yet measured
+	timer         *fetchTimer
+	flightMu      sync.Mutex
+	flights       map[string]*fetchFlight // outstanding requests by hash
+	metrics       *monitoring.Metrics
+
+	self      peer.ID
+	attempts  int              // requests per chunk before it is queued, the last to every peer
+	providers func() []peer.ID // connected peers to ask, best first
+	missing   *MissingQueue
+	verify    *ReceivedVerifier // test-decrypts received chunks, if set
+	locations *ChunkLocations   // peers to ask first per chunk, if set
+	shedding  atomic.Bool       // chunk requests from peers go unanswered
+	host      host.Host         // asks peers over ChunkProtocol, if set
+	legacy    bool              // chunk requests and responses still go on the data topic
 }
 
 // NewChunkFetcher creates a new chunk fetcher
-func NewChunkFetcher(store *storage.Store, signerPub, signerPriv []byte, maxConcurrent int, timeout time.Duration) *ChunkFetcher {
+func NewChunkFetcher(store *storage.Store, signerPub, signerPriv []byte, maxConcurrent, maxChunkSize int, timeout time.Duration) *ChunkFetcher {
 	return &ChunkFetcher{
 		store:         store,
 		signerPub:     signerPub,
 		signerPriv:    signerPriv,
 		maxConcurrent: maxConcurrent,
+		maxChunkSize:  maxChunkSize,
 		timeout:       timeout,
+		timer:         newFetchTimer(timeout, timeout, timeout, maxChunkSize),
 		metrics:       monitoring.GetMetrics(),
 	}
 }
 
-// FetchChunk fetches a chunk from peers
-func (cf *ChunkFetcher) FetchChunk(ctx context.Context, hash string, topic *pubsub.Topic, peerID string) ([]byte, error) {
+// SetRepository sets the local repository ID. Chunks of other repositories
+// are only stored when accept returns true for their ID.
+func (cf *ChunkFetcher) SetRepository(repoID string, accept func(repoID string) bool) {
+	cf.repoID = repoID
+	cf.acceptRepo = accept
+}
+
+// acceptsRepository reports whether chunks of repoID may enter our store
+func (cf *ChunkFetcher) acceptsRepository(repoID string) bool {
+	if repoID == cf.repoID {
+		return true
+	}
+	return cf.acceptRepo != nil && cf.acceptRepo(repoID)
+}
+
+// Shed stops or resumes answering chunk requests from peers, e.g. while
+// the node is short of memory.
+func (cf *ChunkFetcher) Shed(on bool) {
+	cf.shedding.Store(on)
+}
+
+// Shedding reports whether chunk requests from peers go unanswered.
+func (cf *ChunkFetcher) Shedding() bool {
+	return cf.shedding.Load()
+}
+
+// FetchChunk fetches a chunk of repository repoID from peers
+func (cf *ChunkFetcher) FetchChunk(ctx context.Context, hash, repoID string, topic *pubsub.Topic, peerID string) ([]byte, error) {
+	return cf.fetchFrom(ctx, hash, repoID, topic, peerID, "")
+}
+
+// FetchChunkFailover asks one provider at a time for a chunk: first, cache
+// nodes, then the peer that announced it, then connected peers that
+// recently served or confirmed it, then the other connected peers best
+// scored first. The last of its attempts asks every peer at once. Attempts are spaced by a
+// jittered backoff.
+func (cf *ChunkFetcher) FetchChunkFailover(ctx context.Context, hash, repoID string, topic *pubsub.Topic, first peer.ID) ([]byte, error) {
+	var err error
+	providers, hinted := cf.candidates(hash, first)
+	for i, provider := range providers {
+		if i > 0 {
+			cf.metrics.ChunkFetchRetries.Add(1)
+			pause := time.NewTimer(retryDelay(i - 1))
+			select {
+			case <-pause.C:
+			case <-ctx.Done():
+				pause.Stop()
+				return nil, ctx.Err()
+			}
+		}
+		var data []byte
+		data, err = cf.fetchFrom(ctx, hash, repoID, topic, cf.self.String(), provider)
+		if err == nil || ctx.Err() != nil {
+			if err == nil && hinted[provider] {
+				cf.metrics.LocationHintHits.Add(1)
+			}
+			return data, err
+		}
+		if hinted[provider] && !errors.Is(err, ErrFetchStale) {
+			pid, _ := peer.Decode(provider)
+			cf.locations.Forget(pid, hash)
+		}
+	}
+	return nil, err
+}
+
+// candidates returns the providers to ask for hash in turn, "" standing for
+// every peer, and which of them were hinted by the chunk's locations
+func (cf *ChunkFetcher) candidates(hash string, first peer.ID) ([]string, map[string]bool) {
+	var out []string
+	hinted := make(map[string]bool)
+	seen := map[peer.ID]bool{cf.self: true}
+	add := func(p peer.ID) bool {
+		if p != "" && !seen[p] && len(out) < cf.attempts-1 {
+			seen[p] = true
+			out = append(out, p.String())
+			return true
+		}
+		return false
+	}
+	var connected []peer.ID
+	if cf.providers != nil {
+		connected = cf.providers()
+	}
+	// Cache nodes are on our network and fetch what they lack themselves
+	if cf.host != nil {
+		for _, p := range connected {
+			if IsCacheNode(cf.host, p) {
+				add(p)
+			}
+		}
+	}
+	add(first)
+	// Hints only help while the peer is there to ask
+	if cf.locations != nil {
+		online := make(map[peer.ID]bool, len(connected))
+		for _, p := range connected {
+			online[p] = true
+		}
+		for _, p := range cf.locations.Lookup(hash) {
+			if online[p] && add(p) {
+				hinted[p.String()] = true
+			}
+		}
+	}
+	for _, p := range connected {
+		add(p)
+	}
+	return append(out, ""), hinted
+}
+
+// fetchFrom publishes one request for a chunk, answered only by provider
+// unless it is empty, and waits for the response. A fetch of a chunk already
+// requested waits for that request instead.
+func (cf *ChunkFetcher) fetchFrom(ctx context.Context, hash, repoID string, topic *pubsub.Topic, peerID, provider string) ([]byte, error) {
 	logger := monitoring.GetLogger().WithField("chunk_hash", hash)
 	logger.Debug("Fetching chunk from peers")
 
@@ -57,16 +202,57 @@ func (cf *ChunkFetcher) FetchChunk(ctx context.Context, hash string, topic *pubs
 		return data, nil
 	}
 
+	f, leader := cf.joinFlight(hash)
+	if !leader {
+		logger.Debug("Waiting for chunk request already in flight")
+		return f.wait(ctx)
+	}
+	data, err := cf.request(ctx, f, hash, repoID, topic, peerID, provider)
+	cf.endFlight(hash, f, data, err)
+	return data, err
+}
+
+// request asks provider, or every peer when empty, for the chunk of flight
+// f. Peers speaking ChunkProtocol are asked over a stream; the others, if
+// p2p.chunk_pubsub allows, by a request published on topic.
+func (cf *ChunkFetcher) request(ctx context.Context, f *fetchFlight, hash, repoID string, topic *pubsub.Topic, peerID, provider string) ([]byte, error) {
+	if cf.host != nil {
+		pid, err := peer.Decode(provider)
+		switch {
+		case provider == "" && !cf.legacy:
+			return cf.requestAll(ctx, hash, repoID)
+		case provider == "":
+		case err != nil:
+			return nil, err
+		case IsCacheNode(cf.host, pid):
+			return cf.requestStream(ctx, pid, CacheProtocol, hash, repoID)
+		case speaks(cf.host, pid, ChunkProtocol) || !cf.legacy:
+			data, err := cf.requestStream(ctx, pid, ChunkProtocol, hash, repoID)
+			if err == nil || !cf.legacy || !errors.Is(err, errChunkStream) {
+				return data, err
+			}
+		}
+		cf.metrics.LegacyChunkRequestsSent.Add(1)
+	}
+	return cf.publish(ctx, f, hash, repoID, topic, peerID, provider)
+}
+
+// publish publishes a request for the chunk of flight f on topic and waits
+// for its response
+func (cf *ChunkFetcher) publish(ctx context.Context, f *fetchFlight, hash, repoID string, topic *pubsub.Topic, peerID, provider string) ([]byte, error) {
+	logger := monitoring.GetLogger().WithField("chunk_hash", hash)
+
 	// Create request
 	req := &protocol.ChunkRequest{
 		Hash:      hash,
 		Requestor: peerID,
+		RepoID:    repoID,
 		SignerPub: base64.StdEncoding.EncodeToString(cf.signerPub),
+		Provider:  provider,
 	}
 
 	// Sign request
-	payload := req.Hash + "|" + req.Requestor
-	sig := crypto.Sign([]byte(payload), cf.signerPriv)
+	sig := crypto.Sign(req.SigningPayload(), cf.signerPriv)
 	req.Signature = base64.StdEncoding.EncodeToString(sig)
 
 	// Encode request
@@ -78,11 +264,6 @@ func (cf *ChunkFetcher) FetchChunk(ctx context.Context, hash string, topic *pubs
 		return nil, fmt.Errorf("failed to encode request: %w", err)
 	}
 
-	// Create response channel
-	respChan := make(chan []byte, 1)
-	cf.pendingFetches.Store(hash, respChan)
-	defer cf.pendingFetches.Delete(hash)
-
 	// Publish request
 	if err := topic.Publish(ctx, reqBytes); err != nil {
 		logger.WithError(err).Error("Failed to publish chunk request")
@@ -93,28 +274,54 @@ func (cf *ChunkFetcher) FetchChunk(ctx context.Context, hash string, topic *pubs
 	cf.metrics.RecordChunkRequest(true, false)
 	logger.Debug("Chunk request published")
 
-	// Wait for response with timeout
+	// Wait for response with a timeout fitting the provider's link
+	sent := time.Now()
+	timeout := cf.timer.timeout(provider)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 	select {
-	case data := <-respChan:
+	case data := <-f.resp:
 		logger.Debug("Chunk received from peer")
+		cf.timer.observe(provider, len(data), time.Since(sent))
 		return data, nil
-	case <-time.After(cf.timeout):
-		logger.Warn("Chunk fetch timeout")
+	case <-timer.C:
+		logger.WithField("timeout", timeout.String()).Warn("Chunk fetch timeout")
 		cf.metrics.RecordChunkRequest(true, true)
+		cf.timer.timedOut(provider)
 		return nil, errors.New("chunk fetch timeout")
+	case <-f.done:
+		return nil, ErrFetchStale
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
 }
 
-// HandleChunkResponse processes a chunk response
-func (cf *ChunkFetcher) HandleChunkResponse(resp *protocol.ChunkResponse) error {
+// HandleChunkResponse processes a chunk response published by from
+func (cf *ChunkFetcher) HandleChunkResponse(resp *protocol.ChunkResponse, from peer.ID) error {
 	logger := monitoring.GetLogger().WithField("chunk_hash", resp.Hash)
 
+	if cf.host != nil && !cf.legacy {
+		cf.metrics.LegacyChunkMessagesDropped.Add(1)
+		return nil
+	}
+
+	// Bound memory before decoding
+	if base64.StdEncoding.DecodedLen(len(resp.Data)) > cf.maxChunkSize {
+		logger.Warn("Oversize chunk response dropped")
+		cf.metrics.RecordMessageDropped()
+		return ErrChunkTooLarge
+	}
+
+	// Responses are broadcast; ignore chunks of repositories we do not hold
+	if !cf.acceptsRepository(resp.RepoID) {
+		logger.Debugf("Ignoring chunk of repository %q", resp.RepoID)
+		return ErrForeignRepository
+	}
+
 	// Validate response
 	if err := resp.Validate(); err != nil {
 		logger.WithError(err).Warn("Invalid chunk response signature")
-		return fmt.Errorf("invalid chunk response: %w", err)
+		return fmt.Errorf("invalid chunk response: %w: %v", ErrInvalidSignature, err)
 	}
 
 	// Decode chunk data
@@ -128,22 +335,15 @@ func (cf *ChunkFetcher) HandleChunkResponse(resp *protocol.ChunkResponse) error
 	actualHash := hex.EncodeToString(crypto.Hash(data))
 	if actualHash != resp.Hash {
 		logger.Errorf("Chunk hash mismatch: expected %s, got %s", resp.Hash, actualHash)
-		return errors.New("chunk hash mismatch")
+		return ErrChunkHashMismatch
 	}
 
-	// Store chunk
-	if err := cf.store.Put(resp.Hash, data); err != nil {
-		logger.WithError(err).Error("Failed to store chunk")
-		return fmt.Errorf("failed to store chunk: %w", err)
+	if err := cf.received(resp.Hash, resp.RepoID, resp.SignerPub, from, data); err != nil {
+		return err
 	}
 
 	// Notify waiting fetchers
-	if ch, ok := cf.pendingFetches.Load(resp.Hash); ok {
-		select {
-		case ch.(chan []byte) <- data:
-		default:
-		}
-	}
+	cf.deliver(resp.Hash, data)
 
 	logger.Debug("Chunk response processed successfully")
 	return nil
@@ -153,20 +353,47 @@ func (cf *ChunkFetcher) HandleChunkResponse(resp *protocol.ChunkResponse) error
 func (cf *ChunkFetcher) HandleChunkRequest(ctx context.Context, req *protocol.ChunkRequest, topic *pubsub.Topic) error {
 	logger := monitoring.GetLogger().WithField("chunk_hash", req.Hash)
 
+	if cf.host != nil && !cf.legacy {
+		cf.metrics.LegacyChunkMessagesDropped.Add(1)
+		return nil
+	}
 	cf.metrics.RecordChunkRequest(false, false)
+	cf.metrics.LegacyChunkRequestsReceived.Add(1)
 
 	// Validate request
 	if err := req.Validate(); err != nil {
 		logger.WithError(err).Warn("Invalid chunk request signature")
 		cf.metrics.RecordChunkRequest(false, true)
-		return fmt.Errorf("invalid chunk request: %w", err)
+		return fmt.Errorf("invalid chunk request: %w: %v", ErrInvalidSignature, err)
+	}
+
+	// Requests addressed to another provider are theirs to answer
+	if req.Provider != "" && req.Provider != cf.self.String() {
+		return nil
+	}
+
+	// Only serve chunks of our own repository
+	if req.RepoID != cf.repoID {
+		logger.Debugf("Ignoring chunk request for repository %q", req.RepoID)
+		return nil
+	}
+
+	// Other providers answer while we are over our resource limits
+	if cf.Shedding() {
+		cf.metrics.ChunkRequestsShed.Add(1)
+		logger.Debug("Chunk request shed")
+		return nil
 	}
 
-	// Get chunk from storage
-	data, err := cf.store.Get(req.Hash)
+	// Get chunk from storage, or memory when peers keep asking for it
+	data, err := cf.store.Serve(req.Hash)
 	if err != nil {
-		logger.WithError(err).Debug("Chunk not found in local storage")
 		// Don't respond if we don't have the chunk
+		if sverrors.GetErrorCode(err) == sverrors.ErrCodeChunkNotFound {
+			logger.Debug("Chunk not found in local storage")
+		} else {
+			logger.WithError(err).Warn("Failed to read requested chunk")
+		}
 		return nil
 	}
 
@@ -174,12 +401,12 @@ func (cf *ChunkFetcher) HandleChunkRequest(ctx context.Context, req *protocol.Ch
 	resp := &protocol.ChunkResponse{
 		Hash:      req.Hash,
 		Data:      base64.StdEncoding.EncodeToString(data),
+		RepoID:    cf.repoID,
 		SignerPub: base64.StdEncoding.EncodeToString(cf.signerPub),
 	}
 
 	// Sign response
-	payload := resp.Hash + "|" + resp.Data
-	sig := crypto.Sign([]byte(payload), cf.signerPriv)
+	sig := crypto.Sign(resp.SigningPayload(), cf.signerPriv)
 	resp.Signature = base64.StdEncoding.EncodeToString(sig)
 
 	// Encode response
@@ -231,7 +458,7 @@ func (ss *SnapshotSyncer) BroadcastSnapshot(ctx context.Context, snapshot *versi
 
 	// Create announcement
 	announcement := &protocol.SnapshotAnnouncement{
-		Snapshot: *snapshot,
+		Snapshot: *snapshot.Public(),
 	}
 
 	// Encode announcement
@@ -255,6 +482,83 @@ func (ss *SnapshotSyncer) BroadcastSnapshot(ctx context.Context, snapshot *versi
 	return nil
 }
 
+// BroadcastSnapshotHeader announces snapshot by its signed header only.
+// Peers that want it fetch the manifest over ManifestProtocol.
+func (ss *SnapshotSyncer) BroadcastSnapshotHeader(ctx context.Context, snapshot *versioning.Snapshot, topic *pubsub.Topic) error {
+	logger := monitoring.GetLogger().WithField("snapshot_id", snapshot.ID)
+
+	hdr, err := protocol.NewSnapshotHeader(snapshot, ss.signerPriv)
+	if err != nil {
+		return fmt.Errorf("failed to build snapshot header: %w", err)
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"type":   "snapshot_header",
+		"header": hdr,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot header: %w", err)
+	}
+	if err := topic.Publish(ctx, data); err != nil {
+		logger.WithError(err).Error("Failed to publish snapshot header")
+		return fmt.Errorf("failed to publish snapshot header: %w", err)
+	}
+
+	ss.metrics.RecordMessageSent()
+	logger.Infof("Snapshot header announced (%d bytes, %d chunks)", len(data), hdr.Chunks)
+	return nil
+}
+
+// HandleSnapshotHeader fetches the manifest of an announced snapshot, from
+// the announcer first and then from other providers, and fetches its
+// missing chunks.
+func (ss *SnapshotSyncer) HandleSnapshotHeader(ctx context.Context, hdr *protocol.SnapshotHeader, h host.Host, topic *pubsub.Topic, from peer.ID) error {
+	logger := monitoring.GetLogger().WithField("snapshot_id", hdr.ID)
+
+	if err := hdr.Validate(); err != nil {
+		return fmt.Errorf("invalid snapshot header: %w: %v", ErrInvalidSignature, err)
+	}
+	if !ss.fetcher.acceptsRepository(hdr.RepoID) {
+		logger.Infof("Ignoring snapshot of foreign repository %q", hdr.RepoID)
+		return nil
+	}
+
+	go func() {
+		var err error
+		for _, pid := range ss.manifestProviders(from) {
+			fctx, cancel := context.WithTimeout(ctx, ss.fetcher.timeout)
+			var snap *versioning.Snapshot
+			snap, err = FetchManifest(fctx, h, pid, hdr)
+			cancel()
+			if err == nil {
+				logger.Infof("Fetched manifest of announced snapshot from %s", pid)
+				ss.fetchMissingChunks(ctx, snap, topic, from.String())
+				return
+			}
+			logger.WithError(err).Debugf("Manifest not fetched from %s", pid)
+		}
+		logger.WithError(err).Warn("Failed to fetch manifest of announced snapshot")
+	}()
+	return nil
+}
+
+// manifestProviders returns the announcer and then the best scored other
+// peers, as many as a chunk fetch would ask
+func (ss *SnapshotSyncer) manifestProviders(announcer peer.ID) []peer.ID {
+	out := []peer.ID{announcer}
+	if ss.fetcher.providers == nil {
+		return out
+	}
+	for _, p := range ss.fetcher.providers() {
+		if len(out) >= ss.fetcher.attempts {
+			break
+		}
+		if p != announcer && p != ss.fetcher.self {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
 // HandleSnapshotAnnouncement processes a snapshot announcement
 func (ss *SnapshotSyncer) HandleSnapshotAnnouncement(ctx context.Context, ann *protocol.SnapshotAnnouncement, topic *pubsub.Topic, peerID string, db interface{}) error {
 	logger := monitoring.GetLogger().WithField("snapshot_id", ann.Snapshot.ID)
@@ -263,7 +567,13 @@ func (ss *SnapshotSyncer) HandleSnapshotAnnouncement(ctx context.Context, ann *p
 	// Validate announcement
 	if err := ann.Validate(); err != nil {
 		logger.WithError(err).Warn("Invalid snapshot announcement signature")
-		return fmt.Errorf("invalid announcement: %w", err)
+		return fmt.Errorf("invalid announcement: %w: %v", ErrInvalidSignature, err)
+	}
+
+	// Never mix another repository's snapshots into ours unless importing
+	if !ss.fetcher.acceptsRepository(ann.Snapshot.RepoID) {
+		logger.Infof("Ignoring snapshot of foreign repository %q", ann.Snapshot.RepoID)
+		return nil
 	}
 
 	// Check if we already have this snapshot
@@ -276,18 +586,24 @@ func (ss *SnapshotSyncer) HandleSnapshotAnnouncement(ctx context.Context, ann *p
 	return nil
 }
 
-// fetchMissingChunks fetches chunks that are missing locally
+// fetchMissingChunks fetches chunks that are missing locally, failing over
+// between providers. Chunks no provider returned are queued for retry.
 func (ss *SnapshotSyncer) fetchMissingChunks(ctx context.Context, snapshot *versioning.Snapshot, topic *pubsub.Topic, peerID string) {
 	logger := monitoring.GetLogger().WithField("snapshot_id", snapshot.ID)
+	announcer, _ := peer.Decode(peerID)
 
 	// Create semaphore for concurrent fetches
 	sem := make(chan struct{}, ss.fetcher.maxConcurrent)
 	var wg sync.WaitGroup
 
 	missingCount := 0
+	var failed atomic.Int64
 	for _, chunkHash := range snapshot.Chunks {
-		// Check if chunk exists locally
-		if _, err := ss.store.Get(chunkHash); err == nil {
+		// Check if chunk exists locally; only missing ones are fetched
+		if _, err := ss.store.Get(chunkHash); sverrors.GetErrorCode(err) != sverrors.ErrCodeChunkNotFound {
+			if err != nil {
+				logger.WithError(err).Warnf("Failed to check for chunk %s", chunkHash)
+			}
 			continue
 		}
 
@@ -301,13 +617,24 @@ func (ss *SnapshotSyncer) fetchMissingChunks(ctx context.Context, snapshot *vers
 			sem <- struct{}{}
 			defer func() { <-sem }()
 
-			// Fetch chunk
-			if _, err := ss.fetcher.FetchChunk(ctx, hash, topic, peerID); err != nil {
-				logger.WithError(err).Warnf("Failed to fetch chunk %s", hash)
+			_, err := ss.fetcher.FetchChunkFailover(ctx, hash, snapshot.RepoID, topic, announcer)
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			failed.Add(1)
+			logger.WithError(err).Warnf("Failed to fetch chunk %s from any provider", hash)
+			if ss.fetcher.missing != nil {
+				if err := ss.fetcher.missing.Add(hash, snapshot.RepoID, snapshot.ID, err); err != nil {
+					logger.WithError(err).Error("Failed to queue missing chunk")
+				}
 			}
 		}(chunkHash)
 	}
 
 	wg.Wait()
+	if n := failed.Load(); n > 0 {
+		logger.Warnf("Fetched %d of %d missing chunks for snapshot %s, %d queued for retry", int64(missingCount)-n, missingCount, snapshot.ID, n)
+		return
+	}
 	logger.Infof("Finished fetching %d missing chunks for snapshot %s", missingCount, snapshot.ID)
 }
@@ -0,0 +1,212 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/crypto"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/storage"
+	libp2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	peer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+)
+
+// newFetcher returns a chunk fetcher over a fresh store, and its DB
+func newFetcher(t *testing.T) (*ChunkFetcher, *persistence.DB) {
+	t.Helper()
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.EnableSealing(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.New(db, bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, priv, err := crypto.GenerateEd25519Keypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewChunkFetcher(store, pub, priv, 4, 1<<20, time.Second), db
+}
+
+// newPeerID returns the ID of a peer no host runs
+func newPeerID(t *testing.T) peer.ID {
+	t.Helper()
+	_, pub, err := libp2pcrypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// waitJoined waits until n more fetches than before joined a flight
+func waitJoined(t *testing.T, cf *ChunkFetcher, before uint64, n int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for cf.metrics.ChunkFetchesJoined.Load()-before < uint64(n) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d fetches joined the flight", cf.metrics.ChunkFetchesJoined.Load()-before, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConcurrentFetchesShareRequest(t *testing.T) {
+	cf, _ := newFetcher(t)
+	local, remote := newTestHost(t), newTestHost(t)
+	local.Peerstore().AddAddrs(remote.ID(), remote.Addrs(), peerstore.PermanentAddrTTL)
+	cf.SetChunkProtocol(local, false)
+
+	data := []byte("a chunk only the remote peer holds")
+	hash := hex.EncodeToString(crypto.Hash(data))
+	// The remote peer holds its answer back until every fetch has started
+	var requests atomic.Int32
+	asked, release := make(chan struct{}), make(chan struct{})
+	remote.SetStreamHandler(ChunkProtocol, func(s network.Stream) {
+		defer s.Close()
+		if _, err := readPushFrame(s, bufio.NewReader(s)); err != nil {
+			return
+		}
+		if requests.Add(1) == 1 {
+			close(asked)
+		}
+		<-release
+		w := bufio.NewWriter(s)
+		writeChunk(s, w, hash, data)
+		writePushFrame(s, w, &pushFrame{Kind: pullDone})
+	})
+
+	const fetches = 5
+	joined := cf.metrics.ChunkFetchesJoined.Load()
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make(chan result, fetches)
+	fetch := func(provider string) {
+		data, err := cf.fetchFrom(context.Background(), hash, "repo", nil, "", provider)
+		results <- result{data, err}
+	}
+	go fetch(remote.ID().String())
+	<-asked
+	for i := 1; i < fetches; i++ {
+		go fetch(remote.ID().String())
+	}
+	waitJoined(t, cf, joined, fetches-1)
+	close(release)
+
+	for i := 0; i < fetches; i++ {
+		res := <-results
+		if res.err != nil || !bytes.Equal(res.data, data) {
+			t.Fatalf("fetch %d: %d bytes, %v", i, len(res.data), res.err)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("%d fetches of one chunk sent %d requests, want 1", fetches, n)
+	}
+	if n := cf.InFlight(); n != 0 {
+		t.Fatalf("%d flights left after the fetches", n)
+	}
+}
+
+func TestFailoverCandidates(t *testing.T) {
+	cf, db := newFetcher(t)
+	h := newTestHost(t)
+	cf.SetChunkProtocol(h, false)
+	cf.self = h.ID()
+	cf.locations = NewChunkLocations(db)
+
+	hash := hex.EncodeToString(crypto.Hash([]byte("chunk")))
+	cache, first, hinted, offline, best, worst := newPeerID(t), newPeerID(t), newPeerID(t), newPeerID(t), newPeerID(t), newPeerID(t)
+	h.Peerstore().AddProtocols(cache, CacheProtocol)
+	cf.locations.Record(hinted, hash)
+	cf.locations.Record(offline, hash)
+	// Connected peers best scored first; the offline hinted peer is not
+	// connected
+	cf.providers = func() []peer.ID { return []peer.ID{best, h.ID(), hinted, first, cache, worst} }
+
+	cf.attempts = 10
+	got, hints := cf.candidates(hash, first)
+	want := []string{cache.String(), first.String(), hinted.String(), best.String(), worst.String(), ""}
+	if !slices.Equal(got, want) {
+		t.Errorf("candidates %v, want cache, first, hinted, connected, broadcast: %v", got, want)
+	}
+	if len(hints) != 1 || !hints[hinted.String()] {
+		t.Errorf("hinted candidates %v, want only %s", hints, hinted)
+	}
+
+	// Attempts cap the candidates, the last broadcasting
+	cf.attempts = 3
+	got, _ = cf.candidates(hash, first)
+	if want := []string{cache.String(), first.String(), ""}; !slices.Equal(got, want) {
+		t.Errorf("candidates with 3 attempts %v, want %v", got, want)
+	}
+}
+
+func TestFailoverForgetsHints(t *testing.T) {
+	hash := hex.EncodeToString(crypto.Hash([]byte("chunk")))
+	// setup returns a fetcher whose one candidate before the broadcast is a
+	// hinted peer that cannot be reached
+	setup := func(t *testing.T) (*ChunkFetcher, peer.ID) {
+		cf, db := newFetcher(t)
+		h := newTestHost(t)
+		cf.SetChunkProtocol(h, false)
+		cf.self = h.ID()
+		cf.locations = NewChunkLocations(db)
+		cf.attempts = 2
+		hinted := newPeerID(t)
+		cf.locations.Record(hinted, hash)
+		cf.providers = func() []peer.ID { return []peer.ID{hinted} }
+		return cf, hinted
+	}
+
+	t.Run("failed", func(t *testing.T) {
+		cf, hinted := setup(t)
+		if _, err := cf.FetchChunkFailover(context.Background(), hash, "repo", nil, ""); err == nil {
+			t.Fatal("fetched a chunk no peer holds")
+		}
+		if hints := cf.locations.Lookup(hash); slices.Contains(hints, hinted) {
+			t.Fatal("hint kept for a peer that failed to return the chunk")
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		cf, hinted := setup(t)
+		// The hinted fetch waits on a flight that is reaped, which says
+		// nothing about the peer
+		f, _ := cf.joinFlight(hash)
+		joined := cf.metrics.ChunkFetchesJoined.Load()
+		errc := make(chan error, 1)
+		go func() {
+			_, err := cf.FetchChunkFailover(context.Background(), hash, "repo", nil, "")
+			errc <- err
+		}()
+		waitJoined(t, cf, joined, 1)
+		cf.endFlight(hash, f, nil, ErrFetchStale)
+		if err := <-errc; err == nil || errors.Is(err, ErrFetchStale) {
+			t.Fatalf("broadcast after the stale fetch: %v", err)
+		}
+		if hints := cf.locations.Lookup(hash); !slices.Contains(hints, hinted) {
+			t.Fatal("hint dropped after a stale fetch")
+		}
+	})
+}
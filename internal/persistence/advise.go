@@ -0,0 +1,69 @@
+package persistence
+
+import (
+	"os"
+	"unsafe"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Span is a byte range of the database file.
+type Span struct {
+	Off int64
+	Len int64
+}
+
+// Locate returns where v, a value read in tx, lies in the database file.
+// Values of a read transaction point into bbolt's mmap of the file, so the
+// offset is their distance from the start of the mapping.
+func Locate(tx *bolt.Tx, v []byte) (Span, bool) {
+	if len(v) == 0 || tx.Writable() {
+		return Span{}, false
+	}
+	off := int64(uintptr(unsafe.Pointer(&v[0])) - tx.DB().Info().Data)
+	if off < 0 || off+int64(len(v)) > tx.Size() {
+		return Span{}, false
+	}
+	return Span{Off: off, Len: int64(len(v))}, true
+}
+
+// WillNeed tells the OS that spans will be read soon, in the given order,
+// so it reads them into the page cache ahead of the mmap faults. It is a
+// hint: platforms without readahead advice ignore it.
+func (d *DB) WillNeed(spans []Span) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	f, err := os.Open(d.db.Path())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, s := range coalesce(spans) {
+		if err := willNeed(f, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// coalesce merges spans that touch the same or adjacent pages, keeping order
+func coalesce(spans []Span) []Span {
+	page := int64(os.Getpagesize())
+	var out []Span
+	for _, s := range spans {
+		start := s.Off &^ (page - 1)
+		end := (s.Off + s.Len + page - 1) &^ (page - 1)
+		if n := len(out); n > 0 {
+			last := &out[n-1]
+			if start >= last.Off && start <= last.Off+last.Len {
+				if end > last.Off+last.Len {
+					last.Len = end - last.Off
+				}
+				continue
+			}
+		}
+		out = append(out, Span{Off: start, Len: end - start})
+	}
+	return out
+}
@@ -0,0 +1,11 @@
+package persistence
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func willNeed(f *os.File, s Span) error {
+	return unix.Fadvise(int(f.Fd()), s.Off, s.Len, unix.FADV_WILLNEED)
+}
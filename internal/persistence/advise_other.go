@@ -0,0 +1,9 @@
+//go:build !linux
+
+package persistence
+
+import "os"
+
+func willNeed(f *os.File, s Span) error {
+	return nil
+}
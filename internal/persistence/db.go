@@ -1,20 +1,49 @@
 package persistence
 
 import (
+	"sync/atomic"
 	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
 
 const (
-	BucketBlocks    = "blocks"
-	BucketSnapshots = "snapshots"
-	BucketPeers     = "peers"
-	BucketACLs      = "acls"
+	BucketBlocks     = "blocks"
+	BucketSnapshots  = "snapshots"
+	BucketPeers      = "peers"
+	BucketACLs       = "acls"
+	BucketRecovery   = "recovery"
+	BucketQuarantine = "quarantine"
+	BucketSnapIndex  = "snapshot_index"
+	BucketMeta       = "meta"
+	BucketPins       = "pins"
+	BucketMirrors    = "mirrors"
+	BucketSeeding    = "seeding"
+	BucketSeedFiles  = "seed_files"
+	BucketFileIndex  = "file_index"
+	BucketChunkIndex = "chunk_index"
+	BucketGCRuns     = "gc_runs"
+	BucketMissing    = "missing_chunks"
+	BucketBadChunks  = "quarantined_chunks"
+	BucketOffers     = "storage_offers"
+	BucketShares     = "share_links"
+	BucketRemoved    = "removed_peers"
+	BucketPlacements = "placements"
+	BucketImports    = "imports"
+	BucketScanFiles  = "scan_checkpoint"
+	BucketVerifyPass = "verify_pass"
+	BucketDicts      = "compression_dicts"
+	BucketLocations  = "chunk_locations"
+	BucketPackIndex  = "pack_index"
+	BucketPacks      = "packs"
+	BucketGCPending  = "gc_pending"
+	BucketHolds      = "snapshot_holds"
+	BucketPendingOps = "pending_ops"
 )
 
 type DB struct {
-	db *bolt.DB
+	db     *bolt.DB
+	sealer atomic.Pointer[sealer] // set by EnableSealing
 }
 
 func Open(path string) (*DB, error) {
@@ -23,7 +52,7 @@ func Open(path string) (*DB, error) {
 		return nil, err
 	}
 	err = b.Update(func(tx *bolt.Tx) error {
-		for _, bucket := range []string{BucketBlocks, BucketSnapshots, BucketPeers, BucketACLs} {
+		for _, bucket := range []string{BucketBlocks, BucketSnapshots, BucketPeers, BucketACLs, BucketRecovery, BucketQuarantine, BucketSnapIndex, BucketMeta, BucketPins, BucketMirrors, BucketSeeding, BucketSeedFiles, BucketFileIndex, BucketChunkIndex, BucketGCRuns, BucketMissing, BucketBadChunks, BucketOffers, BucketShares, BucketRemoved, BucketPlacements, BucketImports, BucketScanFiles, BucketVerifyPass, BucketDicts, BucketLocations, BucketPackIndex, BucketPacks, BucketGCPending, BucketHolds, BucketPendingOps} {
 			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
 				return err
 			}
@@ -47,3 +76,22 @@ func (d *DB) Update(fn func(tx *bolt.Tx) error) error {
 func (d *DB) Close() error {
 	return d.db.Close()
 }
+
+// Stats describe the metadata DB for monitoring.
+type Stats struct {
+	Size      int64 // bytes of the file in use
+	OpenTxs   int   // read transactions open now
+	Txs       int   // read transactions started since it was opened
+	FreePages int   // pages free for reuse, left by deleted data
+}
+
+// Stats returns the current Stats of the DB.
+func (d *DB) Stats() (Stats, error) {
+	bs := d.db.Stats()
+	st := Stats{OpenTxs: bs.OpenTxN, Txs: bs.TxN, FreePages: bs.FreePageN}
+	err := d.db.View(func(tx *bolt.Tx) error {
+		st.Size = tx.Size()
+		return nil
+	})
+	return st, err
+}
@@ -0,0 +1,45 @@
+package persistence_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStats(t *testing.T) {
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	before, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Size == 0 || before.OpenTxs != 0 {
+		t.Fatalf("stats of a new DB: %+v", before)
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		st, err := db.Stats()
+		if err != nil {
+			return err
+		}
+		if st.OpenTxs != 1 {
+			t.Errorf("%d open transactions inside View, want 1", st.OpenTxs)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Txs <= before.Txs {
+		t.Fatalf("transactions started went from %d to %d", before.Txs, after.Txs)
+	}
+}
@@ -0,0 +1,110 @@
+package persistence
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	keyRepositoryID = "repository_id"
+	keyKeySalt      = "key_salt"
+	keyChunker      = "chunker"
+	saltSize        = 16
+)
+
+// ErrRepositoryMismatch is returned when a data directory belongs to a
+// different repository than the configuration expects.
+var ErrRepositoryMismatch = errors.New("repository ID mismatch")
+
+// RepositoryID returns the ID stamped on this repository. On first use it
+// stamps want, or a new random UUID when want is empty. If want is set and
+// differs from the stored ID, ErrRepositoryMismatch is returned.
+func (d *DB) RepositoryID(want string) (string, error) {
+	var id string
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BucketMeta))
+		if v := b.Get([]byte(keyRepositoryID)); v != nil {
+			id = string(v)
+			if want != "" && want != id {
+				return fmt.Errorf("%w: data directory belongs to %s, config expects %s",
+					ErrRepositoryMismatch, id, want)
+			}
+			return nil
+		}
+		id = want
+		if id == "" {
+			var err error
+			if id, err = newUUID(); err != nil {
+				return err
+			}
+		}
+		return b.Put([]byte(keyRepositoryID), []byte(id))
+	})
+	return id, err
+}
+
+// KeySalt returns the salt the master key is derived with, creating a random
+// one on first use. It is not secret, but without it the passphrase cannot
+// reproduce the key.
+func (d *DB) KeySalt() ([]byte, error) {
+	var salt []byte
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BucketMeta))
+		if v := b.Get([]byte(keyKeySalt)); v != nil {
+			salt = append([]byte(nil), v...)
+			return nil
+		}
+		salt = make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		return b.Put([]byte(keyKeySalt), salt)
+	})
+	return salt, err
+}
+
+// SetKeySalt replaces the key salt, as when recovering a repository whose
+// chunks were encrypted under another one.
+func (d *DB) SetKeySalt(salt []byte) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BucketMeta)).Put([]byte(keyKeySalt), salt)
+	})
+}
+
+// Chunker returns the chunking algorithm of this repository. On first use it
+// stamps want, or initial when want is empty; later a non-empty want
+// replaces the stored algorithm. changed reports a replacement.
+func (d *DB) Chunker(want, initial string) (algo string, changed bool, err error) {
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BucketMeta))
+		stored := string(b.Get([]byte(keyChunker)))
+		switch {
+		case want != "":
+			algo = want
+		case stored != "":
+			algo = stored
+		default:
+			algo = initial
+		}
+		if algo == stored {
+			return nil
+		}
+		changed = stored != ""
+		return b.Put([]byte(keyChunker), []byte(algo))
+	})
+	return algo, changed, err
+}
+
+// newUUID returns a random RFC 4122 version 4 UUID
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
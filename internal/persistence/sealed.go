@@ -0,0 +1,303 @@
+package persistence
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/hoangsonww/backupagent/internal/crypto"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/hkdf"
+)
+
+// SealedBuckets hold state that reveals the node's network or what it backs
+// up: stored, pinned, removed and quarantined peers, mirror replication
+// state, where snapshot copies were placed, which peers hold which chunks,
+// the storage offers of peers, share links, the file index and scan and
+// seeding checkpoints naming every backed-up path, recovery shares and
+// requests, and operations awaiting approval. Their keys are replaced by
+// keyed hashes and their values encrypted, both under keys derived from the
+// repository master key, so the metadata DB alone does not leak them.
+//
+// Other buckets stay in the clear for lookups that must not need the key,
+// such as verifying and serving chunks: chunk hashes and their locations,
+// reference counts and GC state, and snapshot records, whose metadata is
+// sealed on its own. Source roots stay visible, as the owner's snapshot
+// records and the per-source settings and seeding progress name them.
+var SealedBuckets = []string{BucketPeers, BucketPins, BucketQuarantine, BucketMirrors, BucketOffers, BucketRemoved, BucketPlacements, BucketLocations,
+	BucketShares, BucketFileIndex, BucketSeedFiles, BucketScanFiles, BucketRecovery, BucketPendingOps}
+
+// firstSealed are the buckets sealed by repositories that predate the record
+// of which buckets are sealed
+var firstSealed = []string{BucketPeers, BucketPins, BucketQuarantine, BucketMirrors, BucketOffers, BucketRemoved, BucketPlacements, BucketLocations}
+
+var (
+	// ErrNotSealed means EnableSealing has not been called
+	ErrNotSealed = errors.New("state encryption key not set")
+	// ErrStateKey means the master key does not decrypt the sealed state
+	ErrStateKey = errors.New("passphrase does not decrypt the repository state")
+)
+
+const (
+	// keyStateCheck holds a known value sealed under the current state key
+	keyStateCheck = "state_check"
+	// keySealedBuckets lists the buckets sealed so far, comma-separated
+	keySealedBuckets = "state_sealed_buckets"
+	stateCheck       = "shadowvault-state-v1"
+	nonceSize        = 12
+)
+
+// sealer derives the state keys from the master key
+type sealer struct {
+	enc []byte // encrypts values
+	mac []byte // hashes keys
+}
+
+func newSealer(master []byte) *sealer {
+	derive := func(info string) []byte {
+		k := make([]byte, 32)
+		io.ReadFull(hkdf.New(sha256.New, master, nil, []byte(info)), k)
+		return k
+	}
+	return &sealer{enc: derive("shadowvault state encryption"), mac: derive("shadowvault state keys")}
+}
+
+func (s *sealer) id(k []byte) []byte {
+	m := hmac.New(sha256.New, s.mac)
+	m.Write(k)
+	return m.Sum(nil)
+}
+
+// sealRecord encrypts k and v together, so the key survives its hashing
+func (s *sealer) sealRecord(k, v []byte) ([]byte, error) {
+	rec := binary.AppendUvarint(nil, uint64(len(k)))
+	rec = append(append(rec, k...), v...)
+	return s.seal(rec)
+}
+
+func (s *sealer) openRecord(sealed []byte) (k, v []byte, err error) {
+	rec, err := s.open(sealed)
+	if err != nil {
+		return nil, nil, err
+	}
+	n, w := binary.Uvarint(rec)
+	if w <= 0 || uint64(len(rec)-w) < n {
+		return nil, nil, ErrStateKey
+	}
+	return rec[w : w+int(n)], rec[w+int(n):], nil
+}
+
+func (s *sealer) seal(v []byte) ([]byte, error) {
+	enc, nonce, err := crypto.Encrypt(v, s.enc)
+	if err != nil {
+		return nil, err
+	}
+	return append(nonce, enc...), nil
+}
+
+func (s *sealer) open(v []byte) ([]byte, error) {
+	if len(v) < nonceSize {
+		return nil, ErrStateKey
+	}
+	plain, err := crypto.Decrypt(v[nonceSize:], s.enc, v[:nonceSize])
+	if err != nil {
+		return nil, ErrStateKey
+	}
+	return plain, nil
+}
+
+// SealedBucket is a bucket of SealedBuckets seen through the state key.
+type SealedBucket struct {
+	b *bolt.Bucket
+	s *sealer
+}
+
+// Sealed opens one of SealedBuckets in tx.
+func (d *DB) Sealed(tx *bolt.Tx, name string) (*SealedBucket, error) {
+	s := d.sealer.Load()
+	if s == nil {
+		return nil, ErrNotSealed
+	}
+	return &SealedBucket{b: tx.Bucket([]byte(name)), s: s}, nil
+}
+
+// Get returns the value of k, or nil if there is none.
+func (b *SealedBucket) Get(k []byte) ([]byte, error) {
+	sealed := b.b.Get(b.s.id(k))
+	if sealed == nil {
+		return nil, nil
+	}
+	_, v, err := b.s.openRecord(sealed)
+	return v, err
+}
+
+// Put stores v under k.
+func (b *SealedBucket) Put(k, v []byte) error {
+	sealed, err := b.s.sealRecord(k, v)
+	if err != nil {
+		return err
+	}
+	return b.b.Put(b.s.id(k), sealed)
+}
+
+// Delete removes k.
+func (b *SealedBucket) Delete(k []byte) error {
+	return b.b.Delete(b.s.id(k))
+}
+
+// ForEach calls fn with every key and value, in no particular order.
+func (b *SealedBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.b.ForEach(func(_, sealed []byte) error {
+		k, v, err := b.s.openRecord(sealed)
+		if err != nil {
+			return err
+		}
+		return fn(k, v)
+	})
+}
+
+// DeleteFunc removes every key for which match returns true. Keys are
+// hashed, so it reads the whole bucket.
+func (b *SealedBucket) DeleteFunc(match func(k []byte) bool) error {
+	var keys [][]byte
+	err := b.ForEach(func(k, _ []byte) error {
+		if match(k) {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnableSealing sets the state key derived from master. The first time,
+// the plaintext records of SealedBuckets are sealed in place; after that
+// master must be the key they were sealed under, and only buckets added to
+// SealedBuckets since are sealed.
+func (d *DB) EnableSealing(master []byte) error {
+	s := newSealer(master)
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(BucketMeta))
+		var done []string
+		if check := meta.Get([]byte(keyStateCheck)); check != nil {
+			plain, err := s.open(check)
+			if err != nil || string(plain) != stateCheck {
+				return ErrStateKey
+			}
+			done = firstSealed
+			if v := meta.Get([]byte(keySealedBuckets)); v != nil {
+				done = strings.Split(string(v), ",")
+			}
+		}
+		var todo []string
+		for _, name := range SealedBuckets {
+			if !slices.Contains(done, name) {
+				todo = append(todo, name)
+			}
+		}
+		if len(todo) == 0 {
+			return nil
+		}
+		plain := func(k, v []byte) ([]byte, []byte, error) { return k, v, nil }
+		if err := rewriteSealed(tx, todo, plain, s); err != nil {
+			return err
+		}
+		if err := meta.Put([]byte(keySealedBuckets), []byte(strings.Join(SealedBuckets, ","))); err != nil {
+			return err
+		}
+		return putStateCheck(meta, s)
+	})
+	if err != nil {
+		return err
+	}
+	d.sealer.Store(s)
+	return nil
+}
+
+// StateSealed reports whether the state has been sealed before.
+func (d *DB) StateSealed() (bool, error) {
+	sealed := false
+	err := d.db.View(func(tx *bolt.Tx) error {
+		sealed = tx.Bucket([]byte(BucketMeta)).Get([]byte(keyStateCheck)) != nil
+		return nil
+	})
+	return sealed, err
+}
+
+// Reseal re-encrypts the sealed state under a key derived from master, as
+// when the master key changes with the key salt.
+func (d *DB) Reseal(master []byte) error {
+	old := d.sealer.Load()
+	if old == nil {
+		return ErrNotSealed
+	}
+	s := newSealer(master)
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		open := func(_, sealed []byte) ([]byte, []byte, error) { return old.openRecord(sealed) }
+		if err := rewriteSealed(tx, SealedBuckets, open, s); err != nil {
+			return err
+		}
+		return putStateCheck(tx.Bucket([]byte(BucketMeta)), s)
+	})
+	if err != nil {
+		return err
+	}
+	d.sealer.Store(s)
+	return nil
+}
+
+// rewriteSealed replaces every record of buckets with one sealed by s. plain
+// recovers a stored record's key and value.
+func rewriteSealed(tx *bolt.Tx, buckets []string, plain func(k, v []byte) ([]byte, []byte, error), s *sealer) error {
+	for _, name := range buckets {
+		type record struct{ k, v []byte }
+		var records []record
+		err := tx.Bucket([]byte(name)).ForEach(func(k, v []byte) error {
+			pk, pv, err := plain(k, v)
+			if err != nil {
+				return err
+			}
+			records = append(records, record{append([]byte(nil), pk...), append([]byte(nil), pv...)})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket([]byte(name)); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket([]byte(name))
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			sealed, err := s.sealRecord(r.k, r.v)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(s.id(r.k), sealed); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func putStateCheck(meta *bolt.Bucket, s *sealer) error {
+	check, err := s.seal([]byte(stateCheck))
+	if err != nil {
+		return err
+	}
+	return meta.Put([]byte(keyStateCheck), check)
+}
@@ -0,0 +1,169 @@
+package persistence_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestSealedBuckets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.db")
+	db, err := persistence.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A peer stored before state encryption existed
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistence.BucketPeers)).Put([]byte("peer-a"), []byte(`{"ID":"peer-a"}`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := bytes.Repeat([]byte{1}, 32)
+	if err := db.EnableSealing(key); err != nil {
+		t.Fatal(err)
+	}
+	get := func(db *persistence.DB, k string) []byte {
+		t.Helper()
+		var v []byte
+		err := db.View(func(tx *bolt.Tx) error {
+			b, err := db.Sealed(tx, persistence.BucketPeers)
+			if err != nil {
+				return err
+			}
+			v, err = b.Get([]byte(k))
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	if v := get(db, "peer-a"); string(v) != `{"ID":"peer-a"}` {
+		t.Fatalf("migrated peer = %q", v)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistence.BucketPeers)).ForEach(func(k, v []byte) error {
+			if bytes.Contains(k, []byte("peer-a")) || bytes.Contains(v, []byte("peer-a")) {
+				t.Error("peer ID stored in the clear")
+			}
+			return nil
+		})
+	})
+
+	// Rekeying keeps records reachable by their original keys
+	newKey := bytes.Repeat([]byte{2}, 32)
+	if err := db.Reseal(newKey); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = persistence.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.EnableSealing(key); !errors.Is(err, persistence.ErrStateKey) {
+		t.Fatalf("old key after reseal: %v", err)
+	}
+	if err := db.EnableSealing(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if v := get(db, "peer-a"); string(v) != `{"ID":"peer-a"}` {
+		t.Fatalf("resealed peer = %q", v)
+	}
+	var keys []string
+	db.View(func(tx *bolt.Tx) error {
+		b, _ := db.Sealed(tx, persistence.BucketPeers)
+		return b.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	if len(keys) != 1 || keys[0] != "peer-a" {
+		t.Fatalf("ForEach keys = %v", keys)
+	}
+}
+
+func TestSealAddedBuckets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.db")
+	db, err := persistence.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{1}, 32)
+	if err := db.EnableSealing(key); err != nil {
+		t.Fatal(err)
+	}
+	// A repository sealed before the file index was: it has no record of
+	// the sealed buckets and a plaintext index entry
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(persistence.BucketMeta)).Delete([]byte("state_sealed_buckets")); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(persistence.BucketFileIndex)).Put([]byte("/home/user\x00/home/user/secret"), []byte(`[{"name":"plan.txt"}]`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = persistence.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.EnableSealing(key); err != nil {
+		t.Fatal(err)
+	}
+	var v []byte
+	err = db.View(func(tx *bolt.Tx) error {
+		b, err := db.Sealed(tx, persistence.BucketFileIndex)
+		if err != nil {
+			return err
+		}
+		v, err = b.Get([]byte("/home/user\x00/home/user/secret"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != `[{"name":"plan.txt"}]` {
+		t.Fatalf("migrated index entry = %q", v)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistence.BucketFileIndex)).ForEach(func(k, v []byte) error {
+			if bytes.Contains(k, []byte("secret")) || bytes.Contains(v, []byte("plan.txt")) {
+				t.Error("file index stored in the clear")
+			}
+			return nil
+		})
+	})
+
+	// Buckets already sealed are not sealed twice
+	db.Close()
+	db, err = persistence.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.EnableSealing(key); err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		b, err := db.Sealed(tx, persistence.BucketFileIndex)
+		if err != nil {
+			return err
+		}
+		v, err = b.Get([]byte("/home/user\x00/home/user/secret"))
+		return err
+	})
+	if err != nil || string(v) != `[{"name":"plan.txt"}]` {
+		t.Fatalf("index entry after reopening = %q, %v", v, err)
+	}
+}
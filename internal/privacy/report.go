@@ -0,0 +1,242 @@
+package privacy
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/hoangsonww/backupagent/config"
+)
+
+// Severity ranks how much a leak reveals about the node or its data.
+type Severity string
+
+const (
+	SeverityHigh   Severity = "high"
+	SeverityMedium Severity = "medium"
+	SeverityLow    Severity = "low"
+)
+
+// Audiences that can observe node metadata
+const (
+	AudiencePeers   = "pubsub peers"
+	AudienceDHT     = "DHT"
+	AudienceNetwork = "network"
+	AudienceRelays  = "relays"
+)
+
+// gcmOverhead is the nonce and tag AES-GCM adds to every stored chunk.
+const gcmOverhead = 12 + 16
+
+// Finding is one piece of metadata the node exposes, and to whom.
+type Finding struct {
+	Audience  string   `json:"audience"`
+	Leak      string   `json:"leak"`
+	Severity  Severity `json:"severity"`
+	Detail    string   `json:"detail"`
+	Hardening []string `json:"hardening,omitempty"`
+}
+
+// Report lists what the node leaks under a given configuration.
+type Report struct {
+	Findings []Finding `json:"findings"`
+}
+
+// Generate inspects cfg and reports the metadata the agent exposes to peers,
+// the DHT and the network when running with it.
+func Generate(cfg *config.Config) *Report {
+	r := &Report{}
+
+	r.add(Finding{
+		Audience: AudiencePeers,
+		Leak:     "chunk hashes",
+		Severity: SeverityHigh,
+		Detail: "Chunk IDs are unkeyed SHA-256 hashes of plaintext. Every chunk_request " +
+			"broadcasts them to all pubsub peers and manifests list them, so a peer holding a " +
+			"known file can confirm you back it up.",
+		Hardening: []string{
+			"keyed chunk IDs (HMAC with a repository secret) would make hashes unlinkable to content",
+			"share the swarm only with peers you would trust with your file list",
+		},
+	})
+
+	if cfg.Snapshot.PlainMetadata {
+		r.add(Finding{
+			Audience: AudiencePeers,
+			Leak:     "snapshot manifests",
+			Severity: SeverityHigh,
+			Detail: "Snapshot headers broadcast the snapshot ID, parent ID, timestamp, chunk count, " +
+				"repository ID and signer public key. The manifest, with the full chunk list and meta.source " +
+				"(the absolute path that was backed up) and meta.host, is served to any peer that is not quarantined.",
+			Hardening: []string{
+				"unset snapshot.plain_metadata once every peer understands sealed metadata",
+				"snapshot directories whose path does not reveal personal information",
+			},
+		})
+	} else {
+		r.add(Finding{
+			Audience: AudiencePeers,
+			Leak:     "snapshot manifests",
+			Severity: SeverityMedium,
+			Detail: "Snapshot headers broadcast the snapshot ID, parent ID, timestamp, chunk count, " +
+				"repository ID and signer public key. The manifest, with the full chunk list, is served to any " +
+				"peer that is not quarantined; its source path and host are sealed under the repository key.",
+		})
+	}
+
+	r.add(Finding{
+		Audience: AudiencePeers,
+		Leak:     "data sizes",
+		Severity: SeverityMedium,
+		Detail: fmt.Sprintf("Chunk responses are plaintext size + %d bytes. With content-defined "+
+			"chunking between %d and %d bytes (avg %d), chunk counts and sizes outline file sizes "+
+			"and edit patterns.", gcmOverhead, cfg.Snapshot.MinChunkSize, cfg.Snapshot.MaxChunkSize,
+			cfg.Snapshot.AvgChunkSize),
+		Hardening: []string{
+			"padding chunks to max_chunk_size would hide individual chunk sizes",
+		},
+	})
+
+	if cfg.Scheduler.EnableAutoBackup {
+		r.add(Finding{
+			Audience: AudiencePeers,
+			Leak:     "backup timing",
+			Severity: SeverityMedium,
+			Detail: fmt.Sprintf("Automatic backups of %d path(s) announce a snapshot every %s, "+
+				"revealing when this node is online and how often the data changes.",
+				len(cfg.Scheduler.BackupPaths), cfg.Scheduler.BackupInterval),
+			Hardening: []string{
+				"add random jitter to scheduler.backup_interval",
+			},
+		})
+	} else {
+		r.add(Finding{
+			Audience: AudiencePeers,
+			Leak:     "backup timing",
+			Severity: SeverityLow,
+			Detail:   "Manual snapshots are announced immediately, revealing when the operator is active.",
+		})
+	}
+
+	r.add(Finding{
+		Audience: AudienceDHT,
+		Leak:     "swarm membership and addresses",
+		Severity: SeverityHigh,
+		Detail: "The node joins the Kademlia DHT and advertises the \"backupagent\" rendezvous, " +
+			"so anyone querying the DHT can enumerate ShadowVault nodes and their addresses.",
+		Hardening: []string{
+			"a private network (libp2p pre-shared key) would keep the node out of the public DHT",
+			"rely on peer_bootstrap instead of DHT discovery",
+		},
+	})
+
+	r.add(Finding{
+		Audience: AudienceNetwork,
+		Leak:     "public listen address",
+		Severity: SeverityMedium,
+		Detail: fmt.Sprintf("The node listens on 0.0.0.0:%d and always requests a UPnP/NAT-PMP "+
+			"port mapping, making it directly reachable from the internet.", cfg.ListenPort),
+		Hardening: []string{
+			"relay-only operation would hide the node's IP from peers it does not dial",
+			"firewall listen_port to known peer addresses",
+		},
+	})
+
+	if cfg.NATTraversal.EnableAutoRelay {
+		r.add(Finding{
+			Audience: AudienceRelays,
+			Leak:     "connection metadata",
+			Severity: SeverityLow,
+			Detail: "AutoRelay is enabled; relay nodes see which peer IDs this node talks to " +
+				"and how much traffic flows, though not the content.",
+			Hardening: []string{
+				"set nat_traversal.enable_auto_relay: false if the node is directly reachable",
+			},
+		})
+	}
+
+	if n := len(cfg.PeerBootstrap); n > 0 {
+		r.add(Finding{
+			Audience: AudienceNetwork,
+			Leak:     "startup presence",
+			Severity: SeverityLow,
+			Detail:   fmt.Sprintf("%d bootstrap peer(s) learn this node's address and uptime on every start.", n),
+		})
+	}
+
+	if cfg.P2P.PEXTrust != "none" {
+		r.add(Finding{
+			Audience: AudiencePeers,
+			Leak:     "peer graph",
+			Severity: SeverityMedium,
+			Detail: fmt.Sprintf("Peer exchange gossips a signed list of the peers this node is connected "+
+				"to, with their addresses, every %s.", cfg.P2P.PEXInterval),
+			Hardening: []string{
+				"set p2p.pex_trust: none and distribute peers with peerctl add instead",
+			},
+		})
+	}
+
+	r.add(Finding{
+		Audience: AudiencePeers,
+		Leak:     "stable identity",
+		Severity: SeverityMedium,
+		Detail: "The libp2p identity is persistent and every signed message carries the same " +
+			"ed25519 public key, so activity is linkable across IP address changes.",
+	})
+
+	if n := len(cfg.Recovery.TrustedPeers); n > 0 {
+		r.add(Finding{
+			Audience: AudiencePeers,
+			Leak:     "recovery trustees",
+			Severity: SeverityLow,
+			Detail: fmt.Sprintf("Key share messages are gossiped to all peers, revealing the %d "+
+				"trustee public keys (threshold %d). Share contents are sealed.", n, cfg.Recovery.Threshold),
+		})
+	}
+
+	if len(cfg.ACL.Admins) > 0 || cfg.ACL.TwoPersonRule {
+		r.add(Finding{
+			Audience: AudiencePeers,
+			Leak:     "admin set",
+			Severity: SeverityLow,
+			Detail: "Admin key updates, revocation lists and operation proposals are gossiped, " +
+				"revealing which keys administer the swarm.",
+		})
+	}
+
+	return r
+}
+
+func (r *Report) add(f Finding) {
+	r.Findings = append(r.Findings, f)
+}
+
+// Count returns the number of findings with the given severity.
+func (r *Report) Count(s Severity) int {
+	n := 0
+	for _, f := range r.Findings {
+		if f.Severity == s {
+			n++
+		}
+	}
+	return n
+}
+
+// WriteText renders the report for a terminal.
+func (r *Report) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Privacy report: %d finding(s) (%d high, %d medium, %d low)\n",
+		len(r.Findings), r.Count(SeverityHigh), r.Count(SeverityMedium), r.Count(SeverityLow))
+
+	for i, f := range r.Findings {
+		fmt.Fprintf(&b, "\n%d. [%s] %s -> %s\n", i+1, f.Severity, f.Leak, f.Audience)
+		fmt.Fprintf(&b, "   %s\n", f.Detail)
+		for _, h := range f.Hardening {
+			fmt.Fprintf(&b, "   hardening: %s\n", h)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
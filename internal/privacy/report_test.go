@@ -0,0 +1,51 @@
+package privacy_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/config"
+	"github.com/hoangsonww/backupagent/internal/privacy"
+)
+
+func findLeak(r *privacy.Report, leak string) *privacy.Finding {
+	for i := range r.Findings {
+		if r.Findings[i].Leak == leak {
+			return &r.Findings[i]
+		}
+	}
+	return nil
+}
+
+func TestReportFollowsConfig(t *testing.T) {
+	cfg := &config.Config{ListenPort: 9000}
+	cfg.Scheduler.EnableAutoBackup = true
+	cfg.Scheduler.BackupInterval = time.Hour
+
+	r := privacy.Generate(cfg)
+	if f := findLeak(r, "backup timing"); f == nil || f.Severity != privacy.SeverityMedium {
+		t.Fatalf("expected medium backup timing finding with auto backup, got %+v", f)
+	}
+	if findLeak(r, "connection metadata") != nil {
+		t.Fatal("relay finding reported with auto relay disabled")
+	}
+	if f := findLeak(r, "snapshot manifests"); f == nil || f.Severity != privacy.SeverityMedium {
+		t.Fatalf("expected medium manifest finding with sealed metadata, got %+v", f)
+	}
+
+	cfg.Scheduler.EnableAutoBackup = false
+	cfg.NATTraversal.EnableAutoRelay = true
+	r = privacy.Generate(cfg)
+	if f := findLeak(r, "backup timing"); f == nil || f.Severity != privacy.SeverityLow {
+		t.Fatalf("expected low backup timing finding without auto backup, got %+v", f)
+	}
+	if findLeak(r, "connection metadata") == nil {
+		t.Fatal("missing relay finding with auto relay enabled")
+	}
+
+	cfg.Snapshot.PlainMetadata = true
+	r = privacy.Generate(cfg)
+	if f := findLeak(r, "snapshot manifests"); f == nil || f.Severity != privacy.SeverityHigh {
+		t.Fatalf("expected high manifest finding with plain metadata, got %+v", f)
+	}
+}
@@ -0,0 +1,211 @@
+// Package progress counts the work of a running backup or restore so it can
+// be shown while the job runs: redrawn on the terminal, logged periodically
+// and served with the job's operation by the API.
+package progress
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tracker counts the work of one job. Its methods may be called from
+// several goroutines, and on a nil *Tracker, which counts nothing.
+type Tracker struct {
+	start time.Time
+
+	files, chunks, bytes    atomic.Int64
+	newBytes, dedupBytes    atomic.Int64
+	totalChunks, totalBytes atomic.Int64
+	current                 atomic.Pointer[string]
+}
+
+// New returns a tracker of a job starting now.
+func New() *Tracker {
+	return &Tracker{start: time.Now()}
+}
+
+type trackerKey struct{}
+
+// With returns ctx carrying t, for the job ctx runs to count its work in.
+func With(ctx context.Context, t *Tracker) context.Context {
+	return context.WithValue(ctx, trackerKey{}, t)
+}
+
+// From returns the tracker ctx carries, nil when none.
+func From(ctx context.Context) *Tracker {
+	t, _ := ctx.Value(trackerKey{}).(*Tracker)
+	return t
+}
+
+// Expect sets how many chunks and bytes the job will process, from which
+// the ETA is estimated; 0 leaves either unknown.
+func (t *Tracker) Expect(chunks, bytes int64) {
+	if t == nil {
+		return
+	}
+	t.totalChunks.Store(chunks)
+	t.totalBytes.Store(bytes)
+}
+
+// File records that the job moved on to the file at path.
+func (t *Tracker) File(path string) {
+	if t == nil {
+		return
+	}
+	t.files.Add(1)
+	t.current.Store(&path)
+}
+
+// Unchanged records a file of size bytes taken over from an earlier
+// snapshot without reading it; all its bytes are deduplicated.
+func (t *Tracker) Unchanged(size int64) {
+	if t == nil {
+		return
+	}
+	t.files.Add(1)
+	t.bytes.Add(size)
+	t.dedupBytes.Add(size)
+}
+
+// Stored records chunks of n bytes read and stored, of which fresh bytes
+// were new to the repository and the rest deduplicated.
+func (t *Tracker) Stored(chunks int, n, fresh int64) {
+	if t == nil {
+		return
+	}
+	t.chunks.Add(int64(chunks))
+	t.bytes.Add(n)
+	t.newBytes.Add(fresh)
+	t.dedupBytes.Add(n - fresh)
+}
+
+// Chunks sets the number of chunks the job will process and returns the
+// callback counting each one done, of n bytes; nil when t is.
+func (t *Tracker) Chunks(total int) func(n int) {
+	if t == nil {
+		return nil
+	}
+	t.totalChunks.Store(int64(total))
+	return func(n int) {
+		t.chunks.Add(1)
+		t.bytes.Add(int64(n))
+	}
+}
+
+// Report is how far a job has got.
+type Report struct {
+	Done       int64         `json:"done"`                  // chunks processed
+	Total      int64         `json:"total"`                 // chunks to process; 0 when unknown
+	Bytes      int64         `json:"bytes"`                 // bytes processed
+	TotalBytes int64         `json:"total_bytes,omitempty"` // bytes to process, for backups the size of the last snapshot; 0 when unknown
+	Files      int64         `json:"files,omitempty"`       // files scanned
+	NewBytes   int64         `json:"new_bytes,omitempty"`   // of Bytes, stored for the first time
+	DedupBytes int64         `json:"dedup_bytes,omitempty"` // of Bytes, stored already
+	Current    string        `json:"current,omitempty"`     // file being processed
+	Elapsed    time.Duration `json:"elapsed"`
+	Rate       float64       `json:"rate"`          // bytes per second
+	ETA        time.Duration `json:"eta,omitempty"` // 0 when unknown
+}
+
+// Report returns the work counted so far, nil when t is.
+func (t *Tracker) Report() *Report {
+	if t == nil {
+		return nil
+	}
+	r := &Report{
+		Done:       t.chunks.Load(),
+		Total:      t.totalChunks.Load(),
+		Bytes:      t.bytes.Load(),
+		TotalBytes: t.totalBytes.Load(),
+		Files:      t.files.Load(),
+		NewBytes:   t.newBytes.Load(),
+		DedupBytes: t.dedupBytes.Load(),
+		Elapsed:    time.Since(t.start),
+	}
+	if p := t.current.Load(); p != nil {
+		r.Current = *p
+	}
+	if secs := r.Elapsed.Seconds(); secs > 0 {
+		r.Rate = float64(r.Bytes) / secs
+	}
+	switch {
+	case r.TotalBytes > r.Bytes && r.Rate > 0:
+		r.ETA = time.Duration(float64(r.TotalBytes-r.Bytes) / r.Rate * float64(time.Second))
+	case r.TotalBytes == 0 && r.Total > r.Done && r.Done > 0:
+		r.ETA = time.Duration(float64(r.Elapsed) * float64(r.Total-r.Done) / float64(r.Done))
+	}
+	return r
+}
+
+// Percent is the share of the work done, by bytes when their total is
+// known and by chunks otherwise; -1 when neither is.
+func (r *Report) Percent() float64 {
+	switch {
+	case r.TotalBytes > 0:
+		return min(100, 100*float64(r.Bytes)/float64(r.TotalBytes))
+	case r.Total > 0:
+		return min(100, 100*float64(r.Done)/float64(r.Total))
+	}
+	return -1
+}
+
+// String renders r on one line, e.g. for a terminal.
+func (r *Report) String() string {
+	const mib = 1 << 20
+	var b strings.Builder
+	if pct := r.Percent(); pct >= 0 {
+		fmt.Fprintf(&b, "%3.0f%%  ", pct)
+	}
+	if r.Files > 0 {
+		fmt.Fprintf(&b, "%d files  ", r.Files)
+	}
+	if r.TotalBytes > 0 {
+		fmt.Fprintf(&b, "%.1f/%.1f MiB", float64(r.Bytes)/mib, float64(r.TotalBytes)/mib)
+	} else {
+		fmt.Fprintf(&b, "%.1f MiB", float64(r.Bytes)/mib)
+	}
+	fmt.Fprintf(&b, "  %.1f MiB/s", r.Rate/mib)
+	if r.NewBytes > 0 || r.DedupBytes > 0 {
+		fmt.Fprintf(&b, "  new %.1f MiB, deduped %.1f MiB", float64(r.NewBytes)/mib, float64(r.DedupBytes)/mib)
+	}
+	if r.ETA > 0 {
+		fmt.Fprintf(&b, "  ETA %s", r.ETA.Round(time.Second))
+	}
+	return b.String()
+}
+
+// Watch calls fn with a report of t every interval until the returned stop
+// is called, which waits for a call in progress. Nothing is reported for a
+// nil t.
+func (t *Tracker) Watch(interval time.Duration, fn func(*Report)) (stop func()) {
+	if t == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				fn(t.Report())
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
@@ -1,9 +1,14 @@
 package protocol
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/hoangsonww/backupagent/internal/crypto"
 	"github.com/hoangsonww/backupagent/internal/versioning"
@@ -16,16 +21,7 @@ type SnapshotAnnouncement struct {
 
 // Validate verifies the embedded snapshot signature.
 func (sa *SnapshotAnnouncement) Validate() error {
-	// Reconstruct canonical snapshot without signature for verification
-	rawSnap := versioning.Snapshot{
-		ID:        sa.Snapshot.ID,
-		Parent:    sa.Snapshot.Parent,
-		Timestamp: sa.Snapshot.Timestamp,
-		Chunks:    sa.Snapshot.Chunks,
-		Meta:      sa.Snapshot.Meta,
-		SignerPub: sa.Snapshot.SignerPub,
-	}
-	data, err := json.Marshal(rawSnap)
+	data, err := manifestPayload(&sa.Snapshot)
 	if err != nil {
 		return err
 	}
@@ -43,17 +39,131 @@ func (sa *SnapshotAnnouncement) Validate() error {
 	return nil
 }
 
+// manifestPayload returns the canonical snapshot without its signature,
+// the bytes its signature covers
+func manifestPayload(snap *versioning.Snapshot) ([]byte, error) {
+	return json.Marshal(versioning.Snapshot{
+		ID:            snap.ID,
+		Parent:        snap.Parent,
+		Timestamp:     snap.Timestamp,
+		Chunks:        snap.Chunks,
+		Meta:          snap.SignedMeta(),
+		SealedMeta:    snap.SealedMeta,
+		SignerPub:     snap.SignerPub,
+		RepoID:        snap.RepoID,
+		ChunkEncoding: snap.ChunkEncoding,
+	})
+}
+
+// ManifestHash returns the hex SHA-256 of the signed content of snap.
+func ManifestHash(snap *versioning.Snapshot) (string, error) {
+	data, err := manifestPayload(snap)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// SnapshotHeader announces a snapshot without its chunk list or metadata.
+// Peers that want the snapshot fetch its manifest from the announcer and
+// check it against ManifestHash. Signed by the snapshot's signer.
+type SnapshotHeader struct {
+	ID           string `json:"id"`
+	Parent       string `json:"parent,omitempty"`
+	Timestamp    string `json:"timestamp"` // RFC3339
+	RepoID       string `json:"repo_id,omitempty"`
+	ManifestHash string `json:"manifest_hash"` // hex SHA-256 of the signed manifest
+	Chunks       int    `json:"chunks"`
+	SignerPub    string `json:"signer_pub"` // base64 ed25519 pubkey
+	Signature    string `json:"signature"`  // base64 signature over SigningPayload
+}
+
+// NewSnapshotHeader returns the header of snap signed with signerPriv, which
+// must be the key that signed snap.
+func NewSnapshotHeader(snap *versioning.Snapshot, signerPriv []byte) (*SnapshotHeader, error) {
+	hash, err := ManifestHash(snap)
+	if err != nil {
+		return nil, err
+	}
+	h := &SnapshotHeader{
+		ID:           snap.ID,
+		Parent:       snap.Parent,
+		Timestamp:    snap.Timestamp.String(),
+		RepoID:       snap.RepoID,
+		ManifestHash: hash,
+		Chunks:       len(snap.Chunks),
+		SignerPub:    snap.SignerPub,
+	}
+	h.Signature = base64.StdEncoding.EncodeToString(crypto.Sign(h.SigningPayload(), signerPriv))
+	return h, nil
+}
+
+// SigningPayload returns the bytes covered by the header signature.
+func (h *SnapshotHeader) SigningPayload() []byte {
+	return []byte(fmt.Sprintf("%s|%s|%s|%s|%s|%d", h.ID, h.Parent, h.Timestamp, h.RepoID, h.ManifestHash, h.Chunks))
+}
+
+// Validate verifies the header signature.
+func (h *SnapshotHeader) Validate() error {
+	if h.ID == "" || len(h.ManifestHash) != sha256.Size*2 || h.Chunks < 0 {
+		return errors.New("snapshot header incomplete")
+	}
+	sig, err := base64.StdEncoding.DecodeString(h.Signature)
+	if err != nil {
+		return err
+	}
+	pub, err := base64.StdEncoding.DecodeString(h.SignerPub)
+	if err != nil {
+		return err
+	}
+	if !crypto.Verify(h.SigningPayload(), sig, pub) {
+		return errors.New("snapshot header signature invalid")
+	}
+	return nil
+}
+
+// Matches checks that snap is the validly signed manifest h announced.
+func (h *SnapshotHeader) Matches(snap *versioning.Snapshot) error {
+	if snap.ID != h.ID || snap.RepoID != h.RepoID || snap.SignerPub != h.SignerPub || len(snap.Chunks) != h.Chunks {
+		return fmt.Errorf("manifest of %s does not match its header", snap.ID)
+	}
+	hash, err := ManifestHash(snap)
+	if err != nil {
+		return err
+	}
+	if hash != h.ManifestHash {
+		return fmt.Errorf("manifest of %s does not match its header hash", snap.ID)
+	}
+	return (&SnapshotAnnouncement{Snapshot: *snap}).Validate()
+}
+
 // ChunkRequest asks for a block by hash. Signed by requester.
 type ChunkRequest struct {
 	Hash      string `json:"hash"`
-	Requestor string `json:"requestor"`  // peer ID
-	SignerPub string `json:"signer_pub"` // base64 ed25519 pubkey
-	Signature string `json:"signature"`  // base64 signature over Hash+Requestor
+	Requestor string `json:"requestor"`         // peer ID
+	RepoID    string `json:"repo_id,omitempty"` // repository the chunk belongs to
+	SignerPub string `json:"signer_pub"`        // base64 ed25519 pubkey
+	Signature string `json:"signature"`         // base64 signature over Hash+Requestor[+RepoID]
+
+	// Provider, if set, is the one peer asked to answer. It only routes the
+	// request, so it is left unsigned and peers predating it still accept
+	// the request and answer regardless.
+	Provider string `json:"provider,omitempty"`
+}
+
+// SigningPayload returns the bytes covered by the request signature.
+func (cr *ChunkRequest) SigningPayload() []byte {
+	payload := cr.Hash + "|" + cr.Requestor
+	if cr.RepoID != "" {
+		payload += "|" + cr.RepoID
+	}
+	return []byte(payload)
 }
 
 // Validate ensures the signature on the request is correct.
 func (cr *ChunkRequest) Validate() error {
-	payload := cr.Hash + "|" + cr.Requestor
+	payload := cr.SigningPayload()
 	sig, err := base64.StdEncoding.DecodeString(cr.Signature)
 	if err != nil {
 		return err
@@ -62,7 +172,7 @@ func (cr *ChunkRequest) Validate() error {
 	if err != nil {
 		return err
 	}
-	if !crypto.Verify([]byte(payload), sig, pub) {
+	if !crypto.Verify(payload, sig, pub) {
 		return errors.New("chunk request signature invalid")
 	}
 	return nil
@@ -71,14 +181,24 @@ func (cr *ChunkRequest) Validate() error {
 // ChunkResponse carries the requested block. Signed by responder.
 type ChunkResponse struct {
 	Hash      string `json:"hash"`
-	Data      string `json:"data"`       // base64 encrypted chunk
-	SignerPub string `json:"signer_pub"` // base64 ed25519 pubkey
-	Signature string `json:"signature"`  // base64 signature over Hash+Data
+	Data      string `json:"data"`              // base64 encrypted chunk
+	RepoID    string `json:"repo_id,omitempty"` // repository the chunk belongs to
+	SignerPub string `json:"signer_pub"`        // base64 ed25519 pubkey
+	Signature string `json:"signature"`         // base64 signature over Hash+Data[+RepoID]
+}
+
+// SigningPayload returns the bytes covered by the response signature.
+func (cr *ChunkResponse) SigningPayload() []byte {
+	payload := cr.Hash + "|" + cr.Data
+	if cr.RepoID != "" {
+		payload += "|" + cr.RepoID
+	}
+	return []byte(payload)
 }
 
 // Validate ensures the response signature is correct.
 func (cr *ChunkResponse) Validate() error {
-	payload := cr.Hash + "|" + cr.Data
+	payload := cr.SigningPayload()
 	sig, err := base64.StdEncoding.DecodeString(cr.Signature)
 	if err != nil {
 		return err
@@ -87,7 +207,7 @@ func (cr *ChunkResponse) Validate() error {
 	if err != nil {
 		return err
 	}
-	if !crypto.Verify([]byte(payload), sig, pub) {
+	if !crypto.Verify(payload, sig, pub) {
 		return errors.New("chunk response signature invalid")
 	}
 	return nil
@@ -118,16 +238,28 @@ func (pa *PeerAdd) Validate() error {
 	return nil
 }
 
-// PeerRemove signals removal of a peer.
+// PeerRemove signals removal of a peer. Abuse marks a peer that must not
+// be added back without an explicit override.
 type PeerRemove struct {
 	PeerID    string `json:"peer_id"`
+	Reason    string `json:"reason,omitempty"`
+	Abuse     bool   `json:"abuse,omitempty"`
 	SignerPub string `json:"signer_pub"`
 	Signature string `json:"signature"`
 }
 
+// SigningPayload returns the bytes covered by the removal signature. A
+// removal without reason signs the peer ID alone, as older nodes do.
+func (pr *PeerRemove) SigningPayload() []byte {
+	if pr.Reason == "" && !pr.Abuse {
+		return []byte(pr.PeerID)
+	}
+	return []byte(fmt.Sprintf("%s|%s|%t", pr.PeerID, pr.Reason, pr.Abuse))
+}
+
 // Validate verifies removal signature.
 func (pr *PeerRemove) Validate() error {
-	payload := pr.PeerID
+	payload := pr.SigningPayload()
 	sig, err := base64.StdEncoding.DecodeString(pr.Signature)
 	if err != nil {
 		return err
@@ -136,8 +268,304 @@ func (pr *PeerRemove) Validate() error {
 	if err != nil {
 		return err
 	}
-	if !crypto.Verify([]byte(payload), sig, pub) {
+	if !crypto.Verify(payload, sig, pub) {
 		return errors.New("peer remove signature invalid")
 	}
 	return nil
 }
+
+// MaxPeerListEntries bounds how many addresses one peer list may carry.
+const MaxPeerListEntries = 64
+
+// PeerList is a signed set of swarm members the signer has connected to,
+// exchanged so a node bootstrapping from one peer learns the rest (PEX).
+type PeerList struct {
+	Peers     []string `json:"peers"`     // multiaddrs ending in /p2p/<peerID>
+	IssuedAt  string   `json:"issued_at"` // RFC3339
+	SignerPub string   `json:"signer_pub"`
+	Signature string   `json:"signature"`
+}
+
+// SigningPayload returns the canonical bytes covered by the signature.
+func (pl *PeerList) SigningPayload() []byte {
+	return []byte(strings.Join(pl.Peers, ",") + "|" + pl.IssuedAt + "|" + pl.SignerPub)
+}
+
+// Validate checks bounds and the signature.
+func (pl *PeerList) Validate() error {
+	if len(pl.Peers) > MaxPeerListEntries {
+		return fmt.Errorf("peer list has %d entries, max %d", len(pl.Peers), MaxPeerListEntries)
+	}
+	if _, err := time.Parse(time.RFC3339, pl.IssuedAt); err != nil {
+		return fmt.Errorf("invalid issued_at: %w", err)
+	}
+	return verifyBase64(pl.SigningPayload(), pl.Signature, pl.SignerPub, "peer list")
+}
+
+// StorageOffer advertises how much space a peer is willing to host for the
+// swarm and how much of it is in use. Signed by the peer's identity key.
+type StorageOffer struct {
+	PeerID    string `json:"peer_id"`
+	Capacity  int64  `json:"capacity"`  // bytes offered
+	Used      int64  `json:"used"`      // bytes stored
+	IssuedAt  string `json:"issued_at"` // RFC3339
+	SignerPub string `json:"signer_pub"`
+	Signature string `json:"signature"`
+}
+
+// SigningPayload returns the canonical bytes covered by the signature.
+func (so *StorageOffer) SigningPayload() []byte {
+	return []byte(fmt.Sprintf("%s|%d|%d|%s|%s", so.PeerID, so.Capacity, so.Used, so.IssuedAt, so.SignerPub))
+}
+
+// Validate checks the figures and the signature.
+func (so *StorageOffer) Validate() error {
+	if so.Capacity < 0 || so.Used < 0 {
+		return errors.New("storage offer has negative size")
+	}
+	if _, err := time.Parse(time.RFC3339, so.IssuedAt); err != nil {
+		return fmt.Errorf("invalid issued_at: %w", err)
+	}
+	return verifyBase64(so.SigningPayload(), so.Signature, so.SignerPub, "storage offer")
+}
+
+// Free returns the offered bytes not yet in use.
+func (so *StorageOffer) Free() int64 {
+	if so.Used >= so.Capacity {
+		return 0
+	}
+	return so.Capacity - so.Used
+}
+
+// RecoverySet describes one distribution round of recovery shares: its
+// trustees and how many of them restore the secret. The owner signs it, so
+// a node recovering with nothing but the owner key can tell which releases
+// count.
+type RecoverySet struct {
+	SetID     string   `json:"set_id"`
+	OwnerPub  string   `json:"owner_pub"`
+	Threshold int      `json:"threshold"`
+	Trustees  []string `json:"trustees"`  // base64 ed25519 pubkeys, one per share
+	Signature string   `json:"signature"` // signature by OwnerPub over all fields above
+}
+
+// SigningPayload returns the canonical bytes covered by the signature.
+func (rs *RecoverySet) SigningPayload() []byte {
+	return []byte(fmt.Sprintf("%s|%s|%d|%s",
+		rs.SetID, rs.OwnerPub, rs.Threshold, strings.Join(rs.Trustees, ",")))
+}
+
+// Validate verifies the owner's signature and that every trustee is listed
+// once, as each holds one share.
+func (rs *RecoverySet) Validate() error {
+	seen := make(map[string]bool, len(rs.Trustees))
+	for _, t := range rs.Trustees {
+		if seen[t] {
+			return fmt.Errorf("recovery set lists trustee %s twice", t)
+		}
+		seen[t] = true
+	}
+	if rs.Threshold < 2 || rs.Threshold > len(rs.Trustees) {
+		return fmt.Errorf("recovery set threshold %d out of range for %d trustees", rs.Threshold, len(rs.Trustees))
+	}
+	return verifyBase64(rs.SigningPayload(), rs.Signature, rs.OwnerPub, "recovery set")
+}
+
+// HasTrustee reports whether pub is one of the set's trustees.
+func (rs *RecoverySet) HasTrustee(pub string) bool {
+	for _, t := range rs.Trustees {
+		if t == pub {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyShare delivers one sealed recovery share to a designated trustee.
+type KeyShare struct {
+	SetID        string `json:"set_id"`        // identifies one distribution round
+	OwnerPub     string `json:"owner_pub"`     // base64 ed25519 pubkey of the secret owner
+	RecipientPub string `json:"recipient_pub"` // base64 ed25519 pubkey of the trustee
+	Index        int    `json:"index"`
+	Threshold    int    `json:"threshold"`
+	Sealed       string `json:"sealed"`    // base64 share sealed to RecipientPub
+	Signature    string `json:"signature"` // signature by OwnerPub over all fields above
+
+	Set *RecoverySet `json:"set,omitempty"` // the round the share belongs to, signed on its own
+}
+
+// SigningPayload returns the canonical bytes covered by the signature.
+func (ks *KeyShare) SigningPayload() []byte {
+	return []byte(fmt.Sprintf("%s|%s|%s|%d|%d|%s",
+		ks.SetID, ks.OwnerPub, ks.RecipientPub, ks.Index, ks.Threshold, ks.Sealed))
+}
+
+// Validate verifies the owner's signature over the share.
+func (ks *KeyShare) Validate() error {
+	return verifyBase64(ks.SigningPayload(), ks.Signature, ks.OwnerPub, "key share")
+}
+
+// ShareRequest asks trustees to release the shares they hold for OwnerPub.
+// Trustees only answer after an operator confirms Code out-of-band.
+type ShareRequest struct {
+	OwnerPub     string `json:"owner_pub"`
+	RequesterPub string `json:"requester_pub"` // base64 ed25519 pubkey shares are sealed to
+	Nonce        string `json:"nonce"`
+	Signature    string `json:"signature"` // signature by RequesterPub
+}
+
+// SigningPayload returns the canonical bytes covered by the signature.
+func (sr *ShareRequest) SigningPayload() []byte {
+	return []byte(sr.OwnerPub + "|" + sr.RequesterPub + "|" + sr.Nonce)
+}
+
+// Validate verifies the requester's signature.
+func (sr *ShareRequest) Validate() error {
+	return verifyBase64(sr.SigningPayload(), sr.Signature, sr.RequesterPub, "share request")
+}
+
+// ConfirmationCode derives the short code read aloud between requester and trustee.
+func (sr *ShareRequest) ConfirmationCode() string {
+	sum := crypto.Hash(sr.SigningPayload())
+	n := uint32(sum[0])<<16 | uint32(sum[1])<<8 | uint32(sum[2])
+	return fmt.Sprintf("%06d", n%1000000)
+}
+
+// ShareRelease returns a trustee's share, re-sealed to the requester. The
+// requester trusts only the owner-signed Set for the threshold and the
+// trustees, not Threshold.
+type ShareRelease struct {
+	OwnerPub     string `json:"owner_pub"`
+	RequesterPub string `json:"requester_pub"`
+	TrusteePub   string `json:"trustee_pub"`
+	Nonce        string `json:"nonce"` // echoes the request being answered
+	SetID        string `json:"set_id"`
+	Threshold    int    `json:"threshold"`
+	Sealed       string `json:"sealed"`    // base64 share sealed to RequesterPub
+	Signature    string `json:"signature"` // signature by TrusteePub over all fields above
+
+	Set *RecoverySet `json:"set,omitempty"` // as the trustee received it from the owner
+}
+
+// SigningPayload returns the canonical bytes covered by the signature.
+func (sr *ShareRelease) SigningPayload() []byte {
+	return []byte(fmt.Sprintf("%s|%s|%s|%s|%s|%d|%s",
+		sr.OwnerPub, sr.RequesterPub, sr.TrusteePub, sr.Nonce, sr.SetID, sr.Threshold, sr.Sealed))
+}
+
+// Validate verifies the trustee's signature.
+func (sr *ShareRelease) Validate() error {
+	return verifyBase64(sr.SigningPayload(), sr.Signature, sr.TrusteePub, "share release")
+}
+
+// verifyBase64 checks a base64 signature against a base64 ed25519 pubkey.
+func verifyBase64(payload []byte, sigB64, pubB64, what string) error {
+	sig, err := base64.StdEncoding.DecodeString(sigB64)
+	if err != nil {
+		return err
+	}
+	pub, err := base64.StdEncoding.DecodeString(pubB64)
+	if err != nil {
+		return err
+	}
+	if len(pub) != 32 {
+		return errors.New(what + " signer key malformed")
+	}
+	if !crypto.Verify(payload, sig, pub) {
+		return errors.New(what + " signature invalid")
+	}
+	return nil
+}
+
+// Admin key lifecycle actions
+const (
+	AdminActionAdd    = "add"
+	AdminActionRotate = "rotate"
+	AdminActionRevoke = "revoke"
+)
+
+// AdminKeyUpdate adds, rotates, or revokes an admin key. Signed by an admin
+// that was active at IssuedAt.
+type AdminKeyUpdate struct {
+	Action      string `json:"action"`
+	AdminPub    string `json:"admin_pub"`               // key being added, rotated away from, or revoked
+	NewAdminPub string `json:"new_admin_pub,omitempty"` // replacement key for rotate
+	EffectiveAt string `json:"effective_at"`            // RFC3339; revocation applies from this time
+	IssuedAt    string `json:"issued_at"`               // RFC3339
+	Reason      string `json:"reason,omitempty"`
+	SignerPub   string `json:"signer_pub"`
+	Signature   string `json:"signature"`
+}
+
+// SigningPayload returns the canonical bytes covered by the signature.
+func (u *AdminKeyUpdate) SigningPayload() []byte {
+	return []byte(u.Action + "|" + u.AdminPub + "|" + u.NewAdminPub + "|" +
+		u.EffectiveAt + "|" + u.IssuedAt + "|" + u.Reason + "|" + u.SignerPub)
+}
+
+// Validate checks fields and the signature.
+func (u *AdminKeyUpdate) Validate() error {
+	switch u.Action {
+	case AdminActionAdd, AdminActionRevoke:
+	case AdminActionRotate:
+		if u.NewAdminPub == "" {
+			return errors.New("rotate requires new_admin_pub")
+		}
+	default:
+		return fmt.Errorf("unknown admin action: %s", u.Action)
+	}
+	if u.AdminPub == "" {
+		return errors.New("admin_pub is required")
+	}
+	if _, err := time.Parse(time.RFC3339, u.EffectiveAt); err != nil {
+		return fmt.Errorf("invalid effective_at: %w", err)
+	}
+	if _, err := time.Parse(time.RFC3339, u.IssuedAt); err != nil {
+		return fmt.Errorf("invalid issued_at: %w", err)
+	}
+	return verifyBase64(u.SigningPayload(), u.Signature, u.SignerPub, "admin key update")
+}
+
+// OperationProposal wraps a destructive operation that needs a second admin
+// approval before peers execute it. The proposer's signature counts as the first.
+type OperationProposal struct {
+	Kind        string          `json:"kind"` // e.g. "peer_remove", "admin_key_update", "prune"
+	Payload     json.RawMessage `json:"payload"`
+	ProposedAt  string          `json:"proposed_at"` // RFC3339
+	ProposerPub string          `json:"proposer_pub"`
+	Signature   string          `json:"signature"` // signature over ApprovalPayload(ID())
+}
+
+// ID returns the content-derived identifier of the proposal.
+func (op *OperationProposal) ID() string {
+	h := crypto.Hash([]byte(op.Kind + "|" + string(op.Payload) + "|" + op.ProposedAt + "|" + op.ProposerPub))
+	return hex.EncodeToString(h)
+}
+
+// Validate verifies the proposer's signature.
+func (op *OperationProposal) Validate() error {
+	if op.Kind == "" {
+		return errors.New("operation kind is required")
+	}
+	if _, err := time.Parse(time.RFC3339, op.ProposedAt); err != nil {
+		return fmt.Errorf("invalid proposed_at: %w", err)
+	}
+	return verifyBase64(ApprovalPayload(op.ID()), op.Signature, op.ProposerPub, "operation proposal")
+}
+
+// OperationApproval is an additional admin's signature on a pending operation.
+type OperationApproval struct {
+	OperationID string `json:"operation_id"`
+	SignerPub   string `json:"signer_pub"`
+	Signature   string `json:"signature"` // signature over ApprovalPayload(OperationID)
+}
+
+// Validate verifies the approver's signature.
+func (oa *OperationApproval) Validate() error {
+	return verifyBase64(ApprovalPayload(oa.OperationID), oa.Signature, oa.SignerPub, "operation approval")
+}
+
+// ApprovalPayload is the message every approving admin signs for an operation.
+func ApprovalPayload(operationID string) []byte {
+	return []byte("approve|" + operationID)
+}
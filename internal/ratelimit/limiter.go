@@ -278,6 +278,43 @@ func (r *ResourceLimiter) EndGoroutine() {
 	}
 }
 
+// Observe replaces the tallies kept by AllocateMemory and StartGoroutine
+// with usage measured elsewhere, e.g. by the runtime
+func (r *ResourceLimiter) Observe(memoryBytes int64, goroutines int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.currentMemory = memoryBytes
+	r.goroutineCount = goroutines
+}
+
+// Exceeded names the limits current usage is over, "memory" and
+// "goroutines"; limits of 0 are unlimited
+func (r *ResourceLimiter) Exceeded() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var over []string
+	if r.maxMemoryBytes > 0 && r.currentMemory > r.maxMemoryBytes {
+		over = append(over, "memory")
+	}
+	if r.maxGoroutines > 0 && r.goroutineCount > r.maxGoroutines {
+		over = append(over, "goroutines")
+	}
+	return over
+}
+
+// Within reports whether current usage is at most share of every limit
+func (r *ResourceLimiter) Within(share float64) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.maxMemoryBytes > 0 && float64(r.currentMemory) > share*float64(r.maxMemoryBytes) {
+		return false
+	}
+	if r.maxGoroutines > 0 && float64(r.goroutineCount) > share*float64(r.maxGoroutines) {
+		return false
+	}
+	return true
+}
+
 // GetStats returns current resource usage
 func (r *ResourceLimiter) GetStats() map[string]interface{} {
 	r.mu.RLock()
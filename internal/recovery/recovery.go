@@ -0,0 +1,476 @@
+package recovery
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/crypto"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/protocol"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Key prefixes inside the recovery bucket
+const (
+	prefixHeld     = "held/"     // shares we keep for other owners
+	prefixPending  = "pending/"  // requests awaiting operator approval
+	prefixRequest  = "request/"  // our own outstanding recovery request
+	prefixReleased = "released/" // shares returned to us by trustees
+	prefixSet      = "set/"      // the recovery set of an owner, distributed by us or learned from releases
+)
+
+var (
+	ErrNoShareHeld       = errors.New("no share held for owner")
+	ErrNoPendingRequest  = errors.New("no pending request matches confirmation code")
+	ErrNoRecoveryRequest = errors.New("no outstanding recovery request for owner")
+	ErrNotEnoughShares   = errors.New("not enough shares released to recover secret")
+	ErrNoRecoverySet     = errors.New("no recovery set known for owner")
+	ErrSetMismatch       = errors.New("share release belongs to another recovery set")
+	ErrNotTrustee        = errors.New("share release signer is not a trustee of the recovery set")
+	ErrDuplicateTrustee  = errors.New("more than one share released by the same trustee")
+
+	errKeyNotFound = errors.New("recovery record not found")
+)
+
+// HeldShare is a key share stored on behalf of another owner.
+type HeldShare struct {
+	Share      protocol.KeyShare `json:"share"`
+	ReceivedAt string            `json:"received_at"` // RFC3339 format
+}
+
+// Manager implements both sides of social recovery: distributing shares to
+// trustees, holding shares for others, and collecting them back.
+type Manager struct {
+	db         *persistence.DB
+	signerPub  []byte
+	signerPriv []byte
+	logger     *monitoring.Logger
+}
+
+// NewManager creates a recovery manager bound to the agent's signing identity
+func NewManager(db *persistence.DB, signerPub, signerPriv []byte) *Manager {
+	return &Manager{
+		db:         db,
+		signerPub:  signerPub,
+		signerPriv: signerPriv,
+		logger:     monitoring.GetLogger(),
+	}
+}
+
+// BuildShares splits secret across trustees (base64 ed25519 pubkeys) and seals
+// each share to its trustee. Any threshold of them can later restore the secret.
+// The signed recovery set travels with each share and is stored as ours.
+func (m *Manager) BuildShares(secret []byte, trustees []string, threshold int) ([]*protocol.KeyShare, error) {
+	shares, err := Split(secret, len(trustees), threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	setID, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	ownerPub := base64.StdEncoding.EncodeToString(m.signerPub)
+	set := &protocol.RecoverySet{
+		SetID:     setID,
+		OwnerPub:  ownerPub,
+		Threshold: threshold,
+		Trustees:  trustees,
+	}
+	set.Signature = base64.StdEncoding.EncodeToString(crypto.Sign(set.SigningPayload(), m.signerPriv))
+	if err := set.Validate(); err != nil {
+		return nil, err
+	}
+
+	out := make([]*protocol.KeyShare, 0, len(trustees))
+	for i, trustee := range trustees {
+		trusteePub, err := base64.StdEncoding.DecodeString(trustee)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trustee key %q: %w", trustee, err)
+		}
+		sealed, err := crypto.SealTo(shares[i], trusteePub)
+		if err != nil {
+			return nil, fmt.Errorf("failed to seal share for %s: %w", trustee, err)
+		}
+		ks := &protocol.KeyShare{
+			SetID:        setID,
+			OwnerPub:     ownerPub,
+			RecipientPub: trustee,
+			Index:        int(shares[i][0]),
+			Threshold:    threshold,
+			Sealed:       base64.StdEncoding.EncodeToString(sealed),
+			Set:          set,
+		}
+		ks.Signature = base64.StdEncoding.EncodeToString(crypto.Sign(ks.SigningPayload(), m.signerPriv))
+		out = append(out, ks)
+	}
+	if err := m.put(prefixSet+ownerPub, set); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// HandleKeyShare stores a share addressed to us, replacing any older set from the same owner.
+func (m *Manager) HandleKeyShare(ks *protocol.KeyShare) error {
+	if err := ks.Validate(); err != nil {
+		return fmt.Errorf("invalid key share: %w", err)
+	}
+	if !m.isSelf(ks.RecipientPub) {
+		return nil
+	}
+	// The requester will need the set to tell which releases count
+	if ks.Set == nil {
+		return errors.New("key share carries no recovery set")
+	}
+	if err := ks.Set.Validate(); err != nil {
+		return fmt.Errorf("invalid recovery set: %w", err)
+	}
+	if ks.Set.SetID != ks.SetID || ks.Set.OwnerPub != ks.OwnerPub || ks.Set.Threshold != ks.Threshold ||
+		!ks.Set.HasTrustee(ks.RecipientPub) {
+		return errors.New("key share does not match its recovery set")
+	}
+	// Make sure the share is actually readable before accepting custody
+	if _, err := m.openShare(ks.Sealed); err != nil {
+		return fmt.Errorf("key share cannot be opened: %w", err)
+	}
+
+	held := HeldShare{Share: *ks, ReceivedAt: time.Now().UTC().Format(time.RFC3339)}
+	if err := m.put(prefixHeld+ks.OwnerPub, held); err != nil {
+		return err
+	}
+	m.logger.WithFields(map[string]interface{}{
+		"owner":  ks.OwnerPub,
+		"set_id": ks.SetID,
+		"index":  ks.Index,
+	}).Info("Holding recovery share for peer")
+	return nil
+}
+
+// NewRequest creates a signed request asking trustees to release shares of
+// ownerPub back to this agent. The confirmation code must be read to each
+// trustee out-of-band. It forgets the releases of an earlier request and,
+// unless we distributed the shares, the recovery set learned from them.
+func (m *Manager) NewRequest(ownerPub string) (*protocol.ShareRequest, error) {
+	nonce, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	req := &protocol.ShareRequest{
+		OwnerPub:     ownerPub,
+		RequesterPub: base64.StdEncoding.EncodeToString(m.signerPub),
+		Nonce:        nonce,
+	}
+	req.Signature = base64.StdEncoding.EncodeToString(crypto.Sign(req.SigningPayload(), m.signerPriv))
+
+	err = m.db.Update(func(tx *bolt.Tx) error {
+		b, err := m.db.Sealed(tx, persistence.BucketRecovery)
+		if err != nil {
+			return err
+		}
+		// Releases for an earlier request are no longer valid
+		prefix := []byte(prefixReleased + ownerPub + "/")
+		if err := b.DeleteFunc(func(k []byte) bool { return bytes.HasPrefix(k, prefix) }); err != nil {
+			return err
+		}
+		if !m.isSelf(ownerPub) {
+			if err := b.Delete([]byte(prefixSet + ownerPub)); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(prefixRequest+ownerPub), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// HandleShareRequest queues a request for operator approval if we hold a share for the owner.
+func (m *Manager) HandleShareRequest(req *protocol.ShareRequest) error {
+	if err := req.Validate(); err != nil {
+		return fmt.Errorf("invalid share request: %w", err)
+	}
+	var held HeldShare
+	if err := m.get(prefixHeld+req.OwnerPub, &held); err != nil {
+		if errors.Is(err, errKeyNotFound) {
+			return nil
+		}
+		return err
+	}
+	if err := m.put(prefixPending+req.OwnerPub+"/"+req.Nonce, req); err != nil {
+		return err
+	}
+	m.logger.WithFields(map[string]interface{}{
+		"owner":     req.OwnerPub,
+		"requester": req.RequesterPub,
+	}).Warn("Recovery share requested; awaiting out-of-band confirmation")
+	return nil
+}
+
+// PendingRequests lists requests waiting for operator approval.
+func (m *Manager) PendingRequests() ([]*protocol.ShareRequest, error) {
+	var reqs []*protocol.ShareRequest
+	err := m.forEach(prefixPending, func(v []byte) error {
+		var req protocol.ShareRequest
+		if err := json.Unmarshal(v, &req); err != nil {
+			return err
+		}
+		reqs = append(reqs, &req)
+		return nil
+	})
+	sort.Slice(reqs, func(i, j int) bool {
+		if reqs[i].OwnerPub != reqs[j].OwnerPub {
+			return reqs[i].OwnerPub < reqs[j].OwnerPub
+		}
+		return reqs[i].Nonce < reqs[j].Nonce
+	})
+	return reqs, err
+}
+
+// Approve releases our share for ownerPub to the pending request whose
+// confirmation code matches the one the requester read to us.
+func (m *Manager) Approve(ownerPub, code string) (*protocol.ShareRelease, error) {
+	pending, err := m.PendingRequests()
+	if err != nil {
+		return nil, err
+	}
+	var req *protocol.ShareRequest
+	for _, p := range pending {
+		if p.OwnerPub == ownerPub && p.ConfirmationCode() == code {
+			req = p
+			break
+		}
+	}
+	if req == nil {
+		return nil, ErrNoPendingRequest
+	}
+
+	var held HeldShare
+	if err := m.get(prefixHeld+ownerPub, &held); err != nil {
+		if errors.Is(err, errKeyNotFound) {
+			return nil, ErrNoShareHeld
+		}
+		return nil, err
+	}
+	share, err := m.openShare(held.Share.Sealed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open held share: %w", err)
+	}
+	requesterPub, err := base64.StdEncoding.DecodeString(req.RequesterPub)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := crypto.SealTo(share, requesterPub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal share for requester: %w", err)
+	}
+
+	rel := &protocol.ShareRelease{
+		OwnerPub:     ownerPub,
+		RequesterPub: req.RequesterPub,
+		TrusteePub:   base64.StdEncoding.EncodeToString(m.signerPub),
+		Nonce:        req.Nonce,
+		SetID:        held.Share.SetID,
+		Threshold:    held.Share.Threshold,
+		Sealed:       base64.StdEncoding.EncodeToString(sealed),
+		Set:          held.Share.Set,
+	}
+	rel.Signature = base64.StdEncoding.EncodeToString(crypto.Sign(rel.SigningPayload(), m.signerPriv))
+
+	err = m.db.Update(func(tx *bolt.Tx) error {
+		b, err := m.db.Sealed(tx, persistence.BucketRecovery)
+		if err != nil {
+			return err
+		}
+		return b.Delete([]byte(prefixPending + ownerPub + "/" + req.Nonce))
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.logger.WithFields(map[string]interface{}{
+		"owner":     ownerPub,
+		"requester": req.RequesterPub,
+	}).Info("Recovery share released")
+	return rel, nil
+}
+
+// HandleShareRelease records a share returned for our outstanding request.
+// The first release carrying a valid recovery set signed by the owner makes
+// it the set later releases must belong to, unless we distributed the
+// shares and know the set already.
+func (m *Manager) HandleShareRelease(rel *protocol.ShareRelease) error {
+	if err := rel.Validate(); err != nil {
+		return fmt.Errorf("invalid share release: %w", err)
+	}
+	if !m.isSelf(rel.RequesterPub) {
+		return nil
+	}
+	var req protocol.ShareRequest
+	if err := m.get(prefixRequest+rel.OwnerPub, &req); err != nil {
+		if errors.Is(err, errKeyNotFound) {
+			return ErrNoRecoveryRequest
+		}
+		return err
+	}
+	if req.Nonce != rel.Nonce {
+		return errors.New("share release does not match outstanding request")
+	}
+	if rel.Set == nil {
+		return errors.New("share release carries no recovery set")
+	}
+	if err := rel.Set.Validate(); err != nil {
+		return fmt.Errorf("invalid recovery set: %w", err)
+	}
+	if rel.Set.OwnerPub != rel.OwnerPub || rel.Set.SetID != rel.SetID {
+		return ErrSetMismatch
+	}
+	if !rel.Set.HasTrustee(rel.TrusteePub) {
+		return ErrNotTrustee
+	}
+	var set protocol.RecoverySet
+	switch err := m.get(prefixSet+rel.OwnerPub, &set); {
+	case errors.Is(err, errKeyNotFound):
+		if err := m.put(prefixSet+rel.OwnerPub, rel.Set); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case set.SetID != rel.SetID:
+		return ErrSetMismatch
+	}
+	if err := m.put(prefixReleased+rel.OwnerPub+"/"+rel.TrusteePub, rel); err != nil {
+		return err
+	}
+	m.logger.WithField("trustee", rel.TrusteePub).Info("Received recovery share")
+	return nil
+}
+
+// Recover combines the released shares for ownerPub once the threshold of
+// its recovery set is met. Only releases of that set, each from a different
+// one of its trustees, count.
+func (m *Manager) Recover(ownerPub string) ([]byte, error) {
+	var set protocol.RecoverySet
+	if err := m.get(prefixSet+ownerPub, &set); err != nil {
+		if errors.Is(err, errKeyNotFound) {
+			return nil, ErrNoRecoverySet
+		}
+		return nil, err
+	}
+	var releases []*protocol.ShareRelease
+	err := m.forEach(prefixReleased+ownerPub+"/", func(v []byte) error {
+		var rel protocol.ShareRelease
+		if err := json.Unmarshal(v, &rel); err != nil {
+			return err
+		}
+		releases = append(releases, &rel)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(releases))
+	for _, rel := range releases {
+		switch {
+		case rel.OwnerPub != ownerPub || rel.SetID != set.SetID:
+			return nil, fmt.Errorf("%w: release from %s", ErrSetMismatch, rel.TrusteePub)
+		case !set.HasTrustee(rel.TrusteePub):
+			return nil, fmt.Errorf("%w: %s", ErrNotTrustee, rel.TrusteePub)
+		case seen[rel.TrusteePub]:
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateTrustee, rel.TrusteePub)
+		}
+		seen[rel.TrusteePub] = true
+	}
+	if len(releases) < set.Threshold {
+		return nil, fmt.Errorf("%w: have %d of %d", ErrNotEnoughShares, len(releases), set.Threshold)
+	}
+
+	shares := make([][]byte, 0, len(releases))
+	for _, rel := range releases {
+		share, err := m.openShare(rel.Sealed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open share from %s: %w", rel.TrusteePub, err)
+		}
+		shares = append(shares, share)
+	}
+	return Combine(shares)
+}
+
+func (m *Manager) openShare(sealedB64 string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(sealedB64)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.OpenSealed(sealed, m.signerPriv)
+}
+
+func (m *Manager) isSelf(pubB64 string) bool {
+	return pubB64 == base64.StdEncoding.EncodeToString(m.signerPub)
+}
+
+func (m *Manager) put(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b, err := m.db.Sealed(tx, persistence.BucketRecovery)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+func (m *Manager) get(key string, v interface{}) error {
+	return m.db.View(func(tx *bolt.Tx) error {
+		b, err := m.db.Sealed(tx, persistence.BucketRecovery)
+		if err != nil {
+			return err
+		}
+		data, err := b.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			return errKeyNotFound
+		}
+		return json.Unmarshal(data, v)
+	})
+}
+
+// forEach calls fn with the value of every record whose key starts with prefix
+func (m *Manager) forEach(prefix string, fn func(v []byte) error) error {
+	return m.db.View(func(tx *bolt.Tx) error {
+		b, err := m.db.Sealed(tx, persistence.BucketRecovery)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if !strings.HasPrefix(string(k), prefix) {
+				return nil
+			}
+			return fn(v)
+		})
+	})
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
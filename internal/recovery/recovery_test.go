@@ -0,0 +1,194 @@
+package recovery_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/crypto"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/protocol"
+	"github.com/hoangsonww/backupagent/internal/recovery"
+)
+
+// node is one agent's side of social recovery
+type node struct {
+	m    *recovery.Manager
+	pub  string
+	priv []byte
+}
+
+func newNode(t *testing.T) *node {
+	t.Helper()
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.EnableSealing(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	pub, priv, err := crypto.GenerateEd25519Keypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &node{recovery.NewManager(db, pub, priv), base64.StdEncoding.EncodeToString(pub), priv}
+}
+
+// distribute splits secret across trustees, which take custody of their shares
+func distribute(t *testing.T, owner *node, secret string, threshold int, trustees ...*node) {
+	t.Helper()
+	var pubs []string
+	for _, tr := range trustees {
+		pubs = append(pubs, tr.pub)
+	}
+	shares, err := owner.m.BuildShares([]byte(secret), pubs, threshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ks := range shares {
+		if err := trustees[i].m.HandleKeyShare(ks); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// release has trustee approve req, as after confirming its code
+func release(t *testing.T, trustee *node, req *protocol.ShareRequest) *protocol.ShareRelease {
+	t.Helper()
+	if err := trustee.m.HandleShareRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	rel, err := trustee.m.Approve(req.OwnerPub, req.ConfirmationCode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rel
+}
+
+// resign signs rel again with priv, as its sender would after changing it
+func resign(rel *protocol.ShareRelease, priv []byte) {
+	rel.Signature = base64.StdEncoding.EncodeToString(crypto.Sign(rel.SigningPayload(), priv))
+}
+
+func TestRecover(t *testing.T) {
+	owner, a, b, c, requester := newNode(t), newNode(t), newNode(t), newNode(t), newNode(t)
+	distribute(t, owner, "correct horse battery staple", 2, a, b, c)
+
+	req, err := requester.m.NewRequest(owner.pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := requester.m.HandleShareRelease(release(t, a, req)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := requester.m.Recover(owner.pub); !errors.Is(err, recovery.ErrNotEnoughShares) {
+		t.Fatalf("recovered from one share of two: %v", err)
+	}
+	if err := requester.m.HandleShareRelease(release(t, c, req)); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := requester.m.Recover(owner.pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret) != "correct horse battery staple" {
+		t.Fatalf("recovered %q", secret)
+	}
+}
+
+func TestRecoverRejects(t *testing.T) {
+	t.Run("threshold of the release", func(t *testing.T) {
+		owner, a, b, c, requester := newNode(t), newNode(t), newNode(t), newNode(t), newNode(t)
+		distribute(t, owner, "secret", 3, a, b, c)
+		req, err := requester.m.NewRequest(owner.pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A trustee claiming its share alone is enough
+		for _, tr := range []*node{a, b} {
+			rel := release(t, tr, req)
+			rel.Threshold = 1
+			resign(rel, tr.priv)
+			if err := requester.m.HandleShareRelease(rel); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := requester.m.Recover(owner.pub); !errors.Is(err, recovery.ErrNotEnoughShares) {
+			t.Fatalf("recovered from two shares of a set of threshold 3: %v", err)
+		}
+	})
+
+	t.Run("signer not a trustee", func(t *testing.T) {
+		owner, a, b, requester, outsider := newNode(t), newNode(t), newNode(t), newNode(t), newNode(t)
+		distribute(t, owner, "secret", 2, a, b)
+		req, err := requester.m.NewRequest(owner.pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel := release(t, a, req)
+		rel.TrusteePub = outsider.pub
+		resign(rel, outsider.priv)
+		if err := requester.m.HandleShareRelease(rel); !errors.Is(err, recovery.ErrNotTrustee) {
+			t.Fatalf("release by an outsider: %v", err)
+		}
+	})
+
+	t.Run("set not signed by the owner", func(t *testing.T) {
+		owner, a, b, requester, outsider := newNode(t), newNode(t), newNode(t), newNode(t), newNode(t)
+		distribute(t, owner, "secret", 2, a, b)
+		req, err := requester.m.NewRequest(owner.pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The outsider lists itself as a trustee of a set of its own
+		rel := release(t, a, req)
+		set := *rel.Set
+		set.Trustees = []string{outsider.pub, a.pub}
+		set.Signature = base64.StdEncoding.EncodeToString(crypto.Sign(set.SigningPayload(), outsider.priv))
+		rel.Set = &set
+		rel.TrusteePub = outsider.pub
+		resign(rel, outsider.priv)
+		if err := requester.m.HandleShareRelease(rel); err == nil {
+			t.Fatal("accepted a recovery set the owner did not sign")
+		}
+		if _, err := requester.m.Recover(owner.pub); !errors.Is(err, recovery.ErrNoRecoverySet) {
+			t.Fatalf("forged set stored: %v", err)
+		}
+	})
+
+	t.Run("release of another set", func(t *testing.T) {
+		owner, a, b, c, requester := newNode(t), newNode(t), newNode(t), newNode(t), newNode(t)
+		distribute(t, owner, "old secret", 2, a, b, c)
+		req, err := requester.m.NewRequest(owner.pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := requester.m.HandleShareRelease(release(t, a, req)); err != nil {
+			t.Fatal(err)
+		}
+		// The owner distributes again before b answers
+		distribute(t, owner, "new secret", 2, a, b, c)
+		if err := requester.m.HandleShareRelease(release(t, b, req)); !errors.Is(err, recovery.ErrSetMismatch) {
+			t.Fatalf("release of another set: %v", err)
+		}
+	})
+
+	t.Run("duplicate trustees", func(t *testing.T) {
+		owner, a, b := newNode(t), newNode(t), newNode(t)
+		if _, err := owner.m.BuildShares([]byte("secret"), []string{a.pub, a.pub, b.pub}, 2); err == nil {
+			t.Fatal("split a secret giving one trustee two shares")
+		}
+
+		// A set listing a trustee twice, as an older owner could sign
+		set := &protocol.RecoverySet{SetID: "0011223344556677", OwnerPub: owner.pub, Threshold: 2, Trustees: []string{a.pub, a.pub, b.pub}}
+		set.Signature = base64.StdEncoding.EncodeToString(crypto.Sign(set.SigningPayload(), owner.priv))
+		ks := &protocol.KeyShare{SetID: set.SetID, OwnerPub: owner.pub, RecipientPub: a.pub, Index: 1, Threshold: 2, Set: set}
+		ks.Signature = base64.StdEncoding.EncodeToString(crypto.Sign(ks.SigningPayload(), owner.priv))
+		if err := a.m.HandleKeyShare(ks); err == nil {
+			t.Fatal("took custody of a share of a set listing a trustee twice")
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package recovery
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Shamir secret sharing over GF(2^8). Each share is the x coordinate (1..255)
+// followed by one polynomial evaluation per secret byte.
+
+// Split divides secret into n shares, any k of which reconstruct it.
+func Split(secret []byte, n, k int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("secret cannot be empty")
+	}
+	if k < 2 || k > n {
+		return nil, fmt.Errorf("threshold must be between 2 and %d, got %d", n, k)
+	}
+	if n > 255 {
+		return nil, fmt.Errorf("at most 255 shares supported, got %d", n)
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+
+	coeffs := make([]byte, k)
+	for idx, b := range secret {
+		coeffs[0] = b
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			shares[i][idx+1] = evalPoly(coeffs, shares[i][0])
+		}
+	}
+	return shares, nil
+}
+
+// Combine reconstructs the secret from at least threshold distinct shares.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least two shares are required")
+	}
+	size := len(shares[0])
+	if size < 2 {
+		return nil, errors.New("share too short")
+	}
+	seen := make(map[byte]bool, len(shares))
+	for _, s := range shares {
+		if len(s) != size {
+			return nil, errors.New("shares have mismatched lengths")
+		}
+		if s[0] == 0 || seen[s[0]] {
+			return nil, errors.New("shares must have distinct non-zero indices")
+		}
+		seen[s[0]] = true
+	}
+
+	secret := make([]byte, size-1)
+	for idx := range secret {
+		// Lagrange interpolation at x = 0
+		var acc byte
+		for i, si := range shares {
+			num, den := byte(1), byte(1)
+			for j, sj := range shares {
+				if i == j {
+					continue
+				}
+				num = gfMul(num, sj[0])
+				den = gfMul(den, si[0]^sj[0])
+			}
+			acc ^= gfMul(si[idx+1], gfMul(num, gfInv(den)))
+		}
+		secret[idx] = acc
+	}
+	return secret, nil
+}
+
+func evalPoly(coeffs []byte, x byte) byte {
+	// Horner's method from the highest degree down
+	var y byte
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ coeffs[i]
+	}
+	return y
+}
+
+func gfMul(a, b byte) byte {
+	var p byte
+	for b > 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b // x^8 + x^4 + x^3 + x + 1
+		}
+		b >>= 1
+	}
+	return p
+}
+
+func gfInv(a byte) byte {
+	// a^254 == a^-1 in GF(2^8)
+	result := byte(1)
+	for i := 0; i < 254; i++ {
+		result = gfMul(result, a)
+	}
+	return result
+}
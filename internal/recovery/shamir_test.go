@@ -0,0 +1,59 @@
+package recovery_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/recovery"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+	shares, err := recovery.Split(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("split failed: %v", err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("expected 5 shares got %d", len(shares))
+	}
+
+	got, err := recovery.Combine([][]byte{shares[4], shares[0], shares[2]})
+	if err != nil {
+		t.Fatalf("combine failed: %v", err)
+	}
+	if !bytes.Equal(got, secret) {
+		t.Fatalf("expected %q got %q", secret, got)
+	}
+
+	got, err = recovery.Combine(shares)
+	if err != nil {
+		t.Fatalf("combine all failed: %v", err)
+	}
+	if !bytes.Equal(got, secret) {
+		t.Fatalf("expected %q got %q", secret, got)
+	}
+}
+
+func TestCombineBelowThreshold(t *testing.T) {
+	secret := []byte("secret")
+	shares, err := recovery.Split(secret, 4, 3)
+	if err != nil {
+		t.Fatalf("split failed: %v", err)
+	}
+	got, err := recovery.Combine(shares[:2])
+	if err != nil {
+		t.Fatalf("combine failed: %v", err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Fatalf("two shares should not reveal a threshold-3 secret")
+	}
+}
+
+func TestSplitInvalidThreshold(t *testing.T) {
+	if _, err := recovery.Split([]byte("x"), 3, 4); err == nil {
+		t.Fatalf("expected error for threshold above share count")
+	}
+	if _, err := recovery.Split([]byte("x"), 3, 1); err == nil {
+		t.Fatalf("expected error for threshold of one")
+	}
+}
@@ -0,0 +1,174 @@
+// Package render prints the results of the command line tools, as text for
+// people or as JSON or YAML for scripts. Machine-readable results use the
+// json field names of the value printed in both formats, so a script can
+// switch between them, and keep progress and notes off stdout. The commands
+// move their logs to stderr as well.
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Format is how results are printed.
+type Format string
+
+const (
+	Table Format = "table"
+	JSON  Format = "json"
+	YAML  Format = "yaml"
+)
+
+// Exit statuses shared by the command line tools.
+const (
+	ExitOK      = 0
+	ExitError   = 1
+	ExitPartial = 3 // a backup was saved without some unreadable files, or a restore quarantined some
+)
+
+// ParseFormat reads a --output value.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case Table, JSON, YAML:
+		return f, nil
+	case "":
+		return Table, nil
+	}
+	return "", fmt.Errorf("invalid output format %q (must be table, json or yaml)", s)
+}
+
+// String, Set and Type let a Format be a command line flag.
+func (f *Format) String() string {
+	if *f == "" {
+		return string(Table)
+	}
+	return string(*f)
+}
+
+func (f *Format) Set(s string) error {
+	v, err := ParseFormat(s)
+	if err != nil {
+		return err
+	}
+	*f = v
+	return nil
+}
+
+func (f *Format) Type() string { return "format" }
+
+// Printer prints results in Format to Out. Notes and progress go to Out
+// along with tables and to Err otherwise. Nil writers are os.Stdout and
+// os.Stderr.
+type Printer struct {
+	Format Format
+	Out    io.Writer
+	Err    io.Writer
+}
+
+// Structured reports whether results are printed as JSON or YAML.
+func (p *Printer) Structured() bool {
+	return p.Format == JSON || p.Format == YAML
+}
+
+// Result prints v, or calls table to print it as text, which writes to
+// stdout. A nil list prints as an empty one.
+func (p *Printer) Result(v interface{}, table func()) error {
+	if !p.Structured() {
+		table()
+		return nil
+	}
+	return p.encode(v)
+}
+
+// Printf prints a note or progress line.
+func (p *Printer) Printf(format string, a ...interface{}) {
+	fmt.Fprintf(p.notes(), format, a...)
+}
+
+// Println prints a note or progress line.
+func (p *Printer) Println(a ...interface{}) {
+	fmt.Fprintln(p.notes(), a...)
+}
+
+// Fail prints err as {"error": "..."}, or as text after label.
+func (p *Printer) Fail(label string, err error) {
+	if !p.Structured() {
+		fmt.Fprintln(p.out(), label, err)
+		return
+	}
+	p.encode(struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+func (p *Printer) encode(v interface{}) error {
+	// An empty list is [] rather than null
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice && rv.IsNil() {
+		v = []struct{}{}
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if p.Format == YAML {
+		if data, err = toYAML(data); err != nil {
+			return err
+		}
+	} else {
+		data = append(data, '\n')
+	}
+	_, err = p.out().Write(data)
+	return err
+}
+
+func (p *Printer) out() io.Writer {
+	if p.Out == nil {
+		return os.Stdout
+	}
+	return p.Out
+}
+
+func (p *Printer) notes() io.Writer {
+	if !p.Structured() {
+		return p.out()
+	}
+	if p.Err == nil {
+		return os.Stderr
+	}
+	return p.Err
+}
+
+// toYAML re-encodes JSON as block-style YAML, keeping its field names and
+// order
+func toYAML(data []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	block(&doc)
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// block clears the flow and quoting styles JSON decodes with; the encoder
+// quotes the strings that need it
+func block(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		block(c)
+	}
+}
@@ -0,0 +1,103 @@
+package render_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/render"
+)
+
+type result struct {
+	SnapshotID string    `json:"snapshot_id"`
+	Chunks     int       `json:"chunks"`
+	Size       string    `json:"size"`
+	Created    time.Time `json:"created"`
+	Files      []string  `json:"files"`
+}
+
+func TestPrinter(t *testing.T) {
+	v := result{
+		SnapshotID: "abc",
+		Chunks:     2,
+		Size:       "10",
+		Created:    time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC),
+		Files:      []string{"a", "b"},
+	}
+	cases := []struct {
+		format render.Format
+		want   string
+	}{
+		{render.Table, "table\n"},
+		{render.JSON, `{
+  "snapshot_id": "abc",
+  "chunks": 2,
+  "size": "10",
+  "created": "2026-10-01T12:00:00Z",
+  "files": [
+    "a",
+    "b"
+  ]
+}
+`},
+		{render.YAML, `snapshot_id: abc
+chunks: 2
+size: "10"
+created: "2026-10-01T12:00:00Z"
+files:
+  - a
+  - b
+`},
+	}
+	for _, tc := range cases {
+		t.Run(string(tc.format), func(t *testing.T) {
+			var out, notes bytes.Buffer
+			p := &render.Printer{Format: tc.format, Out: &out, Err: &notes}
+			p.Printf("working\n")
+			err := p.Result(v, func() { out.WriteString("table\n") })
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tc.want
+			if tc.format == render.Table {
+				want = "working\n" + want
+			} else if notes.String() != "working\n" {
+				t.Errorf("notes = %q, want them on Err", notes.String())
+			}
+			if out.String() != want {
+				t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestFail(t *testing.T) {
+	var out bytes.Buffer
+	p := &render.Printer{Format: render.JSON, Out: &out}
+	p.Fail("Error:", errors.New("no such snapshot"))
+	if want := "{\n  \"error\": \"no such snapshot\"\n}\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+	out.Reset()
+	p.Format = render.Table
+	p.Fail("Error:", errors.New("no such snapshot"))
+	if want := "Error: no such snapshot\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, s := range []string{"", "table", "json", "yaml"} {
+		if _, err := render.ParseFormat(s); err != nil {
+			t.Errorf("ParseFormat(%q): %v", s, err)
+		}
+	}
+	var f render.Format
+	if err := f.Set("xml"); err == nil {
+		t.Error("Set accepted xml")
+	}
+	if f.String() != "table" {
+		t.Errorf("default format %q, want table", f.String())
+	}
+}
@@ -0,0 +1,107 @@
+package restic
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	ivSize  = aes.BlockSize
+	macSize = poly1305.TagSize
+)
+
+// ErrWrongPassword is returned by Open when no key of the repository opens
+// with the password.
+var ErrWrongPassword = errors.New("restic: wrong password or no key file")
+
+// errMAC is a ciphertext whose authenticator does not match
+var errMAC = errors.New("restic: ciphertext verification failed")
+
+// key encrypts with AES-256-CTR and authenticates with Poly1305-AES, as
+// restic's crypto.Key
+type key struct {
+	MAC struct {
+		K []byte `json:"k"`
+		R []byte `json:"r"`
+	} `json:"mac"`
+	Encrypt []byte `json:"encrypt"`
+}
+
+// keyFile is a file under keys/: the master key, encrypted with a key
+// derived from the password by scrypt
+type keyFile struct {
+	KDF  string `json:"kdf"`
+	N    int    `json:"N"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	Salt []byte `json:"salt"`
+	Data []byte `json:"data"`
+}
+
+// open derives the user key of kf from password and decrypts the master key
+func (kf *keyFile) open(password string) (*key, error) {
+	if kf.KDF != "scrypt" {
+		return nil, fmt.Errorf("restic: unsupported key derivation %q", kf.KDF)
+	}
+	b, err := scrypt.Key([]byte(password), kf.Salt, kf.N, kf.R, kf.P, 64)
+	if err != nil {
+		return nil, err
+	}
+	user := &key{Encrypt: b[:32]}
+	user.MAC.K, user.MAC.R = b[32:48], b[48:]
+	plain, err := user.decrypt(kf.Data)
+	if err != nil {
+		return nil, err
+	}
+	var master key
+	if err := json.Unmarshal(plain, &master); err != nil {
+		return nil, err
+	}
+	if len(master.Encrypt) != 32 || len(master.MAC.K) != 16 || len(master.MAC.R) != 16 {
+		return nil, errors.New("restic: malformed master key")
+	}
+	return &master, nil
+}
+
+// decrypt checks and decrypts IV || ciphertext || MAC
+func (k *key) decrypt(data []byte) ([]byte, error) {
+	if len(data) < ivSize+macSize {
+		return nil, errors.New("restic: ciphertext too short")
+	}
+	iv, ct, mac := data[:ivSize], data[ivSize:len(data)-macSize], data[len(data)-macSize:]
+	var tag [macSize]byte
+	copy(tag[:], mac)
+	polyKey, err := k.polyKey(iv)
+	if err != nil {
+		return nil, err
+	}
+	if !poly1305.Verify(&tag, ct, &polyKey) {
+		return nil, errMAC
+	}
+	block, err := aes.NewCipher(k.Encrypt)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(ct))
+	cipher.NewCTR(block, iv).XORKeyStream(plain, ct)
+	return plain, nil
+}
+
+// polyKey is the Poly1305 key for nonce: r, which poly1305 clamps itself,
+// followed by AES_k(nonce)
+func (k *key) polyKey(nonce []byte) ([32]byte, error) {
+	var pk [32]byte
+	block, err := aes.NewCipher(k.MAC.K)
+	if err != nil {
+		return pk, err
+	}
+	copy(pk[:16], k.MAC.R)
+	block.Encrypt(pk[16:], nonce)
+	return pk, nil
+}
@@ -0,0 +1,301 @@
+// Package restic reads restic repositories kept in a local directory, so
+// their snapshots can be imported. It never writes to the repository.
+package restic
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrNotRepository is returned by Open for a directory without a restic
+// config and keys.
+var ErrNotRepository = errors.New("not a restic repository")
+
+// Repository is an opened restic repository.
+type Repository struct {
+	dir     string
+	key     *key
+	ID      string
+	Version int
+	blobs   map[string]blob
+	zstd    *zstd.Decoder
+}
+
+// blob is where the index places a blob
+type blob struct {
+	pack         string
+	offset       int64
+	length       int64
+	uncompressed int64 // set for compressed blobs
+}
+
+// Snapshot is a restic snapshot.
+type Snapshot struct {
+	ID       string    `json:"-"`
+	Time     time.Time `json:"time"`
+	Parent   string    `json:"parent,omitempty"`
+	Tree     string    `json:"tree"`
+	Paths    []string  `json:"paths"`
+	Hostname string    `json:"hostname,omitempty"`
+	Username string    `json:"username,omitempty"`
+	Tags     []string  `json:"tags,omitempty"`
+}
+
+// ShortID is the abbreviated ID restic prints.
+func (s *Snapshot) ShortID() string {
+	if len(s.ID) > 8 {
+		return s.ID[:8]
+	}
+	return s.ID
+}
+
+// Node types
+const (
+	NodeFile = "file"
+	NodeDir  = "dir"
+)
+
+// Node is an entry of a tree. Besides files and directories, trees hold
+// symlinks, devices, fifos and sockets.
+type Node struct {
+	Name    string      `json:"name"`
+	Type    string      `json:"type"`
+	Mode    fs.FileMode `json:"mode,omitempty"`
+	ModTime time.Time   `json:"mtime,omitempty"`
+	UID     int         `json:"uid"`
+	GID     int         `json:"gid"`
+	User    string      `json:"user,omitempty"`
+	Group   string      `json:"group,omitempty"`
+	Size    int64       `json:"size,omitempty"`
+	Content []string    `json:"content,omitempty"` // data blobs of a file, in order
+	Subtree string      `json:"subtree,omitempty"` // tree of a directory
+}
+
+// Open opens the repository in dir with password and loads its index.
+func Open(dir, password string) (*Repository, error) {
+	if _, err := os.Stat(filepath.Join(dir, "config")); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: %w", dir, ErrNotRepository)
+		}
+		return nil, err
+	}
+	names, err := listDir(filepath.Join(dir, "keys"))
+	if err != nil {
+		return nil, err
+	}
+	r := &Repository{dir: dir, blobs: make(map[string]blob)}
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, "keys", name))
+		if err != nil {
+			return nil, err
+		}
+		var kf keyFile
+		if err := json.Unmarshal(data, &kf); err != nil {
+			return nil, fmt.Errorf("restic: key %s: %w", name, err)
+		}
+		if r.key, err = kf.open(password); err == nil {
+			break
+		}
+		if !errors.Is(err, errMAC) {
+			return nil, fmt.Errorf("restic: key %s: %w", name, err)
+		}
+	}
+	if r.key == nil {
+		return nil, ErrWrongPassword
+	}
+	if r.zstd, err = zstd.NewReader(nil); err != nil {
+		return nil, err
+	}
+
+	var cfg struct {
+		Version int    `json:"version"`
+		ID      string `json:"id"`
+	}
+	if err := r.loadJSON("config", &cfg); err != nil {
+		return nil, fmt.Errorf("restic: config: %w", err)
+	}
+	if cfg.Version < 1 || cfg.Version > 2 {
+		return nil, fmt.Errorf("restic: unsupported repository version %d", cfg.Version)
+	}
+	r.ID, r.Version = cfg.ID, cfg.Version
+	if err := r.loadIndex(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close releases the decompressor.
+func (r *Repository) Close() {
+	r.zstd.Close()
+}
+
+// loadIndex reads every index file into r.blobs
+func (r *Repository) loadIndex() error {
+	names, err := listDir(filepath.Join(r.dir, "index"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		var idx struct {
+			Packs []struct {
+				ID    string `json:"id"`
+				Blobs []struct {
+					ID                 string `json:"id"`
+					Offset             int64  `json:"offset"`
+					Length             int64  `json:"length"`
+					UncompressedLength int64  `json:"uncompressed_length,omitempty"`
+				} `json:"blobs"`
+			} `json:"packs"`
+		}
+		if err := r.loadJSON(filepath.Join("index", name), &idx); err != nil {
+			return fmt.Errorf("restic: index %s: %w", name, err)
+		}
+		for _, p := range idx.Packs {
+			for _, b := range p.Blobs {
+				r.blobs[b.ID] = blob{pack: p.ID, offset: b.Offset, length: b.Length, uncompressed: b.UncompressedLength}
+			}
+		}
+	}
+	return nil
+}
+
+// Snapshots returns every snapshot, oldest first.
+func (r *Repository) Snapshots() ([]*Snapshot, error) {
+	names, err := listDir(filepath.Join(r.dir, "snapshots"))
+	if err != nil {
+		return nil, err
+	}
+	snaps := make([]*Snapshot, 0, len(names))
+	for _, name := range names {
+		s := &Snapshot{ID: name}
+		if err := r.loadJSON(filepath.Join("snapshots", name), s); err != nil {
+			return nil, fmt.Errorf("restic: snapshot %s: %w", name, err)
+		}
+		snaps = append(snaps, s)
+	}
+	sort.SliceStable(snaps, func(i, j int) bool { return snaps[i].Time.Before(snaps[j].Time) })
+	return snaps, nil
+}
+
+// Tree returns the nodes of a tree, sorted by name.
+func (r *Repository) Tree(id string) ([]*Node, error) {
+	data, err := r.Blob(id)
+	if err != nil {
+		return nil, err
+	}
+	var tree struct {
+		Nodes []*Node `json:"nodes"`
+	}
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("restic: tree %s: %w", id, err)
+	}
+	return tree.Nodes, nil
+}
+
+// Blob returns the plaintext of a blob after checking it against its ID.
+func (r *Repository) Blob(id string) ([]byte, error) {
+	b, ok := r.blobs[id]
+	if !ok {
+		return nil, fmt.Errorf("restic: blob %s is not in the index", id)
+	}
+	if len(b.pack) < 2 {
+		return nil, fmt.Errorf("restic: blob %s: bad pack ID %q", id, b.pack)
+	}
+	f, err := os.Open(filepath.Join(r.dir, "data", b.pack[:2], b.pack))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ct := make([]byte, b.length)
+	if _, err := f.ReadAt(ct, b.offset); err != nil {
+		return nil, fmt.Errorf("restic: blob %s in pack %s: %w", id, b.pack, err)
+	}
+	data, err := r.key.decrypt(ct)
+	if err != nil {
+		return nil, fmt.Errorf("restic: blob %s: %w", id, err)
+	}
+	if b.uncompressed > 0 {
+		if data, err = r.zstd.DecodeAll(data, make([]byte, 0, b.uncompressed)); err != nil {
+			return nil, fmt.Errorf("restic: blob %s: %w", id, err)
+		}
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != id {
+		return nil, fmt.Errorf("restic: blob %s does not match its ID", id)
+	}
+	return data, nil
+}
+
+// NewReader reads the content of a file node, fetching its blobs in turn.
+func (r *Repository) NewReader(n *Node) io.Reader {
+	return &fileReader{repo: r, blobs: n.Content}
+}
+
+type fileReader struct {
+	repo  *Repository
+	blobs []string
+	buf   []byte
+}
+
+func (fr *fileReader) Read(p []byte) (int, error) {
+	for len(fr.buf) == 0 {
+		if len(fr.blobs) == 0 {
+			return 0, io.EOF
+		}
+		data, err := fr.repo.Blob(fr.blobs[0])
+		if err != nil {
+			return 0, err
+		}
+		fr.buf, fr.blobs = data, fr.blobs[1:]
+	}
+	n := copy(p, fr.buf)
+	fr.buf = fr.buf[n:]
+	return n, nil
+}
+
+// loadJSON decrypts the file at name, relative to the repository, and
+// decodes it. Version 2 repositories may compress such files, marked by a
+// leading version byte where JSON would start.
+func (r *Repository) loadJSON(name string, v interface{}) error {
+	data, err := os.ReadFile(filepath.Join(r.dir, name))
+	if err != nil {
+		return err
+	}
+	plain, err := r.key.decrypt(data)
+	if err != nil {
+		return err
+	}
+	if len(plain) > 0 && plain[0] == 2 {
+		if plain, err = r.zstd.DecodeAll(plain[1:], nil); err != nil {
+			return err
+		}
+	}
+	return json.NewDecoder(bytes.NewReader(plain)).Decode(v)
+}
+
+// listDir returns the names of the files in dir, skipping temporary ones
+func listDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
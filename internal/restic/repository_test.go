@@ -0,0 +1,207 @@
+package restic
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// encrypt is the inverse of decrypt
+func (k *key) encrypt(t *testing.T, plain []byte) []byte {
+	iv := random(t, ivSize)
+	block, err := aes.NewCipher(k.Encrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct := make([]byte, len(plain))
+	cipher.NewCTR(block, iv).XORKeyStream(ct, plain)
+	pk, err := k.polyKey(iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mac [macSize]byte
+	poly1305.Sum(&mac, ct, &pk)
+	return append(append(iv, ct...), mac[:]...)
+}
+
+func random(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func blobID(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// testRepo writes a version 2 repository holding one snapshot of
+// /home/me/docs with a file split into two blobs, one of them compressed,
+// and returns its directory and the file's content
+func testRepo(t *testing.T, password string) (string, []byte) {
+	dir := t.TempDir()
+	for _, d := range []string{"keys", "index", "snapshots", "data"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	master := &key{Encrypt: random(t, 32)}
+	master.MAC.K, master.MAC.R = random(t, 16), random(t, 16)
+
+	// The key file, with cheap scrypt parameters
+	kf := keyFile{KDF: "scrypt", N: 1024, R: 8, P: 1, Salt: random(t, 16)}
+	b, err := scrypt.Key([]byte(password), kf.Salt, kf.N, kf.R, kf.P, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &key{Encrypt: b[:32]}
+	user.MAC.K, user.MAC.R = b[32:48], b[48:]
+	mk, _ := json.Marshal(master)
+	kf.Data = user.encrypt(t, mk)
+	writeJSON(t, filepath.Join(dir, "keys", "k1"), kf)
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	save := func(name string, v interface{}, compress bool) {
+		plain, _ := json.Marshal(v)
+		if compress {
+			plain = append([]byte{2}, enc.EncodeAll(plain, nil)...)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), master.encrypt(t, plain), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save("config", map[string]interface{}{"version": 2, "id": "repo-1", "chunker_polynomial": "3dea92648f6e83"}, false)
+
+	// One pack of data and tree blobs
+	content := bytes.Repeat([]byte("restic to shadowvault "), 1000)
+	parts := [][]byte{content[:7000], content[7000:]}
+	var pack bytes.Buffer
+	type indexBlob struct {
+		ID                 string `json:"id"`
+		Type               string `json:"type"`
+		Offset             int    `json:"offset"`
+		Length             int    `json:"length"`
+		UncompressedLength int    `json:"uncompressed_length,omitempty"`
+	}
+	var blobs []indexBlob
+	add := func(typ string, plain []byte, compress bool) string {
+		id := blobID(plain)
+		ib := indexBlob{ID: id, Type: typ, Offset: pack.Len()}
+		data := plain
+		if compress {
+			data = enc.EncodeAll(plain, nil)
+			ib.UncompressedLength = len(plain)
+		}
+		ct := master.encrypt(t, data)
+		ib.Length = len(ct)
+		pack.Write(ct)
+		blobs = append(blobs, ib)
+		return id
+	}
+	c1 := add("data", parts[0], false)
+	c2 := add("data", parts[1], true)
+	mtime := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	tree := func(nodes ...map[string]interface{}) string {
+		data, _ := json.Marshal(map[string]interface{}{"nodes": nodes})
+		return add("tree", append(data, '\n'), true)
+	}
+	docs := tree(
+		map[string]interface{}{"name": "notes.txt", "type": "file", "mode": 0640, "mtime": mtime, "uid": 1000, "gid": 1000, "user": "me", "size": len(content), "content": []string{c1, c2}},
+		map[string]interface{}{"name": "latest", "type": "symlink", "linktarget": "notes.txt"},
+	)
+	me := tree(map[string]interface{}{"name": "docs", "type": "dir", "mode": 0x80000000 | 0750, "subtree": docs})
+	home := tree(map[string]interface{}{"name": "me", "type": "dir", "mode": 0x80000000 | 0755, "subtree": me})
+	root := tree(map[string]interface{}{"name": "home", "type": "dir", "mode": 0x80000000 | 0755, "subtree": home})
+	packID := blobID(pack.Bytes())
+	if err := os.MkdirAll(filepath.Join(dir, "data", packID[:2]), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data", packID[:2], packID), pack.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	save("index/i1", map[string]interface{}{"packs": []interface{}{map[string]interface{}{"id": packID, "blobs": blobs}}}, true)
+	save("snapshots/"+blobID([]byte("s1")), map[string]interface{}{
+		"time": mtime.Add(time.Hour), "tree": root, "paths": []string{"/home/me/docs"}, "hostname": "laptop", "tags": []string{"daily"},
+	}, true)
+	return dir, content
+}
+
+func writeJSON(t *testing.T, p string, v interface{}) {
+	data, _ := json.Marshal(v)
+	if err := os.WriteFile(p, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, content := testRepo(t, "secret")
+	if _, err := Open(dir, "wrong"); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("opened with the wrong password: %v", err)
+	}
+	if _, err := Open(t.TempDir(), "secret"); !errors.Is(err, ErrNotRepository) {
+		t.Fatalf("opened an empty directory: %v", err)
+	}
+
+	r, err := Open(dir, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.ID != "repo-1" || r.Version != 2 {
+		t.Errorf("config: id %s, version %d", r.ID, r.Version)
+	}
+	snaps, err := r.Snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 1 || snaps[0].Hostname != "laptop" || snaps[0].Paths[0] != "/home/me/docs" || snaps[0].Tags[0] != "daily" {
+		t.Fatalf("snapshots = %+v", snaps)
+	}
+
+	// Walk down to the file
+	id := snaps[0].Tree
+	for _, name := range []string{"home", "me", "docs"} {
+		nodes, err := r.Tree(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nodes) != 1 || nodes[0].Name != name || nodes[0].Type != NodeDir || !nodes[0].Mode.IsDir() {
+			t.Fatalf("tree %s = %+v", id, nodes)
+		}
+		id = nodes[0].Subtree
+	}
+	nodes, err := r.Tree(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 || nodes[0].Type != NodeFile || nodes[0].Mode != 0640 || nodes[0].User != "me" {
+		t.Fatalf("docs = %+v", nodes)
+	}
+	got, err := io.ReadAll(r.NewReader(nodes[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("read %d bytes, want %d", len(got), len(content))
+	}
+}
@@ -0,0 +1,145 @@
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+)
+
+// Hook stages, passed to hooks in SHADOWVAULT_HOOK
+const (
+	HookPreBackup  = "pre_backup"
+	HookPostBackup = "post_backup"
+	HookOnFailure  = "on_failure"
+)
+
+const (
+	// hookOutputTail bounds the output of a failed hook quoted in its error
+	hookOutputTail = 512
+	// hookWaitDelay is how long a killed hook's output is read for
+	hookWaitDelay = 5 * time.Second
+)
+
+// Hooks are shell commands run around a backup, e.g. to quiesce a database
+// before it and resume it after, or to send a notification. Empty commands
+// are skipped.
+type Hooks struct {
+	PreBackup  string
+	PostBackup string
+	OnFailure  string
+	Timeout    time.Duration // per command; 0 is unlimited
+}
+
+// BackupStats describe a finished backup to the hooks after it.
+type BackupStats struct {
+	SnapshotID string
+	Files      int64
+	Bytes      int64 // read from the source
+	NewBytes   int64 // of Bytes, stored for the first time
+	Chunks     int
+	Skipped    int // unreadable files left out
+}
+
+// Run runs backup of source between the hooks. A failed pre_backup hook
+// cancels the backup. post_backup runs after a backup that succeeded, and
+// on_failure after one that failed or was cancelled, with SHADOWVAULT_ERROR
+// set; on_failure is where to undo what pre_backup did when the backup does
+// not finish. A failed post_backup hook is logged but does not fail the
+// backup, which is saved by then.
+func (h *Hooks) Run(ctx context.Context, source string, backup func(context.Context) (*BackupStats, error)) error {
+	logger := monitoring.LoggerFor(ctx).WithField("path", source)
+	start := time.Now()
+	env := map[string]string{"SHADOWVAULT_SOURCE": source}
+
+	err := h.run(ctx, HookPreBackup, h.PreBackup, env)
+	if err == nil {
+		var stats *BackupStats
+		stats, err = backup(ctx)
+		if stats != nil {
+			env["SHADOWVAULT_SNAPSHOT_ID"] = stats.SnapshotID
+			env["SHADOWVAULT_FILES"] = strconv.FormatInt(stats.Files, 10)
+			env["SHADOWVAULT_BYTES"] = strconv.FormatInt(stats.Bytes, 10)
+			env["SHADOWVAULT_NEW_BYTES"] = strconv.FormatInt(stats.NewBytes, 10)
+			env["SHADOWVAULT_CHUNKS"] = strconv.Itoa(stats.Chunks)
+			env["SHADOWVAULT_SKIPPED"] = strconv.Itoa(stats.Skipped)
+		}
+	}
+	env["SHADOWVAULT_DURATION"] = strconv.FormatFloat(time.Since(start).Seconds(), 'f', 3, 64)
+
+	if err != nil {
+		env["SHADOWVAULT_ERROR"] = err.Error()
+		// The backup's context may be what ended it, so the hook gets its own
+		if herr := h.run(context.WithoutCancel(ctx), HookOnFailure, h.OnFailure, env); herr != nil {
+			logger.WithError(herr).Error("Backup hook failed")
+		}
+		return err
+	}
+	if herr := h.run(ctx, HookPostBackup, h.PostBackup, env); herr != nil {
+		logger.WithError(herr).Error("Backup hook failed")
+	}
+	return nil
+}
+
+// run runs command as hook stage with env added to the environment
+func (h *Hooks) run(ctx context.Context, stage, command string, env map[string]string) error {
+	if command == "" {
+		return nil
+	}
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), "SHADOWVAULT_HOOK="+stage)
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// Children of a killed shell may hold its output open
+	cmd.WaitDelay = hookWaitDelay
+
+	logger := monitoring.LoggerFor(ctx).WithField("hook", stage)
+	logger.Debugf("Running backup hook: %s", command)
+	start := time.Now()
+	err := cmd.Run()
+	logger = logger.WithField("duration", time.Since(start).Seconds())
+	if out := strings.TrimSpace(output.String()); out != "" {
+		logger = logger.WithField("output", out)
+	}
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", h.Timeout)
+		}
+		return fmt.Errorf("%s hook: %w%s", stage, err, tail(output.String()))
+	}
+	logger.Info("Backup hook finished")
+	return nil
+}
+
+// tail quotes the end of a failed hook's output for its error
+func tail(output string) string {
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return ""
+	}
+	if len(output) > hookOutputTail {
+		output = "..." + output[len(output)-hookOutputTail:]
+	}
+	return ": " + output
+}
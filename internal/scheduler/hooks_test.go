@@ -0,0 +1,77 @@
+package scheduler_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/scheduler"
+)
+
+func TestHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks here are sh commands")
+	}
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	record := `echo "$SHADOWVAULT_HOOK $SHADOWVAULT_SOURCE $SHADOWVAULT_SNAPSHOT_ID $SHADOWVAULT_FILES $SHADOWVAULT_ERROR" >> ` + log
+	h := &scheduler.Hooks{PreBackup: record, PostBackup: record, OnFailure: record, Timeout: time.Minute}
+	lines := func() []string {
+		data, _ := os.ReadFile(log)
+		os.Remove(log)
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			got = append(got, strings.Join(strings.Fields(line), " "))
+		}
+		return got
+	}
+
+	err := h.Run(context.Background(), "/src", func(context.Context) (*scheduler.BackupStats, error) {
+		return &scheduler.BackupStats{SnapshotID: "snap1", Files: 3}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"pre_backup /src", "post_backup /src snap1 3"}
+	if got := lines(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("success ran %q, want %q", got, want)
+	}
+
+	boom := errors.New("boom")
+	err = h.Run(context.Background(), "/src", func(context.Context) (*scheduler.BackupStats, error) {
+		return nil, boom
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("failed backup returned %v", err)
+	}
+	want = []string{"pre_backup /src", "on_failure /src boom"}
+	if got := lines(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("failure ran %q, want %q", got, want)
+	}
+
+	// A failed pre_backup hook cancels the backup
+	h.PreBackup = "echo not quiesced; exit 3"
+	ran := false
+	err = h.Run(context.Background(), "/src", func(context.Context) (*scheduler.BackupStats, error) {
+		ran = true
+		return nil, nil
+	})
+	if ran || err == nil || !strings.Contains(err.Error(), "pre_backup hook") || !strings.Contains(err.Error(), "not quiesced") {
+		t.Fatalf("failed pre_backup: ran %v, %v", ran, err)
+	}
+	if got := lines(); len(got) != 1 || !strings.HasPrefix(got[0], "on_failure /src") {
+		t.Fatalf("failed pre_backup ran %q", got)
+	}
+
+	// Hooks that overrun are killed
+	h = &scheduler.Hooks{PreBackup: "exec sleep 10", Timeout: 50 * time.Millisecond}
+	err = h.Run(context.Background(), "/src", func(context.Context) (*scheduler.BackupStats, error) { return nil, nil })
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("slow hook: %v", err)
+	}
+}
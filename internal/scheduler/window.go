@@ -0,0 +1,103 @@
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ActiveWindow is a daily span of local time, such as "22:00-06:00", during
+// which background work may run. A window whose end precedes its start wraps
+// past midnight.
+type ActiveWindow struct {
+	Start time.Duration // offset from midnight
+	End   time.Duration
+}
+
+// ParseActiveWindow parses "HH:MM-HH:MM". An empty string yields nil, which
+// means any time.
+func ParseActiveWindow(s string) (*ActiveWindow, error) {
+	if s == "" {
+		return nil, nil
+	}
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("active window %q must look like 22:00-06:00", s)
+	}
+	start, err := parseClock(strings.TrimSpace(from))
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(strings.TrimSpace(to))
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, fmt.Errorf("active window %q is empty", s)
+	}
+	return &ActiveWindow{Start: start, End: end}, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: %w", s, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains reports whether t falls inside the window. A nil window contains
+// every instant.
+func (w *ActiveWindow) Contains(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	off := sinceMidnight(t)
+	if w.Start < w.End {
+		return off >= w.Start && off < w.End
+	}
+	return off >= w.Start || off < w.End
+}
+
+// NextStart returns when the window next opens after t, or t itself if the
+// window is open.
+func (w *ActiveWindow) NextStart(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+	midnight := t.Add(-sinceMidnight(t))
+	next := midnight.Add(w.Start)
+	if !next.After(t) {
+		next = midnight.AddDate(0, 0, 1).Add(w.Start)
+	}
+	return next
+}
+
+// Closes returns when the window open at t closes. A nil window is taken
+// to be open all day and closes at the next midnight.
+func (w *ActiveWindow) Closes(t time.Time) time.Time {
+	midnight := t.Add(-sinceMidnight(t))
+	if w == nil {
+		return midnight.AddDate(0, 0, 1)
+	}
+	end := midnight.Add(w.End)
+	if !end.After(t) {
+		end = midnight.AddDate(0, 0, 1).Add(w.End)
+	}
+	return end
+}
+
+func (w *ActiveWindow) String() string {
+	if w == nil {
+		return "any time"
+	}
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return clock(w.Start) + "-" + clock(w.End)
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	h, m, s := t.Clock()
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+}
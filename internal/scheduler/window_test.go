@@ -0,0 +1,79 @@
+package scheduler_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/scheduler"
+)
+
+func at(hour, min int) time.Time {
+	return time.Date(2024, 3, 10, hour, min, 0, 0, time.UTC)
+}
+
+func TestActiveWindowWrapsMidnight(t *testing.T) {
+	w, err := scheduler.ParseActiveWindow("22:00-06:00")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	for _, tc := range []struct {
+		t    time.Time
+		open bool
+	}{
+		{at(23, 0), true},
+		{at(2, 30), true},
+		{at(6, 0), false},
+		{at(12, 0), false},
+		{at(22, 0), true},
+	} {
+		if got := w.Contains(tc.t); got != tc.open {
+			t.Errorf("Contains(%s) = %v, want %v", tc.t.Format("15:04"), got, tc.open)
+		}
+	}
+
+	if next := w.NextStart(at(12, 0)); !next.Equal(at(22, 0)) {
+		t.Errorf("NextStart(12:00) = %s, want 22:00 same day", next)
+	}
+	if next := w.NextStart(at(1, 0)); !next.Equal(at(1, 0)) {
+		t.Errorf("NextStart inside window should be immediate, got %s", next)
+	}
+}
+
+func TestActiveWindowNextStartTomorrow(t *testing.T) {
+	w, err := scheduler.ParseActiveWindow("01:00-05:00")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := at(1, 0).AddDate(0, 0, 1)
+	if next := w.NextStart(at(9, 0)); !next.Equal(want) {
+		t.Errorf("NextStart(09:00) = %s, want %s", next, want)
+	}
+}
+
+func TestParseActiveWindow(t *testing.T) {
+	if w, err := scheduler.ParseActiveWindow(""); err != nil || w != nil {
+		t.Errorf("empty window should mean any time, got %v, %v", w, err)
+	}
+	for _, bad := range []string{"22:00", "25:00-06:00", "08:00-08:00", "night"} {
+		if _, err := scheduler.ParseActiveWindow(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestActiveWindowCloses(t *testing.T) {
+	w, err := scheduler.ParseActiveWindow("22:00-06:00")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if end := w.Closes(at(23, 0)); !end.Equal(at(6, 0).AddDate(0, 0, 1)) {
+		t.Errorf("Closes(23:00) = %s, want 06:00 next day", end)
+	}
+	if end := w.Closes(at(2, 30)); !end.Equal(at(6, 0)) {
+		t.Errorf("Closes(02:30) = %s, want 06:00 same day", end)
+	}
+	var any *scheduler.ActiveWindow
+	if end := any.Closes(at(15, 0)); !end.Equal(at(0, 0).AddDate(0, 0, 1)) {
+		t.Errorf("nil window Closes(15:00) = %s, want midnight", end)
+	}
+}
@@ -0,0 +1,419 @@
+// Package security inventories the ciphers, key derivation, keys, signatures,
+// transport security and access control in effect for a repository, and
+// flags the choices a policy profile rejects. It reports what this build and
+// configuration do, for audits; it is not a validation of the cryptographic
+// module.
+package security
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hoangsonww/backupagent/config"
+	"github.com/hoangsonww/backupagent/internal/auth"
+	"github.com/hoangsonww/backupagent/internal/crypto"
+)
+
+// Severity ranks how far a finding departs from the profile.
+type Severity string
+
+const (
+	SeverityHigh   Severity = "high"
+	SeverityMedium Severity = "medium"
+	SeverityLow    Severity = "low"
+)
+
+// Algorithms named in the inventory and in profiles
+const (
+	AESGCM     = "AES-256-GCM"
+	SHA256     = "SHA-256"
+	HMACSHA256 = "HMAC-SHA256"
+	HKDFSHA256 = "HKDF-SHA256"
+	Argon2id   = "Argon2id"
+	Ed25519    = "Ed25519"
+	X25519     = "X25519"
+	TLS13      = "TLS 1.3"
+	Noise      = "Noise XX (X25519, ChaCha20-Poly1305)"
+	PlainHTTP  = "none (plain HTTP)"
+)
+
+// gcmRandomNonceLimit is how many messages one key may encrypt under random
+// 96-bit nonces (NIST SP 800-38D, 8.3)
+const gcmRandomNonceLimit = 1 << 32
+
+// Profile is a policy the inventory is checked against.
+type Profile struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Approved lists the algorithms the profile accepts; nil accepts any
+	Approved map[string]bool `json:"-"`
+	// The weakest Argon2id parameters accepted, memory in KiB
+	MinKDFTime   uint32 `json:"-"`
+	MinKDFMemory uint32 `json:"-"`
+	// MaxKeyAge is the longest a key may stay in use; 0 leaves ages unchecked
+	MaxKeyAge time.Duration `json:"-"`
+	// TwoPersonRule requires destructive remote operations to need two admins
+	TwoPersonRule bool `json:"-"`
+}
+
+// Profiles are the built-in policy profiles by name.
+var Profiles = map[string]*Profile{
+	"baseline": {
+		Name:         "baseline",
+		Description:  "current practice: OWASP minimums for Argon2id, no algorithm restrictions",
+		MinKDFTime:   1,
+		MinKDFMemory: 46 * 1024,
+	},
+	"fips": {
+		Name:        "fips",
+		Description: "FIPS 140-3 style: NIST-approved algorithms only, SP 800-57 cryptoperiods, two-person rule",
+		Approved: map[string]bool{
+			AESGCM: true, SHA256: true, HMACSHA256: true, HKDFSHA256: true, Ed25519: true, TLS13: true,
+		},
+		MinKDFTime:    1,
+		MinKDFMemory:  46 * 1024,
+		MaxKeyAge:     2 * 365 * 24 * time.Hour,
+		TwoPersonRule: true,
+	},
+}
+
+// ProfileNames returns the names of the built-in profiles, sorted.
+func ProfileNames() []string {
+	names := make([]string, 0, len(Profiles))
+	for name := range Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// State is what the repository holds that the report reads besides the
+// configuration, collected by the agent.
+type State struct {
+	RepoID        string
+	SaltSize      int                    // bytes of the master key salt
+	StateSealed   bool                   // peer and mirror state encrypted at rest
+	Chunks        int64                  // chunks stored, each encrypted under the master key
+	KeySince      time.Time              // oldest snapshot kept, so the master key is at least this old; zero when none
+	IdentityKey   string                 // type of the node identity key, e.g. Ed25519
+	IdentitySince time.Time              // when the identity key file was written
+	IdentityMode  fs.FileMode            // permissions of the identity key file; 0 on Windows
+	Admins        []string               // active admin keys
+	Revoked       []auth.RevocationEntry // revoked admin keys
+	Dicts         int                    // compression dictionaries stored
+}
+
+// Item is one mechanism in effect.
+type Item struct {
+	Area      string `json:"area"`
+	Use       string `json:"use"`
+	Algorithm string `json:"algorithm"`
+	Detail    string `json:"detail,omitempty"`
+	Approved  bool   `json:"approved"` // accepted by the profile
+
+	severity Severity // of the finding when it is not approved
+}
+
+// Finding is a choice the profile flags.
+type Finding struct {
+	Area     string   `json:"area"`
+	Issue    string   `json:"issue"`
+	Severity Severity `json:"severity"`
+	Detail   string   `json:"detail"`
+	Remedy   string   `json:"remedy,omitempty"`
+}
+
+// Report is the inventory of a repository checked against a profile.
+type Report struct {
+	Profile   *Profile  `json:"profile"`
+	RepoID    string    `json:"repo_id"`
+	Generated time.Time `json:"generated"`
+	Inventory []Item    `json:"inventory"`
+	Findings  []Finding `json:"findings"`
+}
+
+// Generate inventories what cfg and st put in effect and checks it against
+// profile.
+func Generate(cfg *config.Config, st *State, profile *Profile, now time.Time) *Report {
+	r := &Report{Profile: profile, RepoID: st.RepoID, Generated: now.UTC()}
+
+	chunks := fmt.Sprintf("one master key, random 96-bit nonces; %d chunks encrypted", st.Chunks)
+	if cfg.Snapshot.Compression {
+		chunks += fmt.Sprintf(", zstd-compressed first (%d trained dictionaries)", st.Dicts)
+	}
+	r.item(Item{Area: "data at rest", Use: "chunk encryption", Algorithm: AESGCM, severity: SeverityHigh, Detail: chunks})
+	r.item(Item{Area: "data at rest", Use: "chunk addressing and integrity", Algorithm: SHA256, severity: SeverityMedium,
+		Detail: "unkeyed hash of the plaintext"})
+	if cfg.Snapshot.PlainMetadata {
+		r.item(Item{Area: "data at rest", Use: "snapshot manifests", Algorithm: "none", severity: SeverityMedium,
+			Detail: "source path and host readable to hosting peers"})
+	} else {
+		r.item(Item{Area: "data at rest", Use: "snapshot manifests", Algorithm: AESGCM, severity: SeverityMedium,
+			Detail: "source path and host sealed under the master key"})
+	}
+	r.item(Item{Area: "keys", Use: "master key derivation", Algorithm: Argon2id, severity: SeverityHigh,
+		Detail: fmt.Sprintf("t=%d, m=%d MiB, p=%d, %d-byte salt, %d-bit key",
+			crypto.KDFTime, crypto.KDFMemory/1024, crypto.KDFThreads, st.SaltSize, crypto.KeySize*8)})
+	r.item(Item{Area: "keys", Use: "state key derivation", Algorithm: HKDFSHA256, severity: SeverityMedium,
+		Detail: "state encryption and key hashing keys from the master key"})
+	if st.StateSealed {
+		r.item(Item{Area: "data at rest", Use: "peer and mirror state", Algorithm: AESGCM, severity: SeverityMedium,
+			Detail: "values encrypted, keys replaced by " + HMACSHA256})
+		r.item(Item{Area: "data at rest", Use: "peer and mirror state keys", Algorithm: HMACSHA256, severity: SeverityMedium})
+	} else {
+		r.item(Item{Area: "data at rest", Use: "peer and mirror state", Algorithm: "none", severity: SeverityMedium,
+			Detail: "not sealed yet"})
+	}
+	r.item(Item{Area: "signatures", Use: "node identity, snapshots, share links, peer exchange", Algorithm: st.IdentityKey, severity: SeverityHigh,
+		Detail: identityDetail(st)})
+	r.item(Item{Area: "signatures", Use: "admin key updates and approvals", Algorithm: Ed25519, severity: SeverityHigh,
+		Detail: fmt.Sprintf("%d active admin key(s), %d revoked", len(st.Admins), len(st.Revoked))})
+	if n := len(cfg.Recovery.TrustedPeers); n > 0 {
+		r.item(Item{Area: "keys", Use: "recovery key shares", Algorithm: X25519, severity: SeverityMedium,
+			Detail: fmt.Sprintf("Shamir split %d of %d, each sealed to its trustee with %s, %s and %s",
+				cfg.Recovery.Threshold, n, X25519, SHA256, AESGCM)})
+	}
+	r.item(Item{Area: "transport", Use: "peer connections", Algorithm: TLS13, severity: SeverityMedium,
+		Detail: "libp2p TLS, preferred"})
+	r.item(Item{Area: "transport", Use: "peer connections", Algorithm: Noise, severity: SeverityMedium,
+		Detail: "libp2p Noise, used by peers that do not offer TLS"})
+	if cfg.API.Enable {
+		r.item(Item{Area: "transport", Use: "HTTP API", Algorithm: PlainHTTP, severity: SeverityHigh,
+			Detail: fmt.Sprintf("port %d on all interfaces, bearer token of %d characters", cfg.API.Port, len(cfg.API.Token))})
+	}
+
+	r.check(cfg, st, now)
+	return r
+}
+
+// item adds it to the inventory, flagging it when the profile does not
+// approve its algorithm
+func (r *Report) item(it Item) {
+	p := r.Profile
+	// Unprotected items get findings of their own
+	unprotected := it.Algorithm == "none" || it.Algorithm == PlainHTTP
+	it.Approved = !unprotected && (p.Approved == nil || p.Approved[it.Algorithm])
+	r.Inventory = append(r.Inventory, it)
+	if !it.Approved && !unprotected {
+		r.add(Finding{
+			Area:     it.Area,
+			Issue:    it.Algorithm + " is not approved",
+			Severity: it.severity,
+			Detail:   fmt.Sprintf("%s uses %s, which the %s profile does not approve.", it.Use, it.Algorithm, p.Name),
+		})
+	}
+}
+
+// check adds the findings about parameters, key ages and access control
+func (r *Report) check(cfg *config.Config, st *State, now time.Time) {
+	p := r.Profile
+	if crypto.KDFTime < p.MinKDFTime || crypto.KDFMemory < p.MinKDFMemory {
+		r.add(Finding{
+			Area:     "keys",
+			Issue:    "weak key derivation parameters",
+			Severity: SeverityHigh,
+			Detail: fmt.Sprintf("Argon2id runs %d pass(es) over %d MiB; the profile asks for at least %d over %d MiB.",
+				crypto.KDFTime, crypto.KDFMemory/1024, p.MinKDFTime, p.MinKDFMemory/1024),
+		})
+	}
+	if st.SaltSize < 16 {
+		r.add(Finding{
+			Area:     "keys",
+			Issue:    "short key salt",
+			Severity: SeverityMedium,
+			Detail:   fmt.Sprintf("The master key salt is %d bytes; 16 or more are expected.", st.SaltSize),
+		})
+	}
+	if st.Chunks >= gcmRandomNonceLimit/2 {
+		sev := SeverityMedium
+		if st.Chunks >= gcmRandomNonceLimit {
+			sev = SeverityHigh
+		}
+		r.add(Finding{
+			Area:     "data at rest",
+			Issue:    "master key near its encryption limit",
+			Severity: sev,
+			Detail: fmt.Sprintf("%d chunks are encrypted under one key with random nonces; "+
+				"NIST SP 800-38D allows 2^32.", st.Chunks),
+			Remedy: "start a new repository, with a new passphrase, for further backups",
+		})
+	}
+	if p.MaxKeyAge > 0 && !st.KeySince.IsZero() && now.Sub(st.KeySince) > p.MaxKeyAge {
+		r.add(Finding{
+			Area:     "keys",
+			Issue:    "master key past its cryptoperiod",
+			Severity: SeverityMedium,
+			Detail: fmt.Sprintf("The master key has encrypted chunks since at least %s; the profile allows %s.",
+				st.KeySince.Format(time.DateOnly), age(p.MaxKeyAge)),
+			Remedy: "start a new repository, with a new passphrase, for further backups",
+		})
+	}
+	if p.MaxKeyAge > 0 && !st.IdentitySince.IsZero() && now.Sub(st.IdentitySince) > p.MaxKeyAge {
+		r.add(Finding{
+			Area:     "signatures",
+			Issue:    "identity key past its cryptoperiod",
+			Severity: SeverityLow,
+			Detail: fmt.Sprintf("The node identity key was created %s; the profile allows %s.",
+				st.IdentitySince.Format(time.DateOnly), age(p.MaxKeyAge)),
+		})
+	}
+	if st.IdentityMode&0o077 != 0 {
+		r.add(Finding{
+			Area:     "signatures",
+			Issue:    "identity key readable by others",
+			Severity: SeverityHigh,
+			Detail:   fmt.Sprintf("The identity key file has mode %s; anyone who reads it can sign as this node.", st.IdentityMode.Perm()),
+			Remedy:   "chmod 600 the identity.key file in repository_path",
+		})
+	}
+	if !st.StateSealed {
+		r.add(Finding{
+			Area:     "data at rest",
+			Issue:    "state not sealed",
+			Severity: SeverityMedium,
+			Detail:   "Peer, mirror and placement state is stored in the clear in metadata.db.",
+			Remedy:   "start the agent once with the passphrase to seal it",
+		})
+	}
+	if cfg.Snapshot.PlainMetadata {
+		r.add(Finding{
+			Area:     "data at rest",
+			Issue:    "plain snapshot metadata",
+			Severity: SeverityMedium,
+			Detail:   "snapshot.plain_metadata leaves source paths and host names readable to hosting peers.",
+			Remedy:   "unset snapshot.plain_metadata once every peer understands sealed metadata",
+		})
+	}
+	if cfg.API.Enable {
+		r.add(Finding{
+			Area:     "transport",
+			Issue:    "API served without TLS",
+			Severity: SeverityHigh,
+			Detail:   "The API token, snapshot listings and restored files cross the network unencrypted.",
+			Remedy:   "bind the API behind a TLS-terminating reverse proxy or disable api.enable",
+		})
+	}
+	r.checkACL(cfg, st)
+}
+
+// checkACL adds the findings about admins and trustees
+func (r *Report) checkACL(cfg *config.Config, st *State) {
+	revoked := make(map[string]bool, len(st.Revoked))
+	for _, e := range st.Revoked {
+		revoked[e.AdminPub] = true
+	}
+	var invalid, stale []string
+	for _, a := range cfg.ACL.Admins {
+		if pub, err := auth.StringToPubKey(a); err != nil || len(pub) != 32 {
+			invalid = append(invalid, a)
+		} else if revoked[a] {
+			stale = append(stale, a)
+		}
+	}
+	if len(invalid) > 0 {
+		r.add(Finding{
+			Area:     "access control",
+			Issue:    "malformed admin keys",
+			Severity: SeverityMedium,
+			Detail:   fmt.Sprintf("acl.admins lists %d entries that are not Ed25519 public keys: %s.", len(invalid), strings.Join(invalid, ", ")),
+			Remedy:   "remove them from acl.admins",
+		})
+	}
+	if len(stale) > 0 {
+		r.add(Finding{
+			Area:     "access control",
+			Issue:    "revoked admin keys still configured",
+			Severity: SeverityLow,
+			Detail:   fmt.Sprintf("acl.admins lists %d revoked key(s); the revocation wins, but the config misleads readers.", len(stale)),
+			Remedy:   "remove them from acl.admins",
+		})
+	}
+	if r.Profile.TwoPersonRule && !cfg.ACL.TwoPersonRule && len(st.Admins) > 0 {
+		r.add(Finding{
+			Area:     "access control",
+			Issue:    "two-person rule off",
+			Severity: SeverityMedium,
+			Detail:   fmt.Sprintf("Any one of %d admin key(s) can remove peers and change admins alone.", len(st.Admins)),
+			Remedy:   "set acl.two_person_rule: true",
+		})
+	}
+	if len(cfg.Recovery.TrustedPeers) > 0 && cfg.Recovery.Threshold < 2 {
+		r.add(Finding{
+			Area:     "access control",
+			Issue:    "single-trustee recovery",
+			Severity: SeverityMedium,
+			Detail:   "recovery.threshold lets one trustee recover the master key alone.",
+			Remedy:   "raise recovery.threshold to 2 or more",
+		})
+	}
+}
+
+func identityDetail(st *State) string {
+	if st.IdentitySince.IsZero() {
+		return "identity key file not found"
+	}
+	if st.IdentityMode == 0 {
+		return "identity key created " + st.IdentitySince.Format(time.DateOnly)
+	}
+	return fmt.Sprintf("identity key created %s, mode %s", st.IdentitySince.Format(time.DateOnly), st.IdentityMode.Perm())
+}
+
+// age renders d in years or days
+func age(d time.Duration) string {
+	days := int(d / (24 * time.Hour))
+	if days%365 == 0 {
+		return fmt.Sprintf("%d year(s)", days/365)
+	}
+	return fmt.Sprintf("%d days", days)
+}
+
+func (r *Report) add(f Finding) {
+	r.Findings = append(r.Findings, f)
+}
+
+// Count returns the number of findings with the given severity.
+func (r *Report) Count(s Severity) int {
+	n := 0
+	for _, f := range r.Findings {
+		if f.Severity == s {
+			n++
+		}
+	}
+	return n
+}
+
+// WriteText renders the report for a terminal.
+func (r *Report) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Security report for repository %s, profile %s (%s)\n", r.RepoID, r.Profile.Name, r.Profile.Description)
+	fmt.Fprintf(&b, "Generated %s\n\n", r.Generated.Format(time.RFC1123))
+
+	fmt.Fprintln(&b, "Inventory:")
+	for _, it := range r.Inventory {
+		mark := "ok"
+		if !it.Approved {
+			mark = "!!"
+		}
+		fmt.Fprintf(&b, "  [%s] %-13s %-52s %s\n", mark, it.Area, it.Use, it.Algorithm)
+		if it.Detail != "" {
+			fmt.Fprintf(&b, "       %s\n", it.Detail)
+		}
+	}
+
+	fmt.Fprintf(&b, "\n%d finding(s) (%d high, %d medium, %d low)\n",
+		len(r.Findings), r.Count(SeverityHigh), r.Count(SeverityMedium), r.Count(SeverityLow))
+	for i, f := range r.Findings {
+		fmt.Fprintf(&b, "\n%d. [%s] %s (%s)\n", i+1, f.Severity, f.Issue, f.Area)
+		fmt.Fprintf(&b, "   %s\n", f.Detail)
+		if f.Remedy != "" {
+			fmt.Fprintf(&b, "   remedy: %s\n", f.Remedy)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
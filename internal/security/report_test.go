@@ -0,0 +1,88 @@
+package security_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/config"
+	"github.com/hoangsonww/backupagent/internal/auth"
+	"github.com/hoangsonww/backupagent/internal/security"
+)
+
+func findIssue(r *security.Report, issue string) *security.Finding {
+	for i := range r.Findings {
+		if r.Findings[i].Issue == issue {
+			return &r.Findings[i]
+		}
+	}
+	return nil
+}
+
+func TestReportFollowsProfile(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	admin := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	cfg := &config.Config{}
+	cfg.ACL.Admins = []string{admin}
+	st := &security.State{
+		RepoID:        "repo",
+		SaltSize:      16,
+		StateSealed:   true,
+		Chunks:        1000,
+		KeySince:      now.AddDate(-3, 0, 0),
+		IdentityKey:   security.Ed25519,
+		IdentitySince: now.AddDate(0, -1, 0),
+		IdentityMode:  0o600,
+		Admins:        []string{admin},
+	}
+
+	r := security.Generate(cfg, st, security.Profiles["baseline"], now)
+	if len(r.Findings) != 0 {
+		t.Fatalf("baseline flags a sound repository: %+v", r.Findings)
+	}
+
+	r = security.Generate(cfg, st, security.Profiles["fips"], now)
+	if f := findIssue(r, security.Argon2id+" is not approved"); f == nil || f.Severity != security.SeverityHigh {
+		t.Errorf("fips: Argon2id finding = %+v", f)
+	}
+	if findIssue(r, security.Noise+" is not approved") == nil {
+		t.Error("fips: Noise transport not flagged")
+	}
+	if findIssue(r, security.AESGCM+" is not approved") != nil {
+		t.Error("fips: AES-GCM flagged")
+	}
+	if findIssue(r, "master key past its cryptoperiod") == nil {
+		t.Error("fips: 3-year-old master key not flagged")
+	}
+	if findIssue(r, "identity key past its cryptoperiod") != nil {
+		t.Error("fips: 1-month-old identity key flagged")
+	}
+	if findIssue(r, "two-person rule off") == nil {
+		t.Error("fips: two-person rule not required")
+	}
+
+	cfg.API.Enable = true
+	cfg.ACL.Admins = append(cfg.ACL.Admins, "peerPubKeyBase64...")
+	st.IdentityMode = 0o644
+	st.StateSealed = false
+	st.Revoked = []auth.RevocationEntry{{AdminPub: admin, RevokedAt: now}}
+	r = security.Generate(cfg, st, security.Profiles["baseline"], now)
+	for issue, sev := range map[string]security.Severity{
+		"API served without TLS":              security.SeverityHigh,
+		"identity key readable by others":     security.SeverityHigh,
+		"state not sealed":                    security.SeverityMedium,
+		"malformed admin keys":                security.SeverityMedium,
+		"revoked admin keys still configured": security.SeverityLow,
+	} {
+		if f := findIssue(r, issue); f == nil || f.Severity != sev {
+			t.Errorf("%s: finding = %+v, want severity %s", issue, f, sev)
+		}
+	}
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil || !strings.Contains(b.String(), "remedy: chmod 600") {
+		t.Errorf("WriteText = %q, %v", b.String(), err)
+	}
+}
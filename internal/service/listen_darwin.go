@@ -0,0 +1,51 @@
+//go:build darwin && cgo
+
+package service
+
+/*
+#include <launch.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Listeners returns the API sockets launchd opened for the job, one per
+// address family, or none when launchd did not start the process or its
+// job declares no API socket.
+func Listeners() ([]net.Listener, error) {
+	name := C.CString(SocketName)
+	defer C.free(unsafe.Pointer(name))
+	var fds *C.int
+	var n C.size_t
+	if rc := C.launch_activate_socket(name, &fds, &n); rc != 0 {
+		err := syscall.Errno(rc)
+		if errors.Is(err, syscall.ESRCH) || errors.Is(err, syscall.ENOENT) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("launchd socket %s: %w", SocketName, err)
+	}
+	defer C.free(unsafe.Pointer(fds))
+
+	var listeners []net.Listener
+	for _, fd := range unsafe.Slice(fds, int(n)) {
+		f := os.NewFile(uintptr(fd), SocketName)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("launchd socket %s: %w", SocketName, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
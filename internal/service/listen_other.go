@@ -0,0 +1,11 @@
+//go:build !(darwin && cgo)
+
+package service
+
+import "net"
+
+// Listeners returns the sockets the service manager opened for the API;
+// none on this platform, where the API listens by itself.
+func Listeners() ([]net.Listener, error) {
+	return nil, nil
+}
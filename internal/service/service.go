@@ -0,0 +1,42 @@
+// Package service runs the daemon under the platform's service manager. On
+// Windows it answers the service control manager and logs to the Windows
+// event log; on macOS it runs as a launchd daemon, serving the API on the
+// socket launchd holds open for it. Started from a terminal, or on other
+// platforms, the daemon runs in the foreground as before.
+//
+// WatchSessionEnd holds off shutdown, through a systemd-logind delay
+// inhibitor on Linux and the service control manager on Windows, while the
+// daemon does its last work.
+package service
+
+import "errors"
+
+// Names the daemon is registered under
+const (
+	Name        = "ShadowVault"              // Windows service and event source
+	Label       = "com.shadowvault.agent"    // launchd job
+	DisplayName = "ShadowVault Backup Agent" // shown in the services console
+	Description = "Encrypted peer-to-peer backups of this computer"
+
+	// SocketName names the API socket in the launchd job
+	SocketName = "API"
+)
+
+// Why WatchSessionEnd calls back
+const (
+	EndShutdown = "shutdown" // the system is shutting down or restarting
+	EndLogout   = "logout"   // a user is logging out
+)
+
+// ErrUnsupported is returned by Install and Uninstall on platforms whose
+// service manager this build does not know.
+var ErrUnsupported = errors.New("no supported service manager on this platform")
+
+// Config describes the daemon to register with the service manager.
+type Config struct {
+	Executable string   // absolute path of the binary
+	Args       []string // arguments running the daemon
+	Dir        string   // working directory, so relative paths in the config resolve
+	APIPort    int      // port launchd listens on for the API; 0 for none
+	LogFile    string   // where launchd sends output; ignored on Windows
+}
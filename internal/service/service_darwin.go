@@ -0,0 +1,106 @@
+//go:build darwin
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// plistDir holds the definitions of system-wide launchd daemons
+const plistDir = "/Library/LaunchDaemons"
+
+// Managed reports whether launchd started the process as the installed job.
+func Managed() bool {
+	return os.Getenv("XPC_SERVICE_NAME") == Label
+}
+
+// Run runs daemon in the foreground. launchd stops a job with SIGTERM, then
+// SIGKILL after its exit timeout, so daemon's own signal handling applies.
+func Run(daemon func(ctx context.Context) error) error {
+	return daemon(context.Background())
+}
+
+// Install writes the launchd job of the daemon, kept alive and started at
+// boot. With an API port, launchd opens the socket and passes it on, so the
+// API answers as soon as the machine is up. It returns the command loading
+// the job.
+func Install(cfg Config) (string, error) {
+	path := plistPath()
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("%s already exists", path)
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+`)
+	key := func(k string) { fmt.Fprintf(&b, "\t<key>%s</key>\n", k) }
+	str := func(indent, s string) {
+		b.WriteString(indent + "<string>")
+		xml.EscapeText(&b, []byte(s))
+		b.WriteString("</string>\n")
+	}
+	key("Label")
+	str("\t", Label)
+	key("ProgramArguments")
+	b.WriteString("\t<array>\n")
+	for _, arg := range append([]string{cfg.Executable}, cfg.Args...) {
+		str("\t\t", arg)
+	}
+	b.WriteString("\t</array>\n")
+	if cfg.Dir != "" {
+		key("WorkingDirectory")
+		str("\t", cfg.Dir)
+	}
+	key("RunAtLoad")
+	b.WriteString("\t<true/>\n")
+	key("KeepAlive")
+	b.WriteString("\t<dict>\n\t\t<key>SuccessfulExit</key>\n\t\t<false/>\n\t</dict>\n")
+	key("ExitTimeOut")
+	b.WriteString("\t<integer>30</integer>\n")
+	if cfg.LogFile != "" {
+		key("StandardOutPath")
+		str("\t", cfg.LogFile)
+		key("StandardErrorPath")
+		str("\t", cfg.LogFile)
+	}
+	if cfg.APIPort > 0 {
+		key("Sockets")
+		fmt.Fprintf(&b, "\t<dict>\n\t\t<key>%s</key>\n\t\t<dict>\n", SocketName)
+		b.WriteString("\t\t\t<key>SockServiceName</key>\n")
+		str("\t\t\t", strconv.Itoa(cfg.APIPort))
+		b.WriteString("\t\t\t<key>SockType</key>\n")
+		str("\t\t\t", "stream")
+		b.WriteString("\t\t</dict>\n\t</dict>\n")
+	}
+	b.WriteString("</dict>\n</plist>\n")
+
+	if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+		return "", fmt.Errorf("%w; run as root", err)
+	}
+	return "sudo launchctl bootstrap system " + path, nil
+}
+
+// Uninstall removes the launchd job. A loaded job keeps running until it is
+// booted out.
+func Uninstall() error {
+	if err := os.Remove(plistPath()); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("launchd job %s is not installed", Label)
+		}
+		return err
+	}
+	return nil
+}
+
+func plistPath() string {
+	return filepath.Join(plistDir, Label+".plist")
+}
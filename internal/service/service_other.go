@@ -0,0 +1,26 @@
+//go:build !windows && !darwin
+
+package service
+
+import "context"
+
+// Managed reports whether a service manager this package knows started the
+// process; never on this platform.
+func Managed() bool {
+	return false
+}
+
+// Run runs daemon in the foreground.
+func Run(daemon func(ctx context.Context) error) error {
+	return daemon(context.Background())
+}
+
+// Install is not supported on this platform.
+func Install(cfg Config) (string, error) {
+	return "", ErrUnsupported
+}
+
+// Uninstall is not supported on this platform.
+func Uninstall() error {
+	return ErrUnsupported
+}
@@ -0,0 +1,250 @@
+//go:build windows
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+)
+
+const (
+	// stopWaitHint is how long the service control manager is told a stop
+	// may take before it considers the service hung
+	stopWaitHint = 30 * time.Second
+
+	// Event IDs written to the event log
+	eventInfo    = 1
+	eventWarning = 2
+	eventError   = 3
+)
+
+// Managed reports whether the service control manager started the process.
+func Managed() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// Run runs daemon until it returns. Under the service control manager, Stop,
+// Shutdown and PreShutdown requests cancel its context, the latter two once
+// the function given to WatchSessionEnd returns, and everything logged
+// also goes to the event log; otherwise daemon runs in the foreground.
+func Run(daemon func(ctx context.Context) error) error {
+	if !Managed() {
+		return daemon(context.Background())
+	}
+	elog, err := eventlog.Open(Name)
+	if err != nil {
+		return fmt.Errorf("event source %s is not registered, run service install: %w", Name, err)
+	}
+	defer elog.Close()
+	monitoring.SetSink(func(level monitoring.LogLevel, entry monitoring.LogEntry) {
+		switch {
+		case level >= monitoring.ErrorLevel:
+			elog.Error(eventError, eventText(entry))
+		case level == monitoring.WarnLevel:
+			elog.Warning(eventWarning, eventText(entry))
+		default:
+			elog.Info(eventInfo, eventText(entry))
+		}
+	})
+	defer monitoring.SetSink(nil)
+	return svc.Run(Name, &handler{daemon: daemon, elog: elog})
+}
+
+// sessionEnd is what WatchSessionEnd asked the handler to call
+var sessionEnd struct {
+	sync.Mutex
+	ctx    context.Context
+	budget time.Duration
+	fn     func(ctx context.Context, reason string)
+}
+
+// WatchSessionEnd calls fn, with a context ending after budget, when the
+// system is about to shut down or a user logs out, until ctx ends. The
+// service is stopped for a shutdown only once fn returns; logouts do not
+// wait for it. Only the service control manager reports either.
+func WatchSessionEnd(ctx context.Context, budget time.Duration, fn func(ctx context.Context, reason string)) error {
+	if !Managed() {
+		return errors.New("shutdown and logout are only reported to the service")
+	}
+	sessionEnd.Lock()
+	sessionEnd.ctx, sessionEnd.budget, sessionEnd.fn = ctx, budget, fn
+	sessionEnd.Unlock()
+	return nil
+}
+
+// endSession calls the function WatchSessionEnd was given, if any, and
+// reports whether it did
+func endSession(reason string) bool {
+	sessionEnd.Lock()
+	ctx, budget, fn := sessionEnd.ctx, sessionEnd.budget, sessionEnd.fn
+	sessionEnd.Unlock()
+	if fn == nil || ctx.Err() != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+	fn(ctx, reason)
+	return true
+}
+
+// endBudget is how long endSession may take, or 0 without a watcher
+func endBudget() time.Duration {
+	sessionEnd.Lock()
+	defer sessionEnd.Unlock()
+	if sessionEnd.fn == nil {
+		return 0
+	}
+	return sessionEnd.budget
+}
+
+type handler struct {
+	daemon func(ctx context.Context) error
+	elog   *eventlog.Log
+}
+
+// Execute reports the daemon running and cancels it when asked to stop. A
+// daemon failing on its own exits with an error code, so the recovery
+// actions set by Install restart it.
+func (h *handler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPreShutdown | svc.AcceptSessionChange
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- h.daemon(ctx) }()
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+
+	stopping := false
+	for {
+		select {
+		case err := <-done:
+			if err != nil && !(stopping && errors.Is(err, context.Canceled)) {
+				h.elog.Error(eventError, fmt.Sprintf("%s stopped: %v", DisplayName, err))
+				return false, 1
+			}
+			return false, 0
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.SessionChange:
+				if r.EventType == windows.WTS_SESSION_LOGOFF && !stopping {
+					go endSession(EndLogout)
+				}
+			case svc.Stop:
+				if !stopping {
+					stopping = true
+					status <- svc.Status{State: svc.StopPending, WaitHint: uint32(stopWaitHint / time.Millisecond)}
+					cancel()
+				}
+			case svc.Shutdown, svc.PreShutdown:
+				if !stopping {
+					// The daemon keeps running until the shutdown work is
+					// done, within its budget
+					stopping = true
+					wait := stopWaitHint + endBudget()
+					status <- svc.Status{State: svc.StopPending, WaitHint: uint32(wait / time.Millisecond)}
+					go func() {
+						endSession(EndShutdown)
+						cancel()
+					}()
+				}
+			}
+		}
+	}
+}
+
+// Install registers the daemon as an automatically started service that
+// is restarted after failures, and the event source it logs to. It returns
+// the command starting the service.
+func Install(cfg Config) (string, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return "", fmt.Errorf("cannot reach the service control manager, run as administrator: %w", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(Name); err == nil {
+		s.Close()
+		return "", fmt.Errorf("service %s is already installed", Name)
+	}
+	s, err := m.CreateService(Name, cfg.Executable, mgr.Config{
+		DisplayName:      DisplayName,
+		Description:      Description,
+		StartType:        mgr.StartAutomatic,
+		DelayedAutoStart: true,
+	}, cfg.Args...)
+	if err != nil {
+		return "", err
+	}
+	defer s.Close()
+
+	restart := []mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 10 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: time.Minute},
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Minute},
+	}
+	err = s.SetRecoveryActions(restart, uint32((24 * time.Hour).Seconds()))
+	if err == nil {
+		err = s.SetRecoveryActionsOnNonCrashFailures(true)
+	}
+	if err == nil {
+		err = eventlog.InstallAsEventCreate(Name, eventlog.Error|eventlog.Warning|eventlog.Info)
+	}
+	if err != nil {
+		s.Delete()
+		return "", err
+	}
+	return "sc start " + Name, nil
+}
+
+// Uninstall removes the service and its event source. A running service is
+// deleted once it stops.
+func Uninstall() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("cannot reach the service control manager, run as administrator: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(Name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", Name)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	return eventlog.Remove(Name)
+}
+
+// eventText renders a log entry for the event log, which stamps its own
+// time and level
+func eventText(entry monitoring.LogEntry) string {
+	var b strings.Builder
+	b.WriteString(entry.Message)
+	keys := make([]string, 0, len(entry.Fields))
+	for k := range entry.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "\n%s=%v", k, entry.Fields[k])
+	}
+	if entry.Error != "" {
+		fmt.Fprintf(&b, "\nerror=%s", entry.Error)
+	}
+	return b.String()
+}
@@ -0,0 +1,95 @@
+//go:build linux
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+)
+
+const (
+	logindDest   = "org.freedesktop.login1"
+	logindPath   = dbus.ObjectPath("/org/freedesktop/login1")
+	logindIface  = "org.freedesktop.login1.Manager"
+	inhibitWhy   = "Snapshotting critical paths before shutdown"
+	prepareEvent = "PrepareForShutdown"
+)
+
+// WatchSessionEnd calls fn, with a context ending after budget, when the
+// system is about to shut down or restart, until ctx ends. A delay
+// inhibitor taken from systemd-logind holds shutdown off until fn returns,
+// for at most logind's InhibitDelayMaxSec. Logouts cannot be delayed on
+// Linux and are not reported.
+func WatchSessionEnd(ctx context.Context, budget time.Duration, fn func(ctx context.Context, reason string)) error {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return fmt.Errorf("cannot reach the system bus: %w", err)
+	}
+	login := conn.Object(logindDest, logindPath)
+	inhibit := func() (int, error) {
+		var fd dbus.UnixFD
+		err := login.CallWithContext(ctx, logindIface+".Inhibit", 0, "shutdown", DisplayName, inhibitWhy, "delay").Store(&fd)
+		return int(fd), err
+	}
+	fd, err := inhibit()
+	if err == nil {
+		err = conn.AddMatchSignal(dbus.WithMatchObjectPath(logindPath), dbus.WithMatchInterface(logindIface), dbus.WithMatchMember(prepareEvent))
+	}
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("cannot take a shutdown inhibitor from systemd-logind: %w", err)
+	}
+	signals := make(chan *dbus.Signal, 4)
+	conn.Signal(signals)
+
+	go func() {
+		logger := monitoring.GetLogger()
+		defer conn.Close()
+		defer func() {
+			if fd >= 0 {
+				syscall.Close(fd)
+			}
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig, ok := <-signals:
+				if !ok {
+					return
+				}
+				if sig.Name != logindIface+"."+prepareEvent || len(sig.Body) != 1 {
+					continue
+				}
+				if starting, _ := sig.Body[0].(bool); !starting {
+					// Shutdown was cancelled; hold off the next one
+					if fd < 0 {
+						again, err := inhibit()
+						if err != nil {
+							logger.WithError(err).Warn("Failed to take a shutdown inhibitor again")
+							continue
+						}
+						fd = again
+					}
+					continue
+				}
+				if fd < 0 {
+					continue
+				}
+				endCtx, cancel := context.WithTimeout(ctx, budget)
+				fn(endCtx, EndShutdown)
+				cancel()
+				// Closing the inhibitor lets shutdown go on
+				syscall.Close(fd)
+				fd = -1
+			}
+		}
+	}()
+	return nil
+}
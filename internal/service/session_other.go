@@ -0,0 +1,13 @@
+//go:build !linux && !windows
+
+package service
+
+import (
+	"context"
+	"time"
+)
+
+// WatchSessionEnd is not supported on this platform.
+func WatchSessionEnd(ctx context.Context, budget time.Duration, fn func(ctx context.Context, reason string)) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,155 @@
+package setup
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/hoangsonww/backupagent/config"
+)
+
+// Answers are the choices made in the wizard.
+type Answers struct {
+	RepositoryPath string
+	ListenPort     int
+	BackupPaths    []string
+	Interval       time.Duration // between scheduled backups of BackupPaths; 0 schedules none
+	Peers          []string      // multiaddrs to connect to on start
+	Mirrors        []Mirror
+	TrustedPeers   []string // base64 Ed25519 keys of recovery share holders
+	Threshold      int
+}
+
+// Mirror is a peer to replicate every snapshot to.
+type Mirror struct {
+	Peer         string
+	RepositoryID string
+}
+
+// file is the part of the config the wizard sets; everything else keeps
+// its default
+type file struct {
+	RepositoryPath string   `yaml:"repository_path"`
+	ListenPort     int      `yaml:"listen_port"`
+	PeerBootstrap  []string `yaml:"peer_bootstrap"`
+	Scheduler      struct {
+		EnableAutoBackup bool     `yaml:"enable_auto_backup"`
+		BackupInterval   string   `yaml:"backup_interval,omitempty"`
+		BackupPaths      []string `yaml:"backup_paths"`
+	} `yaml:"scheduler"`
+	Recovery *recoveryFile `yaml:"recovery,omitempty"`
+	Mirrors  []mirrorFile  `yaml:"mirrors,omitempty"`
+}
+
+type recoveryFile struct {
+	TrustedPeers []string `yaml:"trusted_peers"`
+	Threshold    int      `yaml:"threshold"`
+}
+
+type mirrorFile struct {
+	Peer         string `yaml:"peer"`
+	RepositoryID string `yaml:"repository_id"`
+}
+
+const header = `# Written by "backup-agent setup". Settings left out take their defaults;
+# see config.yaml in the source tree for all of them.
+`
+
+// YAML returns the config file for a.
+func (a *Answers) YAML() ([]byte, error) {
+	var f file
+	f.RepositoryPath = a.RepositoryPath
+	f.ListenPort = a.ListenPort
+	f.PeerBootstrap = append([]string{}, a.Peers...)
+	f.Scheduler.BackupPaths = append([]string{}, a.BackupPaths...)
+	if a.Interval > 0 && len(a.BackupPaths) > 0 {
+		f.Scheduler.EnableAutoBackup = true
+		f.Scheduler.BackupInterval = FormatInterval(a.Interval)
+	}
+	if len(a.TrustedPeers) > 0 {
+		f.Recovery = &recoveryFile{a.TrustedPeers, a.Threshold}
+	}
+	for _, m := range a.Mirrors {
+		f.Mirrors = append(f.Mirrors, mirrorFile{m.Peer, m.RepositoryID})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&f); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Write saves the config file for a to path, once it loads and validates,
+// and returns the loaded config. An existing file is replaced.
+func Write(path string, a *Answers) (*config.Config, error) {
+	data, err := a.YAML()
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".setup-*.yaml")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	cfg, err := config.Load(tmp.Name())
+	if err != nil {
+		return nil, fmt.Errorf("the answers do not make a valid config: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// FormatInterval prints d the way it is best typed, e.g. 24h rather than
+// 24h0m0s.
+func FormatInterval(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return d.String()
+}
+
+// ParseInterval reads a backup interval: hourly, daily or weekly, or a
+// duration such as 6h. never is 0.
+func ParseInterval(s string) (time.Duration, error) {
+	switch s {
+	case "never", "none", "off":
+		return 0, nil
+	case "hourly":
+		return time.Hour, nil
+	case "daily":
+		return 24 * time.Hour, nil
+	case "weekly":
+		return 7 * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not hourly, daily, weekly, never or a duration such as 6h", s)
+	}
+	if d < 5*time.Minute {
+		return 0, fmt.Errorf("backups more often than every 5m are not supported, got %s", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,103 @@
+package setup_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/setup"
+)
+
+func TestRate(t *testing.T) {
+	cases := []struct {
+		pass string
+		want string
+	}{
+		{"", setup.Weak},
+		{"password", setup.Weak},
+		{"Summer2024!", setup.Weak},
+		{"aaaaaaaaaaaaaaaaaaaaaaaa", setup.Weak},
+		{"abcdefghijklmnop", setup.Weak},
+		{"correct horse battery staple", setup.Fair},
+		{"correct horse battery staple arrow", setup.Good},
+		{"correct horse battery staple arrow velvet", setup.Strong},
+		{"T7#kq9!Vz2@pLm4x", setup.Strong},
+	}
+	for _, tc := range cases {
+		s := setup.Rate(tc.pass)
+		if s.Level != tc.want {
+			t.Errorf("Rate(%q) = %s (%.0f bits), want %s", tc.pass, s.Level, s.Bits, tc.want)
+		}
+		if s.Level != setup.Strong && len(s.Hints) == 0 {
+			t.Errorf("Rate(%q) gave no hints", tc.pass)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	a := &setup.Answers{
+		RepositoryPath: filepath.Join(dir, "data"),
+		ListenPort:     9100,
+		BackupPaths:    []string{"/home/me/photos"},
+		Interval:       24 * time.Hour,
+		Peers:          []string{"/ip4/192.168.1.20/tcp/9000/p2p/12D3KooWExample"},
+		Mirrors:        []setup.Mirror{{Peer: "/ip4/192.168.1.20/tcp/9000/p2p/12D3KooWExample", RepositoryID: "repo-2"}},
+		TrustedPeers:   []string{"a2V5MQ==", "a2V5Mg==", "a2V5Mw=="},
+		Threshold:      2,
+	}
+	cfg, err := setup.Write(path, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ListenPort != 9100 || cfg.RepositoryPath != a.RepositoryPath {
+		t.Errorf("got port %d and repository %s", cfg.ListenPort, cfg.RepositoryPath)
+	}
+	if !cfg.Scheduler.EnableAutoBackup || cfg.Scheduler.BackupInterval != 24*time.Hour || len(cfg.Scheduler.BackupPaths) != 1 {
+		t.Errorf("scheduler = %+v", cfg.Scheduler)
+	}
+	if len(cfg.Mirrors) != 1 || cfg.Mirrors[0].SyncInterval != time.Hour {
+		t.Errorf("mirrors = %+v, want one with defaults", cfg.Mirrors)
+	}
+	if cfg.Recovery.Threshold != 2 || len(cfg.Recovery.TrustedPeers) != 3 {
+		t.Errorf("recovery = %+v", cfg.Recovery)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// An invalid config is not written
+	bad := filepath.Join(dir, "bad.yaml")
+	a.TrustedPeers = a.TrustedPeers[:1]
+	if _, err := setup.Write(bad, a); err == nil {
+		t.Error("wrote a config with a single trustee")
+	}
+	if _, err := os.Stat(bad); !os.IsNotExist(err) {
+		t.Errorf("invalid config left at %s", bad)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("left temporary files: %v", entries)
+	}
+}
+
+func TestParseInterval(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"daily": 24 * time.Hour, "hourly": time.Hour, "weekly": 168 * time.Hour, "6h": 6 * time.Hour, "never": 0,
+	} {
+		got, err := setup.ParseInterval(s)
+		if err != nil || got != want {
+			t.Errorf("ParseInterval(%q) = %s, %v; want %s", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"sometimes", "1m"} {
+		if _, err := setup.ParseInterval(s); err == nil {
+			t.Errorf("ParseInterval(%q) succeeded", s)
+		}
+	}
+	if got := setup.FormatInterval(168 * time.Hour); got != "168h" {
+		t.Errorf("FormatInterval = %s", got)
+	}
+}
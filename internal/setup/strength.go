@@ -0,0 +1,156 @@
+// Package setup holds the pieces of the first-run wizard that are not
+// interaction: rating a new passphrase and writing the answers out as a
+// validated config file.
+package setup
+
+import (
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Strength levels, by estimated bits of entropy
+const (
+	Weak   = "weak"   // below 40 bits
+	Fair   = "fair"   // below 56 bits
+	Good   = "good"   // below 72 bits
+	Strong = "strong" // 72 bits and up
+)
+
+// Strength is an estimate of how hard a passphrase is to guess.
+type Strength struct {
+	Bits  float64
+	Level string
+	Hints []string // how to improve it
+}
+
+// Bits per word of a passphrase made of words, as for words drawn from a
+// 7776-word diceware list
+var wordBits = math.Log2(7776)
+
+// common are words and fragments guessers try first; each match is rated
+// as one guess from a small dictionary instead of by its letters
+var common = []string{
+	"password", "passwort", "passphrase", "qwerty", "azerty", "letmein", "welcome", "iloveyou",
+	"admin", "login", "master", "secret", "monkey", "dragon", "football", "baseball",
+	"sunshine", "princess", "summer", "winter", "spring", "autumn", "abc123", "123456",
+	"shadowvault", "shadow", "vault", "backup",
+}
+
+var year = regexp.MustCompile(`(19|20)[0-9]{2}`)
+
+// Rate estimates the strength of pass. The estimate is deliberately
+// simple: the character classes used and the length, with common words,
+// years and repeated or sequential characters discounted, and passphrases
+// of plain words rated per word.
+func Rate(pass string) Strength {
+	var s Strength
+	if pass == "" {
+		s.Level = Weak
+		s.Hints = []string{"Enter a passphrase"}
+		return s
+	}
+
+	var lower, upper, digit, symbol, other bool
+	for _, r := range pass {
+		switch {
+		case r < unicode.MaxASCII && unicode.IsLower(r):
+			lower = true
+		case r < unicode.MaxASCII && unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	pool := 0
+	for _, c := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if c.used {
+			pool += c.size
+		}
+	}
+
+	// Dictionary words and years are single guesses
+	rest := strings.ToLower(pass)
+	var bits float64
+	foundCommon := false
+	for _, w := range common {
+		if n := strings.Count(rest, w); n > 0 {
+			foundCommon = true
+			bits += float64(n) * 10
+			rest = strings.ReplaceAll(rest, w, "\x00")
+		}
+	}
+	if n := len(year.FindAllString(rest, -1)); n > 0 {
+		bits += float64(n) * 7
+		rest = year.ReplaceAllString(rest, "\x00")
+	}
+
+	// Repeated and sequential characters add little
+	length, patterned := 0.0, false
+	prev := rune(-1)
+	for _, r := range rest {
+		switch {
+		case r == 0:
+			prev = -1
+			continue
+		case prev >= 0 && (r == prev || r == prev+1 || r == prev-1):
+			length += 0.25
+			patterned = true
+		default:
+			length++
+		}
+		prev = r
+	}
+	bits += length * math.Log2(float64(pool))
+
+	// A passphrase of plain words is as strong as its word count
+	fields := strings.Fields(pass)
+	words := len(fields) >= 3
+	for _, f := range fields {
+		for _, r := range f {
+			words = words && unicode.IsLetter(r)
+		}
+	}
+	if words {
+		bits = math.Min(bits, float64(len(fields))*wordBits)
+	}
+
+	s.Bits = bits
+	switch {
+	case bits < 40:
+		s.Level = Weak
+	case bits < 56:
+		s.Level = Fair
+	case bits < 72:
+		s.Level = Good
+	default:
+		s.Level = Strong
+	}
+	if s.Level == Strong {
+		return s
+	}
+	switch {
+	case words:
+		s.Hints = append(s.Hints, "Add more words, six random ones are strong")
+	case len([]rune(pass)) < 12:
+		s.Hints = append(s.Hints, "Use at least 12 characters, or six or more random words")
+	}
+	if !words && pool <= 36 {
+		s.Hints = append(s.Hints, "Mix in upper case letters, digits and symbols")
+	}
+	if foundCommon {
+		s.Hints = append(s.Hints, "Avoid common passwords and words like the program's name")
+	}
+	if patterned {
+		s.Hints = append(s.Hints, "Avoid repeated and sequential characters")
+	}
+	return s
+}
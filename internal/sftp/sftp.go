@@ -0,0 +1,438 @@
+// Package sftp is a client of version 3 of the SSH File Transfer Protocol,
+// the version OpenSSH serves, covering what a chunk store needs: reading,
+// writing at an offset, stat, rename, remove and mkdir.
+package sftp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Packet types
+const (
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpWrite    = 6
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpStat     = 17
+	fxpRename   = 18
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpAttrs    = 105
+	fxpExtended = 200
+)
+
+// Status codes
+const (
+	statusOK         = 0
+	statusEOF        = 1
+	statusNoSuchFile = 2
+	statusPermission = 3
+)
+
+const (
+	attrSize = 0x1
+
+	// maxPacket bounds the packets accepted from the server
+	maxPacket = 256 * 1024
+	// maxData is how much one read or write request carries; every server
+	// must accept 32KiB
+	maxData = 32 * 1024
+
+	// posixRename is the OpenSSH extension renaming over an existing file
+	posixRename = "posix-rename@openssh.com"
+)
+
+// Flags of Open
+const (
+	Read   = 0x01
+	Write  = 0x02
+	Create = 0x08
+	Trunc  = 0x10
+)
+
+// StatusError is a request the server answered with a failure status.
+// Errors of any other type mean the connection is no longer usable.
+type StatusError struct {
+	Code uint32
+	Msg  string
+}
+
+func (e *StatusError) Error() string {
+	if e.Msg == "" {
+		return fmt.Sprintf("sftp: status %d", e.Code)
+	}
+	return "sftp: " + e.Msg
+}
+
+// Is matches fs.ErrNotExist and fs.ErrPermission to the statuses meaning
+// them.
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.Code == statusNoSuchFile
+	case fs.ErrPermission:
+		return e.Code == statusPermission
+	}
+	return false
+}
+
+// Client is one SFTP session. Requests are sent one at a time; use several
+// clients for parallel transfers.
+type Client struct {
+	conn    *ssh.Client
+	session *ssh.Session
+	w       io.WriteCloser
+	r       *bufio.Reader
+
+	mu     sync.Mutex
+	nextID uint32
+	exts   map[string]string
+}
+
+// Dial connects to the SSH server at addr and starts an SFTP session.
+func Dial(addr string, config *ssh.ClientConfig) (*Client, error) {
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient starts an SFTP session on conn, which Close closes.
+func NewClient(conn *ssh.Client) (*Client, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, err
+	}
+	c := &Client{conn: conn, session: session, w: w, r: bufio.NewReader(r), exts: make(map[string]string)}
+
+	var init packet
+	init.byte(fxpInit)
+	init.uint32(3)
+	if err := c.send(init); err != nil {
+		c.Close()
+		return nil, err
+	}
+	typ, body, err := c.recv()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if typ != fxpVersion {
+		c.Close()
+		return nil, fmt.Errorf("sftp: unexpected packet %d during handshake", typ)
+	}
+	in := reader(body)
+	if v := in.uint32(); v != 3 {
+		c.Close()
+		return nil, fmt.Errorf("sftp: server speaks version %d, not 3", v)
+	}
+	for len(in) > 0 {
+		name, data := in.string(), in.string()
+		c.exts[name] = data
+	}
+	return c, nil
+}
+
+// Close ends the session and the connection.
+func (c *Client) Close() error {
+	c.session.Close()
+	return c.conn.Close()
+}
+
+// Stat returns the size of the file at p.
+func (c *Client) Stat(p string) (int64, error) {
+	var req packet
+	req.string(p)
+	typ, body, err := c.call(fxpStat, req)
+	if err != nil {
+		return 0, err
+	}
+	if typ != fxpAttrs {
+		return 0, unexpected(typ)
+	}
+	in := reader(body)
+	if in.uint32()&attrSize == 0 {
+		return 0, errors.New("sftp: server did not report the size")
+	}
+	return int64(in.uint64()), nil
+}
+
+// ReadFile returns the content of the file at p.
+func (c *Client) ReadFile(p string) ([]byte, error) {
+	f, err := c.Open(p, Read)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	for {
+		var req packet
+		req.string(f.handle)
+		req.uint64(uint64(len(data)))
+		req.uint32(maxData)
+		typ, body, err := c.call(fxpRead, req)
+		if err != nil {
+			f.Close()
+			var se *StatusError
+			if errors.As(err, &se) && se.Code == statusEOF {
+				return data, nil
+			}
+			return nil, err
+		}
+		if typ != fxpData {
+			f.Close()
+			return nil, unexpected(typ)
+		}
+		in := reader(body)
+		data = append(data, in.string()...)
+	}
+}
+
+// Remove removes the file at p.
+func (c *Client) Remove(p string) error {
+	var req packet
+	req.string(p)
+	return c.status(fxpRemove, req)
+}
+
+// Rename renames oldpath to newpath, replacing any file there when the
+// server supports it, as OpenSSH does; otherwise a file at newpath is
+// removed first.
+func (c *Client) Rename(oldpath, newpath string) error {
+	var req packet
+	if _, ok := c.exts[posixRename]; ok {
+		req.string(posixRename)
+		req.string(oldpath)
+		req.string(newpath)
+		return c.status(fxpExtended, req)
+	}
+	if err := c.Remove(newpath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	req.string(oldpath)
+	req.string(newpath)
+	return c.status(fxpRename, req)
+}
+
+// MkdirAll creates the directory p and any parents missing.
+func (c *Client) MkdirAll(p string) error {
+	p = path.Clean(p)
+	if _, err := c.Stat(p); err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if parent := path.Dir(p); parent != p {
+		if err := c.MkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	var req packet
+	req.string(p)
+	req.uint32(0) // no attributes
+	err := c.status(fxpMkdir, req)
+	if err != nil {
+		// Created meanwhile by another client
+		if _, serr := c.Stat(p); serr == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// File is an open remote file.
+type File struct {
+	c      *Client
+	handle string
+}
+
+// Open opens the file at p with flags, a combination of Read, Write, Create
+// and Trunc. Files are created with mode 0600.
+func (c *Client) Open(p string, flags uint32) (*File, error) {
+	var req packet
+	req.string(p)
+	req.uint32(flags)
+	req.uint32(0x4) // permissions
+	req.uint32(0o600)
+	typ, body, err := c.call(fxpOpen, req)
+	if err != nil {
+		return nil, err
+	}
+	if typ != fxpHandle {
+		return nil, unexpected(typ)
+	}
+	in := reader(body)
+	return &File{c: c, handle: in.string()}, nil
+}
+
+// WriteAt writes data at offset off, in requests of at most 32KiB.
+func (f *File) WriteAt(data []byte, off int64) error {
+	for len(data) > 0 {
+		n := min(len(data), maxData)
+		var req packet
+		req.string(f.handle)
+		req.uint64(uint64(off))
+		req.string(string(data[:n]))
+		if err := f.c.status(fxpWrite, req); err != nil {
+			return err
+		}
+		data, off = data[n:], off+int64(n)
+	}
+	return nil
+}
+
+// Close closes the file.
+func (f *File) Close() error {
+	var req packet
+	req.string(f.handle)
+	return f.c.status(fxpClose, req)
+}
+
+// status sends a request answered by a status
+func (c *Client) status(typ byte, req packet) error {
+	rtyp, _, err := c.call(typ, req)
+	if err != nil {
+		return err
+	}
+	if rtyp != fxpStatus {
+		return unexpected(rtyp)
+	}
+	return nil
+}
+
+// call sends a request of type typ with body req after its ID and returns
+// the response, turning a failure status into a *StatusError
+func (c *Client) call(typ byte, req packet) (byte, []byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	id := c.nextID
+	var p packet
+	p.byte(typ)
+	p.uint32(id)
+	p = append(p, req...)
+	if err := c.send(p); err != nil {
+		return 0, nil, err
+	}
+	rtyp, body, err := c.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	in := reader(body)
+	if got := in.uint32(); got != id {
+		return 0, nil, fmt.Errorf("sftp: response %d to request %d", got, id)
+	}
+	if rtyp == fxpStatus {
+		code := in.uint32()
+		msg := in.string()
+		if code != statusOK {
+			return 0, nil, &StatusError{Code: code, Msg: msg}
+		}
+	}
+	return rtyp, in, nil
+}
+
+func (c *Client) send(p packet) error {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(p)))
+	if _, err := c.w.Write(append(n[:], p...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *Client) recv() (byte, []byte, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(c.r, n[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(n[:])
+	if size == 0 || size > maxPacket {
+		return 0, nil, fmt.Errorf("sftp: packet of %d bytes", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return body[0], body[1:], nil
+}
+
+func unexpected(typ byte) error {
+	return fmt.Errorf("sftp: unexpected response packet %d", typ)
+}
+
+// packet builds a request in the protocol's encoding
+type packet []byte
+
+func (p *packet) byte(b byte)     { *p = append(*p, b) }
+func (p *packet) uint32(v uint32) { *p = binary.BigEndian.AppendUint32(*p, v) }
+func (p *packet) uint64(v uint64) { *p = binary.BigEndian.AppendUint64(*p, v) }
+func (p *packet) string(s string) {
+	p.uint32(uint32(len(s)))
+	*p = append(*p, s...)
+}
+
+// reader decodes a response; reading past its end yields zero values
+type reader []byte
+
+func (r *reader) uint32() uint32 {
+	if len(*r) < 4 {
+		*r = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint32(*r)
+	*r = (*r)[4:]
+	return v
+}
+
+func (r *reader) uint64() uint64 {
+	if len(*r) < 8 {
+		*r = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint64(*r)
+	*r = (*r)[8:]
+	return v
+}
+
+func (r *reader) string() string {
+	n := r.uint32()
+	if uint32(len(*r)) < n {
+		*r = nil
+		return ""
+	}
+	s := string((*r)[:n])
+	*r = (*r)[n:]
+	return s
+}
@@ -0,0 +1,315 @@
+package snapshots
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/hoangsonww/backupagent/internal/fspath"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// Archive formats
+const (
+	ArchiveTar    = "tar"
+	ArchiveTarGz  = "tar.gz"
+	ArchiveTarZst = "tar.zst"
+	ArchiveZip    = "zip"
+)
+
+// ArchiveFormats lists the formats NewArchiveWriter writes.
+var ArchiveFormats = []string{ArchiveTar, ArchiveTarGz, ArchiveTarZst, ArchiveZip}
+
+// ArchiveFormatOf returns the format a file name's extension asks for, or
+// "" for none.
+func ArchiveFormatOf(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		return ArchiveTarZst
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return ArchiveTarGz
+	case strings.HasSuffix(name, ".tar"):
+		return ArchiveTar
+	case strings.HasSuffix(name, ".zip"):
+		return ArchiveZip
+	}
+	return ""
+}
+
+// ArchiveWriter writes the files of a snapshot as a tar or zip archive, under
+// a top directory named after the source. Each Write must be one whole chunk
+// of Chunks, in order, as storage.Store.ReadChunks delivers them.
+type ArchiveWriter struct {
+	arc     archive
+	files   []versioning.FileEntry
+	names   []string
+	chunks  []string
+	next    int   // entry to write after the current file
+	left    int   // chunks of the current file still to come
+	size    int64 // bytes of the current file still to come
+	written int64
+}
+
+// archive is a tar or zip writer
+type archive interface {
+	header(e *versioning.FileEntry, name string) error
+	io.Writer
+	Close() error
+}
+
+// NewArchiveWriter prepares to write snap, which must have a file manifest,
+// to w in format. With paths, slash-separated and relative to the source,
+// only the files and directories at or below them are written, along with
+// the directories leading to them.
+func NewArchiveWriter(w io.Writer, format string, snap *versioning.Snapshot, paths []string) (*ArchiveWriter, error) {
+	files, err := snap.Files()
+	if err != nil {
+		return nil, err
+	}
+	if files == nil {
+		return nil, fmt.Errorf("%w: snapshot %s has none", versioning.ErrBadFileManifest, snap.ID)
+	}
+	if files, err = selectFiles(snap, files, paths); err != nil {
+		return nil, err
+	}
+
+	top := path.Base(strings.TrimRight(strings.ReplaceAll(snap.OriginalSource(), `\`, "/"), "/"))
+	if top == "." || top == "/" || top == "" {
+		top = snap.ID
+	}
+	aw := &ArchiveWriter{files: files, names: make([]string, len(files))}
+	for i, e := range files {
+		aw.names[i] = top
+		if e.Path != versioning.SourcePath {
+			rel := e.Path
+			if e.Original != "" {
+				if orig, err := fspath.DecodeOriginal(e.Original); err == nil {
+					rel = orig
+				}
+			}
+			aw.names[i] = top + "/" + rel
+		}
+		if !e.IsDir() {
+			aw.chunks = append(aw.chunks, snap.Span(&files[i])...)
+		}
+	}
+
+	switch format {
+	case ArchiveTar:
+		aw.arc = &tarArchive{tw: tar.NewWriter(w), mtime: snap.Timestamp}
+	case ArchiveTarGz:
+		gz := gzip.NewWriter(w)
+		aw.arc = &tarArchive{tw: tar.NewWriter(gz), mtime: snap.Timestamp, comp: gz}
+	case ArchiveTarZst:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		aw.arc = &tarArchive{tw: tar.NewWriter(zw), mtime: snap.Timestamp, comp: zw}
+	case ArchiveZip:
+		aw.arc = &zipArchive{zw: zip.NewWriter(w), mtime: snap.Timestamp}
+	default:
+		return nil, fmt.Errorf("unknown archive format %q, want one of %s", format, strings.Join(ArchiveFormats, ", "))
+	}
+	return aw, aw.advance()
+}
+
+// selectFiles keeps the entries of files at or below paths and the
+// directories above them
+func selectFiles(snap *versioning.Snapshot, files []versioning.FileEntry, paths []string) ([]versioning.FileEntry, error) {
+	if len(paths) == 0 {
+		return files, nil
+	}
+	keys := make([]string, len(paths))
+	for i, p := range paths {
+		e, err := snap.File(p)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = e.Path
+	}
+	var selected []versioning.FileEntry
+	for _, e := range files {
+		for _, k := range keys {
+			if k == versioning.SourcePath || e.Path == k || strings.HasPrefix(e.Path, k+"/") || strings.HasPrefix(k, e.Path+"/") {
+				selected = append(selected, e)
+				break
+			}
+		}
+	}
+	return selected, nil
+}
+
+// Chunks returns the chunks to Write, in order.
+func (aw *ArchiveWriter) Chunks() []string {
+	return aw.chunks
+}
+
+// Files returns how many files and directories are written.
+func (aw *ArchiveWriter) Files() int {
+	return len(aw.files)
+}
+
+// Write adds one chunk to the file it belongs to.
+func (aw *ArchiveWriter) Write(data []byte) (int, error) {
+	if aw.left == 0 {
+		return 0, fmt.Errorf("%w: more chunks than files cover", versioning.ErrBadFileManifest)
+	}
+	if int64(len(data)) > aw.size {
+		return 0, fmt.Errorf("%w: %s holds more than its %d bytes", versioning.ErrBadFileManifest, aw.names[aw.next-1], aw.files[aw.next-1].Size)
+	}
+	if _, err := aw.arc.Write(data); err != nil {
+		return 0, err
+	}
+	aw.left--
+	aw.size -= int64(len(data))
+	aw.written += int64(len(data))
+	return len(data), aw.advance()
+}
+
+// Close writes the remaining entries and ends the archive.
+func (aw *ArchiveWriter) Close() error {
+	if err := aw.advance(); err != nil {
+		return err
+	}
+	if aw.left > 0 || aw.next < len(aw.files) {
+		return fmt.Errorf("archive ended after %d bytes, before every file was written", aw.written)
+	}
+	return aw.arc.Close()
+}
+
+// advance writes the headers of the entries up to the next file with
+// content, once the current one is complete
+func (aw *ArchiveWriter) advance() error {
+	if aw.left > 0 {
+		return nil
+	}
+	if aw.next > 0 && aw.size != 0 {
+		return fmt.Errorf("%w: %s is %d bytes short", versioning.ErrBadFileManifest, aw.names[aw.next-1], aw.size)
+	}
+	for aw.next < len(aw.files) {
+		i := aw.next
+		aw.next++
+		e := &aw.files[i]
+		if err := aw.arc.header(e, aw.names[i]); err != nil {
+			return err
+		}
+		if e.IsDir() || e.IsSymlink() {
+			continue
+		}
+		aw.size = e.Size
+		if aw.left = e.Count; aw.left > 0 {
+			return nil
+		}
+		if e.Size != 0 {
+			return fmt.Errorf("%w: %s has no chunks for its %d bytes", versioning.ErrBadFileManifest, aw.names[i], e.Size)
+		}
+	}
+	return nil
+}
+
+type tarArchive struct {
+	tw    *tar.Writer
+	comp  io.WriteCloser // the compressor under tw, if any
+	mtime versioning.Timestamp
+}
+
+func (a *tarArchive) header(e *versioning.FileEntry, name string) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    tarMode(e.Mode),
+		ModTime: e.ModTime,
+		Format:  tar.FormatPAX,
+	}
+	if hdr.ModTime.IsZero() {
+		hdr.ModTime = a.mtime.Time()
+	}
+	switch {
+	case e.IsDir():
+		hdr.Typeflag, hdr.Name = tar.TypeDir, name+"/"
+	case e.IsSymlink():
+		hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.Link
+	default:
+		hdr.Typeflag, hdr.Size = tar.TypeReg, e.Size
+	}
+	if o := e.Owner; o != nil {
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = o.UID, o.GID, o.User, o.Group
+	}
+	// Recorded as GNU tar and bsdtar read them back with --xattrs
+	for name, value := range e.Xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string, len(e.Xattrs))
+		}
+		hdr.PAXRecords["SCHILY.xattr."+name] = string(value)
+	}
+	return a.tw.WriteHeader(hdr)
+}
+
+// tarMode returns the permission and special bits of mode as a tar header
+// holds them
+func tarMode(mode fs.FileMode) int64 {
+	m := int64(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 01000
+	}
+	return m
+}
+
+func (a *tarArchive) Write(p []byte) (int, error) {
+	return a.tw.Write(p)
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.comp != nil {
+		return a.comp.Close()
+	}
+	return nil
+}
+
+type zipArchive struct {
+	zw    *zip.Writer
+	w     io.Writer // the current file
+	mtime versioning.Timestamp
+}
+
+func (a *zipArchive) header(e *versioning.FileEntry, name string) error {
+	hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: e.ModTime}
+	if hdr.Modified.IsZero() {
+		hdr.Modified = a.mtime.Time()
+	}
+	if e.IsDir() {
+		hdr.Name, hdr.Method = name+"/", zip.Store
+	}
+	hdr.SetMode(e.Mode)
+	w, err := a.zw.CreateHeader(hdr)
+	a.w = w
+	if err == nil && e.IsSymlink() {
+		// A zip symlink holds its target as content
+		_, err = io.WriteString(w, e.Link)
+	}
+	return err
+}
+
+func (a *zipArchive) Write(p []byte) (int, error) {
+	return a.w.Write(p)
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
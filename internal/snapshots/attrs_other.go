@@ -0,0 +1,22 @@
+//go:build !linux && !darwin
+
+package snapshots
+
+import (
+	"errors"
+	"time"
+)
+
+// Extended attributes are read and set on Linux and macOS only
+func readXattrs(string) map[string][]byte {
+	return nil
+}
+
+func setXattr(string, string, []byte) error {
+	return errors.ErrUnsupported
+}
+
+// setLinkTime leaves symlink times alone where they cannot be set
+func setLinkTime(string, time.Time) error {
+	return nil
+}
@@ -0,0 +1,62 @@
+//go:build linux || darwin
+
+package snapshots
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of the entry at p, not
+// following a symlink; nil when it has none or its filesystem keeps none.
+// Attributes that cannot be read, e.g. for lack of privilege, are left out.
+func readXattrs(p string) map[string][]byte {
+	size, err := unix.Llistxattr(p, nil)
+	if err != nil || size <= 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(p, buf); err != nil {
+		return nil
+	}
+	var xattrs map[string][]byte
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		n, err := unix.Lgetxattr(p, string(name), nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, n)
+		if n, err = unix.Lgetxattr(p, string(name), value); err != nil {
+			continue
+		}
+		if xattrs == nil {
+			xattrs = make(map[string][]byte)
+		}
+		xattrs[string(name)] = value[:n]
+	}
+	return xattrs
+}
+
+// setXattr sets the extended attribute name of the entry at p, not
+// following a symlink
+func setXattr(p, name string, value []byte) error {
+	if err := unix.Lsetxattr(p, name, value, 0); err != nil {
+		return fmt.Errorf("set extended attribute %s of %s: %w", name, p, err)
+	}
+	return nil
+}
+
+// setLinkTime sets the modification time of the symlink at p itself
+func setLinkTime(p string, mtime time.Time) error {
+	tv := []unix.Timeval{unix.NsecToTimeval(time.Now().UnixNano()), unix.NsecToTimeval(mtime.UnixNano())}
+	if err := unix.Lutimes(p, tv); err != nil {
+		return fmt.Errorf("set time of symlink %s: %w", p, err)
+	}
+	return nil
+}
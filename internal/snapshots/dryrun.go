@@ -0,0 +1,270 @@
+package snapshots
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/hoangsonww/backupagent/internal/chunker"
+	"github.com/hoangsonww/backupagent/internal/contentpolicy"
+	"github.com/hoangsonww/backupagent/internal/crypto"
+	"github.com/hoangsonww/backupagent/internal/exclude"
+	"github.com/hoangsonww/backupagent/internal/fspath"
+	"github.com/hoangsonww/backupagent/internal/storage"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// DryRunReport is what a snapshot of a source would read and store.
+type DryRunReport struct {
+	Source    string `json:"source"`
+	Files     int    `json:"files"`
+	Dirs      int    `json:"dirs"`
+	Bytes     int64  `json:"bytes"`      // total size of the files
+	Excluded  int    `json:"excluded"`   // paths left out by exclude patterns or the content policy
+	Read      int    `json:"read"`       // new or changed files, which would be chunked
+	ReadBytes int64  `json:"read_bytes"` // their size
+	Chunks    int    `json:"chunks"`     // distinct chunks of the snapshot
+	NewChunks int    `json:"new_chunks"` // chunks not stored yet
+	NewBytes  int64  `json:"new_bytes"`  // their size before encryption
+
+	Skipped []versioning.FileError  `json:"skipped,omitempty"` // unreadable paths that would be left out
+	Flagged []contentpolicy.Finding `json:"flagged,omitempty"` // files the content policy flags, left out if enforced
+}
+
+// dryRun is the state of one DryRun
+type dryRun struct {
+	ix       *Index
+	root     string
+	store    *storage.Store
+	chunking chunker.Params
+	excludes *exclude.Set
+	policy   *contentpolicy.Policy
+	skip     *skipper
+	indexed  bool            // the index holds root chunked with chunking
+	seen     map[string]bool // chunks counted so far
+	links    map[inode]bool  // hard-linked files counted so far
+	files    *fileList
+	report   *DryRunReport
+}
+
+// DryRun walks root as Scan would, applying excludes, and reports how many
+// chunks and bytes a snapshot would add to store without writing anything.
+// Files the index holds as unchanged are not read; the others are chunked
+// and their chunks hashed and looked up in the dedup index. Every file is
+// checked against policy, so the report lists all it flags.
+func (ix *Index) DryRun(ctx context.Context, root string, store *storage.Store, chunking chunker.Params, excludes *exclude.Set, policy *contentpolicy.Policy, onError string) (*DryRunReport, error) {
+	root, err := fspath.Resolve(root)
+	if err != nil {
+		return nil, err
+	}
+	d := &dryRun{
+		ix:       ix,
+		root:     root,
+		store:    store,
+		chunking: chunking,
+		excludes: excludes,
+		policy:   policy,
+		skip:     &skipper{policy: onError},
+		indexed:  ix.loadMeta(indexChunkerKey+root) == chunking.String(),
+		seen:     make(map[string]bool),
+		links:    make(map[inode]bool),
+		files:    &fileList{root: root},
+		report:   &DryRunReport{Source: root},
+	}
+
+	info, err := os.Lstat(root)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case info.IsDir():
+		err = d.walk(ctx, root)
+	case info.Mode().IsRegular():
+		err = d.file(ctx, root, info, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.report.Skipped = d.skip.skipped
+	return d.report, nil
+}
+
+func (d *dryRun) walk(ctx context.Context, dir string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var des []os.DirEntry
+	ok, err := d.skip.read(ctx, dir, func() (err error) {
+		if des, err = os.ReadDir(dir); err != nil {
+			return &readError{err}
+		}
+		return nil
+	})
+	if err != nil || !ok {
+		return err
+	}
+	var prev map[string]*indexEntry
+	if d.indexed {
+		old, _, err := d.ix.loadDir(d.root, dir)
+		if err != nil {
+			return err
+		}
+		prev = make(map[string]*indexEntry, len(old))
+		for i := range old {
+			prev[old[i].Name] = &old[i]
+		}
+	}
+
+	for _, de := range des {
+		p := filepath.Join(dir, de.Name())
+		if d.excludes.ExcludedAt(p, d.files.path(p), de.IsDir()) {
+			d.report.Excluded++
+			continue
+		}
+		switch {
+		case de.IsDir():
+			d.report.Dirs++
+			if err := d.walk(ctx, p); err != nil {
+				return err
+			}
+		case de.Type().IsRegular():
+			var info os.FileInfo
+			ok, err := d.skip.read(ctx, p, func() (err error) {
+				if info, err = de.Info(); err != nil {
+					return &readError{err}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if ok {
+				if err := d.file(ctx, p, info, prev[de.Name()]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// file counts the chunks of p, taking them from its index entry prev when
+// the file is unchanged and they are all still stored. A hard link to a
+// file counted before adds nothing.
+func (d *dryRun) file(ctx context.Context, p string, info os.FileInfo, prev *indexEntry) error {
+	if d.policy != nil {
+		var f *contentpolicy.Finding
+		ok, err := d.skip.read(ctx, p, func() (err error) {
+			rel := d.files.path(p)
+			if p == d.root {
+				rel = filepath.Base(p)
+			}
+			if f, err = d.policy.Check(p, rel); err != nil {
+				return &readError{err}
+			}
+			return nil
+		})
+		if err != nil || !ok {
+			return err
+		}
+		if f != nil {
+			d.report.Flagged = append(d.report.Flagged, *f)
+			if f.Excluded {
+				d.report.Excluded++
+				return nil
+			}
+		}
+	}
+	if id := fileInode(info); id != nil {
+		if d.links[*id] {
+			d.report.Files++
+			d.report.Bytes += info.Size()
+			return nil
+		}
+		d.links[*id] = true
+	}
+	if prev != nil && prev.isFile() && prev.Size == info.Size() && prev.ModTime.Equal(info.ModTime()) {
+		missing, err := d.store.Missing(prev.Chunks)
+		if err != nil {
+			return err
+		}
+		if len(missing) == 0 {
+			d.report.Files++
+			d.report.Bytes += info.Size()
+			for _, h := range prev.Chunks {
+				d.add(h)
+			}
+			return nil
+		}
+	}
+
+	var hashes []string
+	var sizes []int
+	ok, err := d.skip.read(ctx, p, func() error {
+		hashes, sizes = nil, nil
+		f, err := os.Open(p)
+		if err != nil {
+			return &readError{err}
+		}
+		defer f.Close()
+		var r io.Reader = f
+		if isSparse(info) {
+			r = newHoleReader(f, info.Size())
+		}
+		ch, err := chunker.NewAlgorithm(r, d.chunking)
+		if err != nil {
+			return err
+		}
+		for {
+			chunk, err := ch.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return &readError{err}
+			}
+			hashes = append(hashes, hex.EncodeToString(crypto.Hash(chunk)))
+			sizes = append(sizes, len(chunk))
+			if len(chunk) == 0 {
+				return nil
+			}
+		}
+	})
+	if err != nil || !ok {
+		return err
+	}
+	d.report.Files++
+	d.report.Bytes += info.Size()
+	d.report.Read++
+	d.report.ReadBytes += info.Size()
+
+	size := make(map[string]int)
+	var fresh []string
+	for i, h := range hashes {
+		if d.add(h) {
+			fresh = append(fresh, h)
+			size[h] = sizes[i]
+		}
+	}
+	missing, err := d.store.Missing(fresh)
+	if err != nil {
+		return err
+	}
+	for _, h := range missing {
+		d.report.NewChunks++
+		d.report.NewBytes += int64(size[h])
+	}
+	return nil
+}
+
+// add counts chunk h, reporting whether it is the first time
+func (d *dryRun) add(h string) bool {
+	if d.seen[h] {
+		return false
+	}
+	d.seen[h] = true
+	d.report.Chunks++
+	return true
+}
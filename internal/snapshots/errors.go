@@ -0,0 +1,95 @@
+package snapshots
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// What a snapshot does about a file or directory it cannot read
+const (
+	OnErrorFail  = "fail"            // abort the snapshot
+	OnErrorSkip  = "skip-and-report" // leave it out and list it in the snapshot
+	OnErrorRetry = "retry"           // try a few more times, then skip and report
+)
+
+const (
+	// readRetries is how often OnErrorRetry tries again
+	readRetries = 3
+	// readRetryDelay is the wait before the first retry; it doubles each time
+	readRetryDelay = time.Second
+)
+
+// ErrFilesSkipped is wrapped by SkippedError
+var ErrFilesSkipped = errors.New("unreadable files skipped")
+
+// SkippedError reports a snapshot that was saved without the files it
+// could not read.
+type SkippedError struct {
+	SnapshotID string
+	Skipped    []versioning.FileError
+}
+
+func (e *SkippedError) Error() string {
+	return fmt.Sprintf("snapshot %s saved without %d unreadable file(s)", e.SnapshotID, len(e.Skipped))
+}
+
+func (e *SkippedError) Unwrap() error { return ErrFilesSkipped }
+
+// readError is a failure to read the source, as opposed to storing it
+type readError struct{ err error }
+
+func (e *readError) Error() string { return e.err.Error() }
+func (e *readError) Unwrap() error { return e.err }
+
+// skipper applies an error policy to reads and collects what it skipped
+type skipper struct {
+	policy  string
+	skipped []versioning.FileError
+}
+
+// read calls fn, retrying or skipping if it fails with a *readError as the
+// policy says. It reports whether fn succeeded; a skipped path is not an
+// error.
+func (s *skipper) read(ctx context.Context, p string, fn func() error) (bool, error) {
+	delay := readRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		var re *readError
+		if err == nil {
+			return true, nil
+		}
+		if !errors.As(err, &re) || s.fails() {
+			return false, err
+		}
+		if s.policy == OnErrorRetry && attempt < readRetries {
+			select {
+			case <-ctx.Done():
+				return false, ctx.Err()
+			case <-time.After(delay):
+			}
+			delay *= 2
+			continue
+		}
+		return false, s.report(p, re.err)
+	}
+}
+
+// report skips p for err without retrying, unless the policy is to fail.
+func (s *skipper) report(p string, err error) error {
+	if s.fails() {
+		return err
+	}
+	monitoring.GetLogger().WithError(err).WithField("path", p).Warn("Skipping unreadable file")
+	s.skipped = append(s.skipped, versioning.FileError{Path: p, Error: err.Error()})
+	return nil
+}
+
+// fails reports whether unreadable paths abort the snapshot
+func (s *skipper) fails() bool {
+	return s.policy == OnErrorFail || s.policy == ""
+}
@@ -0,0 +1,838 @@
+package snapshots
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/chunker"
+	"github.com/hoangsonww/backupagent/internal/contentpolicy"
+	"github.com/hoangsonww/backupagent/internal/exclude"
+	"github.com/hoangsonww/backupagent/internal/fspath"
+	"github.com/hoangsonww/backupagent/internal/journal"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/progress"
+	"github.com/hoangsonww/backupagent/internal/storage"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// journalCursorKey prefixes the per-source journal cursor in the meta bucket
+	journalCursorKey = "journal_cursor:"
+	// indexChunkerKey prefixes the chunking parameters a source was indexed with
+	indexChunkerKey = "index_chunker:"
+	// indexExcludesKey prefixes the exclude patterns a source was last listed with
+	indexExcludesKey = "index_excludes:"
+	// indexPolicyKey prefixes the content policy a source was last listed with
+	indexPolicyKey = "index_policy:"
+	// indexFormatKey prefixes the indexFormat a source was last listed with;
+	// directories indexed in an older one are listed again
+	indexFormatKey = "index_format:"
+	// indexFormat 2 records symlinks and extended attributes, 3 sparse
+	// files and hard links
+	indexFormat = "3"
+	// indexFlushDirs is how many directory records are written per transaction
+	indexFlushDirs = 1000
+	// scanCheckpointBytes and scanCheckpointInterval bound the reading an
+	// interrupted scan loses: past either, the files chunked so far are
+	// checkpointed
+	scanCheckpointBytes    = 64 << 20
+	scanCheckpointInterval = 30 * time.Second
+)
+
+// ScanStats describes how much of a tree an incremental scan touched.
+type ScanStats struct {
+	Journal string `json:"journal"` // mechanism used, "full" when every directory was listed
+	Changed int    `json:"changed"` // paths reported by the journal
+	Listed  int    `json:"listed"`  // directories read from disk
+	Reused  int    `json:"reused"`  // directories taken from the index unread
+	Read    int    `json:"read"`    // files chunked
+	Bytes   int64  `json:"bytes"`   // bytes read
+	Resumed int    `json:"resumed"` // files taken from the checkpoint of an interrupted scan
+
+	Skipped []versioning.FileError  `json:"skipped,omitempty"` // unreadable paths left out
+	Flagged []contentpolicy.Finding `json:"flagged,omitempty"` // files the content policy flagged, left out if enforced
+}
+
+// Index remembers how every file under a snapshot source was chunked, one
+// record per directory. With a change journal, later scans list only the
+// directories it reports as touched and stat only the files it names;
+// without one, every directory is listed but unchanged files (same size and
+// modification time) are still not read again.
+type Index struct {
+	db      *persistence.DB
+	journal journal.Journal
+}
+
+// NewIndex returns an index over db. j may be nil.
+func NewIndex(db *persistence.DB, j journal.Journal) *Index {
+	return &Index{db: db, journal: j}
+}
+
+// indexEntry is one directory entry as of the last scan
+type indexEntry struct {
+	Name    string                `json:"name"`
+	Dir     bool                  `json:"dir,omitempty"`
+	Mode    fs.FileMode           `json:"mode,omitempty"` // permission, setuid, setgid and sticky bits
+	Owner   *versioning.FileOwner `json:"owner,omitempty"`
+	Size    int64                 `json:"size,omitempty"`
+	ModTime time.Time             `json:"mod_time,omitempty"`
+	Chunks  []string              `json:"chunks,omitempty"`
+	Link    string                `json:"link,omitempty"` // target, for a symlink
+	Xattrs  map[string][]byte     `json:"xattrs,omitempty"`
+	Sparse  bool                  `json:"sparse,omitempty"`
+	Inode   *inode                `json:"inode,omitempty"` // for a file with other hard links
+}
+
+// newIndexEntry returns the entry named name with the manifest attributes
+// attrs, without chunks
+func newIndexEntry(name string, attrs versioning.FileEntry) *indexEntry {
+	return &indexEntry{
+		Name:    name,
+		Dir:     attrs.IsDir(),
+		Mode:    attrs.Mode &^ (fs.ModeDir | fs.ModeSymlink),
+		Owner:   attrs.Owner,
+		Size:    attrs.Size,
+		ModTime: attrs.ModTime,
+		Link:    attrs.Link,
+		Xattrs:  attrs.Xattrs,
+		Sparse:  attrs.Sparse,
+	}
+}
+
+// isFile reports whether the entry is a regular file
+func (e *indexEntry) isFile() bool {
+	return !e.Dir && e.Link == ""
+}
+
+// mode returns the recorded permissions, or the usual defaults for entries
+// indexed before modes were
+func (e *indexEntry) mode() fs.FileMode {
+	switch {
+	case e.Mode != 0:
+		return e.Mode
+	case e.Dir:
+		return 0755
+	default:
+		return 0644
+	}
+}
+
+// attrs returns the manifest attributes of the entry
+func (e *indexEntry) attrs() versioning.FileEntry {
+	mode := e.mode()
+	switch {
+	case e.Dir:
+		mode |= fs.ModeDir
+	case e.Link != "":
+		mode |= fs.ModeSymlink
+	}
+	return versioning.FileEntry{Mode: mode, Owner: e.Owner, Size: e.Size, ModTime: e.ModTime.UTC(), Link: e.Link, Xattrs: e.Xattrs, Sparse: e.Sparse}
+}
+
+// indexScan is the state of one Scan
+type indexScan struct {
+	ctx      context.Context
+	ix       *Index
+	root     string
+	store    *storage.Store
+	chunking chunker.Params
+	excludes *exclude.Set
+	policy   *contentpolicy.Policy
+	skip     *skipper
+	full     bool
+	recheck  bool            // the policy changed, so unchanged files are checked too
+	changed  map[string]bool // paths the journal reported
+	dirty    map[string]bool // directories that must be listed
+	pending  map[string][]indexEntry
+	forget   []string
+	files    *fileList
+	stats    *ScanStats
+	links    map[inode]*indexEntry // hard-linked files met so far, by inode
+
+	resuming bool                 // root has a checkpoint from an interrupted scan
+	done     map[string]*seedFile // files chunked since the last checkpoint
+	doneN    int64
+	lastSave time.Time
+}
+
+// Watch asks the change journal to track roots, and every source indexed
+// before, from now on.
+func (ix *Index) Watch(roots []string) {
+	if ix.journal == nil {
+		return
+	}
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(persistence.BucketMeta)).Cursor()
+		prefix := []byte(journalCursorKey)
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			roots = append(roots, string(k[len(prefix):]))
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	for _, root := range roots {
+		if abs, err := fspath.Resolve(root); err == nil {
+			if err := ix.journal.Watch(abs); err != nil {
+				monitoring.GetLogger().WithError(err).Warnf("Change journal cannot watch %s", abs)
+			}
+		}
+	}
+}
+
+// Scan returns the chunk hashes of every regular file under root in the
+// order filepath.Walk visits them, and the file manifest of its files,
+// directories and symlinks, storing the chunks of new and changed
+// files along the way. If root was indexed with other chunking parameters,
+// every file is chunked again. Paths matching excludes are neither listed
+// nor read; if they changed since root was last scanned, every directory
+// is listed again. New and changed files are checked against policy, and
+// every file when it changed; those it flags are in the stats. onError is
+// the policy for unreadable files and directories; those skipped are
+// listed in the stats. The progress tracker
+// of ctx, if any, counts the files and bytes as they are scanned; a scan
+// stopped by ctx returns its error. Of the hard links to a file, only the
+// first met is read; the others are recorded as links to it.
+//
+// Files chunked during the scan are checkpointed as it goes, so a scan
+// that is interrupted, by a crash or otherwise, resumes where it left off
+// the next time root is scanned instead of reading everything again.
+func (ix *Index) Scan(ctx context.Context, root string, store *storage.Store, chunking chunker.Params, excludes *exclude.Set, policy *contentpolicy.Policy, onError string) ([]string, []versioning.FileEntry, *ScanStats, error) {
+	root, err := fspath.Resolve(root)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := ix.checkChunking(root, chunking); err != nil {
+		return nil, nil, nil, err
+	}
+	return ix.scan(ctx, root, store, chunking, excludes, policy, onError, true)
+}
+
+func (ix *Index) scan(ctx context.Context, root string, store *storage.Store, chunking chunker.Params, excludes *exclude.Set, policy *contentpolicy.Policy, onError string, retry bool) ([]string, []versioning.FileEntry, *ScanStats, error) {
+	stats := &ScanStats{Journal: "full"}
+	skip := &skipper{policy: onError}
+	files := &fileList{root: root}
+
+	info, err := os.Lstat(root)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !info.IsDir() {
+		if !info.Mode().IsRegular() {
+			return nil, nil, stats, nil
+		}
+		var hashes []string
+		withheld := false
+		progress.From(ctx).File(root)
+		ok, err := skip.read(ctx, root, func() error {
+			f, err := checkPolicy(policy, files, root)
+			if err != nil {
+				return err
+			}
+			if f != nil {
+				stats.Flagged = append(stats.Flagged, *f)
+				if withheld = f.Excluded; withheld {
+					return nil
+				}
+			}
+			hashes, err = storeFile(ctx, store, root, chunking, nil, nil)
+			return err
+		})
+		if ok && !withheld {
+			stats.Read, stats.Bytes = 1, info.Size()
+			files.file(root, fileAttrs(root, info), nil, hashes)
+		}
+		stats.Skipped = skip.skipped
+		return files.chunks, files.files, stats, err
+	}
+
+	s := &indexScan{
+		ctx:      ctx,
+		ix:       ix,
+		root:     root,
+		store:    store,
+		chunking: chunking,
+		excludes: excludes,
+		policy:   policy,
+		skip:     skip,
+		full:     true,
+		changed:  make(map[string]bool),
+		dirty:    make(map[string]bool),
+		pending:  make(map[string][]indexEntry),
+		links:    make(map[inode]*indexEntry),
+		files:    files,
+		stats:    stats,
+		resuming: ix.hasCheckpoint(root),
+		done:     make(map[string]*seedFile),
+		lastSave: time.Now(),
+	}
+	next := s.plan()
+	// Directories indexed under other patterns may lack what is now
+	// included, or hold what is now excluded
+	patterns := excludes.String()
+	if ix.loadMeta(indexExcludesKey+root) != patterns || ix.loadMeta(indexFormatKey+root) != indexFormat {
+		s.full = true
+		s.stats.Journal = "full"
+	}
+	if ix.loadMeta(indexPolicyKey+root) != policy.String() {
+		s.full = true
+		s.recheck = true
+		s.stats.Journal = "full"
+	}
+	if err := s.walk(root); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := s.flush(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Chunks reused from the index may have been collected since; if so
+	// distrust the index for this source and read everything again
+	missing, err := store.Missing(files.chunks)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(missing) > 0 && retry {
+		monitoring.GetLogger().WithField("root", root).
+			Warnf("%d indexed chunks no longer stored, rescanning whole tree", len(missing))
+		if err := ix.Forget(root); err != nil {
+			return nil, nil, nil, err
+		}
+		return ix.scan(ctx, root, store, chunking, excludes, policy, onError, false)
+	}
+	if len(missing) > 0 {
+		return nil, nil, nil, fmt.Errorf("%d chunks missing after full scan of %s", len(missing), root)
+	}
+
+	if next != "" {
+		if err := ix.saveCursor(root, next); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	// Every directory is indexed now, making the checkpoint redundant
+	if err := ix.db.Update(func(tx *bolt.Tx) error { return deleteScanFiles(ix.db, tx, root) }); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := ix.saveMeta(indexExcludesKey+root, patterns); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := ix.saveMeta(indexFormatKey+root, indexFormat); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := ix.saveMeta(indexPolicyKey+root, policy.String()); err != nil {
+		return nil, nil, nil, err
+	}
+	stats.Skipped = skip.skipped
+	return files.chunks, files.files, stats, nil
+}
+
+// Forget drops everything indexed under root.
+func (ix *Index) Forget(root string) error {
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(persistence.BucketMeta))
+		if err := meta.Delete([]byte(journalCursorKey + root)); err != nil {
+			return err
+		}
+		if err := meta.Delete([]byte(indexExcludesKey + root)); err != nil {
+			return err
+		}
+		if err := meta.Delete([]byte(indexFormatKey + root)); err != nil {
+			return err
+		}
+		if err := meta.Delete([]byte(indexPolicyKey + root)); err != nil {
+			return err
+		}
+		if err := deleteScanFiles(ix.db, tx, root); err != nil {
+			return err
+		}
+		return deleteIndexTrees(ix.db, tx, root, root)
+	})
+}
+
+// checkChunking forgets root if it was indexed with other chunking
+// parameters, whose chunk lists would not deduplicate against new ones
+func (ix *Index) checkChunking(root string, chunking chunker.Params) error {
+	want := chunking.String()
+	var had string
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		had = string(tx.Bucket([]byte(persistence.BucketMeta)).Get([]byte(indexChunkerKey + root)))
+		return nil
+	})
+	if err != nil || had == want {
+		return err
+	}
+	if had != "" {
+		monitoring.GetLogger().WithFields(map[string]interface{}{
+			"root": root,
+			"from": had,
+			"to":   want,
+		}).Info("Chunking changed, rechunking every file of source")
+	}
+	if err := ix.Forget(root); err != nil {
+		return err
+	}
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistence.BucketMeta)).Put([]byte(indexChunkerKey+root), []byte(want))
+	})
+}
+
+// plan asks the journal what changed and returns the cursor to store once
+// the scan succeeds. It leaves s.full set when every directory must be listed.
+func (s *indexScan) plan() string {
+	j := s.ix.journal
+	if j == nil {
+		return ""
+	}
+	logger := monitoring.GetLogger().WithField("root", s.root)
+	if err := j.Watch(s.root); err != nil {
+		logger.WithError(err).Debug("Change journal cannot watch source, walking whole tree")
+		return ""
+	}
+
+	prefix := j.Name() + ":"
+	if since := s.ix.loadCursor(s.root); strings.HasPrefix(since, prefix) {
+		paths, next, err := j.Changes(s.root, strings.TrimPrefix(since, prefix))
+		if err == nil {
+			s.full = false
+			for _, p := range paths {
+				s.changed[p] = true
+				s.dirty[p] = true
+				s.dirty[filepath.Dir(p)] = true
+			}
+			s.stats.Journal = j.Name()
+			s.stats.Changed = len(paths)
+			return prefix + next
+		}
+		logger.WithError(err).Info("Change journal cannot cover this snapshot, walking whole tree")
+	}
+
+	// Take the position before walking so changes made during the walk are
+	// reported next time
+	cur, err := j.Cursor(s.root)
+	if err != nil {
+		logger.WithError(err).Debug("Change journal has no cursor for source")
+		return ""
+	}
+	return prefix + cur
+}
+
+func (s *indexScan) walk(dir string) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	old, indexed, err := s.ix.loadDir(s.root, dir)
+	if err != nil {
+		return err
+	}
+	entries := old
+	listed := s.full || s.dirty[dir] || !indexed
+	if listed {
+		ok, err := s.skip.read(s.ctx, dir, func() (err error) {
+			entries, err = s.list(dir, old)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if !ok {
+			entries = nil
+			s.forget = append(s.forget, dir)
+		}
+		s.stats.Listed++
+	} else {
+		s.stats.Reused++
+	}
+
+	for i := range entries {
+		e := &entries[i]
+		p := filepath.Join(dir, e.Name)
+		switch {
+		case e.Dir:
+			s.files.dir(p, e.attrs())
+			if err := s.walk(p); err != nil {
+				return err
+			}
+		case e.Link != "":
+			s.files.link(p, e.attrs())
+		default:
+			if !listed {
+				progress.From(s.ctx).Unchanged(e.Size)
+				s.remember(e)
+			}
+			s.files.file(p, e.attrs(), e.Inode, e.Chunks)
+		}
+	}
+	return nil
+}
+
+// list reads dir from disk, reusing the chunks of unchanged files. A
+// directory with skipped files is not recorded, so they are tried again
+// next time.
+func (s *indexScan) list(dir string, old []indexEntry) ([]indexEntry, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, &readError{err}
+	}
+	prev := make(map[string]*indexEntry, len(old))
+	for i := range old {
+		prev[old[i].Name] = &old[i]
+	}
+
+	entries := make([]indexEntry, 0, len(des))
+	subdirs := make(map[string]bool)
+	complete := true
+	for _, de := range des {
+		p := filepath.Join(dir, de.Name())
+		if s.excludes.ExcludedAt(p, s.files.path(p), de.IsDir()) {
+			continue
+		}
+		switch {
+		case de.IsDir():
+			e := &indexEntry{Name: de.Name(), Dir: true}
+			if info, err := de.Info(); err == nil {
+				e = newIndexEntry(de.Name(), fileAttrs(p, info))
+			}
+			entries = append(entries, *e)
+			subdirs[de.Name()] = true
+		case de.Type()&fs.ModeSymlink != 0:
+			var e *indexEntry
+			ok, err := s.skip.read(s.ctx, p, func() error {
+				info, err := de.Info()
+				if err != nil {
+					return &readError{err}
+				}
+				attrs, err := linkAttrs(p, info)
+				if err != nil {
+					return &readError{err}
+				}
+				e = newIndexEntry(de.Name(), attrs)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				complete = false
+				continue
+			}
+			entries = append(entries, *e)
+		case de.Type().IsRegular():
+			var e *indexEntry
+			ok, err := s.skip.read(s.ctx, p, func() (err error) {
+				e, err = s.file(p, de, prev[de.Name()])
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				complete = false
+				continue
+			}
+			if e == nil {
+				// Withheld by the content policy
+				continue
+			}
+			entries = append(entries, *e)
+		}
+	}
+
+	// Subtrees that disappeared must not be reused if the name comes back
+	for _, e := range old {
+		if e.Dir && !subdirs[e.Name] {
+			s.forget = append(s.forget, filepath.Join(dir, e.Name))
+		}
+	}
+	if complete {
+		s.pending[dir] = entries
+	} else {
+		s.forget = append(s.forget, dir)
+	}
+	if len(s.pending) >= indexFlushDirs {
+		if err := s.flush(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// file returns the index entry of p, chunking it only if it changed, or
+// nil if the content policy withholds it
+func (s *indexScan) file(p string, de os.DirEntry, prev *indexEntry) (*indexEntry, error) {
+	e, err := s.indexFile(p, de, prev)
+	if err != nil || e == nil {
+		return nil, err
+	}
+	s.remember(e)
+	return e, nil
+}
+
+// remember keeps e, if hard-linked, so other links to it are not read again
+func (s *indexScan) remember(e *indexEntry) {
+	if e.Inode == nil {
+		return
+	}
+	if _, ok := s.links[*e.Inode]; !ok {
+		s.links[*e.Inode] = e
+	}
+}
+
+func (s *indexScan) indexFile(p string, de os.DirEntry, prev *indexEntry) (*indexEntry, error) {
+	tracker := progress.From(s.ctx)
+	if prev != nil && prev.isFile() && !s.full && !s.changed[p] {
+		// Untouched according to the journal: not even a stat
+		tracker.Unchanged(prev.Size)
+		return prev, nil
+	}
+	info, err := de.Info()
+	if err != nil {
+		return nil, &readError{err}
+	}
+	e := newIndexEntry(de.Name(), fileAttrs(p, info))
+	e.Inode = fileInode(info)
+	if s.recheck {
+		if withheld, err := s.screen(p); err != nil || withheld {
+			return nil, err
+		}
+	}
+	if prev != nil && prev.isFile() && prev.Size == info.Size() && prev.ModTime.Equal(info.ModTime()) {
+		// A chmod, chown or change of extended attributes leaves the
+		// content alone
+		e.Chunks = prev.Chunks
+		tracker.Unchanged(e.Size)
+		return e, nil
+	}
+	if e.Inode != nil {
+		// Another link to a file read in this scan has its content
+		if l := s.links[*e.Inode]; l != nil && l.Size == e.Size && l.ModTime.Equal(e.ModTime) {
+			e.Chunks = l.Chunks
+			tracker.Unchanged(e.Size)
+			return e, nil
+		}
+	}
+	if s.resuming {
+		rec, err := s.ix.loadScanFile(s.root, p)
+		if err != nil {
+			return nil, err
+		}
+		if rec != nil && rec.Size == info.Size() && rec.ModTime.Equal(info.ModTime()) {
+			s.stats.Resumed++
+			e.Chunks = rec.Chunks
+			tracker.Unchanged(e.Size)
+			return e, nil
+		}
+	}
+	if !s.recheck {
+		if withheld, err := s.screen(p); err != nil || withheld {
+			return nil, err
+		}
+	}
+	tracker.File(p)
+	hashes, err := storeFile(s.ctx, s.store, p, s.chunking, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.stats.Read++
+	s.stats.Bytes += info.Size()
+	e.Chunks = hashes
+	s.done[p] = &seedFile{Size: info.Size(), ModTime: info.ModTime(), Chunks: hashes}
+	s.doneN += info.Size()
+	if s.doneN >= scanCheckpointBytes || time.Since(s.lastSave) >= scanCheckpointInterval {
+		if err := s.flush(); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// screen checks p against the content policy, reporting whether it is
+// withheld
+func (s *indexScan) screen(p string) (bool, error) {
+	f, err := checkPolicy(s.policy, s.files, p)
+	if err != nil || f == nil {
+		return false, err
+	}
+	s.stats.Flagged = append(s.stats.Flagged, *f)
+	return f.Excluded, nil
+}
+
+// flush writes pending directory records, checkpoints the files chunked
+// since the last flush and drops vanished subtrees
+func (s *indexScan) flush() error {
+	s.lastSave = time.Now()
+	if len(s.pending) == 0 && len(s.forget) == 0 && len(s.done) == 0 {
+		return nil
+	}
+	err := s.ix.db.Update(func(tx *bolt.Tx) error {
+		if len(s.forget) > 0 {
+			if err := deleteIndexTrees(s.ix.db, tx, s.root, s.forget...); err != nil {
+				return err
+			}
+		}
+		b, err := s.ix.db.Sealed(tx, persistence.BucketFileIndex)
+		if err != nil {
+			return err
+		}
+		for dir, entries := range s.pending {
+			data, err := json.Marshal(entries)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(indexKey(s.root, dir), data); err != nil {
+				return err
+			}
+		}
+		cp, err := s.ix.db.Sealed(tx, persistence.BucketScanFiles)
+		if err != nil {
+			return err
+		}
+		for p, rec := range s.done {
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			if err := cp.Put(indexKey(s.root, p), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update file index: %w", err)
+	}
+	s.pending = make(map[string][]indexEntry)
+	s.forget = nil
+	s.done = make(map[string]*seedFile)
+	s.doneN = 0
+	return nil
+}
+
+// errFound ends a walk over a sealed bucket once it found what it sought
+var errFound = errors.New("found")
+
+// hasCheckpoint reports whether a scan of root was interrupted after
+// checkpointing files
+func (ix *Index) hasCheckpoint(root string) bool {
+	found := false
+	ix.db.View(func(tx *bolt.Tx) error {
+		b, err := ix.db.Sealed(tx, persistence.BucketScanFiles)
+		if err != nil {
+			return err
+		}
+		prefix := indexKey(root, "")
+		return b.ForEach(func(k, _ []byte) error {
+			if bytes.HasPrefix(k, prefix) {
+				found = true
+				return errFound
+			}
+			return nil
+		})
+	})
+	return found
+}
+
+// loadScanFile returns the checkpointed chunks of p, or nil
+func (ix *Index) loadScanFile(root, p string) (*seedFile, error) {
+	var rec *seedFile
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		b, err := ix.db.Sealed(tx, persistence.BucketScanFiles)
+		if err != nil {
+			return err
+		}
+		v, err := b.Get(indexKey(root, p))
+		if err != nil || v == nil {
+			return err
+		}
+		rec = &seedFile{}
+		return json.Unmarshal(v, rec)
+	})
+	return rec, err
+}
+
+func (ix *Index) loadDir(root, dir string) ([]indexEntry, bool, error) {
+	var entries []indexEntry
+	found := false
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		b, err := ix.db.Sealed(tx, persistence.BucketFileIndex)
+		if err != nil {
+			return err
+		}
+		v, err := b.Get(indexKey(root, dir))
+		if err != nil || v == nil {
+			return err
+		}
+		found = true
+		return json.Unmarshal(v, &entries)
+	})
+	return entries, found, err
+}
+
+func (ix *Index) loadCursor(root string) string {
+	return ix.loadMeta(journalCursorKey + root)
+}
+
+func (ix *Index) saveCursor(root, cursor string) error {
+	return ix.saveMeta(journalCursorKey+root, cursor)
+}
+
+func (ix *Index) loadMeta(key string) string {
+	var v string
+	ix.db.View(func(tx *bolt.Tx) error {
+		v = string(tx.Bucket([]byte(persistence.BucketMeta)).Get([]byte(key)))
+		return nil
+	})
+	return v
+}
+
+// saveMeta stores v under key, deleting key for an empty v
+func (ix *Index) saveMeta(key, v string) error {
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(persistence.BucketMeta))
+		if v == "" {
+			return b.Delete([]byte(key))
+		}
+		return b.Put([]byte(key), []byte(v))
+	})
+}
+
+// deleteScanFiles drops the checkpoint of an interrupted scan of root
+func deleteScanFiles(db *persistence.DB, tx *bolt.Tx, root string) error {
+	b, err := db.Sealed(tx, persistence.BucketScanFiles)
+	if err != nil {
+		return err
+	}
+	prefix := indexKey(root, "")
+	return b.DeleteFunc(func(k []byte) bool { return bytes.HasPrefix(k, prefix) })
+}
+
+// deleteIndexTrees removes the records of dirs and everything below them,
+// in one pass over the index
+func deleteIndexTrees(db *persistence.DB, tx *bolt.Tx, root string, dirs ...string) error {
+	b, err := db.Sealed(tx, persistence.BucketFileIndex)
+	if err != nil {
+		return err
+	}
+	return b.DeleteFunc(func(k []byte) bool {
+		for _, dir := range dirs {
+			if bytes.Equal(k, indexKey(root, dir)) || bytes.HasPrefix(k, indexKey(root, dir+string(filepath.Separator))) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func indexKey(root, dir string) []byte {
+	return []byte(root + "\x00" + dir)
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package snapshots
+
+import (
+	"io/fs"
+	"syscall"
+
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+const canChown = true
+
+// fileOwner returns the owner of info as recorded in manifests
+func fileOwner(info fs.FileInfo) *versioning.FileOwner {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	uid, gid := int(st.Uid), int(st.Gid)
+	return &versioning.FileOwner{UID: uid, GID: gid, User: userName(uid), Group: groupName(gid)}
+}
@@ -0,0 +1,14 @@
+package snapshots
+
+import (
+	"io/fs"
+
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// Windows files have no numeric owners to record or restore
+const canChown = false
+
+func fileOwner(fs.FileInfo) *versioning.FileOwner {
+	return nil
+}
@@ -0,0 +1,210 @@
+package snapshots
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// userNames and groupNames cache account names by ID for the walk; an
+// unknown ID maps to ""
+var userNames, groupNames sync.Map
+
+func userName(uid int) string {
+	if v, ok := userNames.Load(uid); ok {
+		return v.(string)
+	}
+	name := ""
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		name = u.Username
+	}
+	userNames.Store(uid, name)
+	return name
+}
+
+func groupName(gid int) string {
+	if v, ok := groupNames.Load(gid); ok {
+		return v.(string)
+	}
+	name := ""
+	if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+		name = g.Name
+	}
+	groupNames.Store(gid, name)
+	return name
+}
+
+// Owners decides who owns restored files. A stored owner is mapped by the
+// rules given, matched on its name and then its ID, or else to the local
+// account of the same name. Owners that map to nothing are left to the
+// restoring user and reported, rather than given their stored IDs, which
+// rarely mean the same account on another machine.
+type Owners struct {
+	currentUser bool
+	users       map[string]int // stored name or ID -> local ID
+	groups      map[string]int
+	local       map[string]int // "u:name" or "g:name" -> local ID, -1 if none
+	report      OwnerReport
+}
+
+// OwnerReport sums up how the owners of restored entries were mapped.
+type OwnerReport struct {
+	Mapped   int            `json:"mapped"`
+	Unmapped map[string]int `json:"unmapped,omitempty"` // stored owner -> entries left to the restoring user
+	Denied   int            `json:"denied,omitempty"`   // entries whose owner could not be set
+}
+
+// NewOwners parses mapping rules of the form old:new, where old is a stored
+// name or ID and new a local name or ID. With currentUser set, everything is
+// left to the restoring user and the rules are ignored.
+func NewOwners(currentUser bool, userRules, groupRules []string) (*Owners, error) {
+	o := &Owners{
+		currentUser: currentUser,
+		users:       make(map[string]int),
+		groups:      make(map[string]int),
+		local:       make(map[string]int),
+	}
+	for _, r := range userRules {
+		from, to, err := o.parseRule(r, false)
+		if err != nil {
+			return nil, err
+		}
+		o.users[from] = to
+	}
+	for _, r := range groupRules {
+		from, to, err := o.parseRule(r, true)
+		if err != nil {
+			return nil, err
+		}
+		o.groups[from] = to
+	}
+	return o, nil
+}
+
+func (o *Owners) parseRule(rule string, group bool) (string, int, error) {
+	from, to, ok := strings.Cut(rule, ":")
+	if !ok || from == "" || to == "" {
+		return "", 0, fmt.Errorf("invalid owner mapping %q, expected old:new", rule)
+	}
+	if id, err := strconv.Atoi(to); err == nil && id >= 0 {
+		return from, id, nil
+	}
+	id := o.lookup(to, group)
+	if id < 0 {
+		kind := "user"
+		if group {
+			kind = "group"
+		}
+		return "", 0, fmt.Errorf("owner mapping %q: no local %s %q", rule, kind, to)
+	}
+	return from, id, nil
+}
+
+// lookup returns the local ID of an account name, or -1
+func (o *Owners) lookup(name string, group bool) int {
+	key := "u:" + name
+	if group {
+		key = "g:" + name
+	}
+	if id, ok := o.local[key]; ok {
+		return id
+	}
+	id := -1
+	if group {
+		if g, err := user.LookupGroup(name); err == nil {
+			id, _ = strconv.Atoi(g.Gid)
+		}
+	} else if u, err := user.Lookup(name); err == nil {
+		id, _ = strconv.Atoi(u.Uid)
+	}
+	o.local[key] = id
+	return id
+}
+
+// mapID returns the local ID for a stored ID and name, or -1
+func (o *Owners) mapID(id int, name string, group bool) int {
+	rules := o.users
+	if group {
+		rules = o.groups
+	}
+	if to, ok := rules[name]; ok && name != "" {
+		return to
+	}
+	if to, ok := rules[strconv.Itoa(id)]; ok {
+		return to
+	}
+	if name == "" {
+		return -1
+	}
+	return o.lookup(name, group)
+}
+
+// apply gives the entry at p its mapped owner, and reports whether both its
+// user and group were set
+func (o *Owners) apply(p string, owner *versioning.FileOwner) bool {
+	if o == nil || o.currentUser || owner == nil || !canChown {
+		return false
+	}
+	uid := o.mapID(owner.UID, owner.User, false)
+	gid := o.mapID(owner.GID, owner.Group, true)
+	if uid < 0 {
+		o.unmapped(fmt.Sprintf("user %s", describeOwner(owner.UID, owner.User)))
+	}
+	if gid < 0 {
+		o.unmapped(fmt.Sprintf("group %s", describeOwner(owner.GID, owner.Group)))
+	}
+	if uid < 0 && gid < 0 {
+		return false
+	}
+	if err := os.Lchown(p, uid, gid); err != nil {
+		if o.report.Denied == 0 && errors.Is(err, os.ErrPermission) {
+			monitoring.GetLogger().WithError(err).Warn("Not permitted to set owners of restored files")
+		}
+		o.report.Denied++
+		return false
+	}
+	o.report.Mapped++
+	return uid >= 0 && gid >= 0
+}
+
+func (o *Owners) unmapped(owner string) {
+	if o.report.Unmapped == nil {
+		o.report.Unmapped = make(map[string]int)
+	}
+	o.report.Unmapped[owner]++
+}
+
+// Report returns how the owners of everything restored so far were mapped.
+func (o *Owners) Report() OwnerReport {
+	return o.report
+}
+
+// UnmappedOwners lists the unmapped owners of the report, most entries first.
+func (r *OwnerReport) UnmappedOwners() []string {
+	out := make([]string, 0, len(r.Unmapped))
+	for owner := range r.Unmapped {
+		out = append(out, owner)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if r.Unmapped[out[i]] != r.Unmapped[out[j]] {
+			return r.Unmapped[out[i]] > r.Unmapped[out[j]]
+		}
+		return out[i] < out[j]
+	})
+	return out
+}
+
+func describeOwner(id int, name string) string {
+	if name == "" {
+		return strconv.Itoa(id)
+	}
+	return fmt.Sprintf("%s (%d)", name, id)
+}
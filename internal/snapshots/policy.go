@@ -0,0 +1,37 @@
+package snapshots
+
+import (
+	"path/filepath"
+
+	"github.com/hoangsonww/backupagent/internal/contentpolicy"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+)
+
+// checkPolicy applies policy to the regular file p met by a walk of l's
+// root, logging and counting what it flags. It returns the finding, if
+// any; a file that cannot be read is a *readError.
+func checkPolicy(policy *contentpolicy.Policy, l *fileList, p string) (*contentpolicy.Finding, error) {
+	if policy == nil {
+		return nil, nil
+	}
+	rel := l.path(p)
+	if p == l.root {
+		rel = filepath.Base(p)
+	}
+	f, err := policy.Check(p, rel)
+	if err != nil {
+		return nil, &readError{err}
+	}
+	if f == nil {
+		return nil, nil
+	}
+	logger := monitoring.GetLogger().WithFields(map[string]interface{}{"path": p, "rule": f.Rule})
+	if f.Excluded {
+		monitoring.GetMetrics().FilesWithheld.Add(1)
+		logger.Warn("Leaving out file flagged by the content policy")
+	} else {
+		monitoring.GetMetrics().FilesReported.Add(1)
+		logger.Warn("Backing up file flagged by the content policy")
+	}
+	return f, nil
+}
@@ -0,0 +1,164 @@
+package snapshots
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// What a snapshot does about a post-processor that fails
+const (
+	// PostProcessFail abandons the snapshot: it is neither saved nor
+	// broadcast, and the backup counts as failed
+	PostProcessFail = "fail"
+	// PostProcessWarn logs the failure and saves the snapshot anyway
+	PostProcessWarn = "warn"
+)
+
+// ErrPostProcessor is returned for a post-processor that cannot be registered
+var ErrPostProcessor = errors.New("invalid post-processor")
+
+// PostProcessor is handed each snapshot the agent creates once its manifest
+// is complete, before it is saved and broadcast, e.g. to index its content,
+// emit an SBOM or countersign it. The snapshot is signed already, so Process
+// must not modify it.
+type PostProcessor interface {
+	// Name identifies the processor in logs and errors; it must be unique
+	Name() string
+	Process(ctx context.Context, snap *versioning.Snapshot) error
+}
+
+type funcProcessor struct {
+	name string
+	fn   func(context.Context, *versioning.Snapshot) error
+}
+
+func (p funcProcessor) Name() string { return p.name }
+
+func (p funcProcessor) Process(ctx context.Context, snap *versioning.Snapshot) error {
+	return p.fn(ctx, snap)
+}
+
+// PostProcessorFunc returns a PostProcessor called name that calls fn.
+func PostProcessorFunc(name string, fn func(context.Context, *versioning.Snapshot) error) PostProcessor {
+	return funcProcessor{name: name, fn: fn}
+}
+
+// PostProcessOptions says how a post-processor is run.
+type PostProcessOptions struct {
+	// OnError is PostProcessFail or PostProcessWarn; PostProcessFail if
+	// empty
+	OnError string
+	// Timeout bounds each call of Process; 0 leaves it to the snapshot's
+	// context
+	Timeout time.Duration
+}
+
+// PostProcessError reports a post-processor that failed a snapshot.
+type PostProcessError struct {
+	Processor  string
+	SnapshotID string
+	Err        error
+}
+
+func (e *PostProcessError) Error() string {
+	return fmt.Sprintf("post-processor %s failed on snapshot %s: %v", e.Processor, e.SnapshotID, e.Err)
+}
+
+func (e *PostProcessError) Unwrap() error { return e.Err }
+
+type registered struct {
+	p    PostProcessor
+	opts PostProcessOptions
+}
+
+// PostProcessors runs registered post-processors in the order they were
+// registered. The zero value has none and is ready to use.
+type PostProcessors struct {
+	mu    sync.RWMutex
+	procs []registered
+}
+
+// Register adds p, to run after those registered before it.
+func (r *PostProcessors) Register(p PostProcessor, opts PostProcessOptions) error {
+	if p == nil || p.Name() == "" {
+		return fmt.Errorf("%w: no name", ErrPostProcessor)
+	}
+	switch opts.OnError {
+	case "":
+		opts.OnError = PostProcessFail
+	case PostProcessFail, PostProcessWarn:
+	default:
+		return fmt.Errorf("%w: %s: OnError %q (must be %s or %s)", ErrPostProcessor, p.Name(), opts.OnError, PostProcessFail, PostProcessWarn)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, reg := range r.procs {
+		if reg.p.Name() == p.Name() {
+			return fmt.Errorf("%w: %s registered twice", ErrPostProcessor, p.Name())
+		}
+	}
+	r.procs = append(r.procs, registered{p, opts})
+	return nil
+}
+
+// Names returns the registered post-processors in the order they run.
+func (r *PostProcessors) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, len(r.procs))
+	for i, reg := range r.procs {
+		names[i] = reg.p.Name()
+	}
+	return names
+}
+
+// Run hands snap to every post-processor. The first to fail under
+// PostProcessFail stops the run with a *PostProcessError; failures under
+// PostProcessWarn are logged. A nil r runs nothing.
+func (r *PostProcessors) Run(ctx context.Context, snap *versioning.Snapshot) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	procs := append([]registered(nil), r.procs...)
+	r.mu.RUnlock()
+
+	for _, reg := range procs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := runProcessor(ctx, reg, snap)
+		if err == nil {
+			continue
+		}
+		monitoring.GetMetrics().PostProcessFailures.Add(1)
+		err = &PostProcessError{Processor: reg.p.Name(), SnapshotID: snap.ID, Err: err}
+		if reg.opts.OnError == PostProcessFail {
+			return err
+		}
+		monitoring.LoggerFor(ctx).WithError(err).Warn("Post-processor failed; saving the snapshot anyway")
+	}
+	return nil
+}
+
+// runProcessor calls one post-processor within its timeout, turning a panic
+// into an error so an embedder's bug cannot take the agent down
+func runProcessor(ctx context.Context, reg registered, snap *versioning.Snapshot) (err error) {
+	if reg.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, reg.opts.Timeout)
+		defer cancel()
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	return reg.p.Process(ctx, snap)
+}
@@ -0,0 +1,151 @@
+package snapshots
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/hoangsonww/backupagent/internal/fspath"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// ErrOverlappingRoots is returned for paths of one snapshot of which one
+// holds another, or that cannot share a snapshot at all.
+var ErrOverlappingRoots = errors.New("snapshot paths overlap")
+
+// RootSet combines the scans of several paths into the chunk list and file
+// manifest of one snapshot. Each path's files are recorded under its own
+// section, the path without its leading separator, along with the
+// directories above it, so restoring the snapshot into / puts every path
+// back where it was.
+type RootSet struct {
+	roots  []versioning.Root
+	paths  []string
+	raw    []string // section names as the filesystem spells them
+	chunks []string
+	files  []versioning.FileEntry
+	dirs   map[string]bool // sections and the directories above them recorded
+}
+
+// NewRootSet returns the set of paths, which should come from
+// fspath.Resolve. It fails with ErrOverlappingRoots unless every path is
+// below the filesystem root and none holds another.
+func NewRootSet(paths []string) (*RootSet, error) {
+	s := &RootSet{dirs: make(map[string]bool)}
+	for _, p := range paths {
+		raw := rootName(p)
+		if raw == "" {
+			return nil, fmt.Errorf("%w: %s is a filesystem root", ErrOverlappingRoots, p)
+		}
+		name := fspath.Key(raw)
+		for i, r := range s.roots {
+			if name == r.Name || strings.HasPrefix(name, r.Name+"/") || strings.HasPrefix(r.Name, name+"/") {
+				return nil, fmt.Errorf("%w: %s and %s", ErrOverlappingRoots, s.paths[i], p)
+			}
+		}
+		s.roots = append(s.roots, versioning.Root{Name: name, Path: fspath.Key(p), Original: fspath.Original(p)})
+		s.paths = append(s.paths, p)
+		s.raw = append(s.raw, raw)
+	}
+	return s, nil
+}
+
+// rootName is p without its volume and leading separator, slash-separated;
+// a volume name keeps its letter, so C:\data is C/data
+func rootName(p string) string {
+	vol := filepath.VolumeName(p)
+	rest := strings.Trim(filepath.ToSlash(p[len(vol):]), "/")
+	if vol = strings.Trim(filepath.ToSlash(vol), "/:"); vol != "" && rest != "" {
+		rest = vol + "/" + rest
+	}
+	return rest
+}
+
+// Paths returns the paths of the set, in the order given.
+func (s *RootSet) Paths() []string {
+	return s.paths
+}
+
+// Roots returns the roots to record in the snapshot.
+func (s *RootSet) Roots() []versioning.Root {
+	return s.roots
+}
+
+// Chunks returns the chunk list of the paths added so far.
+func (s *RootSet) Chunks() []string {
+	return s.chunks
+}
+
+// Files returns the file manifest of the paths added so far.
+func (s *RootSet) Files() []versioning.FileEntry {
+	return s.files
+}
+
+// Add appends the scan of the i-th path, its chunks and files relative to
+// it, moving them under its section.
+func (s *RootSet) Add(i int, chunks []string, files []versioning.FileEntry) error {
+	name, raw := s.roots[i].Name, s.raw[i]
+	if err := s.parents(s.paths[i], raw); err != nil {
+		return err
+	}
+	if len(files) != 1 || files[0].Path != versioning.SourcePath {
+		info, err := os.Lstat(s.paths[i])
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			s.add(raw, fileAttrs(s.paths[i], info))
+		}
+	}
+	first := len(s.chunks)
+	for _, e := range files {
+		rel := raw
+		if e.Path != versioning.SourcePath {
+			orig := e.Path
+			if e.Original != "" {
+				if o, err := fspath.DecodeOriginal(e.Original); err == nil {
+					orig = o
+				}
+			}
+			rel = path.Join(raw, orig)
+		}
+		if e.Hardlink != "" {
+			e.Hardlink = path.Join(name, e.Hardlink)
+		}
+		e.First += first
+		s.add(rel, e)
+	}
+	s.chunks = append(s.chunks, chunks...)
+	return nil
+}
+
+// parents records the directories above the section raw of p that no
+// earlier path recorded, with the attributes they have on disk
+func (s *RootSet) parents(p, raw string) error {
+	var dirs, disk []string
+	for dir := path.Dir(raw); dir != "." && !s.dirs[fspath.Key(dir)]; dir = path.Dir(dir) {
+		p = filepath.Dir(p)
+		dirs, disk = append(dirs, dir), append(disk, p)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := os.Lstat(disk[i])
+		if err != nil {
+			return err
+		}
+		s.add(dirs[i], fileAttrs(disk[i], info))
+	}
+	return nil
+}
+
+// add records e under rel, slash-separated and spelled as the filesystem
+// does
+func (s *RootSet) add(rel string, e versioning.FileEntry) {
+	e.Path, e.Original = fspath.Key(rel), fspath.Original(rel)
+	if e.IsDir() {
+		s.dirs[e.Path] = true
+	}
+	s.files = append(s.files, e)
+}
@@ -0,0 +1,213 @@
+package snapshots
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+)
+
+const (
+	// scanWaitDelay is how long a scan command's output may stay open after
+	// it was killed, by children of its shell
+	scanWaitDelay = 5 * time.Second
+	// scanOutputTail is how much of a scan command's output is kept
+	scanOutputTail = 512
+)
+
+// ErrFilesQuarantined is wrapped by QuarantinedError
+var ErrFilesQuarantined = errors.New("restored files quarantined")
+
+// QuarantinedError reports a restore that finished with files the scan
+// command flagged kept out of the target.
+type QuarantinedError struct {
+	Quarantined []QuarantinedFile
+}
+
+func (e *QuarantinedError) Error() string {
+	return fmt.Sprintf("%d restored file(s) flagged by the scan command and quarantined", len(e.Quarantined))
+}
+
+func (e *QuarantinedError) Unwrap() error { return ErrFilesQuarantined }
+
+// QuarantinedFile is a restored file the scan command flagged.
+type QuarantinedFile struct {
+	Path       string `json:"path"`       // where it would have been restored
+	Quarantine string `json:"quarantine"` // where it was put instead
+	Output     string `json:"output,omitempty"`
+}
+
+// ScanReport is what a Scanner did during a restore.
+type ScanReport struct {
+	Scanned     int               `json:"scanned"`
+	Quarantined []QuarantinedFile `json:"quarantined,omitempty"`
+}
+
+// Scanner passes every restored file through a shell command before it is
+// moved into place, e.g. a malware scanner. The command reads the file on
+// its standard input, with its target path in SHADOWVAULT_RESTORE_PATH. It
+// exits 0 to pass the file and 1 to flag it, as clamscan does; anything
+// else fails the restore. Flagged files are moved to a quarantine directory
+// rather than restored. A nil *Scanner passes everything unscanned.
+type Scanner struct {
+	command    string
+	timeout    time.Duration
+	quarantine string
+
+	mu     sync.Mutex
+	report ScanReport
+}
+
+// NewScanner returns a Scanner running command, killed after timeout
+// unless it is 0, and moving flagged files into the directory quarantine.
+func NewScanner(command string, timeout time.Duration, quarantine string) *Scanner {
+	return &Scanner{command: command, timeout: timeout, quarantine: quarantine}
+}
+
+// Report returns what was scanned and quarantined so far.
+func (s *Scanner) Report() *ScanReport {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.report
+	r.Quarantined = append([]QuarantinedFile(nil), r.Quarantined...)
+	return &r
+}
+
+// Err returns a *QuarantinedError if any file was quarantined.
+func (s *Scanner) Err() error {
+	if r := s.Report(); r != nil && len(r.Quarantined) > 0 {
+		return &QuarantinedError{Quarantined: r.Quarantined}
+	}
+	return nil
+}
+
+// commit scans the restored content at tmp and renames it to final if the
+// command passes it. It reports whether the file was quarantined instead.
+func (s *Scanner) commit(tmp, final string) (bool, error) {
+	if s == nil {
+		return false, os.Rename(tmp, final)
+	}
+	flagged, output, err := s.scan(tmp, final)
+	if err != nil {
+		os.Remove(tmp)
+		return false, fmt.Errorf("scanning %s: %w", final, err)
+	}
+	s.mu.Lock()
+	s.report.Scanned++
+	s.mu.Unlock()
+	if !flagged {
+		return false, os.Rename(tmp, final)
+	}
+
+	dest, err := s.isolate(tmp, final)
+	if err != nil {
+		os.Remove(tmp)
+		return false, fmt.Errorf("quarantining %s: %w", final, err)
+	}
+	monitoring.GetLogger().WithFields(map[string]interface{}{
+		"path":       final,
+		"quarantine": dest,
+		"output":     output,
+	}).Warn("Restored file flagged by the scan command, quarantined")
+	monitoring.GetMetrics().FilesQuarantined.Add(1)
+	s.mu.Lock()
+	s.report.Quarantined = append(s.report.Quarantined, QuarantinedFile{Path: final, Quarantine: dest, Output: output})
+	s.mu.Unlock()
+	return true, nil
+}
+
+// scan runs the command on the content at tmp, to be restored as final,
+// and reports whether it flagged it, with the end of what it printed
+func (s *Scanner) scan(tmp, final string) (bool, string, error) {
+	in, err := os.Open(tmp)
+	if err != nil {
+		return false, "", err
+	}
+	defer in.Close()
+
+	ctx := context.Background()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", s.command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", s.command)
+	}
+	cmd.Env = append(os.Environ(), "SHADOWVAULT_RESTORE_PATH="+final)
+	var output bytes.Buffer
+	cmd.Stdin = in
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.WaitDelay = scanWaitDelay
+
+	err = cmd.Run()
+	out := strings.TrimSpace(output.String())
+	if len(out) > scanOutputTail {
+		out = "..." + out[len(out)-scanOutputTail:]
+	}
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		return false, out, nil
+	case ctx.Err() == context.DeadlineExceeded:
+		return false, out, fmt.Errorf("scan command timed out after %s", s.timeout)
+	case errors.As(err, &exit) && exit.ExitCode() == 1:
+		return true, out, nil
+	}
+	if out != "" {
+		return false, out, fmt.Errorf("scan command: %w: %s", err, out)
+	}
+	return false, out, fmt.Errorf("scan command: %w", err)
+}
+
+// isolate moves tmp into the quarantine directory under the name of final,
+// made unique, and returns where it put it
+func (s *Scanner) isolate(tmp, final string) (string, error) {
+	if err := os.MkdirAll(s.quarantine, 0700); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(s.quarantine, fmt.Sprintf("%s.%d", filepath.Base(final), time.Now().UnixNano()))
+	if err := os.Rename(tmp, dest); err == nil {
+		return dest, nil
+	}
+	// The quarantine may be on another filesystem than the target
+	if err := copyFile(tmp, dest); err != nil {
+		os.Remove(dest)
+		return "", err
+	}
+	return dest, os.Remove(tmp)
+}
+
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
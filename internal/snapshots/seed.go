@@ -0,0 +1,543 @@
+package snapshots
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/chunker"
+	"github.com/hoangsonww/backupagent/internal/contentpolicy"
+	"github.com/hoangsonww/backupagent/internal/exclude"
+	"github.com/hoangsonww/backupagent/internal/fspath"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/scheduler"
+	"github.com/hoangsonww/backupagent/internal/storage"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/time/rate"
+)
+
+// Seeding phases
+const (
+	SeedScanning = "scanning"
+	SeedRunning  = "seeding"
+	SeedPaused   = "paused"
+	SeedDone     = "done"
+)
+
+const (
+	// seedCheckpointBytes forces a checkpoint inside very large directories
+	seedCheckpointBytes = 1 << 30
+)
+
+var ErrNoSeed = errors.New("no seeding run for this path")
+
+// SeedProgress is the checkpointed state of a seeding run.
+type SeedProgress struct {
+	Root           string        `json:"root"`
+	Phase          string        `json:"phase"`
+	StartedAt      time.Time     `json:"started_at"`
+	UpdatedAt      time.Time     `json:"updated_at"`
+	LastCheckpoint time.Time     `json:"last_checkpoint,omitempty"`
+	TotalFiles     int64         `json:"total_files"`
+	TotalBytes     int64         `json:"total_bytes"`
+	DoneFiles      int64         `json:"done_files"`
+	DoneBytes      int64         `json:"done_bytes"`
+	ReadBytes      int64         `json:"read_bytes"` // bytes actually read, excluding files reused on resume
+	Dirs           int64         `json:"dirs"`
+	CurrentDir     string        `json:"current_dir,omitempty"`
+	ActiveTime     time.Duration `json:"active_time"` // time spent seeding, excluding pauses
+	ResumeAt       time.Time     `json:"resume_at,omitempty"`
+	Resumes        int           `json:"resumes"`
+	SnapshotID     string        `json:"snapshot_id,omitempty"`
+}
+
+// Percent is the share of bytes processed so far.
+func (p *SeedProgress) Percent() float64 {
+	if p.TotalBytes == 0 {
+		if p.Phase == SeedDone {
+			return 100
+		}
+		return 0
+	}
+	return 100 * float64(p.DoneBytes) / float64(p.TotalBytes)
+}
+
+// Rate is the read throughput in bytes per second of active time.
+func (p *SeedProgress) Rate() float64 {
+	if p.ActiveTime <= 0 {
+		return 0
+	}
+	return float64(p.ReadBytes) / p.ActiveTime.Seconds()
+}
+
+// ETA estimates the active time still needed, not counting pauses.
+func (p *SeedProgress) ETA() time.Duration {
+	r := p.Rate()
+	if r == 0 || p.DoneBytes >= p.TotalBytes {
+		return 0
+	}
+	return time.Duration(float64(p.TotalBytes-p.DoneBytes) / r * float64(time.Second))
+}
+
+// SeedOptions controls a seeding run.
+type SeedOptions struct {
+	Window      *scheduler.ActiveWindow // nil seeds at any time
+	MaxReadRate int64                   // bytes per second; 0 is unlimited
+	Chunking    chunker.Params
+	OnError     string // policy for unreadable files, OnErrorFail if empty
+	Excludes    *exclude.Set
+	Policy      *contentpolicy.Policy // checks each file before it is read
+	RepoID      string
+	Seal        func([]byte) ([]byte, error) // seals the snapshot metadata if set
+	SignerPub   []byte
+	SignerPriv  []byte
+	OnProgress  func(*SeedProgress)
+	// PostProcessors see the finished snapshot before it is saved. When one
+	// fails the run, the checkpoints are kept and a rerun tries again.
+	PostProcessors *PostProcessors
+}
+
+// seedFile records how a file was chunked so a resumed run can skip it
+type seedFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Chunks  []string  `json:"chunks"`
+}
+
+// seeder walks one tree, checkpointing after each directory
+type seeder struct {
+	db       *persistence.DB
+	store    *storage.Store
+	opts     SeedOptions
+	progress *SeedProgress
+	limiter  *rate.Limiter
+	skip     *skipper
+	files    *fileList
+	pending  map[string]*seedFile
+	pendingN int64
+	lastTick time.Time
+}
+
+// Seed performs the first full backup of root. Unlike CreateSnapshot it only
+// reads during the active window, throttles disk reads and checkpoints every
+// directory, so an interrupted run resumes where it stopped, reusing files
+// whose size and modification time are unchanged. The finished snapshot is
+// saved to db.
+func Seed(ctx context.Context, db *persistence.DB, store *storage.Store, root string, opts SeedOptions) (*versioning.Snapshot, error) {
+	root, err := fspath.Resolve(root)
+	if err != nil {
+		return nil, err
+	}
+	logger := monitoring.GetLogger().WithField("root", root)
+
+	progress, err := LoadSeed(db, root)
+	switch {
+	case errors.Is(err, ErrNoSeed) || (err == nil && progress.Phase == SeedDone):
+		progress = &SeedProgress{Root: root, Phase: SeedScanning, StartedAt: time.Now().UTC()}
+	case err != nil:
+		return nil, err
+	default:
+		progress.Resumes++
+		logger.Infof("Resuming seeding at %.1f%%", progress.Percent())
+	}
+
+	s := &seeder{
+		db:       db,
+		store:    store,
+		opts:     opts,
+		progress: progress,
+		skip:     &skipper{policy: opts.OnError},
+		files:    &fileList{root: root},
+		pending:  make(map[string]*seedFile),
+	}
+	if opts.MaxReadRate > 0 {
+		burst := int(opts.MaxReadRate)
+		if burst < opts.Chunking.Max {
+			burst = opts.Chunking.Max
+		}
+		s.limiter = rate.NewLimiter(rate.Limit(opts.MaxReadRate), burst)
+	}
+
+	if progress.Phase == SeedScanning {
+		if err := s.scan(ctx, root); err != nil {
+			return nil, err
+		}
+		logger.WithFields(map[string]interface{}{
+			"files": progress.TotalFiles,
+			"bytes": progress.TotalBytes,
+		}).Info("Seeding scan complete")
+	}
+
+	// Counters are rebuilt as the walk passes files finished by earlier runs
+	s.lastTick = time.Now()
+	progress.Phase = SeedRunning
+	progress.DoneFiles, progress.DoneBytes, progress.Dirs = 0, 0, 0
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Walk has already given up on p, so there is nothing to retry
+			if p == root {
+				return err
+			}
+			return s.skip.report(p, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if excluded(s.files, opts.Excludes, p, info) {
+			return skipExcluded(info)
+		}
+		if info.IsDir() {
+			s.files.dir(p, fileAttrs(p, info))
+			progress.Dirs++
+			progress.CurrentDir = p
+			if len(s.pending) == 0 {
+				return nil
+			}
+			return s.checkpoint()
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			attrs, err := linkAttrs(p, info)
+			if err != nil {
+				return s.skip.report(p, err)
+			}
+			s.files.link(p, attrs)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if err := s.waitActive(ctx); err != nil {
+			return err
+		}
+		if err := s.seedFile(ctx, p, info); err != nil {
+			return err
+		}
+		if s.pendingN >= seedCheckpointBytes {
+			return s.checkpoint()
+		}
+		return nil
+	})
+	// Keep whatever was finished so the next run picks up from here
+	if cerr := s.checkpoint(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snap, err := NewSnapshot(root, s.files.chunks, s.files.files, opts.Chunking, s.skip.skipped, nil, opts.Seal, opts.SignerPub, opts.SignerPriv, nil, opts.RepoID)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.PostProcessors.Run(ctx, snap); err != nil {
+		return nil, err
+	}
+	if err := versioning.SaveSnapshot(db, snap); err != nil {
+		return nil, err
+	}
+	progress.Phase = SeedDone
+	progress.SnapshotID = snap.ID
+	progress.CurrentDir = ""
+	if err := finishSeed(db, progress); err != nil {
+		return nil, err
+	}
+	s.report()
+	return snap, nil
+}
+
+// scan sizes the tree up front so progress can be shown as a percentage
+func (s *seeder) scan(ctx context.Context, root string) error {
+	var files, size int64
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Reported by the seeding walk unless the policy is to fail
+			if p == root || s.skip.fails() {
+				return err
+			}
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if excluded(s.files, s.opts.Excludes, p, info) {
+			return skipExcluded(info)
+		}
+		if info.Mode().IsRegular() {
+			files++
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.progress.TotalFiles = files
+	s.progress.TotalBytes = size
+	s.progress.Phase = SeedRunning
+	s.lastTick = time.Now()
+	return s.checkpoint()
+}
+
+// seedFile chunks one file, or reuses its chunks from an earlier run
+func (s *seeder) seedFile(ctx context.Context, p string, info os.FileInfo) error {
+	var f *contentpolicy.Finding
+	ok, err := s.skip.read(ctx, p, func() (err error) {
+		f, err = checkPolicy(s.opts.Policy, s.files, p)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !ok || (f != nil && f.Excluded) {
+		s.progress.DoneFiles++
+		s.progress.DoneBytes += info.Size()
+		s.report()
+		return nil
+	}
+
+	prev, err := s.loadFile(p)
+	if err != nil {
+		return err
+	}
+	if prev != nil && prev.Size == info.Size() && prev.ModTime.Equal(info.ModTime()) {
+		s.files.file(p, fileAttrs(p, info), fileInode(info), prev.Chunks)
+		s.progress.DoneFiles++
+		s.progress.DoneBytes += info.Size()
+		s.report()
+		return nil
+	}
+	if hashes, ok := s.files.linked(info); ok {
+		// A hard link to a file seeded in this run
+		s.files.file(p, fileAttrs(p, info), fileInode(info), hashes)
+		s.progress.DoneFiles++
+		s.progress.DoneBytes += info.Size()
+		s.report()
+		return nil
+	}
+
+	var hashes []string
+	ok, err = s.skip.read(ctx, p, func() (err error) {
+		hashes, err = storeFile(ctx, s.store, p, s.opts.Chunking, s.limiter, func(n int) {
+			s.progress.ReadBytes += int64(n)
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		s.progress.DoneFiles++
+		s.progress.DoneBytes += info.Size()
+		s.report()
+		return nil
+	}
+
+	rec := &seedFile{Size: info.Size(), ModTime: info.ModTime(), Chunks: hashes}
+	s.files.file(p, fileAttrs(p, info), fileInode(info), rec.Chunks)
+	s.pending[p] = rec
+	s.pendingN += info.Size()
+	s.progress.DoneFiles++
+	s.progress.DoneBytes += info.Size()
+	s.report()
+	return nil
+}
+
+// waitActive blocks outside the active window, checkpointing first
+func (s *seeder) waitActive(ctx context.Context) error {
+	now := time.Now()
+	if s.opts.Window.Contains(now) {
+		return nil
+	}
+	s.progress.Phase = SeedPaused
+	s.progress.ResumeAt = s.opts.Window.NextStart(now)
+	if err := s.checkpoint(); err != nil {
+		return err
+	}
+	monitoring.GetLogger().WithField("resume_at", s.progress.ResumeAt.Format(time.RFC3339)).
+		Infof("Seeding paused outside active hours %s", s.opts.Window)
+	s.report()
+
+	timer := time.NewTimer(time.Until(s.progress.ResumeAt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	}
+
+	s.lastTick = time.Now()
+	s.progress.Phase = SeedRunning
+	s.progress.ResumeAt = time.Time{}
+	return nil
+}
+
+// checkpoint stores the finished files and progress in one transaction
+func (s *seeder) checkpoint() error {
+	now := time.Now()
+	if s.progress.Phase == SeedRunning {
+		s.progress.ActiveTime += now.Sub(s.lastTick)
+	}
+	s.lastTick = now
+	s.progress.UpdatedAt = now.UTC()
+	s.progress.LastCheckpoint = s.progress.UpdatedAt
+
+	data, err := json.Marshal(s.progress)
+	if err != nil {
+		return err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		files, err := s.db.Sealed(tx, persistence.BucketSeedFiles)
+		if err != nil {
+			return err
+		}
+		for p, rec := range s.pending {
+			v, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			if err := files.Put(seedFileKey(s.progress.Root, p), v); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket([]byte(persistence.BucketSeeding)).Put([]byte(s.progress.Root), data)
+	})
+	if err != nil {
+		return err
+	}
+	s.pending = make(map[string]*seedFile)
+	s.pendingN = 0
+	return nil
+}
+
+func (s *seeder) loadFile(p string) (*seedFile, error) {
+	var rec *seedFile
+	err := s.db.View(func(tx *bolt.Tx) error {
+		files, err := s.db.Sealed(tx, persistence.BucketSeedFiles)
+		if err != nil {
+			return err
+		}
+		v, err := files.Get(seedFileKey(s.progress.Root, p))
+		if err != nil || v == nil {
+			return err
+		}
+		rec = &seedFile{}
+		return json.Unmarshal(v, rec)
+	})
+	return rec, err
+}
+
+func (s *seeder) report() {
+	if s.opts.OnProgress != nil {
+		s.opts.OnProgress(s.progress)
+	}
+}
+
+// finishSeed marks the run done and drops its per-file records
+func finishSeed(db *persistence.DB, progress *SeedProgress) error {
+	progress.UpdatedAt = time.Now().UTC()
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := deleteSeedFiles(db, tx, progress.Root); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(persistence.BucketSeeding)).Put([]byte(progress.Root), data)
+	})
+}
+
+// LoadSeed returns the seeding state of root.
+func LoadSeed(db *persistence.DB, root string) (*SeedProgress, error) {
+	var progress *SeedProgress
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(persistence.BucketSeeding)).Get([]byte(root))
+		if v == nil {
+			return ErrNoSeed
+		}
+		progress = &SeedProgress{}
+		return json.Unmarshal(v, progress)
+	})
+	return progress, err
+}
+
+// ListSeeds returns every seeding run, finished or not.
+func ListSeeds(db *persistence.DB) ([]*SeedProgress, error) {
+	var out []*SeedProgress
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistence.BucketSeeding)).ForEach(func(k, v []byte) error {
+			var p SeedProgress
+			if err := json.Unmarshal(v, &p); err != nil {
+				return nil
+			}
+			out = append(out, &p)
+			return nil
+		})
+	})
+	return out, err
+}
+
+// CancelSeed forgets a seeding run and its checkpoints. Chunks already stored
+// stay until garbage collection.
+func CancelSeed(db *persistence.DB, root string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(persistence.BucketSeeding))
+		if b.Get([]byte(root)) == nil {
+			return ErrNoSeed
+		}
+		if err := deleteSeedFiles(db, tx, root); err != nil {
+			return err
+		}
+		return b.Delete([]byte(root))
+	})
+}
+
+func deleteSeedFiles(db *persistence.DB, tx *bolt.Tx, root string) error {
+	files, err := db.Sealed(tx, persistence.BucketSeedFiles)
+	if err != nil {
+		return err
+	}
+	prefix := seedFileKey(root, "")
+	return files.DeleteFunc(func(k []byte) bool { return bytes.HasPrefix(k, prefix) })
+}
+
+func seedFileKey(root, p string) []byte {
+	return []byte(root + "\x00" + p)
+}
+
+// CheckpointedChunks returns the chunks of files checkpointed by
+// interrupted scans and seeding runs. No snapshot references them until the
+// run is resumed and finishes, so garbage collection must keep them.
+func CheckpointedChunks(db *persistence.DB) (map[string]bool, error) {
+	chunks := make(map[string]bool)
+	err := db.View(func(tx *bolt.Tx) error {
+		for _, name := range []string{persistence.BucketSeedFiles, persistence.BucketScanFiles} {
+			b, err := db.Sealed(tx, name)
+			if err != nil {
+				return err
+			}
+			err = b.ForEach(func(k, v []byte) error {
+				var rec seedFile
+				if err := json.Unmarshal(v, &rec); err != nil {
+					return fmt.Errorf("checkpoint of %q: %w", k, err)
+				}
+				for _, h := range rec.Chunks {
+					chunks[h] = true
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return chunks, err
+}
@@ -1,6 +1,8 @@
 package snapshots
 
 import (
+	"bufio"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -10,25 +12,79 @@ import (
 	"time"
 
 	"github.com/hoangsonww/backupagent/internal/chunker"
+	"github.com/hoangsonww/backupagent/internal/compression"
 	"github.com/hoangsonww/backupagent/internal/crypto"
+	"github.com/hoangsonww/backupagent/internal/exclude"
+	"github.com/hoangsonww/backupagent/internal/fspath"
+	"github.com/hoangsonww/backupagent/internal/progress"
 	"github.com/hoangsonww/backupagent/internal/storage"
 	"github.com/hoangsonww/backupagent/internal/versioning"
+	"golang.org/x/time/rate"
 )
 
-func CreateSnapshot(path string, store *storage.Store, signerPub, signerPriv []byte, parent string, cfgSnapshotMin, cfgSnapshotMax, cfgSnapshotAvg int) (*versioning.Snapshot, error) {
-	var chunkHashes []string
+const (
+	// readBufferSize favours long sequential reads of large files
+	readBufferSize = 1 << 20
+	// batchBytes is how much chunk data is stored per transaction
+	batchBytes = 8 << 20
+)
+
+// CreateSnapshot chunks every file under path into store, leaving out what
+// excludes matches without reading it. With a parent, a snapshot of the
+// same path, files whose size and modification time match the parent's
+// manifest reuse its chunks without being read, as long as those are still
+// stored.
+func CreateSnapshot(path string, store *storage.Store, signerPub, signerPriv []byte, parent *versioning.Snapshot, repoID string, excludes *exclude.Set, cfgSnapshotMin, cfgSnapshotMax, cfgSnapshotAvg int) (*versioning.Snapshot, error) {
+	chunking := chunker.Params{Algorithm: chunker.Default, Min: cfgSnapshotMin, Max: cfgSnapshotMax, Avg: cfgSnapshotAvg}
+	list := &fileList{root: path}
+	prev := make(map[string]versioning.FileEntry)
+	if parent != nil {
+		files, _ := parent.Files()
+		for _, e := range files {
+			prev[e.Path] = e
+		}
+	}
 
 	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if excluded(list, excludes, p, info) {
+			return skipExcluded(info)
+		}
+		if info.IsDir() {
+			list.dir(p, fileAttrs(p, info))
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			attrs, err := linkAttrs(p, info)
+			if err != nil {
+				return err
+			}
+			list.link(p, attrs)
+		}
 		if info.Mode().IsRegular() {
+			attrs := fileAttrs(p, info)
+			if e, ok := prev[fspath.Key(list.path(p))]; ok && !e.IsDir() && !e.IsSymlink() && e.Size == attrs.Size && e.ModTime.Equal(attrs.ModTime) {
+				span := parent.Chunks[e.First : e.First+e.Count]
+				if missing, err := store.Missing(span); err == nil && len(missing) == 0 {
+					list.file(p, attrs, fileInode(info), span)
+					return nil
+				}
+			}
+			if hashes, ok := list.linked(info); ok {
+				list.file(p, attrs, fileInode(info), hashes)
+				return nil
+			}
+			var hashes []string
 			f, err := os.Open(p)
 			if err != nil {
 				return err
 			}
 			defer f.Close()
-			ch := chunker.New(f, cfgSnapshotMin, cfgSnapshotMax, cfgSnapshotAvg)
+			ch, err := chunker.NewAlgorithm(f, chunking)
+			if err != nil {
+				return err
+			}
 			for {
 				chunk, err := ch.Next()
 				if err == io.EOF {
@@ -41,11 +97,12 @@ func CreateSnapshot(path string, store *storage.Store, signerPub, signerPriv []b
 				if err != nil {
 					return err
 				}
-				chunkHashes = append(chunkHashes, hash)
+				hashes = append(hashes, hash)
 				if len(chunk) == 0 {
 					break
 				}
 			}
+			list.file(p, attrs, fileInode(info), hashes)
 		}
 		return nil
 	})
@@ -53,29 +110,207 @@ func CreateSnapshot(path string, store *storage.Store, signerPub, signerPriv []b
 		return nil, err
 	}
 
+	return NewSnapshot(path, list.chunks, list.files, chunking, nil, nil, store.Seal, signerPub, signerPriv, parent, repoID)
+}
+
+// excluded reports whether excludes leaves out p, met by a walk of l's root;
+// the root itself is never left out
+func excluded(l *fileList, excludes *exclude.Set, p string, info os.FileInfo) bool {
+	return p != l.root && excludes.ExcludedAt(p, l.path(p), info.IsDir())
+}
+
+// skipExcluded is what a filepath.Walk callback returns for an excluded
+// path: the directory is not entered, the file not read
+func skipExcluded(info os.FileInfo) error {
+	if info.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// NewSnapshot builds and signs the manifest of path from its chunk hashes
+// and the files they belong to, recording how they were cut, which files were
+// left out, its tags and the host they were read on. With a parent, the previous
+// snapshot of path, files unchanged since it record where their content was
+// first read. path should
+// come from fspath.Resolve; the manifest records its fspath.Key, and its
+// exact bytes if those differ. With seal set, that metadata is sealed so
+// only holders of the repository key can read it.
+func NewSnapshot(path string, chunkHashes []string, files []versioning.FileEntry, chunking chunker.Params, skipped []versioning.FileError, tags []string, seal func([]byte) ([]byte, error), signerPub, signerPriv []byte, parent *versioning.Snapshot, repoID string) (*versioning.Snapshot, error) {
+	return newSnapshot(path, nil, chunkHashes, files, chunking, skipped, tags, seal, signerPub, signerPriv, parent, repoID)
+}
+
+// NewGroupSnapshot is NewSnapshot for the paths of set, scanned into it,
+// taken together as group: its source is versioning.GroupSource(group) and
+// it records the roots of set. parent is the previous snapshot of group.
+func NewGroupSnapshot(group string, set *RootSet, chunking chunker.Params, skipped []versioning.FileError, tags []string, seal func([]byte) ([]byte, error), signerPub, signerPriv []byte, parent *versioning.Snapshot, repoID string) (*versioning.Snapshot, error) {
+	return newSnapshot(versioning.GroupSource(group), set.Roots(), set.Chunks(), set.Files(), chunking, skipped, tags, seal, signerPub, signerPriv, parent, repoID)
+}
+
+func newSnapshot(path string, roots []versioning.Root, chunkHashes []string, files []versioning.FileEntry, chunking chunker.Params, skipped []versioning.FileError, tags []string, seal func([]byte) ([]byte, error), signerPub, signerPriv []byte, parent *versioning.Snapshot, repoID string) (*versioning.Snapshot, error) {
+	if parent != nil {
+		// A parent without a usable manifest only links the history
+		if parentFiles, err := parent.Files(); err == nil {
+			versioning.InheritFiles(files, chunkHashes, parent, parentFiles)
+		}
+	}
 	snap := &versioning.Snapshot{
 		ID:        fmt.Sprintf("snap-%d", time.Now().Unix()),
-		Parent:    parent,
-		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Timestamp: versioning.NewTimestamp(time.Now()),
 		Chunks:    chunkHashes,
-		Meta:      map[string]string{"source": path},
+		Meta:      map[string]string{"source": fspath.Key(path), "chunker": chunking.String()},
 		SignerPub: base64.StdEncoding.EncodeToString(signerPub),
+		RepoID:    repoID,
+		Errors:    skipped,
+	}
+	if parent != nil {
+		snap.Parent = parent.ID
+	}
+	if orig := fspath.Original(path); orig != "" {
+		snap.Meta["source_original"] = orig
+	}
+	if host, err := os.Hostname(); err == nil {
+		snap.Meta["host"] = host
+	}
+	snap.SetTags(tags)
+	if err := snap.SetFiles(files); err != nil {
+		return nil, err
+	}
+	if err := snap.SetRoots(roots); err != nil {
+		return nil, err
+	}
+	if seal != nil {
+		if err := snap.SealMeta(seal); err != nil {
+			return nil, fmt.Errorf("failed to seal snapshot metadata: %w", err)
+		}
+	}
+	Sign(snap, signerPriv)
+	return snap, nil
+}
+
+// Backdate turns snap, built by NewSnapshot without sealing, into the record
+// of a backup taken at taken on host, e.g. one imported from another tool,
+// under id. It then seals the metadata if seal is set and signs snap again.
+func Backdate(snap *versioning.Snapshot, id string, taken time.Time, host string, seal func([]byte) ([]byte, error), signerPriv []byte) error {
+	snap.ID = id
+	snap.Timestamp = versioning.NewTimestamp(taken)
+	if host != "" {
+		snap.Meta["host"] = host
+	}
+	if seal != nil {
+		if err := snap.SealMeta(seal); err != nil {
+			return fmt.Errorf("failed to seal snapshot metadata: %w", err)
+		}
 	}
-	// Sign it
+	Sign(snap, signerPriv)
+	return nil
+}
+
+// Sign packs the chunk list of snap and signs it. Any later change to snap
+// invalidates the signature.
+func Sign(snap *versioning.Snapshot, signerPriv []byte) {
+	snap.PackChunks()
 	raw, _ := json.Marshal(snapWithoutSignature(snap))
 	sig := crypto.Sign(raw, signerPriv)
 	snap.Signature = base64.StdEncoding.EncodeToString(sig)
+}
 
-	return snap, nil
+// storeFile chunks the file at p into store, batching writes, and returns its
+// chunk hashes in order. limiter, if set, throttles reads; onRead, if set, is
+// told the size of each chunk read. The chunks stored are counted by the
+// progress tracker of ctx. The holes of a sparse file are not read, only
+// chunked as the zeros they hold. Failures to read p are *readError.
+func storeFile(ctx context.Context, store *storage.Store, p string, chunking chunker.Params, limiter *rate.Limiter, onRead func(int)) ([]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, &readError{err}
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if info, err := f.Stat(); err == nil && isSparse(info) {
+		r = newHoleReader(f, info.Size())
+	}
+	return storeReader(ctx, store, bufio.NewReaderSize(r, readBufferSize), chunking, limiter, onRead)
+}
+
+// StoreReader chunks everything r yields into store, as a file of a
+// snapshot would be, and returns its chunk hashes in order.
+func StoreReader(ctx context.Context, store *storage.Store, r io.Reader, chunking chunker.Params) ([]string, error) {
+	return storeReader(ctx, store, r, chunking, nil, nil)
+}
+
+func storeReader(ctx context.Context, store *storage.Store, r io.Reader, chunking chunker.Params, limiter *rate.Limiter, onRead func(int)) ([]string, error) {
+	var hashes []string
+	var batch [][]byte
+	var batchN int
+	// The content type, detected from the first chunk, picks how every
+	// chunk of r is compressed
+	kind := compression.Unknown
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		stored, fresh, err := store.PutChunksOf(kind, batch)
+		if err != nil {
+			return err
+		}
+		progress.From(ctx).Stored(len(batch), int64(batchN), fresh)
+		hashes = append(hashes, stored...)
+		batch, batchN = nil, 0
+		return nil
+	}
+
+	ch, err := chunker.NewAlgorithm(r, chunking)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		chunk, err := ch.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &readError{err}
+		}
+		if limiter != nil {
+			if err := limiter.WaitN(ctx, len(chunk)); err != nil {
+				return nil, err
+			}
+		}
+		if kind == compression.Unknown {
+			kind = compression.Detect(chunk)
+		}
+		batch = append(batch, chunk)
+		batchN += len(chunk)
+		if onRead != nil {
+			onRead(len(chunk))
+		}
+		if batchN >= batchBytes {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+		if len(chunk) == 0 {
+			break
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
 }
 
 func snapWithoutSignature(s *versioning.Snapshot) *versioning.Snapshot {
 	return &versioning.Snapshot{
-		ID:        s.ID,
-		Parent:    s.Parent,
-		Timestamp: s.Timestamp,
-		Chunks:    s.Chunks,
-		Meta:      s.Meta,
-		SignerPub: s.SignerPub,
+		ID:            s.ID,
+		Parent:        s.Parent,
+		Timestamp:     s.Timestamp,
+		Chunks:        s.Chunks,
+		Meta:          s.SignedMeta(),
+		SealedMeta:    s.SealedMeta,
+		SignerPub:     s.SignerPub,
+		RepoID:        s.RepoID,
+		Errors:        s.Errors,
+		ChunkEncoding: s.ChunkEncoding,
 	}
 }
@@ -0,0 +1,125 @@
+package snapshots_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/crypto"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/snapshots"
+	"github.com/hoangsonww/backupagent/internal/storage"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+func TestCreateSnapshotReusesParent(t *testing.T) {
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := storage.New(db, bytes.Repeat([]byte{3}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, priv, err := crypto.GenerateEd25519Keypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := t.TempDir()
+	write := func(name, content string, mtime time.Time) {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	then := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write("same.txt", "unchanged", then)
+	write("touched.txt", "original", then)
+	write("sub/kept.txt", "old text", then)
+	snapshot := func(parent *versioning.Snapshot, id string) (*versioning.Snapshot, map[string]versioning.FileEntry) {
+		t.Helper()
+		snap, err := snapshots.CreateSnapshot(src, store, pub, priv, parent, "repo", nil, 2048, 65536, 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Snapshots taken within a second share an ID
+		snap.ID = id
+		files, err := snap.Files()
+		if err != nil {
+			t.Fatal(err)
+		}
+		byPath := make(map[string]versioning.FileEntry)
+		for _, e := range files {
+			byPath[e.Path] = e
+		}
+		return snap, byPath
+	}
+	// content joins the chunks of the file at path in snap
+	content := func(snap *versioning.Snapshot, e versioning.FileEntry) string {
+		t.Helper()
+		var data []byte
+		for _, h := range snap.Span(&e) {
+			chunk, err := store.GetChunk(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = append(data, chunk...)
+		}
+		return string(data)
+	}
+
+	parent, parentFiles := snapshot(nil, "snap-parent")
+
+	// The same size with a later mtime is read again; the same size and
+	// mtime are trusted without reading the file
+	write("touched.txt", "replaced", then.Add(time.Minute))
+	write("sub/kept.txt", "new text", then)
+	child, files := snapshot(parent, "snap-child")
+
+	if e := files["touched.txt"]; content(child, e) != "replaced" || e.From != "" {
+		t.Errorf("touched.txt: content %q, from %q, want it chunked again", content(child, e), e.From)
+	}
+	for _, name := range []string{"same.txt", "sub/kept.txt"} {
+		e, p := files[name], parentFiles[name]
+		if !slices.Equal(child.Span(&e), parent.Span(&p)) {
+			t.Errorf("%s: chunks %v, want the parent's %v", name, child.Span(&e), parent.Span(&p))
+		}
+		if e.From != parent.ID {
+			t.Errorf("%s: from %q, want %q", name, e.From, parent.ID)
+		}
+	}
+	if got := content(child, files["sub/kept.txt"]); got != "old text" {
+		t.Errorf("sub/kept.txt: content %q, want the parent's", got)
+	}
+
+	// Inherited files are still covered by the snapshot's own chunk list
+	for name, e := range files {
+		if e.IsDir() || e.IsSymlink() || e.Size == 0 {
+			continue
+		}
+		for _, h := range child.Span(&e) {
+			if !slices.Contains(child.Chunks, h) {
+				t.Errorf("%s: chunk %s missing from the snapshot's chunks", name, h[:8])
+			}
+		}
+	}
+
+	// Provenance points at where content was first read, down the chain
+	_, grandchild := snapshot(child, "snap-grandchild")
+	for name, want := range map[string]string{"same.txt": parent.ID, "touched.txt": child.ID} {
+		if got := grandchild[name].From; got != want {
+			t.Errorf("%s: from %q in the grandchild, want %q", name, got, want)
+		}
+	}
+}
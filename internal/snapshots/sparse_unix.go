@@ -0,0 +1,93 @@
+//go:build linux || darwin
+
+package snapshots
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// inode identifies a file with more than one hard link
+type inode struct {
+	Dev uint64 `json:"dev"`
+	Ino uint64 `json:"ino"`
+}
+
+// fileInode returns the inode of info when other hard links share it, nil
+// otherwise
+func fileInode(info fs.FileInfo) *inode {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 || !info.Mode().IsRegular() {
+		return nil
+	}
+	return &inode{Dev: uint64(st.Dev), Ino: uint64(st.Ino)}
+}
+
+// isSparse reports whether the regular file of info has holes: fewer
+// blocks allocated than its size needs
+func isSparse(info fs.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode().IsRegular() && st.Blocks*512 < info.Size()
+}
+
+// holeReader reads a sparse file, yielding zeros for its holes without
+// reading them from disk
+type holeReader struct {
+	f          *os.File
+	off, size  int64
+	start, end int64 // data region at or after off; zeros before start
+}
+
+// newHoleReader returns a reader of the size bytes of f that skips its holes
+func newHoleReader(f *os.File, size int64) *holeReader {
+	return &holeReader{f: f, size: size}
+}
+
+func (r *holeReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if r.off >= r.end {
+		if err := r.seek(); err != nil {
+			return 0, err
+		}
+	}
+	if r.off < r.start {
+		n := int(min(int64(len(p)), r.start-r.off))
+		clear(p[:n])
+		r.off += int64(n)
+		return n, nil
+	}
+	n, err := r.f.ReadAt(p[:min(int64(len(p)), r.end-r.off)], r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// seek finds the data region at or after off. Where the filesystem cannot
+// tell, the rest of the file is read as data.
+func (r *holeReader) seek() error {
+	start, err := r.f.Seek(r.off, unix.SEEK_DATA)
+	switch {
+	case errors.Is(err, unix.ENXIO):
+		// Only a hole remains
+		r.start, r.end = r.size, r.size
+		return nil
+	case err != nil:
+		r.start, r.end = r.off, r.size
+		return nil
+	}
+	end, err := r.f.Seek(start, unix.SEEK_HOLE)
+	if err != nil {
+		end = r.size
+	}
+	r.start, r.end = min(start, r.size), min(end, r.size)
+	return nil
+}
@@ -0,0 +1,559 @@
+package snapshots
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/fspath"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// fileList builds the chunk list and file manifest of a snapshot of root as
+// its files are chunked, in walk order
+type fileList struct {
+	root   string
+	chunks []string
+	files  []versioning.FileEntry
+	links  map[inode]int // first file recorded of each hard-linked inode
+}
+
+// dir records a directory below root with the attributes of attrs
+func (l *fileList) dir(p string, attrs versioning.FileEntry) {
+	if p == l.root {
+		return
+	}
+	l.add(p, attrs)
+}
+
+// link records a symlink with the attributes of attrs
+func (l *fileList) link(p string, attrs versioning.FileEntry) {
+	l.add(p, attrs)
+}
+
+// file records a file with the attributes of attrs and appends its chunks.
+// id is its inode when it has other hard links: a file of the same inode,
+// size and modification time recorded before makes it a hard link to that
+// one.
+func (l *fileList) file(p string, attrs versioning.FileEntry, id *inode, hashes []string) {
+	attrs.First, attrs.Count = len(l.chunks), len(hashes)
+	if id != nil {
+		if i, ok := l.links[*id]; ok && sameFile(&l.files[i], &attrs) {
+			attrs.Hardlink = l.files[i].Path
+		} else if !ok {
+			if l.links == nil {
+				l.links = make(map[inode]int)
+			}
+			l.links[*id] = len(l.files)
+		}
+	}
+	l.add(p, attrs)
+	l.chunks = append(l.chunks, hashes...)
+}
+
+// linked returns the chunks of the file recorded before that info is a hard
+// link to, so they need not be read again
+func (l *fileList) linked(info fs.FileInfo) ([]string, bool) {
+	id := fileInode(info)
+	if id == nil {
+		return nil, false
+	}
+	i, ok := l.links[*id]
+	if !ok || l.files[i].Size != info.Size() || !l.files[i].ModTime.Equal(info.ModTime()) {
+		return nil, false
+	}
+	return l.chunks[l.files[i].First : l.files[i].First+l.files[i].Count], true
+}
+
+// sameFile reports whether two entries of one inode were recorded with the
+// same content, so one can be restored as a hard link to the other
+func sameFile(a, b *versioning.FileEntry) bool {
+	return a.Size == b.Size && a.ModTime.Equal(b.ModTime)
+}
+
+func (l *fileList) add(p string, e versioning.FileEntry) {
+	rel := l.path(p)
+	e.Path, e.Original = fspath.Key(rel), fspath.Original(rel)
+	l.files = append(l.files, e)
+}
+
+// path returns p relative to root, slash-separated
+func (l *fileList) path(p string) string {
+	if p == l.root {
+		return versioning.SourcePath
+	}
+	rel, _ := filepath.Rel(l.root, p)
+	return filepath.ToSlash(rel)
+}
+
+// recordedMode keeps the bits of mode that manifests record
+func recordedMode(mode fs.FileMode) fs.FileMode {
+	return mode & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky | fs.ModeDir | fs.ModeSymlink)
+}
+
+// fileAttrs returns the manifest attributes of the file or directory at p
+func fileAttrs(p string, info fs.FileInfo) versioning.FileEntry {
+	e := versioning.FileEntry{
+		Mode:    recordedMode(info.Mode()),
+		Owner:   fileOwner(info),
+		ModTime: info.ModTime().UTC(),
+		Xattrs:  readXattrs(p),
+	}
+	if info.Mode().IsRegular() {
+		e.Size = info.Size()
+		e.Sparse = isSparse(info)
+	}
+	return e
+}
+
+// linkAttrs returns the manifest attributes of the symlink at p, with its
+// target
+func linkAttrs(p string, info fs.FileInfo) (versioning.FileEntry, error) {
+	e := fileAttrs(p, info)
+	target, err := os.Readlink(p)
+	if err != nil {
+		return e, err
+	}
+	e.Link = target
+	return e, nil
+}
+
+// TreeWriter rebuilds the files, directories and symlinks of a snapshot
+// under a target directory. Each Write must be one whole chunk of the
+// snapshot, in order, as storage.Store.ReadChunks delivers them. Files
+// recorded as hard links to one restored before are linked to it, their
+// chunks discarded; sparse files are given holes where they hold zeros.
+type TreeWriter struct {
+	root   string // where the source itself is restored
+	files  []versioning.FileEntry
+	paths  []string // target path of each entry
+	next   int      // entry to open after the current file
+	chunk  int      // chunks written so far
+	cur    *File
+	curEnd int // chunk index ending the current file, or hard link whose chunks are discarded
+	owners *Owners
+	scan   *Scanner
+	attrs  attrErrors
+	closed bool
+
+	// restored maps the case-folded target path of every entry written so
+	// far to its exact spelling, to catch names that collide on
+	// case-insensitive filesystems
+	restored map[string]string
+	// linkable maps the Path of every file restored so far to its target
+	// path, for hard links to it
+	linkable map[string]string
+}
+
+// NewTreeWriter prepares to restore snap, which must have a file manifest,
+// into target. A single-file source is restored into target under its
+// original name, a directory source as target itself. Recorded owners are
+// mapped by owners; with nil, everything belongs to the restoring user.
+func NewTreeWriter(snap *versioning.Snapshot, target string, owners *Owners) (*TreeWriter, error) {
+	files, err := snap.Files()
+	if err != nil {
+		return nil, err
+	}
+	if files == nil {
+		return nil, fmt.Errorf("%w: snapshot %s has none", versioning.ErrBadFileManifest, snap.ID)
+	}
+	t := &TreeWriter{
+		root:     target,
+		files:    files,
+		paths:    make([]string, len(files)),
+		owners:   owners,
+		restored: make(map[string]string, len(files)),
+		linkable: make(map[string]string),
+	}
+	if len(files) == 1 && files[0].Path == versioning.SourcePath {
+		name := filepath.Base(snap.OriginalSource())
+		if name == "." || name == string(filepath.Separator) || name == "" {
+			name = fmt.Sprintf("restored_%s.bin", snap.ID)
+		}
+		t.root = filepath.Join(target, name)
+		t.paths[0] = t.root
+	} else {
+		for i, e := range files {
+			rel := e.Path
+			if e.Original != "" {
+				if orig, err := fspath.DecodeOriginal(e.Original); err == nil && filepath.IsLocal(filepath.FromSlash(orig)) {
+					rel = orig
+				}
+			}
+			t.paths[i] = filepath.Join(target, filepath.FromSlash(rel))
+		}
+	}
+
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return nil, err
+	}
+	// Directories are created writable and get their mode once filled
+	for i, e := range files {
+		if e.IsDir() {
+			t.paths[i] = t.claim(t.paths[i])
+			if err := os.MkdirAll(t.paths[i], 0700); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return t, t.advance()
+}
+
+// SetScanner has every file restored passed by s before it is moved into
+// place. It must be called before the first Write.
+func (t *TreeWriter) SetScanner(s *Scanner) {
+	t.scan = s
+}
+
+// Root returns where the snapshot's source is restored.
+func (t *TreeWriter) Root() string {
+	return t.root
+}
+
+// Write stores one chunk into the file it belongs to.
+func (t *TreeWriter) Write(data []byte) (int, error) {
+	if t.chunk >= t.curEnd {
+		return 0, fmt.Errorf("%w: more chunks than files cover", versioning.ErrBadFileManifest)
+	}
+	if t.cur != nil {
+		if _, err := t.cur.Write(data); err != nil {
+			return 0, err
+		}
+	}
+	t.chunk++
+	return len(data), t.advance()
+}
+
+// Close finishes the remaining files, creates the symlinks and applies the
+// attributes of directories. Symlinks come last so that no file is written
+// through one. Closing again does nothing.
+func (t *TreeWriter) Close() error {
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	if err := t.advance(); err != nil {
+		return err
+	}
+	if t.cur != nil || t.chunk < t.curEnd || t.next < len(t.files) {
+		if t.cur != nil {
+			t.cur.Abort()
+		}
+		return fmt.Errorf("restore ended after %d chunks, before every file was written", t.chunk)
+	}
+	for i := range t.files {
+		if e := &t.files[i]; e.IsSymlink() {
+			if err := os.MkdirAll(filepath.Dir(t.paths[i]), 0700); err != nil {
+				return err
+			}
+			t.paths[i] = t.claim(t.paths[i])
+			if err := createLink(t.paths[i], e, t.owners, &t.attrs); err != nil {
+				return err
+			}
+		}
+	}
+	// Deepest first, so a read-only directory is not closed before its
+	// children, nor its time changed by them
+	for i := len(t.files) - 1; i >= 0; i-- {
+		if e := &t.files[i]; e.IsDir() {
+			owned := t.owners.apply(t.paths[i], e.Owner)
+			if err := finish(t.paths[i], e, owned, &t.attrs); err != nil {
+				return err
+			}
+		}
+	}
+	t.attrs.warn(t.root)
+	return nil
+}
+
+// advance closes the current file once all its chunks are written and opens
+// the next one, passing over directories and symlinks, creating empty files
+// and linking hard links
+func (t *TreeWriter) advance() error {
+	for {
+		if t.chunk < t.curEnd {
+			return nil
+		}
+		if t.cur != nil {
+			if err := t.cur.Close(); err != nil {
+				return err
+			}
+			t.cur = nil
+		}
+		if t.next == len(t.files) {
+			return nil
+		}
+		i := t.next
+		t.next++
+		e := &t.files[i]
+		if e.IsDir() || e.IsSymlink() {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(t.paths[i]), 0700); err != nil {
+			return err
+		}
+		t.paths[i] = t.claim(t.paths[i])
+		if e.Hardlink == "" {
+			t.linkable[e.Path] = t.paths[i]
+		} else if target, ok := t.linkable[e.Hardlink]; ok {
+			err := hardlink(target, t.paths[i])
+			if err == nil {
+				t.curEnd = e.First + e.Count
+				continue
+			}
+			// As on filesystems without hard links: a copy will do
+			monitoring.GetLogger().WithError(err).WithField("path", t.paths[i]).Debug("Could not restore hard link, writing a copy")
+		}
+		f, err := CreateFile(t.paths[i], e, t.owners, t.scan)
+		if err != nil {
+			return err
+		}
+		f.attrs = &t.attrs
+		t.cur, t.curEnd = f, e.First+e.Count
+	}
+}
+
+// hardlink makes p a hard link to the restored file target, replacing any
+// file at p
+func hardlink(target, p string) error {
+	if info, err := os.Lstat(p); err == nil && !info.IsDir() {
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+	}
+	return os.Link(target, p)
+}
+
+// File is a file being restored. Closing it gives it the extended
+// attributes, mode and modification time its entry recorded.
+type File struct {
+	*os.File
+	entry  *versioning.FileEntry
+	owned  bool        // given its recorded owner
+	attrs  *attrErrors // nil to warn of attributes not set on Close
+	closed bool
+	size   int64    // bytes written, holes included
+	scan   *Scanner // passes the file before it is renamed to final
+	final  string   // where a scanned file is restored; File is a temporary file beside it
+}
+
+// sparseBlock is the granularity at which zeros of a sparse file are left
+// as holes
+const sparseBlock = 4096
+
+var zeroBlock [sparseBlock]byte
+
+// Write writes the next bytes of the file. Of a sparse file, blocks of
+// zeros are seeked over rather than written, leaving holes.
+func (f *File) Write(p []byte) (int, error) {
+	if !f.entry.Sparse {
+		n, err := f.File.Write(p)
+		f.size += int64(n)
+		return n, err
+	}
+	for start := 0; start < len(p); {
+		// The run of zero or non-zero blocks starting at p[start]
+		end, zero := start, false
+		for end < len(p) {
+			n := min(len(p)-end, sparseBlock-int((f.size+int64(end-start))%sparseBlock))
+			z := bytes.Equal(p[end:end+n], zeroBlock[:n])
+			if end > start && z != zero {
+				break
+			}
+			end, zero = end+n, z
+		}
+		var err error
+		if zero {
+			_, err = f.File.Seek(int64(end-start), io.SeekCurrent)
+		} else {
+			_, err = f.File.Write(p[start:end])
+		}
+		if err != nil {
+			return start, err
+		}
+		f.size += int64(end - start)
+		start = end
+	}
+	return len(p), nil
+}
+
+// CreateFile creates or truncates the file at p to restore the file e into,
+// with its owner mapped by owners. With scan, the content is written to a
+// temporary file beside p instead, renamed to p on Close once scan passes
+// it.
+func CreateFile(p string, e *versioning.FileEntry, owners *Owners, scan *Scanner) (*File, error) {
+	if scan == nil {
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return &File{File: f, entry: e, owned: owners.apply(p, e.Owner)}, nil
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".shadowvault-restore-*")
+	if err != nil {
+		return nil, err
+	}
+	return &File{File: f, entry: e, owned: owners.apply(f.Name(), e.Owner), scan: scan, final: p}, nil
+}
+
+// Abort closes a file that could not be finished, discarding it if it was
+// still waiting to be scanned.
+func (f *File) Abort() {
+	f.File.Close()
+	if f.scan != nil {
+		os.Remove(f.Name())
+	}
+}
+
+// Close closes the file and applies the attributes of its entry. Extended
+// attributes and times that cannot be set are logged rather than failing it.
+func (f *File) Close() error {
+	if f.closed {
+		return f.File.Close()
+	}
+	f.closed = true
+	if f.entry.Sparse {
+		// A trailing hole was only seeked over
+		if err := f.File.Truncate(f.size); err != nil {
+			f.Abort()
+			return err
+		}
+	}
+	if err := f.File.Close(); err != nil {
+		if f.scan != nil {
+			os.Remove(f.Name())
+		}
+		return err
+	}
+	p := f.Name()
+	if f.scan != nil {
+		quarantined, err := f.scan.commit(p, f.final)
+		if err != nil || quarantined {
+			return err
+		}
+		p = f.final
+	}
+	attrs := f.attrs
+	if attrs == nil {
+		attrs = &attrErrors{}
+		defer attrs.warn(p)
+	}
+	return finish(p, f.entry, f.owned, attrs)
+}
+
+// CreateLink creates the symlink e at p, replacing any file there, with its
+// owner mapped by owners.
+func CreateLink(p string, e *versioning.FileEntry, owners *Owners) error {
+	var attrs attrErrors
+	defer attrs.warn(p)
+	return createLink(p, e, owners, &attrs)
+}
+
+func createLink(p string, e *versioning.FileEntry, owners *Owners, attrs *attrErrors) error {
+	if info, err := os.Lstat(p); err == nil && !info.IsDir() {
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+	}
+	if err := os.Symlink(e.Link, p); err != nil {
+		return err
+	}
+	return finish(p, e, owners.apply(p, e.Owner), attrs)
+}
+
+// finish gives the restored entry at p the extended attributes, mode and
+// modification time of e. Setuid and setgid bits are kept only if it was
+// given its recorded owner. Only a failure to set the mode is an error.
+func finish(p string, e *versioning.FileEntry, owned bool, attrs *attrErrors) error {
+	// After the content and the owner, which both clear file capabilities
+	for name, value := range e.Xattrs {
+		attrs.add(setXattr(p, name, value))
+	}
+	if e.IsSymlink() {
+		if !e.ModTime.IsZero() {
+			attrs.add(setLinkTime(p, e.ModTime))
+		}
+		return nil
+	}
+	if err := os.Chmod(p, restoreMode(e, owned)); err != nil {
+		return err
+	}
+	if !e.ModTime.IsZero() {
+		attrs.add(os.Chtimes(p, time.Time{}, e.ModTime))
+	}
+	return nil
+}
+
+// restoreMode returns the mode a restored entry is given. A file keeps its
+// setuid and setgid bits only with its recorded owner, so that restoring
+// as another user grants no one that owner's privileges.
+func restoreMode(e *versioning.FileEntry, owned bool) fs.FileMode {
+	mode := e.Mode & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	if !owned && !e.IsDir() {
+		mode &^= fs.ModeSetuid | fs.ModeSetgid
+	}
+	return mode
+}
+
+// attrErrors counts the extended attributes and times of restored entries
+// that could not be set, as on filesystems without them, to be warned about
+// once rather than fail the restore
+type attrErrors struct {
+	count int
+	first error
+}
+
+func (a *attrErrors) add(err error) {
+	if err == nil {
+		return
+	}
+	if a.count == 0 {
+		a.first = err
+	}
+	a.count++
+}
+
+// warn logs the attributes not set on what was restored at p, if any
+func (a *attrErrors) warn(p string) {
+	if a.count == 0 {
+		return
+	}
+	monitoring.GetLogger().WithError(a.first).WithFields(map[string]interface{}{
+		"path":  p,
+		"count": a.count,
+	}).Warn("Could not restore some extended attributes or times")
+}
+
+// claim returns p, or a free variant of it when p names an entry already
+// restored under another spelling, as on case-insensitive filesystems
+func (t *TreeWriter) claim(p string) string {
+	key := strings.ToLower(fspath.Key(p))
+	prev, taken := t.restored[key]
+	if !taken {
+		t.restored[key] = p
+		return p
+	}
+	if _, err := os.Lstat(p); prev == p || err != nil {
+		// Same entry, or a case-sensitive target that holds both names
+		return p
+	}
+	for n := 2; ; n++ {
+		alt := fmt.Sprintf("%s~%d", p, n)
+		if _, err := os.Lstat(alt); err == nil {
+			continue
+		}
+		monitoring.GetLogger().WithFields(map[string]interface{}{
+			"path":     p,
+			"conflict": prev,
+			"as":       alt,
+		}).Warn("Restored name collides with another on this filesystem, renamed")
+		t.restored[strings.ToLower(fspath.Key(alt))] = alt
+		return alt
+	}
+}
@@ -0,0 +1,282 @@
+// Package sneakernet carries chunks between nodes on a drive rather than the
+// network, for an offsite copy too large to upload. An export is a directory
+// of snapshots and the chunks they need, in their stored, encrypted form:
+//
+//	manifest.json
+//	chunks/<first two hex digits>/<rest of hash>
+//
+// The manifest is written last, so a directory without one is an export
+// still in progress. The node importing it answers with a signed receipt, a
+// small file carried or mailed back, which tells the exporting node that the
+// copy is in place.
+package sneakernet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/auth"
+	"github.com/hoangsonww/backupagent/internal/crypto"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+const (
+	// Version is the export format
+	Version = 1
+
+	// ManifestName is the manifest of an export
+	ManifestName = "manifest.json"
+	// ReceiptName is where an import writes its receipt by default
+	ReceiptName = "receipt.json"
+
+	chunksDir = "chunks"
+)
+
+var (
+	// ErrNoExport means the directory holds no finished export
+	ErrNoExport = errors.New("no finished seed export")
+	// ErrChunkDamaged means a chunk file does not match the manifest,
+	// typically from a damaged drive
+	ErrChunkDamaged = errors.New("exported chunk damaged")
+)
+
+// Manifest describes an export.
+type Manifest struct {
+	Version   int                    `json:"version"`
+	ID        string                 `json:"id"`
+	RepoID    string                 `json:"repo_id"`
+	Origin    string                 `json:"origin"` // peer ID of the exporting node
+	Created   time.Time              `json:"created"`
+	Since     string                 `json:"since,omitempty"` // snapshot whose chunks the importer already holds
+	Snapshots []*versioning.Snapshot `json:"snapshots"`
+	Bytes     int64                  `json:"bytes"`
+	Sums      map[string]string      `json:"sums"` // chunk hash -> sha256 of its stored bytes
+}
+
+// Writer fills an export directory.
+type Writer struct {
+	dir string
+	man *Manifest
+}
+
+// Create starts an export in dir, which must be empty, missing or an export
+// left unfinished; chunks already written there are kept.
+func Create(dir string, man *Manifest) (*Writer, error) {
+	if _, err := os.Stat(filepath.Join(dir, ManifestName)); err == nil {
+		return nil, fmt.Errorf("%s already holds a finished export", dir)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Name() != chunksDir && !strings.HasPrefix(e.Name(), ".tmp-") {
+			return nil, fmt.Errorf("%s is not empty", dir)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, chunksDir), 0700); err != nil {
+		return nil, err
+	}
+	man.Version = Version
+	if man.Sums == nil {
+		man.Sums = make(map[string]string)
+	}
+	return &Writer{dir: dir, man: man}, nil
+}
+
+// Add writes the stored bytes of chunk hash. A file of the same size left by
+// an interrupted run is taken as written.
+func (w *Writer) Add(hash string, data []byte) error {
+	p, err := chunkPath(w.dir, hash)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	w.man.Sums[hash] = hex.EncodeToString(sum[:])
+	w.man.Bytes += int64(len(data))
+	if info, err := os.Stat(p); err == nil && info.Size() == int64(len(data)) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	return writeFile(p, data)
+}
+
+// Close writes the manifest, finishing the export.
+func (w *Writer) Close() error {
+	data, err := json.MarshalIndent(w.man, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(w.dir, ManifestName), data)
+}
+
+// Open reads the manifest of the export in dir.
+func Open(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w in %s", ErrNoExport, dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var man Manifest
+	if err := json.Unmarshal(data, &man); err != nil {
+		return nil, fmt.Errorf("malformed seed manifest: %w", err)
+	}
+	if man.Version != Version {
+		return nil, fmt.Errorf("unsupported seed export version %d", man.Version)
+	}
+	return &man, nil
+}
+
+// Hashes returns the chunks of the export, sorted.
+func (m *Manifest) Hashes() []string {
+	out := make([]string, 0, len(m.Sums))
+	for hash := range m.Sums {
+		out = append(out, hash)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// ReadChunk returns the stored bytes of chunk hash from the export in dir,
+// checked against the manifest.
+func ReadChunk(dir string, man *Manifest, hash string) ([]byte, error) {
+	want, ok := man.Sums[hash]
+	if !ok {
+		return nil, fmt.Errorf("chunk %s is not in the export", hash)
+	}
+	p, err := chunkPath(dir, hash)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != want {
+		return nil, fmt.Errorf("%w: %s", ErrChunkDamaged, hash)
+	}
+	return data, nil
+}
+
+// Receipt is what an importing node signs to acknowledge an export.
+type Receipt struct {
+	ExportID string    `json:"export_id"`
+	RepoID   string    `json:"repo_id"`
+	PeerID   string    `json:"peer_id"` // the importing node
+	Imported time.Time `json:"imported"`
+	// Snapshots maps each snapshot imported to the digest of its chunks, as
+	// p2p.ChunkDigest computes it, so the exporting node can check that the
+	// copy matches its own
+	Snapshots map[string]string `json:"snapshots"`
+	SignerPub string            `json:"signer_pub"`
+	Signature string            `json:"signature"`
+}
+
+// SigningPayload returns the bytes covered by the receipt signature.
+func (r *Receipt) SigningPayload() []byte {
+	ids := make([]string, 0, len(r.Snapshots))
+	for id := range r.Snapshots {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s|%s|%s|%s", r.ExportID, r.RepoID, r.PeerID, r.Imported.UTC().Format(time.RFC3339Nano))
+	for _, id := range ids {
+		fmt.Fprintf(&sb, "|%s=%s", id, r.Snapshots[id])
+	}
+	return []byte(sb.String())
+}
+
+// Sign signs the receipt with the key pair pub, priv.
+func (r *Receipt) Sign(pub, priv []byte) {
+	r.SignerPub = auth.PubKeyToString(pub)
+	r.Signature = auth.PubKeyToString(auth.SignPayload(r.SigningPayload(), priv))
+}
+
+// Validate verifies the receipt signature.
+func (r *Receipt) Validate() error {
+	pub, err := auth.StringToPubKey(r.SignerPub)
+	if err != nil {
+		return fmt.Errorf("malformed receipt signer: %w", err)
+	}
+	sig, err := auth.StringToPubKey(r.Signature)
+	if err != nil {
+		return fmt.Errorf("malformed receipt signature: %w", err)
+	}
+	if !crypto.Verify(r.SigningPayload(), sig, pub) {
+		return errors.New("receipt signature invalid")
+	}
+	return nil
+}
+
+// WriteReceipt writes r to path.
+func WriteReceipt(path string, r *Receipt) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// ReadReceipt reads the receipt at path, without validating it.
+func ReadReceipt(path string) (*Receipt, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r Receipt
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("malformed seed receipt: %w", err)
+	}
+	return &r, nil
+}
+
+func chunkPath(dir, hash string) (string, error) {
+	if len(hash) < 3 {
+		return "", fmt.Errorf("malformed chunk hash %q", hash)
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", fmt.Errorf("malformed chunk hash %q", hash)
+	}
+	return filepath.Join(dir, chunksDir, hash[:2], hash[2:]), nil
+}
+
+// writeFile writes data to a temporary file, syncs it and renames it to p,
+// so a drive pulled mid-write leaves no truncated file
+func writeFile(p string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package sneakernet_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/crypto"
+	"github.com/hoangsonww/backupagent/internal/sneakernet"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+func TestExportRoundTrip(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "export")
+	chunks := map[string][]byte{
+		"aa01": []byte("first sealed chunk"),
+		"bb02": []byte("second sealed chunk"),
+	}
+	man := &sneakernet.Manifest{
+		ID:        "export-1",
+		RepoID:    "repo",
+		Snapshots: []*versioning.Snapshot{{ID: "snap-1", Chunks: []string{"aa01", "bb02"}}},
+	}
+	w, err := sneakernet.Create(dir, man)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for hash, data := range chunks {
+		if err := w.Add(hash, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := sneakernet.Open(dir); !errors.Is(err, sneakernet.ErrNoExport) {
+		t.Fatalf("Open before Close = %v, want ErrNoExport", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sneakernet.Create(dir, &sneakernet.Manifest{}); err == nil {
+		t.Error("Create over a finished export succeeded")
+	}
+
+	got, err := sneakernet.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Bytes != int64(len(chunks["aa01"])+len(chunks["bb02"])) || len(got.Hashes()) != 2 {
+		t.Fatalf("manifest = %+v", got)
+	}
+	for hash, want := range chunks {
+		data, err := sneakernet.ReadChunk(dir, got, hash)
+		if err != nil || !bytes.Equal(data, want) {
+			t.Fatalf("ReadChunk(%s) = %q, %v", hash, data, err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "chunks", "aa", "01"), []byte("bit rot"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sneakernet.ReadChunk(dir, got, "aa01"); !errors.Is(err, sneakernet.ErrChunkDamaged) {
+		t.Errorf("ReadChunk of a damaged file = %v, want ErrChunkDamaged", err)
+	}
+}
+
+func TestReceiptSignature(t *testing.T) {
+	pub, priv, err := crypto.GenerateEd25519Keypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &sneakernet.Receipt{
+		ExportID:  "export-1",
+		RepoID:    "repo",
+		PeerID:    "peer",
+		Imported:  time.Now().UTC(),
+		Snapshots: map[string]string{"snap-1": "digest-1", "snap-2": "digest-2"},
+	}
+	rec.Sign(pub, priv)
+
+	path := filepath.Join(t.TempDir(), sneakernet.ReceiptName)
+	if err := sneakernet.WriteReceipt(path, rec); err != nil {
+		t.Fatal(err)
+	}
+	got, err := sneakernet.ReadReceipt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := got.Validate(); err != nil {
+		t.Fatalf("Validate = %v", err)
+	}
+	got.Snapshots["snap-3"] = "digest-3"
+	if err := got.Validate(); err == nil {
+		t.Error("Validate accepted a receipt claiming another snapshot")
+	}
+}
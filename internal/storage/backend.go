@@ -0,0 +1,362 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hoangsonww/backupagent/internal/chunkindex"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// BackendBolt keeps chunks in the blocks bucket of the metadata DB
+	BackendBolt = "bbolt"
+	// BackendFilesystem keeps each chunk in a file of its own, fanned out
+	// into directories by the first two hex digits of its hash
+	BackendFilesystem = "filesystem"
+	// BackendS3 keeps each chunk in an object of an S3-compatible bucket
+	BackendS3 = "s3"
+	// BackendSFTP keeps each chunk in a file on an SSH server, fanned out
+	// as BackendFilesystem does
+	BackendSFTP = "sftp"
+	// BackendPack appends chunks to pack files of about 16MB each
+	BackendPack = "pack"
+)
+
+// migrateBatch is how many chunks MigrateBackend moves per transaction
+const migrateBatch = 256
+
+// ErrBadChunkName is returned by a backend for a chunk hash it cannot store
+// under, such as one a peer made up to escape the chunks directory.
+var ErrBadChunkName = errors.New("malformed chunk hash")
+
+// Backend keeps the stored bytes of chunks, in the sealed form Get returns.
+// The dedup index records which backend holds each chunk; a backend only
+// moves bytes. Its methods run in the transaction updating the index, tx,
+// so the blocks bucket commits with it. A backend outside the DB writes
+// before the commit and removes after it, so a failed transaction leaves at
+// worst bytes nothing indexes.
+type Backend interface {
+	// Name is how storage.backend selects the backend
+	Name() string
+	// Location is what the index records for the chunks it holds
+	Location() chunkindex.Location
+	// Get returns the bytes of hash, nil if it holds none. They may only be
+	// valid until tx ends.
+	Get(tx *bolt.Tx, hash string) ([]byte, error)
+	Put(tx *bolt.Tx, hash string, data []byte) error
+	Delete(tx *bolt.Tx, hash string) error
+}
+
+// flusher is a Backend that buffers what Put writes until Flush, which the
+// store calls before a transaction that stored chunks commits
+type flusher interface {
+	Flush() error
+}
+
+// uploader is a Backend across the network. The store sends new chunks to
+// it with Upload before opening the transaction that indexes them, so no
+// round trip runs with the store lock and a write transaction held; Put is
+// left to moves between backends.
+type uploader interface {
+	Upload(hash string, data []byte) error
+}
+
+// flush makes what the current backend wrote durable, so the index may
+// commit pointing at it
+func (s *Store) flush() error {
+	if f, ok := s.backend.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// blocksBackend is the blocks bucket of the metadata DB, where chunks are
+// read straight from its mmap.
+type blocksBackend struct{}
+
+func (blocksBackend) Name() string                  { return BackendBolt }
+func (blocksBackend) Location() chunkindex.Location { return chunkindex.Blocks }
+
+func (blocksBackend) Get(tx *bolt.Tx, hash string) ([]byte, error) {
+	return tx.Bucket([]byte(persistence.BucketBlocks)).Get([]byte(hash)), nil
+}
+
+func (blocksBackend) Put(tx *bolt.Tx, hash string, data []byte) error {
+	return tx.Bucket([]byte(persistence.BucketBlocks)).Put([]byte(hash), data)
+}
+
+func (blocksBackend) Delete(tx *bolt.Tx, hash string) error {
+	return tx.Bucket([]byte(persistence.BucketBlocks)).Delete([]byte(hash))
+}
+
+// FileBackend keeps each chunk in a file named by its hash under a
+// directory, like git's loose objects, so the repository is not one file
+// that only grows.
+type FileBackend struct {
+	dir string
+}
+
+// NewFileBackend returns the backend keeping chunks under dir, which is
+// created on the first write.
+func NewFileBackend(dir string) *FileBackend {
+	return &FileBackend{dir: dir}
+}
+
+func (f *FileBackend) Name() string                  { return BackendFilesystem }
+func (f *FileBackend) Location() chunkindex.Location { return chunkindex.Files }
+
+// checkChunkName fails with ErrBadChunkName unless hash is hex long enough
+// to fan out by its first two digits
+func checkChunkName(hash string) error {
+	if len(hash) < 3 {
+		return fmt.Errorf("%w: %q", ErrBadChunkName, hash)
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return fmt.Errorf("%w: %q", ErrBadChunkName, hash)
+	}
+	return nil
+}
+
+// path is where the chunk hash is kept
+func (f *FileBackend) path(hash string) (string, error) {
+	if err := checkChunkName(hash); err != nil {
+		return "", err
+	}
+	return filepath.Join(f.dir, hash[:2], hash[2:]), nil
+}
+
+func (f *FileBackend) Get(_ *bolt.Tx, hash string) ([]byte, error) {
+	p, err := f.path(hash)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Put writes the chunk to a temporary file and renames it into place once
+// synced, so a crash leaves either the whole chunk or none of it.
+func (f *FileBackend) Put(_ *bolt.Tx, hash string, data []byte) error {
+	p, err := f.path(hash)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// Delete removes the chunk's file once tx commits, so a delete rolled back
+// keeps the chunk.
+func (f *FileBackend) Delete(tx *bolt.Tx, hash string) error {
+	p, err := f.path(hash)
+	if err != nil {
+		return err
+	}
+	tx.OnCommit(func() {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			monitoring.GetLogger().WithError(err).WithField("chunk", hash).Warn("Failed to remove chunk file")
+		}
+	})
+	return nil
+}
+
+// syncDir makes a rename in dir durable where the OS allows syncing a
+// directory
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// AddBackend lets the store read and remove the chunks b holds, e.g. ones
+// written before storage.backend changed. New chunks still go to the blocks
+// bucket or the backend of UseBackend.
+func (s *Store) AddBackend(b Backend) {
+	s.backends[b.Location()] = b
+}
+
+// UseBackend stores new chunks in b. Like SetCompression it must be called
+// before the store is used.
+func (s *Store) UseBackend(b Backend) {
+	s.AddBackend(b)
+	s.backend = b
+}
+
+// Backend returns the backend new chunks are stored in.
+func (s *Store) Backend() Backend {
+	return s.backend
+}
+
+// load returns the bytes of hash from the backend the index says holds them,
+// nil if none does
+func (s *Store) load(tx *bolt.Tx, hash string) ([]byte, error) {
+	e, ok := chunkindex.Get(tx, hash)
+	if !ok || !e.Stored() {
+		return nil, nil
+	}
+	b, ok := s.backends[e.Location]
+	if !ok {
+		return nil, fmt.Errorf("chunk %s is kept in %s, which is not open", hash, e.Location)
+	}
+	return b.Get(tx, hash)
+}
+
+// store puts data for hash into the current backend and indexes it there
+func (s *Store) store(tx *bolt.Tx, hash string, data []byte) error {
+	if err := s.backend.Put(tx, hash, data); err != nil {
+		return err
+	}
+	return s.index(tx, hash, int64(len(data)))
+}
+
+// preupload sends recs to the current backend if it is an uploader, before
+// the transaction storing them opens, and returns the hashes it sent
+func (s *Store) preupload(recs []walRecord) (map[string]bool, error) {
+	u, ok := s.backend.(uploader)
+	if !ok {
+		return nil, nil
+	}
+	sent := make(map[string]bool, len(recs))
+	for _, r := range recs {
+		if sent[r.hash] {
+			continue
+		}
+		if err := u.Upload(r.hash, r.data); err != nil {
+			return nil, err
+		}
+		sent[r.hash] = true
+	}
+	return sent, nil
+}
+
+// put stores data for hash, or only indexes it when preupload sent it
+func (s *Store) put(tx *bolt.Tx, hash string, data []byte, sent map[string]bool) error {
+	if sent[hash] {
+		return s.index(tx, hash, int64(len(data)))
+	}
+	return s.store(tx, hash, data)
+}
+
+// index records hash, of size stored bytes, as held by the current backend,
+// then removes any copy another backend held, which the data stored may
+// still point into
+func (s *Store) index(tx *bolt.Tx, hash string, size int64) error {
+	old, _ := chunkindex.Get(tx, hash)
+	if err := chunkindex.SetStored(tx, hash, s.backend.Location(), size); err != nil {
+		return err
+	}
+	if !old.Stored() || old.Location == s.backend.Location() {
+		return nil
+	}
+	return s.drop(tx, hash, old.Location)
+}
+
+// drop removes hash from the backend at loc
+func (s *Store) drop(tx *bolt.Tx, hash string, loc chunkindex.Location) error {
+	b, ok := s.backends[loc]
+	if !ok {
+		return fmt.Errorf("chunk %s is kept in %s, which is not open", hash, loc)
+	}
+	return b.Delete(tx, hash)
+}
+
+// MigrateBackend moves every chunk another backend holds into the one new
+// chunks go to, a batch per transaction, and returns how many it moved.
+// Chunks stay readable throughout, and a migration stopped part way resumes
+// where it left off when run again.
+func (s *Store) MigrateBackend(ctx context.Context) (int, error) {
+	var pending []string
+	to := s.backend.Location()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return chunkindex.ForEach(tx, func(hash string, e chunkindex.Entry) error {
+			if e.Stored() && e.Location != to {
+				pending = append(pending, hash)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for start := 0; start < len(pending); start += migrateBatch {
+		if err := ctx.Err(); err != nil {
+			return moved, err
+		}
+		n, err := s.migrate(pending[start:min(start+migrateBatch, len(pending))])
+		moved += n
+		if err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// migrate moves hashes into the current backend in one transaction,
+// skipping any GC removed or another write moved meanwhile
+func (s *Store) migrate(hashes []string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	moved := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		moved = 0
+		for _, h := range hashes {
+			e, ok := chunkindex.Get(tx, h)
+			if !ok || !e.Stored() || e.Location == s.backend.Location() {
+				continue
+			}
+			data, err := s.load(tx, h)
+			if err != nil {
+				return err
+			}
+			if data == nil {
+				// Indexed but gone; verification reports it
+				continue
+			}
+			if err := s.store(tx, h, data); err != nil {
+				return err
+			}
+			moved++
+		}
+		return s.flush()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return moved, nil
+}
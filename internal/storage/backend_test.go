@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestFileBackendMigration(t *testing.T) {
+	dir := t.TempDir()
+	db, err := persistence.Open(filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	key := bytes.Repeat([]byte{7}, 32)
+	chunks := make(map[string][]byte)
+	put := func(s *Store, i int) {
+		t.Helper()
+		plain := []byte(fmt.Sprintf("chunk %d", i))
+		hash, err := s.PutChunk(plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks[hash] = plain
+	}
+	readAll := func(s *Store) {
+		t.Helper()
+		for hash, plain := range chunks {
+			got, err := s.GetChunk(hash)
+			if err != nil || !bytes.Equal(got, plain) {
+				t.Fatalf("GetChunk(%s) = %q, %v, want %q", hash, got, err, plain)
+			}
+		}
+	}
+	blocks := func() int {
+		n := 0
+		db.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket([]byte(persistence.BucketBlocks)).Stats().KeyN
+			return nil
+		})
+		return n
+	}
+
+	old, err := New(db, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		put(old, i)
+	}
+
+	files := NewFileBackend(filepath.Join(dir, "chunks"))
+	store, err := New(db, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.UseBackend(files)
+	for i := 3; i < 5; i++ {
+		put(store, i)
+	}
+	// Chunks of either backend read back before the migration
+	readAll(store)
+	if n := blocks(); n != 3 {
+		t.Fatalf("blocks bucket holds %d chunks, want 3", n)
+	}
+
+	moved, err := store.MigrateBackend(context.Background())
+	if err != nil || moved != 3 {
+		t.Fatalf("MigrateBackend = %d, %v, want 3", moved, err)
+	}
+	if n := blocks(); n != 0 {
+		t.Errorf("blocks bucket holds %d chunks after migration", n)
+	}
+	readAll(store)
+	for hash := range chunks {
+		if _, err := os.Stat(filepath.Join(dir, "chunks", hash[:2], hash[2:])); err != nil {
+			t.Errorf("chunk %s has no file: %v", hash, err)
+		}
+	}
+	if moved, err := store.MigrateBackend(context.Background()); err != nil || moved != 0 {
+		t.Errorf("second MigrateBackend = %d, %v, want 0", moved, err)
+	}
+
+	for hash := range chunks {
+		if err := store.Delete(hash); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "chunks", hash[:2], hash[2:])); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("chunk %s still has a file after Delete: %v", hash, err)
+		}
+	}
+
+	if err := store.Put("../../escape", []byte("x")); !errors.Is(err, ErrBadChunkName) {
+		t.Errorf("Put of a path-like hash = %v, want ErrBadChunkName", err)
+	}
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/persistence"
+)
+
+// BenchOptions configures Bench.
+type BenchOptions struct {
+	Dir        string     // the scratch repository is created here, on the disk under test
+	Durability string     // DurabilitySync or DurabilityWAL
+	WAL        WALOptions // SyncInterval and MaxPending for DurabilityWAL
+	BatchBytes int        // chunk bytes per PutChunks call
+	Bytes      int64      // chunk bytes written in total
+	Reads      int        // chunks read back at random
+	Fsyncs     int        // fsyncs of a small write, timed on their own
+
+	// Chunk sizes follow the chunker: at least Min, about Avg, at most Max
+	MinChunk, AvgChunk, MaxChunk int
+}
+
+// Latency summarises a set of timings.
+type Latency struct {
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+}
+
+// BenchResult is the outcome of one Bench run.
+type BenchResult struct {
+	Durability string `json:"durability"`
+	BatchBytes int    `json:"batch_bytes"`
+	Chunks     int    `json:"chunks"`
+	Bytes      int64  `json:"bytes"`
+
+	PutRate    float64       `json:"put_rate"`    // chunk bytes per second spent in acknowledged puts
+	PutLatency Latency       `json:"put_latency"` // per PutChunks call
+	Drain      time.Duration `json:"drain"`       // after the last put, until every chunk was indexed
+
+	GetRate    float64 `json:"get_rate"`    // chunk bytes per second of random reads
+	GetLatency Latency `json:"get_latency"` // per GetChunk call
+
+	Fsync Latency `json:"fsync"`
+}
+
+// Bench writes and reads random chunks through a Store on a scratch
+// repository under opts.Dir, which is removed afterwards. Chunk content is
+// random, so nothing dedups or compresses.
+func Bench(opts BenchOptions) (*BenchResult, error) {
+	dir, err := os.MkdirTemp(opts.Dir, "bench-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := persistence.Open(filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	key := make([]byte, 32)
+	rand.Read(key)
+	store, err := New(db, key)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Durability == DurabilityWAL {
+		wal := opts.WAL
+		wal.Path = filepath.Join(dir, "chunks.wal")
+		if err := store.EnableWAL(wal); err != nil {
+			return nil, err
+		}
+	}
+	res := &BenchResult{Durability: opts.Durability, BatchBytes: opts.BatchBytes}
+
+	// Put
+	rng := mrand.New(mrand.NewSource(time.Now().UnixNano()))
+	var hashes []string
+	var sizes []int
+	var putTimes []time.Duration
+	var putTotal time.Duration
+	for res.Bytes < opts.Bytes {
+		var batch [][]byte
+		n := 0
+		for n < opts.BatchBytes && res.Bytes+int64(n) < opts.Bytes {
+			chunk := make([]byte, chunkSize(rng, opts))
+			rng.Read(chunk)
+			batch = append(batch, chunk)
+			n += len(chunk)
+		}
+		t := time.Now()
+		stored, err := store.PutChunks(batch)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+		putTimes = append(putTimes, time.Since(t))
+		putTotal += putTimes[len(putTimes)-1]
+		hashes = append(hashes, stored...)
+		for _, c := range batch {
+			sizes = append(sizes, len(c))
+		}
+		res.Bytes += int64(n)
+	}
+	res.Chunks = len(hashes)
+	res.PutRate = float64(res.Bytes) / putTotal.Seconds()
+	res.PutLatency = summarize(putTimes)
+
+	t := time.Now()
+	if err := store.Close(); err != nil {
+		return nil, err
+	}
+	res.Drain = time.Since(t)
+
+	// Get
+	var getTimes []time.Duration
+	var read int64
+	start := time.Now()
+	for i := 0; i < opts.Reads && len(hashes) > 0; i++ {
+		j := rng.Intn(len(hashes))
+		t := time.Now()
+		if _, err := store.GetChunk(hashes[j]); err != nil {
+			return nil, fmt.Errorf("read back chunk %s: %w", hashes[j], err)
+		}
+		getTimes = append(getTimes, time.Since(t))
+		read += int64(sizes[j])
+	}
+	if len(getTimes) > 0 {
+		res.GetRate = float64(read) / time.Since(start).Seconds()
+		res.GetLatency = summarize(getTimes)
+	}
+
+	// Fsync
+	if res.Fsync, err = benchFsync(dir, opts.Fsyncs); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// chunkSize draws a size the way content-defined chunking spreads them:
+// the minimum plus an exponential tail with the configured average
+func chunkSize(rng *mrand.Rand, opts BenchOptions) int {
+	mean := float64(opts.AvgChunk - opts.MinChunk)
+	size := opts.MinChunk + int(rng.ExpFloat64()*mean)
+	return min(max(size, 1), opts.MaxChunk)
+}
+
+func benchFsync(dir string, n int) (Latency, error) {
+	if n <= 0 {
+		return Latency{}, nil
+	}
+	f, err := os.Create(filepath.Join(dir, "fsync.probe"))
+	if err != nil {
+		return Latency{}, err
+	}
+	defer f.Close()
+	block := make([]byte, 4096)
+	times := make([]time.Duration, 0, n)
+	for i := 0; i < n; i++ {
+		if _, err := f.Write(block); err != nil {
+			return Latency{}, err
+		}
+		t := time.Now()
+		if err := f.Sync(); err != nil {
+			return Latency{}, err
+		}
+		times = append(times, time.Since(t))
+	}
+	return summarize(times), nil
+}
+
+func summarize(times []time.Duration) Latency {
+	if len(times) == 0 {
+		return Latency{}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	at := func(p float64) time.Duration {
+		i := int(math.Ceil(p*float64(len(times)))) - 1
+		return times[max(i, 0)]
+	}
+	return Latency{P50: at(0.50), P90: at(0.90), P99: at(0.99), Max: times[len(times)-1]}
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hoangsonww/backupagent/internal/compression"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	bolt "go.etcd.io/bbolt"
+)
+
+// SaveDict stores a compression dictionary under its ID. Dictionaries are
+// made of repository content, so they are encrypted like chunks.
+func (s *Store) SaveDict(d *compression.Dict) error {
+	if err := d.Check(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	sealed, err := s.Seal(data)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistence.BucketDicts)).Put(dictKey(d.ID), sealed)
+	})
+}
+
+// Dicts returns the stored compression dictionaries, oldest first.
+func (s *Store) Dicts() ([]*compression.Dict, error) {
+	var dicts []*compression.Dict
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistence.BucketDicts)).ForEach(func(k, v []byte) error {
+			data, err := s.Unseal(v)
+			if err != nil {
+				return err
+			}
+			var d compression.Dict
+			if err := json.Unmarshal(data, &d); err != nil {
+				return fmt.Errorf("failed to decode compression dictionary %x: %w", k, err)
+			}
+			dicts = append(dicts, &d)
+			return nil
+		})
+	})
+	sort.SliceStable(dicts, func(i, j int) bool { return dicts[i].Created.Before(dicts[j].Created) })
+	return dicts, err
+}
+
+// LoadDicts registers the stored compression dictionaries, so the chunks
+// compressed against them can be opened, and returns them oldest first.
+func (s *Store) LoadDicts() ([]*compression.Dict, error) {
+	dicts, err := s.Dicts()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dicts {
+		if err := compression.RegisterDict(d); err != nil {
+			return nil, err
+		}
+	}
+	return dicts, nil
+}
+
+func dictKey(id uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, id)
+}
+
+// UseDict makes chunks of d.Kind stored from now on compressed against d,
+// when they are compressed at all.
+func (s *Store) UseDict(d *compression.Dict) error {
+	if policy := s.policy.Load(); policy != nil {
+		return policy.UseDict(d)
+	}
+	return nil
+}
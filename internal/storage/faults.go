@@ -0,0 +1,33 @@
+package storage
+
+// Faults injects failures into chunk writes, so tests can check how ingest
+// recovers from them. The chaos package provides one.
+type Faults interface {
+	// CorruptChunk returns what to write for the stored form of chunk hash
+	CorruptChunk(hash string, stored []byte) []byte
+	// FailWrite returns the error, if any, to abort a write transaction with
+	// once its first chunk is written
+	FailWrite() error
+}
+
+// SetFaults makes the store inject f into its chunk writes. It must be called
+// before the store is shared, and never outside fault-injection tests.
+func (s *Store) SetFaults(f Faults) {
+	s.faults = f
+}
+
+// corrupt returns what to write for the stored form of chunk hash
+func (s *Store) corrupt(hash string, stored []byte) []byte {
+	if s.faults == nil {
+		return stored
+	}
+	return s.faults.CorruptChunk(hash, stored)
+}
+
+// interrupt returns the error to abort a chunk write transaction with
+func (s *Store) interrupt() error {
+	if s.faults == nil {
+		return nil
+	}
+	return s.faults.FailWrite()
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sverrors "github.com/hoangsonww/backupagent/internal/errors"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+)
+
+var errFault = errors.New("fault")
+
+// fakeFaults corrupts and fails as many writes as it is told to
+type fakeFaults struct {
+	corrupt, fail int
+}
+
+func (f *fakeFaults) CorruptChunk(hash string, stored []byte) []byte {
+	if f.corrupt == 0 {
+		return stored
+	}
+	f.corrupt--
+	bad := append([]byte(nil), stored...)
+	bad[len(bad)-1] ^= 0xFF
+	return bad
+}
+
+func (f *fakeFaults) FailWrite() error {
+	if f.fail == 0 {
+		return nil
+	}
+	f.fail--
+	return errFault
+}
+
+func TestInjectedFaults(t *testing.T) {
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := New(db, bytes.Repeat([]byte{5}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	faults := &fakeFaults{fail: 1}
+	store.SetFaults(faults)
+
+	// A write interrupted after its first chunk leaves nothing behind, and
+	// a retry stores everything
+	chunks := [][]byte{[]byte("one"), []byte("two"), []byte("three")}
+	if _, err := store.PutChunks(chunks); !errors.Is(err, errFault) {
+		t.Fatalf("interrupted write: %v", err)
+	}
+	if all, _ := store.ListAll(); len(all) != 0 {
+		t.Fatalf("interrupted write left %d chunks", len(all))
+	}
+	hashes, err := store.PutChunks(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, h := range hashes {
+		if got, err := store.GetChunk(h); err != nil || !bytes.Equal(got, chunks[i]) {
+			t.Fatalf("chunk %d: %q, %v", i, got, err)
+		}
+	}
+
+	// A damaged chunk fails to decrypt
+	faults.corrupt = 1
+	hash, err := store.PutChunk([]byte("four"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.GetChunk(hash)
+	if code := sverrors.GetErrorCode(err); code != sverrors.ErrCodeDecryptionFailed {
+		t.Fatalf("corrupted chunk code = %q (%v)", code, err)
+	}
+}
+
+func TestInjectedWALFaults(t *testing.T) {
+	dir := t.TempDir()
+	db, err := persistence.Open(filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	key := bytes.Repeat([]byte{7}, 32)
+	store, err := New(db, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetFaults(&fakeFaults{fail: 1})
+	if err := store.EnableWAL(WALOptions{
+		Path:         filepath.Join(dir, "chunks.wal"),
+		SyncInterval: time.Millisecond,
+		MaxPending:   1 << 20,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An interrupted apply keeps the chunks staged until one succeeds
+	chunks := [][]byte{[]byte("alpha"), []byte("beta")}
+	hashes, err := store.PutChunks(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.flushStaged(); !errors.Is(err, errFault) {
+		t.Fatalf("interrupted apply: %v", err)
+	}
+	for i, h := range hashes {
+		if got, err := store.GetChunk(h); err != nil || !bytes.Equal(got, chunks[i]) {
+			t.Fatalf("staged chunk %d: %q, %v", i, got, err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	other, err := New(db, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, h := range hashes {
+		if got, err := other.GetChunk(h); err != nil || !bytes.Equal(got, chunks[i]) {
+			t.Fatalf("indexed chunk %d: %q, %v", i, got, err)
+		}
+	}
+}
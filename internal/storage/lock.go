@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+// repoLock lets any number of writes into the repository run at once, or
+// one garbage collection sweep. A write stores chunks before the snapshot
+// referencing them is saved; a sweep running meanwhile would see them
+// unreferenced and delete them.
+type repoLock struct {
+	mu       sync.Mutex
+	writes   int
+	sweeping bool
+	changed  chan struct{} // closed and replaced whenever the lock is released
+}
+
+// acquire waits until ok reports the lock can be taken, then calls take,
+// both under mu
+func (l *repoLock) acquire(ctx context.Context, ok func() bool, take func()) error {
+	for {
+		l.mu.Lock()
+		if ok() {
+			take()
+			l.mu.Unlock()
+			return nil
+		}
+		if l.changed == nil {
+			l.changed = make(chan struct{})
+		}
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release calls give under mu and wakes the waiters
+func (l *repoLock) release(give func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	give()
+	if l.changed != nil {
+		close(l.changed)
+		l.changed = nil
+	}
+}
+
+// BeginWrite marks a write into the repository, such as a backup or a
+// received push, as running until the returned function is called, once
+// the snapshot is saved or the write abandoned. It waits for a garbage
+// collection sweep in progress to finish.
+func (s *Store) BeginWrite(ctx context.Context) (func(), error) {
+	l := &s.lock
+	err := l.acquire(ctx, func() bool { return !l.sweeping }, func() { l.writes++ })
+	if err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(func() { l.writes-- }) })
+	}, nil
+}
+
+// BeginSweep waits until no write is running, then holds off new ones until
+// the returned function is called. Garbage collection deletes chunks only
+// in between.
+func (s *Store) BeginSweep(ctx context.Context) (func(), error) {
+	l := &s.lock
+	err := l.acquire(ctx, func() bool { return l.writes == 0 && !l.sweeping }, func() { l.sweeping = true })
+	if err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(func() { l.sweeping = false }) })
+	}, nil
+}
+
+// Writes returns how many writes are running.
+func (s *Store) Writes() int {
+	s.lock.mu.Lock()
+	defer s.lock.mu.Unlock()
+	return s.lock.writes
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSweepWaitsForWrites(t *testing.T) {
+	var s Store
+	short := func() context.Context {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		t.Cleanup(cancel)
+		return ctx
+	}
+
+	endA, err := s.BeginWrite(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	endB, err := s.BeginWrite(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.BeginSweep(short()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("BeginSweep during writes = %v, want it to wait", err)
+	}
+
+	swept := make(chan func())
+	go func() {
+		end, err := s.BeginSweep(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		swept <- end
+	}()
+	endA()
+	endA() // ending twice counts once
+	select {
+	case <-swept:
+		t.Fatal("sweep began with a write still running")
+	case <-time.After(20 * time.Millisecond):
+	}
+	endB()
+	endSweep := <-swept
+
+	if _, err := s.BeginWrite(short()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("BeginWrite during a sweep = %v, want it to wait", err)
+	}
+	endSweep()
+	end, err := s.BeginWrite(short())
+	if err != nil {
+		t.Fatalf("BeginWrite after the sweep = %v", err)
+	}
+	end()
+	if n := s.Writes(); n != 0 {
+		t.Errorf("%d writes running, want 0", n)
+	}
+}
@@ -0,0 +1,427 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hoangsonww/backupagent/internal/chunkindex"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// DefaultPackSize is how large a pack grows before the next is started
+	DefaultPackSize = 16 << 20
+	// DefaultRepackThreshold is the share of live bytes below which a pack
+	// is rewritten
+	DefaultRepackThreshold = 0.5
+
+	// packEntrySize is pack(8) | offset(8) | length(4)
+	packEntrySize = 20
+	// packRecordSize is size(8) | live(8)
+	packRecordSize = 16
+	// maxOpenPacks bounds the pack files kept open for reading
+	maxOpenPacks = 64
+)
+
+// packEntry is where a chunk is kept in the packs
+type packEntry struct {
+	pack   uint64
+	offset int64
+	length int64
+}
+
+func (e packEntry) encode() []byte {
+	v := make([]byte, packEntrySize)
+	binary.BigEndian.PutUint64(v[0:8], e.pack)
+	binary.BigEndian.PutUint64(v[8:16], uint64(e.offset))
+	binary.BigEndian.PutUint32(v[16:20], uint32(e.length))
+	return v
+}
+
+func decodePackEntry(v []byte) (packEntry, bool) {
+	if len(v) != packEntrySize {
+		return packEntry{}, false
+	}
+	return packEntry{
+		pack:   binary.BigEndian.Uint64(v[0:8]),
+		offset: int64(binary.BigEndian.Uint64(v[8:16])),
+		length: int64(binary.BigEndian.Uint32(v[16:20])),
+	}, true
+}
+
+// packRecord is the bytes a pack file holds and how many of them chunks
+// still indexed use
+type packRecord struct {
+	size int64
+	live int64
+}
+
+func (r packRecord) encode() []byte {
+	v := make([]byte, packRecordSize)
+	binary.BigEndian.PutUint64(v[0:8], uint64(r.size))
+	binary.BigEndian.PutUint64(v[8:16], uint64(r.live))
+	return v
+}
+
+func packKey(id uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, id)
+}
+
+// PackBackend appends chunks to pack files of about a set size under a
+// directory, so millions of small chunks make a few thousand files, and
+// the DB holds a small fixed-size entry per chunk rather than its bytes.
+// The pack_index bucket maps each hash to its pack, offset and length; the
+// packs bucket counts the live bytes of each pack. A pack whose chunks are
+// all deleted is removed; Repack rewrites the chunks of sparse ones.
+//
+// Appends are synced once per transaction, by Flush, before the index
+// recording them commits.
+type PackBackend struct {
+	dir       string
+	size      int64
+	threshold float64
+
+	mu      sync.Mutex
+	cur     *os.File // pack being appended to; a new one after a restart
+	curID   uint64
+	curSize int64
+	nextID  uint64
+	dirty   bool // appended to cur since the last Flush
+	created bool // created a pack since the last Flush
+	open    map[uint64]*os.File
+}
+
+// NewPackBackend returns the backend keeping packs of about size bytes
+// under dir, rewriting those whose live share falls below threshold. Zero
+// values take DefaultPackSize and DefaultRepackThreshold.
+func NewPackBackend(dir string, size int64, threshold float64) *PackBackend {
+	if size <= 0 {
+		size = DefaultPackSize
+	}
+	if threshold <= 0 {
+		threshold = DefaultRepackThreshold
+	}
+	return &PackBackend{dir: dir, size: size, threshold: threshold, open: make(map[uint64]*os.File)}
+}
+
+func (b *PackBackend) Name() string                  { return BackendPack }
+func (b *PackBackend) Location() chunkindex.Location { return chunkindex.Packs }
+
+func (b *PackBackend) path(id uint64) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%016x.pack", id))
+}
+
+func (b *PackBackend) Get(tx *bolt.Tx, hash string) ([]byte, error) {
+	e, ok := decodePackEntry(tx.Bucket([]byte(persistence.BucketPackIndex)).Get([]byte(hash)))
+	if !ok {
+		return nil, nil
+	}
+	data := make([]byte, e.length)
+	for attempt := 0; ; attempt++ {
+		f, err := b.reader(e.pack)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.ReadAt(data, e.offset)
+		if err == nil {
+			return data, nil
+		}
+		// Another read may have closed the file to open a different pack
+		if !errors.Is(err, os.ErrClosed) || attempt > 0 {
+			return nil, fmt.Errorf("reading chunk %s from pack %016x: %w", hash, e.pack, err)
+		}
+	}
+}
+
+// Put appends the chunk to the current pack, starting a new one when it
+// is full.
+func (b *PackBackend) Put(tx *bolt.Tx, hash string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cur == nil || b.curSize+int64(len(data)) > b.size {
+		if err := b.startPack(tx); err != nil {
+			return err
+		}
+	}
+	off := b.curSize
+	if _, err := b.cur.Write(data); err != nil {
+		// Where the file ends is unknown now; start afresh
+		b.cur.Close()
+		b.cur = nil
+		return err
+	}
+	b.curSize += int64(len(data))
+	b.dirty = true
+
+	if err := b.release(tx, hash); err != nil {
+		return err
+	}
+	e := packEntry{pack: b.curID, offset: off, length: int64(len(data))}
+	if err := tx.Bucket([]byte(persistence.BucketPackIndex)).Put([]byte(hash), e.encode()); err != nil {
+		return err
+	}
+	packs := tx.Bucket([]byte(persistence.BucketPacks))
+	rec := loadPackRecord(packs, b.curID)
+	rec.size = max(rec.size, b.curSize)
+	rec.live += e.length
+	return packs.Put(packKey(b.curID), rec.encode())
+}
+
+// Delete drops the chunk from the index, removing its pack once nothing
+// in it is live.
+func (b *PackBackend) Delete(tx *bolt.Tx, hash string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.release(tx, hash)
+}
+
+// Flush syncs what Put appended, so the transaction indexing it can
+// commit.
+func (b *PackBackend) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.dirty && b.cur != nil {
+		if err := b.cur.Sync(); err != nil {
+			return err
+		}
+	}
+	if b.created {
+		syncDir(b.dir)
+	}
+	b.dirty, b.created = false, false
+	return nil
+}
+
+// startPack syncs and closes the current pack and opens a new one
+func (b *PackBackend) startPack(tx *bolt.Tx) error {
+	if b.cur != nil {
+		if b.dirty {
+			if err := b.cur.Sync(); err != nil {
+				return err
+			}
+			b.dirty = false
+		}
+		b.cur.Close()
+		b.cur = nil
+	}
+	if err := os.MkdirAll(b.dir, 0o700); err != nil {
+		return err
+	}
+	// IDs of packs created by transactions that rolled back are not reused
+	id := b.nextID
+	if k, _ := tx.Bucket([]byte(persistence.BucketPacks)).Cursor().Last(); len(k) == 8 {
+		id = max(id, binary.BigEndian.Uint64(k)+1)
+	}
+	id = max(id, 1)
+	f, err := os.OpenFile(b.path(id), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	b.cur, b.curID, b.curSize = f, id, info.Size()
+	b.nextID = id + 1
+	b.created = true
+	return nil
+}
+
+// release takes the chunk hash out of its pack, if one holds it, and
+// removes the pack once tx commits if nothing else in it is live
+func (b *PackBackend) release(tx *bolt.Tx, hash string) error {
+	index := tx.Bucket([]byte(persistence.BucketPackIndex))
+	e, ok := decodePackEntry(index.Get([]byte(hash)))
+	if !ok {
+		return nil
+	}
+	if err := index.Delete([]byte(hash)); err != nil {
+		return err
+	}
+	packs := tx.Bucket([]byte(persistence.BucketPacks))
+	if packs.Get(packKey(e.pack)) == nil {
+		return nil
+	}
+	rec := loadPackRecord(packs, e.pack)
+	rec.live -= e.length
+	if rec.live > 0 || (b.cur != nil && e.pack == b.curID) {
+		return packs.Put(packKey(e.pack), rec.encode())
+	}
+	return b.dropPack(tx, e.pack)
+}
+
+// dropPack forgets pack id and removes its file once tx commits
+func (b *PackBackend) dropPack(tx *bolt.Tx, id uint64) error {
+	if err := tx.Bucket([]byte(persistence.BucketPacks)).Delete(packKey(id)); err != nil {
+		return err
+	}
+	tx.OnCommit(func() {
+		b.mu.Lock()
+		if f, ok := b.open[id]; ok {
+			f.Close()
+			delete(b.open, id)
+		}
+		b.mu.Unlock()
+		if err := os.Remove(b.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			monitoring.GetLogger().WithError(err).WithField("pack", fmt.Sprintf("%016x", id)).Warn("Failed to remove pack file")
+		}
+	})
+	return nil
+}
+
+// reader returns pack id open for reading
+func (b *PackBackend) reader(id uint64) (*os.File, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if f, ok := b.open[id]; ok {
+		return f, nil
+	}
+	f, err := os.Open(b.path(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(b.open) >= maxOpenPacks {
+		for other, g := range b.open {
+			g.Close()
+			delete(b.open, other)
+			break
+		}
+	}
+	b.open[id] = f
+	return f, nil
+}
+
+func loadPackRecord(packs *bolt.Bucket, id uint64) packRecord {
+	return decodePackRecord(packs.Get(packKey(id)))
+}
+
+func decodePackRecord(v []byte) packRecord {
+	if len(v) != packRecordSize {
+		return packRecord{}
+	}
+	return packRecord{
+		size: int64(binary.BigEndian.Uint64(v[0:8])),
+		live: int64(binary.BigEndian.Uint64(v[8:16])),
+	}
+}
+
+// sparsePacks returns the chunks of each pack, other than the one being
+// appended to, whose live bytes are below the repack threshold
+func (b *PackBackend) sparsePacks(tx *bolt.Tx) map[uint64][]string {
+	b.mu.Lock()
+	cur, hasCur := b.curID, b.cur != nil
+	b.mu.Unlock()
+	sparse := make(map[uint64][]string)
+	tx.Bucket([]byte(persistence.BucketPacks)).ForEach(func(k, v []byte) error {
+		id, rec := binary.BigEndian.Uint64(k), decodePackRecord(v)
+		if (hasCur && id == cur) || rec.size == 0 {
+			return nil
+		}
+		if float64(rec.live) < b.threshold*float64(rec.size) {
+			sparse[id] = nil
+		}
+		return nil
+	})
+	if len(sparse) == 0 {
+		return sparse
+	}
+	tx.Bucket([]byte(persistence.BucketPackIndex)).ForEach(func(k, v []byte) error {
+		if e, ok := decodePackEntry(v); ok {
+			if _, ok := sparse[e.pack]; ok {
+				sparse[e.pack] = append(sparse[e.pack], string(k))
+			}
+		}
+		return nil
+	})
+	return sparse
+}
+
+// repack moves the chunks of pack id still in it to the current pack,
+// which removes it, and returns the bytes it frees
+func (b *PackBackend) repack(tx *bolt.Tx, id uint64, hashes []string) (int64, error) {
+	packs := tx.Bucket([]byte(persistence.BucketPacks))
+	if packs.Get(packKey(id)) == nil {
+		return 0, nil
+	}
+	rec := loadPackRecord(packs, id)
+	index := tx.Bucket([]byte(persistence.BucketPackIndex))
+	for _, hash := range hashes {
+		if e, ok := decodePackEntry(index.Get([]byte(hash))); !ok || e.pack != id {
+			continue
+		}
+		data, err := b.Get(tx, hash)
+		if err != nil {
+			return 0, err
+		}
+		if data == nil {
+			continue
+		}
+		if err := b.Put(tx, hash, data); err != nil {
+			return 0, err
+		}
+	}
+	// Put removed the pack when its last chunk moved; one holding only
+	// space left by deleted chunks is removed here
+	if packs.Get(packKey(id)) != nil {
+		if err := b.dropPack(tx, id); err != nil {
+			return 0, err
+		}
+	}
+	return rec.size - rec.live, nil
+}
+
+// Repack rewrites the packs whose live bytes have fallen below the repack
+// threshold of the pack backend, one transaction each, and returns how
+// many it rewrote and the bytes freed. It does nothing without a pack
+// backend.
+func (s *Store) Repack(ctx context.Context) (int, int64, error) {
+	pb, ok := s.backends[chunkindex.Packs].(*PackBackend)
+	if !ok {
+		return 0, 0, nil
+	}
+	if err := s.flushStaged(); err != nil {
+		return 0, 0, err
+	}
+	var sparse map[uint64][]string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		sparse = pb.sparsePacks(tx)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rewritten, freed := 0, int64(0)
+	for id, hashes := range sparse {
+		if err := ctx.Err(); err != nil {
+			return rewritten, freed, err
+		}
+		var n int64
+		s.mu.Lock()
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			var err error
+			if n, err = pb.repack(tx, id, hashes); err != nil {
+				return err
+			}
+			return pb.Flush()
+		})
+		s.mu.Unlock()
+		if err != nil {
+			return rewritten, freed, err
+		}
+		rewritten++
+		freed += n
+	}
+	return rewritten, freed, nil
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/persistence"
+)
+
+func TestPackBackendRepack(t *testing.T) {
+	dir := t.TempDir()
+	db, err := persistence.Open(filepath.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := New(db, bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packDir := filepath.Join(dir, "packs")
+	store.UseBackend(NewPackBackend(packDir, 4096, 0.5))
+	packFiles := func() int {
+		t.Helper()
+		entries, err := os.ReadDir(packDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	chunks := make(map[string][]byte)
+	var order []string
+	for i := 0; i < 60; i++ {
+		plain := bytes.Repeat([]byte(fmt.Sprintf("chunk %d ", i)), 20)
+		hash, err := store.PutChunk(plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks[hash] = plain
+		order = append(order, hash)
+	}
+	if n := packFiles(); n < 3 {
+		t.Fatalf("%d pack files after 60 chunks, want several", n)
+	}
+
+	// Leave one chunk in three, so every full pack is sparse
+	for i, hash := range order {
+		if i%3 == 0 {
+			continue
+		}
+		if err := store.Delete(hash); err != nil {
+			t.Fatal(err)
+		}
+		delete(chunks, hash)
+	}
+	before := packFiles()
+	rewritten, freed, err := store.Repack(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewritten == 0 || freed <= 0 {
+		t.Fatalf("Repack = %d packs, %d bytes, want some", rewritten, freed)
+	}
+	if after := packFiles(); after >= before {
+		t.Errorf("%d pack files after repack, %d before", after, before)
+	}
+	for hash, plain := range chunks {
+		got, err := store.GetChunk(hash)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("GetChunk(%s) after repack = %q, %v", hash, got, err)
+		}
+	}
+
+	for hash := range chunks {
+		if err := store.Delete(hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := packFiles(); n > 1 {
+		t.Errorf("%d pack files left once every chunk is deleted, want at most the current one", n)
+	}
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"fmt"
+
+	sverrors "github.com/hoangsonww/backupagent/internal/errors"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ReadOptions tunes ReadChunks.
+type ReadOptions struct {
+	Readahead int  // chunks read per transaction and advised one window ahead; 0 means 32
+	Prewarm   bool // advise the pages of every chunk before the first read
+}
+
+// ReadChunks calls fn with the decrypted content of each hash, in order. It
+// decrypts chunks of the blocks bucket straight from bbolt's mmap, so their
+// stored bytes are never copied, and
+// tells the OS which pages the next window of the plan will fault in. Each
+// window is its own read transaction, so a long restore does not hold up
+// writers that need to grow the file.
+func (s *Store) ReadChunks(hashes []string, opts ReadOptions, fn func(hash string, plaintext []byte) error) error {
+	window := opts.Readahead
+	if window <= 0 {
+		window = 32
+	}
+	if opts.Prewarm {
+		if err := s.advise(hashes); err != nil {
+			return err
+		}
+	}
+
+	plaintexts := make([][]byte, 0, window)
+	for start := 0; start < len(hashes); start += window {
+		end := min(start+window, len(hashes))
+		plaintexts = plaintexts[:0]
+		err := s.db.View(func(tx *bolt.Tx) error {
+			if !opts.Prewarm && end < len(hashes) {
+				s.locateAndAdvise(tx, hashes[end:min(end+window, len(hashes))])
+			}
+			for _, h := range hashes[start:end] {
+				stored, err := s.load(tx, h)
+				if err != nil {
+					return err
+				}
+				if stored == nil {
+					var ok bool
+					if stored, ok = s.stagedChunk(h); !ok {
+						return sverrors.NewChunkNotFoundError(h)
+					}
+				}
+				plaintext, err := OpenChunk(stored, s.baseKey)
+				if err != nil {
+					return fmt.Errorf("failed to decrypt chunk %s: %w", h, err)
+				}
+				plaintexts = append(plaintexts, plaintext)
+			}
+			return nil
+		})
+		if err != nil {
+			if sverrors.GetErrorCode(err) == "" {
+				err = sverrors.NewStorageIOError(err)
+			}
+			return err
+		}
+		for i, plaintext := range plaintexts {
+			if err := fn(hashes[start+i], plaintext); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// advise hints the OS to read the pages of hashes, in order
+func (s *Store) advise(hashes []string) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return s.locateAndAdvise(tx, hashes)
+	})
+}
+
+func (s *Store) locateAndAdvise(tx *bolt.Tx, hashes []string) error {
+	b := tx.Bucket([]byte(persistence.BucketBlocks))
+	spans := make([]persistence.Span, 0, len(hashes))
+	for _, h := range hashes {
+		if span, ok := persistence.Locate(tx, b.Get([]byte(h))); ok {
+			spans = append(spans, span)
+		}
+	}
+	return s.db.WillNeed(spans)
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/persistence"
+)
+
+func TestReadChunksInPlanOrder(t *testing.T) {
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := New(db, bytes.Repeat([]byte{3}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks [][]byte
+	for i := 0; i < 10; i++ {
+		chunks = append(chunks, []byte(fmt.Sprintf("chunk %d", i)))
+	}
+	hashes, err := store.PutChunks(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Repeats and a window size that does not divide the plan
+	plan := append(append([]string{}, hashes...), hashes[2], hashes[0])
+
+	for _, opts := range []ReadOptions{{Readahead: 3}, {Readahead: 4, Prewarm: true}} {
+		var got []string
+		err := store.ReadChunks(plan, opts, func(hash string, plaintext []byte) error {
+			got = append(got, string(plaintext))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(plan) || got[10] != "chunk 2" || got[11] != "chunk 0" || got[9] != "chunk 9" {
+			t.Errorf("%+v: read %q", opts, got)
+		}
+	}
+
+	if err := store.ReadChunks([]string{"nope"}, ReadOptions{}, func(string, []byte) error { return nil }); err == nil {
+		t.Error("missing chunk not reported")
+	}
+}
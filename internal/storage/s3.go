@@ -0,0 +1,345 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/chunkindex"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrObjectNotFound is returned for an object the bucket does not hold
+var ErrObjectNotFound = errors.New("object not found")
+
+// opTimeout bounds an attempt at a chunk request when S3Options sets no
+// Timeout, since the store makes them without a context of its own
+const opTimeout = time.Minute
+
+// S3Options says where S3Backend keeps its objects and how it reaches them.
+type S3Options struct {
+	// Endpoint is the base URL of the service, e.g.
+	// https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Endpoint string
+	// Region signs requests; us-east-1 if empty, which MinIO accepts
+	Region string
+	Bucket string
+	// Prefix is prepended to every object key, so several repositories can
+	// share a bucket
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// PathStyle addresses the bucket in the path, as MinIO expects, rather
+	// than in the host name
+	PathStyle bool
+	// MaxRetries is how often a request failing with a network error, a 5xx
+	// or a 429 is tried again
+	MaxRetries int
+	// RetryDelay is the wait before the first retry; it doubles each time
+	RetryDelay time.Duration
+	// Timeout bounds each attempt; 0 is none
+	Timeout time.Duration
+	// Client sends the requests; nil uses http.DefaultClient
+	Client *http.Client
+}
+
+// S3Backend keeps each chunk in an object of an S3-compatible bucket, such
+// as AWS S3 or MinIO, under <prefix>chunks/<first two hex digits>/<rest>.
+// Chunks are uploaded sealed, so the object store never sees plaintext.
+type S3Backend struct {
+	opts   S3Options
+	base   *url.URL
+	client *http.Client
+}
+
+// NewS3Backend returns the backend keeping chunks in the bucket opts names.
+// It does not contact the service.
+func NewS3Backend(opts S3Options) (*S3Backend, error) {
+	base, err := url.Parse(opts.Endpoint)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", opts.Endpoint)
+	}
+	if opts.Bucket == "" {
+		return nil, errors.New("no S3 bucket")
+	}
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	if opts.Prefix = strings.Trim(opts.Prefix, "/"); opts.Prefix != "" {
+		opts.Prefix += "/"
+	}
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &S3Backend{opts: opts, base: base, client: client}, nil
+}
+
+func (b *S3Backend) Name() string                  { return BackendS3 }
+func (b *S3Backend) Location() chunkindex.Location { return chunkindex.ObjectStore }
+
+// chunkKey is the object key of the chunk hash
+func (b *S3Backend) chunkKey(hash string) (string, error) {
+	if err := checkChunkName(hash); err != nil {
+		return "", err
+	}
+	return b.opts.Prefix + "chunks/" + hash[:2] + "/" + hash[2:], nil
+}
+
+// opContext bounds a chunk request: every attempt it makes, and the waits
+// between them
+func (b *S3Backend) opContext() (context.Context, context.CancelFunc) {
+	attempt := b.opts.Timeout
+	if attempt <= 0 {
+		attempt = opTimeout
+	}
+	total := time.Duration(b.opts.MaxRetries+1) * attempt
+	for i, delay := 0, b.opts.RetryDelay; i < b.opts.MaxRetries; i, delay = i+1, delay*2 {
+		total += delay
+	}
+	return context.WithTimeout(context.Background(), total)
+}
+
+func (b *S3Backend) Get(_ *bolt.Tx, hash string) ([]byte, error) {
+	key, err := b.chunkKey(hash)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := b.opContext()
+	defer cancel()
+	data, err := b.GetObject(ctx, key)
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Put uploads the chunk. The store calls it only to move chunks between
+// backends; new chunks are sent with Upload before their transaction.
+func (b *S3Backend) Put(_ *bolt.Tx, hash string, data []byte) error {
+	return b.Upload(hash, data)
+}
+
+// Upload uploads the chunk outside any transaction, for the store to index
+// afterwards.
+func (b *S3Backend) Upload(hash string, data []byte) error {
+	key, err := b.chunkKey(hash)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := b.opContext()
+	defer cancel()
+	return b.PutObject(ctx, key, data)
+}
+
+// Delete removes the chunk's object once tx commits, so a delete rolled
+// back keeps the chunk.
+func (b *S3Backend) Delete(tx *bolt.Tx, hash string) error {
+	key, err := b.chunkKey(hash)
+	if err != nil {
+		return err
+	}
+	tx.OnCommit(func() {
+		ctx, cancel := b.opContext()
+		defer cancel()
+		if err := b.DeleteObject(ctx, key); err != nil {
+			monitoring.GetLogger().WithError(err).WithField("chunk", hash).Warn("Failed to remove chunk object")
+		}
+	})
+	return nil
+}
+
+// PutSnapshot uploads the metadata record of a snapshot to
+// <prefix>snapshots/<id>.json, beside its chunks.
+func (b *S3Backend) PutSnapshot(ctx context.Context, id string, record []byte) error {
+	if id == "" || strings.ContainsAny(id, "/\\") {
+		return fmt.Errorf("invalid snapshot ID %q", id)
+	}
+	return b.PutObject(ctx, b.opts.Prefix+"snapshots/"+id+".json", record)
+}
+
+// GetObject returns the object key, or ErrObjectNotFound.
+func (b *S3Backend) GetObject(ctx context.Context, key string) ([]byte, error) {
+	return b.do(ctx, http.MethodGet, key, nil)
+}
+
+// PutObject stores data as the object key, replacing any before.
+func (b *S3Backend) PutObject(ctx context.Context, key string, data []byte) error {
+	_, err := b.do(ctx, http.MethodPut, key, data)
+	return err
+}
+
+// DeleteObject removes the object key; one already gone is not an error.
+func (b *S3Backend) DeleteObject(ctx context.Context, key string) error {
+	_, err := b.do(ctx, http.MethodDelete, key, nil)
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil
+	}
+	return err
+}
+
+// S3Error is an error response of the object store.
+type S3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 request failed: %s", http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("S3 request failed: %s: %s", e.Code, e.Message)
+}
+
+// transient reports whether err may not happen again: the request did not
+// reach the service, or the service was failing or throttling
+func transient(err error) bool {
+	var se *S3Error
+	if errors.As(err, &se) {
+		return se.Status >= 500 || se.Status == http.StatusTooManyRequests
+	}
+	return !errors.Is(err, ErrObjectNotFound)
+}
+
+// do sends a request for key, retrying transient failures as opts say, and
+// returns the response body
+func (b *S3Backend) do(ctx context.Context, method, key string, body []byte) ([]byte, error) {
+	delay := b.opts.RetryDelay
+	for attempt := 0; ; attempt++ {
+		data, err := b.send(ctx, method, key, body)
+		if err == nil || ctx.Err() != nil || !transient(err) || attempt >= b.opts.MaxRetries {
+			return data, err
+		}
+		monitoring.GetLogger().WithError(err).WithField("key", key).Debugf("Retrying S3 %s", method)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// send makes one attempt at a request
+func (b *S3Backend) send(ctx context.Context, method, key string, body []byte) ([]byte, error) {
+	if b.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.opts.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, b.objectURL(key).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	b.sign(req, body, time.Now())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	case resp.StatusCode/100 != 2:
+		se := &S3Error{Status: resp.StatusCode}
+		xml.Unmarshal(data, se)
+		return nil, se
+	}
+	return data, nil
+}
+
+// objectURL is the URL of key, with the bucket in the path or the host name
+func (b *S3Backend) objectURL(key string) *url.URL {
+	u := *b.base
+	dir := strings.TrimSuffix(u.Path, "/")
+	if b.opts.PathStyle {
+		u.Path = dir + "/" + b.opts.Bucket + "/" + key
+	} else {
+		u.Host = b.opts.Bucket + "." + u.Host
+		u.Path = dir + "/" + key
+	}
+	// Send the path escaped exactly as it is signed
+	u.RawPath = uriEncode(u.Path)
+	return &u
+}
+
+// sign adds AWS Signature Version 4 headers to req, which carries payload.
+// Without an access key the request goes unsigned, for a public bucket.
+func (b *S3Backend) sign(req *http.Request, payload []byte, now time.Time) {
+	sum := sha256.Sum256(payload)
+	payloadHash := hex.EncodeToString(sum[:])
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("x-amz-date", amzDate)
+	if b.opts.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", b.opts.SessionToken)
+	}
+	if b.opts.AccessKeyID == "" {
+		return
+	}
+
+	signed := "host;x-amz-content-sha256;x-amz-date"
+	headers := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	if b.opts.SessionToken != "" {
+		signed += ";x-amz-security-token"
+		headers += "x-amz-security-token:" + b.opts.SessionToken + "\n"
+	}
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers, signed, payloadHash}, "\n")
+	canonicalSum := sha256.Sum256([]byte(canonical))
+
+	day := amzDate[:8]
+	scope := day + "/" + b.opts.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+	key := hmacSHA256([]byte("AWS4"+b.opts.SecretAccessKey), day)
+	key = hmacSHA256(key, b.opts.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+b.opts.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode escapes p the way Signature Version 4 expects: everything but
+// unreserved characters and slashes
+func uriEncode(p string) string {
+	var sb strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
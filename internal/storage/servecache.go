@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+)
+
+const (
+	// serveAdmitRequests is how often a chunk must be asked for before it
+	// is cached; most chunks are fetched once and would only evict others
+	serveAdmitRequests = 2
+	// serveEntryShare makes chunks larger than 1/serveEntryShare of the
+	// cache too big to cache
+	serveEntryShare = 16
+	// serveTypicalChunk sizes the request history kept for admission
+	serveTypicalChunk = 64 << 10
+	// serveMinHistory and serveMaxHistory bound the requests counted before
+	// the counts are halved, so chunks that were popular long ago fade
+	serveMinHistory = 1 << 10
+	serveMaxHistory = 1 << 20
+)
+
+// ServeCacheStats describe the hot-chunk cache.
+type ServeCacheStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// HitRate is the share of requests served from memory.
+func (s ServeCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// serveCache keeps the stored form of chunks peers ask for often in
+// memory, so a node many peers fetch from does not read the same chunks
+// from the database for each of them. A chunk is admitted once it has been
+// asked for serveAdmitRequests times, and only in place of chunks asked for
+// no more often than it; the least recently served of those go first.
+type serveCache struct {
+	max      int64
+	maxEntry int64 // larger chunks are never cached
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // of *serveEntry
+	lru     *list.List               // most recently served first
+	size    int64
+	freq    map[string]int // requests per chunk, halved every history requests
+	counted int
+	history int
+	gen     uint64 // bumped whenever a chunk is forgotten
+	stats   ServeCacheStats
+}
+
+type serveEntry struct {
+	hash string
+	data []byte
+}
+
+func newServeCache(limit int64) *serveCache {
+	history := int(limit/serveTypicalChunk) * 8
+	history = min(max(history, serveMinHistory), serveMaxHistory)
+	return &serveCache{
+		max:      limit,
+		maxEntry: limit / serveEntryShare,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		freq:     make(map[string]int),
+		history:  history,
+	}
+}
+
+// get returns a cached chunk, counting the request either way. gen is to be
+// passed to offer the chunk once read.
+func (c *serveCache) get(hash string) (data []byte, gen uint64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.count(hash)
+	if el, ok := c.entries[hash]; ok {
+		c.lru.MoveToFront(el)
+		c.stats.Hits++
+		monitoring.GetMetrics().ServeCacheHits.Add(1)
+		return el.Value.(*serveEntry).data, c.gen, true
+	}
+	c.stats.Misses++
+	monitoring.GetMetrics().ServeCacheMisses.Add(1)
+	return nil, c.gen, false
+}
+
+// count records a request for hash, aging the history when it is full
+func (c *serveCache) count(hash string) {
+	c.freq[hash]++
+	c.counted++
+	if c.counted < c.history {
+		return
+	}
+	c.counted = 0
+	for h, n := range c.freq {
+		if n /= 2; n == 0 {
+			delete(c.freq, h)
+		} else {
+			c.freq[h] = n
+		}
+	}
+}
+
+// offer caches a chunk just read from the database if it is asked for often
+// enough and small enough. It is dropped when a chunk was forgotten since
+// gen, as it may be that one.
+func (c *serveCache) offer(hash string, data []byte, gen uint64) {
+	size := int64(len(data))
+	if size > c.maxEntry {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	want := c.freq[hash]
+	if gen != c.gen || want < serveAdmitRequests {
+		return
+	}
+	if _, ok := c.entries[hash]; ok {
+		return
+	}
+	// Make room from the least recently served, unless that would evict a
+	// chunk in more demand
+	var victims []*list.Element
+	free := c.max - c.size
+	for el := c.lru.Back(); free < size; el = el.Prev() {
+		if el == nil {
+			return
+		}
+		e := el.Value.(*serveEntry)
+		if c.freq[e.hash] > want {
+			return
+		}
+		victims = append(victims, el)
+		free += int64(len(e.data))
+	}
+	for _, el := range victims {
+		c.remove(el)
+	}
+	c.entries[hash] = c.lru.PushFront(&serveEntry{hash: hash, data: data})
+	c.size += size
+	c.track()
+}
+
+// forget drops a chunk that was deleted or replaced
+func (c *serveCache) forget(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if el, ok := c.entries[hash]; ok {
+		c.remove(el)
+		c.track()
+	}
+}
+
+func (c *serveCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*serveEntry)
+	delete(c.entries, e.hash)
+	c.size -= int64(len(e.data))
+}
+
+// track publishes the size of the cache
+func (c *serveCache) track() {
+	monitoring.GetMetrics().ServeCacheBytes.Store(c.size)
+}
+
+func (c *serveCache) snapshot() ServeCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = len(c.entries)
+	s.Bytes = c.size
+	return s
+}
+
+// EnableServeCache keeps the chunks peers ask for most in up to limit
+// bytes of memory; 0 disables it. It must be called before the store is
+// shared.
+func (s *Store) EnableServeCache(limit int64) {
+	if limit <= 0 {
+		s.serving = nil
+		return
+	}
+	s.serving = newServeCache(limit)
+}
+
+// Serve returns the stored form of a chunk to send to a peer, from memory
+// when it is in demand. The data is shared and must not be modified. It
+// fails like Get.
+func (s *Store) Serve(hash string) ([]byte, error) {
+	if s.serving == nil {
+		return s.Get(hash)
+	}
+	data, gen, ok := s.serving.get(hash)
+	if ok {
+		return data, nil
+	}
+	data, err := s.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	s.serving.offer(hash, data, gen)
+	return data, nil
+}
+
+// ServeCacheStats describes the hot-chunk cache, zero when it is disabled.
+func (s *Store) ServeCacheStats() ServeCacheStats {
+	if s.serving == nil {
+		return ServeCacheStats{}
+	}
+	return s.serving.snapshot()
+}
+
+// unserve drops a chunk from the hot-chunk cache
+func (s *Store) unserve(hash string) {
+	if s.serving != nil {
+		s.serving.forget(hash)
+	}
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/persistence"
+)
+
+func TestServeCache(t *testing.T) {
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := New(db, bytes.Repeat([]byte{5}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes []string
+	for i := 0; i < 4; i++ {
+		h, err := store.PutChunk(bytes.Repeat([]byte(fmt.Sprint(i)), 1000))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, h)
+	}
+	stored, _ := store.Get(hashes[0])
+	// Room for two chunks
+	store.EnableServeCache(int64(len(stored)) * 2)
+	store.serving.maxEntry = int64(len(stored))
+
+	serve := func(h string) {
+		t.Helper()
+		data, err := store.Serve(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, _ := store.Get(h); !bytes.Equal(data, want) {
+			t.Fatalf("served %s wrong", h)
+		}
+	}
+
+	// A chunk asked for once is not cached; the second request admits it
+	serve(hashes[0])
+	if st := store.ServeCacheStats(); st.Entries != 0 || st.Misses != 1 {
+		t.Fatalf("after one request: %+v", st)
+	}
+	serve(hashes[0])
+	serve(hashes[0])
+	if st := store.ServeCacheStats(); st.Entries != 1 || st.Hits != 1 || st.Misses != 2 {
+		t.Fatalf("after three requests: %+v", st)
+	}
+
+	// A chunk in less demand does not evict one in more
+	serve(hashes[1])
+	serve(hashes[1])
+	serve(hashes[2])
+	serve(hashes[2])
+	if st := store.ServeCacheStats(); st.Entries != 2 || st.Bytes > store.serving.max {
+		t.Fatalf("over budget: %+v", st)
+	}
+	if _, ok := store.serving.entries[hashes[0]]; !ok {
+		t.Fatal("hottest chunk evicted")
+	}
+
+	// Deleted chunks are no longer served
+	if err := store.Delete(hashes[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Serve(hashes[0]); err == nil {
+		t.Fatal("deleted chunk served")
+	}
+	if st := store.ServeCacheStats(); st.HitRate() <= 0 || st.HitRate() >= 1 {
+		t.Fatalf("hit rate %v", st.HitRate())
+	}
+
+	// Chunks too big for the cache are never kept
+	store.EnableServeCache(int64(len(stored)) * 2)
+	for i := 0; i < 3; i++ {
+		serve(hashes[3])
+	}
+	if st := store.ServeCacheStats(); st.Entries != 0 || st.Misses != 3 {
+		t.Fatalf("oversize chunk: %+v", st)
+	}
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/chunkindex"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/sftp"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPOptions says where SFTPBackend keeps its files and how it reaches
+// them.
+type SFTPOptions struct {
+	Addr   string // host:port of the SSH server
+	Dir    string // remote directory holding the chunks
+	Config *ssh.ClientConfig
+	// MaxConns is how many connections are kept open for transfers at once
+	MaxConns int
+	// MaxRetries is how often a transfer whose connection failed is tried
+	// again on another; an upload resumes where it stopped
+	MaxRetries int
+	// RetryDelay is the wait before the first retry; it doubles each time
+	RetryDelay time.Duration
+}
+
+// SFTPBackend keeps each chunk in a file on an SSH server, laid out as
+// FileBackend lays them out locally. Uploads go to a partial file renamed
+// into place when complete. Connections are pooled, and one that fails
+// mid-transfer is replaced.
+type SFTPBackend struct {
+	opts  SFTPOptions
+	idle  chan *sftp.Client
+	slots chan struct{} // one per open connection
+	dirs  sync.Map      // directories known to exist
+}
+
+// NewSFTPBackend returns the backend keeping chunks under opts.Dir. It
+// connects on first use.
+func NewSFTPBackend(opts SFTPOptions) *SFTPBackend {
+	if opts.MaxConns < 1 {
+		opts.MaxConns = 1
+	}
+	return &SFTPBackend{
+		opts:  opts,
+		idle:  make(chan *sftp.Client, opts.MaxConns),
+		slots: make(chan struct{}, opts.MaxConns),
+	}
+}
+
+func (b *SFTPBackend) Name() string                  { return BackendSFTP }
+func (b *SFTPBackend) Location() chunkindex.Location { return chunkindex.SFTP }
+
+// path is the remote path of the chunk hash
+func (b *SFTPBackend) path(hash string) (string, error) {
+	if err := checkChunkName(hash); err != nil {
+		return "", err
+	}
+	return path.Join(b.opts.Dir, "chunks", hash[:2], hash[2:]), nil
+}
+
+func (b *SFTPBackend) Get(_ *bolt.Tx, hash string) ([]byte, error) {
+	p, err := b.path(hash)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	err = b.with(func(c *sftp.Client) error {
+		data, err = c.ReadFile(p)
+		return err
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Put uploads the chunk to a partial file named after its content and
+// renames it into place. A retry after a failed connection resumes the
+// partial file where the server has it end.
+func (b *SFTPBackend) Put(_ *bolt.Tx, hash string, data []byte) error {
+	p, err := b.path(hash)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	part := p + "." + hex.EncodeToString(sum[:6]) + ".part"
+	return b.with(func(c *sftp.Client) error {
+		if err := b.mkdirAll(c, path.Dir(p)); err != nil {
+			return err
+		}
+		off, err := c.Stat(part)
+		if errors.Is(err, fs.ErrNotExist) || off > int64(len(data)) {
+			off = 0
+		} else if err != nil {
+			return err
+		}
+		flags := uint32(sftp.Write | sftp.Create)
+		if off == 0 {
+			flags |= sftp.Trunc
+		}
+		f, err := c.Open(part, flags)
+		if err != nil {
+			return err
+		}
+		if err := f.WriteAt(data[off:], off); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return c.Rename(part, p)
+	})
+}
+
+// Delete removes the chunk's file once tx commits, so a delete rolled back
+// keeps the chunk.
+func (b *SFTPBackend) Delete(tx *bolt.Tx, hash string) error {
+	p, err := b.path(hash)
+	if err != nil {
+		return err
+	}
+	tx.OnCommit(func() {
+		err := b.with(func(c *sftp.Client) error { return c.Remove(p) })
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			monitoring.GetLogger().WithError(err).WithField("chunk", hash).Warn("Failed to remove remote chunk file")
+		}
+	})
+	return nil
+}
+
+// mkdirAll creates the remote directory dir unless it is known to exist
+func (b *SFTPBackend) mkdirAll(c *sftp.Client, dir string) error {
+	if _, ok := b.dirs.Load(dir); ok {
+		return nil
+	}
+	if err := c.MkdirAll(dir); err != nil {
+		return err
+	}
+	b.dirs.Store(dir, true)
+	return nil
+}
+
+// with runs fn on a pooled connection. When the connection fails rather
+// than the server refusing the request, it is dropped and fn tried again
+// on another, as opts say.
+func (b *SFTPBackend) with(fn func(*sftp.Client) error) error {
+	delay := b.opts.RetryDelay
+	for attempt := 0; ; attempt++ {
+		c, err := b.get()
+		if err == nil {
+			err = fn(c)
+			b.release(c, err)
+		}
+		var se *sftp.StatusError
+		if err == nil || errors.As(err, &se) || errors.Is(err, ErrBadChunkName) || attempt >= b.opts.MaxRetries {
+			return err
+		}
+		monitoring.GetLogger().WithError(err).WithField("server", b.opts.Addr).Debug("Retrying SFTP transfer on a new connection")
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// get returns an idle connection, or opens one if fewer than MaxConns are
+// open, or waits for one to be released
+func (b *SFTPBackend) get() (*sftp.Client, error) {
+	select {
+	case c := <-b.idle:
+		return c, nil
+	default:
+	}
+	select {
+	case c := <-b.idle:
+		return c, nil
+	case b.slots <- struct{}{}:
+		c, err := sftp.Dial(b.opts.Addr, b.opts.Config)
+		if err != nil {
+			<-b.slots
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+// release returns c to the pool, or closes it if err shows the connection
+// broke
+func (b *SFTPBackend) release(c *sftp.Client, err error) {
+	var se *sftp.StatusError
+	if err != nil && !errors.As(err, &se) {
+		c.Close()
+		<-b.slots
+		return
+	}
+	b.idle <- c
+}
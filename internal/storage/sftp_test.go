@@ -0,0 +1,415 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeSFTP is an SSH server whose sftp subsystem serves the files under
+// root, speaking as much of version 3 as the client uses. It records the
+// offset of every write and can drop a connection after a write, as a
+// flaky link would.
+type fakeSFTP struct {
+	root string
+	ln   net.Listener
+
+	mu        sync.Mutex
+	conns     []*ssh.ServerConn
+	dials     int
+	writes    []int64 // offsets written, in order
+	dropAfter int     // writes before the connection is dropped; 0 never
+}
+
+func newFakeSFTP(t *testing.T) (*fakeSFTP, *ssh.ClientConfig) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() != "backup" || string(pass) != "secret" {
+				return nil, errors.New("denied")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSFTP{root: t.TempDir(), ln: ln}
+	t.Cleanup(func() {
+		ln.Close()
+		f.drop()
+	})
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serveConn(nc, config)
+		}
+	}()
+	return f, &ssh.ClientConfig{
+		User:            "backup",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.FixedHostKey(signer.PublicKey()),
+		Timeout:         5 * time.Second,
+	}
+}
+
+// drop closes every open connection
+func (f *fakeSFTP) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.conns {
+		c.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeSFTP) serveConn(nc net.Conn, config *ssh.ServerConfig) {
+	conn, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	f.mu.Lock()
+	f.conns = append(f.conns, conn)
+	f.dials++
+	f.mu.Unlock()
+	go ssh.DiscardRequests(reqs)
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "sessions only")
+			continue
+		}
+		ch, reqs, err := nch.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range reqs {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go f.serveSFTP(conn, ch)
+				}
+			}
+		}()
+	}
+}
+
+// serveSFTP answers the requests of one session
+func (f *fakeSFTP) serveSFTP(conn *ssh.ServerConn, ch ssh.Channel) {
+	defer ch.Close()
+	handles := make(map[string]*os.File)
+	defer func() {
+		for _, h := range handles {
+			h.Close()
+		}
+	}()
+	for {
+		var n [4]byte
+		if _, err := io.ReadFull(ch, n[:]); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(n[:]))
+		if _, err := io.ReadFull(ch, body); err != nil {
+			return
+		}
+		typ, in := body[0], fakeReader(body[1:])
+		if typ == 1 { // init
+			var out fakePacket
+			out.byte(2)
+			out.uint32(3)
+			out.string("posix-rename@openssh.com")
+			out.string("1")
+			out.send(ch)
+			continue
+		}
+		id := in.uint32()
+		var out fakePacket
+		status := func(err error) {
+			code, msg := uint32(0), ""
+			switch {
+			case errors.Is(err, io.EOF):
+				code, msg = 1, "EOF"
+			case errors.Is(err, os.ErrNotExist):
+				code, msg = 2, err.Error()
+			case err != nil:
+				code, msg = 4, err.Error()
+			}
+			out.byte(101)
+			out.uint32(id)
+			out.uint32(code)
+			out.string(msg)
+			out.string("")
+		}
+		switch typ {
+		case 3: // open
+			p, flags := f.path(in.string()), in.uint32()
+			mode := os.O_RDONLY
+			if flags&0x02 != 0 {
+				mode = os.O_WRONLY
+				if flags&0x01 != 0 {
+					mode = os.O_RDWR
+				}
+			}
+			if flags&0x08 != 0 {
+				mode |= os.O_CREATE
+			}
+			if flags&0x10 != 0 {
+				mode |= os.O_TRUNC
+			}
+			h, err := os.OpenFile(p, mode, 0600)
+			if err != nil {
+				status(err)
+				break
+			}
+			handle := hex.EncodeToString([]byte(p))
+			handles[handle] = h
+			out.byte(102)
+			out.uint32(id)
+			out.string(handle)
+		case 4: // close
+			handle := in.string()
+			err := handles[handle].Close()
+			delete(handles, handle)
+			status(err)
+		case 5: // read
+			h, off, size := handles[in.string()], in.uint64(), in.uint32()
+			data := make([]byte, size)
+			n, err := h.ReadAt(data, int64(off))
+			if n == 0 {
+				status(err)
+				break
+			}
+			out.byte(103)
+			out.uint32(id)
+			out.string(string(data[:n]))
+		case 6: // write
+			h, off, data := handles[in.string()], in.uint64(), in.string()
+			_, err := h.WriteAt([]byte(data), int64(off))
+			f.mu.Lock()
+			f.writes = append(f.writes, int64(off))
+			drop := false
+			if f.dropAfter > 0 {
+				f.dropAfter--
+				drop = f.dropAfter == 0
+			}
+			f.mu.Unlock()
+			if drop {
+				conn.Close()
+				return
+			}
+			status(err)
+		case 13: // remove
+			status(os.Remove(f.path(in.string())))
+		case 14: // mkdir
+			status(os.Mkdir(f.path(in.string()), 0700))
+		case 17: // stat
+			fi, err := os.Stat(f.path(in.string()))
+			if err != nil {
+				status(err)
+				break
+			}
+			out.byte(105)
+			out.uint32(id)
+			out.uint32(0x1)
+			out.uint64(uint64(fi.Size()))
+		case 18: // rename
+			oldpath, newpath := f.path(in.string()), f.path(in.string())
+			status(os.Rename(oldpath, newpath))
+		case 200: // extended
+			if in.string() != "posix-rename@openssh.com" {
+				status(errors.New("unsupported extension"))
+				break
+			}
+			oldpath, newpath := f.path(in.string()), f.path(in.string())
+			status(os.Rename(oldpath, newpath))
+		default:
+			status(errors.New("unsupported request"))
+		}
+		out.send(ch)
+	}
+}
+
+func (f *fakeSFTP) path(p string) string {
+	return filepath.Join(f.root, filepath.FromSlash(path.Clean("/"+p)))
+}
+
+type fakePacket []byte
+
+func (p *fakePacket) byte(b byte)     { *p = append(*p, b) }
+func (p *fakePacket) uint32(v uint32) { *p = binary.BigEndian.AppendUint32(*p, v) }
+func (p *fakePacket) uint64(v uint64) { *p = binary.BigEndian.AppendUint64(*p, v) }
+func (p *fakePacket) string(s string) {
+	p.uint32(uint32(len(s)))
+	*p = append(*p, s...)
+}
+
+func (p fakePacket) send(w io.Writer) {
+	w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(p))))
+	w.Write(p)
+}
+
+type fakeReader []byte
+
+func (r *fakeReader) uint32() uint32 {
+	v := binary.BigEndian.Uint32(*r)
+	*r = (*r)[4:]
+	return v
+}
+
+func (r *fakeReader) uint64() uint64 {
+	v := binary.BigEndian.Uint64(*r)
+	*r = (*r)[8:]
+	return v
+}
+
+func (r *fakeReader) string() string {
+	n := r.uint32()
+	s := string((*r)[:n])
+	*r = (*r)[n:]
+	return s
+}
+
+func TestSFTPBackend(t *testing.T) {
+	fake, config := newFakeSFTP(t)
+	b := NewSFTPBackend(SFTPOptions{
+		Addr:       fake.ln.Addr().String(),
+		Dir:        "/backups",
+		Config:     config,
+		MaxConns:   1,
+		MaxRetries: 3,
+		RetryDelay: time.Millisecond,
+	})
+	chunk := func(seed byte, size int) (string, []byte) {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = seed + byte(i*7)
+		}
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:]), data
+	}
+	stored := func(hash string) []byte {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(fake.root, "backups", "chunks", hash[:2], hash[2:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	writesFrom := func() []int64 {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		w := fake.writes
+		fake.writes = nil
+		return w
+	}
+
+	// Put, then Get
+	hash, data := chunk(1, 1000)
+	if err := b.Put(nil, hash, data); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored(hash), data) {
+		t.Error("stored file differs from the chunk")
+	}
+	if got, err := b.Get(nil, hash); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Get = %d bytes, %v; want the %d put", len(got), err, len(data))
+	}
+	if got, err := b.Get(nil, hex.EncodeToString(make([]byte, 32))); got != nil || err != nil {
+		t.Errorf("Get of a missing chunk = %q, %v; want nil, nil", got, err)
+	}
+
+	// A partial file left by an earlier attempt is resumed where it ends
+	hash, data = chunk(2, 100*1024)
+	sum := sha256.Sum256(data)
+	part := filepath.Join(fake.root, "backups", "chunks", hash[:2], hash[2:]+"."+hex.EncodeToString(sum[:6])+".part")
+	if err := os.MkdirAll(filepath.Dir(part), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(part, data[:40000], 0600); err != nil {
+		t.Fatal(err)
+	}
+	writesFrom()
+	if err := b.Put(nil, hash, data); err != nil {
+		t.Fatal(err)
+	}
+	if w := writesFrom(); len(w) == 0 || w[0] != 40000 {
+		t.Errorf("writes at %v, want the first at 40000", w)
+	}
+	if !bytes.Equal(stored(hash), data) {
+		t.Error("resumed file differs from the chunk")
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Errorf("partial file left after the upload: %v", err)
+	}
+
+	// A connection dropped mid-upload is replaced and the upload resumed
+	fake.mu.Lock()
+	fake.dropAfter = 1
+	dials := fake.dials
+	fake.mu.Unlock()
+	hash, data = chunk(3, 100*1024)
+	if err := b.Put(nil, hash, data); err != nil {
+		t.Fatal(err)
+	}
+	if w := writesFrom(); len(w) < 2 || w[0] != 0 || w[1] != 32*1024 {
+		t.Errorf("writes at %v, want 0 then a resume at %d", w, 32*1024)
+	}
+	if !bytes.Equal(stored(hash), data) {
+		t.Error("file uploaded across connections differs from the chunk")
+	}
+
+	// A pooled connection the server closed is replaced
+	fake.drop()
+	if got, err := b.Get(nil, hash); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Get after a dropped connection = %d bytes, %v", len(got), err)
+	}
+	fake.mu.Lock()
+	if fake.dials != dials+2 {
+		t.Errorf("%d connections opened, want 2 after the drops", fake.dials-dials)
+	}
+	fake.mu.Unlock()
+
+	// Delete removes the file once the transaction commits
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error { return b.Delete(tx, hash) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(fake.root, "backups", "chunks", hash[:2], hash[2:])); !os.IsNotExist(err) {
+		t.Errorf("chunk file kept after Delete: %v", err)
+	}
+}
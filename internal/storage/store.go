@@ -3,122 +3,324 @@ package storage
 import (
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 
+	"github.com/hoangsonww/backupagent/internal/chunkindex"
+	"github.com/hoangsonww/backupagent/internal/compression"
 	"github.com/hoangsonww/backupagent/internal/crypto"
+	sverrors "github.com/hoangsonww/backupagent/internal/errors"
 	"github.com/hoangsonww/backupagent/internal/persistence"
 	bolt "go.etcd.io/bbolt"
 )
 
+// ErrHashMismatch means a chunk decrypted to content with a different hash.
+// It is wrapped in a CHUNK_INVALID error.
+var ErrHashMismatch = errors.New("chunk content does not match its hash")
+
 type Store struct {
-	db      *persistence.DB
-	baseKey []byte // master encryption key
-	mu      sync.Mutex
+	db       *persistence.DB
+	baseKey  []byte // master encryption key
+	mu       sync.Mutex
+	backend  Backend                         // where new chunks are stored
+	backends map[chunkindex.Location]Backend // every backend chunks are read from
+	wal      *wal                            // nil unless ingest is staged in a write-ahead log
+	policy   atomic.Pointer[compression.Policy]
+	faults   Faults      // nil outside fault-injection tests
+	serving  *serveCache // nil unless chunks in demand are served from memory
+	lock     repoLock    // between writes and garbage collection sweeps
 }
 
 func New(db *persistence.DB, masterKey []byte) (*Store, error) {
 	if len(masterKey) != 32 {
 		return nil, errors.New("master key must be 32 bytes")
 	}
-	return &Store{
-		db:      db,
-		baseKey: masterKey,
-	}, nil
+	// Repositories from before the dedup index get it built once
+	if _, err := chunkindex.Build(db); err != nil {
+		return nil, fmt.Errorf("failed to build chunk index: %w", err)
+	}
+	s := &Store{
+		db:       db,
+		baseKey:  masterKey,
+		backends: make(map[chunkindex.Location]Backend),
+	}
+	s.UseBackend(blocksBackend{})
+	return s, nil
 }
 
-// PutChunk stores deduped encrypted chunk. Returns its hash.
+// PutChunk stores deduped encrypted chunk, compressed first as the policy of
+// SetCompression says, and returns its hash. GetChunk undoes both.
 func (s *Store) PutChunk(plaintext []byte) (string, error) {
-	hash := crypto.Hash(plaintext)
-	hashStr := hex.EncodeToString(hash)
+	hashes, err := s.PutChunks([][]byte{plaintext})
+	if err != nil {
+		return "", err
+	}
+	return hashes[0], nil
+}
+
+// PutChunks stores several deduped encrypted chunks in one transaction, which
+// is much cheaper than one commit per chunk when ingesting a large tree. The
+// content type of each chunk is detected from its own bytes.
+func (s *Store) PutChunks(plaintexts [][]byte) ([]string, error) {
+	hashes, _, err := s.PutChunksOf(compression.Unknown, plaintexts)
+	return hashes, err
+}
+
+// PutChunksOf is PutChunks for chunks of a file whose content type, detected
+// from its start, is kind. It also returns the plaintext bytes of the chunks
+// that were new, the others being deduplicated.
+func (s *Store) PutChunksOf(kind compression.Kind, plaintexts [][]byte) ([]string, int64, error) {
+	if s.wal != nil {
+		return s.stageChunks(plaintexts, kind)
+	}
+	hashes := make([]string, len(plaintexts))
+	for i, plaintext := range plaintexts {
+		hashes[i] = chunkHash(plaintext)
+	}
+	var fresh int64
+	wrote := false
+
+	// A backend across the network is sent the new chunks first
+	var sealed map[string][]byte
+	var sent map[string]bool
+	if _, ok := s.backend.(uploader); ok {
+		recs, err := s.sealMissing(kind, hashes, plaintexts)
+		if err != nil {
+			return nil, 0, err
+		}
+		if sent, err = s.preupload(recs); err != nil {
+			return nil, 0, err
+		}
+		sealed = make(map[string][]byte, len(recs))
+		for _, r := range recs {
+			sealed[r.hash] = r.data
+		}
+	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	err := s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(persistence.BucketBlocks))
-		if b.Get([]byte(hashStr)) != nil {
-			// Already exists (dedup)
-			return nil
-		}
-		enc, nonce, err := crypto.Encrypt(plaintext, s.baseKey)
-		if err != nil {
-			return err
+		for i, plaintext := range plaintexts {
+			hashStr := hashes[i]
+			if chunkindex.Stored(tx, hashStr) {
+				// Already exists (dedup)
+				continue
+			}
+			stored, ok := sealed[hashStr]
+			if !ok {
+				var err error
+				if stored, err = s.sealChunk(plaintext, kind); err != nil {
+					return err
+				}
+				stored = s.corrupt(hashStr, stored)
+			}
+			if err := s.put(tx, hashStr, stored, sent); err != nil {
+				return err
+			}
+			fresh += int64(len(plaintext))
+			if !wrote {
+				wrote = true
+				if err := s.interrupt(); err != nil {
+					return err
+				}
+			}
 		}
-		// Store as nonce || ciphertext
-		stored := append(nonce, enc...)
-		return b.Put([]byte(hashStr), stored)
+		return s.flush()
 	})
 	if err != nil {
-		return "", err
+		return nil, 0, err
 	}
-	return hashStr, nil
+	return hashes, fresh, nil
 }
 
-// GetChunk returns decrypted chunk by hash string
-func (s *Store) GetChunk(hashStr string) ([]byte, error) {
-	var stored []byte
+// sealMissing seals the chunks of plaintexts, whose hashes are hashes, that
+// are not stored yet
+func (s *Store) sealMissing(kind compression.Kind, hashes []string, plaintexts [][]byte) ([]walRecord, error) {
+	var need []int
 	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(persistence.BucketBlocks))
-		v := b.Get([]byte(hashStr))
-		if v == nil {
-			return errors.New("chunk not found")
+		for i, h := range hashes {
+			if !chunkindex.Stored(tx, h) {
+				need = append(need, i)
+			}
 		}
-		stored = append([]byte(nil), v...)
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	// assume nonce size 12 for GCM
-	if len(stored) < 12 {
-		return nil, errors.New("stored chunk malformed")
+	recs := make([]walRecord, 0, len(need))
+	seen := make(map[string]bool, len(need))
+	for _, i := range need {
+		if seen[hashes[i]] {
+			continue
+		}
+		seen[hashes[i]] = true
+		stored, err := s.sealChunk(plaintexts[i], kind)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, walRecord{hash: hashes[i], data: s.corrupt(hashes[i], stored)})
+	}
+	return recs, nil
+}
+
+// GetChunk returns decrypted chunk by hash string, failing with the codes of
+// Get and decrypt
+func (s *Store) GetChunk(hashStr string) ([]byte, error) {
+	stored, err := s.Get(hashStr)
+	if err != nil {
+		return nil, err
+	}
+	return OpenChunk(stored, s.baseKey)
+}
+
+// Open decrypts chunk data in its stored form, e.g. as returned by a peer,
+// and checks the plaintext against hashStr.
+func (s *Store) Open(hashStr string, stored []byte) ([]byte, error) {
+	plaintext, err := OpenChunk(stored, s.baseKey)
+	if err != nil {
+		return nil, err
+	}
+	if chunkHash(plaintext) != hashStr {
+		return nil, sverrors.WrapError(sverrors.ErrCodeChunkInvalid, "chunk "+hashStr, ErrHashMismatch)
+	}
+	return plaintext, nil
+}
+
+func chunkHash(plaintext []byte) string {
+	return hex.EncodeToString(crypto.Hash(plaintext))
+}
+
+// Seal encrypts data under the repository key into the stored form of a
+// chunk, nonce || ciphertext.
+func (s *Store) Seal(plaintext []byte) ([]byte, error) {
+	enc, nonce, err := crypto.Encrypt(plaintext, s.baseKey)
+	if err != nil {
+		return nil, err
 	}
-	nonce := stored[:12]
-	ciphertext := stored[12:]
-	return crypto.Decrypt(ciphertext, s.baseKey, nonce)
+	return append(nonce, enc...), nil
 }
 
-// Get retrieves encrypted chunk data by hash (for P2P transfer)
+// Unseal decrypts data sealed by Seal.
+func (s *Store) Unseal(sealed []byte) ([]byte, error) {
+	return s.decrypt(sealed)
+}
+
+// decrypt opens data sealed by Seal. Failures are CHUNK_INVALID for data too
+// short to be sealed and DECRYPTION_FAILED otherwise.
+func (s *Store) decrypt(sealed []byte) ([]byte, error) {
+	if len(sealed) < nonceSize {
+		return nil, sverrors.NewError(sverrors.ErrCodeChunkInvalid, "stored chunk malformed")
+	}
+	plaintext, err := crypto.Decrypt(sealed[nonceSize:], s.baseKey, sealed[:nonceSize])
+	if err != nil {
+		return nil, sverrors.NewDecryptionFailedError(err)
+	}
+	return plaintext, nil
+}
+
+// Get retrieves encrypted chunk data by hash (for P2P transfer). A chunk not
+// stored is a CHUNK_NOT_FOUND error; failing to read the database is
+// STORAGE_IO.
 func (s *Store) Get(hashStr string) ([]byte, error) {
+	if data, ok := s.stagedChunk(hashStr); ok {
+		return data, nil
+	}
 	var stored []byte
 	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(persistence.BucketBlocks))
-		v := b.Get([]byte(hashStr))
+		v, err := s.load(tx, hashStr)
+		if err != nil {
+			return err
+		}
 		if v == nil {
-			return errors.New("chunk not found")
+			return sverrors.NewChunkNotFoundError(hashStr)
 		}
 		stored = append([]byte(nil), v...)
 		return nil
 	})
+	if err != nil && sverrors.GetErrorCode(err) == "" {
+		err = sverrors.NewStorageIOError(err)
+	}
 	return stored, err
 }
 
 // Put stores encrypted chunk data directly (for P2P received chunks)
 func (s *Store) Put(hashStr string, data []byte) error {
+	data = s.corrupt(hashStr, data)
+	s.unserve(hashStr)
+	sent, err := s.preupload([]walRecord{{hash: hashStr, data: data}})
+	if err != nil {
+		return err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	return s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(persistence.BucketBlocks))
-		return b.Put([]byte(hashStr), data)
+		if err := s.put(tx, hashStr, data, sent); err != nil {
+			return err
+		}
+		if err := s.interrupt(); err != nil {
+			return err
+		}
+		return s.flush()
 	})
 }
 
 // Delete removes a chunk from storage
 func (s *Store) Delete(hashStr string) error {
+	if err := s.flushStaged(); err != nil {
+		return err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	return s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(persistence.BucketBlocks))
-		return b.Delete([]byte(hashStr))
+		return s.deleteLocked(tx, hashStr)
 	})
 }
 
+// DeleteUnreferenced removes a chunk only if no snapshot references it,
+// checked in the same transaction. Returns whether it was removed.
+func (s *Store) DeleteUnreferenced(hashStr string) (bool, error) {
+	if err := s.flushStaged(); err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		e, ok := chunkindex.Get(tx, hashStr)
+		if !ok || e.Refs > 0 || !e.Stored() {
+			return nil
+		}
+		deleted = true
+		return s.deleteLocked(tx, hashStr)
+	})
+	return deleted, err
+}
+
+func (s *Store) deleteLocked(tx *bolt.Tx, hashStr string) error {
+	s.unserve(hashStr)
+	if e, ok := chunkindex.Get(tx, hashStr); ok && e.Stored() {
+		if err := s.drop(tx, hashStr, e.Location); err != nil {
+			return err
+		}
+	}
+	return chunkindex.Unstore(tx, hashStr)
+}
+
 // ListAll returns all chunk hashes in storage
 func (s *Store) ListAll() ([]string, error) {
-	var hashes []string
+	staged := s.stagedHashes()
+	seen := make(map[string]bool, len(staged))
+	for _, h := range staged {
+		seen[h] = true
+	}
+	hashes := staged
 	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(persistence.BucketBlocks))
-		return b.ForEach(func(k, v []byte) error {
-			hashes = append(hashes, string(k))
+		return chunkindex.ForEach(tx, func(hash string, e chunkindex.Entry) error {
+			if e.Stored() && !seen[hash] {
+				hashes = append(hashes, hash)
+			}
 			return nil
 		})
 	})
@@ -127,12 +329,62 @@ func (s *Store) ListAll() ([]string, error) {
 
 // Exists checks if a chunk exists in storage
 func (s *Store) Exists(hashStr string) bool {
+	if _, ok := s.stagedChunk(hashStr); ok {
+		return true
+	}
+	stored := false
+	s.db.View(func(tx *bolt.Tx) error {
+		stored = chunkindex.Stored(tx, hashStr)
+		return nil
+	})
+	return stored
+}
+
+// Missing returns the hashes not present in storage, checked in one
+// transaction. Chunks staged in the WAL count as present.
+func (s *Store) Missing(hashes []string) ([]string, error) {
+	var missing []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, h := range hashes {
+			if !chunkindex.Stored(tx, h) {
+				missing = append(missing, h)
+			}
+		}
+		return nil
+	})
+	if err != nil || s.wal == nil {
+		return missing, err
+	}
+	s.wal.mu.Lock()
+	defer s.wal.mu.Unlock()
+	kept := missing[:0]
+	for _, h := range missing {
+		if _, ok := s.wal.staged[h]; !ok {
+			kept = append(kept, h)
+		}
+	}
+	return kept, nil
+}
+
+// Size returns the bytes stored for hashes, or for every stored chunk if
+// hashes is nil. Chunks absent or still staged in the WAL count nothing.
+func (s *Store) Size(hashes []string) (int64, error) {
+	var size int64
 	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(persistence.BucketBlocks))
-		if b.Get([]byte(hashStr)) == nil {
-			return errors.New("not found")
+		if hashes == nil {
+			return chunkindex.ForEach(tx, func(_ string, e chunkindex.Entry) error {
+				if e.Stored() {
+					size += e.Size
+				}
+				return nil
+			})
+		}
+		for _, h := range hashes {
+			if e, ok := chunkindex.Get(tx, h); ok && e.Stored() {
+				size += e.Size
+			}
 		}
 		return nil
 	})
-	return err == nil
+	return size, err
 }
@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/compression"
+	sverrors "github.com/hoangsonww/backupagent/internal/errors"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+)
+
+func TestStoreErrorCodes(t *testing.T) {
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := New(db, bytes.Repeat([]byte{5}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := store.PutChunk([]byte("some chunk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := New(db, bytes.Repeat([]byte{6}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := store.Get(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.Get("absent")
+	if code := sverrors.GetErrorCode(err); code != sverrors.ErrCodeChunkNotFound {
+		t.Errorf("Get(absent) code = %q (%v)", code, err)
+	}
+	err = store.ReadChunks([]string{"absent"}, ReadOptions{}, func(string, []byte) error { return nil })
+	if code := sverrors.GetErrorCode(err); code != sverrors.ErrCodeChunkNotFound {
+		t.Errorf("ReadChunks(absent) code = %q (%v)", code, err)
+	}
+	_, err = other.GetChunk(hash)
+	if code := sverrors.GetErrorCode(err); code != sverrors.ErrCodeDecryptionFailed {
+		t.Errorf("GetChunk with wrong key code = %q (%v)", code, err)
+	}
+	_, err = store.Open("tampered", stored)
+	if code := sverrors.GetErrorCode(err); code != sverrors.ErrCodeChunkInvalid || !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("Open with wrong hash = %q (%v)", code, err)
+	}
+	_, err = store.Open(hash, stored[:4])
+	if code := sverrors.GetErrorCode(err); code != sverrors.ErrCodeChunkInvalid {
+		t.Errorf("Open of truncated chunk code = %q (%v)", code, err)
+	}
+}
+
+func TestStoreSize(t *testing.T) {
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := New(db, bytes.Repeat([]byte{5}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := store.PutChunk([]byte("first chunk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := store.PutChunk([]byte("second, longer chunk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataA, _ := store.Get(a)
+	dataB, _ := store.Get(b)
+
+	if size, err := store.Size([]string{a, "absent"}); err != nil || size != int64(len(dataA)) {
+		t.Errorf("Size(a, absent) = %d, %v; want %d", size, err, len(dataA))
+	}
+	if size, err := store.Size(nil); err != nil || size != int64(len(dataA)+len(dataB)) {
+		t.Errorf("Size(nil) = %d, %v; want %d", size, err, len(dataA)+len(dataB))
+	}
+}
+
+func TestStoreCompression(t *testing.T) {
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := New(db, bytes.Repeat([]byte{5}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := bytes.Repeat([]byte("func main() { fmt.Println(\"hello\") }\n"), 200)
+	legacy, err := store.PutChunk(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := compression.NewPolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetCompression(policy)
+	jpeg := append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, bytes.Repeat([]byte{7}, 4000)...)
+	hashes, fresh, err := store.PutChunksOf(compression.Unknown, [][]byte{append(text, '!'), jpeg, text})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(len(text) + 1 + len(jpeg)); fresh != want {
+		t.Errorf("PutChunksOf reported %d new bytes, want %d", fresh, want)
+	}
+	sizes := map[string]int{}
+	for _, h := range hashes {
+		stored, err := store.Get(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[h] = len(stored)
+	}
+	if n := sizes[hashes[0]]; n >= len(text)/4 {
+		t.Errorf("text chunk stored in %d bytes, want it compressed", n)
+	}
+	if n := sizes[hashes[1]]; n <= len(jpeg) {
+		t.Errorf("jpeg chunk stored in %d bytes, want it left uncompressed", n)
+	}
+
+	want := map[string][]byte{legacy: text, hashes[0]: append(text, '!'), hashes[1]: jpeg}
+	for h, plain := range want {
+		got, err := store.GetChunk(h)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("GetChunk(%s) = %d bytes, %v", h[:8], len(got), err)
+		}
+		stored, _ := store.Get(h)
+		if _, err := store.Open(h, stored); err != nil {
+			t.Errorf("Open(%s): %v", h[:8], err)
+		}
+	}
+	err = store.ReadChunks(hashes, ReadOptions{}, func(h string, plain []byte) error {
+		if !bytes.Equal(plain, want[h]) {
+			t.Errorf("ReadChunks(%s) returned other content", h[:8])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDictionaryChunks(t *testing.T) {
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := New(db, bytes.Repeat([]byte{5}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	config := func() []byte {
+		return []byte(fmt.Sprintf(`{"name": "service-%d", "replicas": %d, "image": "registry.example.com/team/app:%d.%d",
+  "env": {"LOG_LEVEL": "info", "PORT": "%d", "DATABASE_URL": "postgres://db-%d.internal:5432/app"},
+  "resources": {"limits": {"cpu": "%dm", "memory": "%dMi"}}, "labels": ["tier-%d", "owner-%d"]}
+`, rng.Intn(1000), rng.Intn(9), rng.Intn(20), rng.Intn(20), 8000+rng.Intn(100), rng.Intn(50), 100*rng.Intn(20), 64*rng.Intn(32), rng.Intn(4), rng.Intn(30)))
+	}
+	var samples [][]byte
+	for i := 0; i < 400; i++ {
+		samples = append(samples, config())
+	}
+	d, err := compression.TrainDict(compression.Text, samples, 16<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveDict(d); err != nil {
+		t.Fatal(err)
+	}
+	if dicts, err := store.LoadDicts(); err != nil || len(dicts) != 1 || dicts[0].ID != d.ID {
+		t.Fatalf("LoadDicts = %v, %v", dicts, err)
+	}
+
+	plain, _ := compression.NewPolicy(nil)
+	policy, _ := compression.NewPolicy(nil)
+	store.SetCompression(policy)
+	if err := store.UseDict(d); err != nil {
+		t.Fatal(err)
+	}
+	chunk := config()
+	hash, err := store.PutChunk(chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := store.Get(hash)
+	if without := len(plain.Pack(chunk, compression.Text)) + 1 + nonceSize + 16; len(stored) >= without {
+		t.Errorf("chunk stored in %d bytes against the dictionary, %d without", len(stored), without)
+	}
+	if got, err := store.GetChunk(hash); err != nil || !bytes.Equal(got, chunk) {
+		t.Fatalf("GetChunk = %q, %v", got, err)
+	}
+
+	// A dictionary not loaded leaves the chunk unreadable but not corrupt
+	unknown, err := compression.TrainDict(compression.Text, samples[:200], 8<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UseDict(unknown); err != nil {
+		t.Fatal(err)
+	}
+	hash, err = store.PutChunk(config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.GetChunk(hash)
+	if !errors.Is(err, compression.ErrUnknownDict) || sverrors.GetErrorCode(err) != "" {
+		t.Errorf("GetChunk against a dictionary not loaded = %v", err)
+	}
+}
@@ -0,0 +1,509 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/chunkindex"
+	"github.com/hoangsonww/backupagent/internal/compression"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Durability modes of chunk ingest
+const (
+	// DurabilitySync commits every ingest batch to the metadata DB
+	DurabilitySync = "sync"
+	// DurabilityWAL appends chunks to a write-ahead log and indexes them later
+	DurabilityWAL = "wal"
+)
+
+const (
+	// walHeader is body length(4) | crc32c of body(4)
+	walHeader = 8
+	// walApplyBatch bounds the chunk bytes indexed in one transaction
+	walApplyBatch = 32 << 20
+	// walRetry is how long to wait after a failed apply before trying again
+	walRetry = time.Second
+)
+
+var (
+	ErrWALClosed = errors.New("chunk WAL is closed")
+
+	walTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// WALOptions configures write-ahead staging of ingested chunks.
+type WALOptions struct {
+	Path         string
+	SyncInterval time.Duration // how long a group commit waits for more writers
+	MaxPending   int64         // chunk bytes logged but not yet indexed
+}
+
+type walRecord struct {
+	hash string
+	data []byte
+}
+
+// wal stages encrypted chunks in an append-only log. A writer returns once
+// a group fsync covering its records is done; a background loop then moves
+// them into the blocks bucket in large transactions and truncates the log
+// when everything in it is indexed. Until then staged chunks are served from
+// memory, and after a crash the log is replayed on open.
+type wal struct {
+	opts  WALOptions
+	f     *os.File
+	apply func([]walRecord) error
+
+	mu       sync.Mutex
+	cond     *sync.Cond // signalled on sync, apply, truncate and close
+	staged   map[string][]byte
+	queue    []walRecord // staged records in log order
+	pending  int64       // chunk bytes in queue
+	size     int64       // bytes in the log file
+	written  int64       // bytes ever appended
+	synced   int64       // bytes ever appended and fsynced
+	err      error       // a failed write or fsync; the log takes no more records
+	applyErr error
+	closed   bool
+
+	syncKick  chan struct{}
+	applyKick chan struct{}
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// EnableWAL switches chunk ingest to write-ahead staging, first replaying
+// whatever a previous run left in the log.
+func (s *Store) EnableWAL(opts WALOptions) error {
+	f, err := os.OpenFile(opts.Path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	w := &wal{
+		opts:      opts,
+		f:         f,
+		apply:     s.applyStaged,
+		staged:    make(map[string][]byte),
+		syncKick:  make(chan struct{}, 1),
+		applyKick: make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	w.cond = sync.NewCond(&w.mu)
+	if err := w.replay(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to replay chunk WAL: %w", err)
+	}
+	w.wg.Add(2)
+	go w.syncLoop()
+	go w.applyLoop()
+	s.wal = w
+	return nil
+}
+
+// Close indexes every staged chunk and closes the log. It is a no-op when
+// ingest is not staged.
+func (s *Store) Close() error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.close()
+}
+
+// stageChunks is PutChunksOf in WAL mode.
+func (s *Store) stageChunks(plaintexts [][]byte, kind compression.Kind) ([]string, int64, error) {
+	hashes := make([]string, len(plaintexts))
+	for i, plaintext := range plaintexts {
+		hashes[i] = chunkHash(plaintext)
+	}
+	missing, err := s.Missing(hashes)
+	if err != nil {
+		return nil, 0, err
+	}
+	need := make(map[string]bool, len(missing))
+	for _, h := range missing {
+		need[h] = true
+	}
+	var recs []walRecord
+	var fresh int64
+	for i, plaintext := range plaintexts {
+		if !need[hashes[i]] {
+			continue
+		}
+		delete(need, hashes[i])
+		stored, err := s.sealChunk(plaintext, kind)
+		if err != nil {
+			return nil, 0, err
+		}
+		recs = append(recs, walRecord{hash: hashes[i], data: s.corrupt(hashes[i], stored)})
+		fresh += int64(len(plaintext))
+	}
+	if err := s.wal.append(recs); err != nil {
+		return nil, 0, err
+	}
+	return hashes, fresh, nil
+}
+
+// applyStaged moves logged chunks into the backend
+func (s *Store) applyStaged(recs []walRecord) error {
+	wrote := false
+	sent, err := s.preupload(recs)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, r := range recs {
+			if chunkindex.Stored(tx, r.hash) {
+				continue
+			}
+			if err := s.put(tx, r.hash, r.data, sent); err != nil {
+				return err
+			}
+			if !wrote {
+				wrote = true
+				if err := s.interrupt(); err != nil {
+					return err
+				}
+			}
+		}
+		return s.flush()
+	})
+}
+
+// stagedChunk returns the stored form of a chunk that is logged but not yet indexed
+func (s *Store) stagedChunk(hash string) ([]byte, bool) {
+	if s.wal == nil {
+		return nil, false
+	}
+	s.wal.mu.Lock()
+	defer s.wal.mu.Unlock()
+	data, ok := s.wal.staged[hash]
+	return data, ok
+}
+
+// stagedHashes returns the hashes of all chunks not yet indexed
+func (s *Store) stagedHashes() []string {
+	if s.wal == nil {
+		return nil
+	}
+	s.wal.mu.Lock()
+	defer s.wal.mu.Unlock()
+	hashes := make([]string, 0, len(s.wal.staged))
+	for h := range s.wal.staged {
+		hashes = append(hashes, h)
+	}
+	return hashes
+}
+
+// flushStaged waits until every staged chunk is indexed, so a deletion
+// cannot be undone by a later apply.
+func (s *Store) flushStaged() error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.flush()
+}
+
+// append logs recs and waits until they are fsynced. Records whose hash is
+// already staged are dropped.
+func (w *wal) append(recs []walRecord) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var buf []byte
+	var bytes int64
+	for _, r := range recs {
+		if _, ok := w.staged[r.hash]; ok {
+			continue
+		}
+		buf = appendWALRecord(buf, r)
+		bytes += int64(len(r.data))
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+
+	// Bound what a crash leaves to replay, and let the log be truncated
+	// once it has grown well past that
+	for !w.closed && w.err == nil && w.pending > 0 &&
+		(w.pending+bytes > w.opts.MaxPending || w.size > 4*w.opts.MaxPending) {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return ErrWALClosed
+	}
+	if w.err != nil {
+		return w.err
+	}
+
+	if _, err := w.f.Write(buf); err != nil {
+		// A torn record may follow, so nothing more can be appended after it
+		w.err = fmt.Errorf("chunk WAL write failed: %w", err)
+		w.cond.Broadcast()
+		return w.err
+	}
+	w.size += int64(len(buf))
+	w.written += int64(len(buf))
+	target := w.written
+	for _, r := range recs {
+		if _, ok := w.staged[r.hash]; ok {
+			continue
+		}
+		w.staged[r.hash] = r.data
+		w.queue = append(w.queue, r)
+		w.pending += int64(len(r.data))
+	}
+	kick(w.syncKick)
+	kick(w.applyKick)
+
+	for w.synced < target && w.err == nil && !w.closed {
+		w.cond.Wait()
+	}
+	if w.synced < target {
+		if w.err != nil {
+			return w.err
+		}
+		return ErrWALClosed
+	}
+	return nil
+}
+
+func (w *wal) syncLoop() {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.syncKick:
+		}
+		// Let concurrent writers join this group commit
+		time.Sleep(w.opts.SyncInterval)
+
+		w.mu.Lock()
+		target := w.written
+		w.mu.Unlock()
+		err := w.f.Sync()
+
+		w.mu.Lock()
+		if err != nil && w.err == nil {
+			w.err = fmt.Errorf("chunk WAL fsync failed: %w", err)
+		} else if err == nil && target > w.synced {
+			w.synced = target
+			w.truncateLocked()
+		}
+		w.cond.Broadcast()
+		w.mu.Unlock()
+	}
+}
+
+func (w *wal) applyLoop() {
+	defer w.wg.Done()
+	logger := monitoring.GetLogger().WithField("component", "chunk_wal")
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.applyKick:
+		}
+		for {
+			batch := w.nextBatch()
+			if len(batch) == 0 {
+				break
+			}
+			err := w.apply(batch)
+			w.applied(batch, err)
+			if err != nil {
+				logger.WithError(err).Error("Failed to index staged chunks, retrying")
+				select {
+				case <-w.done:
+					return
+				case <-time.After(walRetry):
+				}
+			}
+		}
+	}
+}
+
+// nextBatch returns the oldest staged records, up to walApplyBatch bytes
+func (w *wal) nextBatch() []walRecord {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var bytes int64
+	n := 0
+	for n < len(w.queue) && bytes < walApplyBatch {
+		bytes += int64(len(w.queue[n].data))
+		n++
+	}
+	return w.queue[:n:n]
+}
+
+// applied drops batch from the staged set once it is indexed
+func (w *wal) applied(batch []walRecord, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.applyErr = err
+	if err == nil {
+		w.queue = w.queue[len(batch):]
+		for _, r := range batch {
+			delete(w.staged, r.hash)
+			w.pending -= int64(len(r.data))
+		}
+		w.truncateLocked()
+	}
+	w.cond.Broadcast()
+}
+
+// truncateLocked empties the log once every record in it is fsynced and
+// indexed. The blocks bucket is fsynced by its own commits.
+func (w *wal) truncateLocked() {
+	if len(w.queue) > 0 || w.synced < w.written || w.size == 0 || w.err != nil {
+		return
+	}
+	if err := w.f.Truncate(0); err != nil {
+		w.err = fmt.Errorf("chunk WAL truncate failed: %w", err)
+		return
+	}
+	w.size = 0
+}
+
+func (w *wal) flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	kick(w.applyKick)
+	for len(w.queue) > 0 && w.applyErr == nil && !w.closed {
+		w.cond.Wait()
+	}
+	if len(w.queue) > 0 {
+		if w.applyErr != nil {
+			return w.applyErr
+		}
+		return ErrWALClosed
+	}
+	return nil
+}
+
+func (w *wal) close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.cond.Broadcast()
+	w.mu.Unlock()
+
+	close(w.done)
+	w.wg.Wait()
+
+	// Writers are gone, so what is left can be indexed directly
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		return err
+	}
+	if len(w.queue) > 0 {
+		if err := w.apply(w.queue); err != nil {
+			// The log keeps the records for replay on the next start
+			w.f.Close()
+			return fmt.Errorf("failed to index staged chunks: %w", err)
+		}
+	}
+	if w.err == nil {
+		if err := w.f.Truncate(0); err != nil {
+			w.f.Close()
+			return err
+		}
+	}
+	return w.f.Close()
+}
+
+// replay indexes the records a previous run logged, stopping at the first
+// torn or corrupt one, and empties the log.
+func (w *wal) replay() error {
+	data, err := os.ReadFile(w.opts.Path)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	var recs []walRecord
+	rest := data
+	for len(rest) > 0 {
+		r, n, ok := readWALRecord(rest)
+		if !ok {
+			break
+		}
+		recs = append(recs, r)
+		rest = rest[n:]
+	}
+	for start := 0; start < len(recs); {
+		end, bytes := start, 0
+		for end < len(recs) && bytes < walApplyBatch {
+			bytes += len(recs[end].data)
+			end++
+		}
+		if err := w.apply(recs[start:end]); err != nil {
+			return err
+		}
+		start = end
+	}
+	monitoring.GetLogger().WithFields(map[string]interface{}{
+		"chunks":        len(recs),
+		"dropped_bytes": len(rest),
+	}).Info("Replayed chunk WAL")
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+// appendWALRecord encodes r as header | hash length(1) | hash | data
+func appendWALRecord(buf []byte, r walRecord) []byte {
+	body := 1 + len(r.hash) + len(r.data)
+	start := len(buf)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(body))
+	buf = binary.BigEndian.AppendUint32(buf, 0)
+	buf = append(buf, byte(len(r.hash)))
+	buf = append(buf, r.hash...)
+	buf = append(buf, r.data...)
+	binary.BigEndian.PutUint32(buf[start+4:], crc32.Checksum(buf[start+walHeader:], walTable))
+	return buf
+}
+
+func readWALRecord(data []byte) (walRecord, int, bool) {
+	if len(data) < walHeader {
+		return walRecord{}, 0, false
+	}
+	body := int(binary.BigEndian.Uint32(data))
+	if body < 1 || len(data)-walHeader < body {
+		return walRecord{}, 0, false
+	}
+	b := data[walHeader : walHeader+body]
+	if crc32.Checksum(b, walTable) != binary.BigEndian.Uint32(data[4:]) {
+		return walRecord{}, 0, false
+	}
+	hashLen := int(b[0])
+	if 1+hashLen > len(b) {
+		return walRecord{}, 0, false
+	}
+	r := walRecord{
+		hash: string(b[1 : 1+hashLen]),
+		data: append([]byte(nil), b[1+hashLen:]...),
+	}
+	return r, walHeader + body, true
+}
+
+// kick wakes a loop without blocking
+func kick(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
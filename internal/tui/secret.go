@@ -0,0 +1,20 @@
+package tui
+
+import (
+	"errors"
+	"os"
+)
+
+// HideInput stops the terminal on f echoing what is typed, until restore
+// is called, so a passphrase can be read from it. It reports ok false, and
+// changes nothing, when f is not a terminal.
+func HideInput(f *os.File) (restore func(), ok bool, err error) {
+	restore, err = noEcho(int(f.Fd()))
+	if errors.Is(err, errNotTerminal) {
+		return func() {}, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return restore, true, nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+
+package tui
+
+import "errors"
+
+func makeRaw(fd int) (restore func(), err error) {
+	return nil, errors.New("the terminal UI is not supported on this platform; use the remote commands or the web UI")
+}
+
+func termSize(fd int) (cols, rows int) {
+	return 80, 24
+}
+
+func noEcho(fd int) (restore func(), err error) {
+	return nil, errNotTerminal
+}
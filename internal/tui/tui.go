@@ -0,0 +1,655 @@
+// Package tui is a full-screen terminal interface to a daemon's management
+// API, for hosts reached over SSH: live jobs, a snapshot browser that starts
+// restores, connected peers with their health, and a tail of the daemon's
+// log. It polls the API and needs nothing but a terminal that understands
+// ANSI escapes.
+package tui
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/agent"
+	"github.com/hoangsonww/backupagent/internal/api"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+var errNotTerminal = errors.New("standard input is not a terminal")
+
+const (
+	// maxLogs is how many log entries the log view keeps
+	maxLogs = 1000
+	// requestTimeout bounds each API call of a refresh or action
+	requestTimeout = 10 * time.Second
+)
+
+// Views, in tab order
+const (
+	viewJobs = iota
+	viewSnapshots
+	viewPeers
+	viewLogs
+	numViews
+)
+
+var viewNames = [numViews]string{"Jobs", "Snapshots", "Peers", "Logs"}
+
+// ANSI escapes
+const (
+	escHome      = "\x1b[H"
+	escClearEOL  = "\x1b[K"
+	escClearDown = "\x1b[J"
+	escReverse   = "\x1b[7m"
+	escBold      = "\x1b[1m"
+	escDim       = "\x1b[2m"
+	escRed       = "\x1b[31m"
+	escYellow    = "\x1b[33m"
+	escReset     = "\x1b[0m"
+	escAltScreen = "\x1b[?1049h\x1b[?25l"
+	escMainScrn  = "\x1b[?25h\x1b[?1049l"
+)
+
+// Keys, as decoded from input
+const (
+	keyUp     = "up"
+	keyDown   = "down"
+	keyPgUp   = "pgup"
+	keyPgDown = "pgdown"
+	keyEnter  = "enter"
+	keyEsc    = "esc"
+	keyBack   = "backspace"
+	keyTab    = "tab"
+	keyCtrlC  = "ctrl-c"
+)
+
+// data is what one refresh fetched
+type data struct {
+	status *api.Status
+	ops    []*agent.Operation
+	snaps  []*versioning.Snapshot
+	peers  []api.Peer
+	logs   []monitoring.LogEntry
+	err    error
+}
+
+// prompt reads a line at the bottom of the screen
+type prompt struct {
+	label  string
+	input  []rune
+	submit func(line string)
+}
+
+type ui struct {
+	client  *api.Client
+	in      *os.File
+	out     io.Writer
+	refresh time.Duration
+
+	data
+	lastLog time.Time
+	view    int
+	sel     [numViews]int
+	follow  bool // keep the newest log entry in view
+	prompt  *prompt
+	message string // outcome of the last action
+	actions chan string
+}
+
+// Run shows the daemon behind c on the terminal of in and out, refreshing
+// every refresh, until the user quits or ctx ends.
+func Run(ctx context.Context, c *api.Client, in *os.File, out io.Writer, refresh time.Duration) error {
+	restore, err := makeRaw(int(in.Fd()))
+	if err != nil {
+		return err
+	}
+	defer restore()
+	fmt.Fprint(out, escAltScreen)
+	defer fmt.Fprint(out, escMainScrn)
+
+	u := &ui{client: c, in: in, out: out, refresh: refresh, follow: true, actions: make(chan string, 1)}
+	return u.loop(ctx)
+}
+
+func (u *ui) loop(ctx context.Context) error {
+	keys := make(chan string)
+	go readKeys(u.in, keys)
+
+	fetched := make(chan data, 1)
+	fetching := true
+	go u.fetch(ctx, u.lastLog, fetched)
+	ticker := time.NewTicker(u.refresh)
+	defer ticker.Stop()
+
+	u.draw()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case k, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			if u.key(k) {
+				return nil
+			}
+		case d := <-fetched:
+			fetching = false
+			u.update(d)
+		case msg := <-u.actions:
+			u.message = msg
+			if !fetching {
+				fetching = true
+				go u.fetch(ctx, u.lastLog, fetched)
+			}
+		case <-ticker.C:
+			if !fetching {
+				fetching = true
+				go u.fetch(ctx, u.lastLog, fetched)
+			}
+		}
+		u.draw()
+	}
+}
+
+// fetch gets everything shown from the API
+func (u *ui) fetch(ctx context.Context, since time.Time, fetched chan<- data) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	var d data
+	var err error
+	if d.status, err = u.client.Status(ctx); err != nil {
+		d.err = err
+		fetched <- d
+		return
+	}
+	errs := []error{}
+	if d.ops, err = u.client.Operations(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if d.snaps, err = u.client.Snapshots(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if d.peers, err = u.client.Peers(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if d.logs, err = u.client.Logs(ctx, since, ""); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		d.err = errs[0]
+	}
+	fetched <- d
+}
+
+// update takes in a refresh, keeping what failed to load as it was
+func (u *ui) update(d data) {
+	u.err = d.err
+	if d.status == nil {
+		return
+	}
+	u.status = d.status
+	if d.ops != nil {
+		sortOperations(d.ops)
+		u.ops = d.ops
+	}
+	if d.snaps != nil {
+		// Newest first
+		sort.SliceStable(d.snaps, func(i, j int) bool { return d.snaps[j].Timestamp.Before(d.snaps[i].Timestamp) })
+		u.snaps = d.snaps
+	}
+	if d.peers != nil {
+		sort.Slice(d.peers, func(i, j int) bool { return d.peers[i].ID < d.peers[j].ID })
+		u.peers = d.peers
+	}
+	for _, e := range d.logs {
+		u.lastLog = e.Timestamp
+		// Leave out the requests of this UI polling the API
+		if strings.HasPrefix(e.Message, "API request") {
+			continue
+		}
+		u.logs = append(u.logs, e)
+	}
+	if len(u.logs) > maxLogs {
+		u.logs = u.logs[len(u.logs)-maxLogs:]
+	}
+	if u.follow {
+		u.sel[viewLogs] = len(u.logs) - 1
+	}
+}
+
+// sortOperations orders running operations first, then queued ones, then
+// finished ones, most recent first
+func sortOperations(ops []*agent.Operation) {
+	rank := func(op *agent.Operation) int {
+		switch op.State {
+		case agent.OpRunning:
+			return 0
+		case agent.OpQueued:
+			return 1
+		}
+		return 2
+	}
+	sort.SliceStable(ops, func(i, j int) bool {
+		a, b := ops[i], ops[j]
+		if rank(a) != rank(b) {
+			return rank(a) < rank(b)
+		}
+		if a.State == agent.OpQueued {
+			return a.Position < b.Position
+		}
+		return a.QueuedAt.After(b.QueuedAt)
+	})
+}
+
+// key handles one key press and reports whether to quit
+func (u *ui) key(k string) bool {
+	if p := u.prompt; p != nil {
+		switch k {
+		case keyEnter:
+			u.prompt = nil
+			p.submit(strings.TrimSpace(string(p.input)))
+		case keyEsc, keyCtrlC:
+			u.prompt = nil
+			u.message = "Cancelled"
+		case keyBack:
+			if len(p.input) > 0 {
+				p.input = p.input[:len(p.input)-1]
+			}
+		default:
+			if r := []rune(k); len(r) == 1 && r[0] >= ' ' {
+				p.input = append(p.input, r[0])
+			}
+		}
+		return false
+	}
+
+	_, rows := termSize(int(u.in.Fd()))
+	page := rows - 5
+	switch k {
+	case "q", keyCtrlC:
+		return true
+	case "1", "2", "3", "4":
+		u.view = int(k[0] - '1')
+	case keyTab:
+		u.view = (u.view + 1) % numViews
+	case keyUp, "k":
+		u.move(-1)
+	case keyDown, "j":
+		u.move(1)
+	case keyPgUp:
+		u.move(-page)
+	case keyPgDown:
+		u.move(page)
+	case "g":
+		u.move(-u.rows())
+	case "G":
+		u.move(u.rows())
+	case "r", keyEnter:
+		if snap := u.selectedSnapshot(); snap != nil {
+			u.ask(fmt.Sprintf("Restore %s to (path on the daemon's host): ", snap.ID), func(target string) {
+				u.restore(snap.ID, "", target)
+			})
+		}
+	case "f":
+		if snap := u.selectedSnapshot(); snap != nil {
+			u.ask(fmt.Sprintf("File in %s to restore: ", snap.ID), func(name string) {
+				if name == "" {
+					u.message = "Cancelled: no file given"
+					return
+				}
+				u.ask(fmt.Sprintf("Restore %s to (path on the daemon's host): ", name), func(target string) {
+					u.restore(snap.ID, name, target)
+				})
+			})
+		}
+	}
+	return false
+}
+
+// move moves the selection of the current view by n rows
+func (u *ui) move(n int) {
+	s := u.sel[u.view] + n
+	if s >= u.rows() {
+		s = u.rows() - 1
+	}
+	if s < 0 {
+		s = 0
+	}
+	u.sel[u.view] = s
+	if u.view == viewLogs {
+		u.follow = s == u.rows()-1
+	}
+}
+
+// rows returns the number of rows of the current view
+func (u *ui) rows() int {
+	switch u.view {
+	case viewJobs:
+		return len(u.ops)
+	case viewSnapshots:
+		return len(u.snaps)
+	case viewPeers:
+		return len(u.peers)
+	}
+	return len(u.logs)
+}
+
+func (u *ui) selectedSnapshot() *versioning.Snapshot {
+	if u.view != viewSnapshots || u.sel[viewSnapshots] >= len(u.snaps) {
+		return nil
+	}
+	return u.snaps[u.sel[viewSnapshots]]
+}
+
+func (u *ui) ask(label string, submit func(line string)) {
+	u.prompt = &prompt{label: label, submit: submit}
+}
+
+// restore submits the restore of a snapshot, or of the file name in it, to
+// target; the outcome arrives on u.actions
+func (u *ui) restore(snapshotID, name, target string) {
+	if target == "" {
+		u.message = "Cancelled: no target given"
+		return
+	}
+	u.message = "Submitting restore..."
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+		var sub *api.Submitted
+		var err error
+		if name == "" {
+			sub, err = u.client.Restore(ctx, snapshotID, target, agent.ThrottleSettings{})
+		} else {
+			sub, err = u.client.RestoreFile(ctx, snapshotID, name, target, agent.ThrottleSettings{})
+		}
+		if err != nil {
+			u.actions <- "Restore failed: " + err.Error()
+			return
+		}
+		op := sub.Operation
+		if op.State == agent.OpQueued {
+			u.actions <- fmt.Sprintf("Queued restore %s at position %d; see Jobs", op.ID, op.Position)
+			return
+		}
+		u.actions <- fmt.Sprintf("Started restore %s; see Jobs", op.ID)
+	}()
+}
+
+// draw redraws the whole screen
+func (u *ui) draw() {
+	cols, rows := termSize(int(u.in.Fd()))
+	var b strings.Builder
+	b.WriteString(escHome)
+	line := func(s string) {
+		b.WriteString(s)
+		b.WriteString(escClearEOL + "\r\n")
+	}
+
+	// Header and tabs
+	header := "ShadowVault"
+	if st := u.status; st != nil {
+		header += fmt.Sprintf("  repository %s  peer %s  %d peers  health %s",
+			st.RepositoryID, short(st.P2PID, 12), st.Peers, st.Health.Status)
+	}
+	line(escBold + clip(header, cols) + escReset)
+	var tabs strings.Builder
+	for i, name := range viewNames {
+		label := fmt.Sprintf(" %d %s ", i+1, name)
+		if i == u.view {
+			label = escReverse + label + escReset
+		}
+		tabs.WriteString(label + " ")
+	}
+	line(tabs.String())
+
+	head, body := u.table(cols)
+	line(escDim + clip(head, cols) + escReset)
+	height := rows - 4
+	if height < 1 {
+		height = 1
+	}
+	sel := u.sel[u.view]
+	first := 0
+	if sel >= height {
+		first = sel - height + 1
+	}
+	for i := first; i < first+height; i++ {
+		if i >= len(body) {
+			line("")
+			continue
+		}
+		text := clip(body[i].text, cols)
+		switch {
+		case i == sel && u.view != viewLogs:
+			text = escReverse + text + escReset
+		case body[i].color != "":
+			text = body[i].color + text + escReset
+		}
+		line(text)
+	}
+
+	// Status line
+	var status string
+	switch {
+	case u.prompt != nil:
+		status = u.prompt.label + string(u.prompt.input) + "\x1b[?25h"
+	case u.err != nil:
+		status = escRed + clip("API error: "+u.err.Error(), cols) + escReset
+	case u.message != "":
+		status = clip(u.message, cols)
+	default:
+		help := "1-4/tab view  j/k move  q quit"
+		if u.view == viewSnapshots {
+			help = "r restore  f restore a file  " + help
+		}
+		status = escDim + clip(help, cols) + escReset
+	}
+	if u.prompt == nil {
+		status += "\x1b[?25l"
+	}
+	b.WriteString(status + escClearEOL + escClearDown)
+	io.WriteString(u.out, b.String())
+}
+
+// row is one line of a view
+type row struct {
+	text  string
+	color string
+}
+
+// table returns the column header and the rows of the current view
+func (u *ui) table(cols int) (string, []row) {
+	var rows []row
+	switch u.view {
+	case viewJobs:
+		for _, op := range u.ops {
+			rows = append(rows, jobRow(op))
+		}
+		return fmt.Sprintf("%-24s %-8s %-8s %-28s %-9s %s", "ID", "KIND", "STATE", "PROGRESS", "TIME", "TARGET"), rows
+	case viewSnapshots:
+		for _, s := range u.snaps {
+			r := row{text: fmt.Sprintf("%-16s %-19s %8d %s", short(s.ID, 16),
+				s.Timestamp.Time().Local().Format("2006-01-02 15:04:05"), len(s.Chunks), s.Source())}
+			if len(s.Errors) > 0 {
+				r.text += fmt.Sprintf("  (%d files skipped)", len(s.Errors))
+				r.color = escYellow
+			}
+			rows = append(rows, r)
+		}
+		return fmt.Sprintf("%-16s %-19s %8s %s", "ID", "TAKEN", "CHUNKS", "SOURCE"), rows
+	case viewPeers:
+		for _, p := range u.peers {
+			latency := "-"
+			if p.Latency > 0 {
+				latency = p.Latency.Round(100 * time.Microsecond).String()
+			}
+			pinned := ""
+			if p.Pinned {
+				pinned = "pinned"
+			}
+			addr := ""
+			if len(p.Addrs) > 0 {
+				addr = p.Addrs[0]
+			}
+			r := row{text: fmt.Sprintf("%-52s %10s %7.1f %-6s %s", p.ID, latency, p.Score, pinned, addr)}
+			if p.Score < 0 {
+				r.color = escYellow
+			}
+			rows = append(rows, r)
+		}
+		return fmt.Sprintf("%-52s %10s %7s %-6s %s", "PEER", "LATENCY", "SCORE", "", "ADDRESS"), rows
+	}
+	for _, e := range u.logs {
+		rows = append(rows, logRow(e))
+	}
+	return fmt.Sprintf("%-8s %-5s %s", "TIME", "LEVEL", "MESSAGE"), rows
+}
+
+func jobRow(op *agent.Operation) row {
+	progress := ""
+	switch {
+	case op.State == agent.OpQueued:
+		progress = fmt.Sprintf("queued #%d", op.Position)
+	case op.Progress != nil:
+		p := op.Progress
+		progress = fmt.Sprintf("%.1f MiB", float64(p.Bytes)/(1<<20))
+		if pct := p.Percent(); pct >= 0 {
+			progress = fmt.Sprintf("%3.0f%% %s", pct, progress)
+		}
+		if p.ETA > 0 {
+			progress += " ETA " + p.ETA.Round(time.Second).String()
+		}
+	}
+	var took time.Duration
+	switch {
+	case !op.FinishedAt.IsZero():
+		took = op.FinishedAt.Sub(op.StartedAt)
+	case !op.StartedAt.IsZero():
+		took = time.Since(op.StartedAt)
+	}
+	elapsed := ""
+	if took > 0 {
+		elapsed = took.Round(time.Second).String()
+	}
+	r := row{text: fmt.Sprintf("%-24s %-8s %-8s %-28s %-9s %s", op.ID, op.Kind, op.State, progress, elapsed, op.Target)}
+	switch {
+	case op.Error != "":
+		r.text += "  " + op.Error
+		r.color = escRed
+	case op.Warning != "":
+		r.text += "  " + op.Warning
+		r.color = escYellow
+	}
+	return r
+}
+
+func logRow(e monitoring.LogEntry) row {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s %s", e.Timestamp.Local().Format("15:04:05"), e.Level, e.Message)
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, e.Fields[k])
+	}
+	if e.Error != "" {
+		fmt.Fprintf(&b, " error=%q", e.Error)
+	}
+	r := row{text: b.String()}
+	switch e.Level {
+	case "WARN":
+		r.color = escYellow
+	case "ERROR", "FATAL":
+		r.color = escRed
+	}
+	return r
+}
+
+// readKeys decodes key presses from in until it fails
+func readKeys(in io.Reader, keys chan<- string) {
+	defer close(keys)
+	buf := make([]byte, 64)
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, k := range decodeKeys(buf[:n]) {
+			keys <- k
+		}
+	}
+}
+
+// decodeKeys splits one read of terminal input into keys
+func decodeKeys(b []byte) []string {
+	var keys []string
+	for len(b) > 0 {
+		switch {
+		case b[0] == 0x1b && len(b) >= 3 && (b[1] == '[' || b[1] == 'O'):
+			n := 3
+			switch b[2] {
+			case 'A':
+				keys = append(keys, keyUp)
+			case 'B':
+				keys = append(keys, keyDown)
+			case '5', '6':
+				if len(b) >= 4 && b[3] == '~' {
+					n = 4
+					if b[2] == '5' {
+						keys = append(keys, keyPgUp)
+					} else {
+						keys = append(keys, keyPgDown)
+					}
+				}
+			}
+			b = b[n:]
+			continue
+		case b[0] == 0x1b:
+			keys = append(keys, keyEsc)
+		case b[0] == '\r' || b[0] == '\n':
+			keys = append(keys, keyEnter)
+		case b[0] == '\t':
+			keys = append(keys, keyTab)
+		case b[0] == 0x7f || b[0] == 0x08:
+			keys = append(keys, keyBack)
+		case b[0] == 0x03:
+			keys = append(keys, keyCtrlC)
+		default:
+			r := []rune(string(b))
+			keys = append(keys, string(r[0]))
+			b = b[len(string(r[0])):]
+			continue
+		}
+		b = b[1:]
+	}
+	return keys
+}
+
+// clip cuts s to n columns, counting runes
+func clip(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	if n < 1 {
+		return ""
+	}
+	return string(r[:n-1]) + "…"
+}
+
+func short(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
@@ -0,0 +1,321 @@
+package verification
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sverrors "github.com/hoangsonww/backupagent/internal/errors"
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// passFlushChunks and passFlushInterval bound the checks an interrupted
+	// pass loses: past either, they are checkpointed
+	passFlushChunks   = 1000
+	passFlushInterval = 10 * time.Second
+)
+
+// Chunk states kept in the checkpoint of a pass
+const (
+	chunkOK      byte = 'o'
+	chunkMissing byte = 'm'
+	chunkCorrupt byte = 'c'
+)
+
+// ErrBudget is returned by VerifySnapshots when the run stopped because its
+// time or read budget was spent. The next run resumes the pass.
+var ErrBudget = errors.New("verification budget spent")
+
+// PassOptions controls one run of a verification pass.
+type PassOptions struct {
+	Workers  int           // chunks verified at once; 0 uses one per CPU
+	Budget   time.Duration // most time spent; 0 is unlimited
+	MaxBytes int64         // most chunk bytes read; 0 is unlimited
+}
+
+// PassResult is the outcome of one run of a verification pass.
+type PassResult struct {
+	Snapshots []*VerificationResult `json:"snapshots"`         // snapshots with every chunk checked, in the order given
+	Remaining int                   `json:"remaining"`         // snapshots left for the next run
+	Checked   int                   `json:"checked"`           // chunks read and checked by this run
+	Bytes     int64                 `json:"bytes"`             // bytes read by this run
+	Reused    int                   `json:"reused"`            // chunks checked before in this pass, by an earlier snapshot or run
+	Complete  bool                  `json:"complete"`          // the pass finished and its checkpoint was cleared
+	Duration  time.Duration         `json:"duration"`          // of this run
+	Failed    int                   `json:"failed"`            // snapshots of Snapshots that failed
+	Resumed   bool                  `json:"resumed,omitempty"` // this run continued an interrupted pass
+}
+
+// chunkCheck is the outcome of verifying one chunk
+type chunkCheck struct {
+	hash  string
+	bytes int
+	err   error
+}
+
+// state classifies the outcome; 0 for read failures, which are tried again
+func (c chunkCheck) state() byte {
+	if c.err == nil {
+		return chunkOK
+	}
+	switch sverrors.GetErrorCode(c.err) {
+	case sverrors.ErrCodeChunkNotFound:
+		return chunkMissing
+	case sverrors.ErrCodeChunkInvalid, sverrors.ErrCodeDecryptionFailed:
+		return chunkCorrupt
+	}
+	return 0
+}
+
+// chunkChecks holds the chunks checked so far and what was found
+type chunkChecks struct {
+	states map[string]byte
+	errs   map[string]error // read failures and the errors of this run
+}
+
+func newChunkChecks() *chunkChecks {
+	return &chunkChecks{states: make(map[string]byte), errs: make(map[string]error)}
+}
+
+func (cc *chunkChecks) add(c chunkCheck) {
+	cc.states[c.hash] = c.state()
+	if c.err != nil {
+		cc.errs[c.hash] = c.err
+	}
+}
+
+// get returns the state of hash and its error; a state recorded by an
+// earlier run comes with an error made from it
+func (cc *chunkChecks) get(hash string) (byte, error) {
+	state := cc.states[hash]
+	if err, ok := cc.errs[hash]; ok || state == chunkOK {
+		return state, err
+	}
+	switch state {
+	case chunkMissing:
+		return state, sverrors.NewChunkNotFoundError(hash)
+	case chunkCorrupt:
+		return state, sverrors.NewError(sverrors.ErrCodeChunkInvalid, "chunk "+hash+" failed to open")
+	}
+	return state, nil
+}
+
+// checked reports whether hash has a final state
+func (cc *chunkChecks) checked(hash string) bool {
+	return cc.states[hash] != 0
+}
+
+// VerifySnapshots verifies snaps as one pass. Chunks shared between
+// snapshots are read once, by workers in parallel. Checked chunks are
+// checkpointed as the run goes, so a run stopped by ctx or its budget,
+// returning ctx's error or ErrBudget, leaves the pass for the next run to
+// resume; snapshots are reported as soon as all their chunks are checked.
+// The checkpoint is cleared once every snapshot is.
+func (v *Verifier) VerifySnapshots(ctx context.Context, snaps []*versioning.Snapshot, opts PassOptions) (*PassResult, error) {
+	start := time.Now()
+	runCtx := ctx
+	if opts.Budget > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, opts.Budget)
+		defer cancel()
+	}
+
+	checks, err := v.loadPass()
+	if err != nil {
+		return nil, err
+	}
+	res := &PassResult{Resumed: len(checks.states) > 0}
+	cp := &passCheckpoint{v: v, last: time.Now()}
+	var budget *int64
+	if opts.MaxBytes > 0 {
+		budget = &opts.MaxBytes
+	}
+
+	stopped := false
+	for i, snap := range snaps {
+		var todo []string
+		queued := make(map[string]bool)
+		for _, h := range snap.Chunks {
+			switch {
+			case checks.checked(h):
+				res.Reused++
+			case !queued[h]:
+				queued[h] = true
+				todo = append(todo, h)
+			}
+		}
+		err := v.checkChunks(runCtx, todo, opts.Workers, budget, func(c chunkCheck) {
+			checks.add(c)
+			res.Checked++
+			res.Bytes += int64(c.bytes)
+			cp.add(c)
+		})
+		if err == nil {
+			err = cp.flushDue()
+		}
+		if err != nil && !errors.Is(err, runCtx.Err()) && !errors.Is(err, ErrBudget) {
+			cp.flush()
+			return nil, err
+		}
+		if err != nil {
+			res.Remaining = len(snaps) - i
+			stopped = true
+			break
+		}
+		r := v.result(snap, checks)
+		if !r.Success {
+			res.Failed++
+		}
+		res.Snapshots = append(res.Snapshots, r)
+	}
+	res.Duration = time.Since(start)
+
+	if !stopped {
+		res.Complete = true
+		return res, v.clearPass()
+	}
+	if err := cp.flush(); err != nil {
+		return nil, err
+	}
+	v.logger.WithFields(map[string]interface{}{
+		"verified":  len(res.Snapshots),
+		"remaining": res.Remaining,
+		"chunks":    res.Checked,
+		"bytes":     res.Bytes,
+	}).Info("Verification paused, the next run resumes it")
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+	return res, ErrBudget
+}
+
+// checkChunks verifies hashes with workers goroutines, passing each outcome
+// to fn from the calling goroutine. It stops early with ctx's error when
+// ctx ends, or with ErrBudget once the bytes read reach *budget, which it
+// counts down.
+func (v *Verifier) checkChunks(ctx context.Context, hashes []string, workers int, budget *int64, fn func(chunkCheck)) error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	jobs := make(chan string)
+	results := make(chan chunkCheck)
+	var left atomic.Int64
+	if budget != nil {
+		left.Store(*budget)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for h := range jobs {
+				n, err := v.verifyChunk(h)
+				left.Add(-int64(n))
+				results <- chunkCheck{hash: h, bytes: n, err: err}
+			}
+		}()
+	}
+	var stop error
+	go func() {
+		defer close(results)
+		defer wg.Wait()
+		defer close(jobs)
+		for _, h := range hashes {
+			if budget != nil && left.Load() <= 0 {
+				stop = ErrBudget
+				return
+			}
+			select {
+			case jobs <- h:
+			case <-ctx.Done():
+				stop = ctx.Err()
+				return
+			}
+		}
+	}()
+
+	for c := range results {
+		fn(c)
+	}
+	if budget != nil {
+		*budget = left.Load()
+	}
+	return stop
+}
+
+// passCheckpoint batches chunk states into the verify_pass bucket
+type passCheckpoint struct {
+	v       *Verifier
+	pending map[string]byte
+	last    time.Time
+}
+
+func (cp *passCheckpoint) add(c chunkCheck) {
+	if s := c.state(); s != 0 {
+		if cp.pending == nil {
+			cp.pending = make(map[string]byte)
+		}
+		cp.pending[c.hash] = s
+	}
+}
+
+// flushDue flushes once enough checks are pending or enough time passed
+func (cp *passCheckpoint) flushDue() error {
+	if len(cp.pending) < passFlushChunks && time.Since(cp.last) < passFlushInterval {
+		return nil
+	}
+	return cp.flush()
+}
+
+func (cp *passCheckpoint) flush() error {
+	cp.last = time.Now()
+	if len(cp.pending) == 0 {
+		return nil
+	}
+	err := cp.v.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(persistence.BucketVerifyPass))
+		for h, s := range cp.pending {
+			if err := b.Put([]byte(h), []byte{s}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cp.pending = nil
+	return nil
+}
+
+// loadPass returns the chunks checked by earlier runs of an unfinished pass
+func (v *Verifier) loadPass() (*chunkChecks, error) {
+	checks := newChunkChecks()
+	err := v.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistence.BucketVerifyPass)).ForEach(func(k, val []byte) error {
+			if len(val) == 1 {
+				checks.states[string(k)] = val[0]
+			}
+			return nil
+		})
+	})
+	return checks, err
+}
+
+// clearPass drops the checkpoint of a finished pass
+func (v *Verifier) clearPass() error {
+	return v.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(persistence.BucketVerifyPass)); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket([]byte(persistence.BucketVerifyPass))
+		return err
+	})
+}
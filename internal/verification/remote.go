@@ -0,0 +1,145 @@
+package verification
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/crypto"
+	sverrors "github.com/hoangsonww/backupagent/internal/errors"
+	"github.com/hoangsonww/backupagent/internal/p2p"
+	"github.com/hoangsonww/backupagent/internal/storage"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// minSealedChunk is the smallest stored chunk: a GCM nonce and tag
+const minSealedChunk = 12 + 16
+
+// ErrAttestationSignature is returned for attestations whose signature does not verify
+var ErrAttestationSignature = errors.New("attestation signature invalid")
+
+// Attestation is a verifier's signed statement of how much of a snapshot a
+// holding peer could produce when challenged on a random sample of chunks.
+type Attestation struct {
+	SnapshotID       string    `json:"snapshot_id"`
+	RepoID           string    `json:"repo_id"`
+	Holder           string    `json:"holder"`          // peer ID that was challenged
+	SnapshotSigner   string    `json:"snapshot_signer"` // key that signed the manifest
+	ManifestSum      string    `json:"manifest_sum"`    // sha256 of the manifest as served
+	ManifestMismatch bool      `json:"manifest_mismatch,omitempty"`
+	TotalChunks      int       `json:"total_chunks"`
+	Sampled          int       `json:"sampled"`
+	Intact           int       `json:"intact"` // matched the verifier's copy or decrypted to the chunk hash
+	Opaque           int       `json:"opaque"` // returned and well formed, but not checkable by the verifier
+	Missing          []string  `json:"missing,omitempty"`
+	Corrupt          []string  `json:"corrupt,omitempty"`
+	Passed           bool      `json:"passed"`
+	VerifiedAt       time.Time `json:"verified_at"`
+	Verifier         string    `json:"verifier"` // base64 Ed25519 key of the verifier
+	Signature        string    `json:"signature"`
+}
+
+// SampleChunks picks up to n distinct chunk hashes of snap at random. n <= 0
+// picks every chunk.
+func SampleChunks(snap *versioning.Snapshot, n int) []string {
+	seen := make(map[string]bool, len(snap.Chunks))
+	var unique []string
+	for _, hash := range snap.Chunks {
+		if !seen[hash] {
+			seen[hash] = true
+			unique = append(unique, hash)
+		}
+	}
+	rand.Shuffle(len(unique), func(i, j int) { unique[i], unique[j] = unique[j], unique[i] })
+	if n > 0 && n < len(unique) {
+		unique = unique[:n]
+	}
+	return unique
+}
+
+// CheckSample judges the chunks a holder returned. A chunk is intact when it
+// is byte for byte the verifier's own copy, or when the verifier's key
+// decrypts it to content matching its hash. Chunks are replicated as stored,
+// so one differing from the verifier's copy that it cannot open is corrupt.
+// local is the verifier's copy of the manifest, if any.
+func CheckSample(holder string, sample *p2p.SampleResult, store *storage.Store, local *versioning.Snapshot) *Attestation {
+	snap := sample.Snapshot
+	manifest, _ := json.Marshal(snap)
+	sum := sha256.Sum256(manifest)
+
+	at := &Attestation{
+		SnapshotID:     snap.ID,
+		RepoID:         snap.RepoID,
+		Holder:         holder,
+		SnapshotSigner: snap.SignerPub,
+		ManifestSum:    hex.EncodeToString(sum[:]),
+		TotalChunks:    len(snap.Chunks),
+		Sampled:        len(sample.Requested),
+		VerifiedAt:     time.Now().UTC(),
+	}
+	if local != nil && local.Signature != snap.Signature {
+		at.ManifestMismatch = true
+	}
+
+	for _, hash := range sample.Requested {
+		data, ok := sample.Chunks[hash]
+		if !ok {
+			at.Missing = append(at.Missing, hash)
+			continue
+		}
+		if len(data) < minSealedChunk {
+			at.Corrupt = append(at.Corrupt, hash)
+			continue
+		}
+		ours, err := store.Get(hash)
+		if err == nil && bytes.Equal(ours, data) {
+			at.Intact++
+			continue
+		}
+		_, openErr := store.Open(hash, data)
+		switch {
+		case openErr == nil:
+			at.Intact++
+		case sverrors.GetErrorCode(openErr) == sverrors.ErrCodeChunkInvalid || err == nil:
+			at.Corrupt = append(at.Corrupt, hash)
+		default:
+			at.Opaque++
+		}
+	}
+
+	at.Passed = !at.ManifestMismatch && len(at.Missing) == 0 && len(at.Corrupt) == 0
+	return at
+}
+
+// Sign stamps the attestation with the verifier's key.
+func (at *Attestation) Sign(pub, priv []byte) {
+	at.Verifier = base64.StdEncoding.EncodeToString(pub)
+	at.Signature = base64.StdEncoding.EncodeToString(crypto.Sign(at.payload(), priv))
+}
+
+// Verify checks the attestation was signed by the key it names.
+func (at *Attestation) Verify() error {
+	pub, err := base64.StdEncoding.DecodeString(at.Verifier)
+	if err != nil {
+		return fmt.Errorf("%w: bad verifier key: %v", ErrAttestationSignature, err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(at.Signature)
+	if err != nil || len(pub) != 32 || !crypto.Verify(at.payload(), sig, pub) {
+		return ErrAttestationSignature
+	}
+	return nil
+}
+
+// payload is the attestation as signed, without its signature
+func (at *Attestation) payload() []byte {
+	unsigned := *at
+	unsigned.Signature = ""
+	data, _ := json.Marshal(&unsigned)
+	return data
+}
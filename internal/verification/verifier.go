@@ -1,10 +1,8 @@
 package verification
 
 import (
-	"encoding/hex"
-	"fmt"
+	"context"
 
-	"github.com/hoangsonww/backupagent/internal/crypto"
 	sverrors "github.com/hoangsonww/backupagent/internal/errors"
 	"github.com/hoangsonww/backupagent/internal/monitoring"
 	"github.com/hoangsonww/backupagent/internal/persistence"
@@ -14,14 +12,14 @@ import (
 
 // VerificationResult contains the results of a backup verification
 type VerificationResult struct {
-	SnapshotID      string
-	TotalChunks     int
-	VerifiedChunks  int
-	MissingChunks   []string
-	CorruptedChunks []string
-	SignatureValid  bool
-	Errors          []error
-	Success         bool
+	SnapshotID      string   `json:"snapshot_id"`
+	TotalChunks     int      `json:"total_chunks"`
+	VerifiedChunks  int      `json:"verified_chunks"`
+	MissingChunks   []string `json:"missing_chunks"`
+	CorruptedChunks []string `json:"corrupted_chunks"`
+	SignatureValid  bool     `json:"signature_valid"`
+	Errors          []error  `json:"-"`
+	Success         bool     `json:"success"`
 }
 
 // Verifier handles backup verification and integrity checking
@@ -42,17 +40,10 @@ func NewVerifier(db *persistence.DB, store *storage.Store) *Verifier {
 	}
 }
 
-// VerifySnapshot performs a complete verification of a snapshot
+// VerifySnapshot performs a complete verification of a snapshot, checking
+// its chunks in parallel
 func (v *Verifier) VerifySnapshot(snapshotID string) (*VerificationResult, error) {
-	logger := v.logger.WithField("snapshot_id", snapshotID)
-	logger.Info("Starting snapshot verification")
-
-	result := &VerificationResult{
-		SnapshotID:      snapshotID,
-		MissingChunks:   make([]string, 0),
-		CorruptedChunks: make([]string, 0),
-		Errors:          make([]error, 0),
-	}
+	v.logger.WithField("snapshot_id", snapshotID).Info("Starting snapshot verification")
 
 	// Load snapshot
 	snapshot, err := versioning.LoadSnapshot(v.db, snapshotID)
@@ -64,7 +55,27 @@ func (v *Verifier) VerifySnapshot(snapshotID string) (*VerificationResult, error
 		)
 	}
 
-	result.TotalChunks = len(snapshot.Chunks)
+	checks := newChunkChecks()
+	err = v.checkChunks(context.Background(), snapshot.Chunks, 0, nil, func(c chunkCheck) {
+		checks.add(c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.result(snapshot, checks), nil
+}
+
+// result tallies the checks of snapshot's chunks, every one of which must
+// have been checked
+func (v *Verifier) result(snapshot *versioning.Snapshot, checks *chunkChecks) *VerificationResult {
+	logger := v.logger.WithField("snapshot_id", snapshot.ID)
+	result := &VerificationResult{
+		SnapshotID:      snapshot.ID,
+		TotalChunks:     len(snapshot.Chunks),
+		MissingChunks:   make([]string, 0),
+		CorruptedChunks: make([]string, 0),
+		Errors:          make([]error, 0),
+	}
 
 	// Verify snapshot signature
 	result.SignatureValid = v.verifySignature(snapshot)
@@ -74,26 +85,27 @@ func (v *Verifier) VerifySnapshot(snapshotID string) (*VerificationResult, error
 		logger.Error("Snapshot signature verification failed")
 	}
 
-	// Verify each chunk
 	for _, chunkHash := range snapshot.Chunks {
-		if err := v.verifyChunk(chunkHash); err != nil {
-			if sverrors.GetErrorCode(err) == sverrors.ErrCodeChunkNotFound {
-				result.MissingChunks = append(result.MissingChunks, chunkHash)
-				logger.Warnf("Missing chunk: %s", chunkHash)
-			} else {
-				result.CorruptedChunks = append(result.CorruptedChunks, chunkHash)
-				logger.Warnf("Corrupted chunk: %s", chunkHash)
-			}
-			result.Errors = append(result.Errors, err)
-		} else {
+		state, err := checks.get(chunkHash)
+		switch state {
+		case chunkOK:
 			result.VerifiedChunks++
+			continue
+		case chunkMissing:
+			result.MissingChunks = append(result.MissingChunks, chunkHash)
+			logger.Warnf("Missing chunk: %s", chunkHash)
+		case chunkCorrupt:
+			result.CorruptedChunks = append(result.CorruptedChunks, chunkHash)
+			logger.Warnf("Corrupted chunk: %s", chunkHash)
+		default:
+			// Neither missing nor corrupt: the chunk could not be read
+			logger.WithError(err).Errorf("Failed to read chunk: %s", chunkHash)
 		}
+		result.Errors = append(result.Errors, err)
 	}
 
 	// Determine overall success
-	result.Success = result.SignatureValid &&
-		len(result.MissingChunks) == 0 &&
-		len(result.CorruptedChunks) == 0
+	result.Success = result.SignatureValid && len(result.Errors) == 0
 
 	logger.WithFields(map[string]interface{}{
 		"total_chunks":     result.TotalChunks,
@@ -104,7 +116,7 @@ func (v *Verifier) VerifySnapshot(snapshotID string) (*VerificationResult, error
 		"success":          result.Success,
 	}).Info("Snapshot verification completed")
 
-	return result, nil
+	return result
 }
 
 // verifySignature verifies the snapshot signature
@@ -116,60 +128,36 @@ func (v *Verifier) verifySignature(snapshot *versioning.Snapshot) bool {
 	return true
 }
 
-// verifyChunk verifies a single chunk's integrity
-func (v *Verifier) verifyChunk(chunkHash string) error {
+// verifyChunk verifies a single chunk's integrity and returns the bytes it
+// read
+func (v *Verifier) verifyChunk(chunkHash string) (int, error) {
 	logger := v.logger.WithField("chunk_hash", chunkHash)
 
-	// Get encrypted chunk data
+	// Get encrypted chunk data; the store tells missing chunks from I/O
+	// failures by code
 	data, err := v.store.Get(chunkHash)
 	if err != nil {
-		return sverrors.NewChunkNotFoundError(chunkHash)
+		return 0, err
 	}
 
-	// Verify hash of encrypted data matches
-	actualHash := hex.EncodeToString(crypto.Hash(data))
-	if actualHash != chunkHash {
-		logger.Errorf("Chunk hash mismatch: expected %s, got %s", chunkHash, actualHash)
-		return sverrors.WrapError(
-			sverrors.ErrCodeChunkInvalid,
-			"chunk hash mismatch",
-			fmt.Errorf("expected %s, got %s", chunkHash, actualHash),
-		)
+	// Chunks are addressed by the hash of their plaintext, so decrypt and
+	// hash that
+	if _, err := v.store.Open(chunkHash, data); err != nil {
+		logger.WithError(err).Error("Chunk failed to open")
+		return len(data), err
 	}
 
-	// Verify chunk can be decrypted
-	_, err = v.store.GetChunk(chunkHash)
-	if err != nil {
-		logger.WithError(err).Error("Chunk decryption failed")
-		return sverrors.WrapError(
-			sverrors.ErrCodeChunkInvalid,
-			"chunk decryption failed",
-			err,
-		)
-	}
-
-	return nil
+	return len(data), nil
 }
 
-// VerifyAllSnapshots verifies all snapshots in the database
-func (v *Verifier) VerifyAllSnapshots() ([]*VerificationResult, error) {
+// VerifyAllSnapshots verifies all snapshots in the database as one pass;
+// see VerifySnapshots
+func (v *Verifier) VerifyAllSnapshots(ctx context.Context, opts PassOptions) (*PassResult, error) {
 	snapshots, err := versioning.ListAllSnapshots(v.db)
 	if err != nil {
 		return nil, err
 	}
-
-	results := make([]*VerificationResult, 0, len(snapshots))
-
-	for _, snapshot := range snapshots {
-		result, err := v.VerifySnapshot(snapshot.ID)
-		if err != nil {
-			v.logger.WithError(err).Errorf("Failed to verify snapshot %s", snapshot.ID)
-			continue
-		}
-		results = append(results, result)
-	}
-
-	return results, nil
+	return v.VerifySnapshots(ctx, snapshots, opts)
 }
 
 // QuickCheck performs a quick integrity check without full verification
@@ -231,10 +219,11 @@ func (v *Verifier) RepairSnapshot(snapshotID string, fetchFunc func(string) erro
 
 // GetVerificationReport generates a comprehensive verification report
 func (v *Verifier) GetVerificationReport() (map[string]interface{}, error) {
-	results, err := v.VerifyAllSnapshots()
+	pass, err := v.VerifyAllSnapshots(context.Background(), PassOptions{})
 	if err != nil {
 		return nil, err
 	}
+	results := pass.Snapshots
 
 	totalSnapshots := len(results)
 	validSnapshots := 0
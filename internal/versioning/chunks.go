@@ -0,0 +1,97 @@
+package versioning
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hoangsonww/backupagent/internal/chunklist"
+)
+
+// Chunk list encodings of a snapshot record
+const (
+	// ChunksPlain is the original JSON array of hex hashes
+	ChunksPlain = ""
+	// ChunksPacked is the chunklist binary form under "chunk_runs"
+	ChunksPacked = "runs"
+)
+
+// plainSnapshot is the record layout with a JSON array of chunk hashes. Field
+// order matters: it is the byte layout older snapshots were signed over.
+type plainSnapshot struct {
+	ID            string            `json:"id"`
+	Parent        string            `json:"parent,omitempty"`
+	Timestamp     Timestamp         `json:"timestamp"`
+	Chunks        []string          `json:"chunks"`
+	Meta          map[string]string `json:"meta"`
+	SealedMeta    string            `json:"sealed_meta,omitempty"`
+	SignerPub     string            `json:"signer_pub"`
+	RepoID        string            `json:"repo_id,omitempty"`
+	Signature     string            `json:"signature"`
+	SchemaVersion int               `json:"schema_version,omitempty"`
+}
+
+// packedSnapshot is the record layout with a packed chunk list
+type packedSnapshot struct {
+	ID            string            `json:"id"`
+	Parent        string            `json:"parent,omitempty"`
+	Timestamp     Timestamp         `json:"timestamp"`
+	ChunkRuns     []byte            `json:"chunk_runs"`
+	Meta          map[string]string `json:"meta"`
+	SealedMeta    string            `json:"sealed_meta,omitempty"`
+	SignerPub     string            `json:"signer_pub"`
+	RepoID        string            `json:"repo_id,omitempty"`
+	Signature     string            `json:"signature"`
+	SchemaVersion int               `json:"schema_version,omitempty"`
+}
+
+// MarshalJSON encodes the chunk list as ChunkEncoding says, so a decoded
+// snapshot re-encodes to the bytes it was signed over.
+func (s Snapshot) MarshalJSON() ([]byte, error) {
+	if s.ChunkEncoding == ChunksPacked {
+		runs, ok := chunklist.Encode(s.Chunks)
+		if !ok {
+			return nil, fmt.Errorf("snapshot %s: chunk list cannot be packed", s.ID)
+		}
+		return json.Marshal(packedSnapshot{
+			ID: s.ID, Parent: s.Parent, Timestamp: s.Timestamp, ChunkRuns: runs, Meta: s.Meta, SealedMeta: s.SealedMeta,
+			SignerPub: s.SignerPub, RepoID: s.RepoID, Signature: s.Signature, SchemaVersion: s.SchemaVersion,
+		})
+	}
+	return json.Marshal(plainSnapshot{
+		ID: s.ID, Parent: s.Parent, Timestamp: s.Timestamp, Chunks: s.Chunks, Meta: s.Meta, SealedMeta: s.SealedMeta,
+		SignerPub: s.SignerPub, RepoID: s.RepoID, Signature: s.Signature, SchemaVersion: s.SchemaVersion,
+	})
+}
+
+// UnmarshalJSON accepts both chunk list encodings.
+func (s *Snapshot) UnmarshalJSON(data []byte) error {
+	var rec struct {
+		plainSnapshot
+		ChunkRuns []byte `json:"chunk_runs"`
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+	p := rec.plainSnapshot
+	*s = Snapshot{
+		ID: p.ID, Parent: p.Parent, Timestamp: p.Timestamp, Chunks: p.Chunks, Meta: p.Meta, SealedMeta: p.SealedMeta,
+		SignerPub: p.SignerPub, RepoID: p.RepoID, Signature: p.Signature, SchemaVersion: p.SchemaVersion,
+	}
+	if rec.ChunkRuns != nil {
+		chunks, err := chunklist.Decode(rec.ChunkRuns)
+		if err != nil {
+			return fmt.Errorf("snapshot %s: %w", p.ID, err)
+		}
+		s.Chunks = chunks
+		s.ChunkEncoding = ChunksPacked
+	}
+	return nil
+}
+
+// PackChunks selects the packed chunk list encoding when every hash allows
+// it. It must be called before the snapshot is signed.
+func (s *Snapshot) PackChunks() {
+	if chunklist.Packable(s.Chunks) {
+		s.ChunkEncoding = ChunksPacked
+	}
+}
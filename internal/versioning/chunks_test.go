@@ -0,0 +1,46 @@
+package versioning_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+func TestSnapshotKeepsChunkEncoding(t *testing.T) {
+	// A record written before packing must re-encode to the signed bytes
+	legacy := `{"id":"s1","timestamp":"2024-03-01T10:00:00Z","chunks":["aa","bb"],"meta":null,"signer_pub":"k","signature":"sig"}`
+	var snap versioning.Snapshot
+	if err := json.Unmarshal([]byte(legacy), &snap); err != nil {
+		t.Fatal(err)
+	}
+	out, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != legacy {
+		t.Errorf("legacy record re-encoded as %s", out)
+	}
+
+	snap.Chunks = []string{strings.Repeat("ab", 32), strings.Repeat("cd", 32), strings.Repeat("ab", 32)}
+	snap.PackChunks()
+	if snap.ChunkEncoding != versioning.ChunksPacked {
+		t.Fatal("hex chunk list not packed")
+	}
+	out, err = json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), `"chunks"`) {
+		t.Errorf("packed record still has a plain list: %s", out)
+	}
+	var back versioning.Snapshot
+	if err := json.Unmarshal(out, &back); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back, snap) {
+		t.Errorf("round trip: got %+v, want %+v", back, snap)
+	}
+}
@@ -0,0 +1,209 @@
+package versioning
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/fspath"
+)
+
+// ErrBadFileManifest is returned for a file manifest that does not fit its
+// snapshot: paths escaping the restore target or spans that do not tile the
+// chunk list.
+var ErrBadFileManifest = errors.New("invalid file manifest")
+
+// ErrFileNotInSnapshot is returned for a path a snapshot did not record.
+var ErrFileNotInSnapshot = errors.New("file not in snapshot")
+
+// metaFiles is the metadata key of the file manifest, so it is sealed and
+// signed along with the rest of the metadata
+const metaFiles = "files"
+
+// SourcePath is the Path of the only entry of a snapshot whose source is a
+// single file.
+const SourcePath = "."
+
+// FileEntry is one file, directory or symlink of a snapshot, in walk order.
+// A file's content is the Count chunks of Snapshot.Chunks starting at First.
+type FileEntry struct {
+	Path     string            `json:"path"`               // slash-separated, relative to the source, NFC as fspath.Key
+	Original string            `json:"original,omitempty"` // exact bytes of Path, as fspath.Original, if they differ
+	Mode     fs.FileMode       `json:"mode"`               // permission, setuid, setgid and sticky bits, fs.ModeDir or fs.ModeSymlink
+	Size     int64             `json:"size,omitempty"`
+	ModTime  time.Time         `json:"mtime,omitempty"`
+	First    int               `json:"first,omitempty"`
+	Count    int               `json:"count,omitempty"`
+	Owner    *FileOwner        `json:"owner,omitempty"`  // nil where the platform has no numeric owners
+	Link     string            `json:"link,omitempty"`   // target of a symlink, as read
+	Xattrs   map[string][]byte `json:"xattrs,omitempty"` // extended attributes by name
+	Sparse   bool              `json:"sparse,omitempty"` // the file had holes; runs of zeros are restored as holes
+
+	// Hardlink is the Path of an earlier file of the manifest this one was
+	// a hard link to. It still has its own span, the same chunks, so it can
+	// be restored alone.
+	Hardlink string `json:"hardlink,omitempty"`
+
+	// From is the earlier snapshot, along the parent chain, that first
+	// recorded this content; empty when this snapshot did
+	From string `json:"from,omitempty"`
+}
+
+// FileOwner is the owner of a file on the system it was read on, with the
+// account names when they could be looked up, so a restore elsewhere can
+// match them.
+type FileOwner struct {
+	UID   int    `json:"uid"`
+	GID   int    `json:"gid"`
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+}
+
+// IsDir reports whether the entry is a directory.
+func (e *FileEntry) IsDir() bool {
+	return e.Mode.IsDir()
+}
+
+// IsSymlink reports whether the entry is a symlink.
+func (e *FileEntry) IsSymlink() bool {
+	return e.Mode&fs.ModeSymlink != 0
+}
+
+// SetFiles records the file manifest in the metadata. It must be called
+// before the metadata is sealed and the snapshot signed.
+func (s *Snapshot) SetFiles(files []FileEntry) error {
+	if files == nil {
+		// An empty source still has a manifest
+		files = []FileEntry{}
+	}
+	data, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+	if s.Meta == nil {
+		s.Meta = make(map[string]string)
+	}
+	s.Meta[metaFiles] = string(data)
+	return nil
+}
+
+// Files returns the file manifest, nil for snapshots that predate it and
+// metadata exports. It fails with ErrBadFileManifest unless every path stays
+// below the source and the file spans cover Chunks in order.
+func (s *Snapshot) Files() ([]FileEntry, error) {
+	enc := s.Meta[metaFiles]
+	if enc == "" {
+		return nil, nil
+	}
+	var files []FileEntry
+	if err := json.Unmarshal([]byte(enc), &files); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadFileManifest, err)
+	}
+
+	next := 0
+	regular := make(map[string]bool)
+	for i, e := range files {
+		switch {
+		case e.Path == SourcePath:
+			if len(files) != 1 || e.IsDir() {
+				return nil, fmt.Errorf("%w: %q only names a single-file source", ErrBadFileManifest, e.Path)
+			}
+		case path.Clean(e.Path) != e.Path || !filepath.IsLocal(filepath.FromSlash(e.Path)):
+			return nil, fmt.Errorf("%w: path %q", ErrBadFileManifest, e.Path)
+		}
+		if e.IsDir() || e.IsSymlink() {
+			if e.Count != 0 {
+				return nil, fmt.Errorf("%w: %q has chunks", ErrBadFileManifest, e.Path)
+			}
+			if e.IsSymlink() && e.Link == "" {
+				return nil, fmt.Errorf("%w: symlink %q has no target", ErrBadFileManifest, e.Path)
+			}
+			if e.Hardlink != "" {
+				return nil, fmt.Errorf("%w: %q is a hard link but not a file", ErrBadFileManifest, e.Path)
+			}
+			continue
+		}
+		if e.First != next || e.Count < 0 {
+			return nil, fmt.Errorf("%w: entry %d spans chunks %d+%d, expected to start at %d", ErrBadFileManifest, i, e.First, e.Count, next)
+		}
+		next += e.Count
+		if e.Hardlink != "" {
+			if !regular[e.Hardlink] {
+				return nil, fmt.Errorf("%w: %q is a hard link to %q, not an earlier file", ErrBadFileManifest, e.Path, e.Hardlink)
+			}
+			continue
+		}
+		regular[e.Path] = true
+	}
+	if next != len(s.Chunks) {
+		return nil, fmt.Errorf("%w: files cover %d of %d chunks", ErrBadFileManifest, next, len(s.Chunks))
+	}
+	return files, nil
+}
+
+// File returns the manifest entry of name, slash-separated and relative to
+// the source. The only file of a single-file source is found as SourcePath
+// or by its own name. It fails with ErrFileNotInSnapshot when the manifest
+// lacks name or the snapshot has none.
+func (s *Snapshot) File(name string) (*FileEntry, error) {
+	files, err := s.Files()
+	if err != nil {
+		return nil, err
+	}
+	if files == nil {
+		return nil, fmt.Errorf("%w: snapshot %s has no file manifest", ErrFileNotInSnapshot, s.ID)
+	}
+	key := fspath.Key(path.Clean(filepath.ToSlash(name)))
+	if len(files) == 1 && files[0].Path == SourcePath && key == fspath.Key(filepath.Base(s.OriginalSource())) {
+		key = SourcePath
+	}
+	for i := range files {
+		if files[i].Path == key {
+			return &files[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s has no %q", ErrFileNotInSnapshot, s.ID, name)
+}
+
+// Span returns the chunks holding the content of e, a file of s.
+func (s *Snapshot) Span(e *FileEntry) []string {
+	return s.Chunks[e.First : e.First+e.Count]
+}
+
+// InheritFiles sets From on every file of files whose content, by path, size
+// and chunks, is unchanged since parent, whose own manifest is parentFiles.
+func InheritFiles(files []FileEntry, chunks []string, parent *Snapshot, parentFiles []FileEntry) {
+	prev := make(map[string]*FileEntry, len(parentFiles))
+	for i := range parentFiles {
+		if !parentFiles[i].IsDir() && !parentFiles[i].IsSymlink() {
+			prev[parentFiles[i].Path] = &parentFiles[i]
+		}
+	}
+	for i := range files {
+		e := &files[i]
+		p := prev[e.Path]
+		if e.IsDir() || e.IsSymlink() || p == nil || p.Size != e.Size || p.Count != e.Count {
+			continue
+		}
+		if !equalChunks(chunks[e.First:e.First+e.Count], parent.Chunks[p.First:p.First+p.Count]) {
+			continue
+		}
+		e.From = p.From
+		if e.From == "" {
+			e.From = parent.ID
+		}
+	}
+}
+
+func equalChunks(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
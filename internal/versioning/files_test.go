@@ -0,0 +1,132 @@
+package versioning_test
+
+import (
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+func TestFileManifest(t *testing.T) {
+	files := []versioning.FileEntry{
+		{Path: "docs", Mode: fs.ModeDir | 0755},
+		{Path: "docs/a.txt", Mode: 0644, Size: 10, First: 0, Count: 2, Owner: &versioning.FileOwner{UID: 1000, GID: 100, User: "alice", Group: "users"}},
+		{Path: "docs/empty", Mode: 0600, First: 2},
+		{Path: "run.sh", Mode: 0755 | fs.ModeSetuid, Size: 3, ModTime: time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC), First: 2, Count: 1, From: "s0", Xattrs: map[string][]byte{"user.origin": {0, 1, 0xFF}}},
+		{Path: "latest", Mode: fs.ModeSymlink | 0777, Link: "docs/a.txt"},
+		{Path: "vm.img", Mode: 0644, Size: 10, First: 3, Count: 2, Sparse: true},
+		{Path: "vm-link.img", Mode: 0644, Size: 10, First: 5, Count: 2, Sparse: true, Hardlink: "vm.img"},
+	}
+	snap := &versioning.Snapshot{ID: "s1", Chunks: []string{"a", "b", "c", "z", "d", "z", "d"}, Meta: map[string]string{"source": "/data"}}
+	if err := snap.SetFiles(files); err != nil {
+		t.Fatal(err)
+	}
+	got, err := snap.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, files) {
+		t.Errorf("Files() = %+v, want %+v", got, files)
+	}
+	if snap.Source() != "/data" {
+		t.Errorf("SetFiles changed the source to %q", snap.Source())
+	}
+
+	legacy := &versioning.Snapshot{ID: "s0", Chunks: []string{"a"}}
+	if got, err := legacy.Files(); got != nil || err != nil {
+		t.Errorf("Files() of a snapshot without manifest = %v, %v", got, err)
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	snap := &versioning.Snapshot{ID: "s1", Chunks: []string{"a", "b", "c"}}
+	if err := snap.SetFiles([]versioning.FileEntry{
+		{Path: "docs", Mode: fs.ModeDir | 0755},
+		{Path: "docs/a.txt", Mode: 0644, Size: 10, First: 0, Count: 2},
+		{Path: "b.txt", Mode: 0644, Size: 3, First: 2, Count: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	e, err := snap.File("./docs//a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Path != "docs/a.txt" || !reflect.DeepEqual(snap.Span(e), []string{"a", "b"}) {
+		t.Errorf("File() = %+v with chunks %v", e, snap.Span(e))
+	}
+	if _, err := snap.File("docs/missing"); !errors.Is(err, versioning.ErrFileNotInSnapshot) {
+		t.Errorf("File() of a missing path: %v, want ErrFileNotInSnapshot", err)
+	}
+
+	single := &versioning.Snapshot{ID: "s2", Chunks: []string{"x"}, Meta: map[string]string{"source": "/etc/hosts"}}
+	if err := single.SetFiles([]versioning.FileEntry{{Path: versioning.SourcePath, Mode: 0644, Size: 1, Count: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{".", "hosts"} {
+		if e, err := single.File(name); err != nil || e.Path != versioning.SourcePath {
+			t.Errorf("File(%q) of a single-file snapshot = %+v, %v", name, e, err)
+		}
+	}
+
+	legacy := &versioning.Snapshot{ID: "s0", Chunks: []string{"a"}}
+	if _, err := legacy.File("a"); !errors.Is(err, versioning.ErrFileNotInSnapshot) {
+		t.Errorf("File() without manifest: %v, want ErrFileNotInSnapshot", err)
+	}
+}
+
+func TestInheritFiles(t *testing.T) {
+	parent := &versioning.Snapshot{ID: "s1", Chunks: []string{"a", "b", "c"}}
+	parentFiles := []versioning.FileEntry{
+		{Path: "kept", Mode: 0644, Size: 2, First: 0, Count: 1},
+		{Path: "old", Mode: 0644, Size: 2, First: 1, Count: 1, From: "s0"},
+		{Path: "edited", Mode: 0644, Size: 2, First: 2, Count: 1},
+	}
+	files := []versioning.FileEntry{
+		{Path: "dir", Mode: fs.ModeDir | 0755},
+		{Path: "edited", Mode: 0644, Size: 2, First: 0, Count: 1},
+		{Path: "kept", Mode: 0600, Size: 2, First: 1, Count: 1},
+		{Path: "new", Mode: 0644, Size: 2, First: 2, Count: 1},
+		{Path: "old", Mode: 0644, Size: 2, First: 3, Count: 1},
+	}
+	versioning.InheritFiles(files, []string{"x", "a", "b", "b"}, parent, parentFiles)
+
+	want := map[string]string{"dir": "", "edited": "", "kept": "s1", "new": "", "old": "s0"}
+	for _, e := range files {
+		if e.From != want[e.Path] {
+			t.Errorf("%s: From = %q, want %q", e.Path, e.From, want[e.Path])
+		}
+	}
+}
+
+func TestFileManifestRejected(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []versioning.FileEntry
+	}{
+		{"escapes source", []versioning.FileEntry{{Path: "../etc/passwd", Mode: 0644, Count: 1}}},
+		{"absolute", []versioning.FileEntry{{Path: "/etc/passwd", Mode: 0644, Count: 1}}},
+		{"unclean", []versioning.FileEntry{{Path: "a//b", Mode: 0644, Count: 1}}},
+		{"gap in spans", []versioning.FileEntry{{Path: "a", Mode: 0644, First: 1, Count: 1}}},
+		{"too few chunks", []versioning.FileEntry{{Path: "a", Mode: 0644, Count: 2}}},
+		{"source path among others", []versioning.FileEntry{{Path: ".", Mode: 0644, Count: 1}, {Path: "b", Mode: 0644}}},
+		{"symlink with chunks", []versioning.FileEntry{{Path: "a", Mode: fs.ModeSymlink | 0777, Link: "b", Count: 1}}},
+		{"symlink without target", []versioning.FileEntry{{Path: "a", Mode: fs.ModeSymlink | 0777}, {Path: "b", Mode: 0644, Count: 1}}},
+		{"hard link to later file", []versioning.FileEntry{{Path: "a", Mode: 0644, Hardlink: "b"}, {Path: "b", Mode: 0644, Count: 1}}},
+		{"hard link to directory", []versioning.FileEntry{{Path: "a", Mode: fs.ModeDir | 0755}, {Path: "b", Mode: 0644, Count: 1, Hardlink: "a"}}},
+		{"hard linked symlink", []versioning.FileEntry{{Path: "a", Mode: 0644, Count: 1}, {Path: "b", Mode: fs.ModeSymlink | 0777, Link: "a", Hardlink: "a"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snap := &versioning.Snapshot{ID: "s1", Chunks: []string{"a"}}
+			if err := snap.SetFiles(tt.files); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := snap.Files(); !errors.Is(err, versioning.ErrBadFileManifest) {
+				t.Errorf("Files() error = %v, want ErrBadFileManifest", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package versioning
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrSnapshotHeld is returned when deleting a snapshot under a hold.
+var ErrSnapshotHeld = errors.New("snapshot is held")
+
+// Hold keeps a snapshot from being deleted, by retention or otherwise,
+// until it is released: a legal hold, or a restore point known to be good.
+type Hold struct {
+	SnapshotID string    `json:"snapshot_id"`
+	Reason     string    `json:"reason,omitempty"`
+	Since      time.Time `json:"since"`
+}
+
+// PlaceHold holds snapshot id for reason. Holding a held snapshot again
+// replaces the reason but keeps the time it was first held.
+func PlaceHold(db *persistence.DB, id, reason string) (*Hold, error) {
+	h := &Hold{SnapshotID: id, Reason: reason, Since: time.Now().UTC()}
+	err := db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(persistence.BucketSnapshots)).Get([]byte(id)) == nil {
+			return fmt.Errorf("%w: %s", ErrSnapshotNotFound, id)
+		}
+		b := tx.Bucket([]byte(persistence.BucketHolds))
+		if v := b.Get([]byte(id)); v != nil {
+			var old Hold
+			if err := json.Unmarshal(v, &old); err == nil {
+				h.Since = old.Since
+			}
+		}
+		data, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// ReleaseHold lifts the hold on snapshot id, reporting whether it was held.
+func ReleaseHold(db *persistence.DB, id string) (bool, error) {
+	held := false
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(persistence.BucketHolds))
+		held = b.Get([]byte(id)) != nil
+		return b.Delete([]byte(id))
+	})
+	return held, err
+}
+
+// ListHolds returns every hold, oldest first.
+func ListHolds(db *persistence.DB) ([]Hold, error) {
+	var holds []Hold
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistence.BucketHolds)).ForEach(func(k, v []byte) error {
+			var h Hold
+			if err := json.Unmarshal(v, &h); err != nil {
+				return fmt.Errorf("hold on %s: %w", k, err)
+			}
+			holds = append(holds, h)
+			return nil
+		})
+	})
+	sort.Slice(holds, func(i, j int) bool { return holds[i].Since.Before(holds[j].Since) })
+	return holds, err
+}
+
+// isHeld reports whether snapshot id is under a hold
+func isHeld(tx *bolt.Tx, id string) bool {
+	return tx.Bucket([]byte(persistence.BucketHolds)).Get([]byte(id)) != nil
+}
@@ -0,0 +1,55 @@
+package versioning_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+func TestHoldBlocksDeletion(t *testing.T) {
+	db, err := persistence.Open(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := versioning.PlaceHold(db, "missing", ""); !errors.Is(err, versioning.ErrSnapshotNotFound) {
+		t.Fatalf("holding a missing snapshot = %v", err)
+	}
+	if err := versioning.SaveSnapshot(db, &versioning.Snapshot{ID: "s1", Chunks: []string{"aa"}}); err != nil {
+		t.Fatal(err)
+	}
+	first, err := versioning.PlaceHold(db, "s1", "case 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := versioning.PlaceHold(db, "s1", "case 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Since.Equal(first.Since) || again.Reason != "case 2" {
+		t.Errorf("held again: %+v, want the reason replaced and the time kept from %+v", again, first)
+	}
+
+	if err := versioning.DeleteSnapshot(db, "s1"); !errors.Is(err, versioning.ErrSnapshotHeld) {
+		t.Fatalf("deleting a held snapshot = %v", err)
+	}
+	if _, err := versioning.LoadSnapshot(db, "s1"); err != nil {
+		t.Fatalf("held snapshot gone: %v", err)
+	}
+	if holds, err := versioning.ListHolds(db); err != nil || len(holds) != 1 || holds[0].SnapshotID != "s1" {
+		t.Fatalf("ListHolds = %+v, %v", holds, err)
+	}
+
+	if held, err := versioning.ReleaseHold(db, "s1"); !held || err != nil {
+		t.Fatalf("ReleaseHold = %v, %v", held, err)
+	}
+	if held, err := versioning.ReleaseHold(db, "s1"); held || err != nil {
+		t.Fatalf("releasing twice = %v, %v", held, err)
+	}
+	if err := versioning.DeleteSnapshot(db, "s1"); err != nil {
+		t.Fatalf("deleting a released snapshot = %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package versioning
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// ErrMetaSealed means the metadata of a snapshot is sealed under a key we
+// do not hold.
+var ErrMetaSealed = errors.New("snapshot metadata is sealed")
+
+// SealMeta encrypts Meta into SealedMeta with seal, so peers hosting the
+// snapshot see neither its paths nor its host. It must be called before the
+// snapshot is signed.
+func (s *Snapshot) SealMeta(seal func(plaintext []byte) ([]byte, error)) error {
+	data, err := json.Marshal(s.Meta)
+	if err != nil {
+		return err
+	}
+	sealed, err := seal(data)
+	if err != nil {
+		return err
+	}
+	s.SealedMeta = base64.StdEncoding.EncodeToString(sealed)
+	return nil
+}
+
+// OpenMeta restores Meta from SealedMeta with open, e.g. for a snapshot of
+// our own repository received back from a peer. Snapshots whose metadata is
+// not sealed are left as they are.
+func (s *Snapshot) OpenMeta(open func(sealed []byte) ([]byte, error)) error {
+	if s.SealedMeta == "" || s.Meta != nil {
+		return nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(s.SealedMeta)
+	if err != nil {
+		return err
+	}
+	data, err := open(sealed)
+	if err != nil {
+		return errors.Join(ErrMetaSealed, err)
+	}
+	var meta map[string]string
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return err
+	}
+	s.Meta = meta
+	return nil
+}
+
+// SignedMeta returns the metadata the signature covers: Meta, or nothing
+// when it is sealed.
+func (s *Snapshot) SignedMeta() map[string]string {
+	if s.SealedMeta != "" {
+		return nil
+	}
+	return s.Meta
+}
+
+// Public returns the snapshot as peers may see it, without the owner's copy
+// of sealed metadata.
+func (s *Snapshot) Public() *Snapshot {
+	if s.SealedMeta == "" || s.Meta == nil {
+		return s
+	}
+	pub := *s
+	pub.Meta = nil
+	return &pub
+}
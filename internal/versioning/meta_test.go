@@ -0,0 +1,62 @@
+package versioning_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+func TestSealedMeta(t *testing.T) {
+	xor := func(b []byte) ([]byte, error) {
+		out := make([]byte, len(b))
+		for i := range b {
+			out[i] = b[i] ^ 0x5a
+		}
+		return out, nil
+	}
+	meta := map[string]string{"source": "/home/alice/taxes", "host": "laptop"}
+	snap := &versioning.Snapshot{ID: "s1", Meta: meta}
+	if err := snap.SealMeta(xor); err != nil {
+		t.Fatal(err)
+	}
+	if snap.SignedMeta() != nil {
+		t.Error("sealed metadata is still signed in the clear")
+	}
+
+	// Peers receive the record without the owner's copy
+	out, err := json.Marshal(snap.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "alice") || strings.Contains(string(out), "laptop") {
+		t.Errorf("public record leaks metadata: %s", out)
+	}
+	if snap.Meta == nil {
+		t.Error("Public cleared the owner's metadata")
+	}
+
+	var got versioning.Snapshot
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatal(err)
+	}
+	wrongKey := func([]byte) ([]byte, error) { return nil, errors.New("authentication failed") }
+	if err := got.OpenMeta(wrongKey); !errors.Is(err, versioning.ErrMetaSealed) || got.Meta != nil {
+		t.Errorf("OpenMeta with the wrong key = %v, meta %v", err, got.Meta)
+	}
+	if err := got.OpenMeta(xor); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Meta, meta) || got.Source() != "/home/alice/taxes" {
+		t.Errorf("opened metadata = %v", got.Meta)
+	}
+
+	plain := &versioning.Snapshot{ID: "s2", Meta: meta}
+	if out, _ := json.Marshal(plain.Public()); !bytes.Contains(out, []byte("alice")) {
+		t.Errorf("unsealed record lost its metadata: %s", out)
+	}
+}
@@ -0,0 +1,86 @@
+package versioning
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	bolt "go.etcd.io/bbolt"
+)
+
+// MigrateSnapshots upgrades stored snapshot records to CurrentSchemaVersion
+// and builds the time index for them. Timestamps that no longer parse are
+// recovered from the "snap-<unix>" ID; the original text is otherwise kept
+// because it is covered by the snapshot signature. Returns the number of
+// records migrated.
+func MigrateSnapshots(db *persistence.DB) (int, error) {
+	migrated := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(persistence.BucketSnapshots))
+
+		// Collect first; bolt buckets must not be modified during ForEach
+		pending := make(map[string][]byte)
+		err := b.ForEach(func(k, v []byte) error {
+			var hdr struct {
+				SchemaVersion int `json:"schema_version"`
+			}
+			if err := json.Unmarshal(v, &hdr); err != nil {
+				return fmt.Errorf("snapshot %s: %w", k, err)
+			}
+			if hdr.SchemaVersion < CurrentSchemaVersion {
+				pending[string(k)] = append([]byte(nil), v...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for id, v := range pending {
+			fields := make(map[string]json.RawMessage)
+			if err := json.Unmarshal(v, &fields); err != nil {
+				return fmt.Errorf("snapshot %s: %w", id, err)
+			}
+			var ts Timestamp
+			if err := ts.UnmarshalJSON(fields["timestamp"]); err != nil || ts.IsZero() {
+				recovered, ok := timestampFromID(id)
+				if !ok {
+					return fmt.Errorf("snapshot %s: unrecoverable timestamp %s", id, fields["timestamp"])
+				}
+				raw, _ := recovered.MarshalJSON()
+				fields["timestamp"] = raw
+			}
+			fields["schema_version"] = json.RawMessage(strconv.Itoa(CurrentSchemaVersion))
+
+			data, err := json.Marshal(fields)
+			if err != nil {
+				return err
+			}
+			var snap Snapshot
+			if err := json.Unmarshal(data, &snap); err != nil {
+				return fmt.Errorf("snapshot %s: %w", id, err)
+			}
+			if err := b.Put([]byte(id), data); err != nil {
+				return err
+			}
+			if err := indexSnapshot(tx, &snap); err != nil {
+				return err
+			}
+			migrated++
+		}
+		return nil
+	})
+	return migrated, err
+}
+
+// timestampFromID recovers the creation time encoded in "snap-<unix>" IDs
+func timestampFromID(id string) (Timestamp, bool) {
+	secs, err := strconv.ParseInt(strings.TrimPrefix(id, "snap-"), 10, 64)
+	if err != nil || !strings.HasPrefix(id, "snap-") {
+		return Timestamp{}, false
+	}
+	return NewTimestamp(time.Unix(secs, 0)), true
+}
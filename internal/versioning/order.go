@@ -0,0 +1,95 @@
+package versioning
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+
+	"github.com/hoangsonww/backupagent/internal/persistence"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The snapshot index is keyed source || 0x00 || time || id so a cursor walks
+// each source's snapshots in creation order regardless of timezone offsets.
+
+func indexPrefix(source string) []byte {
+	return append([]byte(source), 0)
+}
+
+func indexKey(snap *Snapshot) []byte {
+	key := indexPrefix(snap.Source())
+	var ts [8]byte
+	// Flip the sign bit so pre-1970 times still sort first
+	binary.BigEndian.PutUint64(ts[:], uint64(snap.Timestamp.Time().UnixNano())^(1<<63))
+	key = append(key, ts[:]...)
+	return append(key, snap.ID...)
+}
+
+func indexSnapshot(tx *bolt.Tx, snap *Snapshot) error {
+	return tx.Bucket([]byte(persistence.BucketSnapIndex)).Put(indexKey(snap), []byte(snap.ID))
+}
+
+func unindexSnapshot(tx *bolt.Tx, snap *Snapshot) error {
+	return tx.Bucket([]byte(persistence.BucketSnapIndex)).Delete(indexKey(snap))
+}
+
+// ListSnapshotsByTime returns the snapshots of one source, oldest first.
+func ListSnapshotsByTime(db *persistence.DB, source string) ([]*Snapshot, error) {
+	var snapshots []*Snapshot
+	err := ForEachSnapshotByTime(db, source, func(snap *Snapshot) error {
+		snapshots = append(snapshots, snap)
+		return nil
+	})
+	return snapshots, err
+}
+
+// ForEachSnapshotByTime calls fn for each snapshot of source, oldest first.
+func ForEachSnapshotByTime(db *persistence.DB, source string, fn func(*Snapshot) error) error {
+	prefix := indexPrefix(source)
+	return db.View(func(tx *bolt.Tx) error {
+		snaps := tx.Bucket([]byte(persistence.BucketSnapshots))
+		c := tx.Bucket([]byte(persistence.BucketSnapIndex)).Cursor()
+		for k, id := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, id = c.Next() {
+			v := snaps.Get(id)
+			if v == nil {
+				continue
+			}
+			var snap Snapshot
+			if err := json.Unmarshal(v, &snap); err != nil {
+				return err
+			}
+			if err := fn(&snap); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LatestSnapshot returns the most recent snapshot of source.
+func LatestSnapshot(db *persistence.DB, source string) (*Snapshot, error) {
+	var latest *Snapshot
+	err := ForEachSnapshotByTime(db, source, func(snap *Snapshot) error {
+		latest = snap
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if latest == nil {
+		return nil, ErrSnapshotNotFound
+	}
+	return latest, nil
+}
+
+// SortByTime orders snapshots oldest first, breaking ties by ID.
+func SortByTime(snapshots []*Snapshot) {
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		ti, tj := snapshots[i].Timestamp.Time(), snapshots[j].Timestamp.Time()
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return snapshots[i].ID < snapshots[j].ID
+	})
+}
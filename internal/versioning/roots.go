@@ -0,0 +1,78 @@
+package versioning
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// metaRoots is the metadata key of the roots of a snapshot of several paths
+const metaRoots = "roots"
+
+// GroupPrefix starts the source of a snapshot of several paths, followed by
+// the name of their group.
+const GroupPrefix = "group:"
+
+// Root is one of the paths a snapshot of several recorded. Its files are in
+// the manifest under Name, the path without its leading separator, so
+// /etc/hosts of the roots /etc and /var/www is etc/hosts.
+type Root struct {
+	Name     string `json:"name"`               // slash-separated section of the manifest
+	Path     string `json:"path"`               // as fspath.Key
+	Original string `json:"original,omitempty"` // exact bytes of Path, as fspath.Original, if they differ
+}
+
+// GroupSource returns the source recorded for a snapshot of the paths of
+// group name, under which its snapshots form one history.
+func GroupSource(name string) string {
+	return GroupPrefix + name
+}
+
+// Group returns the name of the group a snapshot of several paths was taken
+// of, empty for a snapshot of one.
+func (s *Snapshot) Group() string {
+	if !strings.HasPrefix(s.Source(), GroupPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(s.Source(), GroupPrefix)
+}
+
+// SetRoots records the roots of a snapshot of several paths in the
+// metadata. Like SetFiles it must be called before the metadata is sealed
+// and the snapshot signed.
+func (s *Snapshot) SetRoots(roots []Root) error {
+	if len(roots) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(roots)
+	if err != nil {
+		return err
+	}
+	if s.Meta == nil {
+		s.Meta = make(map[string]string)
+	}
+	s.Meta[metaRoots] = string(data)
+	return nil
+}
+
+// Roots returns the roots of a snapshot of several paths, nil for a
+// snapshot of one. It fails with ErrBadFileManifest for a section name that
+// would escape the restore target.
+func (s *Snapshot) Roots() ([]Root, error) {
+	enc := s.Meta[metaRoots]
+	if enc == "" {
+		return nil, nil
+	}
+	var roots []Root
+	if err := json.Unmarshal([]byte(enc), &roots); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadFileManifest, err)
+	}
+	for _, r := range roots {
+		if r.Name == SourcePath || path.Clean(r.Name) != r.Name || !filepath.IsLocal(filepath.FromSlash(r.Name)) {
+			return nil, fmt.Errorf("%w: root %q", ErrBadFileManifest, r.Name)
+		}
+	}
+	return roots, nil
+}
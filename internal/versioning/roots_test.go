@@ -0,0 +1,45 @@
+package versioning_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+func TestSnapshotRoots(t *testing.T) {
+	roots := []versioning.Root{
+		{Name: "etc/nginx", Path: "/etc/nginx"},
+		{Name: "var/www", Path: "/var/www"},
+	}
+	snap := &versioning.Snapshot{ID: "s1", Meta: map[string]string{"source": versioning.GroupSource("web")}}
+	if err := snap.SetRoots(roots); err != nil {
+		t.Fatal(err)
+	}
+	got, err := snap.Roots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, roots) {
+		t.Errorf("Roots() = %+v, want %+v", got, roots)
+	}
+	if snap.Group() != "web" {
+		t.Errorf("Group() = %q, want web", snap.Group())
+	}
+
+	single := &versioning.Snapshot{ID: "s2", Meta: map[string]string{"source": "/data"}}
+	if got, err := single.Roots(); got != nil || err != nil || single.Group() != "" {
+		t.Errorf("snapshot of one path: Roots() = %v, %v; Group() = %q", got, err, single.Group())
+	}
+
+	for _, name := range []string{"../etc", "/etc", ".", "etc/../var"} {
+		bad := &versioning.Snapshot{ID: "s3"}
+		if err := bad.SetRoots([]versioning.Root{{Name: name, Path: "/etc"}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bad.Roots(); !errors.Is(err, versioning.ErrBadFileManifest) {
+			t.Errorf("Roots() with section %q: %v, want ErrBadFileManifest", name, err)
+		}
+	}
+}
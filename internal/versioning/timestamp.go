@@ -0,0 +1,101 @@
+package versioning
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// timestampLayouts are the textual formats accepted from older producers.
+var timestampLayouts = []string{
+	time.RFC3339Nano, // also matches RFC3339
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02T15:04:05", // no zone, taken as UTC
+	"2006-01-02 15:04:05",
+}
+
+// Timestamp is a snapshot creation time. It decodes RFC3339 strings with any
+// offset or precision as well as unix-second numbers, and re-encodes exactly
+// the JSON it was decoded from so signatures over stored and announced
+// snapshots keep verifying. New timestamps encode as RFC3339 in UTC.
+type Timestamp struct {
+	t   time.Time
+	raw []byte
+}
+
+// NewTimestamp returns a Timestamp for t at second precision in UTC.
+func NewTimestamp(t time.Time) Timestamp {
+	return Timestamp{t: t.UTC().Truncate(time.Second)}
+}
+
+// ParseTimestamp parses s using the accepted layouts.
+func ParseTimestamp(s string) (Timestamp, error) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return Timestamp{t: t.UTC()}, nil
+		}
+	}
+	return Timestamp{}, fmt.Errorf("unrecognized timestamp %q", s)
+}
+
+// Time returns the timestamp in UTC.
+func (ts Timestamp) Time() time.Time {
+	return ts.t
+}
+
+// IsZero reports whether the timestamp is unset.
+func (ts Timestamp) IsZero() bool {
+	return ts.t.IsZero()
+}
+
+// Before reports whether ts is earlier than other.
+func (ts Timestamp) Before(other Timestamp) bool {
+	return ts.t.Before(other.t)
+}
+
+// String returns the timestamp as RFC3339 in UTC.
+func (ts Timestamp) String() string {
+	return ts.t.Format(time.RFC3339)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (ts Timestamp) MarshalJSON() ([]byte, error) {
+	if ts.raw != nil {
+		return ts.raw, nil
+	}
+	return json.Marshal(ts.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (ts *Timestamp) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		*ts = Timestamp{}
+		return nil
+	}
+
+	var parsed Timestamp
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		p, err := ParseTimestamp(s)
+		if err != nil {
+			return err
+		}
+		parsed = p
+	} else {
+		secs, err := strconv.ParseInt(string(data), 10, 64)
+		if err != nil {
+			return fmt.Errorf("unrecognized timestamp %s", data)
+		}
+		parsed = Timestamp{t: time.Unix(secs, 0).UTC()}
+	}
+
+	parsed.raw = append([]byte(nil), data...)
+	*ts = parsed
+	return nil
+}
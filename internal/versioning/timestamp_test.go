@@ -0,0 +1,53 @@
+package versioning_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+func TestTimestampDecodesLegacyFormats(t *testing.T) {
+	want := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	inputs := []string{
+		`"2024-03-01T10:00:00Z"`,
+		`"2024-03-01T12:00:00+02:00"`,
+		`"2024-03-01T10:00:00.000000000Z"`,
+		`"2024-03-01 10:00:00"`,
+		`1709287200`,
+	}
+	for _, in := range inputs {
+		var ts versioning.Timestamp
+		if err := json.Unmarshal([]byte(in), &ts); err != nil {
+			t.Fatalf("%s: %v", in, err)
+		}
+		if !ts.Time().Equal(want) {
+			t.Errorf("%s: got %s, want %s", in, ts.Time(), want)
+		}
+		// Re-encoding must reproduce the signed bytes
+		out, err := json.Marshal(ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != in {
+			t.Errorf("round trip changed %s to %s", in, out)
+		}
+	}
+}
+
+func TestSortByTimeIgnoresOffsets(t *testing.T) {
+	var a, b versioning.Timestamp
+	// a is later in absolute time despite the smaller wall clock
+	if err := json.Unmarshal([]byte(`"2024-03-01T09:00:00-05:00"`), &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(`"2024-03-01T12:00:00Z"`), &b); err != nil {
+		t.Fatal(err)
+	}
+	snaps := []*versioning.Snapshot{{ID: "a", Timestamp: a}, {ID: "b", Timestamp: b}}
+	versioning.SortByTime(snaps)
+	if snaps[0].ID != "b" {
+		t.Errorf("expected b first, got %s", snaps[0].ID)
+	}
+}
@@ -3,29 +3,174 @@ package versioning
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
 
+	"github.com/hoangsonww/backupagent/internal/chunkindex"
+	"github.com/hoangsonww/backupagent/internal/fspath"
 	"github.com/hoangsonww/backupagent/internal/persistence"
 	bolt "go.etcd.io/bbolt"
 )
 
+// CurrentSchemaVersion is the storage schema of snapshot records. Version 2
+// introduced typed timestamps and the per-source time index.
+const CurrentSchemaVersion = 2
+
 type Snapshot struct {
-	ID        string            `json:"id"`
-	Parent    string            `json:"parent,omitempty"`
-	Timestamp string            `json:"timestamp"` // RFC3339 format
-	Chunks    []string          `json:"chunks"`    // hashes
-	Meta      map[string]string `json:"meta"`
-	SignerPub string            `json:"signer_pub"` // for authenticity
-	Signature string            `json:"signature"`
+	ID         string            `json:"id"`
+	Parent     string            `json:"parent,omitempty"`
+	Timestamp  Timestamp         `json:"timestamp"`
+	Chunks     []string          `json:"chunks"`                // hashes
+	Meta       map[string]string `json:"meta"`                  // owner-only when SealedMeta is set
+	SealedMeta string            `json:"sealed_meta,omitempty"` // Meta encrypted under the repository key; signed instead of Meta
+	SignerPub  string            `json:"signer_pub"`            // for authenticity
+	RepoID     string            `json:"repo_id,omitempty"`
+	Errors     []FileError       `json:"errors,omitempty"` // files left out because they could not be read
+	Signature  string            `json:"signature"`
+
+	// SchemaVersion describes the stored record and is not signed
+	SchemaVersion int `json:"schema_version,omitempty"`
+	// ChunkEncoding is how Chunks is encoded in JSON; see MarshalJSON
+	ChunkEncoding string `json:"-"`
+}
+
+// FileError is a file or directory a snapshot left out.
+type FileError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// Source returns the backed-up path recorded in the snapshot metadata, in
+// the NFC form of fspath.Key.
+func (s *Snapshot) Source() string {
+	return s.Meta["source"]
+}
+
+// OriginalSource returns the backed-up path as the filesystem spelled it,
+// which differs from Source for NFD or non-UTF-8 names.
+func (s *Snapshot) OriginalSource() string {
+	if enc := s.Meta["source_original"]; enc != "" {
+		if p, err := fspath.DecodeOriginal(enc); err == nil {
+			return p
+		}
+	}
+	return s.Source()
+}
+
+// Host returns the hostname of the machine that took the snapshot, empty for
+// snapshots that predate the record.
+func (s *Snapshot) Host() string {
+	return s.Meta["host"]
+}
+
+// Tags returns the tags the snapshot was taken with.
+func (s *Snapshot) Tags() []string {
+	if s.Meta["tags"] == "" {
+		return nil
+	}
+	return strings.Split(s.Meta["tags"], ",")
+}
+
+// SetTags records tags, which CheckTag accepts, in the snapshot metadata.
+func (s *Snapshot) SetTags(tags []string) {
+	if len(tags) == 0 {
+		return
+	}
+	if s.Meta == nil {
+		s.Meta = make(map[string]string)
+	}
+	sorted := append([]string(nil), tags...)
+	sort.Strings(sorted)
+	unique := sorted[:1]
+	for _, t := range sorted[1:] {
+		if t != unique[len(unique)-1] {
+			unique = append(unique, t)
+		}
+	}
+	s.Meta["tags"] = strings.Join(unique, ",")
+}
+
+// CheckTag reports whether tag can label a snapshot: letters, digits and
+// the characters - _ . : /, at most 64 of them.
+func CheckTag(tag string) error {
+	if tag == "" || len(tag) > 64 {
+		return fmt.Errorf("invalid tag %q: must be 1 to 64 characters", tag)
+	}
+	for _, r := range tag {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("-_.:/", r) {
+			return fmt.Errorf("invalid tag %q: only letters, digits and - _ . : / are allowed", tag)
+		}
+	}
+	return nil
+}
+
+// Chunker returns the chunking algorithm and sizes the snapshot's files were
+// split with, empty for snapshots that predate the record. Restores do not
+// need it: chunks are concatenated whatever cut them.
+func (s *Snapshot) Chunker() string {
+	return s.Meta["chunker"]
+}
+
+const (
+	// MetadataSource is the source of snapshots whose chunks are an encrypted
+	// export of the repository metadata rather than backed-up files
+	MetadataSource = "shadowvault:metadata"
+	// LatestMetadataID asks a pull for the newest metadata export of a repository
+	LatestMetadataID = "metadata:latest"
+)
+
+// IsMetadata reports whether snap is a metadata export.
+func (s *Snapshot) IsMetadata() bool {
+	return s.Source() == MetadataSource
+}
+
+// LatestMetadata returns the newest metadata export of repoID.
+func LatestMetadata(db *persistence.DB, repoID string) (*Snapshot, error) {
+	var latest *Snapshot
+	err := ForEachSnapshotByTime(db, MetadataSource, func(snap *Snapshot) error {
+		if snap.RepoID == repoID {
+			latest = snap
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if latest == nil {
+		return nil, ErrSnapshotNotFound
+	}
+	return latest, nil
 }
 
 func SaveSnapshot(db *persistence.DB, snap *Snapshot) error {
 	return db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(persistence.BucketSnapshots))
+		// Drop the index entries of a record being replaced
+		if old := b.Get([]byte(snap.ID)); old != nil {
+			var prev Snapshot
+			if err := json.Unmarshal(old, &prev); err == nil {
+				if err := unindexSnapshot(tx, &prev); err != nil {
+					return err
+				}
+				if err := chunkindex.AddRefs(tx, prev.Chunks, -1); err != nil {
+					return err
+				}
+			}
+		}
+		snap.SchemaVersion = CurrentSchemaVersion
 		data, err := json.Marshal(snap)
 		if err != nil {
 			return err
 		}
-		return b.Put([]byte(snap.ID), data)
+		if err := b.Put([]byte(snap.ID), data); err != nil {
+			return err
+		}
+		if err := chunkindex.AddRefs(tx, snap.Chunks, 1); err != nil {
+			return err
+		}
+		return indexSnapshot(tx, snap)
 	})
 }
 
@@ -45,7 +190,40 @@ func LoadSnapshot(db *persistence.DB, id string) (*Snapshot, error) {
 	return &snap, nil
 }
 
-var ErrSnapshotNotFound = errors.New("snapshot not found")
+// ParentChain returns snap followed by its parent, grandparent and so on, as
+// far as they are stored.
+func ParentChain(db *persistence.DB, snap *Snapshot) ([]*Snapshot, error) {
+	chain := []*Snapshot{snap}
+	seen := map[string]bool{snap.ID: true}
+	for cur := snap; cur.Parent != "" && !seen[cur.Parent]; {
+		parent, err := LoadSnapshot(db, cur.Parent)
+		if errors.Is(err, ErrSnapshotNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		seen[parent.ID] = true
+		chain = append(chain, parent)
+		cur = parent
+	}
+	return chain, nil
+}
+
+var (
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	ErrForeignSnapshot  = errors.New("snapshot belongs to a different repository")
+)
+
+// CheckRepository returns ErrForeignSnapshot unless snap belongs to repoID.
+// Snapshots created before repository IDs carry none and are accepted.
+func CheckRepository(snap *Snapshot, repoID string) error {
+	if snap.RepoID != "" && snap.RepoID != repoID {
+		return fmt.Errorf("%w: %s is from %s, this repository is %s",
+			ErrForeignSnapshot, snap.ID, snap.RepoID, repoID)
+	}
+	return nil
+}
 
 // ListAllSnapshots returns all snapshots in the database
 func ListAllSnapshots(db *persistence.DB) ([]*Snapshot, error) {
@@ -64,10 +242,25 @@ func ListAllSnapshots(db *persistence.DB) ([]*Snapshot, error) {
 	return snapshots, err
 }
 
-// DeleteSnapshot removes a snapshot from the database
+// DeleteSnapshot removes a snapshot from the database. A held snapshot is
+// kept and ErrSnapshotHeld returned.
 func DeleteSnapshot(db *persistence.DB, id string) error {
 	return db.Update(func(tx *bolt.Tx) error {
+		if isHeld(tx, id) {
+			return fmt.Errorf("%w: %s", ErrSnapshotHeld, id)
+		}
 		b := tx.Bucket([]byte(persistence.BucketSnapshots))
+		if v := b.Get([]byte(id)); v != nil {
+			var snap Snapshot
+			if err := json.Unmarshal(v, &snap); err == nil {
+				if err := unindexSnapshot(tx, &snap); err != nil {
+					return err
+				}
+				if err := chunkindex.AddRefs(tx, snap.Chunks, -1); err != nil {
+					return err
+				}
+			}
+		}
 		return b.Delete([]byte(id))
 	})
 }
@@ -0,0 +1,199 @@
+//go:build integration && chaos
+// +build integration,chaos
+
+package tests
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hoangsonww/backupagent/config"
+	"github.com/hoangsonww/backupagent/internal/agent"
+	"github.com/hoangsonww/backupagent/internal/chaos"
+	"github.com/hoangsonww/backupagent/internal/monitoring"
+	"github.com/hoangsonww/backupagent/internal/verification"
+	"github.com/hoangsonww/backupagent/internal/versioning"
+)
+
+// newChaosAgent starts an agent injecting faults, none when empty
+func newChaosAgent(t *testing.T, port int, durability, faults string) *agent.Agent {
+	t.Helper()
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "config.yaml")
+	cfg := fmt.Sprintf(`repository_path: %s
+listen_port: %d
+snapshot:
+  min_chunk_size: 2048
+  max_chunk_size: 65536
+  avg_chunk_size: 8192
+storage:
+  durability: %s
+`, filepath.Join(dir, "repo"), port, durability)
+	if err := os.WriteFile(cfgPath, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := config.Load(cfgPath)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	monitoring.SetGlobalLogger(monitoring.NewLogger("debug", "text"))
+	monitoring.InitHealthChecker("test")
+
+	t.Setenv(chaos.EnvVar, faults)
+	a, err := agent.New(c, "test-passphrase")
+	if err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+// writeRandomData writes size random bytes to a file of a new directory
+func writeRandomData(t *testing.T, size int) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "random.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// verifySnapshot checks every chunk of snap and returns the result
+func verifySnapshot(t *testing.T, a *agent.Agent, snap *versioning.Snapshot) *verification.VerificationResult {
+	t.Helper()
+	res, err := a.VerifyLocal(context.Background(), []string{snap.ID}, verification.PassOptions{})
+	if err != nil {
+		t.Fatalf("Failed to verify snapshot: %v", err)
+	}
+	if len(res.Snapshots) != 1 {
+		t.Fatalf("Verified %d snapshots, want 1", len(res.Snapshots))
+	}
+	return res.Snapshots[0]
+}
+
+func TestChaosInterruptedWrites(t *testing.T) {
+	a := newChaosAgent(t, 19100, "sync", "fail_writes=2")
+	dataPath := writeRandomData(t, 256<<10)
+
+	// Each interrupted write fails its snapshot and leaves nothing behind,
+	// so a retry stores everything
+	for attempt := 1; attempt <= 2; attempt++ {
+		if _, err := a.CreateAndSaveSnapshot(context.Background(), dataPath); !errors.Is(err, chaos.ErrInjected) {
+			t.Fatalf("Attempt %d: want an injected failure, got %v", attempt, err)
+		}
+	}
+	snap, err := a.CreateAndSaveSnapshot(context.Background(), dataPath)
+	if err != nil {
+		t.Fatalf("Failed to create snapshot: %v", err)
+	}
+	if res := verifySnapshot(t, a, snap); !res.Success {
+		t.Fatalf("Snapshot damaged: %d missing, %d corrupted",
+			len(res.MissingChunks), len(res.CorruptedChunks))
+	}
+}
+
+func TestChaosInterruptedWALApply(t *testing.T) {
+	before := chaos.Totals().FailedWrites
+	a := newChaosAgent(t, 19101, "wal", "fail_writes=2")
+	dataPath := writeRandomData(t, 256<<10)
+
+	// Staged chunks are indexed in the background, which retries
+	// interrupted transactions until they go through
+	snap, err := a.CreateAndSaveSnapshot(context.Background(), dataPath)
+	if err != nil {
+		t.Fatalf("Failed to create snapshot: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for chaos.Totals().FailedWrites-before < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Staged chunks were not indexed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := a.Store.Close(); err != nil {
+		t.Fatalf("Failed to index staged chunks: %v", err)
+	}
+	if res := verifySnapshot(t, a, snap); !res.Success {
+		t.Fatalf("Snapshot damaged: %d missing, %d corrupted",
+			len(res.MissingChunks), len(res.CorruptedChunks))
+	}
+}
+
+func TestChaosCorruptedChunks(t *testing.T) {
+	a := newChaosAgent(t, 19110, "sync", "corrupt=3")
+	dataPath := writeRandomData(t, 1<<20)
+
+	snap, err := a.CreateAndSaveSnapshot(context.Background(), dataPath)
+	if err != nil {
+		t.Fatalf("Failed to create snapshot: %v", err)
+	}
+
+	// Damaged chunks are caught by verification and fail a restore
+	res := verifySnapshot(t, a, snap)
+	if len(res.CorruptedChunks) != 3 || res.Success {
+		t.Fatalf("Verification found %d corrupted chunks, want 3", len(res.CorruptedChunks))
+	}
+	if _, err := a.RestoreSnapshot(context.Background(), snap, t.TempDir(), nil, nil, nil); err == nil {
+		t.Fatal("Restore of a corrupted snapshot succeeded")
+	}
+
+	// Dropping them and backing up the unchanged source again stores them
+	// anew, which repairs the first snapshot too
+	for _, h := range res.CorruptedChunks {
+		if err := a.Store.Delete(h); err != nil {
+			t.Fatalf("Failed to delete corrupted chunk: %v", err)
+		}
+	}
+	again, err := a.CreateAndSaveSnapshot(context.Background(), dataPath)
+	if err != nil {
+		t.Fatalf("Failed to create snapshot: %v", err)
+	}
+	for _, s := range []*versioning.Snapshot{snap, again} {
+		if res := verifySnapshot(t, a, s); !res.Success {
+			t.Fatalf("Snapshot %s still damaged: %d missing, %d corrupted",
+				s.ID, len(res.MissingChunks), len(res.CorruptedChunks))
+		}
+	}
+}
+
+func TestChaosSlowLossyPush(t *testing.T) {
+	receiver := newChaosAgent(t, 19121, "sync", "")
+	sender := newChaosAgent(t, 19120, "sync", "delay=100ms,drop=0.5")
+	receiver.AllowImport(sender.RepoID)
+
+	snap, err := sender.CreateAndSaveSnapshot(context.Background(), writeRandomData(t, 512<<10))
+	if err != nil {
+		t.Fatalf("Failed to create snapshot: %v", err)
+	}
+	to := fmt.Sprintf("/ip4/127.0.0.1/tcp/%d/p2p/%s", 19121, receiver.P2P.Host.ID())
+	res, err := sender.PushSnapshot(context.Background(), snap.ID, to, nil)
+	if err != nil {
+		t.Fatalf("Push failed: %v", err)
+	}
+	t.Logf("Pushed %d of %d chunks in %s", res.Missing, res.Total, res.Duration)
+
+	missing, err := receiver.Store.Missing(snap.Chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 {
+		t.Fatalf("Receiver lacks %d of %d chunks", len(missing), len(snap.Chunks))
+	}
+	if chaos.Totals().Delayed == 0 {
+		t.Fatal("No stream was delayed")
+	}
+}
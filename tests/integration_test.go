@@ -62,7 +62,7 @@ func TestEndToEndBackupRestore(t *testing.T) {
 	defer agent.DB.Close()
 
 	// Create snapshot
-	if err := agent.CreateAndSaveSnapshot(dataPath); err != nil {
+	if _, err := agent.CreateAndSaveSnapshot(context.Background(), dataPath); err != nil {
 		t.Fatalf("Failed to create snapshot: %v", err)
 	}
 
@@ -134,7 +134,7 @@ func TestMultipleSnapshotsWithGC(t *testing.T) {
 			t.Fatalf("Failed to write test file: %v", err)
 		}
 
-		if err := agent.CreateAndSaveSnapshot(dataPath); err != nil {
+		if _, err := agent.CreateAndSaveSnapshot(context.Background(), dataPath); err != nil {
 			t.Fatalf("Failed to create snapshot %d: %v", i, err)
 		}
 
@@ -206,7 +206,8 @@ func TestConcurrentBackups(t *testing.T) {
 	errChan := make(chan error, numConcurrent)
 	for i := 0; i < numConcurrent; i++ {
 		go func(path string) {
-			errChan <- agent.CreateAndSaveSnapshot(path)
+			_, err := agent.CreateAndSaveSnapshot(context.Background(), path)
+			errChan <- err
 		}(dataPaths[i])
 	}
 